@@ -0,0 +1,29 @@
+package banman
+
+import "sync/atomic"
+
+// Enforcement is whether the bans recorded in a Store are enforced. While
+// paused, bans are still recorded along with their reasons, but banned IP
+// networks are no longer kept from connecting. This is useful to tell
+// whether bans are starving us of peers, or to ride out a known bug in
+// some peer software. The zero value enforces bans, and it is safe for
+// concurrent use.
+type Enforcement struct {
+	// notEnforced is non-zero while ban enforcement is paused. It must
+	// be accessed atomically.
+	notEnforced int32
+}
+
+// Set pauses or resumes the enforcement of bans.
+func (e *Enforcement) Set(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&e.notEnforced, v)
+}
+
+// Enforced returns whether bans are currently being enforced.
+func (e *Enforcement) Enforced() bool {
+	return atomic.LoadInt32(&e.notEnforced) == 0
+}
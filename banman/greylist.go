@@ -0,0 +1,169 @@
+package banman
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Greylist keeps track of peers that have misbehaved, but not yet badly
+// enough to be banned. A single offense may be down to a buggy peer or a
+// protocol mismatch rather than malice, so greylisted peers remain
+// connected, though callers should prefer other peers over them. A peer is
+// promoted to a ban once it reaches the maximum number of offenses, while a
+// peer that goes long enough without offending is forgiven and removed
+// from the greylist. With a half-life, each offense counts for less as time
+// goes on, so a peer that offends rarely never reaches a ban.
+type Greylist struct {
+	maxOffenses  int
+	forgiveAfter time.Duration
+	halfLife     time.Duration
+
+	// now returns the current time. It can be overridden in tests.
+	now func() time.Time
+
+	mtx   sync.Mutex
+	peers map[string]*greylistEntry
+}
+
+// greylistEntry records the offenses of a greylisted peer.
+type greylistEntry struct {
+	// score is the number of offenses as of the last one, which decays
+	// from then on if the greylist has a half-life.
+	score float64
+
+	reason      Reason
+	lastOffense time.Time
+}
+
+// scoreAt returns the score of the entry at the given time, halved for
+// every half-life that has passed since the last offense.
+func (e *greylistEntry) scoreAt(now time.Time,
+	halfLife time.Duration) float64 {
+
+	if halfLife <= 0 || !now.After(e.lastOffense) {
+		return e.score
+	}
+
+	halfLives := float64(now.Sub(e.lastOffense)) / float64(halfLife)
+	return e.score * math.Exp2(-halfLives)
+}
+
+// NewGreylist returns an empty greylist that promotes a peer to a ban on its
+// given number of offenses, and forgives a peer once the given duration has
+// passed since its last offense. If forgiveAfter is zero, peers are never
+// forgiven.
+func NewGreylist(maxOffenses int, forgiveAfter time.Duration) *Greylist {
+	if maxOffenses < 1 {
+		maxOffenses = 1
+	}
+
+	return &Greylist{
+		maxOffenses:  maxOffenses,
+		forgiveAfter: forgiveAfter,
+		now:          time.Now,
+		peers:        make(map[string]*greylistEntry),
+	}
+}
+
+// NewDecayingGreylist returns an empty greylist that promotes a peer to a
+// ban once its score reaches the given number of offenses. Each offense
+// adds one to the score, which halves with every half-life that passes, and
+// a peer is forgiven once its score has decayed to half an offense. A
+// peer that had one bad day is then not penalized forever.
+func NewDecayingGreylist(maxOffenses int, halfLife time.Duration) *Greylist {
+	g := NewGreylist(maxOffenses, 0)
+	g.halfLife = halfLife
+	return g
+}
+
+// Offend records an offense by the peer for the given reason, greylisting
+// it. It returns true once the peer has reached the maximum number of
+// offenses and should be banned, at which point it is removed from the
+// greylist.
+func (g *Greylist) Offend(peer string, reason Reason) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := g.now()
+	entry := g.entry(peer)
+	if entry == nil {
+		entry = &greylistEntry{}
+		g.peers[peer] = entry
+	}
+	entry.score = entry.scoreAt(now, g.halfLife) + 1
+	entry.reason = reason
+	entry.lastOffense = now
+
+	if entry.score < float64(g.maxOffenses) {
+		return false
+	}
+
+	// The peer is about to be banned, so it starts over with a clean
+	// slate for whenever the ban expires.
+	delete(g.peers, peer)
+	return true
+}
+
+// IsGreylisted returns whether the peer is currently greylisted.
+func (g *Greylist) IsGreylisted(peer string) bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	return g.entry(peer) != nil
+}
+
+// Status returns the number of offenses recorded against the peer since it
+// was last forgiven, along with the reason for the latest one. The number
+// of offenses is zero if the peer isn't greylisted, and is the decayed
+// score rounded down if the greylist has a half-life.
+func (g *Greylist) Status(peer string) (int, Reason) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	entry := g.entry(peer)
+	if entry == nil {
+		return 0, 0
+	}
+	return int(entry.scoreAt(g.now(), g.halfLife)), entry.reason
+}
+
+// Score returns the score of the peer, which is its number of offenses
+// since it was last forgiven, decayed if the greylist has a half-life. It
+// is zero if the peer isn't greylisted.
+func (g *Greylist) Score(peer string) float64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	entry := g.entry(peer)
+	if entry == nil {
+		return 0
+	}
+	return entry.scoreAt(g.now(), g.halfLife)
+}
+
+// entry returns the greylist entry for the peer, or nil if it isn't
+// greylisted. A peer that has gone long enough without offending, or whose
+// score has decayed to half an offense, is forgiven, removing its entry.
+//
+// NOTE: This method must be called with the mutex held.
+func (g *Greylist) entry(peer string) *greylistEntry {
+	entry, ok := g.peers[peer]
+	if !ok {
+		return nil
+	}
+
+	if g.forgiveAfter > 0 &&
+		g.now().Sub(entry.lastOffense) >= g.forgiveAfter {
+
+		delete(g.peers, peer)
+		return nil
+	}
+
+	if entry.scoreAt(g.now(), g.halfLife) <= 0.5 {
+		delete(g.peers, peer)
+		return nil
+	}
+
+	return entry
+}
@@ -0,0 +1,156 @@
+package banman
+
+import (
+	"testing"
+	"time"
+)
+
+// TestGreylistPromotion ensures that a peer is greylisted on its first
+// offenses, and promoted to a ban once it reaches the maximum number of
+// offenses.
+func TestGreylistPromotion(t *testing.T) {
+	t.Parallel()
+
+	const maxOffenses = 3
+	g := NewGreylist(maxOffenses, time.Hour)
+
+	for i := 1; i < maxOffenses; i++ {
+		if g.Offend("a", InvalidMwebUtxos) {
+			t.Fatalf("peer banned on offense %v", i)
+		}
+		if !g.IsGreylisted("a") {
+			t.Fatalf("peer not greylisted on offense %v", i)
+		}
+		offenses, reason := g.Status("a")
+		if offenses != i || reason != InvalidMwebUtxos {
+			t.Fatalf("expected %v offenses for %v, got %v for %v",
+				i, InvalidMwebUtxos, offenses, reason)
+		}
+	}
+
+	// Offenses by other peers don't count against the first.
+	if g.Offend("b", InvalidMwebHeader) {
+		t.Fatal("other peer banned on first offense")
+	}
+	if g.IsGreylisted("c") {
+		t.Fatal("peer greylisted without offending")
+	}
+
+	if !g.Offend("a", InvalidMwebHeader) {
+		t.Fatalf("peer not banned on offense %v", maxOffenses)
+	}
+
+	// Once promoted to a ban, the peer leaves the greylist and starts
+	// over with a clean slate.
+	if g.IsGreylisted("a") {
+		t.Fatal("banned peer still greylisted")
+	}
+	if offenses, _ := g.Status("a"); offenses != 0 {
+		t.Fatalf("expected no offenses, got %v", offenses)
+	}
+	if g.Offend("a", InvalidMwebUtxos) {
+		t.Fatal("peer banned again on first offense after ban")
+	}
+	if !g.IsGreylisted("b") {
+		t.Fatal("other peer no longer greylisted")
+	}
+}
+
+// TestGreylistForgiveness ensures that a peer is removed from the greylist
+// once it has gone long enough without offending, and that offenses before
+// then don't count towards a ban.
+func TestGreylistForgiveness(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	g := NewGreylist(2, time.Hour)
+	g.now = func() time.Time {
+		return now
+	}
+
+	if g.Offend("a", InvalidMwebUtxos) {
+		t.Fatal("peer banned on first offense")
+	}
+
+	now = now.Add(time.Hour - time.Second)
+	if !g.IsGreylisted("a") {
+		t.Fatal("peer forgiven too early")
+	}
+
+	now = now.Add(time.Second)
+	if g.IsGreylisted("a") {
+		t.Fatal("peer not forgiven after good behavior")
+	}
+
+	// The forgiven offense no longer counts towards a ban.
+	if g.Offend("a", InvalidMwebUtxos) {
+		t.Fatal("forgiven peer banned on its next offense")
+	}
+	now = now.Add(time.Minute)
+	if !g.Offend("a", InvalidMwebUtxos) {
+		t.Fatal("peer not banned on repeated offense")
+	}
+
+	// Without a forgiveness period, peers are never forgiven.
+	g = NewGreylist(2, 0)
+	g.now = func() time.Time {
+		return now
+	}
+	g.Offend("b", InvalidMwebUtxos)
+	now = now.Add(24 * 365 * time.Hour)
+	if !g.IsGreylisted("b") {
+		t.Fatal("peer forgiven without a forgiveness period")
+	}
+}
+
+// TestGreylistDecay ensures that with a half-life, the score of a peer
+// decays over time, so that offenses spread out enough never reach a ban,
+// and the peer is forgiven once its score decays to half an offense.
+func TestGreylistDecay(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000, 0)
+	g := NewDecayingGreylist(3, time.Hour)
+	g.now = func() time.Time {
+		return now
+	}
+
+	g.Offend("a", InvalidMwebUtxos)
+	g.Offend("a", InvalidMwebUtxos)
+	if score := g.Score("a"); score != 2 {
+		t.Fatalf("expected score of 2, got %v", score)
+	}
+
+	// After a half-life, the score has halved, so the next offense
+	// leaves the peer below the threshold.
+	now = now.Add(time.Hour)
+	if score := g.Score("a"); score != 1 {
+		t.Fatalf("expected score of 1, got %v", score)
+	}
+	if g.Offend("a", InvalidMwebUtxos) {
+		t.Fatal("peer banned despite its score decaying")
+	}
+	if offenses, _ := g.Status("a"); offenses != 2 {
+		t.Fatalf("expected 2 offenses, got %v", offenses)
+	}
+
+	// Another offense right away reaches the threshold.
+	if !g.Offend("a", InvalidMwebUtxos) {
+		t.Fatal("peer not banned on reaching the threshold")
+	}
+
+	// A peer that stops offending is forgiven once its score decays to
+	// half an offense.
+	g.Offend("b", InvalidMwebHeader)
+	now = now.Add(time.Hour - time.Second)
+	if !g.IsGreylisted("b") {
+		t.Fatal("peer forgiven too early")
+	}
+	now = now.Add(time.Second)
+	if g.IsGreylisted("b") {
+		t.Fatal("peer not forgiven after its score decayed")
+	}
+	if score := g.Score("b"); score != 0 {
+		t.Fatalf("expected no score, got %v", score)
+	}
+}
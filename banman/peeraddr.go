@@ -0,0 +1,108 @@
+package banman
+
+import (
+	"encoding/base32"
+	"net"
+	"strings"
+)
+
+// onionCatPrefix is the IPv6 prefix that OnionCat maps onion services into.
+// An onion service's address is the prefix followed by the first ten bytes
+// of its decoded name.
+var onionCatPrefix = []byte{0xfd, 0x87, 0xd8, 0x7e, 0xeb, 0x43}
+
+// onionEncoding is the base32 encoding of onion service names.
+var onionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// PeerAddr is a peer address parsed into its parts, with its host
+// normalized so that the different ways of writing the same address are
+// banned as one.
+type PeerAddr struct {
+	// Host is the normalized host, which is either an IP address in its
+	// shortest form, with IPv4-mapped IPv6 addresses written as IPv4, or
+	// a lowercased onion address.
+	Host string
+
+	// Port is the port of the address, or empty if it had none.
+	Port string
+
+	// IP is the IP address of the host, which is 4 bytes long for IPv4.
+	// For an onion address, it's the IPv6 address that OnionCat maps
+	// the onion service to. For v3 onion services, which are too long
+	// to map in full, the first ten bytes of the public key are used.
+	IP net.IP
+}
+
+// ParsePeerAddr parses the peer address, which may have a port. IPv6
+// addresses may be bracketed with or without a port, and any zone is
+// dropped. ErrUnsupportedIP is returned if the host is neither an IP nor an
+// onion address.
+//
+// NOTE: This assumes that the address has already been resolved.
+func ParsePeerAddr(addr string) (*PeerAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Address doesn't include a port.
+		host, port = addr, ""
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	if strings.HasSuffix(strings.ToLower(host), ".onion") {
+		return parseOnionAddr(strings.ToLower(host), port)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrUnsupportedIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return &PeerAddr{Host: ip.String(), Port: port, IP: ip}, nil
+}
+
+// parseOnionAddr parses the lowercased onion host into a PeerAddr.
+func parseOnionAddr(host, port string) (*PeerAddr, error) {
+	name := strings.TrimSuffix(host, ".onion")
+	decoded, err := onionEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || len(decoded) < net.IPv6len-len(onionCatPrefix) {
+		return nil, ErrUnsupportedIP
+	}
+
+	ip := make(net.IP, 0, net.IPv6len)
+	ip = append(ip, onionCatPrefix...)
+	ip = append(ip, decoded[:net.IPv6len-len(onionCatPrefix)]...)
+
+	return &PeerAddr{Host: host, Port: port, IP: ip}, nil
+}
+
+// IsOnion returns whether the address is of an onion service.
+func (a *PeerAddr) IsOnion() bool {
+	return strings.HasSuffix(a.Host, ".onion")
+}
+
+// IPNet returns the IP network containing the address. An optional mask can
+// be provided, to expand the scope of the IP network, otherwise the IP's
+// default is used.
+func (a *PeerAddr) IPNet(mask net.IPMask) *net.IPNet {
+	if mask == nil {
+		mask = defaultIPv6Mask
+		if len(a.IP) == net.IPv4len {
+			mask = defaultIPv4Mask
+		}
+	}
+
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}
+}
+
+// String returns the normalized address, with its port if it had one.
+func (a *PeerAddr) String() string {
+	if a.Port == "" {
+		return a.Host
+	}
+	return net.JoinHostPort(a.Host, a.Port)
+}
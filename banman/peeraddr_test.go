@@ -0,0 +1,129 @@
+package banman
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// TestParsePeerAddr ensures that the different ways of writing the same
+// peer address are normalized to the same address and IP network.
+func TestParsePeerAddr(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name  string
+		addr  string
+		host  string
+		port  string
+		ipNet *net.IPNet
+		err   error
+	}{
+		{
+			name: "ipv4 with port",
+			addr: "10.0.0.1:9333",
+			host: "10.0.0.1",
+			port: "9333",
+			ipNet: &net.IPNet{
+				IP:   net.ParseIP("10.0.0.1").To4(),
+				Mask: defaultIPv4Mask,
+			},
+		},
+		{
+			name: "ipv4-mapped ipv6 with port",
+			addr: "[::ffff:10.0.0.1]:9333",
+			host: "10.0.0.1",
+			port: "9333",
+			ipNet: &net.IPNet{
+				IP:   net.ParseIP("10.0.0.1").To4(),
+				Mask: defaultIPv4Mask,
+			},
+		},
+		{
+			name: "ipv6 with port",
+			addr: "[2001:DB8:0::1]:9333",
+			host: "2001:db8::1",
+			port: "9333",
+			ipNet: &net.IPNet{
+				IP:   net.ParseIP("2001:db8::1"),
+				Mask: defaultIPv6Mask,
+			},
+		},
+		{
+			name: "bracketed ipv6 with zone",
+			addr: "[fe80::1%eth0]",
+			host: "fe80::1",
+			ipNet: &net.IPNet{
+				IP:   net.ParseIP("fe80::1"),
+				Mask: defaultIPv6Mask,
+			},
+		},
+		{
+			name: "v2 onion with port",
+			addr: "EXPYUZZ4WQQYQHJN.onion:9333",
+			host: "expyuzz4wqqyqhjn.onion",
+			port: "9333",
+			ipNet: &net.IPNet{
+				IP: net.ParseIP(
+					"fd87:d87e:eb43:25df:" +
+						"8a67:3cb4:2188:1d2d",
+				),
+				Mask: defaultIPv6Mask,
+			},
+		},
+		{
+			name: "v3 onion",
+			addr: "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4" +
+				"xyclen53wid.onion",
+			host: "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4" +
+				"xyclen53wid.onion",
+			ipNet: &net.IPNet{
+				IP: net.ParseIP(
+					"fd87:d87e:eb43:d1b3:" +
+						"8b83:a83b:3ed9:18c5",
+				),
+				Mask: defaultIPv6Mask,
+			},
+		},
+		{
+			name: "bad onion",
+			addr: "not-base32!.onion:9333",
+			err:  ErrUnsupportedIP,
+		},
+		{
+			name: "hostname",
+			addr: "example.com:9333",
+			err:  ErrUnsupportedIP,
+		},
+	}
+
+	for _, testCase := range testCases {
+		peerAddr, err := ParsePeerAddr(testCase.addr)
+		if err != testCase.err {
+			t.Fatalf("%s: expected error %v, got %v", testCase.name,
+				testCase.err, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if peerAddr.Host != testCase.host {
+			t.Fatalf("%s: expected host %v, got %v", testCase.name,
+				testCase.host, peerAddr.Host)
+		}
+		if peerAddr.Port != testCase.port {
+			t.Fatalf("%s: expected port %v, got %v", testCase.name,
+				testCase.port, peerAddr.Port)
+		}
+		if peerAddr.IsOnion() != (peerAddr.IP[0] == 0xfd) {
+			t.Fatalf("%s: unexpected onion address %v",
+				testCase.name, peerAddr)
+		}
+
+		ipNet := peerAddr.IPNet(nil)
+		if !reflect.DeepEqual(ipNet, testCase.ipNet) {
+			t.Fatalf("%s: expected IP network %v, got %v",
+				testCase.name, testCase.ipNet, ipNet)
+		}
+	}
+}
@@ -31,6 +31,10 @@ const (
 	// InvalidMwebUtxos signals that a peer served us an invalid
 	// mweb utxos message.
 	InvalidMwebUtxos Reason = 21
+
+	// InvalidMwebKernels signals that a peer served us a block whose
+	// mweb kernels don't match the kernel root of its mweb header.
+	InvalidMwebKernels Reason = 22
 )
 
 // String returns a human-readable description for the reason a peer was banned.
@@ -57,7 +61,34 @@ func (r Reason) String() string {
 	case InvalidMwebUtxos:
 		return "peer served invalid mweb utxos message"
 
+	case InvalidMwebKernels:
+		return "peer served invalid mweb kernels"
+
 	default:
 		return "unknown reason"
 	}
 }
+
+// Severity ranks how strongly the reason points to a malicious peer, from
+// zero for a peer that merely misbehaved. When bans have to be lifted to
+// make room for others, those of the lowest severity go first.
+func (r Reason) Severity() int {
+	switch r {
+	case ExceededBanThreshold:
+		return 0
+
+	case NoCompactFilters:
+		return 1
+
+	case InvalidFilterHeader, InvalidFilterHeaderCheckpoint,
+		InvalidBlock:
+
+		return 2
+
+	case InvalidMwebHeader, InvalidMwebUtxos, InvalidMwebKernels:
+		return 3
+
+	default:
+		return 0
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/ltcsuite/ltcwallet/walletdb"
@@ -73,10 +74,30 @@ func NewStore(db walletdb.DB) (Store, error) {
 	return newBanStore(db)
 }
 
+// NewLimitedStore returns a Store backed by a database that holds at most
+// the given number of bans at once, so that a flood of bans can't cut us
+// off from the network. Once a new ban takes the store over the limit, the
+// ban of the lowest severity is lifted, the one closest to expiring first
+// among equals. This may be the new ban itself. A limit of zero means there
+// is no limit.
+func NewLimitedStore(db walletdb.DB, maxBans int) (Store, error) {
+	s, err := newBanStore(db)
+	if err != nil {
+		return nil, err
+	}
+	s.maxBans = maxBans
+
+	return s, nil
+}
+
 // banStore is a concrete implementation of the Store interface backed by a
 // database.
 type banStore struct {
 	db walletdb.DB
+
+	// maxBans is the maximum number of bans held at once, or zero if
+	// there is no limit.
+	maxBans int
 }
 
 // A compile-time constraint to ensure banStore satisfies the Store interface.
@@ -132,7 +153,17 @@ func (s *banStore) BanIPNet(ipNet *net.IPNet, reason Reason, duration time.Durat
 		}
 		k := ipNetBuf.Bytes()
 
-		return addBannedIPNet(banIndex, reasonIndex, k, reason, duration)
+		err := addBannedIPNet(
+			banIndex, reasonIndex, k, reason, duration,
+		)
+		if err != nil {
+			return err
+		}
+		if s.maxBans <= 0 {
+			return nil
+		}
+
+		return limitBannedIPNets(banIndex, reasonIndex, s.maxBans)
 	})
 }
 
@@ -150,6 +181,59 @@ func addBannedIPNet(banIndex, reasonIndex walletdb.ReadWriteBucket,
 	return reasonIndex.Put(ipNetKey, []byte{byte(reason)})
 }
 
+// limitBannedIPNets removes the expired bans from the ban store, followed by
+// as many of the others as it takes to get down to the given number of bans.
+// The bans of the lowest severity are removed first, and among those the
+// ones closest to expiring.
+func limitBannedIPNets(banIndex, reasonIndex walletdb.ReadWriteBucket,
+	maxBans int) error {
+
+	type ban struct {
+		ipNetKey []byte
+		status   Status
+	}
+
+	now := time.Now()
+	var bans, removed []ban
+	err := banIndex.ForEach(func(k, _ []byte) error {
+		b := ban{
+			ipNetKey: append([]byte(nil), k...),
+			status:   fetchStatus(banIndex, reasonIndex, k),
+		}
+		if !now.Before(b.status.Expiration) {
+			removed = append(removed, b)
+		} else {
+			bans = append(bans, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(bans) > maxBans {
+		sort.SliceStable(bans, func(i, j int) bool {
+			si := bans[i].status.Reason.Severity()
+			sj := bans[j].status.Reason.Severity()
+			if si != sj {
+				return si < sj
+			}
+			return bans[i].status.Expiration.Before(
+				bans[j].status.Expiration,
+			)
+		})
+		removed = append(removed, bans[:len(bans)-maxBans]...)
+	}
+
+	for _, b := range removed {
+		err := removeBannedIPNet(banIndex, reasonIndex, b.ipNetKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Status returns the ban status for a given IP network.
 func (s *banStore) Status(ipNet *net.IPNet) (Status, error) {
 	var banStatus Status
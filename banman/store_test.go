@@ -17,6 +17,16 @@ import (
 func createTestBanStore(t *testing.T) (banman.Store, func()) {
 	t.Helper()
 
+	return createTestLimitedBanStore(t, 0)
+}
+
+// createTestLimitedBanStore creates a test Store backed by a boltdb instance
+// that holds at most the given number of bans.
+func createTestLimitedBanStore(t *testing.T, maxBans int) (banman.Store,
+	func()) {
+
+	t.Helper()
+
 	dbDir, err := ioutil.TempDir("", "")
 	if err != nil {
 		t.Fatalf("unable to create db dir: %v", err)
@@ -34,7 +44,7 @@ func createTestBanStore(t *testing.T) (banman.Store, func()) {
 		os.RemoveAll(dbDir)
 	}
 
-	banStore, err := banman.NewStore(db)
+	banStore, err := banman.NewLimitedStore(db, maxBans)
 	if err != nil {
 		cleanUp()
 		t.Fatalf("unable to create ban store: %v", err)
@@ -124,3 +134,84 @@ func TestBanStore(t *testing.T) {
 	// to the BanStore. We should expect not to find anything regarding it.
 	checkBanStore(ipNet2, false, 0, 0)
 }
+
+// TestBanStoreLimit ensures that a limited BanStore lifts the bans of the
+// lowest severity, closest to expiring first, once it goes over its limit.
+func TestBanStoreLimit(t *testing.T) {
+	t.Parallel()
+
+	banStore, cleanUp := createTestLimitedBanStore(t, 3)
+	defer cleanUp()
+
+	ban := func(addr string, reason banman.Reason,
+		duration time.Duration) *net.IPNet {
+
+		t.Helper()
+
+		ipNet, err := banman.ParseIPNet(addr, nil)
+		if err != nil {
+			t.Fatalf("unable to parse IP network from %v: %v",
+				addr, err)
+		}
+		err = banStore.BanIPNet(ipNet, reason, duration)
+		if err != nil {
+			t.Fatalf("unable to ban IP network: %v", err)
+		}
+		return ipNet
+	}
+	checkBanned := func(ipNets map[*net.IPNet]bool) {
+		t.Helper()
+
+		for ipNet, banned := range ipNets {
+			banStatus, err := banStore.Status(ipNet)
+			if err != nil {
+				t.Fatalf("unable to determine %v's ban "+
+					"status: %v", ipNet, err)
+			}
+			if banStatus.Banned != banned {
+				t.Fatalf("expected %v banned=%v, got %v",
+					ipNet, banned, banStatus.Banned)
+			}
+		}
+	}
+
+	// The ban expiring the soonest stands in for the oldest one.
+	threshold1 := ban("10.0.0.1:9333", banman.ExceededBanThreshold,
+		time.Hour)
+	mweb1 := ban("10.0.0.2:9333", banman.InvalidMwebUtxos, time.Hour)
+	threshold2 := ban("10.0.0.3:9333", banman.ExceededBanThreshold,
+		2*time.Hour)
+	checkBanned(map[*net.IPNet]bool{
+		threshold1: true, mweb1: true, threshold2: true,
+	})
+
+	// Going over the limit lifts the oldest of the bans of the lowest
+	// severity.
+	mweb2 := ban("10.0.0.4:9333", banman.InvalidMwebHeader, time.Hour)
+	checkBanned(map[*net.IPNet]bool{
+		threshold1: false, mweb1: true, threshold2: true, mweb2: true,
+	})
+
+	// A ban of a higher severity than the threshold ban takes its
+	// place, however much longer it has left.
+	filters := ban("10.0.0.5:9333", banman.NoCompactFilters, time.Minute)
+	checkBanned(map[*net.IPNet]bool{
+		threshold2: false, mweb1: true, mweb2: true, filters: true,
+	})
+
+	// A new ban of the lowest severity is lifted right away.
+	threshold3 := ban("10.0.0.6:9333", banman.ExceededBanThreshold,
+		24*time.Hour)
+	checkBanned(map[*net.IPNet]bool{
+		threshold3: false, mweb1: true, mweb2: true, filters: true,
+	})
+
+	// Bans of the same severity as the new one make room for it in order
+	// of age.
+	mweb3 := ban("10.0.0.7:9333", banman.InvalidMwebUtxos, 3*time.Hour)
+	mweb4 := ban("10.0.0.8:9333", banman.InvalidMwebUtxos, 3*time.Hour)
+	checkBanned(map[*net.IPNet]bool{
+		filters: false, mweb1: false, mweb2: true, mweb3: true,
+		mweb4: true,
+	})
+}
@@ -18,31 +18,15 @@ var (
 
 // ParseIPNet parses the IP network that contains the given address. An optional
 // mask can be provided, to expand the scope of the IP network, otherwise the
-// IP's default is used.
+// IP's default is used. The address is normalized as ParsePeerAddr does, so
+// onion addresses are supported too.
 //
 // NOTE: This assumes that the address has already been resolved.
 func ParseIPNet(addr string, mask net.IPMask) (*net.IPNet, error) {
-	// If the address includes a port, we'll remove it.
-	host, _, err := net.SplitHostPort(addr)
+	peerAddr, err := ParsePeerAddr(addr)
 	if err != nil {
-		// Address doesn't include a port.
-		host = addr
+		return nil, err
 	}
 
-	// Parse the IP from the host to ensure it is supported.
-	ip := net.ParseIP(host)
-	switch {
-	case ip.To4() != nil:
-		if mask == nil {
-			mask = defaultIPv4Mask
-		}
-	case ip.To16() != nil:
-		if mask == nil {
-			mask = defaultIPv6Mask
-		}
-	default:
-		return nil, ErrUnsupportedIP
-	}
-
-	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+	return peerAddr.IPNet(mask), nil
 }
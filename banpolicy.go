@@ -0,0 +1,147 @@
+package neutrino
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/query"
+)
+
+// BanPolicy decides whether a peer that served us invalid mweb data should
+// be banned for it.
+type BanPolicy interface {
+	// ShouldBan is called each time the peer serves us invalid data for
+	// the given reason, and returns whether the peer should be banned.
+	// Implementations may keep track of each peer's past offenses.
+	ShouldBan(peer string, reason banman.Reason) bool
+}
+
+// banOnFirstOffense is the default BanPolicy, banning a peer as soon as it
+// serves us any invalid data.
+type banOnFirstOffense struct{}
+
+// A compile time check to ensure banOnFirstOffense satisfies the BanPolicy
+// interface.
+var _ BanPolicy = banOnFirstOffense{}
+
+// ShouldBan always returns true.
+//
+// NOTE: Part of the BanPolicy interface.
+func (banOnFirstOffense) ShouldBan(string, banman.Reason) bool {
+	return true
+}
+
+// banPeer bans the peer for the given reason, unless the BeforeBan hook
+// vetoes it. A vetoed ban isn't an error, as whatever the peer served is
+// thrown away all the same.
+func (b *blockManager) banPeer(addr string, reason banman.Reason) error {
+	if b.cfg.BeforeBan != nil && !b.cfg.BeforeBan(addr, reason) {
+		log.Infof("Not banning peer %v (%v), vetoed by BeforeBan",
+			addr, reason)
+		return nil
+	}
+
+	return b.cfg.BanPeer(addr, reason)
+}
+
+// strikesBanPolicy is a BanPolicy that only bans a peer once it has served
+// us invalid data a number of times.
+type strikesBanPolicy struct {
+	strikes int
+
+	mtx      sync.Mutex
+	offenses map[string]int
+}
+
+// A compile time check to ensure strikesBanPolicy satisfies the BanPolicy
+// interface.
+var _ BanPolicy = (*strikesBanPolicy)(nil)
+
+// NewStrikesBanPolicy returns a BanPolicy that bans a peer on its given
+// number of offenses, whatever their reasons. This tolerates peers that
+// occasionally serve stale data, at the cost of more wasted queries to
+// peers that are malicious.
+func NewStrikesBanPolicy(strikes int) BanPolicy {
+	if strikes < 1 {
+		strikes = 1
+	}
+
+	return &strikesBanPolicy{
+		strikes:  strikes,
+		offenses: make(map[string]int),
+	}
+}
+
+// ShouldBan records an offense by the peer, returning true once the peer has
+// run out of strikes.
+//
+// NOTE: Part of the BanPolicy interface.
+func (p *strikesBanPolicy) ShouldBan(peer string, _ banman.Reason) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.offenses[peer]++
+	if p.offenses[peer] < p.strikes {
+		return false
+	}
+
+	// The peer is about to be banned, so its slate is wiped clean for
+	// whenever the ban expires.
+	delete(p.offenses, peer)
+	return true
+}
+
+// greylistBanPolicy is a BanPolicy that greylists a peer on its first
+// offenses, only banning it once the greylist promotes it.
+type greylistBanPolicy struct {
+	greylist *banman.Greylist
+}
+
+// A compile time check to ensure greylistBanPolicy satisfies the BanPolicy
+// interface.
+var _ BanPolicy = (*greylistBanPolicy)(nil)
+
+// NewGreylistBanPolicy returns a BanPolicy that records each offense in the
+// given greylist, banning a peer once the greylist promotes it. While a peer
+// is greylisted, queries are given to other peers in preference to it.
+func NewGreylistBanPolicy(greylist *banman.Greylist) BanPolicy {
+	return &greylistBanPolicy{greylist: greylist}
+}
+
+// ShouldBan records an offense by the peer in the greylist, returning true
+// once the peer has been promoted to a ban.
+//
+// NOTE: Part of the BanPolicy interface.
+func (p *greylistBanPolicy) ShouldBan(peer string, reason banman.Reason) bool {
+	return p.greylist.Offend(peer, reason)
+}
+
+// greylistRanking is a query.PeerRanking that orders greylisted peers after
+// all others, keeping the order of the underlying ranking otherwise.
+type greylistRanking struct {
+	query.PeerRanking
+
+	greylist *banman.Greylist
+}
+
+// A compile time check to ensure greylistRanking satisfies the
+// query.PeerRanking interface.
+var _ query.PeerRanking = (*greylistRanking)(nil)
+
+// Order sorts the given slice of peers by their rank, with greylisted peers
+// last.
+//
+// NOTE: Part of the query.PeerRanking interface.
+func (r *greylistRanking) Order(peers []query.Peer) {
+	r.PeerRanking.Order(peers)
+
+	greylisted := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		greylisted[peer.Addr()] = r.greylist.IsGreylisted(peer.Addr())
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return !greylisted[peers[i].Addr()] &&
+			greylisted[peers[j].Addr()]
+	})
+}
@@ -0,0 +1,383 @@
+package neutrino
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/blockchain"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/peer"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStrikesBanPolicy tests that with a three strikes ban policy, a peer
+// serving invalid mweb utxos is only banned on its third offense.
+func TestStrikesBanPolicy(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	bm.cfg.BanPolicy = NewStrikesBanPolicy(3)
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// The mock utxos don't hash to the empty output root, so each
+	// response is an offense.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	)
+	q.leafset.Bits = []byte{0x80}
+	q.leafset.Size = 1
+	for i := 0; i < 2; i++ {
+		q.handleResponse(req, newMockMwebUtxos(req), "a")
+		require.Empty(t, banned)
+	}
+
+	// Offenses by other peers don't count against the first.
+	q.handleResponse(req, newMockMwebUtxos(req), "b")
+	require.Empty(t, banned)
+
+	q.handleResponse(req, newMockMwebUtxos(req), "a")
+	require.Equal(t, []string{"a"}, banned)
+
+	// Once banned, the peer starts over with a clean slate.
+	q.handleResponse(req, newMockMwebUtxos(req), "a")
+	require.Equal(t, []string{"a"}, banned)
+
+	// The default policy bans on the first offense.
+	bm.cfg.BanPolicy = nil
+	q.handleResponse(req, newMockMwebUtxos(req), "c")
+	require.Equal(t, []string{"a", "c"}, banned)
+}
+
+// TestBeforeBan tests that a peer serving invalid mweb utxos or headers, or
+// lacking the services we require, isn't banned if the BeforeBan hook
+// vetoes it, while the bans it allows go ahead, and that the invalid data is
+// rejected either way.
+func TestBeforeBan(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+
+	var asked, banned []string
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		banned = append(banned, addr)
+		return nil
+	}
+	bm.cfg.BeforeBan = func(addr string, _ banman.Reason) bool {
+		asked = append(asked, addr)
+		return addr != "trusted"
+	}
+
+	// The mock utxos don't hash to the empty output root.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	)
+	q.leafset.Bits = []byte{0x80}
+	q.leafset.Size = 1
+
+	p := q.handleResponse(req, newMockMwebUtxos(req), "trusted")
+	require.False(t, p.Progressed)
+	require.Equal(t, []string{"trusted"}, asked)
+	require.Empty(t, banned)
+
+	p = q.handleResponse(req, newMockMwebUtxos(req), "other")
+	require.False(t, p.Progressed)
+	require.Equal(t, []string{"trusted", "other"}, asked)
+	require.Equal(t, []string{"other"}, banned)
+
+	// The same goes for a header that fails verification.
+	header, mwebHeader, _ := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{Height: 1}, []byte{0x80},
+	)
+	mwebHeader.MwebHeader.Height = 2
+	blockHash := header.BlockHash()
+	hq := &mwebHeadersQuery{
+		blockMgr:    bm,
+		headersChan: make(chan *wire.MsgMwebHeader, 1),
+	}
+	for _, addr := range []string{"trusted", "other"} {
+		gdmsg := wire.NewMsgGetData()
+		gdmsg.AddInvVect(
+			wire.NewInvVect(wire.InvTypeMwebHeader, &blockHash),
+		)
+		p := hq.handleResponse(gdmsg, mwebHeader, addr)
+		require.False(t, p.Progressed)
+	}
+	require.Equal(t, []string{"trusted", "other", "trusted", "other"},
+		asked)
+	require.Equal(t, []string{"other", "other"}, banned)
+
+	// The same goes for a peer lacking the services we require.
+	s := &ChainService{
+		blockManager: bm,
+		timeSource:   blockchain.NewMedianTime(),
+	}
+	sp := NewServerPeer(s, false)
+	var err error
+	const peerAddr = "10.0.0.1:9333"
+	sp.Peer, err = peer.NewOutboundPeer(&peer.Config{}, peerAddr)
+	require.NoError(t, err)
+	sp.OnVersion(sp.Peer, &wire.MsgVersion{})
+	require.Equal(t, []string{"trusted", "other", "trusted", "other",
+		peerAddr}, asked)
+	require.Equal(t, []string{"other", "other", peerAddr}, banned)
+
+	// Without the hook, every ban goes ahead.
+	bm.cfg.BeforeBan = nil
+	q.handleResponse(req, newMockMwebUtxos(req), "trusted")
+	require.Equal(t, []string{"other", "other", peerAddr, "trusted"},
+		banned)
+}
+
+// TestGreylistBanPolicy tests that with a greylist ban policy, a peer
+// serving invalid mweb utxos is greylisted, and only banned once promoted
+// after repeated offenses.
+func TestGreylistBanPolicy(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	greylist := banman.NewGreylist(3, time.Hour)
+	bm.cfg.BanPolicy = NewGreylistBanPolicy(greylist)
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// The mock utxos don't hash to the empty output root, so each
+	// response is an offense.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	)
+	q.leafset.Bits = []byte{0x80}
+	q.leafset.Size = 1
+	for i := 1; i < 3; i++ {
+		q.handleResponse(req, newMockMwebUtxos(req), "a")
+		require.Empty(t, banned)
+		require.True(t, greylist.IsGreylisted("a"))
+
+		offenses, reason := greylist.Status("a")
+		require.Equal(t, i, offenses)
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+	}
+	require.False(t, greylist.IsGreylisted("b"))
+
+	q.handleResponse(req, newMockMwebUtxos(req), "a")
+	require.Equal(t, []string{"a"}, banned)
+	require.False(t, greylist.IsGreylisted("a"))
+}
+
+// addrPeer is a silentPeer with the given address.
+type addrPeer struct {
+	silentPeer
+	addr string
+}
+
+func (p *addrPeer) Addr() string {
+	return p.addr
+}
+
+// TestGreylistRanking tests that greylisted peers are ordered after all
+// other peers, which otherwise keep their ranking.
+func TestGreylistRanking(t *testing.T) {
+	t.Parallel()
+
+	greylist := banman.NewGreylist(3, time.Hour)
+	ranking := &greylistRanking{
+		PeerRanking: query.NewPeerRanking(),
+		greylist:    greylist,
+	}
+
+	var peers []query.Peer
+	for _, addr := range []string{"a", "b", "c", "d"} {
+		ranking.AddPeer(addr)
+		peers = append(peers, &addrPeer{addr: addr})
+	}
+
+	// Peer b is ranked best, then a, with c and d behind them.
+	ranking.Reward("b")
+	ranking.Reward("b")
+	ranking.Reward("a")
+	ranking.Punish("d")
+
+	addrs := func() []string {
+		ranking.Order(peers)
+		var addrs []string
+		for _, peer := range peers {
+			addrs = append(addrs, peer.Addr())
+		}
+		return addrs
+	}
+	require.Equal(t, []string{"b", "a", "c", "d"}, addrs())
+
+	// Greylisting the best peers sends them to the back.
+	greylist.Offend("b", banman.InvalidMwebUtxos)
+	greylist.Offend("a", banman.InvalidMwebHeader)
+	require.Equal(t, []string{"c", "d", "b", "a"}, addrs())
+}
+
+// TestBanEnforcement tests that while ban enforcement is paused, bans are
+// still recorded but don't keep the peer from connecting, and that pausing
+// it only affects the chain service it was paused for.
+func TestBanEnforcement(t *testing.T) {
+	t.Parallel()
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/bans.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	banStore, err := banman.NewStore(db)
+	require.NoError(t, err)
+	s := &ChainService{banStore: banStore}
+
+	s.SetBanEnforcement(false)
+
+	const addr = "10.0.0.1:9333"
+	require.NoError(t, s.BanPeer(addr, banman.InvalidMwebUtxos))
+	require.False(t, s.IsBanned(addr))
+
+	// The ban and its reason are still on record.
+	ipNet, err := banman.ParseIPNet(addr, nil)
+	require.NoError(t, err)
+	status, err := banStore.Status(ipNet)
+	require.NoError(t, err)
+	require.True(t, status.Banned)
+	require.Equal(t, banman.InvalidMwebUtxos, status.Reason)
+
+	// Another chain service still enforces the ban.
+	other := &ChainService{banStore: banStore}
+	require.True(t, other.IsBanned(addr))
+
+	// Once enforcement resumes, the recorded ban takes effect.
+	s.SetBanEnforcement(true)
+	require.True(t, s.IsBanned(addr))
+}
+
+// TestBanStats tests that the bans are counted by their reasons.
+func TestBanStats(t *testing.T) {
+	t.Parallel()
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/bans.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	banStore, err := banman.NewStore(db)
+	require.NoError(t, err)
+
+	// With the chain service shut down, there are no peers to
+	// disconnect.
+	quit := make(chan struct{})
+	close(quit)
+	s := &ChainService{banStore: banStore, quit: quit}
+	require.Empty(t, s.BanStats())
+
+	bans := []struct {
+		addr   string
+		reason banman.Reason
+	}{
+		{"10.0.0.1:9333", banman.InvalidMwebUtxos},
+		{"10.0.0.2:9333", banman.InvalidMwebUtxos},
+		{"10.0.0.3:9333", banman.InvalidMwebHeader},
+		{"10.0.0.4:9333", banman.NoCompactFilters},
+		{"10.0.0.5:9333", banman.ExceededBanThreshold},
+		{"10.0.0.1:9333", banman.InvalidMwebUtxos},
+	}
+	for _, ban := range bans {
+		require.NoError(t, s.BanPeer(ban.addr, ban.reason))
+	}
+
+	// A ban that fails isn't counted.
+	require.Error(t, s.BanPeer("bad address", banman.InvalidBlock))
+
+	require.Equal(t, map[banman.Reason]int{
+		banman.InvalidMwebUtxos:     3,
+		banman.InvalidMwebHeader:    1,
+		banman.NoCompactFilters:     1,
+		banman.ExceededBanThreshold: 1,
+	}, s.BanStats())
+
+	// The counts returned are a copy.
+	s.BanStats()[banman.InvalidBlock] = 1
+	require.NotContains(t, s.BanStats(), banman.InvalidBlock)
+}
+
+// TestBanNormalizedAddr tests that a ban targets the normalized address of
+// the peer, so that it covers the other ways of writing the same address.
+func TestBanNormalizedAddr(t *testing.T) {
+	t.Parallel()
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/bans.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	banStore, err := banman.NewStore(db)
+	require.NoError(t, err)
+
+	quit := make(chan struct{})
+	close(quit)
+	s := &ChainService{banStore: banStore, quit: quit}
+
+	bans := []struct {
+		addr     string
+		variants []string
+		target   string
+	}{
+		{
+			addr:     "[::ffff:10.0.0.1]:9333",
+			variants: []string{"10.0.0.1", "10.0.0.1:19335"},
+			target:   "10.0.0.1/32",
+		},
+		{
+			addr:     "[2001:DB8:0:0::1%eth0]:9333",
+			variants: []string{"2001:db8::1", "[2001:db8::1]:1"},
+			target:   "2001:db8::1/128",
+		},
+		{
+			addr:     "EXPYUZZ4WQQYQHJN.onion:9333",
+			variants: []string{"expyuzz4wqqyqhjn.onion"},
+			target:   "fd87:d87e:eb43:25df:8a67:3cb4:2188:1d2d/128",
+		},
+	}
+	for _, ban := range bans {
+		require.False(t, s.IsBanned(ban.addr))
+		require.NoError(t, s.BanPeer(ban.addr, banman.InvalidBlock))
+
+		_, target, err := net.ParseCIDR(ban.target)
+		require.NoError(t, err)
+		status, err := banStore.Status(target)
+		require.NoError(t, err)
+		require.True(t, status.Banned, ban.addr)
+
+		for _, variant := range append(ban.variants, ban.addr) {
+			require.True(t, s.IsBanned(variant), variant)
+		}
+	}
+
+	// Neighbouring addresses aren't banned.
+	require.False(t, s.IsBanned("10.0.0.2:9333"))
+	require.False(t, s.IsBanned("[2001:db8::2]:9333"))
+}
@@ -0,0 +1,37 @@
+package neutrino
+
+import (
+	"sync"
+
+	"github.com/ltcmweb/neutrino/banman"
+)
+
+// banStats counts the peers banned for each reason since startup. The zero
+// value is ready to use, and it is safe for concurrent use.
+type banStats struct {
+	mtx    sync.Mutex
+	counts map[banman.Reason]int
+}
+
+// record counts a peer banned for the given reason.
+func (s *banStats) record(reason banman.Reason) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.counts == nil {
+		s.counts = make(map[banman.Reason]int)
+	}
+	s.counts[reason]++
+}
+
+// snapshot returns a copy of the counts.
+func (s *banStats) snapshot() map[banman.Reason]int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	counts := make(map[banman.Reason]int, len(s.counts))
+	for reason, count := range s.counts {
+		counts[reason] = count
+	}
+	return counts
+}
@@ -0,0 +1,29 @@
+package neutrino
+
+import (
+	"hash"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"lukechampine.com/blake3"
+)
+
+// The blake3 hashes of the mweb MMRs and leafsets are computed by the
+// implementation selected at build time. By default that's the optimized
+// one, which uses SIMD instructions where the CPU has them. Building with
+// the purego tag selects the portable pure Go one instead, for constrained
+// or unusual platforms where the optimized one can't be built or trusted.
+
+// newOptimizedBlake3 returns a new blake3 hasher with a 32-byte output from
+// the optimized implementation.
+func newOptimizedBlake3() hash.Hash {
+	return blake3.New(32, nil)
+}
+
+// blake3Sum256 returns the blake3 hash of the data, using the implementation
+// selected at build time.
+func blake3Sum256(data []byte) (sum chainhash.Hash) {
+	h := newBlake3()
+	h.Write(data)
+	copy(sum[:], h.Sum(nil))
+	return
+}
@@ -0,0 +1,13 @@
+//go:build !purego
+// +build !purego
+
+package neutrino
+
+import "hash"
+
+// newBlake3 returns a new blake3 hasher with a 32-byte output from the
+// optimized implementation, which is selected unless building with the
+// purego tag.
+func newBlake3() hash.Hash {
+	return newOptimizedBlake3()
+}
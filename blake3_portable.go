@@ -0,0 +1,263 @@
+package neutrino
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	// blake3BlockLen is the number of bytes compressed at a time.
+	blake3BlockLen = 64
+
+	// blake3ChunkLen is the number of bytes in each chunk, the leaves of
+	// the tree that blake3 hashes its input as.
+	blake3ChunkLen = 1024
+
+	// blake3MaxDepth is the tallest tree of chunks that an input of up to
+	// 2^64 bytes can need.
+	blake3MaxDepth = 54
+)
+
+// The domain flags of blake3, marking the kind of node being compressed.
+const (
+	blake3ChunkStart = 1 << iota
+	blake3ChunkEnd
+	blake3Parent
+	blake3Root
+)
+
+// blake3IV is the initial chaining value of an unkeyed hash.
+var blake3IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// blake3MsgPermutation is the order that the message words are permuted to
+// after each round.
+var blake3MsgPermutation = [16]int{
+	2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8,
+}
+
+// blake3G is the quarter-round mixing function.
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// blake3Compress compresses a block into the chaining value, returning the
+// full state. The first half of it is the next chaining value.
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64,
+	blockLen, flags uint32) [16]uint32 {
+
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for round := 0; round < 7; round++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+
+		var permuted [16]uint32
+		for i, j := range blake3MsgPermutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+// blake3Output is a node of the tree that's yet to be compressed, as either
+// a chaining value for its parent or, at the root, the hash itself.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+// chainingValue returns the chaining value of the node.
+func (o *blake3Output) chainingValue() (cv [8]uint32) {
+	s := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[:8])
+	return
+}
+
+// blake3ParentOutput returns the parent node of two chaining values.
+func blake3ParentOutput(left, right [8]uint32) blake3Output {
+	o := blake3Output{
+		cv:       blake3IV,
+		blockLen: blake3BlockLen,
+		flags:    blake3Parent,
+	}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// portableBlake3 is a pure Go implementation of an unkeyed blake3 hash with
+// a 32-byte output, for builds where the optimized one can't be used. It
+// follows the blake3 reference implementation, favouring simplicity over
+// speed.
+type portableBlake3 struct {
+	// cv is the chaining value of the chunk being hashed.
+	cv [8]uint32
+
+	// chunkCounter is the index of the chunk being hashed.
+	chunkCounter uint64
+
+	// block holds the bytes of the chunk yet to be compressed, of which
+	// there are blockLen.
+	block    [blake3BlockLen]byte
+	blockLen int
+
+	// blocksCompressed is the number of blocks of the chunk compressed
+	// so far.
+	blocksCompressed int
+
+	// cvStack holds the chaining values of the completed subtrees that
+	// are waiting for a sibling, from the largest to the smallest.
+	cvStack [blake3MaxDepth][8]uint32
+	cvLen   int
+}
+
+// newPortableBlake3 returns a new pure Go blake3 hasher with a 32-byte
+// output.
+func newPortableBlake3() hash.Hash {
+	h := &portableBlake3{}
+	h.Reset()
+	return h
+}
+
+// blockWords returns the bytes of the block as little-endian words, padded
+// with zeros.
+func (h *portableBlake3) blockWords() (words [16]uint32) {
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(h.block[i*4:])
+	}
+	return
+}
+
+// startFlag returns the flag marking the first block of a chunk.
+func (h *portableBlake3) startFlag() uint32 {
+	if h.blocksCompressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+// chunkOutput returns the output of the chunk being hashed.
+func (h *portableBlake3) chunkOutput() blake3Output {
+	return blake3Output{
+		cv:       h.cv,
+		block:    h.blockWords(),
+		counter:  h.chunkCounter,
+		blockLen: uint32(h.blockLen),
+		flags:    h.startFlag() | blake3ChunkEnd,
+	}
+}
+
+// Write adds more data to the hash. It never returns an error.
+func (h *portableBlake3) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunkLen := h.blocksCompressed*blake3BlockLen + h.blockLen
+
+		// Once the chunk is full and there's more input, it's
+		// merged into the completed subtrees and the next is
+		// started.
+		if chunkLen == blake3ChunkLen {
+			output := h.chunkOutput()
+			h.addChunk(output.chainingValue())
+			h.cv = blake3IV
+			h.blockLen = 0
+			h.blocksCompressed = 0
+			h.block = [blake3BlockLen]byte{}
+		}
+
+		// A full block is only compressed once there's more input,
+		// as the last block of a chunk is flagged as such.
+		if h.blockLen == blake3BlockLen {
+			words := h.blockWords()
+			s := blake3Compress(
+				&h.cv, &words, h.chunkCounter,
+				blake3BlockLen, h.startFlag(),
+			)
+			copy(h.cv[:], s[:8])
+			h.blocksCompressed++
+			h.blockLen = 0
+			h.block = [blake3BlockLen]byte{}
+		}
+
+		take := copy(h.block[h.blockLen:], p)
+		h.blockLen += take
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// addChunk merges the chaining value of a completed chunk with those of the
+// subtrees completed before it, one for each trailing zero bit of the number
+// of chunks completed.
+func (h *portableBlake3) addChunk(cv [8]uint32) {
+	h.chunkCounter++
+	for total := h.chunkCounter; total&1 == 0; total >>= 1 {
+		h.cvLen--
+		output := blake3ParentOutput(h.cvStack[h.cvLen], cv)
+		cv = output.chainingValue()
+	}
+	h.cvStack[h.cvLen] = cv
+	h.cvLen++
+}
+
+// Sum appends the hash to b without changing the state of the hasher.
+func (h *portableBlake3) Sum(b []byte) []byte {
+	output := h.chunkOutput()
+	for i := h.cvLen - 1; i >= 0; i-- {
+		cv := output.chainingValue()
+		output = blake3ParentOutput(h.cvStack[i], cv)
+	}
+
+	s := blake3Compress(
+		&output.cv, &output.block, output.counter, output.blockLen,
+		output.flags|blake3Root,
+	)
+	for _, word := range s[:8] {
+		b = binary.LittleEndian.AppendUint32(b, word)
+	}
+	return b
+}
+
+// Reset resets the hasher to its initial state.
+func (h *portableBlake3) Reset() {
+	*h = portableBlake3{cv: blake3IV}
+}
+
+// Size returns the number of bytes that Sum appends.
+func (h *portableBlake3) Size() int {
+	return 32
+}
+
+// BlockSize returns the number of bytes compressed at a time.
+func (h *portableBlake3) BlockSize() int {
+	return blake3BlockLen
+}
@@ -0,0 +1,131 @@
+package neutrino
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPortableBlake3 tests that the portable blake3 implementation gives
+// the published hashes, and the same hashes as the optimized one for inputs
+// spanning several blocks and chunks, however they're written.
+func TestPortableBlake3(t *testing.T) {
+	t.Parallel()
+
+	vectors := map[string]string{
+		"": "af1349b9f5f9a1a6a0404dea36dcc949" +
+			"9bcb25c9adc112b7cc9a93cae41f3262",
+		"abc": "6437b3ac38465133ffb63b75273a8db5" +
+			"48c558465d79db03fd359c6cd5bd9d85",
+	}
+	for input, want := range vectors {
+		h := newPortableBlake3()
+		h.Write([]byte(input))
+		require.Equal(t, want, hex.EncodeToString(h.Sum(nil)))
+	}
+
+	lengths := []int{
+		1, 63, 64, 65, 1023, 1024, 1025, 2048, 2049, 3*1024 + 5,
+		8 * 1024, 8*1024 + 1, 100_000,
+	}
+	for _, n := range lengths {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+
+		optimized := newOptimizedBlake3()
+		optimized.Write(data)
+		want := optimized.Sum(nil)
+
+		// The portable hasher is written to in uneven pieces.
+		portable := newPortableBlake3()
+		for rest, size := data, 1; len(rest) > 0; size = size*3 + 1 {
+			if size > len(rest) {
+				size = len(rest)
+			}
+			portable.Write(rest[:size])
+			rest = rest[size:]
+		}
+		require.Equal(t, want, portable.Sum(nil), "length %v", n)
+
+		// Summing doesn't change the state, and a reset starts over.
+		require.Equal(t, want, portable.Sum(nil), "length %v", n)
+		portable.Reset()
+		portable.Write(data)
+		require.Equal(t, want, portable.Sum(nil), "length %v", n)
+	}
+}
+
+// mmrRootWith returns the output root of the MMR, hashing its nodes with the
+// given blake3 implementation rather than the one selected at build time.
+func mmrRootWith(m *testMwebMmr,
+	newHash func() hash.Hash) chainhash.Hash {
+
+	sum := func(i nodeIdx, write func(h hash.Hash)) *chainhash.Hash {
+		h := newHash()
+		binary.Write(h, binary.LittleEndian, uint64(i))
+		write(h)
+		return (*chainhash.Hash)(h.Sum(nil))
+	}
+
+	var nodeHash func(node nodeIdx) *chainhash.Hash
+	nodeHash = func(node nodeIdx) *chainhash.Hash {
+		height := node.height()
+		if height == 0 {
+			outputId := m.outputIds[node.leafIdx()]
+			return sum(node, func(h hash.Hash) {
+				wire.WriteVarBytes(h, 0, outputId[:])
+			})
+		}
+		left := nodeHash(node.left(height))
+		right := nodeHash(node.right())
+		return sum(node, func(h hash.Hash) {
+			h.Write(left[:])
+			h.Write(right[:])
+		})
+	}
+
+	numNodes := m.nextNodeIdx()
+	peaks := calcPeaks(uint64(numNodes))
+	root := nodeHash(peaks[len(peaks)-1])
+	for i := len(peaks) - 2; i >= 0; i-- {
+		peak, bagged := nodeHash(peaks[i]), root
+		root = sum(numNodes, func(h hash.Hash) {
+			h.Write(peak[:])
+			h.Write(bagged[:])
+		})
+	}
+	return *root
+}
+
+// TestBlake3MmrRoots tests that the optimized and portable blake3
+// implementations give the same output roots as each other and as the
+// implementation selected at build time, along with the same leafset roots.
+func TestBlake3MmrRoots(t *testing.T) {
+	t.Parallel()
+
+	for _, numLeaves := range []int{1, 2, 3, 7, 20, 64, 100} {
+		mmr := newTestMwebMmr(numLeaves)
+		root := mmr.root()
+		require.Equal(t, root, mmrRootWith(mmr, newOptimizedBlake3),
+			"%v leaves", numLeaves)
+		require.Equal(t, root, mmrRootWith(mmr, newPortableBlake3),
+			"%v leaves", numLeaves)
+
+		leafset := mmr.leafset(0, uint64(numLeaves-1))
+		optimized := newOptimizedBlake3()
+		optimized.Write(leafset.Bits)
+		portable := newPortableBlake3()
+		portable.Write(leafset.Bits)
+
+		leafsetRoot := blake3Sum256(leafset.Bits)
+		require.Equal(t, leafsetRoot[:], optimized.Sum(nil))
+		require.Equal(t, leafsetRoot[:], portable.Sum(nil))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -98,6 +99,145 @@ type blockManagerCfg struct {
 	// MwebCoins is the store where mweb coins are persistently stored.
 	MwebCoins mwebdb.CoinDatabase
 
+	// MwebWriteRetries is the number of times a failed write to the mweb
+	// coins db is retried before the current sync attempt is abandoned.
+	// If zero or negative, failed writes aren't retried.
+	MwebWriteRetries int
+
+	// MwebWriteBackoff is the initial time to wait between retries of a
+	// failed write to the mweb coins db.
+	MwebWriteBackoff time.Duration
+
+	// MwebCircuitThreshold is the number of mweb sync failures in a row
+	// after which the sync cools down for MwebCircuitCooldown. If zero,
+	// the sync never cools down.
+	MwebCircuitThreshold int
+
+	// MwebCircuitCooldown is how long the mweb sync cools down for once
+	// it has failed MwebCircuitThreshold times in a row.
+	MwebCircuitCooldown time.Duration
+
+	// MwebTimeoutThreshold is the number of getmwebutxos messages in a
+	// row that a peer may time out on before MwebTimeoutPolicy is applied
+	// to it. If zero or negative, peers timing out are only ever
+	// reassigned.
+	MwebTimeoutThreshold int
+
+	// MwebTimeoutPolicy is what's done with a peer that has timed out on
+	// MwebTimeoutThreshold getmwebutxos messages in a row.
+	MwebTimeoutPolicy MwebTimeoutPolicy
+
+	// MwebFanOut is the number of peers that each span of mweb utxos is
+	// requested from at once, cancelling the others once one of them
+	// answers with verified utxos. If zero or one, each span is
+	// requested from one peer at a time.
+	MwebFanOut int
+
+	// MwebQuitTimeout is the longest we'll wait on shutdown for the query
+	// dispatcher to cancel an outstanding mweb query.
+	MwebQuitTimeout time.Duration
+
+	// OrderedMwebCallbacks is whether fetched mweb utxos must be delivered
+	// to the callbacks in leaf index order.
+	OrderedMwebCallbacks bool
+
+	// MwebInterestFilter, if set, reports the leaves whose utxos should be
+	// fetched before the rest.
+	MwebInterestFilter func(leafIndex uint64) bool
+
+	// MwebConfirmations is the number of confirmations that mweb utxos
+	// need before they're passed to the confirmed mweb utxos callbacks.
+	MwebConfirmations uint32
+
+	// ShouldRetainPurgedCoin, if set, reports the spent leaves whose coins
+	// are kept, marked spent, rather than purged from the mweb coins db.
+	ShouldRetainPurgedCoin func(leafIdx uint64) bool
+
+	// MwebSyncOrder is the order in which the added spans of mweb utxos
+	// are fetched.
+	MwebSyncOrder MwebSyncOrder
+
+	// MwebMemoryBudget is the estimated memory in bytes that the
+	// responses to outstanding mweb utxos requests may take up. If zero,
+	// there is no budget.
+	MwebMemoryBudget uint64
+
+	// MwebStreamThreshold is the estimated memory in bytes of a batch of
+	// mweb utxos requests above which the responses are written to the
+	// mweb coins db one by one as they're verified, rather than all at
+	// once. If zero, every batch is written response by response.
+	MwebStreamThreshold uint64
+
+	// StrictMwebLeafsetCheck is whether fetched mweb utxos are also
+	// cross-checked against the leafset tracked in the mweb coins db.
+	StrictMwebLeafsetCheck bool
+
+	// MwebDistinctUtxosPeer is whether the mweb utxos must be served by a
+	// peer other than the one that served the mweb header they're
+	// verified against.
+	MwebDistinctUtxosPeer bool
+
+	// CheckMwebFetchedLeaves is whether the coins fetched from the mweb
+	// coins db to notify of added mweb utxos are checked against the
+	// leaves asked for and the leafset.
+	CheckMwebFetchedLeaves bool
+
+	// MwebArchivalPeer, if set, reports whether the peer is archival, and
+	// so preferred for mweb utxos requests deep below the chain tip.
+	MwebArchivalPeer func(addr string) bool
+
+	// MwebPeerGroup, if set, returns the network group of a peer, and
+	// mweb utxos requests are spread across the groups of our peers.
+	MwebPeerGroup func(addr string) string
+
+	// MwebPeerSelector, if set, selects the peers that mweb requests are
+	// sent to, in the order to try them.
+	MwebPeerSelector MwebPeerSelector
+
+	// MwebRootVariants are the rules under which the output root of an
+	// mweb header is accepted. If empty, only the default rule is.
+	MwebRootVariants []MwebRootVariant
+
+	// MwebSnapshot, if set, seeds an empty mweb coins db once the block
+	// headers are synced.
+	MwebSnapshot *MwebSnapshot
+
+	// MwebVerifyTiming is whether the time taken to verify each mweb
+	// utxos response is recorded.
+	MwebVerifyTiming bool
+
+	// MwebProofStats is whether the bytes of proof hashes and of utxos in
+	// each verified mweb utxos response are recorded by peer.
+	MwebProofStats bool
+
+	// MwebCheckpoint, if set, is a trusted checkpoint that the mweb utxos
+	// below it are verified against in place of the output root.
+	MwebCheckpoint *MwebCheckpoint
+
+	// MwebVerifyWorkers is the number of goroutines that mweb utxos
+	// responses are verified on. If zero, they're verified on the query
+	// workers that receive them.
+	MwebVerifyWorkers int
+
+	// MwebMinProofHashRatio is the ratio of the fewest proof hashes that
+	// the utxos of an mwebutxos response could need, below which the
+	// response is rejected without its proof being walked. If zero, no
+	// response is rejected on its number of proof hashes alone.
+	MwebMinProofHashRatio float64
+
+	// MwebProofs, if set, stores the proofs of the fetched mweb utxos
+	// alongside the coins.
+	MwebProofs *mwebdb.ProofStore
+
+	// MwebKernels, if set, stores the mweb kernels of the blocks synced,
+	// which are fetched and verified after the mweb utxos.
+	MwebKernels *mwebdb.KernelStore
+
+	// MwebFullBlockFallback, if nonzero, is how long the mweb sync may go
+	// without any peer serving it before the mweb utxos are taken from
+	// full blocks instead.
+	MwebFullBlockFallback time.Duration
+
 	// TimeSource is used to access a time estimate based on the clocks of
 	// the connected peers.
 	TimeSource blockchain.MedianTimeSource
@@ -108,6 +248,26 @@ type blockManagerCfg struct {
 	// BanPeer bans and disconnects the given peer.
 	BanPeer func(addr string, reason banman.Reason) error
 
+	// DisconnectPeer, if set, disconnects the given peer without banning
+	// it.
+	DisconnectPeer func(addr string)
+
+	// BanPolicy decides whether a peer serving us invalid mweb data is
+	// banned. If nil, such peers are always banned.
+	BanPolicy BanPolicy
+
+	// BeforeBan, if set, is asked before any peer is banned, and the ban
+	// only goes ahead if it returns true.
+	BeforeBan func(addr string, reason banman.Reason) bool
+
+	// MwebVerifyDumpDir, if set, is the directory that the state of each
+	// failed verification of mweb utxos is dumped to.
+	MwebVerifyDumpDir string
+
+	// MwebFailureSink, if set, is given the invalid mweb data served by
+	// peers before they are punished.
+	MwebFailureSink MwebFailureSink
+
 	// GetBlock fetches a block from the p2p network.
 	GetBlock func(chainhash.Hash, ...QueryOption) (*ltcutil.Block, error)
 
@@ -131,6 +291,11 @@ type blockManager struct { // nolint:maligned
 	started  int32 // To be used atomically.
 	shutdown int32 // To be used atomically.
 
+	// mwebVerifyDumps counts the mweb verify states dumped, to name
+	// their files and cap their number. It must be accessed atomically,
+	// and is kept here to be 64-bit aligned.
+	mwebVerifyDumps uint64
+
 	cfg *blockManagerCfg
 
 	// blkHeaderProgressLogger is a progress logger that we'll use to
@@ -170,6 +335,17 @@ type blockManager struct { // nolint:maligned
 	// switch over.
 	newHeadersSignal *sync.Cond
 
+	// mwebRefresh holds the mweb header and leafset of the chain tip
+	// fetched by a refresh of the mweb state, if the mweb handler is yet
+	// to do another round for it. Callers MUST hold newHeadersMtx each
+	// time they read/write from this field.
+	mwebRefresh *mwebHeaderPrefetch
+
+	// mwebResync is the full resync of the mweb coins db requested by
+	// ResyncMweb, until it completes. Callers MUST hold newHeadersMtx
+	// each time they read/write from this field.
+	mwebResync *mwebResync
+
 	// filterHeaderTip will be set to the height of the current filter
 	// header tip at all times.  Callers MUST hold the lock below each time
 	// they read/write from this field.
@@ -226,11 +402,95 @@ type blockManager struct { // nolint:maligned
 	mwebUtxosCallbacksMtx sync.Mutex
 	mwebUtxosCallbacks    []func(*mweb.Leafset, []*wire.MwebNetUtxo)
 	mwebRollbackSignal    *sync.Cond
+
+	// mwebMemory tracks the estimated memory held by outstanding mweb
+	// utxos requests against the MwebMemoryBudget.
+	mwebMemory *mwebMemoryBudget
+
+	mwebHeaderCallbacksMtx sync.Mutex
+	mwebHeaderCallbacks    []func(*wire.MwebHeader, uint32,
+		chainhash.Hash)
+
+	mwebStatsCallbacksMtx sync.Mutex
+	mwebStatsCallbacks    []func(MwebUtxosBatchStats)
+
+	mwebProgressCallbacksMtx sync.Mutex
+	mwebProgressCallbacks    []func(MwebSyncProgress)
+
+	// mwebNtfns holds the MwebConnected notifications queued by the mweb
+	// sync until mwebNtfnHandler delivers them.
+	mwebNtfns *mwebNtfnQueue
+
+	// mwebUtxosResume records how far the last mweb utxos fetch got if
+	// it was abandoned due to the chain tip changing, so that the next
+	// fetch can skip the leaves that were already written. It must only
+	// be accessed from the mwebHandler goroutine.
+	mwebUtxosResume *mwebUtxosResume
+
+	// mwebHeaderPrefetch, if set, is fetching the mweb header and leafset
+	// of the next chain tip alongside the current mweb utxos fetch. It
+	// must only be accessed from the mwebHandler goroutine.
+	mwebHeaderPrefetch *mwebHeaderPrefetch
+
+	// mwebHeaders holds the mweb headers verified so far, to check the
+	// headers served after them against.
+	mwebHeaders mwebHeaderCache
+
+	// mwebFailureLog rate limits the logging of mweb verification
+	// failures by peer.
+	mwebFailureLog mwebFailureLogger
+
+	// mwebVerifyTimer records the time taken to verify mweb utxos
+	// responses. It is nil unless MwebVerifyTiming is set.
+	mwebVerifyTimer *mwebVerifyTimer
+
+	// mwebProofTracker records the proof efficiency of the mweb utxos
+	// responses served by each peer. It is nil unless MwebProofStats is
+	// set.
+	mwebProofTracker *mwebProofTracker
+
+	// mwebVerifyPool runs the verification of mweb utxos responses. It
+	// is nil unless MwebVerifyWorkers is set.
+	mwebVerifyPool *mwebVerifyPool
+
+	// mwebBatchSizer adapts the size of getmwebutxos messages to the
+	// performance of each of our peers.
+	mwebBatchSizer *mwebBatchSizer
+
+	// mwebQueryPeers are the peers that mweb queries are pinned to by
+	// SetMwebQueryPeers.
+	mwebQueryPeers mwebQueryPeers
+
+	// mwebTimeouts counts the getmwebutxos messages that each of our
+	// peers has timed out on in a row.
+	mwebTimeouts *mwebTimeoutTracker
+
+	// mwebPause pauses the mweb sync while the mweb queries are
+	// cancelled by CancelMwebQueries.
+	mwebPause *mwebPause
+
+	// mwebCircuit cools the mweb sync down after it fails too many times
+	// in a row.
+	mwebCircuit *mwebCircuitBreaker
+
+	// mwebFallback tracks when the mweb sync is to fall back to full
+	// blocks. It is nil unless MwebFullBlockFallback is set.
+	mwebFallback *mwebFullBlockFallback
+
+	// mwebSyncStartHeight is the height of the first block whose mweb
+	// utxos are fetched. It must be accessed atomically.
+	mwebSyncStartHeight uint32
 }
 
 // newBlockManager returns a new bitcoin block manager.  Use Start to begin
 // processing asynchronous block and inv updates.
 func newBlockManager(cfg *blockManagerCfg) (*blockManager, error) {
+	if cfg.ShouldRetainPurgedCoin != nil && cfg.MwebCoins != nil {
+		if _, ok := cfg.MwebCoins.(mwebCoinRetainer); !ok {
+			return nil, ErrMwebCoinsNoRetain
+		}
+	}
+
 	targetTimespan := int64(cfg.ChainParams.TargetTimespan / time.Second)
 	targetTimePerBlock := int64(cfg.ChainParams.TargetTimePerBlock / time.Second)
 	adjustmentFactor := cfg.ChainParams.RetargetAdjustmentFactor
@@ -256,6 +516,16 @@ func newBlockManager(cfg *blockManagerCfg) (*blockManager, error) {
 		minRetargetTimespan: targetTimespan / adjustmentFactor,
 		maxRetargetTimespan: targetTimespan * adjustmentFactor,
 		requestedTxns:       make(map[chainhash.Hash]struct{}),
+		mwebMemory:          newMwebMemoryBudget(cfg.MwebMemoryBudget),
+		mwebBatchSizer:      newMwebBatchSizer(),
+		mwebPause:           newMwebPause(),
+		mwebNtfns:           newMwebNtfnQueue(),
+		mwebTimeouts: newMwebTimeoutTracker(
+			cfg.MwebTimeoutThreshold,
+		),
+		mwebCircuit: newMwebCircuitBreaker(
+			cfg.MwebCircuitThreshold, cfg.MwebCircuitCooldown,
+		),
 	}
 
 	// Next we'll create the two signals that goroutines will use to wait
@@ -265,6 +535,23 @@ func newBlockManager(cfg *blockManagerCfg) (*blockManager, error) {
 	bm.newFilterHeadersSignal = sync.NewCond(&bm.newFilterHeadersMtx)
 	bm.mwebRollbackSignal = sync.NewCond(&bm.mwebUtxosCallbacksMtx)
 
+	if cfg.MwebFullBlockFallback > 0 {
+		bm.mwebFallback = newMwebFullBlockFallback(
+			cfg.MwebFullBlockFallback,
+		)
+	}
+	if cfg.MwebVerifyTiming {
+		bm.mwebVerifyTimer = newMwebVerifyTimer()
+	}
+	if cfg.MwebProofStats {
+		bm.mwebProofTracker = newMwebProofTracker()
+	}
+	if cfg.MwebVerifyWorkers > 0 {
+		bm.mwebVerifyPool = newMwebVerifyPool(
+			cfg.MwebVerifyWorkers, bm.quit, &bm.wg,
+		)
+	}
+
 	// We fetch the genesis header to use for verifying the first received
 	// interval.
 	genesisHeader, err := cfg.RegFilterHeaders.FetchHeaderByHeight(0)
@@ -312,8 +599,9 @@ func (b *blockManager) Start() {
 	}
 
 	log.Trace("Starting block manager")
-	b.wg.Add(3)
+	b.wg.Add(4)
 	go b.blockHandler()
+	go b.mwebNtfnHandler()
 	go func() {
 		defer b.wg.Done()
 
@@ -458,6 +746,9 @@ func (b *blockManager) handleDonePeerMsg(peers *list.List, sp *ServerPeer) {
 
 	log.Infof("Lost peer %s", sp)
 
+	b.mwebBatchSizer.removePeer(sp.Addr())
+	b.mwebTimeouts.removePeer(sp.Addr())
+
 	// Attempt to find a new peer to sync from if the quitting peer is the
 	// sync peer.  Also, reset the header state.
 	if b.SyncPeer() != nil && b.SyncPeer() == sp {
@@ -765,7 +1056,7 @@ func (b *blockManager) getUncheckpointedCFHeaders(
 	// Ban any peer that responds with the wrong prev filter header.
 	for peer, msg := range headers {
 		if msg.PrevFilterHeader != *filterTip {
-			err := b.cfg.BanPeer(peer, banman.InvalidFilterHeader)
+			err := b.banPeer(peer, banman.InvalidFilterHeader)
 			if err != nil {
 				log.Errorf("Unable to ban peer %v: %v", peer, err)
 			}
@@ -795,7 +1086,7 @@ func (b *blockManager) getUncheckpointedCFHeaders(
 				"headers", len(badPeers))
 
 			for _, peer := range badPeers {
-				err := b.cfg.BanPeer(
+				err := b.banPeer(
 					peer, banman.InvalidFilterHeader,
 				)
 				if err != nil {
@@ -916,7 +1207,7 @@ func (c *checkpointedCFHeadersQuery) handleResponse(req, resp wire.Message,
 		// If the peer gives us a header that doesn't match what we
 		// know to be the best checkpoint, then we'll ban the peer so
 		// we can re-allocate the query elsewhere.
-		err := c.blockMgr.cfg.BanPeer(
+		err := c.blockMgr.banPeer(
 			peerAddr, banman.InvalidFilterHeaderCheckpoint,
 		)
 		if err != nil {
@@ -1411,7 +1702,7 @@ func (b *blockManager) resolveConflict(
 					"checkpoints didn't match our "+
 					"checkpoint at height %d", peer, height)
 
-				err := b.cfg.BanPeer(
+				err := b.banPeer(
 					peer, banman.InvalidFilterHeaderCheckpoint,
 				)
 				if err != nil {
@@ -1498,7 +1789,7 @@ func (b *blockManager) resolveConflict(
 				"headers", len(badPeers))
 
 			for _, peer := range badPeers {
-				err := b.cfg.BanPeer(
+				err := b.banPeer(
 					peer, banman.InvalidFilterHeader,
 				)
 				if err != nil {
@@ -1516,7 +1807,7 @@ func (b *blockManager) resolveConflict(
 	// didn't respond, and ban them from future queries.
 	for peer := range checkpoints {
 		if _, ok := headers[peer]; !ok {
-			err := b.cfg.BanPeer(
+			err := b.banPeer(
 				peer, banman.InvalidFilterHeaderCheckpoint,
 			)
 			if err != nil {
@@ -3142,3 +3433,29 @@ func (b *blockManager) RegisterMwebUtxosCallback(
 	defer b.mwebUtxosCallbacksMtx.Unlock()
 	b.mwebUtxosCallbacks = append(b.mwebUtxosCallbacks, onMwebUtxos)
 }
+
+// RegisterMwebHeaderCallback will register a callback that will fire when
+// an mweb header has been verified against its block.
+func (b *blockManager) RegisterMwebHeaderCallback(
+	onMwebHeader func(*wire.MwebHeader, uint32, chainhash.Hash)) {
+
+	b.mwebHeaderCallbacksMtx.Lock()
+	defer b.mwebHeaderCallbacksMtx.Unlock()
+	b.mwebHeaderCallbacks = append(b.mwebHeaderCallbacks, onMwebHeader)
+}
+
+// notifyMwebHeader fires the mweb header callbacks for a verified mweb
+// header. The callbacks are run without holding any locks, so they're free
+// to call back into the ChainService.
+func (b *blockManager) notifyMwebHeader(mwebHeader *wire.MwebHeader,
+	blockHash chainhash.Hash) {
+
+	b.mwebHeaderCallbacksMtx.Lock()
+	callbacks := slices.Clone(b.mwebHeaderCallbacks)
+	b.mwebHeaderCallbacksMtx.Unlock()
+
+	height := uint32(mwebHeader.Height)
+	for _, cb := range callbacks {
+		cb(mwebHeader, height, blockHash)
+	}
+}
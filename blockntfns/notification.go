@@ -22,6 +22,21 @@ type BlockNtfn interface {
 	ChainTip() wire.BlockHeader
 }
 
+// MwebSummary summarizes the effect of a block on the mweb, as computed from
+// the diff of the mweb leafsets before and after it.
+type MwebSummary struct {
+	// LeavesAdded is the number of leaves that the block added to the
+	// mweb output MMR.
+	LeavesAdded uint64
+
+	// LeavesRemoved is the number of unspent leaves that the block spent.
+	LeavesRemoved uint64
+
+	// MMRSize is the number of leaves in the mweb output MMR after the
+	// block.
+	MMRSize uint64
+}
+
 // Connected is a block notification that gets dispatched to clients when the
 // filter header of a new block has been found that extends the current chain.
 type Connected struct {
@@ -59,6 +74,54 @@ func (n *Connected) String() string {
 		n.header.BlockHash())
 }
 
+// MwebConnected is a block notification that gets dispatched to clients once
+// the mweb sync has stored the mweb leafset of a block that extends the
+// leafset it stored before, following the block's Connected notification.
+type MwebConnected struct {
+	header wire.BlockHeader
+	height uint32
+	mweb   MwebSummary
+}
+
+// A compile-time check to ensure MwebConnected satisfies the BlockNtfn
+// interface.
+var _ BlockNtfn = (*MwebConnected)(nil)
+
+// NewMwebConnected creates a new MwebConnected notification for the given
+// block, carrying the summary of its effect on the mweb.
+func NewMwebConnected(header wire.BlockHeader, height uint32,
+	mweb MwebSummary) *MwebConnected {
+
+	return &MwebConnected{header: header, height: height, mweb: mweb}
+}
+
+// Header returns the header of the block that the mweb sync has reached.
+func (n *MwebConnected) Header() wire.BlockHeader {
+	return n.header
+}
+
+// Height returns the height of the block that the mweb sync has reached.
+func (n *MwebConnected) Height() uint32 {
+	return n.height
+}
+
+// ChainTip returns the header of the block that the mweb sync has reached.
+func (n *MwebConnected) ChainTip() wire.BlockHeader {
+	return n.header
+}
+
+// MwebSummary returns the summary of the block's effect on the mweb.
+func (n *MwebConnected) MwebSummary() MwebSummary {
+	return n.mweb
+}
+
+// String returns the string representation of an MwebConnected
+// notification.
+func (n *MwebConnected) String() string {
+	return fmt.Sprintf("mweb block connected (height=%d, hash=%v)",
+		n.height, n.header.BlockHash())
+}
+
 // Disconnected if a notification that gets dispatched to clients when a reorg
 // has been detected at the tip of the chain.
 type Disconnected struct {
@@ -0,0 +1,106 @@
+package neutrino
+
+import (
+	"net"
+	"sync"
+
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebArchivalDepth is the number of blocks below the chain tip past which
+// mweb utxos are preferably fetched from archival peers. It matches the
+// depth that peers signalling NODE_NETWORK_LIMITED are expected to keep,
+// as pruned peers may be slow or unable to serve anything older.
+const mwebArchivalDepth = 288
+
+// mwebArchivalPeers tags the connected peers that are preferred for mweb
+// utxos queries at low leaf indices, either because they advertise the
+// configured service bits or because they're on the user's allowlist.
+type mwebArchivalPeers struct {
+	services  wire.ServiceFlag
+	allowlist map[string]struct{}
+
+	mtx    sync.Mutex
+	tagged map[string]struct{}
+}
+
+// newMwebArchivalPeers creates a tracker for the peers advertising all of
+// the given service bits, along with those whose address or host is in the
+// allowlist. It returns nil if neither is configured.
+func newMwebArchivalPeers(services wire.ServiceFlag,
+	allowlist []string) *mwebArchivalPeers {
+
+	if services == 0 && len(allowlist) == 0 {
+		return nil
+	}
+
+	a := &mwebArchivalPeers{
+		services:  services,
+		allowlist: make(map[string]struct{}, len(allowlist)),
+		tagged:    make(map[string]struct{}),
+	}
+	for _, addr := range allowlist {
+		a.allowlist[addr] = struct{}{}
+	}
+	return a
+}
+
+// addPeer tags the peer as archival if it advertises the configured service
+// bits.
+func (a *mwebArchivalPeers) addPeer(addr string, services wire.ServiceFlag) {
+	if a.services == 0 || services&a.services != a.services {
+		return
+	}
+
+	a.mtx.Lock()
+	a.tagged[addr] = struct{}{}
+	a.mtx.Unlock()
+}
+
+// removePeer removes the tag from a disconnected peer.
+func (a *mwebArchivalPeers) removePeer(addr string) {
+	a.mtx.Lock()
+	delete(a.tagged, addr)
+	a.mtx.Unlock()
+}
+
+// isArchival returns whether the peer is tagged as archival or is on the
+// allowlist, by either its full address or its host.
+func (a *mwebArchivalPeers) isArchival(addr string) bool {
+	if _, ok := a.allowlist[addr]; ok {
+		return true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if _, ok := a.allowlist[host]; ok {
+			return true
+		}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	_, ok := a.tagged[addr]
+	return ok
+}
+
+// mwebArchivalLeafIndex returns the number of leaves in the output MMR as
+// of mwebArchivalDepth blocks below the given tip height, according to the
+// leaf counts of the blocks in the height map. Leaves below it are old
+// enough to prefer archival peers for. As not every block's leaf count is
+// stored, the count of the nearest block at or before that height is used.
+func mwebArchivalLeafIndex(heights []uint32, heightMap map[uint32]uint64,
+	tipHeight uint32) uint64 {
+
+	if tipHeight < mwebArchivalDepth {
+		return 0
+	}
+
+	var leafIndex uint64
+	for _, height := range heights {
+		if height > tipHeight-mwebArchivalDepth {
+			break
+		}
+		leafIndex = heightMap[height]
+	}
+	return leafIndex
+}
@@ -0,0 +1,151 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebArchivalPeers tests that peers are tagged as archival by their
+// service bits or by being on the allowlist.
+func TestMwebArchivalPeers(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, newMwebArchivalPeers(0, nil))
+
+	a := newMwebArchivalPeers(
+		wire.SFNodeNetwork, []string{"10.0.0.1", "10.0.0.2:9333"},
+	)
+
+	// Allowlisted peers are archival whether connected or not, matching
+	// on either the host or the full address.
+	require.True(t, a.isArchival("10.0.0.1:9333"))
+	require.True(t, a.isArchival("10.0.0.1:19335"))
+	require.True(t, a.isArchival("10.0.0.2:9333"))
+	require.False(t, a.isArchival("10.0.0.2:19335"))
+
+	// Peers are only tagged if they advertise all the service bits, and
+	// lose their tag on disconnecting.
+	a.addPeer("10.0.0.3:9333", wire.SFNodeNetworkLimited)
+	require.False(t, a.isArchival("10.0.0.3:9333"))
+	a.addPeer("10.0.0.4:9333", wire.SFNodeNetwork|wire.SFNodeWitness)
+	require.True(t, a.isArchival("10.0.0.4:9333"))
+	a.removePeer("10.0.0.4:9333")
+	require.False(t, a.isArchival("10.0.0.4:9333"))
+
+	// Without service bits configured, only the allowlist counts.
+	a = newMwebArchivalPeers(0, []string{"10.0.0.1"})
+	a.addPeer("10.0.0.4:9333", wire.SFNodeNetwork)
+	require.False(t, a.isArchival("10.0.0.4:9333"))
+}
+
+// TestMwebArchivalPreference tests that the requests for leaves deep below
+// the chain tip prefer archival peers, while those for recent leaves have no
+// preference.
+func TestMwebArchivalPreference(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	// With every fourth leaf already stored, there are spans of three
+	// leaves to fetch starting at 1, 5, 9 and so on. The leaves below 40
+	// were created more than mwebArchivalDepth blocks below the tip.
+	mmr := newTestMwebMmr(100)
+	var missing []uint64
+	for i := uint64(0); i < 100; i++ {
+		if i%4 != 0 {
+			missing = append(missing, i)
+		}
+	}
+	coinDB.leafset = mmr.leafset(missing...)
+	coinDB.leavesAtHeight = map[uint32]uint64{
+		500: 40,
+		800: 80,
+	}
+	leafset := mmr.leafset()
+	leafset.Height = 1000
+
+	bm.cfg.MwebArchivalPeer = func(addr string) bool {
+		return addr == "archival"
+	}
+
+	var (
+		mtx       sync.Mutex
+		preferred = make(map[uint64]bool)
+	)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			mtx.Lock()
+			for _, req := range requests {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				prefer := req.PreferPeer
+				preferred[msg.StartIndex] = prefer != nil &&
+					prefer("archival") && !prefer("pruned")
+			}
+			mtx.Unlock()
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	require.Len(t, preferred, 25)
+	for start, prefer := range preferred {
+		require.Equal(t, start < 40, prefer, "start index %v", start)
+	}
+	require.Len(t, coinDB.coins, len(missing))
+}
+
+// TestMwebArchivalLeafIndex tests finding the leaf index below which leaves
+// are deep enough to prefer archival peers.
+func TestMwebArchivalLeafIndex(t *testing.T) {
+	t.Parallel()
+
+	heights := []uint32{100, 500, 800}
+	heightMap := map[uint32]uint64{100: 10, 500: 40, 800: 80}
+
+	testCases := []struct {
+		tipHeight uint32
+		leafIndex uint64
+	}{
+		{200, 0},
+		{388, 10},
+		{787, 10},
+		{788, 40},
+		{2000, 80},
+	}
+	for _, tc := range testCases {
+		leafIndex := mwebArchivalLeafIndex(
+			heights, heightMap, tc.tipHeight,
+		)
+		require.Equal(t, tc.leafIndex, leafIndex, tc.tipHeight)
+	}
+	require.Equal(t, uint64(0), mwebArchivalLeafIndex(nil, nil, 2000))
+}
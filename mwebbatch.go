@@ -0,0 +1,144 @@
+package neutrino
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+const (
+	// mwebUtxosBatchMsgs is the most getmwebutxos messages dispatched
+	// together in a batch.
+	mwebUtxosBatchMsgs = 10
+
+	// defaultMwebSpanSize is the number of utxos requested in each
+	// getmwebutxos message from a peer whose performance we don't know
+	// yet.
+	defaultMwebSpanSize = 1024
+
+	// minMwebSpanSize is the fewest utxos requested in each getmwebutxos
+	// message, however badly our peers perform.
+	minMwebSpanSize = 64
+
+	// mwebFastResponse is the time within which a peer answering a full
+	// sized getmwebutxos message is given larger ones.
+	mwebFastResponse = 2 * time.Second
+
+	// mwebSlowResponse is the time after which a peer answering a
+	// getmwebutxos message is given smaller ones.
+	mwebSlowResponse = 10 * time.Second
+)
+
+// mwebBatchSizer adapts the number of utxos requested in each getmwebutxos
+// message to the performance of each of our peers. A peer's size doubles
+// each time it quickly answers a request of its full size, and halves each
+// time it is slow to answer or fails to, staying within the range of
+// minMwebSpanSize to wire.MaxMwebUtxosPerQuery.
+type mwebBatchSizer struct {
+	mtx   sync.Mutex
+	sizes map[string]uint16
+}
+
+// newMwebBatchSizer creates a batch sizer that knows of no peers yet.
+func newMwebBatchSizer() *mwebBatchSizer {
+	return &mwebBatchSizer{
+		sizes: make(map[string]uint16),
+	}
+}
+
+// record adjusts the size for the peer once it has answered, or failed to
+// answer, a getmwebutxos message for the given number of utxos in the
+// given time.
+func (s *mwebBatchSizer) record(peer string, numRequested uint16,
+	elapsed time.Duration, err error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	size, ok := s.sizes[peer]
+	if !ok {
+		size = defaultMwebSpanSize
+	}
+
+	switch {
+	case err != nil || elapsed >= mwebSlowResponse:
+		size /= 2
+		if size < minMwebSpanSize {
+			size = minMwebSpanSize
+		}
+
+	case elapsed < mwebFastResponse && numRequested >= size:
+		if size > wire.MaxMwebUtxosPerQuery/2 {
+			size = wire.MaxMwebUtxosPerQuery
+		} else {
+			size *= 2
+		}
+	}
+	s.sizes[peer] = size
+}
+
+// size returns the number of utxos to request from the peer in each
+// getmwebutxos message.
+func (s *mwebBatchSizer) size(peer string) uint16 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	size, ok := s.sizes[peer]
+	if !ok {
+		return defaultMwebSpanSize
+	}
+	return size
+}
+
+// spanSize returns the number of utxos to request in each getmwebutxos
+// message of the next batch, which is the median of the sizes of the peers
+// we know of. As the messages go to whichever peers are free, each message
+// prefers the peers whose own size it fits.
+func (s *mwebBatchSizer) spanSize() uint16 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.sizes) == 0 {
+		return defaultMwebSpanSize
+	}
+	sizes := make([]uint16, 0, len(s.sizes))
+	for _, size := range s.sizes {
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+	return sizes[len(sizes)/2]
+}
+
+// removePeer forgets the size of a disconnected peer.
+func (s *mwebBatchSizer) removePeer(peer string) {
+	s.mtx.Lock()
+	delete(s.sizes, peer)
+	s.mtx.Unlock()
+}
+
+// splitLeafSpan splits off the first size unspent leaves of the span,
+// returning them along with the span of the leaves left over, which is empty
+// if there are none.
+func splitLeafSpan(leafset *mweb.Leafset, span leafSpan,
+	size uint16) (leafSpan, leafSpan) {
+
+	if span.count <= size {
+		return span, leafSpan{}
+	}
+
+	index := span.start
+	for n := uint16(0); n < size && index < leafset.Size; index++ {
+		if leafset.Contains(index) {
+			n++
+		}
+	}
+	for index < leafset.Size && !leafset.Contains(index) {
+		index++
+	}
+
+	return leafSpan{start: span.start, count: size},
+		leafSpan{start: index, count: span.count - size}
+}
@@ -0,0 +1,140 @@
+package neutrino
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebBatchSizer tests that the batch sizes of fast peers grow and those
+// of slow or failing peers shrink, within bounds.
+func TestMwebBatchSizer(t *testing.T) {
+	t.Parallel()
+
+	s := newMwebBatchSizer()
+	require.Equal(t, uint16(defaultMwebSpanSize), s.size("fast"))
+	require.Equal(t, uint16(defaultMwebSpanSize), s.spanSize())
+
+	// Only quick answers to requests of the full size count towards
+	// growing.
+	s.record("fast", 100, time.Millisecond, nil)
+	require.Equal(t, uint16(defaultMwebSpanSize), s.size("fast"))
+	for i := 0; i < 10; i++ {
+		s.record("fast", s.size("fast"), time.Millisecond, nil)
+	}
+	require.Equal(t, uint16(wire.MaxMwebUtxosPerQuery), s.size("fast"))
+
+	// Slow answers and failures both shrink the size.
+	s.record("slow", 100, mwebSlowResponse, nil)
+	require.Equal(t, uint16(defaultMwebSpanSize/2), s.size("slow"))
+	s.record("slow", 100, time.Millisecond, errors.New("failed"))
+	require.Equal(t, uint16(defaultMwebSpanSize/4), s.size("slow"))
+	for i := 0; i < 10; i++ {
+		s.record("slow", 100, mwebSlowResponse, nil)
+	}
+	require.Equal(t, uint16(minMwebSpanSize), s.size("slow"))
+
+	// Answers in between leave the size as it is.
+	s.record("steady", defaultMwebSpanSize, mwebFastResponse, nil)
+	require.Equal(t, uint16(defaultMwebSpanSize), s.size("steady"))
+
+	require.Equal(t, uint16(defaultMwebSpanSize), s.spanSize())
+	s.removePeer("steady")
+	s.removePeer("fast")
+	require.Equal(t, uint16(minMwebSpanSize), s.spanSize())
+	require.Equal(t, uint16(defaultMwebSpanSize), s.size("fast"))
+}
+
+// TestSplitLeafSpan tests splitting the first unspent leaves off a span.
+func TestSplitLeafSpan(t *testing.T) {
+	t.Parallel()
+
+	// Every third leaf is spent.
+	mmr := newTestMwebMmr(30)
+	var spent []uint64
+	for i := uint64(0); i < 30; i += 3 {
+		spent = append(spent, i)
+	}
+	leafset := mmr.leafset(spent...)
+
+	span := leafSpan{start: 1, count: 20}
+	head, tail := splitLeafSpan(leafset, span, 20)
+	require.Equal(t, span, head)
+	require.Equal(t, leafSpan{}, tail)
+
+	head, tail = splitLeafSpan(leafset, span, 4)
+	require.Equal(t, leafSpan{start: 1, count: 4}, head)
+	require.Equal(t, leafSpan{start: 7, count: 16}, tail)
+
+	head, tail = splitLeafSpan(leafset, span, 5)
+	require.Equal(t, leafSpan{start: 1, count: 5}, head)
+	require.Equal(t, leafSpan{start: 8, count: 15}, tail)
+}
+
+// TestMwebUtxosBatchSizes tests that the spans fetched are split to the batch
+// size that suits our peers.
+func TestMwebUtxosBatchSizes(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	mmr := newTestMwebMmr(200)
+	var missing []uint64
+	for i := uint64(0); i < 200; i++ {
+		missing = append(missing, i)
+	}
+	coinDB.leafset = mmr.leafset(missing...)
+	leafset := mmr.leafset()
+
+	for i := 0; i < 4; i++ {
+		bm.mwebBatchSizer.record("peer", 0, mwebSlowResponse, nil)
+	}
+
+	var (
+		mtx   sync.Mutex
+		sizes = make(map[uint64]uint16)
+	)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					mtx.Lock()
+					sizes[msg.StartIndex] = msg.NumRequested
+					mtx.Unlock()
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	require.Equal(t, map[uint64]uint16{
+		0: 64, 64: 64, 128: 64, 192: 8,
+	}, sizes)
+	require.Len(t, coinDB.coins, len(missing))
+}
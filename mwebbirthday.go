@@ -0,0 +1,91 @@
+package neutrino
+
+import "sync/atomic"
+
+// setMwebSyncStartHeight sets the height of the first block whose mweb utxos
+// are fetched. If the height is lowered, such as for an earlier wallet
+// birthday, the utxos of the leaves that were skipped under the old height
+// but are wanted under the new one are fetched, as of the block that the
+// mweb coins db was last synced to. Should that fail, the old height is
+// restored so that setting the new one again retries the fetch.
+func (b *blockManager) setMwebSyncStartHeight(height uint32) error {
+	oldHeight := atomic.SwapUint32(&b.mwebSyncStartHeight, height)
+	if height >= oldHeight {
+		return nil
+	}
+
+	err := b.fetchSkippedMwebUtxos(height, oldHeight)
+	if err != nil {
+		atomic.CompareAndSwapUint32(
+			&b.mwebSyncStartHeight, height, oldHeight,
+		)
+	}
+	return err
+}
+
+// fetchSkippedMwebUtxos fetches the unspent mweb utxos created from the new
+// sync start height up to the old one, which the syncs under the old height
+// skipped. Those already in the mweb coins db, such as from a sync before the
+// start height was raised, aren't fetched again.
+func (b *blockManager) fetchSkippedMwebUtxos(height, oldHeight uint32) error {
+	b.mwebUtxosCallbacksMtx.Lock()
+	defer b.mwebUtxosCallbacksMtx.Unlock()
+
+	// If nothing has been synced yet, the next sync starts from the new
+	// height anyway.
+	leafset, err := b.cfg.MwebCoins.GetLeafset()
+	if err != nil {
+		return err
+	}
+	if leafset.Block == nil {
+		return nil
+	}
+
+	heightMap, err := b.cfg.MwebCoins.GetLeavesAtHeight()
+	if err != nil {
+		return err
+	}
+	start := mwebStartLeaf(heightMap, height)
+	end := mwebStartLeaf(heightMap, oldHeight)
+	if end > leafset.Size {
+		end = leafset.Size
+	}
+
+	var unspent []uint64
+	for i := start; i < end; i++ {
+		if leafset.Contains(i) {
+			unspent = append(unspent, i)
+		}
+	}
+	coins, err := b.cfg.MwebCoins.FetchLeaves(unspent)
+	if err != nil {
+		return err
+	}
+	stored := make(map[uint64]struct{}, len(coins))
+	for _, coin := range coins {
+		stored[coin.LeafIndex] = struct{}{}
+	}
+
+	var missing []uint64
+	for _, leaf := range unspent {
+		if _, ok := stored[leaf]; !ok {
+			missing = append(missing, leaf)
+		}
+	}
+	if len(missing) == 0 {
+		log.Debugf("Mweb utxos from height=%v already stored", height)
+		return nil
+	}
+
+	log.Infof("Fetching %v mweb utxos skipped from height=%v to "+
+		"height=%v", len(missing), height, oldHeight)
+
+	total, err := b.fetchSyncedMwebLeaves(leafset, missing)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Fetched %v skipped mweb utxos", total)
+
+	return nil
+}
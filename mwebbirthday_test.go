@@ -0,0 +1,143 @@
+package neutrino
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLowerMwebSyncStartHeight tests that lowering the mweb sync start
+// height fetches the utxos that were skipped under the old height, and that
+// nothing is fetched if they're already stored.
+func TestLowerMwebSyncStartHeight(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+	coinDB.leavesAtHeight = map[uint32]uint64{100: 10, 200: 25, 300: 40}
+
+	mmr := newTestMwebMmr(40)
+	leafset := mmr.leafset(4, 12, 30)
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{
+			Height:        300,
+			OutputRoot:    mmr.root(),
+			OutputMMRSize: leafset.Size,
+		}, leafset.Bits,
+	)
+	leafset.Height = 300
+	leafset.Block = header
+
+	peers := &mockMwebPeers{
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	var requests []wire.MsgGetMwebUtxos
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(reqs []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			for _, req := range reqs {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				requests = append(requests, *msg)
+			}
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range reqs {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(msg, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	// Before the first sync, there's nothing to fetch yet.
+	require.NoError(t, bm.setMwebSyncStartHeight(250))
+	require.NoError(t, bm.setMwebSyncStartHeight(150))
+	require.Empty(t, requests)
+
+	// The wallet was synced from height 250, so only the utxos from the
+	// end of block 200 onwards are stored.
+	require.NoError(t, bm.setMwebSyncStartHeight(250))
+	coinDB.leafset = leafset
+	for i := uint64(25); i < leafset.Size; i++ {
+		if leafset.Contains(i) {
+			coinDB.coins[i] = newMockMwebUtxo(mmr, i)
+		}
+	}
+
+	// Raising the height fetches nothing.
+	require.NoError(t, bm.setMwebSyncStartHeight(300))
+	require.NoError(t, bm.setMwebSyncStartHeight(250))
+	require.Empty(t, requests)
+
+	// Lowering the birthday to height 150 fetches the unspent leaves
+	// from the end of block 100, as of the synced block.
+	require.NoError(t, bm.setMwebSyncStartHeight(150))
+	require.Equal(t, []wire.MsgGetMwebUtxos{
+		*wire.NewMsgGetMwebUtxos(
+			header.BlockHash(), 10, 14, wire.MwebNetUtxoCompact,
+		),
+	}, requests)
+	for i := uint64(0); i < leafset.Size; i++ {
+		if i >= 10 && leafset.Contains(i) {
+			require.Contains(t, coinDB.coins, i)
+		} else {
+			require.NotContains(t, coinDB.coins, i)
+		}
+	}
+	require.Equal(t, leafset, coinDB.leafset)
+
+	// If the skipped utxos are already stored, such as from a sync
+	// before the height was raised, lowering it is a no-op.
+	for i := uint64(0); i < 10; i++ {
+		if leafset.Contains(i) {
+			coinDB.coins[i] = newMockMwebUtxo(mmr, i)
+		}
+	}
+	requests = nil
+	require.NoError(t, bm.setMwebSyncStartHeight(50))
+	require.Empty(t, requests)
+
+	// If the skipped utxos can't be fetched, the old height is restored
+	// so that lowering it again retries.
+	require.NoError(t, bm.setMwebSyncStartHeight(250))
+	delete(coinDB.coins, 10)
+	peers.mwebLeafset = &wire.MsgMwebLeafset{
+		BlockHash: header.BlockHash(),
+		Leafset:   mmr.leafset(4, 12).Bits,
+	}
+	require.Error(t, bm.setMwebSyncStartHeight(150))
+	require.EqualValues(t, 250, atomic.LoadUint32(&bm.mwebSyncStartHeight))
+	require.Empty(t, requests)
+
+	peers.mwebLeafset = mwebLeafset
+	require.NoError(t, bm.setMwebSyncStartHeight(150))
+	require.Equal(t, []wire.MsgGetMwebUtxos{
+		*wire.NewMsgGetMwebUtxos(
+			header.BlockHash(), 10, 1, wire.MwebNetUtxoCompact,
+		),
+	}, requests)
+	require.Contains(t, coinDB.coins, uint64(10))
+}
+
+// newMockMwebUtxo returns the utxo stored for the given leaf of the MMR.
+func newMockMwebUtxo(mmr *testMwebMmr, leafIdx uint64) *wire.MwebNetUtxo {
+	outputId := mmr.outputIds[leafIdx]
+	return &wire.MwebNetUtxo{
+		LeafIndex: leafIdx,
+		OutputId:  &outputId,
+	}
+}
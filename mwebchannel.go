@@ -0,0 +1,140 @@
+package neutrino
+
+import (
+	"sync"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// defaultMwebUtxoChannelBuffer is the number of events that an mweb utxo
+// channel buffers by default.
+const defaultMwebUtxoChannelBuffer = 16
+
+// MwebUtxoEvent is a delivery of mweb utxos on the channel returned by
+// MwebUtxoChannel, carrying what the mweb utxos callbacks would be called
+// with.
+type MwebUtxoEvent struct {
+	// Leafset is the leafset passed to the callbacks, which is nil for
+	// the utxos delivered while they're being fetched.
+	Leafset *mweb.Leafset
+
+	// Utxos are the mweb utxos delivered.
+	Utxos []*wire.MwebNetUtxo
+}
+
+// MwebUtxoChannelOption is a functional option argument to
+// MwebUtxoChannel.
+type MwebUtxoChannelOption func(*mwebUtxoChannelOptions)
+
+// mwebUtxoChannelOptions holds the options of a call to MwebUtxoChannel.
+type mwebUtxoChannelOptions struct {
+	buffer int
+	drop   bool
+}
+
+// MwebUtxoChannelBuffer is a channel option that sets the number of events
+// that the channel buffers. A buffer of zero leaves the channel unbuffered.
+func MwebUtxoChannelBuffer(buffer int) MwebUtxoChannelOption {
+	return func(o *mwebUtxoChannelOptions) {
+		o.buffer = buffer
+	}
+}
+
+// MwebUtxoChannelDropWhenFull is a channel option that has events dropped
+// while the channel's buffer is full, rather than the delivery waiting for
+// room. This keeps a slow consumer from holding up the mweb sync, at the
+// cost of it missing utxos.
+func MwebUtxoChannelDropWhenFull() MwebUtxoChannelOption {
+	return func(o *mwebUtxoChannelOptions) {
+		o.drop = true
+	}
+}
+
+// mwebUtxoChannel feeds the events of an mweb utxos callback into a
+// channel until it's cancelled.
+type mwebUtxoChannel struct {
+	events    chan MwebUtxoEvent
+	drop      bool
+	cancelled chan struct{}
+
+	// mtx is held for reading while an event is sent, so that the events
+	// channel is only closed once no send is under way.
+	mtx        sync.RWMutex
+	cancelOnce sync.Once
+}
+
+// send sends the event on the channel, unless the channel is cancelled
+// first, or is full and drops events when full.
+func (c *mwebUtxoChannel) send(event MwebUtxoEvent) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	select {
+	case <-c.cancelled:
+		return
+	default:
+	}
+
+	if c.drop {
+		select {
+		case c.events <- event:
+		default:
+			log.Debugf("Dropping %v mweb utxos from full channel",
+				len(event.Utxos))
+		}
+		return
+	}
+
+	select {
+	case c.events <- event:
+	case <-c.cancelled:
+	}
+}
+
+// cancel stops sending events, and closes the channel once no send is under
+// way. It's safe to call more than once.
+func (c *mwebUtxoChannel) cancel() {
+	c.cancelOnce.Do(func() {
+		close(c.cancelled)
+
+		c.mtx.Lock()
+		close(c.events)
+		c.mtx.Unlock()
+	})
+}
+
+// MwebUtxoChannel returns a channel that receives an event for each delivery
+// of mweb utxos to the mweb utxos callbacks, along with a function that
+// cancels it. By default the delivery waits while the channel's buffer is
+// full, which holds up the mweb sync until the channel is read from, just as
+// a slow callback would. The channel is closed once cancelled, and must be
+// cancelled once no longer read from.
+func (b *blockManager) MwebUtxoChannel(
+	options ...MwebUtxoChannelOption) (<-chan MwebUtxoEvent, func()) {
+
+	opts := &mwebUtxoChannelOptions{
+		buffer: defaultMwebUtxoChannelBuffer,
+	}
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.buffer < 0 {
+		opts.buffer = 0
+	}
+
+	// Callbacks can't be unregistered, so once the channel is cancelled
+	// its callback is left in place doing nothing.
+	c := &mwebUtxoChannel{
+		events:    make(chan MwebUtxoEvent, opts.buffer),
+		drop:      opts.drop,
+		cancelled: make(chan struct{}),
+	}
+	b.RegisterMwebUtxosCallback(func(leafset *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		c.send(MwebUtxoEvent{Leafset: leafset, Utxos: utxos})
+	})
+
+	return c.events, c.cancel
+}
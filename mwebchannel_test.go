@@ -0,0 +1,144 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// setupMwebUtxoChannel returns a block manager whose mweb utxos fetches are
+// served from the MMR, along with the leafset to fetch, which has a few
+// spent leaves so that the utxos are delivered over several responses.
+func setupMwebUtxoChannel(t *testing.T, mmr *testMwebMmr) (*blockManager,
+	*mweb.Leafset) {
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	bm.cfg.MwebCoins = newMockCoinDatabase()
+	bm.mwebBatchSizer.sizes["peer"] = 4
+
+	leafset := mmr.leafset(3, 7, 12)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	return bm, leafset
+}
+
+// TestMwebUtxoChannel tests that the mweb utxo channel receives the same
+// events as the mweb utxos callbacks, and that it's closed and receives no
+// more once cancelled.
+func TestMwebUtxoChannel(t *testing.T) {
+	t.Parallel()
+
+	mmr := newTestMwebMmr(20)
+	bm, leafset := setupMwebUtxoChannel(t, mmr)
+
+	var (
+		mtx       sync.Mutex
+		callbacks []MwebUtxoEvent
+	)
+	bm.RegisterMwebUtxosCallback(func(leafset *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		callbacks = append(callbacks, MwebUtxoEvent{
+			Leafset: leafset,
+			Utxos:   utxos,
+		})
+	})
+
+	events, cancel := bm.MwebUtxoChannel()
+	received := make(chan []MwebUtxoEvent)
+	go func() {
+		var all []MwebUtxoEvent
+		for event := range events {
+			all = append(all, event)
+		}
+		received <- all
+	}()
+
+	err := bm.getMwebUtxos(mmr.mwebHeader(), leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	// The utxos already stored are delivered with the leafset too.
+	require.NoError(t, bm.notifyAddedMwebUtxos(&mweb.Leafset{}))
+
+	cancel()
+	all := <-received
+
+	mtx.Lock()
+	require.Greater(t, len(callbacks), 2)
+	require.Equal(t, callbacks, all)
+	require.NotNil(t, all[len(all)-1].Leafset)
+	mtx.Unlock()
+
+	// Once cancelled, the channel's callback does nothing.
+	require.NoError(t, bm.notifyAddedMwebUtxos(&mweb.Leafset{}))
+	_, ok := <-events
+	require.False(t, ok)
+	cancel()
+}
+
+// TestMwebUtxoChannelDrop tests that a channel dropping events while full
+// doesn't hold up the mweb sync when nobody reads from it, while one waiting
+// for room does until it's cancelled.
+func TestMwebUtxoChannelDrop(t *testing.T) {
+	t.Parallel()
+
+	mmr := newTestMwebMmr(20)
+	bm, leafset := setupMwebUtxoChannel(t, mmr)
+
+	events, cancel := bm.MwebUtxoChannel(
+		MwebUtxoChannelBuffer(1), MwebUtxoChannelDropWhenFull(),
+	)
+	err := bm.getMwebUtxos(mmr.mwebHeader(), leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	require.Len(t, events, 1)
+	cancel()
+	event, ok := <-events
+	require.True(t, ok)
+	require.NotEmpty(t, event.Utxos)
+	_, ok = <-events
+	require.False(t, ok)
+
+	// An unbuffered channel that waits for room holds up the delivery
+	// until it's cancelled.
+	events, cancel = bm.MwebUtxoChannel(MwebUtxoChannelBuffer(0))
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- bm.notifyAddedMwebUtxos(&mweb.Leafset{})
+	}()
+
+	select {
+	case err := <-errChan:
+		t.Fatalf("delivery not held up: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	require.NoError(t, <-errChan)
+	_, ok = <-events
+	require.False(t, ok)
+}
@@ -0,0 +1,240 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// ErrMwebCheckpoint is returned when an mweb checkpoint's peak hashes don't
+// give its output root.
+var ErrMwebCheckpoint = errors.New("mweb checkpoint is inconsistent")
+
+// MwebCheckpoint is a trusted commitment to the output MMR as of some block,
+// such as one published periodically for light clients. It is used to
+// verify the mweb utxos of the leaves below it without walking their proofs
+// all the way up to the output root of the chain tip.
+//
+// TRUST ASSUMPTION: the checkpoint is taken on faith. Utxos below its leaf
+// count are only checked to hash to its peaks, and so to its output root,
+// not to the output root committed to by the block we're syncing to. A
+// wrong checkpoint, or one from a chain that has since been reorged away,
+// lets peers serve us utxos that don't exist, or hide ones that do. It
+// should only be taken from a source trusted as much as the block headers,
+// and be deep enough in the chain for a reorg past it to be out of the
+// question.
+type MwebCheckpoint struct {
+	// LeafCount is the number of leaves in the output MMR as of the
+	// checkpoint.
+	LeafCount uint64
+
+	// OutputRoot is the output root of the MMR as of the checkpoint.
+	OutputRoot chainhash.Hash
+
+	// PeakHashes are the hashes of the peaks of the MMR as of the
+	// checkpoint, from left to right. They must give the output root
+	// under the default rule, so that trusting the output root is all
+	// it takes to trust them.
+	PeakHashes []chainhash.Hash
+}
+
+// Validate checks that the checkpoint's peak hashes give its output root.
+func (c *MwebCheckpoint) Validate() error {
+	numNodes := uint64(leafIdx(c.LeafCount).nodeIdx())
+	if len(c.PeakHashes) != len(calcPeaks(numNodes)) {
+		return fmt.Errorf("%w: %v peak hashes for %v leaves",
+			ErrMwebCheckpoint, len(c.PeakHashes), c.LeafCount)
+	}
+
+	peakHashes := make([]*chainhash.Hash, len(c.PeakHashes))
+	for i := range c.PeakHashes {
+		peakHashes[i] = &c.PeakHashes[i]
+	}
+	root := DefaultMwebRootVariant.BagPeaks(peakHashes, numNodes)
+	if root == nil || !root.IsEqual(&c.OutputRoot) {
+		return fmt.Errorf("%w: peak hashes give output root %v, "+
+			"expected %v", ErrMwebCheckpoint, root, c.OutputRoot)
+	}
+
+	return nil
+}
+
+// covers returns whether the mweb utxos can be verified against the
+// checkpoint, which is the case if they all lie below its leaf count in an
+// output MMR that has grown from it. A nil checkpoint covers nothing.
+func (c *MwebCheckpoint) covers(leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) bool {
+
+	if c == nil || len(mwebUtxos.Utxos) == 0 ||
+		leafset.Size < c.LeafCount {
+
+		return false
+	}
+
+	last := mwebUtxos.Utxos[len(mwebUtxos.Utxos)-1]
+	return last.LeafIndex < c.LeafCount
+}
+
+// verifyMwebUtxosCheckpoint checks that the mweb utxos are consecutive
+// unspent leaves of the leafset, and that together with their proof hashes
+// they hash to the peaks of the checkpoint that they fall under. The proof
+// hashes are laid out as for the output MMR of the leafset, but only those
+// under the checkpoint's peaks are hashed, and nothing above them is
+// derived. The utxos must all lie below the checkpoint's leaf count.
+func verifyMwebUtxosCheckpoint(checkpoint *MwebCheckpoint,
+	mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) error {
+
+	if err := checkMwebUtxosFormat(mwebHeader, mwebUtxos); err != nil {
+		return err
+	}
+	if !checkpoint.covers(leafset, mwebUtxos) {
+		return fmt.Errorf("%w: start index %v not covered by "+
+			"checkpoint of %v leaves", ErrMwebBadProof,
+			mwebUtxos.StartIndex, checkpoint.LeafCount)
+	}
+
+	v := &verifyUtxosVars{
+		mwebUtxos:    mwebUtxos,
+		leafset:      leafset,
+		firstLeafIdx: leafIdx(mwebUtxos.StartIndex),
+		lastLeafIdx:  leafIdx(mwebUtxos.StartIndex),
+	}
+	if !v.checkUtxoLeaves() {
+		return fmt.Errorf("%w: start index %v", ErrMwebBadProof,
+			mwebUtxos.StartIndex)
+	}
+
+	w := &checkpointWalk{
+		mwebUtxos: mwebUtxos,
+		last:      v.lastLeafIdx,
+		hashes:    make(map[nodeIdx]*chainhash.Hash),
+	}
+	if !w.assignProofHashes(leafset) {
+		return fmt.Errorf("%w: start index %v", ErrMwebBadProof,
+			mwebUtxos.StartIndex)
+	}
+
+	numNodes := uint64(leafIdx(checkpoint.LeafCount).nodeIdx())
+	for i, peak := range calcPeaks(numNodes) {
+		if !w.hasUtxos(peak, peak.height()) {
+			continue
+		}
+		hash := w.nodeHash(peak, peak.height())
+		if hash == nil || !hash.IsEqual(&checkpoint.PeakHashes[i]) {
+			return fmt.Errorf("%w: start index %v doesn't hash "+
+				"to checkpoint peak %v", ErrMwebBadProof,
+				mwebUtxos.StartIndex, i)
+		}
+	}
+
+	return nil
+}
+
+// checkpointWalk assigns the utxos and proof hashes of an mwebutxos message
+// to the nodes of the output MMR that they're the hashes of, so that the
+// nodes under a checkpoint's peaks can be hashed without walking the rest
+// of the MMR.
+type checkpointWalk struct {
+	mwebUtxos  *wire.MsgMwebUtxos
+	last       leafIdx
+	hashesUsed int
+
+	// hashes holds the hashes of the nodes that were given as proof
+	// hashes, and of the leaves of the utxos.
+	hashes map[nodeIdx]*chainhash.Hash
+}
+
+// leafRange returns the first and last leaves under the node.
+func leafRange(i nodeIdx, height uint64) (leafIdx, leafIdx) {
+	first := (i + 2 - 1<<(height+1)).leafIdx()
+	last := (i - nodeIdx(height)).leafIdx()
+	return first, last
+}
+
+// hasUtxos returns whether any of the utxos are under the node.
+func (w *checkpointWalk) hasUtxos(i nodeIdx, height uint64) bool {
+	first, last := leafRange(i, height)
+	utxos := w.mwebUtxos.Utxos
+	j := sort.Search(len(utxos), func(j int) bool {
+		return leafIdx(utxos[j].LeafIndex) >= first
+	})
+	return j < len(utxos) && leafIdx(utxos[j].LeafIndex) <= last
+}
+
+// nextHash assigns the next proof hash to the node, returning false if
+// they've run out.
+func (w *checkpointWalk) nextHash(i nodeIdx) bool {
+	if w.hashesUsed == len(w.mwebUtxos.ProofHashes) {
+		return false
+	}
+	w.hashes[i] = w.mwebUtxos.ProofHashes[w.hashesUsed]
+	w.hashesUsed++
+	return true
+}
+
+// assignNode assigns the proof hashes and utxos under the node in the same
+// order as the full walk consumes them. A node without any of the utxos
+// under it is given a proof hash, while one with them is descended into.
+func (w *checkpointWalk) assignNode(i nodeIdx, height uint64) bool {
+	if !w.hasUtxos(i, height) {
+		return w.nextHash(i)
+	}
+	if height == 0 {
+		// The utxos were checked to be the consecutive unspent leaves
+		// of the span, so this is one of them.
+		utxos := w.mwebUtxos.Utxos
+		j := sort.Search(len(utxos), func(j int) bool {
+			return leafIdx(utxos[j].LeafIndex) >= i.leafIdx()
+		})
+		w.hashes[i] = i.hash(utxos[j].OutputId[:])
+		return true
+	}
+
+	return w.assignNode(i.left(height), height-1) &&
+		w.assignNode(i.right(), height-1)
+}
+
+// assignProofHashes assigns the proof hashes and utxos to their nodes in
+// the output MMR of the leafset, peak by peak up to the one holding the
+// last utxo, followed by the bagged hash of any peaks after it. It returns
+// false if the proof hashes don't fit the MMR.
+func (w *checkpointWalk) assignProofHashes(leafset *mweb.Leafset) bool {
+	nextNodeIdx := leafIdx(leafset.Size).nodeIdx()
+	peaks := calcPeaks(uint64(nextNodeIdx))
+	for k, peak := range peaks {
+		if !w.assignNode(peak, peak.height()) {
+			return false
+		}
+		if w.last.nodeIdx() <= peak {
+			if k != len(peaks)-1 && !w.nextHash(nextNodeIdx) {
+				return false
+			}
+			break
+		}
+	}
+
+	return w.hashesUsed == len(w.mwebUtxos.ProofHashes)
+}
+
+// nodeHash hashes the node from the hashes assigned under it, returning nil
+// if some are missing.
+func (w *checkpointWalk) nodeHash(i nodeIdx, height uint64) *chainhash.Hash {
+	if hash, ok := w.hashes[i]; ok {
+		return hash
+	}
+	if height == 0 {
+		return nil
+	}
+
+	left := w.nodeHash(i.left(height), height-1)
+	right := w.nodeHash(i.right(), height-1)
+	if left == nil || right == nil {
+		return nil
+	}
+	return i.parentHash(left[:], right[:])
+}
@@ -0,0 +1,219 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMwebCheckpoint returns a checkpoint of the MMR as of the given
+// number of leaves.
+func newTestMwebCheckpoint(t *testing.T, mmr *testMwebMmr,
+	leafCount uint64) *MwebCheckpoint {
+
+	outputIds := make(map[leafIdx]*chainhash.Hash)
+	for i := uint64(0); i < leafCount; i++ {
+		outputIds[leafIdx(i)] = &mmr.outputIds[i]
+	}
+	peakHashes, err := calcMmrPeakHashes(leafCount, outputIds)
+	require.NoError(t, err)
+
+	prefix := newTestMwebMmr(0)
+	prefix.outputIds = mmr.outputIds[:leafCount]
+
+	checkpoint := &MwebCheckpoint{
+		LeafCount:  leafCount,
+		OutputRoot: prefix.root(),
+		PeakHashes: peakHashes,
+	}
+	require.NoError(t, checkpoint.Validate())
+	return checkpoint
+}
+
+// TestMwebCheckpointValidate tests that a checkpoint is only valid if its
+// peak hashes give its output root.
+func TestMwebCheckpointValidate(t *testing.T) {
+	t.Parallel()
+
+	mmr := newTestMwebMmr(13)
+	checkpoint := newTestMwebCheckpoint(t, mmr, 13)
+	require.Len(t, checkpoint.PeakHashes, 3)
+
+	bad := *checkpoint
+	bad.OutputRoot = chainhash.Hash{0x01}
+	require.ErrorIs(t, bad.Validate(), ErrMwebCheckpoint)
+
+	bad = *checkpoint
+	bad.PeakHashes = checkpoint.PeakHashes[:2]
+	require.ErrorIs(t, bad.Validate(), ErrMwebCheckpoint)
+
+	bad = *checkpoint
+	bad.LeafCount = 14
+	require.ErrorIs(t, bad.Validate(), ErrMwebCheckpoint)
+}
+
+// TestVerifyMwebUtxosCheckpoint tests that the mweb utxos below a checkpoint
+// are verified against its peaks, whatever the spans and spent leaves.
+func TestVerifyMwebUtxosCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	mmr := newTestMwebMmr(29)
+	checkpoint := newTestMwebCheckpoint(t, mmr, 19)
+	mwebHeader := mmr.mwebHeader()
+
+	for _, spent := range [][]uint64{nil, {0}, {2, 9}, {7, 8, 16, 17}} {
+		leafset := mmr.leafset(spent...)
+		leafset.Height = 1
+
+		for start := uint64(0); start < checkpoint.LeafCount; start++ {
+			if !leafset.Contains(start) {
+				continue
+			}
+			for count := uint16(1); count <= 20; count++ {
+				req := wire.NewMsgGetMwebUtxos(
+					chainhash.Hash{}, start, count,
+					wire.MwebNetUtxoCompact,
+				)
+				resp := mmr.proveUtxos(leafset, req)
+				if !checkpoint.covers(leafset, resp) {
+					continue
+				}
+
+				err := verifyMwebUtxosCheckpoint(
+					checkpoint, mwebHeader, leafset, resp,
+				)
+				require.NoError(t, err, "start %v count %v "+
+					"spent %v", start, count, spent)
+			}
+		}
+	}
+
+	leafset := mmr.leafset(2, 9)
+	leafset.Height = 1
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 3, 8, wire.MwebNetUtxoCompact,
+	)
+
+	// A tampered utxo or proof hash under the checkpoint's peak doesn't
+	// hash to it. The proof hash for the peaks to the right is never
+	// looked at, as nothing above the checkpoint's peaks is derived.
+	resp := mmr.proveUtxos(leafset, req)
+	resp.Utxos[2].OutputId = &chainhash.Hash{0x01}
+	err := verifyMwebUtxosCheckpoint(checkpoint, mwebHeader, leafset, resp)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	lastIndex := resp.Utxos[len(resp.Utxos)-1].LeafIndex
+	positions, err := MwebProofHashPositions(leafset, 3, lastIndex)
+	require.NoError(t, err)
+	checkpointNodes := uint64(leafIdx(checkpoint.LeafCount).nodeIdx())
+	var underCheckpoint int
+	for i, pos := range positions {
+		resp := mmr.proveUtxos(leafset, req)
+		resp.ProofHashes[i] = &chainhash.Hash{0x01}
+		err := verifyMwebUtxosCheckpoint(
+			checkpoint, mwebHeader, leafset, resp,
+		)
+		if pos >= checkpointNodes {
+			require.NoError(t, err, "proof hash %v", i)
+			continue
+		}
+		require.ErrorIs(t, err, ErrMwebBadProof, "proof hash %v", i)
+		underCheckpoint++
+	}
+	require.NotZero(t, underCheckpoint)
+	require.Less(t, underCheckpoint, len(positions))
+
+	// Nor do utxos that skip an unspent leaf, or proofs with a hash too
+	// many or too few.
+	resp = mmr.proveUtxos(leafset, req)
+	resp.Utxos = append(resp.Utxos[:1], resp.Utxos[2:]...)
+	err = verifyMwebUtxosCheckpoint(checkpoint, mwebHeader, leafset, resp)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	resp = mmr.proveUtxos(leafset, req)
+	resp.ProofHashes = append(resp.ProofHashes, &chainhash.Hash{})
+	err = verifyMwebUtxosCheckpoint(checkpoint, mwebHeader, leafset, resp)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	resp = mmr.proveUtxos(leafset, req)
+	resp.ProofHashes = resp.ProofHashes[:len(resp.ProofHashes)-1]
+	err = verifyMwebUtxosCheckpoint(checkpoint, mwebHeader, leafset, resp)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+}
+
+// TestMwebLightVerify tests that with a checkpoint, the mweb utxos below it
+// are verified against the checkpoint without the output root being derived
+// again, while those above it are still verified in full.
+func TestMwebLightVerify(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+	go func() {
+		for range q.utxosChan {
+		}
+	}()
+
+	mmr := newTestMwebMmr(29)
+	q.leafset = mmr.leafset(2, 9)
+	q.leafset.Height = 1
+	bm.cfg.MwebCheckpoint = newTestMwebCheckpoint(t, mmr, 19)
+
+	// Deriving the output root bags the peaks, so counting the bagging
+	// tells us whether the full walk was made.
+	var bagged int
+	bm.cfg.MwebRootVariants = []MwebRootVariant{{
+		Name: "counting",
+		BagPeaks: func(peakHashes []*chainhash.Hash,
+			numNodes uint64) *chainhash.Hash {
+
+			bagged++
+			return DefaultMwebRootVariant.BagPeaks(
+				peakHashes, numNodes,
+			)
+		},
+	}}
+
+	handle := func(start uint64, count uint16) bool {
+		req := wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, start, count, wire.MwebNetUtxoCompact,
+		)
+		resp := mmr.proveUtxos(q.leafset, req)
+		return q.handleResponse(req, resp, "peer").Finished
+	}
+
+	// With the output root of the header wrong, utxos below the
+	// checkpoint still verify, as the root is never derived.
+	q.mwebHeader = mmr.mwebHeader()
+	q.mwebHeader.OutputRoot = chainhash.Hash{0x01}
+	require.True(t, handle(0, 10))
+	require.True(t, handle(10, 8))
+	require.Zero(t, bagged)
+
+	// Utxos reaching past the checkpoint are verified in full, and so
+	// fail against the wrong root.
+	require.False(t, handle(15, 5))
+	require.NotZero(t, bagged)
+
+	q.mwebHeader = mmr.mwebHeader()
+	bagged = 0
+	require.True(t, handle(15, 5))
+	require.NotZero(t, bagged)
+
+	// A checkpoint ahead of the MMR being synced doesn't cover it.
+	bagged = 0
+	bm.cfg.MwebCheckpoint = newTestMwebCheckpoint(t, mmr, 29)
+	short := newTestMwebMmr(25)
+	q.mwebHeader = short.mwebHeader()
+	q.leafset = short.leafset()
+	q.leafset.Height = 1
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 4, wire.MwebNetUtxoCompact,
+	)
+	resp := short.proveUtxos(q.leafset, req)
+	require.True(t, q.handleResponse(req, resp, "peer").Finished)
+	require.NotZero(t, bagged)
+}
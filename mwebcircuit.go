@@ -0,0 +1,164 @@
+package neutrino
+
+import (
+	"sync"
+	"time"
+)
+
+// MwebCircuitState is the state of the circuit breaker around the mweb
+// sync.
+type MwebCircuitState uint8
+
+const (
+	// MwebCircuitClosed is the state of an mweb sync that is running as
+	// normal.
+	MwebCircuitClosed MwebCircuitState = iota
+
+	// MwebCircuitOpen is the state of an mweb sync that has failed too
+	// many times in a row, and is cooling down before trying again.
+	MwebCircuitOpen
+
+	// MwebCircuitHalfOpen is the state of an mweb sync that has cooled
+	// down, and is trying again. It is closed by the next round that
+	// succeeds, or opened again by the next round that fails.
+	MwebCircuitHalfOpen
+)
+
+// String returns a human readable string for the circuit state.
+func (s MwebCircuitState) String() string {
+	switch s {
+	case MwebCircuitClosed:
+		return "closed"
+	case MwebCircuitOpen:
+		return "open"
+	case MwebCircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// mwebCircuitBreaker keeps the mweb sync from retrying in a tight loop when
+// it keeps failing, such as when all our peers have been banned or keep
+// failing verification. Once the sync has failed a number of times in a
+// row, the breaker opens, and the sync cools down before trying again. It
+// is safe for concurrent use.
+type mwebCircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	// now returns the current time. It can be overridden in tests.
+	now func() time.Time
+
+	mtx      sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+}
+
+// newMwebCircuitBreaker returns a closed circuit breaker that opens after
+// the given number of failures in a row, for the given cooldown. If the
+// threshold is zero, the breaker never opens.
+func newMwebCircuitBreaker(threshold int,
+	cooldown time.Duration) *mwebCircuitBreaker {
+
+	return &mwebCircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// state returns the current state of the breaker.
+func (c *mwebCircuitBreaker) state() MwebCircuitState {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	switch {
+	case !c.open:
+		return MwebCircuitClosed
+	case c.now().Sub(c.openedAt) < c.cooldown:
+		return MwebCircuitOpen
+	default:
+		return MwebCircuitHalfOpen
+	}
+}
+
+// remainingCooldown returns how long is left of the cooldown if the breaker
+// is open, or zero otherwise.
+func (c *mwebCircuitBreaker) remainingCooldown() time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.open {
+		return 0
+	}
+	remaining := c.cooldown - c.now().Sub(c.openedAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// failure records a failed round of the mweb sync, returning true if it
+// opened the breaker. A failure while half-open opens it again at once.
+func (c *mwebCircuitBreaker) failure() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.threshold <= 0 {
+		return false
+	}
+
+	c.failures++
+	if !c.open && c.failures < c.threshold {
+		return false
+	}
+
+	c.open = true
+	c.openedAt = c.now()
+	return true
+}
+
+// success records a successful round of the mweb sync, closing the breaker.
+func (c *mwebCircuitBreaker) success() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.failures = 0
+	c.open = false
+}
+
+// mwebSyncFailed records a failed round of the mweb sync in the circuit
+// breaker, and towards the full block fallback.
+func (b *blockManager) mwebSyncFailed(err error) {
+	b.mwebFallback.failure()
+	if b.mwebCircuit.failure() {
+		log.Warnf("Mweb sync failed %v times in a row, cooling down "+
+			"for %v: %v", b.mwebCircuit.threshold,
+			b.mwebCircuit.cooldown, err)
+	}
+}
+
+// waitMwebCircuit waits out the cooldown of the circuit breaker if it is
+// open, returning false if we're shutting down first.
+func (b *blockManager) waitMwebCircuit() bool {
+	remaining := b.mwebCircuit.remainingCooldown()
+	if remaining == 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(remaining):
+		log.Infof("Mweb sync cooled down, trying again")
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+// MwebCircuitState returns the state of the circuit breaker around the mweb
+// sync.
+func (b *blockManager) MwebCircuitState() MwebCircuitState {
+	return b.mwebCircuit.state()
+}
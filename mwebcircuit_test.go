@@ -0,0 +1,71 @@
+package neutrino
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebCircuitBreaker tests that the circuit breaker around the mweb sync
+// opens after repeated failures, half-opens once cooled down, and closes
+// again on success.
+func TestMwebCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	now := time.Unix(1000, 0)
+	bm.mwebCircuit = newMwebCircuitBreaker(3, time.Minute)
+	bm.mwebCircuit.now = func() time.Time {
+		return now
+	}
+	s := &ChainService{blockManager: bm}
+
+	errSync := errors.New("sync failed")
+	for i := 0; i < 2; i++ {
+		bm.mwebSyncFailed(errSync)
+		require.Equal(t, MwebCircuitClosed, s.MwebCircuitState())
+		require.True(t, bm.waitMwebCircuit())
+	}
+
+	bm.mwebSyncFailed(errSync)
+	require.Equal(t, MwebCircuitOpen, s.MwebCircuitState())
+	require.Equal(t, time.Minute, bm.mwebCircuit.remainingCooldown())
+
+	// The cooldown is waited out, unless we shut down first.
+	now = now.Add(time.Minute - time.Millisecond)
+	require.Equal(t, MwebCircuitOpen, s.MwebCircuitState())
+	require.True(t, bm.waitMwebCircuit())
+
+	now = now.Add(time.Millisecond)
+	require.Equal(t, MwebCircuitHalfOpen, s.MwebCircuitState())
+	require.Zero(t, bm.mwebCircuit.remainingCooldown())
+
+	// A failure while half-open opens the breaker again at once.
+	bm.mwebSyncFailed(errSync)
+	require.Equal(t, MwebCircuitOpen, s.MwebCircuitState())
+
+	close(bm.quit)
+	require.False(t, bm.waitMwebCircuit())
+
+	// Once half-open, a success closes the breaker, and it takes the
+	// full number of failures to open it again.
+	now = now.Add(time.Minute)
+	require.Equal(t, MwebCircuitHalfOpen, s.MwebCircuitState())
+	bm.mwebCircuit.success()
+	require.Equal(t, MwebCircuitClosed, s.MwebCircuitState())
+
+	bm.mwebSyncFailed(errSync)
+	bm.mwebSyncFailed(errSync)
+	require.Equal(t, MwebCircuitClosed, s.MwebCircuitState())
+
+	// Without a threshold, the breaker never opens.
+	bm.mwebCircuit = newMwebCircuitBreaker(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		bm.mwebSyncFailed(errSync)
+	}
+	require.Equal(t, MwebCircuitClosed, s.MwebCircuitState())
+}
@@ -0,0 +1,98 @@
+package neutrino
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebConfirmTracker holds the mweb utxos delivered to the mweb utxos
+// callbacks as pending until they have the confirmations required, then
+// passes them on to a confirmed utxos callback.
+type mwebConfirmTracker struct {
+	// confirmations is the number of confirmations a utxo needs, where
+	// a utxo in the tip block has one.
+	confirmations uint32
+
+	onConfirmed func(*mweb.Leafset, []*wire.MwebNetUtxo)
+
+	// pending holds the utxos yet to be confirmed, by leaf index.
+	mtx     sync.Mutex
+	pending map[uint64]*wire.MwebNetUtxo
+}
+
+// newMwebConfirmTracker returns a tracker that passes the utxos on to the
+// callback once they have the given number of confirmations. Zero is taken
+// as one.
+func newMwebConfirmTracker(confirmations uint32, onConfirmed func(
+	*mweb.Leafset, []*wire.MwebNetUtxo)) *mwebConfirmTracker {
+
+	if confirmations == 0 {
+		confirmations = 1
+	}
+	return &mwebConfirmTracker{
+		confirmations: confirmations,
+		onConfirmed:   onConfirmed,
+		pending:       make(map[uint64]*wire.MwebNetUtxo),
+	}
+}
+
+// handle is an mweb utxos callback. The utxos from blocks are held as
+// pending, and mempool outputs are ignored. Utxos are only confirmed once a
+// leafset is delivered, as its height is that of the chain tip that the
+// mweb sync has reached. The pending utxos whose leaves are beyond the
+// leafset were disconnected by a reorg and are dropped, while a utxo added
+// again under the same leaf replaces the one before.
+func (t *mwebConfirmTracker) handle(leafset *mweb.Leafset,
+	utxos []*wire.MwebNetUtxo) {
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, utxo := range utxos {
+		if utxo.Height > 0 {
+			t.pending[utxo.LeafIndex] = utxo
+		}
+	}
+	if leafset == nil {
+		return
+	}
+
+	var confirmed []*wire.MwebNetUtxo
+	for leaf, utxo := range t.pending {
+		switch {
+		case leaf >= leafset.Size ||
+			uint32(utxo.Height) > leafset.Height:
+
+			delete(t.pending, leaf)
+
+		case leafset.Height-uint32(utxo.Height)+1 >= t.confirmations:
+			confirmed = append(confirmed, utxo)
+			delete(t.pending, leaf)
+		}
+	}
+	if len(confirmed) == 0 {
+		return
+	}
+
+	slices.SortFunc(confirmed, func(a, b *wire.MwebNetUtxo) int {
+		return cmp.Compare(a.LeafIndex, b.LeafIndex)
+	})
+	t.onConfirmed(leafset, confirmed)
+}
+
+// RegisterMwebConfirmedUtxosCallback will register a callback that will
+// fire when mweb utxos have MwebConfirmations confirmations. The utxos are
+// held as pending from when they're received until then, and dropped if
+// their block is disconnected first. The callback is given the leafset of
+// the block that confirmed them, which tells whether they've since been
+// spent. Mempool outputs are never passed to it.
+func (b *blockManager) RegisterMwebConfirmedUtxosCallback(
+	onConfirmed func(*mweb.Leafset, []*wire.MwebNetUtxo)) {
+
+	tracker := newMwebConfirmTracker(b.cfg.MwebConfirmations, onConfirmed)
+	b.RegisterMwebUtxosCallback(tracker.handle)
+}
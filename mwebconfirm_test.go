@@ -0,0 +1,86 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebConfirmedUtxos tests that mweb utxos are only passed to the
+// confirmed utxos callbacks once they have the configured number of
+// confirmations, and that those disconnected by a reorg before then never
+// are.
+func TestMwebConfirmedUtxos(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	bm.cfg.MwebConfirmations = 3
+
+	var (
+		gotLeafset *mweb.Leafset
+		got        []*wire.MwebNetUtxo
+	)
+	bm.RegisterMwebConfirmedUtxosCallback(func(leafset *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		require.Nil(t, got, "unexpected confirmed utxos")
+		gotLeafset, got = leafset, utxos
+	})
+
+	deliver := func(leafset *mweb.Leafset, utxos ...*wire.MwebNetUtxo) {
+		for _, cb := range bm.mwebUtxosCallbacks {
+			cb(leafset, utxos)
+		}
+	}
+	confirmed := func() []*wire.MwebNetUtxo {
+		defer func() {
+			gotLeafset, got = nil, nil
+		}()
+		return got
+	}
+
+	// The utxos at height 5 are delivered while being fetched, and then
+	// along with the leafset.
+	utxo0 := &wire.MwebNetUtxo{Height: 5, LeafIndex: 0}
+	utxo1 := &wire.MwebNetUtxo{Height: 5, LeafIndex: 1}
+	utxo2 := &wire.MwebNetUtxo{Height: 5, LeafIndex: 2}
+	deliver(nil, utxo2, utxo0)
+	deliver(&mweb.Leafset{Size: 3, Height: 5}, utxo1)
+	require.Nil(t, confirmed())
+
+	// Mempool outputs have no block, so are never confirmed.
+	deliver(nil, &wire.MwebNetUtxo{LeafIndex: 100})
+
+	utxo3 := &wire.MwebNetUtxo{Height: 6, LeafIndex: 3}
+	deliver(&mweb.Leafset{Size: 4, Height: 6}, utxo3)
+	require.Nil(t, confirmed())
+
+	// The block at height 7 gives the utxos at height 5 their third
+	// confirmation.
+	leafset7 := &mweb.Leafset{Size: 4, Height: 7}
+	deliver(leafset7)
+	require.Same(t, leafset7, gotLeafset)
+	require.Equal(t, []*wire.MwebNetUtxo{utxo0, utxo1, utxo2}, confirmed())
+
+	// The blocks at heights 6 and 7 are reorged out, and the block that
+	// replaces the one at height 6 adds a different utxo under leaf 3.
+	utxo3b := &wire.MwebNetUtxo{Height: 6, LeafIndex: 3}
+	deliver(&mweb.Leafset{Size: 3, Height: 5})
+	deliver(&mweb.Leafset{Size: 4, Height: 6}, utxo3b)
+	deliver(&mweb.Leafset{Size: 4, Height: 7})
+	require.Nil(t, confirmed())
+
+	leafset8 := &mweb.Leafset{Size: 4, Height: 8}
+	deliver(leafset8)
+	require.Same(t, leafset8, gotLeafset)
+	utxos := confirmed()
+	require.Len(t, utxos, 1)
+	require.Same(t, utxo3b, utxos[0])
+
+	// Nothing is left pending.
+	deliver(&mweb.Leafset{Size: 4, Height: 100})
+	require.Nil(t, confirmed())
+}
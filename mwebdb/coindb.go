@@ -2,8 +2,11 @@ package mwebdb
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"slices"
 
 	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
 	"github.com/ltcmweb/ltcd/ltcutil/mweb"
@@ -28,8 +31,31 @@ var (
 	// leaf indices and output IDs.
 	leafBucket = []byte("leaves")
 
+	// leafsetBucket is the bucket that stores the leafsets of the most
+	// recent blocks, keyed by block height.
+	leafsetBucket = []byte("leafsets")
+
 	// rollbackHeight is the key that stores the rollback height.
 	rollbackHeight = []byte("rollbackHeight")
+
+	// verifiedSpans is the key that stores the spans of leaves written
+	// by an mweb utxos fetch that has yet to store its leafset.
+	verifiedSpans = []byte("verifiedSpans")
+)
+
+// LeafsetRetention is the default number of blocks, up to and including that
+// of the current leafset, whose leafsets are retained.
+const LeafsetRetention = 12
+
+// The bits of the byte that follows a stored coin, marking it. Coins stored
+// before coins were marked lack the byte.
+const (
+	// coinVerified marks a coin that has been verified.
+	coinVerified = 1 << iota
+
+	// coinSpent marks a coin that has been spent but whose body was
+	// retained rather than purged.
+	coinSpent
 )
 
 var (
@@ -43,10 +69,31 @@ var (
 	// ErrUnexpectedValueLen is returned when the bytes value is
 	// of an unexpected length.
 	ErrUnexpectedValueLen = fmt.Errorf("unexpected value length")
+
+	// ErrCoinUnverified is returned in safe mode when a coin is found
+	// that isn't marked verified.
+	ErrCoinUnverified = fmt.Errorf("coin not marked verified")
+
+	// ErrLeafsetNotRetained is returned when the leafset at a height is
+	// not retained, either because it's too old or because the leafset
+	// was never stored at that height.
+	ErrLeafsetNotRetained = fmt.Errorf("leafset not retained")
 )
 
 // CoinDatabase is an interface which represents an object that is capable of
 // storing and retrieving coins according to their corresponding output ID.
+//
+// Implementations must be safe for concurrent use, as wallets read coins
+// while the mweb sync is writing them. Each method must behave atomically
+// with snapshot isolation: a read sees either all or none of the coins and
+// leaves written by a concurrent PutCoins or PutLeafsetAndPurge call, never
+// part of a batch.
+//
+// Isolation only holds within a single call. The leafset returned by one
+// call may have been replaced, and its spent coins purged, by the time of
+// the next, so a reader that needs the leafset and its coins to agree
+// should use a single call that returns both, such as the CoinStore's
+// FetchUnspentCoins.
 type CoinDatabase interface {
 	// Get rollback height.
 	GetRollbackHeight() (uint32, error)
@@ -90,9 +137,18 @@ type CoinDatabase interface {
 }
 
 // CoinStore is an implementation of the CoinDatabase interface which is
-// backed by boltdb.
+// backed by boltdb. Every write is made within a single read-write
+// transaction, and every read within a single read transaction, which bolt
+// isolates from any concurrent write.
 type CoinStore struct {
 	db walletdb.DB
+
+	// retention is the number of blocks whose leafsets are retained.
+	retention uint32
+
+	// safeMode, if set, keeps coins that aren't marked verified from
+	// being fetched.
+	safeMode bool
 }
 
 // A compile-time check to ensure the CoinStore adheres to the CoinDatabase
@@ -122,13 +178,36 @@ func NewCoinStore(db walletdb.DB) (*CoinStore, error) {
 			return err
 		}
 		_, err = rootBucket.CreateBucketIfNotExists(leafBucket)
+		if err != nil {
+			return err
+		}
+		_, err = rootBucket.CreateBucketIfNotExists(leafsetBucket)
 		return err
 	})
 	if err != nil && err != walletdb.ErrBucketExists {
 		return nil, err
 	}
 
-	return &CoinStore{db: db}, nil
+	return &CoinStore{db: db, retention: LeafsetRetention}, nil
+}
+
+// SetLeafsetRetention sets the number of blocks, up to and including that
+// of the current leafset, whose leafsets are retained, in place of
+// LeafsetRetention. A retention of zero retains none. The leafsets outside
+// of the new retention are deleted when the next leafset is stored. It must
+// be called before the store is used.
+func (c *CoinStore) SetLeafsetRetention(retention uint32) {
+	c.retention = retention
+}
+
+// SetSafeMode sets whether the coins that aren't marked verified are kept
+// from being fetched, until they're marked verified by MarkCoinsVerified.
+// The coins passed to PutCoins are marked verified as they're stored, so in
+// safe mode only coins stored before coins were marked, or written other
+// than through PutCoins, are kept back. It must be called before the store
+// is used.
+func (c *CoinStore) SetSafeMode(safeMode bool) {
+	c.safeMode = safeMode
 }
 
 // Get rollback height.
@@ -246,19 +325,27 @@ func (c *CoinStore) RollbackLeavesAtHeight(height uint32) error {
 //
 // NOTE: This method is a part of the CoinDatabase interface.
 func (c *CoinStore) GetLeafset() (leafset *mweb.Leafset, err error) {
-	leafset = &mweb.Leafset{}
 	err = walletdb.View(c.db, func(tx walletdb.ReadTx) error {
-		rootBucket := tx.ReadBucket(rootBucket)
-
-		b := rootBucket.Get([]byte("leafset"))
-		if b == nil {
-			return nil
-		}
-		return leafset.Deserialize(bytes.NewReader(b))
+		leafset, err = readLeafset(tx.ReadBucket(rootBucket))
+		return err
 	})
 	return
 }
 
+// readLeafset reads the leafset from the root bucket, returning an empty one
+// if none has been stored.
+func readLeafset(rootBucket walletdb.ReadBucket) (*mweb.Leafset, error) {
+	leafset := &mweb.Leafset{}
+	b := rootBucket.Get([]byte("leafset"))
+	if b == nil {
+		return leafset, nil
+	}
+	if err := leafset.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return leafset, nil
+}
+
 // Set the leafset and purge the specified leaves and their associated
 // coins from persistent storage.
 //
@@ -266,6 +353,18 @@ func (c *CoinStore) GetLeafset() (leafset *mweb.Leafset, err error) {
 func (c *CoinStore) PutLeafsetAndPurge(leafset *mweb.Leafset,
 	removedLeaves []uint64) error {
 
+	return c.PutLeafsetAndRetain(leafset, removedLeaves, nil)
+}
+
+// PutLeafsetAndRetain sets the leafset and purges the removed leaves and
+// their associated coins from persistent storage, as PutLeafsetAndPurge
+// does, but marks the coins of the retained leaves spent in place of
+// purging them. The retained coins are left out by FetchCoin and FetchLeaves
+// as the purged ones are, but can still be fetched by FetchRetainedCoin, and
+// IsCoinSpent reports them spent.
+func (c *CoinStore) PutLeafsetAndRetain(leafset *mweb.Leafset,
+	removedLeaves, retainedLeaves []uint64) error {
+
 	return walletdb.Update(c.db, func(tx walletdb.ReadWriteTx) error {
 		rootBucket := tx.ReadWriteBucket(rootBucket)
 		coinBucket := rootBucket.NestedReadWriteBucket(coinBucket)
@@ -281,6 +380,21 @@ func (c *CoinStore) PutLeafsetAndPurge(leafset *mweb.Leafset,
 			return err
 		}
 
+		// Databases created before leafsets were retained lack the
+		// bucket.
+		leafsetBucket, err := rootBucket.CreateBucketIfNotExists(
+			leafsetBucket,
+		)
+		if err != nil {
+			return err
+		}
+		err = putRetainedLeafset(
+			leafsetBucket, leafset, buf.Bytes(), c.retention,
+		)
+		if err != nil {
+			return err
+		}
+
 		for _, leafIndex := range removedLeaves {
 			leafIndex := binary.LittleEndian.AppendUint64(nil, leafIndex)
 			outputId := leafBucket.Get(leafIndex)
@@ -295,14 +409,130 @@ func (c *CoinStore) PutLeafsetAndPurge(leafset *mweb.Leafset,
 			}
 		}
 
+		for _, leaf := range retainedLeaves {
+			leafIndex := binary.LittleEndian.AppendUint64(nil, leaf)
+			outputId := bytes.Clone(leafBucket.Get(leafIndex))
+			if outputId == nil {
+				return ErrLeafNotFound
+			}
+			err = markCoin(coinBucket, outputId, coinSpent)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// markCoin adds the mark to those of the stored coin with the given output
+// ID.
+func markCoin(coinBucket walletdb.ReadWriteBucket, outputId []byte,
+	mark byte) error {
+
+	coinBytes := coinBucket.Get(outputId)
+	if coinBytes == nil {
+		return ErrCoinNotFound
+	}
+
+	// Anything after the coin is replaced by the mark.
+	coinLen, oldMark, err := splitCoinMark(coinBytes)
+	if err != nil {
+		return err
+	}
+
+	marked := make([]byte, coinLen+1)
+	copy(marked, coinBytes[:coinLen])
+	marked[coinLen] = oldMark | mark
+	return coinBucket.Put(outputId, marked)
+}
+
+// putRetainedLeafset stores the serialized leafset under its height, unless
+// none are retained, then deletes the leafsets that are no longer retained.
+// Those above the height are deleted too, as they were disconnected by a
+// reorg.
+func putRetainedLeafset(leafsetBucket walletdb.ReadWriteBucket,
+	leafset *mweb.Leafset, serialized []byte, retention uint32) error {
+
+	if retention > 0 {
+		err := leafsetBucket.Put(
+			binary.LittleEndian.AppendUint32(nil, leafset.Height),
+			serialized,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	var expired [][]byte
+	err := leafsetBucket.ForEach(func(k, _ []byte) error {
+		height := binary.LittleEndian.Uint32(k)
+		if height > leafset.Height ||
+			height+retention <= leafset.Height {
+
+			expired = append(expired, bytes.Clone(k))
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err := leafsetBucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FetchLeafsetAtHeight fetches the leafset as it was at the given block
+// height.
+//
+// NOTE: This method is a part of the CoinDatabase interface.
+func (c *CoinStore) FetchLeafsetAtHeight(height uint32) (*mweb.Leafset,
+	error) {
+
+	leafset := &mweb.Leafset{}
+	err := walletdb.View(c.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(rootBucket)
+		leafsetBucket := rootBucket.NestedReadBucket(leafsetBucket)
+		if leafsetBucket == nil {
+			return ErrLeafsetNotRetained
+		}
+
+		b := leafsetBucket.Get(
+			binary.LittleEndian.AppendUint32(nil, height),
+		)
+		if b == nil {
+			return ErrLeafsetNotRetained
+		}
+		return leafset.Deserialize(bytes.NewReader(b))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return leafset, nil
 }
 
-// PutCoins stores coins to persistent storage.
+// PutCoins stores coins to persistent storage, marking them verified, as
+// coins are only stored once they've been verified.
 //
 // NOTE: This method is a part of the CoinDatabase interface.
 func (c *CoinStore) PutCoins(coins []*wire.MwebNetUtxo) error {
+	return c.putCoins(coins, coinVerified)
+}
+
+// PutUnverifiedCoins stores coins to persistent storage without marking
+// them verified, for coins that couldn't be verified against the output
+// root, so that they're kept from being fetched in safe mode.
+func (c *CoinStore) PutUnverifiedCoins(coins []*wire.MwebNetUtxo) error {
+	return c.putCoins(coins, 0)
+}
+
+// putCoins stores coins to persistent storage with the given mark.
+func (c *CoinStore) putCoins(coins []*wire.MwebNetUtxo, mark byte) error {
 	return walletdb.Update(c.db, func(tx walletdb.ReadWriteTx) error {
 		rootBucket := tx.ReadWriteBucket(rootBucket)
 		coinBucket := rootBucket.NestedReadWriteBucket(coinBucket)
@@ -317,6 +547,7 @@ func (c *CoinStore) PutCoins(coins []*wire.MwebNetUtxo) error {
 			if err = coin.Output.Serialize(&buf); err != nil {
 				return err
 			}
+			buf.WriteByte(mark)
 
 			err = coinBucket.Put(coin.OutputId[:], buf.Bytes())
 			if err != nil {
@@ -335,12 +566,48 @@ func (c *CoinStore) PutCoins(coins []*wire.MwebNetUtxo) error {
 }
 
 // FetchCoin attempts to fetch a coin with the given output ID from
-// persistent storage.
+// persistent storage. A coin that was spent and retained is reported not
+// found, as it would be had it been purged.
 //
 // NOTE: This method is a part of the CoinDatabase interface.
 func (c *CoinStore) FetchCoin(outputId *chainhash.Hash) (*wire.MwebOutput, error) {
-	var coin wire.MwebOutput
+	coin, mark, err := c.fetchCoin(outputId)
+	switch {
+	case err != nil:
+		return nil, err
+	case mark&coinSpent != 0:
+		return nil, ErrCoinNotFound
+	case c.safeMode && mark&coinVerified == 0:
+		return nil, ErrCoinUnverified
+	}
+	return coin, nil
+}
+
+// FetchRetainedCoin fetches the coin with the given output ID that was spent
+// and retained by PutLeafsetAndRetain. ErrCoinNotFound is returned if no
+// such coin is stored.
+func (c *CoinStore) FetchRetainedCoin(outputId *chainhash.Hash) (
+	*wire.MwebOutput, error) {
+
+	coin, mark, err := c.fetchCoin(outputId)
+	switch {
+	case err != nil:
+		return nil, err
+	case mark&coinSpent == 0:
+		return nil, ErrCoinNotFound
+	}
+	return coin, nil
+}
 
+// fetchCoin fetches the stored coin with the given output ID along with the
+// bits that it is marked with.
+func (c *CoinStore) fetchCoin(outputId *chainhash.Hash) (*wire.MwebOutput,
+	byte, error) {
+
+	var (
+		coin wire.MwebOutput
+		mark byte
+	)
 	err := walletdb.View(c.db, func(tx walletdb.ReadTx) error {
 		rootBucket := tx.ReadBucket(rootBucket)
 		coinBucket := rootBucket.NestedReadBucket(coinBucket)
@@ -356,62 +623,389 @@ func (c *CoinStore) FetchCoin(outputId *chainhash.Hash) (*wire.MwebOutput, error
 		if err != nil {
 			return err
 		}
-		return coin.Deserialize(buf)
+		if err = coin.Deserialize(buf); err != nil {
+			return err
+		}
+		mark = readCoinMark(buf)
+		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return &coin, nil
+	return &coin, mark, nil
 }
 
-// FetchLeaves fetches the coins corresponding to the leaves specified.
+// IsCoinSpent reports whether the stored coin with the given output ID was
+// spent and retained by PutLeafsetAndRetain. ErrCoinNotFound is returned if
+// no such coin is stored.
+func (c *CoinStore) IsCoinSpent(outputId *chainhash.Hash) (bool, error) {
+	var spent bool
+	err := walletdb.View(c.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(rootBucket)
+		coinBucket := rootBucket.NestedReadBucket(coinBucket)
+
+		coinBytes := coinBucket.Get(outputId[:])
+		if coinBytes == nil {
+			return ErrCoinNotFound
+		}
+		_, mark, err := splitCoinMark(coinBytes)
+		spent = mark&coinSpent != 0
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return spent, nil
+}
+
+// FetchLeaves fetches the coins corresponding to the leaves specified. The
+// coins that were spent and retained are left out, as are those that aren't
+// marked verified in safe mode, as if they weren't stored.
 //
 // NOTE: This method is a part of the CoinDatabase interface.
 func (c *CoinStore) FetchLeaves(leaves []uint64) ([]*wire.MwebNetUtxo, error) {
+	return c.fetchLeaves(leaves, c.safeMode)
+}
+
+// FetchLeavesUnchecked fetches the coins corresponding to the leaves
+// specified as FetchLeaves does, but including the coins that aren't marked
+// verified even in safe mode, so that they can be verified again.
+func (c *CoinStore) FetchLeavesUnchecked(leaves []uint64) (
+	[]*wire.MwebNetUtxo, error) {
+
+	return c.fetchLeaves(leaves, false)
+}
+
+// fetchLeaves fetches the coins corresponding to the leaves specified,
+// leaving out those that aren't marked verified if verifiedOnly is set.
+func (c *CoinStore) fetchLeaves(leaves []uint64, verifiedOnly bool) (
+	coins []*wire.MwebNetUtxo, err error) {
+
+	err = walletdb.View(c.db, func(tx walletdb.ReadTx) error {
+		coins, err = readLeaves(
+			tx.ReadBucket(rootBucket), leaves, verifiedOnly,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coins, nil
+}
+
+// FetchUnspentCoins fetches the leafset along with the coins of its unspent
+// leaves, as FetchLeaves would. Both are read within a single read
+// transaction, so unlike separate calls to GetLeafset and FetchLeaves, the
+// coins are those of the leafset returned even while the mweb sync writes
+// a new leafset and purges the coins spent in it.
+func (c *CoinStore) FetchUnspentCoins() (leafset *mweb.Leafset,
+	coins []*wire.MwebNetUtxo, err error) {
+
+	err = walletdb.View(c.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(rootBucket)
+		leafset, err = readLeafset(rootBucket)
+		if err != nil {
+			return err
+		}
+
+		var leaves []uint64
+		for i := uint64(0); i < leafset.Size; i++ {
+			if leafset.Contains(i) {
+				leaves = append(leaves, i)
+			}
+		}
+		coins, err = readLeaves(rootBucket, leaves, c.safeMode)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return leafset, coins, nil
+}
+
+// readLeaves reads the coins corresponding to the leaves specified from the
+// root bucket, leaving out those that were spent and retained, and those
+// that aren't marked verified if verifiedOnly is set.
+func readLeaves(rootBucket walletdb.ReadBucket, leaves []uint64,
+	verifiedOnly bool) ([]*wire.MwebNetUtxo, error) {
+
+	coinBucket := rootBucket.NestedReadBucket(coinBucket)
+	leafBucket := rootBucket.NestedReadBucket(leafBucket)
+
 	var coins []*wire.MwebNetUtxo
+	for _, leaf := range leaves {
+		leafIndex := binary.LittleEndian.AppendUint64(nil, leaf)
+		outputId := bytes.Clone(leafBucket.Get(leafIndex))
+		if outputId == nil {
+			continue
+		}
+
+		coinBytes := coinBucket.Get(outputId)
+		if coinBytes == nil {
+			return nil, ErrCoinNotFound
+		}
+		buf := bytes.NewReader(coinBytes)
+
+		coin := &wire.MwebNetUtxo{
+			LeafIndex: leaf,
+			Output:    &wire.MwebOutput{},
+			OutputId:  (*chainhash.Hash)(outputId),
+		}
+
+		err := binary.Read(buf, binary.LittleEndian, &coin.Height)
+		if err != nil {
+			return nil, err
+		}
+		if err = coin.Output.Deserialize(buf); err != nil {
+			return nil, err
+		}
+		mark := readCoinMark(buf)
+		if mark&coinSpent != 0 ||
+			verifiedOnly && mark&coinVerified == 0 {
+
+			continue
+		}
+		coins = append(coins, coin)
+	}
+
+	return coins, nil
+}
 
+// readCoinMark reads what follows a stored coin, returning the bits that
+// the coin is marked with.
+func readCoinMark(r *bytes.Reader) byte {
+	mark, err := r.ReadByte()
+	if err != nil {
+		return 0
+	}
+	return mark
+}
+
+// splitCoinMark returns the length of the stored coin without what follows
+// it, and the bits that it is marked with.
+func splitCoinMark(coinBytes []byte) (int, byte, error) {
+	buf := bytes.NewReader(coinBytes)
+	var height int32
+	err := binary.Read(buf, binary.LittleEndian, &height)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = (&wire.MwebOutput{}).Deserialize(buf); err != nil {
+		return 0, 0, err
+	}
+
+	coinLen := len(coinBytes) - buf.Len()
+	return coinLen, readCoinMark(buf), nil
+}
+
+// UnverifiedLeaves returns the leaves whose stored coins aren't marked
+// verified, in ascending order.
+func (c *CoinStore) UnverifiedLeaves() ([]uint64, error) {
+	var leaves []uint64
 	err := walletdb.View(c.db, func(tx walletdb.ReadTx) error {
 		rootBucket := tx.ReadBucket(rootBucket)
 		coinBucket := rootBucket.NestedReadBucket(coinBucket)
 		leafBucket := rootBucket.NestedReadBucket(leafBucket)
 
-		for _, leaf := range leaves {
-			leafIndex := binary.LittleEndian.AppendUint64(nil, leaf)
-			outputId := bytes.Clone(leafBucket.Get(leafIndex))
-			if outputId == nil {
-				continue
+		// The leaf indices are little endian, so the bucket isn't in
+		// leaf order.
+		err := leafBucket.ForEach(func(k, v []byte) error {
+			if len(k) != 8 {
+				return ErrUnexpectedValueLen
 			}
-
-			coinBytes := coinBucket.Get(outputId)
+			coinBytes := coinBucket.Get(v)
 			if coinBytes == nil {
 				return ErrCoinNotFound
 			}
-			buf := bytes.NewReader(coinBytes)
 
-			coin := &wire.MwebNetUtxo{
-				LeafIndex: leaf,
-				Output:    &wire.MwebOutput{},
-				OutputId:  (*chainhash.Hash)(outputId),
-			}
-			coins = append(coins, coin)
-
-			err := binary.Read(buf, binary.LittleEndian, &coin.Height)
+			_, mark, err := splitCoinMark(coinBytes)
 			if err != nil {
 				return err
 			}
-			if err = coin.Output.Deserialize(buf); err != nil {
+			if mark&coinVerified == 0 {
+				leaves = append(
+					leaves, binary.LittleEndian.Uint64(k),
+				)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		slices.Sort(leaves)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return leaves, nil
+}
+
+// MarkCoinsVerified marks the stored coins of the leaves specified as
+// verified, once they've been verified again. Leaves without a stored coin
+// are skipped.
+func (c *CoinStore) MarkCoinsVerified(leaves []uint64) error {
+	return walletdb.Update(c.db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket := tx.ReadWriteBucket(rootBucket)
+		coinBucket := rootBucket.NestedReadWriteBucket(coinBucket)
+		leafBucket := rootBucket.NestedReadWriteBucket(leafBucket)
+
+		for _, leaf := range leaves {
+			leafIndex := binary.LittleEndian.AppendUint64(nil, leaf)
+			outputId := bytes.Clone(leafBucket.Get(leafIndex))
+			if outputId == nil {
+				continue
+			}
+			err := markCoin(coinBucket, outputId, coinVerified)
+			if err != nil {
 				return err
 			}
 		}
 
 		return nil
 	})
+}
+
+// VerifiedSpan is a span of leaves, from Start up to but excluding End,
+// whose unspent coins have all been verified and stored.
+type VerifiedSpan struct {
+	Start uint64
+	End   uint64
+}
+
+// VerifiedSpans records the spans of leaves whose coins have been verified
+// and stored by an mweb utxos fetch against the leafset of a block, before
+// that leafset was stored. A fetch cut short by a restart can skip them.
+type VerifiedSpans struct {
+	// Height is the height of the block that the fetch was against.
+	Height uint32
+
+	// BlockHash is the hash of the block that the fetch was against.
+	BlockHash chainhash.Hash
+
+	// Spans are the spans of leaves verified and stored, in ascending
+	// order and without overlap.
+	Spans []VerifiedSpan
+}
+
+// serialize writes the record to w.
+func (v *VerifiedSpans) serialize(w io.Writer) error {
+	err := binary.Write(w, binary.LittleEndian, v.Height)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(v.BlockHash[:]); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, v.Spans)
+}
+
+// deserialize reads the record from b.
+func (v *VerifiedSpans) deserialize(b []byte) error {
+	const headerLen = 4 + chainhash.HashSize
+	if len(b) < headerLen || (len(b)-headerLen)%16 != 0 {
+		return ErrUnexpectedValueLen
+	}
+
+	v.Height = binary.LittleEndian.Uint32(b)
+	copy(v.BlockHash[:], b[4:headerLen])
+	v.Spans = make([]VerifiedSpan, (len(b)-headerLen)/16)
+	return binary.Read(
+		bytes.NewReader(b[headerLen:]), binary.LittleEndian, v.Spans,
+	)
+}
+
+// mergeVerifiedSpans sorts the spans, merging those that overlap or abut.
+func mergeVerifiedSpans(spans []VerifiedSpan) []VerifiedSpan {
+	slices.SortFunc(spans, func(a, b VerifiedSpan) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	var merged []VerifiedSpan
+	for _, span := range spans {
+		if span.End <= span.Start {
+			continue
+		}
+		last := len(merged) - 1
+		if last >= 0 && span.Start <= merged[last].End {
+			if span.End > merged[last].End {
+				merged[last].End = span.End
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// GetVerifiedSpans returns the spans of leaves recorded as verified and
+// stored by an mweb utxos fetch, or nil if none are recorded.
+func (c *CoinStore) GetVerifiedSpans() (*VerifiedSpans, error) {
+	var record *VerifiedSpans
+	err := walletdb.View(c.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(rootBucket)
+
+		b := rootBucket.Get(verifiedSpans)
+		if b == nil {
+			return nil
+		}
+		record = &VerifiedSpans{}
+		return record.deserialize(b)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return coins, nil
+	return record, nil
+}
+
+// AddVerifiedSpans records the spans of leaves as verified and stored by an
+// mweb utxos fetch against the leafset of the given block. They're added to
+// the spans already recorded for the same block, and replace those recorded
+// for any other.
+func (c *CoinStore) AddVerifiedSpans(height uint32, blockHash chainhash.Hash,
+	spans []VerifiedSpan) error {
+
+	return walletdb.Update(c.db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket := tx.ReadWriteBucket(rootBucket)
+
+		record := &VerifiedSpans{}
+		if b := rootBucket.Get(verifiedSpans); b != nil {
+			if err := record.deserialize(b); err != nil {
+				return err
+			}
+		}
+		if record.Height != height || record.BlockHash != blockHash {
+			record = &VerifiedSpans{
+				Height:    height,
+				BlockHash: blockHash,
+			}
+		}
+		record.Spans = mergeVerifiedSpans(
+			append(record.Spans, spans...),
+		)
+
+		var buf bytes.Buffer
+		if err := record.serialize(&buf); err != nil {
+			return err
+		}
+		return rootBucket.Put(verifiedSpans, buf.Bytes())
+	})
+}
+
+// ClearVerifiedSpans removes the record of verified spans, once the leafset
+// that they were fetched against has been stored.
+func (c *CoinStore) ClearVerifiedSpans() error {
+	return walletdb.Update(c.db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket := tx.ReadWriteBucket(rootBucket)
+		return rootBucket.Delete(verifiedSpans)
+	})
 }
 
 // PurgeCoins purges all coins from persistent storage.
@@ -436,6 +1030,10 @@ func (c *CoinStore) PurgeCoins() error {
 		if _, err := rootBucket.CreateBucket(leafBucket); err != nil {
 			return err
 		}
+		_, err = rootBucket.CreateBucket(leafsetBucket)
+		if err != nil {
+			return err
+		}
 
 		return nil
 	})
@@ -0,0 +1,512 @@
+package mwebdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	_ "github.com/ltcsuite/ltcwallet/walletdb/bdb"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestCoinStore(t *testing.T) *CoinStore {
+	tempDir := t.TempDir()
+
+	db, err := walletdb.Create(
+		"bdb", tempDir+"/test.db", true, time.Second*10,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	coinStore, err := NewCoinStore(db)
+	require.NoError(t, err)
+
+	return coinStore
+}
+
+// TestCoinStoreConcurrentReads tests that readers fetching leaves while
+// batches of coins are being written never see part of a batch.
+func TestCoinStoreConcurrentReads(t *testing.T) {
+	const (
+		numBatches = 50
+		batchSize  = 20
+		numReaders = 4
+	)
+
+	coinStore := createTestCoinStore(t)
+
+	allLeaves := make([]uint64, numBatches*batchSize)
+	for i := range allLeaves {
+		allLeaves[i] = uint64(i)
+	}
+
+	// Each batch is written with its own height, so that readers can
+	// tell which batch every coin belongs to.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for batch := 0; batch < numBatches; batch++ {
+			var coins []*wire.MwebNetUtxo
+			for i := 0; i < batchSize; i++ {
+				leaf := uint64(batch*batchSize + i)
+				coins = append(coins, &wire.MwebNetUtxo{
+					Height:    int32(batch),
+					LeafIndex: leaf,
+					Output:    &wire.MwebOutput{},
+					OutputId: &chainhash.Hash{
+						byte(leaf), byte(leaf >> 8),
+					},
+				})
+			}
+			require.NoError(t, coinStore.PutCoins(coins))
+		}
+	}()
+
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				coins, err := coinStore.FetchLeaves(allLeaves)
+				require.NoError(t, err)
+
+				// Batches are written in order, so a
+				// consistent read sees a whole number of
+				// them.
+				require.Zero(t, len(coins)%batchSize)
+				for i, coin := range coins {
+					require.Equal(t, uint64(i),
+						coin.LeafIndex)
+					require.Equal(t, int32(i/batchSize),
+						coin.Height)
+				}
+
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	coins, err := coinStore.FetchLeaves(allLeaves)
+	require.NoError(t, err)
+	require.Len(t, coins, numBatches*batchSize)
+}
+
+// TestCoinStoreConcurrentUnspentCoins tests that many readers fetching the
+// unspent coins while the leafset is advanced and spent coins are purged
+// always see the coins of exactly the unspent leaves of the leafset they
+// get.
+func TestCoinStoreConcurrentUnspentCoins(t *testing.T) {
+	const (
+		numRounds  = 40
+		roundSize  = 16
+		numReaders = 16
+	)
+
+	coinStore := createTestCoinStore(t)
+
+	// Each round adds a batch of coins, then stores a leafset in which
+	// every other leaf of the round before is spent, as a sync would.
+	leafset := &mweb.Leafset{}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for round := 0; round < numRounds; round++ {
+			first := uint64(round * roundSize)
+			var coins []*wire.MwebNetUtxo
+			for leaf := first; leaf < first+roundSize; leaf++ {
+				coins = append(coins, &wire.MwebNetUtxo{
+					Height:    int32(round),
+					LeafIndex: leaf,
+					Output:    &wire.MwebOutput{},
+					OutputId: &chainhash.Hash{
+						byte(leaf), byte(leaf >> 8),
+					},
+				})
+			}
+			require.NoError(t, coinStore.PutCoins(coins))
+
+			next := &mweb.Leafset{
+				Bits:   make([]byte, (first+roundSize)/8),
+				Size:   first + roundSize,
+				Height: uint32(round),
+				Block:  &wire.BlockHeader{},
+			}
+			copy(next.Bits, leafset.Bits)
+			var removed []uint64
+			for leaf := first; leaf < first+roundSize; leaf++ {
+				next.Bits[leaf/8] |= 0x80 >> (leaf % 8)
+				if round == 0 || leaf%2 == 0 {
+					continue
+				}
+				spent := leaf - roundSize
+				next.Bits[spent/8] &^= 0x80 >> (spent % 8)
+				removed = append(removed, spent)
+			}
+			err := coinStore.PutLeafsetAndPurge(next, removed)
+			require.NoError(t, err)
+			leafset = next
+		}
+	}()
+
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				leafset, coins, err :=
+					coinStore.FetchUnspentCoins()
+				require.NoError(t, err)
+
+				var unspent []uint64
+				for i := uint64(0); i < leafset.Size; i++ {
+					if leafset.Contains(i) {
+						unspent = append(unspent, i)
+					}
+				}
+				require.Len(t, coins, len(unspent))
+				for i, coin := range coins {
+					require.Equal(t, unspent[i],
+						coin.LeafIndex)
+				}
+
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	leafset, coins, err := coinStore.FetchUnspentCoins()
+	require.NoError(t, err)
+	require.Equal(t, uint64(numRounds*roundSize), leafset.Size)
+	require.Len(t, coins, numRounds*roundSize/2+roundSize/2)
+}
+
+// TestFetchLeafsetAtHeight tests that the leafsets of the most recent blocks
+// are retained, that older ones are reported as not retained, and that those
+// disconnected by a reorg are dropped.
+func TestFetchLeafsetAtHeight(t *testing.T) {
+	t.Parallel()
+
+	coinStore := createTestCoinStore(t)
+
+	newLeafset := func(height uint32) *mweb.Leafset {
+		return &mweb.Leafset{
+			Bits:   []byte{byte(height)},
+			Size:   8,
+			Height: height,
+			Block: &wire.BlockHeader{
+				Timestamp: time.Unix(int64(height), 0),
+			},
+		}
+	}
+
+	// Nothing is retained until a leafset is stored.
+	_, err := coinStore.FetchLeafsetAtHeight(1)
+	require.ErrorIs(t, err, ErrLeafsetNotRetained)
+
+	const tip = 30
+	for height := uint32(1); height <= tip; height++ {
+		err := coinStore.PutLeafsetAndPurge(newLeafset(height), nil)
+		require.NoError(t, err)
+	}
+
+	for height := uint32(1); height <= tip; height++ {
+		leafset, err := coinStore.FetchLeafsetAtHeight(height)
+		if height+LeafsetRetention <= tip {
+			require.ErrorIs(t, err, ErrLeafsetNotRetained,
+				"height %v", height)
+			continue
+		}
+		require.NoError(t, err, "height %v", height)
+		require.Equal(t, newLeafset(height), leafset)
+	}
+
+	// Heights past the tip were never stored.
+	_, err = coinStore.FetchLeafsetAtHeight(tip + 1)
+	require.ErrorIs(t, err, ErrLeafsetNotRetained)
+
+	// A reorg back to an earlier height drops the leafsets of the
+	// disconnected blocks.
+	reorgLeafset := newLeafset(tip - 3)
+	reorgLeafset.Bits = []byte{0xff}
+	require.NoError(t, coinStore.PutLeafsetAndPurge(reorgLeafset, nil))
+
+	leafset, err := coinStore.FetchLeafsetAtHeight(tip - 3)
+	require.NoError(t, err)
+	require.Equal(t, reorgLeafset, leafset)
+	for height := uint32(tip - 2); height <= tip; height++ {
+		_, err := coinStore.FetchLeafsetAtHeight(height)
+		require.ErrorIs(t, err, ErrLeafsetNotRetained)
+	}
+	_, err = coinStore.FetchLeafsetAtHeight(tip - 4)
+	require.NoError(t, err)
+
+	// Purging the coins drops the retained leafsets too.
+	require.NoError(t, coinStore.PurgeCoins())
+	_, err = coinStore.FetchLeafsetAtHeight(tip - 3)
+	require.ErrorIs(t, err, ErrLeafsetNotRetained)
+}
+
+// TestSetLeafsetRetention tests that once the configured number of leafsets
+// is exceeded, the oldest are pruned while the most recent remain, and that
+// a retention of zero keeps none.
+func TestSetLeafsetRetention(t *testing.T) {
+	t.Parallel()
+
+	coinStore := createTestCoinStore(t)
+	coinStore.SetLeafsetRetention(3)
+
+	newLeafset := func(height uint32) *mweb.Leafset {
+		return &mweb.Leafset{
+			Bits:   []byte{byte(height)},
+			Size:   8,
+			Height: height,
+			Block:  &wire.BlockHeader{},
+		}
+	}
+
+	for height := uint32(1); height <= 3; height++ {
+		err := coinStore.PutLeafsetAndPurge(newLeafset(height), nil)
+		require.NoError(t, err)
+	}
+	for height := uint32(1); height <= 3; height++ {
+		_, err := coinStore.FetchLeafsetAtHeight(height)
+		require.NoError(t, err, "height %v", height)
+	}
+
+	// Storing past the retention prunes the oldest leafsets.
+	for height := uint32(4); height <= 5; height++ {
+		err := coinStore.PutLeafsetAndPurge(newLeafset(height), nil)
+		require.NoError(t, err)
+	}
+	for height := uint32(1); height <= 5; height++ {
+		_, err := coinStore.FetchLeafsetAtHeight(height)
+		if height <= 2 {
+			require.ErrorIs(t, err, ErrLeafsetNotRetained,
+				"height %v", height)
+			continue
+		}
+		require.NoError(t, err, "height %v", height)
+	}
+
+	// Without retention, the leafsets still around are pruned with the
+	// next one stored, which isn't retained itself.
+	coinStore.SetLeafsetRetention(0)
+	require.NoError(t, coinStore.PutLeafsetAndPurge(newLeafset(6), nil))
+	for height := uint32(1); height <= 6; height++ {
+		_, err := coinStore.FetchLeafsetAtHeight(height)
+		require.ErrorIs(t, err, ErrLeafsetNotRetained,
+			"height %v", height)
+	}
+
+	// The current leafset is kept regardless.
+	leafset, err := coinStore.GetLeafset()
+	require.NoError(t, err)
+	require.Equal(t, uint32(6), leafset.Height)
+}
+
+// TestCoinStoreSafeMode tests that in safe mode, coins that weren't marked
+// verified as they were stored, such as those of a batch that was only
+// partly written, aren't fetched until they're marked verified.
+func TestCoinStoreSafeMode(t *testing.T) {
+	t.Parallel()
+
+	coinStore := createTestCoinStore(t)
+
+	newCoin := func(leaf uint64) *wire.MwebNetUtxo {
+		return &wire.MwebNetUtxo{
+			Height:    1,
+			LeafIndex: leaf,
+			Output:    &wire.MwebOutput{},
+			OutputId:  &chainhash.Hash{byte(leaf), 0x01},
+		}
+	}
+	require.NoError(t, coinStore.PutCoins([]*wire.MwebNetUtxo{
+		newCoin(0), newCoin(1), newCoin(2), newCoin(3),
+	}))
+
+	// The coins of the next batch were written without being marked, as
+	// a writer interrupted before marking them would have left them.
+	err := walletdb.Update(coinStore.db, func(
+		tx walletdb.ReadWriteTx) error {
+
+		rootBucket := tx.ReadWriteBucket(rootBucket)
+		coinBucket := rootBucket.NestedReadWriteBucket(coinBucket)
+		leafBucket := rootBucket.NestedReadWriteBucket(leafBucket)
+
+		for leaf := uint64(4); leaf < 8; leaf++ {
+			coin := newCoin(leaf)
+			var buf bytes.Buffer
+			err := binary.Write(
+				&buf, binary.LittleEndian, coin.Height,
+			)
+			require.NoError(t, err)
+			require.NoError(t, coin.Output.Serialize(&buf))
+
+			err = coinBucket.Put(coin.OutputId[:], buf.Bytes())
+			require.NoError(t, err)
+			err = leafBucket.Put(
+				binary.LittleEndian.AppendUint64(nil, leaf),
+				coin.OutputId[:],
+			)
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	leaves := []uint64{0, 1, 2, 3, 4, 5, 6, 7}
+	fetchedLeaves := func() []uint64 {
+		coins, err := coinStore.FetchLeaves(leaves)
+		require.NoError(t, err)
+
+		var fetched []uint64
+		for _, coin := range coins {
+			fetched = append(fetched, coin.LeafIndex)
+		}
+		return fetched
+	}
+
+	// Outside of safe mode, every coin is fetched.
+	require.Equal(t, leaves, fetchedLeaves())
+	unverified, err := coinStore.UnverifiedLeaves()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4, 5, 6, 7}, unverified)
+
+	// In safe mode, the unmarked coins are held back.
+	coinStore.SetSafeMode(true)
+	require.Equal(t, []uint64{0, 1, 2, 3}, fetchedLeaves())
+	_, err = coinStore.FetchCoin(newCoin(5).OutputId)
+	require.ErrorIs(t, err, ErrCoinUnverified)
+	_, err = coinStore.FetchCoin(newCoin(1).OutputId)
+	require.NoError(t, err)
+
+	coins, err := coinStore.FetchLeavesUnchecked(leaves)
+	require.NoError(t, err)
+	require.Len(t, coins, len(leaves))
+
+	// Once verified again, they're released.
+	require.NoError(t, coinStore.MarkCoinsVerified([]uint64{4, 5, 9}))
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, fetchedLeaves())
+	_, err = coinStore.FetchCoin(newCoin(5).OutputId)
+	require.NoError(t, err)
+	unverified, err = coinStore.UnverifiedLeaves()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{6, 7}, unverified)
+}
+
+// TestCoinStorePutUnverifiedCoins tests that the coins stored without being
+// marked verified are held back in safe mode alongside those that were.
+func TestCoinStorePutUnverifiedCoins(t *testing.T) {
+	t.Parallel()
+
+	coinStore := createTestCoinStore(t)
+
+	var coins []*wire.MwebNetUtxo
+	for leaf := uint64(0); leaf < 4; leaf++ {
+		coins = append(coins, &wire.MwebNetUtxo{
+			Height:    1,
+			LeafIndex: leaf,
+			Output:    &wire.MwebOutput{},
+			OutputId:  &chainhash.Hash{byte(leaf), 0x02},
+		})
+	}
+	require.NoError(t, coinStore.PutCoins(coins[:2]))
+	require.NoError(t, coinStore.PutUnverifiedCoins(coins[2:]))
+
+	unverified, err := coinStore.UnverifiedLeaves()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, unverified)
+
+	coinStore.SetSafeMode(true)
+	fetched, err := coinStore.FetchLeaves([]uint64{0, 1, 2, 3})
+	require.NoError(t, err)
+	require.Equal(t, coins[:2], fetched)
+}
+
+// TestCoinStoreVerifiedSpans tests that the verified spans recorded for a
+// block are merged, replaced by those recorded for another block, and
+// removed once cleared or the coins are purged.
+func TestCoinStoreVerifiedSpans(t *testing.T) {
+	coinStore := createTestCoinStore(t)
+
+	record, err := coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.Nil(t, record)
+
+	blockA, blockB := chainhash.Hash{0x0a}, chainhash.Hash{0x0b}
+	err = coinStore.AddVerifiedSpans(10, blockA, []VerifiedSpan{
+		{Start: 20, End: 30}, {Start: 0, End: 5},
+	})
+	require.NoError(t, err)
+	err = coinStore.AddVerifiedSpans(10, blockA, []VerifiedSpan{
+		{Start: 5, End: 8}, {Start: 25, End: 40}, {Start: 50, End: 50},
+	})
+	require.NoError(t, err)
+
+	record, err = coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.Equal(t, &VerifiedSpans{
+		Height:    10,
+		BlockHash: blockA,
+		Spans:     []VerifiedSpan{{0, 8}, {20, 40}},
+	}, record)
+
+	// The spans recorded for another block replace the old ones.
+	err = coinStore.AddVerifiedSpans(11, blockB, []VerifiedSpan{
+		{Start: 40, End: 44},
+	})
+	require.NoError(t, err)
+
+	record, err = coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.Equal(t, &VerifiedSpans{
+		Height:    11,
+		BlockHash: blockB,
+		Spans:     []VerifiedSpan{{40, 44}},
+	}, record)
+
+	require.NoError(t, coinStore.ClearVerifiedSpans())
+	record, err = coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.Nil(t, record)
+	require.NoError(t, coinStore.ClearVerifiedSpans())
+
+	err = coinStore.AddVerifiedSpans(11, blockB, []VerifiedSpan{
+		{Start: 40, End: 44},
+	})
+	require.NoError(t, err)
+	require.NoError(t, coinStore.PurgeCoins())
+	record, err = coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.Nil(t, record)
+}
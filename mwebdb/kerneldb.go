@@ -0,0 +1,339 @@
+package mwebdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+)
+
+var (
+	// kernelRootBucket is the name of the bucket that stores the mweb
+	// kernels and the state of the kernel MMR that they build.
+	kernelRootBucket = []byte("mweb-kerneldb")
+
+	// kernelBucket is the bucket that stores the kernels, keyed by their
+	// leaf index in the kernel MMR.
+	kernelBucket = []byte("kernels")
+
+	// kernelMmrBucket is the bucket that stores the state of the kernel
+	// MMR after each of the most recent blocks, keyed by block height.
+	kernelMmrBucket = []byte("mmrs")
+
+	// preActivationKey is the key in the root bucket of the last block
+	// found to be before the mweb activated, stored as an empty kernel
+	// MMR.
+	preActivationKey = []byte("pre-activation")
+)
+
+// maxKernelMmrPeaks is the most peaks that a stored kernel MMR may have. An
+// MMR of up to 2^64 leaves has no more than one peak per bit of its size.
+const maxKernelMmrPeaks = 64
+
+// ErrKernelMmrFormat is returned when a stored kernel MMR can't be decoded.
+var ErrKernelMmrFormat = fmt.Errorf("malformed mweb kernel mmr")
+
+// KernelMmr is the state of the mweb kernel MMR after a block, which is all
+// that's needed to append the kernels of the next block and compute its
+// kernel root.
+type KernelMmr struct {
+	// Height is the height of the block.
+	Height uint32
+
+	// BlockHash is the hash of the block.
+	BlockHash chainhash.Hash
+
+	// Size is the number of leaves in the kernel MMR.
+	Size uint64
+
+	// Peaks are the hashes of the peaks of the kernel MMR, from left to
+	// right.
+	Peaks []*chainhash.Hash
+}
+
+// serialize writes the kernel MMR to w.
+func (m *KernelMmr) serialize(w io.Writer) error {
+	fields := []interface{}{
+		m.Height, m.BlockHash, m.Size, uint32(len(m.Peaks)),
+	}
+	for _, field := range fields {
+		err := binary.Write(w, binary.LittleEndian, field)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hash := range m.Peaks {
+		if _, err := w.Write(hash[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deserialize reads the kernel MMR from r.
+func (m *KernelMmr) deserialize(r io.Reader) error {
+	var numPeaks uint32
+	fields := []interface{}{
+		&m.Height, &m.BlockHash, &m.Size, &numPeaks,
+	}
+	for _, field := range fields {
+		err := binary.Read(r, binary.LittleEndian, field)
+		if err != nil {
+			return err
+		}
+	}
+	if numPeaks > maxKernelMmrPeaks {
+		return ErrKernelMmrFormat
+	}
+
+	m.Peaks = make([]*chainhash.Hash, numPeaks)
+	for i := range m.Peaks {
+		m.Peaks[i] = &chainhash.Hash{}
+		if _, err := io.ReadFull(r, m.Peaks[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KernelStore stores the mweb kernels of the blocks synced, along with the
+// state of the kernel MMR after each of the most recent blocks, so that a
+// reorg no deeper than that can be rolled back.
+type KernelStore struct {
+	db        walletdb.DB
+	retention uint32
+}
+
+// NewKernelStore creates a new instance of the KernelStore given an already
+// open database, keeping the state of the kernel MMR after each of the most
+// recent retention blocks.
+func NewKernelStore(db walletdb.DB, retention uint32) (*KernelStore, error) {
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket, err := tx.CreateTopLevelBucket(kernelRootBucket)
+		if err != nil {
+			return err
+		}
+		_, err = rootBucket.CreateBucketIfNotExists(kernelBucket)
+		if err != nil {
+			return err
+		}
+		_, err = rootBucket.CreateBucketIfNotExists(kernelMmrBucket)
+		return err
+	})
+	if err != nil && err != walletdb.ErrBucketExists {
+		return nil, err
+	}
+
+	return &KernelStore{db: db, retention: retention}, nil
+}
+
+// kernelKey returns the key of the kernel with the given leaf index.
+func kernelKey(leafIndex uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, leafIndex)
+}
+
+// kernelMmrKey returns the key of the kernel MMR at the given height.
+func kernelMmrKey(height uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, height)
+}
+
+// readKernelMmr decodes a stored kernel MMR, returning nil if the value is
+// nil.
+func readKernelMmr(v []byte) (*KernelMmr, error) {
+	if v == nil {
+		return nil, nil
+	}
+	mmr := &KernelMmr{}
+	if err := mmr.deserialize(bytes.NewReader(v)); err != nil {
+		return nil, err
+	}
+	return mmr, nil
+}
+
+// KernelMmrTip returns the kernel MMR after the highest block whose kernels
+// are stored, or nil if there is none.
+func (k *KernelStore) KernelMmrTip() (mmr *KernelMmr, err error) {
+	err = walletdb.View(k.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(kernelRootBucket)
+		mmrBucket := rootBucket.NestedReadBucket(kernelMmrBucket)
+
+		_, v := mmrBucket.ReadCursor().Last()
+		mmr, err = readKernelMmr(v)
+		return err
+	})
+	return
+}
+
+// PreActivationTip returns the last block found to be before the mweb
+// activated, as an empty kernel MMR, or nil if there is none.
+func (k *KernelStore) PreActivationTip() (mmr *KernelMmr, err error) {
+	err = walletdb.View(k.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(kernelRootBucket)
+		mmr, err = readKernelMmr(rootBucket.Get(preActivationKey))
+		return err
+	})
+	return
+}
+
+// PutPreActivationTip stores the block at the given height as the last one
+// found to be before the mweb activated, so that the blocks up to it
+// needn't be checked again.
+func (k *KernelStore) PutPreActivationTip(height uint32,
+	blockHash chainhash.Hash) error {
+
+	mmr := &KernelMmr{Height: height, BlockHash: blockHash}
+	var buf bytes.Buffer
+	if err := mmr.serialize(&buf); err != nil {
+		return err
+	}
+
+	return walletdb.Update(k.db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket := tx.ReadWriteBucket(kernelRootBucket)
+		return rootBucket.Put(preActivationKey, buf.Bytes())
+	})
+}
+
+// PutKernels stores the kernels of a block, which are the last leaves of the
+// kernel MMR after it, along with the kernel MMR itself. The kernel MMRs of
+// blocks beyond the retention are dropped.
+func (k *KernelStore) PutKernels(mmr *KernelMmr,
+	kernels []*wire.MwebKernel) error {
+
+	if uint64(len(kernels)) > mmr.Size {
+		return fmt.Errorf("%v kernels don't fit in a kernel mmr of "+
+			"%v leaves", len(kernels), mmr.Size)
+	}
+
+	var buf bytes.Buffer
+	if err := mmr.serialize(&buf); err != nil {
+		return err
+	}
+
+	return walletdb.Update(k.db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket := tx.ReadWriteBucket(kernelRootBucket)
+		kernelBucket := rootBucket.NestedReadWriteBucket(kernelBucket)
+		mmrBucket := rootBucket.NestedReadWriteBucket(kernelMmrBucket)
+
+		leafIndex := mmr.Size - uint64(len(kernels))
+		for _, kernel := range kernels {
+			var kbuf bytes.Buffer
+			if err := kernel.Serialize(&kbuf); err != nil {
+				return err
+			}
+			err := kernelBucket.Put(
+				kernelKey(leafIndex), kbuf.Bytes(),
+			)
+			if err != nil {
+				return err
+			}
+			leafIndex++
+		}
+
+		err := mmrBucket.Put(kernelMmrKey(mmr.Height), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		if mmr.Height < k.retention {
+			return nil
+		}
+
+		// The keys are in height order, so the oldest come first.
+		var expired [][]byte
+		cursor := mmrBucket.ReadCursor()
+		key, _ := cursor.First()
+		for ; key != nil; key, _ = cursor.Next() {
+			height := binary.BigEndian.Uint32(key)
+			if height+k.retention > mmr.Height {
+				break
+			}
+			expired = append(expired, bytes.Clone(key))
+		}
+		for _, key := range expired {
+			if err := mmrBucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RollbackKernels drops the kernel MMRs of the blocks above the given height,
+// along with the kernels that they added, returning the kernel MMR that is
+// left as the tip. If none are left, all the kernels are dropped and nil is
+// returned.
+func (k *KernelStore) RollbackKernels(height uint32) (tip *KernelMmr,
+	err error) {
+
+	err = walletdb.Update(k.db, func(tx walletdb.ReadWriteTx) error {
+		rootBucket := tx.ReadWriteBucket(kernelRootBucket)
+		kernelBucket := rootBucket.NestedReadWriteBucket(kernelBucket)
+		mmrBucket := rootBucket.NestedReadWriteBucket(kernelMmrBucket)
+
+		var expired [][]byte
+		cursor := mmrBucket.ReadCursor()
+		key, v := cursor.Last()
+		for ; key != nil; key, v = cursor.Prev() {
+			if binary.BigEndian.Uint32(key) <= height {
+				tip, err = readKernelMmr(v)
+				if err != nil {
+					return err
+				}
+				break
+			}
+			expired = append(expired, bytes.Clone(key))
+		}
+		for _, key := range expired {
+			if err := mmrBucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		var size uint64
+		if tip != nil {
+			size = tip.Size
+		}
+		expired = nil
+		cursor = kernelBucket.ReadCursor()
+		key, _ = cursor.Seek(kernelKey(size))
+		for ; key != nil; key, _ = cursor.Next() {
+			expired = append(expired, bytes.Clone(key))
+		}
+		for _, key := range expired {
+			if err := kernelBucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// FetchKernels returns the stored kernels with leaf indices from start, up to
+// count of them, stopping short at the first that isn't stored.
+func (k *KernelStore) FetchKernels(start, count uint64) (
+	kernels []*wire.MwebKernel, err error) {
+
+	err = walletdb.View(k.db, func(tx walletdb.ReadTx) error {
+		rootBucket := tx.ReadBucket(kernelRootBucket)
+		kernelBucket := rootBucket.NestedReadBucket(kernelBucket)
+
+		for i := start; i-start < count; i++ {
+			v := kernelBucket.Get(kernelKey(i))
+			if v == nil {
+				break
+			}
+			kernel := &wire.MwebKernel{}
+			err := kernel.Deserialize(bytes.NewReader(v))
+			if err != nil {
+				return err
+			}
+			kernels = append(kernels, kernel)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,121 @@
+package mwebdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKernelStore tests that kernels and kernel MMRs are stored and read
+// back intact, that only the most recent kernel MMRs are kept, that a
+// rollback drops the kernels of the blocks rolled back, and that the last
+// block before the mweb activated is stored apart.
+func TestKernelStore(t *testing.T) {
+	t.Parallel()
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/test.db", true, time.Second*10,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	kernelStore, err := NewKernelStore(db, 2)
+	require.NoError(t, err)
+
+	tip, err := kernelStore.KernelMmrTip()
+	require.NoError(t, err)
+	require.Nil(t, tip)
+
+	// Each block adds as many kernels as its height.
+	var (
+		kernels []*wire.MwebKernel
+		mmrs    []*KernelMmr
+	)
+	for height := uint32(1); height <= 4; height++ {
+		var blockKernels []*wire.MwebKernel
+		for i := uint32(0); i < height; i++ {
+			fee := uint64(len(kernels) + len(blockKernels))
+			blockKernels = append(blockKernels, &wire.MwebKernel{
+				Features: wire.MwebKernelFeeFeatureBit,
+				Fee:      fee,
+			})
+		}
+		kernels = append(kernels, blockKernels...)
+
+		mmr := &KernelMmr{
+			Height:    height,
+			BlockHash: chainhash.Hash{byte(height)},
+			Size:      uint64(len(kernels)),
+			Peaks: []*chainhash.Hash{
+				{byte(height), 1}, {byte(height), 2},
+			},
+		}
+		mmrs = append(mmrs, mmr)
+		require.NoError(t, kernelStore.PutKernels(mmr, blockKernels))
+	}
+
+	tip, err = kernelStore.KernelMmrTip()
+	require.NoError(t, err)
+	require.Equal(t, mmrs[3], tip)
+
+	stored, err := kernelStore.FetchKernels(0, 100)
+	require.NoError(t, err)
+	require.Equal(t, kernels, stored)
+
+	stored, err = kernelStore.FetchKernels(3, 2)
+	require.NoError(t, err)
+	require.Equal(t, kernels[3:5], stored)
+
+	// Rolling back a block drops its kernels.
+	tip, err = kernelStore.RollbackKernels(3)
+	require.NoError(t, err)
+	require.Equal(t, mmrs[2], tip)
+
+	stored, err = kernelStore.FetchKernels(0, 100)
+	require.NoError(t, err)
+	require.Equal(t, kernels[:6], stored)
+
+	// Only the kernel MMRs of the last two blocks were kept, so rolling
+	// back beyond them drops every kernel.
+	tip, err = kernelStore.RollbackKernels(1)
+	require.NoError(t, err)
+	require.Nil(t, tip)
+
+	stored, err = kernelStore.FetchKernels(0, 100)
+	require.NoError(t, err)
+	require.Empty(t, stored)
+
+	tip, err = kernelStore.KernelMmrTip()
+	require.NoError(t, err)
+	require.Nil(t, tip)
+
+	// The last block found to be before the mweb activated is stored
+	// apart from the kernel MMRs.
+	pre, err := kernelStore.PreActivationTip()
+	require.NoError(t, err)
+	require.Nil(t, pre)
+
+	require.NoError(t, kernelStore.PutPreActivationTip(
+		7, chainhash.Hash{7},
+	))
+	pre, err = kernelStore.PreActivationTip()
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), pre.Height)
+	require.Equal(t, chainhash.Hash{7}, pre.BlockHash)
+	require.Zero(t, pre.Size)
+	require.Empty(t, pre.Peaks)
+
+	tip, err = kernelStore.KernelMmrTip()
+	require.NoError(t, err)
+	require.Nil(t, tip)
+
+	// A block can't add more kernels than its kernel MMR has.
+	err = kernelStore.PutKernels(&KernelMmr{Height: 1, Size: 1}, kernels)
+	require.Error(t, err)
+}
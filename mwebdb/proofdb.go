@@ -0,0 +1,204 @@
+package mwebdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+)
+
+// proofRootBucket is the name of the bucket that stores the proofs of the
+// mweb coins, keyed by the sequence number that each was stored under.
+var proofRootBucket = []byte("mweb-proofdb")
+
+// maxProofHashes is the most proof hashes that a stored proof may have. A
+// proof for a span of an MMR of up to 2^64 leaves needs fewer than this.
+const maxProofHashes = 256
+
+// ErrProofFormat is returned when a stored proof can't be decoded.
+var ErrProofFormat = fmt.Errorf("malformed mweb utxos proof")
+
+// UtxosProof is the proof that a span of mweb utxos is committed to by the
+// output root of an mweb header, as served by a peer in an mwebutxos
+// message. The output ids of the utxos aren't part of the proof, as they're
+// stored with the coins.
+type UtxosProof struct {
+	// OutputRoot is the output root of the mweb header that the utxos
+	// were verified against.
+	OutputRoot chainhash.Hash
+
+	// OutputMMRSize is the number of leaves in the output MMR of the mweb
+	// header.
+	OutputMMRSize uint64
+
+	// StartIndex is the leaf index of the first utxo.
+	StartIndex uint64
+
+	// Leaves marks the leaves of the utxos, one bit per leaf starting
+	// from StartIndex, with the same bit order as a leafset.
+	Leaves []byte
+
+	// ProofHashes are the hashes of the MMR nodes that, along with the
+	// utxos, hash to the output root.
+	ProofHashes []*chainhash.Hash
+}
+
+// LeafIndices returns the leaf indices of the utxos, in ascending order.
+func (p *UtxosProof) LeafIndices() []uint64 {
+	var leaves []uint64
+	for i := uint64(0); i < uint64(len(p.Leaves))*8; i++ {
+		if p.Leaves[i/8]&(0x80>>(i%8)) != 0 {
+			leaves = append(leaves, p.StartIndex+i)
+		}
+	}
+	return leaves
+}
+
+// serialize writes the proof to w.
+func (p *UtxosProof) serialize(w io.Writer) error {
+	fields := []interface{}{
+		p.OutputRoot, p.OutputMMRSize, p.StartIndex,
+		uint32(len(p.Leaves)), p.Leaves, uint32(len(p.ProofHashes)),
+	}
+	for _, field := range fields {
+		err := binary.Write(w, binary.LittleEndian, field)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hash := range p.ProofHashes {
+		if _, err := w.Write(hash[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deserialize reads the proof from r.
+func (p *UtxosProof) deserialize(r io.Reader) error {
+	var numLeafBytes, numHashes uint32
+	fields := []interface{}{
+		&p.OutputRoot, &p.OutputMMRSize, &p.StartIndex, &numLeafBytes,
+	}
+	for _, field := range fields {
+		err := binary.Read(r, binary.LittleEndian, field)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.Leaves = make([]byte, numLeafBytes)
+	if _, err := io.ReadFull(r, p.Leaves); err != nil {
+		return err
+	}
+
+	err := binary.Read(r, binary.LittleEndian, &numHashes)
+	if err != nil {
+		return err
+	}
+	if numHashes > maxProofHashes {
+		return ErrProofFormat
+	}
+	p.ProofHashes = make([]*chainhash.Hash, numHashes)
+	for i := range p.ProofHashes {
+		p.ProofHashes[i] = &chainhash.Hash{}
+		if _, err := io.ReadFull(r, p.ProofHashes[i][:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProofStore stores the proofs of the most recently fetched spans of mweb
+// coins, so that the coins can be verified again without the network. It
+// keeps at most a fixed number of proofs, dropping the oldest first.
+type ProofStore struct {
+	db    walletdb.DB
+	limit uint64
+}
+
+// NewProofStore creates a new instance of the ProofStore given an already
+// open database, keeping at most limit proofs.
+func NewProofStore(db walletdb.DB, limit uint64) (*ProofStore, error) {
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		_, err := tx.CreateTopLevelBucket(proofRootBucket)
+		return err
+	})
+	if err != nil && err != walletdb.ErrBucketExists {
+		return nil, err
+	}
+
+	return &ProofStore{db: db, limit: limit}, nil
+}
+
+// PutProof stores the proof, dropping the oldest proofs beyond the limit.
+func (p *ProofStore) PutProof(proof *UtxosProof) error {
+	var buf bytes.Buffer
+	if err := proof.serialize(&buf); err != nil {
+		return err
+	}
+
+	return walletdb.Update(p.db, func(tx walletdb.ReadWriteTx) error {
+		bucket := tx.ReadWriteBucket(proofRootBucket)
+
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := binary.BigEndian.AppendUint64(nil, seq)
+		if err := bucket.Put(key, buf.Bytes()); err != nil {
+			return err
+		}
+		if seq <= p.limit {
+			return nil
+		}
+
+		// The keys are in the order the proofs were stored, so the
+		// oldest come first.
+		var expired [][]byte
+		cursor := bucket.ReadCursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			if binary.BigEndian.Uint64(k)+p.limit > seq {
+				break
+			}
+			expired = append(expired, bytes.Clone(k))
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEachProof calls f with each stored proof, from the oldest to the most
+// recent, stopping at the first error.
+func (p *ProofStore) ForEachProof(f func(*UtxosProof) error) error {
+	var proofs []*UtxosProof
+	err := walletdb.View(p.db, func(tx walletdb.ReadTx) error {
+		bucket := tx.ReadBucket(proofRootBucket)
+		return bucket.ForEach(func(_, v []byte) error {
+			proof := &UtxosProof{}
+			err := proof.deserialize(bytes.NewReader(v))
+			if err != nil {
+				return err
+			}
+			proofs = append(proofs, proof)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, proof := range proofs {
+		if err := f(proof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package mwebdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestProofStore tests that proofs are stored and read back intact, and that
+// only the most recent ones are kept.
+func TestProofStore(t *testing.T) {
+	t.Parallel()
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/test.db", true, time.Second*10,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+
+	proofStore, err := NewProofStore(db, 3)
+	require.NoError(t, err)
+
+	newProof := func(i int) *UtxosProof {
+		return &UtxosProof{
+			OutputRoot:    chainhash.Hash{byte(i)},
+			OutputMMRSize: 1000,
+			StartIndex:    uint64(i) * 10,
+			Leaves:        []byte{0xb0, byte(i)},
+			ProofHashes: []*chainhash.Hash{
+				{byte(i), 1}, {byte(i), 2},
+			},
+		}
+	}
+
+	readProofs := func() []*UtxosProof {
+		var proofs []*UtxosProof
+		err := proofStore.ForEachProof(func(p *UtxosProof) error {
+			proofs = append(proofs, p)
+			return nil
+		})
+		require.NoError(t, err)
+		return proofs
+	}
+	require.Empty(t, readProofs())
+
+	for i := 1; i <= 2; i++ {
+		require.NoError(t, proofStore.PutProof(newProof(i)))
+	}
+	require.Equal(t, []*UtxosProof{newProof(1), newProof(2)}, readProofs())
+
+	// Past the limit, the oldest proofs are dropped.
+	for i := 3; i <= 5; i++ {
+		require.NoError(t, proofStore.PutProof(newProof(i)))
+	}
+	require.Equal(t, []*UtxosProof{
+		newProof(3), newProof(4), newProof(5),
+	}, readProofs())
+
+	// The leaves of a proof are decoded from its bits.
+	require.Equal(t, []uint64{10, 12, 13, 25}, newProof(1).LeafIndices())
+	require.Equal(t, []uint64{30, 32, 33, 44, 45},
+		newProof(3).LeafIndices())
+}
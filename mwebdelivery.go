@@ -0,0 +1,104 @@
+package neutrino
+
+import (
+	"sync"
+
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebDeliveryBacklog is the number of verified mweb utxos responses that
+// may be waiting on the utxos callbacks at once. Once it is reached, the
+// fetch stalls until the callbacks catch up.
+const mwebDeliveryBacklog = 10
+
+// mwebDeliveryItem is either a verified response to deliver to the utxos
+// callbacks, or memory to release back to the mweb memory budget once the
+// callbacks have caught up with it.
+type mwebDeliveryItem struct {
+	utxos    []*wire.MwebNetUtxo
+	reserved uint64
+}
+
+// mwebUtxosDelivery runs the mweb utxos callbacks of a fetch on a goroutine
+// of its own, so that slow callbacks don't hold up the responses still
+// being verified and written. The memory of a batch is only released once
+// the callbacks have been through all of its responses, so that while the
+// callbacks lag behind, the next batch waits on the mweb memory budget
+// rather than piling more responses up in memory.
+type mwebUtxosDelivery struct {
+	blockMgr *blockManager
+	queue    chan mwebDeliveryItem
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newMwebUtxosDelivery starts delivering to the mweb utxos callbacks. The
+// caller must hold the mwebUtxosCallbacksMtx until wait returns.
+func (b *blockManager) newMwebUtxosDelivery() *mwebUtxosDelivery {
+	d := &mwebUtxosDelivery{
+		blockMgr: b,
+		queue:    make(chan mwebDeliveryItem, mwebDeliveryBacklog),
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		defer close(d.done)
+
+		for item := range d.queue {
+			if item.utxos != nil {
+				for _, cb := range b.mwebUtxosCallbacks {
+					cb(nil, item.utxos)
+				}
+			}
+			b.mwebMemory.release(item.reserved)
+		}
+	}()
+
+	return d
+}
+
+// enqueue adds the item to the queue, waiting for room if the backlog is
+// full. If we're shutting down, the item is dropped and its memory released
+// right away.
+func (d *mwebUtxosDelivery) enqueue(item mwebDeliveryItem) {
+	select {
+	case d.queue <- item:
+	case <-d.blockMgr.quit:
+		d.blockMgr.mwebMemory.release(item.reserved)
+	}
+}
+
+// wait stops the delivery once the callbacks have been through everything
+// queued. It's safe to call more than once.
+func (d *mwebUtxosDelivery) wait() {
+	d.stopOnce.Do(func() {
+		close(d.queue)
+	})
+	<-d.done
+}
+
+// deliver hands the utxos to the callbacks, through the query's delivery if
+// it has one, and inline otherwise.
+func (m *mwebUtxosQuery) deliver(utxos []*wire.MwebNetUtxo) {
+	if m.delivery == nil {
+		for _, cb := range m.blockMgr.mwebUtxosCallbacks {
+			cb(nil, utxos)
+		}
+		return
+	}
+	m.delivery.enqueue(mwebDeliveryItem{utxos: utxos})
+}
+
+// releaseMemory returns the given memory to the mweb memory budget, once
+// the callbacks have been through the utxos delivered before it if the
+// query has a delivery.
+func (m *mwebUtxosQuery) releaseMemory(n uint64) {
+	if n == 0 {
+		return
+	}
+	if m.delivery == nil {
+		m.blockMgr.mwebMemory.release(n)
+		return
+	}
+	m.delivery.enqueue(mwebDeliveryItem{reserved: n})
+}
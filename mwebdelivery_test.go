@@ -0,0 +1,150 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebCallbackBackpressure tests that while the mweb utxos callbacks lag
+// behind, the dispatch of new batches stalls, both on the memory budget and
+// on the delivery backlog if there is no budget, and that the fetch runs to
+// completion once the callbacks catch up.
+func TestMwebCallbackBackpressure(t *testing.T) {
+	t.Parallel()
+
+	// With every fourth leaf already stored, there are 25 spans of
+	// three leaves to fetch. The budget fits two of them at a time, so
+	// that there are 13 batches, and three without a budget.
+	t.Run("budget", func(t *testing.T) {
+		testMwebCallbackBackpressure(t, 2*mwebUtxosMemory(3), 13)
+	})
+	t.Run("no budget", func(t *testing.T) {
+		testMwebCallbackBackpressure(t, 0, 3)
+	})
+}
+
+func testMwebCallbackBackpressure(t *testing.T, budget uint64,
+	numBatches int) {
+
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	mmr := newTestMwebMmr(100)
+	var missing []uint64
+	for i := uint64(0); i < 100; i++ {
+		if i%4 != 0 {
+			missing = append(missing, i)
+		}
+	}
+	coinDB.leafset = mmr.leafset(missing...)
+	leafset := mmr.leafset()
+
+	bm.cfg.MwebMemoryBudget = budget
+	bm.mwebMemory = newMwebMemoryBudget(budget)
+
+	var (
+		mtx        sync.Mutex
+		dispatched int
+		maxInUse   uint64
+		delivered  []uint64
+	)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			mtx.Lock()
+			dispatched++
+			if inUse := bm.mwebMemory.inUse(); inUse > maxInUse {
+				maxInUse = inUse
+			}
+			mtx.Unlock()
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	// The callback is stuck until we let it go.
+	slow := make(chan struct{})
+	bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		<-slow
+		mtx.Lock()
+		for _, utxo := range utxos {
+			delivered = append(delivered, utxo.LeafIndex)
+		}
+		mtx.Unlock()
+	})
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- bm.getMwebUtxos(&wire.MwebHeader{
+			OutputRoot:    mmr.root(),
+			OutputMMRSize: leafset.Size,
+		}, leafset, &chainhash.Hash{})
+	}()
+
+	// Dispatch stalls before all the batches are sent.
+	var stalled int
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if dispatched > 0 && dispatched == stalled {
+			return true
+		}
+		stalled = dispatched
+		return false
+	}, 5*time.Second, 100*time.Millisecond)
+
+	select {
+	case err := <-errChan:
+		t.Fatalf("fetch returned while the callback is stuck: %v", err)
+	default:
+	}
+
+	mtx.Lock()
+	require.Less(t, dispatched, numBatches)
+	mtx.Unlock()
+
+	// Once the callback catches up, the fetch runs to completion.
+	close(slow)
+
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch didn't complete once the callback caught up")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	require.Equal(t, numBatches, dispatched)
+	require.ElementsMatch(t, missing, delivered)
+	if budget > 0 {
+		require.LessOrEqual(t, maxInUse, budget)
+	}
+	require.Equal(t, uint64(0), bm.mwebMemory.inUse())
+}
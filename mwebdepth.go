@@ -0,0 +1,56 @@
+package neutrino
+
+import (
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// MwebUtxoDepth is an mweb utxo delivered to the mweb utxos callbacks along
+// with its confirmation depth, so that wallets can tell its maturity without
+// tracking the chain tip themselves.
+type MwebUtxoDepth struct {
+	*wire.MwebNetUtxo
+
+	// Depth is the height of the chain tip less the height of the utxo's
+	// block, as of the utxo being delivered. A utxo in the tip block has
+	// a depth of zero. It is -1 if the depth isn't known, as for mempool
+	// outputs, which have no block, or for utxos from blocks above the
+	// tip.
+	Depth int32
+}
+
+// mwebUtxoDepths pairs the mweb utxos with their confirmation depths at the
+// current chain tip.
+func (b *blockManager) mwebUtxoDepths(
+	utxos []*wire.MwebNetUtxo) []MwebUtxoDepth {
+
+	tipHeight := int32(-1)
+	if _, height, err := b.cfg.BlockHeaders.ChainTip(); err != nil {
+		log.Warnf("Unable to get chain tip for mweb utxo depths: %v",
+			err)
+	} else {
+		tipHeight = int32(height)
+	}
+
+	depths := make([]MwebUtxoDepth, len(utxos))
+	for i, utxo := range utxos {
+		depths[i] = MwebUtxoDepth{MwebNetUtxo: utxo, Depth: -1}
+		if utxo.Height > 0 && utxo.Height <= tipHeight {
+			depths[i].Depth = tipHeight - utxo.Height
+		}
+	}
+	return depths
+}
+
+// RegisterMwebUtxosDepthCallback will register a callback that will fire
+// when new mweb utxos are received, as RegisterMwebUtxosCallback does, but
+// with the confirmation depth of each utxo.
+func (b *blockManager) RegisterMwebUtxosDepthCallback(
+	onMwebUtxos func(*mweb.Leafset, []MwebUtxoDepth)) {
+
+	b.RegisterMwebUtxosCallback(func(leafset *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		onMwebUtxos(leafset, b.mwebUtxoDepths(utxos))
+	})
+}
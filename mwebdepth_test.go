@@ -0,0 +1,67 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebUtxoDepths tests that the mweb utxos callbacks can be given the
+// confirmation depth of each utxo at the current chain tip.
+func TestMwebUtxoDepths(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	prev, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+	for height := uint32(1); height <= 5; height++ {
+		header := &wire.BlockHeader{PrevBlock: prev.BlockHash()}
+		require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+			BlockHeader: header,
+			Height:      height,
+		}))
+		prev = header
+	}
+
+	var (
+		gotLeafset *mweb.Leafset
+		got        []MwebUtxoDepth
+	)
+	bm.RegisterMwebUtxosDepthCallback(func(leafset *mweb.Leafset,
+		utxos []MwebUtxoDepth) {
+
+		gotLeafset, got = leafset, utxos
+	})
+
+	leafset := &mweb.Leafset{Height: 5}
+	utxos := []*wire.MwebNetUtxo{
+		{Height: 5, LeafIndex: 0},
+		{Height: 2, LeafIndex: 1},
+		{Height: 0, LeafIndex: 2},
+		{Height: 6, LeafIndex: 3},
+	}
+	for _, cb := range bm.mwebUtxosCallbacks {
+		cb(leafset, utxos)
+	}
+
+	require.Same(t, leafset, gotLeafset)
+	require.Len(t, got, len(utxos))
+	for i, utxo := range got {
+		require.Same(t, utxos[i], utxo.MwebNetUtxo)
+	}
+	require.Equal(t, int32(0), got[0].Depth)
+	require.Equal(t, int32(3), got[1].Depth)
+	require.Equal(t, int32(-1), got[2].Depth)
+	require.Equal(t, int32(-1), got[3].Depth)
+
+	// Mempool outputs have no depth.
+	bm.notifyMwebUtxos([]*wire.MwebOutput{{}})
+	require.Nil(t, gotLeafset)
+	require.Len(t, got, 1)
+	require.Equal(t, int32(-1), got[0].Depth)
+}
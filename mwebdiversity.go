@@ -0,0 +1,30 @@
+package neutrino
+
+import (
+	"net"
+	"time"
+
+	"github.com/ltcmweb/ltcd/addrmgr"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebPeerGroup returns the network group of the peer with the given
+// address, as the address manager groups addresses for outbound peer
+// diversity. An address that isn't an IP address, such as that of a peer
+// connected by hostname, is a group of its own.
+func mwebPeerGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	na := wire.NetAddressV2FromBytes(time.Time{}, 0, ip, 0)
+	return addrmgr.GroupKey(na)
+}
@@ -0,0 +1,22 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebPeerGroup tests that peers are grouped by network as the address
+// manager groups them.
+func TestMwebPeerGroup(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, mwebPeerGroup("8.8.1.1:9333"),
+		mwebPeerGroup("8.8.2.2:9333"))
+	require.NotEqual(t, mwebPeerGroup("8.8.1.1:9333"),
+		mwebPeerGroup("9.9.1.1:9333"))
+	require.Equal(t, "8.8.0.0", mwebPeerGroup("8.8.1.1"))
+	require.Equal(t, "local", mwebPeerGroup("127.0.0.1:9333"))
+	require.Equal(t, "node.example:9333",
+		mwebPeerGroup("node.example:9333"))
+}
@@ -0,0 +1,178 @@
+package neutrino
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// maxMwebVerifyDumps is the most mweb verify states that are dumped,
+// so that peers serving bad proofs can't fill the disk with them.
+const maxMwebVerifyDumps = 100
+
+// MwebVerifyState is the state of a failed verification of mweb utxos,
+// dumped so that the failure can be reproduced. Along with what was
+// verified, it records how far the walk over the output MMR got.
+type MwebVerifyState struct {
+	// Peer is the address of the peer that served the mweb utxos.
+	Peer string
+
+	// Error is the verification error.
+	Error string
+
+	// MwebHeader is the mweb header that the utxos were verified
+	// against.
+	MwebHeader *wire.MwebHeader
+
+	// LeafsetBits, LeafsetSize and LeafsetHeight are the leafset that
+	// the utxos were verified against.
+	LeafsetBits   []byte
+	LeafsetSize   uint64
+	LeafsetHeight uint32
+
+	// FirstLeafIndex and LastLeafIndex are the leaf indices of the first
+	// and last utxos that the walk checked against the leafset. They are
+	// zero if the walk never started.
+	FirstLeafIndex uint64
+	LastLeafIndex  uint64
+
+	// ProofAssignments are the proof hashes consumed by the final pass of
+	// the walk, each with the node it was taken for.
+	ProofAssignments []MwebProofAssignment
+
+	// Message is the encoded mwebutxos message.
+	Message []byte
+}
+
+// newMwebVerifyState captures the state of a failed verification of the
+// mweb utxos, given the walk over the output MMR as far as it got, which
+// may be nil.
+func newMwebVerifyState(peer string, mwebHeader *wire.MwebHeader,
+	leafset *mweb.Leafset, mwebUtxos *wire.MsgMwebUtxos,
+	v *verifyUtxosVars, verifyErr error) (*MwebVerifyState, error) {
+
+	// Mweb messages are only exchanged with peers that support the
+	// light client protocol version.
+	var msg bytes.Buffer
+	err := mwebUtxos.BtcEncode(
+		&msg, wire.MwebLightClientVersion, wire.LatestEncoding,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &MwebVerifyState{
+		Peer:             peer,
+		MwebHeader:       mwebHeader,
+		LeafsetBits:      leafset.Bits,
+		LeafsetSize:      leafset.Size,
+		LeafsetHeight:    leafset.Height,
+		ProofAssignments: v.proofAssignments(),
+		Message:          msg.Bytes(),
+	}
+	if verifyErr != nil {
+		state.Error = verifyErr.Error()
+	}
+	if v != nil {
+		state.FirstLeafIndex = uint64(v.firstLeafIdx)
+		state.LastLeafIndex = uint64(v.lastLeafIdx)
+	}
+	return state, nil
+}
+
+// LoadMwebVerifyState reads the state of a failed verification of mweb
+// utxos from the file it was dumped to.
+func LoadMwebVerifyState(path string) (*MwebVerifyState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &MwebVerifyState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Replay verifies the dumped mweb utxos again, returning the state that
+// this verification leaves, which matches the dumped state for the peer
+// and error of a failure that is reproduced. The utxos are verified under
+// the default root variant.
+func (s *MwebVerifyState) Replay() (*MwebVerifyState, error) {
+	mwebUtxos := &wire.MsgMwebUtxos{}
+	err := mwebUtxos.BtcDecode(
+		bytes.NewReader(s.Message), wire.MwebLightClientVersion,
+		wire.LatestEncoding,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	leafset := &mweb.Leafset{
+		Bits:   s.LeafsetBits,
+		Size:   s.LeafsetSize,
+		Height: s.LeafsetHeight,
+	}
+	v, verifyErr := walkVerifiedMwebUtxos(
+		nil, s.MwebHeader, leafset, mwebUtxos,
+	)
+	return newMwebVerifyState(
+		s.Peer, s.MwebHeader, leafset, mwebUtxos, v, verifyErr,
+	)
+}
+
+// dumpMwebVerifyState writes the state of a failed verification of mweb
+// utxos to a new file in the MwebVerifyDumpDir, if set, unless
+// maxMwebVerifyDumps have been dumped already. Failing to do so is only
+// logged.
+func (b *blockManager) dumpMwebVerifyState(peer string,
+	mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos, v *verifyUtxosVars, verifyErr error) {
+
+	dir := b.cfg.MwebVerifyDumpDir
+	if dir == "" {
+		return
+	}
+
+	dump := atomic.AddUint64(&b.mwebVerifyDumps, 1)
+	if dump > maxMwebVerifyDumps {
+		log.Debugf("Not dumping mweb verify state of mwebutxos from "+
+			"peer %v, already dumped %v", peer, maxMwebVerifyDumps)
+		return
+	}
+
+	state, err := newMwebVerifyState(
+		peer, mwebHeader, leafset, mwebUtxos, v, verifyErr,
+	)
+	if err != nil {
+		log.Errorf("Unable to capture mweb verify state: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		log.Errorf("Unable to encode mweb verify state: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Errorf("Unable to create mweb verify dump dir: %v", err)
+		return
+	}
+	name := fmt.Sprintf("%v-%v-verify.json", time.Now().UnixNano(), dump)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		log.Errorf("Unable to dump mweb verify state: %v", err)
+		return
+	}
+
+	log.Debugf("Dumped mweb verify state of mwebutxos from peer %v to %v",
+		peer, path)
+}
@@ -0,0 +1,93 @@
+package neutrino
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebVerifyDump tests that the state of a failed verification of mweb
+// utxos is dumped to a file, that once reloaded it replays to the same
+// state, and that no more are dumped once the most have been.
+func TestMwebVerifyDump(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+
+	mmr := newTestMwebMmr(11)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset(2, 9)
+	q.leafset.Height = 1
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 3, 4, wire.MwebNetUtxoCompact,
+	)
+	go func() { <-q.utxosChan }()
+
+	// Nothing is dumped without a directory, nor for utxos that verify.
+	q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "peer")
+
+	dir := filepath.Join(t.TempDir(), "dumps")
+	bm.cfg.MwebVerifyDumpDir = dir
+	go func() { <-q.utxosChan }()
+	q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "peer")
+	_, err := os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+
+	// A bad proof hash still has the walk consume every proof hash, but
+	// the peaks don't give the output root.
+	resp := mmr.proveUtxos(q.leafset, req)
+	require.NotEmpty(t, resp.ProofHashes)
+	resp.ProofHashes[0] = &chainhash.Hash{0x01}
+	q.handleResponse(req, resp, "peer")
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	state, err := LoadMwebVerifyState(
+		filepath.Join(dir, entries[0].Name()),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "peer", state.Peer)
+	require.Contains(t, state.Error, ErrMwebBadProof.Error())
+	require.Equal(t, q.mwebHeader, state.MwebHeader)
+	require.Equal(t, q.leafset.Bits, state.LeafsetBits)
+	require.Equal(t, q.leafset.Size, state.LeafsetSize)
+	require.Equal(t, q.leafset.Height, state.LeafsetHeight)
+	require.Equal(t, uint64(3), state.FirstLeafIndex)
+	require.Equal(t, uint64(6), state.LastLeafIndex)
+	require.Len(t, state.ProofAssignments, len(resp.ProofHashes))
+	require.Equal(t, chainhash.Hash{0x01}, state.ProofAssignments[0].Hash)
+
+	// Replaying the state reproduces it exactly, however many times.
+	for i := 0; i < 2; i++ {
+		replayed, err := state.Replay()
+		require.NoError(t, err)
+		require.Equal(t, state, replayed)
+	}
+
+	// The replayed message is the one served.
+	replayed := &wire.MsgMwebUtxos{}
+	require.NoError(t, replayed.BtcDecode(
+		bytes.NewReader(state.Message), wire.MwebLightClientVersion,
+		wire.LatestEncoding,
+	))
+	require.Equal(t, resp.ProofHashes, replayed.ProofHashes)
+	require.Len(t, replayed.Utxos, len(resp.Utxos))
+
+	// Once the most states have been dumped, no more are.
+	atomic.StoreUint64(&bm.mwebVerifyDumps, maxMwebVerifyDumps)
+	q.handleResponse(req, resp, "peer")
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
@@ -0,0 +1,166 @@
+package neutrino
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+)
+
+// MwebFailureSink receives the mweb messages served by peers that fail
+// verification, so that they can be kept for later analysis.
+type MwebFailureSink interface {
+	// RecordMwebFailure is called with a message that failed
+	// verification, the peer that served it, the reason the peer will be
+	// punished for and the verification error. It is called from the
+	// query workers, so it must be safe for concurrent use and should
+	// return quickly.
+	RecordMwebFailure(peer string, msg wire.Message, reason banman.Reason,
+		err error)
+}
+
+// dirMwebFailureSink is an MwebFailureSink that writes each failure to its
+// own file within a directory.
+type dirMwebFailureSink struct {
+	dir   string
+	count uint64
+}
+
+// A compile time check to ensure dirMwebFailureSink satisfies the
+// MwebFailureSink interface.
+var _ MwebFailureSink = (*dirMwebFailureSink)(nil)
+
+// NewDirMwebFailureSink returns an MwebFailureSink that persists each
+// failure to a new file in the given directory, which is created if it
+// doesn't exist. Each file records the peer, reason and error, followed by
+// the hex encoded payload of the offending message.
+func NewDirMwebFailureSink(dir string) (MwebFailureSink, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &dirMwebFailureSink{dir: dir}, nil
+}
+
+// RecordMwebFailure writes the failure to a file named after the time, a
+// sequence number and the message command.
+//
+// NOTE: Part of the MwebFailureSink interface.
+func (s *dirMwebFailureSink) RecordMwebFailure(peer string, msg wire.Message,
+	reason banman.Reason, err error) {
+
+	// Mweb messages are only exchanged with peers that support the
+	// light client protocol version.
+	var payload bytes.Buffer
+	encodeErr := msg.BtcEncode(
+		&payload, wire.MwebLightClientVersion, wire.LatestEncoding,
+	)
+	if encodeErr != nil {
+		log.Errorf("Unable to encode failed %v message: %v",
+			msg.Command(), encodeErr)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "peer: %v\n", peer)
+	fmt.Fprintf(&b, "reason: %v\n", reason)
+	fmt.Fprintf(&b, "error: %v\n", err)
+	fmt.Fprintf(&b, "command: %v\n", msg.Command())
+	fmt.Fprintf(&b, "payload: %x\n", payload.Bytes())
+
+	name := fmt.Sprintf("%v-%v-%v.txt", time.Now().UnixNano(),
+		atomic.AddUint64(&s.count, 1), msg.Command())
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		log.Errorf("Unable to persist failed %v message from peer "+
+			"%v: %v", msg.Command(), peer, err)
+		return
+	}
+
+	log.Debugf("Persisted failed %v message from peer %v to %v",
+		msg.Command(), peer, path)
+}
+
+// mwebFailureLogInterval is how often the mweb verification failures of a
+// single peer are logged in full. Further failures within the interval are
+// only counted, and summarized along with the next failure logged in full.
+const mwebFailureLogInterval = 30 * time.Second
+
+// mwebFailureLogger rate limits the logging of mweb verification failures
+// by peer, so that a peer flooding us with bad data can't flood the logs
+// too. The zero value is ready for use.
+type mwebFailureLogger struct {
+	mtx   sync.Mutex
+	peers map[string]*mwebFailureLogState
+
+	// now and warnf can be overridden in tests. If nil, time.Now and
+	// log.Warnf are used.
+	now   func() time.Time
+	warnf func(format string, params ...interface{})
+}
+
+// mwebFailureLogState tracks the failures logged for a single peer.
+type mwebFailureLogState struct {
+	lastLogged time.Time
+	suppressed int
+}
+
+// logf logs a verification failure by the peer as a warning, unless one
+// has already been logged for the peer within the log interval, in which
+// case it is only logged at trace level.
+func (l *mwebFailureLogger) logf(peer string, format string,
+	params ...interface{}) {
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	warnf := log.Warnf
+	if l.warnf != nil {
+		warnf = l.warnf
+	}
+
+	if l.peers == nil {
+		l.peers = make(map[string]*mwebFailureLogState)
+	}
+	state, ok := l.peers[peer]
+	if ok && now.Sub(state.lastLogged) < mwebFailureLogInterval {
+		state.suppressed++
+		log.Tracef(format, params...)
+		return
+	}
+	if !ok {
+		state = &mwebFailureLogState{}
+		l.peers[peer] = state
+	}
+
+	// Forget the peers with nothing left to summarize, so that the map
+	// doesn't grow with every peer that ever failed.
+	for p, s := range l.peers {
+		if p != peer && s.suppressed == 0 &&
+			now.Sub(s.lastLogged) >= mwebFailureLogInterval {
+
+			delete(l.peers, p)
+		}
+	}
+
+	if state.suppressed > 0 {
+		warnf("Suppressed %v mweb failure log lines for peer %v "+
+			"in the last %v", state.suppressed, peer,
+			now.Sub(state.lastLogged).Truncate(time.Second))
+	}
+	warnf(format, params...)
+
+	state.lastLogged = now
+	state.suppressed = 0
+}
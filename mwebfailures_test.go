@@ -0,0 +1,199 @@
+package neutrino
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/stretchr/testify/require"
+)
+
+// mwebFailure is a failure captured by the recordingFailureSink.
+type mwebFailure struct {
+	peer   string
+	msg    wire.Message
+	reason banman.Reason
+	err    error
+}
+
+// recordingFailureSink is an MwebFailureSink that keeps every failure in
+// memory.
+type recordingFailureSink struct {
+	mtx      sync.Mutex
+	failures []mwebFailure
+}
+
+func (s *recordingFailureSink) RecordMwebFailure(peer string,
+	msg wire.Message, reason banman.Reason, err error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.failures = append(s.failures, mwebFailure{peer, msg, reason, err})
+}
+
+func (s *recordingFailureSink) count() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.failures)
+}
+
+// TestMwebFailureSink tests that invalid mweb utxos and headers are handed
+// to the failure sink, along with the peer and reason, before the peer is
+// banned.
+func TestMwebFailureSink(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	sink := &recordingFailureSink{}
+	bm.cfg.MwebFailureSink = sink
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		require.Equal(t, len(banned)+1, sink.count())
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// The mock utxos don't hash to the empty output root.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	)
+	q.mwebHeader.OutputMMRSize = 1
+	q.leafset.Bits = []byte{0x80}
+	q.leafset.Size = 1
+	resp := newMockMwebUtxos(req)
+	q.handleResponse(req, resp, "a")
+
+	require.Equal(t, []string{"a"}, banned)
+	require.Len(t, sink.failures, 1)
+	require.Equal(t, "a", sink.failures[0].peer)
+	require.Same(t, resp, sink.failures[0].msg)
+	require.Equal(t, banman.InvalidMwebUtxos, sink.failures[0].reason)
+	require.ErrorIs(t, sink.failures[0].err, ErrMwebBadProof)
+
+	// A response with duplicate leaf indices is also captured.
+	req = wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 2, wire.MwebNetUtxoCompact,
+	)
+	resp = newMockMwebUtxos(req)
+	resp.Utxos[1].LeafIndex = 0
+	q.handleResponse(req, resp, "b")
+
+	require.Equal(t, []string{"a", "b"}, banned)
+	require.Len(t, sink.failures, 2)
+	require.Equal(t, "b", sink.failures[1].peer)
+	require.Same(t, resp, sink.failures[1].msg)
+	require.Contains(t, sink.failures[1].err.Error(), "duplicate")
+
+	// An mweb header that doesn't check out against its block.
+	header := &wire.MsgMwebHeader{}
+	blockHash := header.Merkle.Header.BlockHash()
+	gdmsg := wire.NewMsgGetData()
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &blockHash))
+	hq := &mwebHeadersQuery{blockMgr: bm}
+	hq.handleResponse(gdmsg, header, "c")
+
+	require.Equal(t, []string{"a", "b", "c"}, banned)
+	require.Len(t, sink.failures, 3)
+	require.Equal(t, "c", sink.failures[2].peer)
+	require.Same(t, header, sink.failures[2].msg)
+	require.Equal(t, banman.InvalidMwebHeader, sink.failures[2].reason)
+	require.Error(t, sink.failures[2].err)
+}
+
+// TestDirMwebFailureSink tests that the directory failure sink writes each
+// failure to its own file.
+func TestDirMwebFailureSink(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "failures")
+	sink, err := NewDirMwebFailureSink(dir)
+	require.NoError(t, err)
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	)
+	for i := 0; i < 2; i++ {
+		sink.RecordMwebFailure("peer", newMockMwebUtxos(req),
+			banman.InvalidMwebUtxos, ErrMwebBadProof)
+	}
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	contents, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+	for _, line := range []string{
+		"peer: peer",
+		"reason: " + banman.InvalidMwebUtxos.String(),
+		"error: " + ErrMwebBadProof.Error(),
+		"command: " + wire.CmdMwebUtxos,
+		"payload: ",
+	} {
+		require.Contains(t, string(contents), line)
+	}
+}
+
+// TestMwebFailureLogRateLimit tests that of many rapid verification
+// failures by a peer, only the first is logged in full, with the rest
+// summarized once the log interval has passed.
+func TestMwebFailureLogRateLimit(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	bm.cfg.BanPolicy = NewStrikesBanPolicy(100)
+
+	now := time.Unix(1000, 0)
+	var warnings []string
+	bm.mwebFailureLog.now = func() time.Time {
+		return now
+	}
+	bm.mwebFailureLog.warnf = func(format string,
+		params ...interface{}) {
+
+		warnings = append(warnings, fmt.Sprintf(format, params...))
+	}
+
+	// The mock utxos don't hash to the empty output root.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	)
+	q.mwebHeader.OutputMMRSize = 1
+	q.leafset.Bits = []byte{0x80}
+	q.leafset.Size = 1
+	for i := 0; i < 10; i++ {
+		q.handleResponse(req, newMockMwebUtxos(req), "a")
+		now = now.Add(time.Second)
+	}
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "from peer a")
+	require.Contains(t, warnings[0], ErrMwebBadProof.Error())
+
+	// Failures by other peers are limited separately.
+	q.handleResponse(req, newMockMwebUtxos(req), "b")
+	require.Len(t, warnings, 2)
+	require.Contains(t, warnings[1], "from peer b")
+
+	// Once the interval has passed, the next failure is logged in full
+	// along with a summary of those suppressed.
+	now = now.Add(mwebFailureLogInterval)
+	q.handleResponse(req, newMockMwebUtxos(req), "a")
+	require.Len(t, warnings, 4)
+	require.Contains(t, warnings[2], "Suppressed 9 mweb failure log "+
+		"lines for peer a")
+	require.Contains(t, warnings[3], "from peer a")
+
+	// Peer b had nothing to summarize, so it was forgotten.
+	bm.mwebFailureLog.mtx.Lock()
+	require.NotContains(t, bm.mwebFailureLog.peers, "b")
+	bm.mwebFailureLog.mtx.Unlock()
+}
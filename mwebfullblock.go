@@ -0,0 +1,393 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+var (
+	// ErrMwebSpendUnknown is returned when a block spends an mweb output
+	// that isn't among the stored coins, so that the leafset can't be
+	// updated from the block. The coins db is missing the coin, as when
+	// the mweb sync started past the height it was created at, so the full
+	// block fallback is given up rather than the block's peers punished.
+	ErrMwebSpendUnknown = errors.New("mweb block spends unknown output")
+
+	// ErrMwebDoubleSpend is returned when a block spends the same mweb
+	// output more than once.
+	ErrMwebDoubleSpend = errors.New("mweb block spends output twice")
+
+	// ErrMwebFallbackReorged is returned when the mweb coins db was synced
+	// to a block that has since been reorged out, which the full block
+	// fallback can't roll back from, as the coins spent since are gone.
+	ErrMwebFallbackReorged = errors.New("mweb coins db synced to block " +
+		"no longer in chain")
+)
+
+// mwebUnverifiedCoinsPutter is implemented by mweb coins dbs that can store
+// coins without marking them verified, as the CoinStore does.
+type mwebUnverifiedCoinsPutter interface {
+	// PutUnverifiedCoins stores the coins without marking them verified.
+	PutUnverifiedCoins([]*wire.MwebNetUtxo) error
+}
+
+// mwebFullBlockFallback tracks when the mweb sync is to fall back to full
+// blocks. It falls back once a round of the mweb sync has failed, with no
+// round having been served for long enough before it. The mweb sync is
+// tried again after each round of the fallback, which is taken again only
+// if that fails too. It is safe for concurrent use.
+type mwebFullBlockFallback struct {
+	after time.Duration
+
+	// now returns the current time. It can be overridden in tests.
+	now func() time.Time
+
+	mtx        sync.Mutex
+	lastServed time.Time
+	failed     bool
+}
+
+// newMwebFullBlockFallback returns a fallback that is due once the mweb
+// sync has gone for the given time without being served, counted from now.
+func newMwebFullBlockFallback(after time.Duration) *mwebFullBlockFallback {
+	return &mwebFullBlockFallback{
+		after:      after,
+		now:        time.Now,
+		lastServed: time.Now(),
+	}
+}
+
+// served records a round of the mweb sync that our peers served.
+func (f *mwebFullBlockFallback) served() {
+	if f == nil {
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.lastServed = f.now()
+	f.failed = false
+}
+
+// failure records a failed round of the mweb sync.
+func (f *mwebFullBlockFallback) failure() {
+	if f == nil {
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.failed = true
+}
+
+// due returns whether the mweb sync is to fall back to full blocks, along
+// with how long it has gone without being served. The fallback is taken
+// on it being due, so it isn't due again until the next failure.
+func (f *mwebFullBlockFallback) due() (time.Duration, bool) {
+	if f == nil {
+		return 0, false
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	since := f.now().Sub(f.lastServed)
+	if !f.failed || since < f.after {
+		return since, false
+	}
+	f.failed = false
+	return since, true
+}
+
+// mwebBlockUpdate is the change that a block makes to the mweb coins.
+type mwebBlockUpdate struct {
+	// leafset is the leafset after the block.
+	leafset *mweb.Leafset
+
+	// added are the coins created by the block.
+	added []*wire.MwebNetUtxo
+
+	// removed are the leaves spent by the block, and spent their output
+	// ids.
+	removed []uint64
+	spent   []chainhash.Hash
+}
+
+// applyMwebBlock applies the outputs and inputs of the block at the given
+// height to the leafset, given the leaves of the unspent coins by output
+// id. The leafset that results must hash to the leafset root of the
+// block's mweb header, which its hogex commits to. It returns nil for a
+// block before the mweb activated, which active is set once it has.
+func applyMwebBlock(leafset *mweb.Leafset,
+	leaves map[chainhash.Hash]uint64, height uint32,
+	block *wire.MsgBlock, active bool) (*mwebBlockUpdate, error) {
+
+	hogex, err := mwebBlockHogex(block, active)
+	if hogex == nil || err != nil {
+		return nil, err
+	}
+	if block.MwebHeader == nil || block.MwebTransactions == nil {
+		return nil, fmt.Errorf("%w: block has no mweb",
+			ErrMwebLeafsetRoot)
+	}
+	if err := checkMwebHogAddr(hogex, block.MwebHeader); err != nil {
+		return nil, err
+	}
+
+	var (
+		size    = leafset.Size
+		newSize = block.MwebHeader.OutputMMRSize
+		outputs = block.MwebTransactions.Outputs
+	)
+	if newSize < size || newSize-size != uint64(len(outputs)) {
+		return nil, fmt.Errorf("%w: %v outputs don't take the output "+
+			"mmr from %v to %v leaves", ErrMwebLeafsetRoot,
+			len(outputs), size, newSize)
+	}
+
+	next := &mweb.Leafset{
+		Bits:   make([]byte, (newSize+7)/8),
+		Size:   newSize,
+		Height: height,
+		Block:  &block.Header,
+	}
+	copy(next.Bits, leafset.Bits)
+
+	update := &mwebBlockUpdate{leafset: next}
+	for _, input := range block.MwebTransactions.Inputs {
+		leaf, ok := leaves[input.OutputId]
+		switch {
+		case !ok:
+			return nil, mwebLocalError{fmt.Errorf("%w: %v",
+				ErrMwebSpendUnknown, input.OutputId)}
+
+		case !next.Contains(leaf):
+			return nil, fmt.Errorf("%w: %v", ErrMwebDoubleSpend,
+				input.OutputId)
+		}
+		next.Bits[leaf/8] &^= 0x80 >> (leaf % 8)
+		update.removed = append(update.removed, leaf)
+		update.spent = append(update.spent, input.OutputId)
+	}
+	for i, output := range outputs {
+		leaf := size + uint64(i)
+		next.Bits[leaf/8] |= 0x80 >> (leaf % 8)
+		update.added = append(update.added, &wire.MwebNetUtxo{
+			Height:    int32(height),
+			LeafIndex: leaf,
+			Output:    output,
+			OutputId:  output.Hash(),
+		})
+	}
+
+	err = verifyMwebLeafsetDetailed(block.MwebHeader, &wire.MsgMwebLeafset{
+		BlockHash: block.BlockHash(),
+		Leafset:   next.Bits,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// fetchMwebLeafsetCoins returns the leafset of the mweb coins db along with
+// the coins of its unspent leaves, whether or not they're marked verified,
+// as those taken from full blocks aren't. The caller must hold the mweb
+// utxos callbacks lock, so that the leafset can't change in between.
+func fetchMwebLeafsetCoins(coinDB mwebdb.CoinDatabase) (*mweb.Leafset,
+	[]*wire.MwebNetUtxo, error) {
+
+	fetchLeaves := coinDB.FetchLeaves
+	if marker, ok := coinDB.(mwebCoinMarker); ok {
+		fetchLeaves = marker.FetchLeavesUnchecked
+	}
+
+	leafset, err := coinDB.GetLeafset()
+	if err != nil {
+		return nil, nil, err
+	}
+	var leaves []uint64
+	for i := uint64(0); i < leafset.Size; i++ {
+		if leafset.Contains(i) {
+			leaves = append(leaves, i)
+		}
+	}
+	coins, err := fetchLeaves(leaves)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leafset, coins, nil
+}
+
+// syncMwebFromBlocks brings the mweb coins db up to the given height from
+// the full blocks after the one it was last synced to, fetched with their
+// mweb one at a time. Each block's outputs are stored as coins, and its
+// inputs spend the stored coins, with the leafset that results checked
+// against the block's mweb header. A peer serving a block that doesn't
+// check out is punished, and the block is fetched from another.
+func (b *blockManager) syncMwebFromBlocks(toHeight uint32) error {
+	b.mwebUtxosCallbacksMtx.Lock()
+	defer b.mwebUtxosCallbacksMtx.Unlock()
+
+	leafset, coins, err := fetchMwebLeafsetCoins(b.cfg.MwebCoins)
+	if err != nil {
+		return err
+	}
+
+	height := mwebKernelStartHeights[b.cfg.ChainParams.Net]
+	if height == 0 {
+		height = 1
+	}
+	active := leafset.Block != nil || leafset.Size > 0
+	if active {
+		if leafset.Block != nil && !b.isMwebBlockInChain(
+			leafset.Height, leafset.Block.BlockHash(), toHeight,
+		) {
+
+			return fmt.Errorf("%w: height %v",
+				ErrMwebFallbackReorged, leafset.Height)
+		}
+		height = leafset.Height + 1
+	}
+	if height > toHeight {
+		return nil
+	}
+
+	log.Infof("Syncing mweb utxos from full blocks from height %v to %v",
+		height, toHeight)
+
+	leaves := make(map[chainhash.Hash]uint64, len(coins))
+	for _, coin := range coins {
+		if coin.OutputId != nil {
+			leaves[*coin.OutputId] = coin.LeafIndex
+		}
+	}
+
+	for ; height <= toHeight; height++ {
+		header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+
+		var update *mwebBlockUpdate
+		apply := func(block *wire.MsgBlock) error {
+			var err error
+			update, err = applyMwebBlock(
+				leafset, leaves, height, block, active,
+			)
+			return err
+		}
+		err = b.fetchMwebBlock(
+			header.BlockHash(), "mweb utxos",
+			banman.InvalidMwebUtxos, apply,
+		)
+		if err != nil {
+			return err
+		}
+
+		// Blocks before the mweb activated have no mweb utxos.
+		if update == nil {
+			continue
+		}
+		active = true
+
+		if err := b.putMwebBlockUpdate(update); err != nil {
+			return err
+		}
+		for _, outputId := range update.spent {
+			delete(leaves, outputId)
+		}
+		for _, coin := range update.added {
+			leaves[*coin.OutputId] = coin.LeafIndex
+		}
+		leafset = update.leafset
+	}
+
+	log.Infof("Synced mweb utxos from full blocks up to height %v",
+		toHeight)
+
+	return nil
+}
+
+// putMwebBlockUpdate stores the coins created by a block and the leafset
+// after it, purging the coins it spent, and delivers them to the mweb utxos
+// callbacks. The coins can't be proven against the output root, so they're
+// stored without being marked verified where the db allows. The caller must
+// hold the mweb utxos callbacks lock.
+func (b *blockManager) putMwebBlockUpdate(update *mwebBlockUpdate) error {
+	putCoins := b.cfg.MwebCoins.PutCoins
+	if putter, ok := b.cfg.MwebCoins.(mwebUnverifiedCoinsPutter); ok {
+		putCoins = putter.PutUnverifiedCoins
+	}
+
+	leafset := update.leafset
+	if len(update.added) > 0 {
+		err := b.retryMwebWrite(func() error {
+			return putCoins(update.added)
+		})
+		if err != nil {
+			return err
+		}
+		for _, cb := range b.mwebUtxosCallbacks {
+			cb(nil, update.added)
+		}
+	}
+
+	err := b.cfg.MwebCoins.PutLeavesAtHeight(map[uint32]uint64{
+		leafset.Height: leafset.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.purgeSpentMwebTxos(leafset, update.removed)
+}
+
+// syncMwebFallback falls back to syncing the mweb utxos up to the given
+// height from full blocks, if the mweb sync has gone without being served
+// for long enough. It returns whether the fallback was taken, along with
+// any error from it.
+func (b *blockManager) syncMwebFallback(toHeight uint32) (bool, error) {
+	since, due := b.mwebFallback.due()
+	if !due {
+		return false, nil
+	}
+
+	log.Warnf("No peer has served the mweb sync for %v, falling back "+
+		"to downloading full blocks up to height %v. This takes far "+
+		"more bandwidth than the mweb light client sync, as every "+
+		"block is downloaded along with its whole mweb, and the coins "+
+		"can't be proven against the output root, so they aren't "+
+		"marked verified", since.Round(time.Second), toHeight)
+
+	return true, b.syncMwebFromBlocks(toHeight)
+}
+
+// waitMwebNewBlock waits until the header tip has moved past the given
+// height, or a full resync has been requested, returning false if we're
+// shutting down first.
+func (b *blockManager) waitMwebNewBlock(height uint32) bool {
+	b.newHeadersSignal.L.Lock()
+	defer b.newHeadersSignal.L.Unlock()
+
+	for height >= b.headerTip && !b.mwebResync.pending() {
+		b.newHeadersSignal.Wait()
+
+		select {
+		case <-b.quit:
+			return false
+		default:
+		}
+	}
+	return true
+}
@@ -0,0 +1,492 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMwebUtxoBlock returns a block whose hogex commits to an mweb header
+// with an output MMR of the given size and the given leafset, carrying the
+// given outputs and inputs spending the given output ids.
+func newTestMwebUtxoBlock(t *testing.T, prevBlock chainhash.Hash,
+	outputMMRSize uint64, leafset []byte, outputs []*wire.MwebOutput,
+	spent ...chainhash.Hash) *wire.MsgBlock {
+
+	mwebHeader := wire.MwebHeader{OutputMMRSize: outputMMRSize}
+	header, msgHeader, _ := newTestMwebHeader(
+		t, prevBlock, mwebHeader, leafset,
+	)
+
+	body := &wire.MwebTxBody{Outputs: outputs}
+	for _, outputId := range spent {
+		body.Inputs = append(body.Inputs, &wire.MwebInput{
+			OutputId: outputId,
+		})
+	}
+
+	return &wire.MsgBlock{
+		Header:           *header,
+		Transactions:     []*wire.MsgTx{&msgHeader.Hogex},
+		MwebHeader:       &msgHeader.MwebHeader,
+		MwebTransactions: body,
+	}
+}
+
+// newTestMwebOutputs returns the given number of distinct mweb outputs,
+// starting from the given seed.
+func newTestMwebOutputs(seed byte, n int) []*wire.MwebOutput {
+	outputs := make([]*wire.MwebOutput, n)
+	for i := range outputs {
+		outputs[i] = &wire.MwebOutput{
+			RangeProofHash: chainhash.Hash{seed + byte(i), 0xfb},
+		}
+	}
+	return outputs
+}
+
+// TestMwebFullBlockFallbackDue tests that the full block fallback is only
+// due once the mweb sync has failed after going unserved for long enough,
+// and that it isn't due again until the next failure.
+func TestMwebFullBlockFallbackDue(t *testing.T) {
+	t.Parallel()
+
+	// A nil fallback is never due.
+	var disabled *mwebFullBlockFallback
+	disabled.failure()
+	disabled.served()
+	_, due := disabled.due()
+	require.False(t, due)
+
+	now := time.Unix(1000, 0)
+	f := newMwebFullBlockFallback(time.Minute)
+	f.now = func() time.Time {
+		return now
+	}
+	f.served()
+
+	// Failures before the fallback period is up don't trigger it.
+	f.failure()
+	now = now.Add(30 * time.Second)
+	_, due = f.due()
+	require.False(t, due)
+
+	// Nor does the period being up without a failure since the last
+	// round served.
+	now = now.Add(time.Minute)
+	f.served()
+	now = now.Add(2 * time.Minute)
+	_, due = f.due()
+	require.False(t, due)
+
+	// A failure once it's up does, only the once.
+	f.failure()
+	since, due := f.due()
+	require.True(t, due)
+	require.Equal(t, 2*time.Minute, since)
+	_, due = f.due()
+	require.False(t, due)
+
+	f.failure()
+	_, due = f.due()
+	require.True(t, due)
+}
+
+// TestMwebFullBlockFallback tests that with no peers serving the mweb sync,
+// the fallback engages once the fallback period is up, taking the mweb utxos
+// from full blocks, storing them unverified and delivering them to the
+// callbacks, and that a peer serving a block whose mweb doesn't match its
+// mweb header is banned.
+func TestMwebFullBlockFallback(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/coins.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	coinStore, err := mwebdb.NewCoinStore(db)
+	require.NoError(t, err)
+	bm.cfg.MwebCoins = coinStore
+
+	now := time.Unix(1000, 0)
+	bm.mwebFallback = newMwebFullBlockFallback(time.Minute)
+	bm.mwebFallback.now = func() time.Time {
+		return now
+	}
+	bm.mwebFallback.served()
+
+	// The block at height 1 is before the mweb activated. The block at
+	// height 2 creates three outputs, and the block at height 3 spends
+	// the second of them and creates two more.
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxOut(wire.NewTxOut(0, nil))
+	block1 := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			PrevBlock:  *chaincfg.SimNetParams.GenesisHash,
+			MerkleRoot: coinbase.TxHash(),
+		},
+		Transactions: []*wire.MsgTx{coinbase},
+	}
+	outputs := newTestMwebOutputs(0, 5)
+	block2 := newTestMwebUtxoBlock(
+		t, block1.BlockHash(), 3, []byte{0xe0}, outputs[:3],
+	)
+	block3 := newTestMwebUtxoBlock(
+		t, block2.BlockHash(), 5, []byte{0xb8}, outputs[3:],
+		*outputs[1].Hash(),
+	)
+
+	blocks := make(map[chainhash.Hash]*wire.MsgBlock)
+	for i, block := range []*wire.MsgBlock{block1, block2, block3} {
+		header := block.Header
+		require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+			BlockHeader: &header,
+			Height:      uint32(i + 1),
+		}))
+		blocks[block.BlockHash()] = block
+	}
+
+	// The bad peer is asked first, and serves the last block spending
+	// the third output instead.
+	bad := *block3
+	bad.MwebTransactions = &wire.MwebTxBody{
+		Inputs:  []*wire.MwebInput{{OutputId: *outputs[2].Hash()}},
+		Outputs: outputs[3:],
+	}
+
+	// No peer answers the mweb light client queries, while full blocks
+	// are served.
+	var (
+		mtx          sync.Mutex
+		banned       []string
+		lightQueries int
+	)
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			msg, ok := requests[0].Req.(*wire.MsgGetData)
+			if !ok || msg.InvList[0].Type != wire.InvTypeMwebBlock {
+				mtx.Lock()
+				lightQueries++
+				mtx.Unlock()
+				errChan <- errTestQueryUnanswered
+				return errChan
+			}
+
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetData)
+					iv := msg.InvList[0]
+					block, handle := blocks[iv.Hash],
+						req.HandleResp
+					if block == block3 {
+						handle(req.Req, &bad, "bad")
+					}
+					handle(req.Req, block, "good")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	var (
+		delivered []*wire.MwebNetUtxo
+		leafsets  []*mweb.Leafset
+	)
+	bm.mwebUtxosCallbacks = append(bm.mwebUtxosCallbacks,
+		func(leafset *mweb.Leafset, utxos []*wire.MwebNetUtxo) {
+			if leafset != nil {
+				leafsets = append(leafsets, leafset)
+			}
+			delivered = append(delivered, utxos...)
+		},
+	)
+
+	// failRound fails a round of the mweb sync as the mweb handler
+	// does, with no peer serving the mweb headers.
+	failRound := func() {
+		err := bm.getMwebHeaders(3)
+		require.Error(t, err)
+		bm.mwebSyncFailed(err)
+	}
+
+	// Before the fallback period is up, the fallback isn't taken.
+	failRound()
+	now = now.Add(30 * time.Second)
+	fellBack, err := bm.syncMwebFallback(3)
+	require.NoError(t, err)
+	require.False(t, fellBack)
+
+	// Once it's up, the next failed round engages it.
+	now = now.Add(time.Minute)
+	failRound()
+	fellBack, err = bm.syncMwebFallback(3)
+	require.NoError(t, err)
+	require.True(t, fellBack)
+
+	mtx.Lock()
+	require.Equal(t, []string{"bad"}, banned)
+	require.Equal(t, 2, lightQueries)
+	mtx.Unlock()
+
+	leafset, err := coinStore.GetLeafset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), leafset.Size)
+	require.Equal(t, uint32(3), leafset.Height)
+	require.Equal(t, block3.BlockHash(), leafset.Block.BlockHash())
+	require.Equal(t, []byte{0xb8}, leafset.Bits)
+
+	coins, err := coinStore.FetchLeaves([]uint64{0, 1, 2, 3, 4})
+	require.NoError(t, err)
+	require.Len(t, coins, 4)
+	for _, coin := range coins {
+		require.Equal(t, outputs[coin.LeafIndex].Hash(), coin.OutputId)
+	}
+	unverified, err := coinStore.UnverifiedLeaves()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2, 3, 4}, unverified)
+
+	require.Len(t, delivered, 5)
+	require.Len(t, leafsets, 2)
+	require.Equal(t, uint32(2), leafsets[0].Height)
+	require.Equal(t, uint32(3), leafsets[1].Height)
+
+	// Once synced, another round of the fallback fetches nothing.
+	failRound()
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func([]*query.Request,
+			...query.QueryOption) chan error {
+
+			t.Fatal("unexpected query")
+			return nil
+		},
+	}
+	fellBack, err = bm.syncMwebFallback(3)
+	require.NoError(t, err)
+	require.True(t, fellBack)
+
+	// A round that's served keeps the fallback from being taken.
+	bm.mwebFallback.served()
+	bm.mwebSyncFailed(errTestQueryUnanswered)
+	fellBack, err = bm.syncMwebFallback(3)
+	require.NoError(t, err)
+	require.False(t, fellBack)
+}
+
+// TestMwebFullBlockFallbackSpendUnknown tests that a block spending a coin
+// missing from our own coins db gives up the fallback, without punishing
+// the peer that served the block.
+func TestMwebFullBlockFallbackSpendUnknown(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	coinStore := newTestCoinStore(t)
+	bm.cfg.MwebCoins = coinStore
+
+	// The block at height 1 creates two outputs, and the block at height
+	// 2 spends the first, which wasn't stored.
+	outputs := newTestMwebOutputs(0x20, 2)
+	block1 := newTestMwebUtxoBlock(
+		t, *chaincfg.SimNetParams.GenesisHash, 2, []byte{0xc0},
+		outputs,
+	)
+	block2 := newTestMwebUtxoBlock(
+		t, block1.BlockHash(), 2, []byte{0x40}, nil,
+		*outputs[0].Hash(),
+	)
+	for i, block := range []*wire.MsgBlock{block1, block2} {
+		header := block.Header
+		require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+			BlockHeader: &header,
+			Height:      uint32(i + 1),
+		}))
+	}
+
+	require.NoError(t, coinStore.PutCoins([]*wire.MwebNetUtxo{{
+		Height:    1,
+		LeafIndex: 1,
+		Output:    outputs[1],
+		OutputId:  outputs[1].Hash(),
+	}}))
+	require.NoError(t, coinStore.PutLeafsetAndPurge(&mweb.Leafset{
+		Bits:   []byte{0xc0},
+		Size:   2,
+		Height: 1,
+		Block:  &block1.Header,
+	}, nil))
+
+	var (
+		mtx    sync.Mutex
+		served int
+		banned []string
+	)
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// Both peers serve the block, which is only asked of the second if
+	// the first fails.
+	peers := []string{"a", "b"}
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					for _, addr := range peers {
+						mtx.Lock()
+						served++
+						mtx.Unlock()
+						progress := req.HandleResp(
+							req.Req, block2, addr,
+						)
+						if progress.Finished {
+							break
+						}
+					}
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	err = bm.syncMwebFromBlocks(2)
+	require.ErrorIs(t, err, ErrMwebSpendUnknown)
+
+	mtx.Lock()
+	require.Equal(t, 1, served)
+	require.Empty(t, banned)
+	mtx.Unlock()
+
+	leafset, err := coinStore.GetLeafset()
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), leafset.Height)
+}
+
+// TestApplyMwebBlock tests that the mweb of a block is only applied to the
+// leafset if it spends unspent coins, its outputs fill the output MMR of
+// its mweb header, and the leafset that results matches the header's.
+func TestApplyMwebBlock(t *testing.T) {
+	t.Parallel()
+
+	genesisHash := *chaincfg.SimNetParams.GenesisHash
+	outputs := newTestMwebOutputs(0x10, 4)
+	leaves := map[chainhash.Hash]uint64{
+		*outputs[0].Hash(): 0,
+		*outputs[1].Hash(): 1,
+	}
+	leafset := &mweb.Leafset{Bits: []byte{0xc0}, Size: 2, Height: 4}
+
+	// Spending the first output and adding two more leaves leaves 1 to
+	// 3 unspent.
+	block := newTestMwebUtxoBlock(
+		t, genesisHash, 4, []byte{0x70}, outputs[2:],
+		*outputs[0].Hash(),
+	)
+	update, err := applyMwebBlock(leafset, leaves, 5, block, true)
+	require.NoError(t, err)
+	require.Equal(t, &mweb.Leafset{
+		Bits:   []byte{0x70},
+		Size:   4,
+		Height: 5,
+		Block:  &block.Header,
+	}, update.leafset)
+	require.Equal(t, []uint64{0}, update.removed)
+	require.Equal(t, []chainhash.Hash{*outputs[0].Hash()}, update.spent)
+	require.Len(t, update.added, 2)
+	require.Equal(t, uint64(2), update.added[0].LeafIndex)
+	require.Equal(t, outputs[3].Hash(), update.added[1].OutputId)
+
+	// The leafset passed in is left as it was.
+	require.Equal(t, []byte{0xc0}, leafset.Bits)
+
+	// A block without a hogex before the mweb activated is skipped.
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxOut(wire.NewTxOut(0, nil))
+	preMweb := &wire.MsgBlock{
+		Header:       wire.BlockHeader{MerkleRoot: coinbase.TxHash()},
+		Transactions: []*wire.MsgTx{coinbase},
+	}
+	update, err = applyMwebBlock(leafset, leaves, 5, preMweb, false)
+	require.NoError(t, err)
+	require.Nil(t, update)
+
+	tests := []struct {
+		name  string
+		block *wire.MsgBlock
+		err   error
+	}{{
+		name:  "no hogex",
+		block: preMweb,
+		err:   ErrMwebNotHogEx,
+	}, {
+		name: "unknown spend",
+		block: newTestMwebUtxoBlock(
+			t, genesisHash, 4, []byte{0xf0}, outputs[2:],
+			*outputs[3].Hash(),
+		),
+		err: ErrMwebSpendUnknown,
+	}, {
+		name: "double spend",
+		block: newTestMwebUtxoBlock(
+			t, genesisHash, 2, []byte{0x00}, nil,
+			*outputs[0].Hash(), *outputs[0].Hash(),
+		),
+		err: ErrMwebDoubleSpend,
+	}, {
+		name: "missing output",
+		block: newTestMwebUtxoBlock(
+			t, genesisHash, 4, []byte{0xe0}, outputs[2:3],
+		),
+		err: ErrMwebLeafsetRoot,
+	}, {
+		name: "leafset mismatch",
+		block: newTestMwebUtxoBlock(
+			t, genesisHash, 4, []byte{0xb0}, outputs[2:],
+			*outputs[0].Hash(),
+		),
+		err: ErrMwebLeafsetRoot,
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := applyMwebBlock(
+				leafset, leaves, 5, test.block, true,
+			)
+			require.ErrorIs(t, err, test.err)
+		})
+	}
+}
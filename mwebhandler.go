@@ -1,10 +1,14 @@
 package neutrino
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
 	"github.com/ltcmweb/ltcd/ltcutil/mweb"
 	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
 )
 
 // mwebHandler is the mweb download handler for the block manager. It must be
@@ -14,7 +18,34 @@ func (b *blockManager) mwebHandler() {
 	defer b.wg.Done()
 	defer log.Trace("Mweb handler done")
 
+	// prefetch holds the mweb header and leafset of the new chain tip
+	// if it was fetched during the last round's mweb utxos fetch.
+	var prefetch *mwebHeaderPrefetch
+
+	// snapshot is the mweb snapshot to seed the mweb coins db with once
+	// the block headers have caught up to it.
+	snapshot := b.cfg.MwebSnapshot
+
 	for {
+		// Hold off on the next round while the mweb queries are
+		// cancelled.
+		if !b.waitMwebResumed() {
+			return
+		}
+
+		// Hold off while the mweb sync cools down after failing too
+		// many times in a row.
+		if !b.waitMwebCircuit() {
+			return
+		}
+
+		// A full resync starts over from an empty mweb coins db, seeded
+		// from the snapshot again if there is one.
+		if b.wipeMwebForResync() {
+			prefetch = nil
+			snapshot = b.cfg.MwebSnapshot
+		}
+
 		b.newHeadersSignal.L.Lock()
 		for !b.BlockHeadersSynced() {
 			b.newHeadersSignal.Wait()
@@ -30,6 +61,16 @@ func (b *blockManager) mwebHandler() {
 		}
 		b.newHeadersSignal.L.Unlock()
 
+		// A snapshot that fails to load is skipped, and the mweb utxos
+		// are fetched from the start of the chain instead.
+		if snapshot != nil {
+			if err := b.loadMwebSnapshot(snapshot); err != nil {
+				log.Errorf("Unable to load mweb snapshot: %v",
+					err)
+			}
+			snapshot = nil
+		}
+
 		// Now that the block headers are finished, we'll grab the current
 		// chain tip so we can base our mweb header sync off of that.
 		lastHeader, lastHeight, err := b.cfg.BlockHeaders.ChainTip()
@@ -46,6 +87,7 @@ func (b *blockManager) mwebHandler() {
 		if rollbackHeight > 0 && rollbackHeight < lastHeight {
 			if lastHeight-rollbackHeight > 10 {
 				err = b.cfg.MwebCoins.PurgeCoins()
+				b.mwebUtxosResume = nil
 			} else {
 				lastHeight = rollbackHeight
 				lastHeader, err = b.cfg.BlockHeaders.
@@ -63,6 +105,36 @@ func (b *blockManager) mwebHandler() {
 			return
 		}
 
+		// Once no peer has served the mweb sync for long enough, the
+		// mweb utxos are taken from full blocks instead, and the mweb
+		// sync is tried again once there's a new block. Should the
+		// fallback fail, the mweb sync goes ahead this round.
+		fellBack, err := b.syncMwebFallback(lastHeight)
+		switch {
+		case err == ErrShuttingDown:
+			return
+		case err == errMwebCancelled:
+			continue
+		case err != nil:
+			log.Errorf("Unable to sync mweb utxos from full "+
+				"blocks: %v", err)
+
+		case fellBack:
+			err = b.cfg.MwebCoins.ClearRollbackHeight(
+				rollbackHeight,
+			)
+			if err != nil {
+				log.Critical(err)
+				return
+			}
+			b.mwebRollbackSignal.Broadcast()
+
+			if !b.waitMwebNewBlock(lastHeight) {
+				return
+			}
+			continue
+		}
+
 		lastHash := lastHeader.BlockHash()
 
 		log.Infof("Starting mweb sync at (block_height=%v, block_hash=%v)",
@@ -72,67 +144,25 @@ func (b *blockManager) mwebHandler() {
 		err = b.getMwebHeaders(lastHeight)
 		if err == ErrShuttingDown {
 			return
+		} else if err == errMwebCancelled {
+			continue
 		} else if err != nil {
 			log.Error(err)
+			b.mwebSyncFailed(err)
 			continue
 		}
 
-		gdmsg := wire.NewMsgGetData()
-		gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &lastHash))
-		gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebLeafset, &lastHash))
-
-		var (
-			mwebHeader  *wire.MsgMwebHeader
-			mwebLeafset *wire.MsgMwebLeafset
-			verified    bool
+		mwebHeader, mwebLeafset, err := b.nextMwebHeaderAndLeafset(
+			prefetch, &lastHash,
 		)
-		b.cfg.queryAllPeers(
-			gdmsg,
-			func(sp *ServerPeer, resp wire.Message, quit chan<- struct{},
-				peerQuit chan<- struct{}) {
-
-				switch m := resp.(type) {
-				case *wire.MsgMwebHeader:
-					if m.Merkle.Header.BlockHash() != lastHash {
-						return
-					}
-					if err := mweb.VerifyHeader(m); err != nil {
-						log.Infof("Failed to verify mwebheader: %v", err)
-						return
-					}
-					mwebHeader = m
-
-				case *wire.MsgMwebLeafset:
-					mwebLeafset = m
-
-				default:
-					return
-				}
-
-				if mwebHeader == nil || mwebLeafset == nil {
-					return
-				}
-
-				err := mweb.VerifyLeafset(mwebHeader, mwebLeafset)
-				if err != nil {
-					log.Infof("Failed to verify mwebleafset: %v", err)
-					return
-				}
-
-				verified = true
-
-				close(quit)
-				close(peerQuit)
-			},
-		)
-		select {
-		case <-b.quit:
+		prefetch = nil
+		switch {
+		case err == ErrShuttingDown:
 			return
-		default:
-			if !verified {
-				time.Sleep(time.Second)
-				continue
-			}
+		case err != nil:
+			b.mwebSyncFailed(err)
+			time.Sleep(time.Second)
+			continue
 		}
 
 		log.Infof("Verified mwebheader and mwebleafset at "+
@@ -153,11 +183,20 @@ func (b *blockManager) mwebHandler() {
 			return
 		}
 
-		// Get all the mweb utxos at this height.
-		err = b.getMwebUtxos(&mwebHeader.MwebHeader, leafset, &lastHash)
-		if err != nil {
+		// Get all the mweb utxos at this height, fetching the mweb
+		// header of the next tip alongside should one arrive.
+		prefetch, err = b.getMwebUtxosPipelined(
+			&mwebHeader.MwebHeader, leafset, &lastHash,
+		)
+		switch {
+		case err == errMwebTipChanged || err == errMwebCancelled:
+			continue
+		case err != nil:
+			b.mwebSyncFailed(err)
 			continue
 		}
+		b.mwebCircuit.success()
+		b.mwebFallback.served()
 
 		err = b.cfg.MwebCoins.ClearRollbackHeight(rollbackHeight)
 		if err != nil {
@@ -166,6 +205,19 @@ func (b *blockManager) mwebHandler() {
 		}
 		b.mwebRollbackSignal.Broadcast()
 
+		// Fetch and verify the mweb kernels of the blocks up to this
+		// height, if they're being synced. Failing to do so leaves the
+		// mweb utxos synced, and is retried on the next round.
+		err = b.syncMwebKernels(lastHeight)
+		switch {
+		case err == ErrShuttingDown:
+			return
+		case err == errMwebCancelled:
+			continue
+		case err != nil:
+			log.Errorf("Unable to sync mweb kernels: %v", err)
+		}
+
 		// Now we check the headers again. If the block headers are not yet
 		// current, then we go back to the loop waiting for them to finish.
 		if !b.BlockHeadersSynced() {
@@ -189,9 +241,14 @@ func (b *blockManager) mwebHandler() {
 		// connected. If this happens then we'll do another round to fetch the
 		// new set of mweb utxos.
 
-		// We'll wait until the header tip has advanced.
+		// We'll wait until the header tip has advanced, a refresh of
+		// the mweb state has found the leafset changed, or a full
+		// resync has been requested.
 		b.newHeadersSignal.L.Lock()
-		for lastHeight >= b.headerTip {
+		b.finishMwebResync()
+		for lastHeight >= b.headerTip && b.mwebRefresh == nil &&
+			!b.mwebResync.pending() {
+
 			// We'll wait here until we're woken up by the
 			// broadcast signal.
 			b.newHeadersSignal.Wait()
@@ -205,6 +262,214 @@ func (b *blockManager) mwebHandler() {
 			default:
 			}
 		}
+
+		// The refresh has already fetched the mweb header and leafset
+		// of the chain tip, so the next round needn't fetch them again.
+		if b.mwebRefresh != nil {
+			prefetch, b.mwebRefresh = b.mwebRefresh, nil
+		}
 		b.newHeadersSignal.L.Unlock()
 	}
 }
+
+// fetchMwebHeaderAndLeafset queries our peers for the mweb header and
+// leafset of the given block, returning them once both have been verified
+// against the block header.
+func (b *blockManager) fetchMwebHeaderAndLeafset(blockHash *chainhash.Hash) (
+	*wire.MsgMwebHeader, *wire.MsgMwebLeafset, error) {
+
+	gdmsg := wire.NewMsgGetData()
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, blockHash))
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebLeafset, blockHash))
+
+	var (
+		mwebHeader  *wire.MsgMwebHeader
+		mwebLeafset *wire.MsgMwebLeafset
+		headerPeer  string
+		verified    bool
+	)
+	b.cfg.queryAllPeers(
+		gdmsg,
+		func(sp *ServerPeer, resp wire.Message, quit chan<- struct{},
+			peerQuit chan<- struct{}) {
+
+			switch m := resp.(type) {
+			case *wire.MsgMwebHeader:
+				err := b.verifyMwebHeaderChained(blockHash, m)
+				malformed := errors.Is(
+					err, ErrMwebMalformedMerkleBlock,
+				)
+				switch {
+				case errors.Is(err, ErrMwebBlockHashMismatch):
+					return
+
+				// A hogex that breaks the chain of hogexes,
+				// a leafset root that changed for the same
+				// block, or a malformed merkle block, can't
+				// be an honest mistake.
+				case isMwebHeaderConflict(err), malformed:
+					log.Infof("Failed to verify "+
+						"mwebheader from peer %v: %v",
+						sp, err)
+					b.punishPeer(
+						sp.Addr(),
+						banman.InvalidMwebHeader,
+					)
+					return
+
+				case err != nil:
+					log.Infof("Failed to verify "+
+						"mwebheader: %v", err)
+					return
+				}
+				mwebHeader = m
+				headerPeer = sp.Addr()
+
+			case *wire.MsgMwebLeafset:
+				err := b.checkMwebLeafsetShrink(blockHash, m)
+				if err != nil {
+					log.Infof("Failed to verify "+
+						"mwebleafset from peer %v: %v",
+						sp, err)
+					b.punishPeer(
+						sp.Addr(),
+						banman.InvalidMwebHeader,
+					)
+					return
+				}
+				mwebLeafset = m
+
+			default:
+				return
+			}
+
+			if mwebHeader == nil || mwebLeafset == nil {
+				return
+			}
+
+			err := verifyMwebLeafsetDetailed(
+				&mwebHeader.MwebHeader, mwebLeafset,
+			)
+			if err != nil {
+				log.Infof("Failed to verify mwebleafset: %v",
+					err)
+				return
+			}
+			b.mwebHeaders.addLeafset(
+				*blockHash, len(mwebLeafset.Leafset),
+			)
+
+			verified = true
+
+			close(quit)
+			close(peerQuit)
+		},
+		b.mwebQueryPeers.queryOptions()...,
+	)
+
+	select {
+	case <-b.quit:
+		return nil, nil, ErrShuttingDown
+	default:
+	}
+
+	if !verified {
+		return nil, nil, fmt.Errorf("unable to fetch verified mweb "+
+			"header and leafset for block %v", blockHash)
+	}
+
+	b.mwebHeaders.setServedBy(*blockHash, headerPeer)
+	b.notifyMwebHeader(&mwebHeader.MwebHeader, *blockHash)
+
+	return mwebHeader, mwebLeafset, nil
+}
+
+// verifyMwebHeaderOnly fetches and verifies the mweb header and leafset at
+// the given height, without fetching or storing any mweb utxos.
+func (b *blockManager) verifyMwebHeaderOnly(height uint32) error {
+	header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(height)
+	if err != nil {
+		return err
+	}
+	blockHash := header.BlockHash()
+
+	_, _, err = b.fetchMwebHeaderAndLeafset(&blockHash)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Verified mwebheader and mwebleafset at "+
+		"(block_height=%v, block_hash=%v)", height, blockHash)
+
+	return nil
+}
+
+// refreshMwebState fetches and verifies the mweb header and leafset of the
+// chain tip on demand. If the leafset differs from that of the mweb coins
+// db, the mweb handler is woken to sync the mweb utxos to it.
+func (b *blockManager) refreshMwebState() error {
+	header, height, err := b.cfg.BlockHeaders.ChainTip()
+	if err != nil {
+		return err
+	}
+	blockHash := header.BlockHash()
+
+	mwebHeader, mwebLeafset, err := b.fetchMwebHeaderAndLeafset(&blockHash)
+	if err != nil {
+		return err
+	}
+
+	oldLeafset, err := b.cfg.MwebCoins.GetLeafset()
+	if err != nil {
+		return err
+	}
+	newLeafset := &mweb.Leafset{
+		Bits:   mwebLeafset.Leafset,
+		Size:   mwebHeader.MwebHeader.OutputMMRSize,
+		Height: height,
+		Block:  header,
+	}
+	if mwebLeafsetsEqual(oldLeafset, newLeafset) {
+		log.Debugf("Mweb state already up to date at "+
+			"(block_height=%v, block_hash=%v)", height, blockHash)
+		return nil
+	}
+
+	log.Infof("Mweb leafset changed at (block_height=%v, block_hash=%v), "+
+		"syncing mweb utxos", height, blockHash)
+
+	refresh := &mwebHeaderPrefetch{
+		done:        make(chan struct{}),
+		blockHash:   blockHash,
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	close(refresh.done)
+
+	b.newHeadersSignal.L.Lock()
+	b.mwebRefresh = refresh
+	b.newHeadersSignal.L.Unlock()
+	b.newHeadersSignal.Broadcast()
+
+	return nil
+}
+
+// isMwebQuery returns whether the given message is a request for mweb data,
+// i.e. a getmwebutxos message or a getdata for mweb headers, leafsets or
+// blocks.
+func isMwebQuery(msg wire.Message) bool {
+	switch m := msg.(type) {
+	case *wire.MsgGetMwebUtxos:
+		return true
+
+	case *wire.MsgGetData:
+		for _, iv := range m.InvList {
+			switch iv.Type {
+			case wire.InvTypeMwebHeader, wire.InvTypeMwebLeafset,
+				wire.InvTypeMwebBlock:
+				return true
+			}
+		}
+	}
+	return false
+}
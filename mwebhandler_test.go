@@ -0,0 +1,423 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/peer"
+	"github.com/ltcmweb/ltcd/txscript"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+)
+
+// newTestMwebHeader creates a block header committing to an mweb header
+// with the given leafset, along with the mweb header and leafset messages
+// that a peer would serve for it.
+func newTestMwebHeader(t *testing.T, prevBlock chainhash.Hash,
+	mwebHeader wire.MwebHeader, leafset []byte) (*wire.BlockHeader,
+	*wire.MsgMwebHeader, *wire.MsgMwebLeafset) {
+
+	mwebHeader.LeafsetRoot = blake3.Sum256(leafset)
+
+	// The hogex must pay to the HogAddr committing to the mweb header.
+	hogAddr, err := txscript.NewScriptBuilder().
+		AddOp(txscript.MwebHogAddrWitnessVersion + txscript.OP_1 - 1).
+		AddData(mwebHeader.Hash()[:]).Script()
+	require.NoError(t, err)
+
+	hogex := wire.NewMsgTx(2)
+	hogex.IsHogEx = true
+	hogex.AddTxOut(wire.NewTxOut(0, hogAddr))
+	hogexHash := hogex.TxHash()
+
+	// The hogex is the only transaction in the block, so it is also
+	// the merkle root.
+	header := &wire.BlockHeader{
+		PrevBlock:  prevBlock,
+		MerkleRoot: hogexHash,
+	}
+
+	msgHeader := &wire.MsgMwebHeader{
+		Merkle: wire.MsgMerkleBlock{
+			Header:       *header,
+			Transactions: 1,
+			Hashes:       []*chainhash.Hash{&hogexHash},
+			Flags:        []byte{0x01},
+		},
+		Hogex:      *hogex,
+		MwebHeader: mwebHeader,
+	}
+	msgLeafset := &wire.MsgMwebLeafset{
+		BlockHash: header.BlockHash(),
+		Leafset:   leafset,
+	}
+
+	return header, msgHeader, msgLeafset
+}
+
+// mockMwebPeers records the mweb queries made by a blockManager and answers
+// them with the given mweb header and leafset.
+type mockMwebPeers struct {
+	mtx  sync.Mutex
+	msgs []wire.Message
+
+	mwebHeader  *wire.MsgMwebHeader
+	mwebLeafset *wire.MsgMwebLeafset
+
+	// addr is the address of the peer answering, or a default one if
+	// empty.
+	addr string
+}
+
+// queryAllPeers answers a getdata for an mweb header and leafset as a
+// single peer would.
+func (m *mockMwebPeers) queryAllPeers(queryMsg wire.Message,
+	checkResponse func(sp *ServerPeer, resp wire.Message,
+		quit chan<- struct{}, peerQuit chan<- struct{}),
+	_ ...QueryOption) {
+
+	m.mtx.Lock()
+	m.msgs = append(m.msgs, queryMsg)
+	m.mtx.Unlock()
+
+	addr := m.addr
+	if addr == "" {
+		addr = "10.0.0.1:9333"
+	}
+	p, err := peer.NewOutboundPeer(&peer.Config{}, addr)
+	if err != nil {
+		panic(err)
+	}
+	sp := &ServerPeer{Peer: p}
+
+	quit := make(chan struct{})
+	peerQuit := make(chan struct{})
+	for _, resp := range []wire.Message{m.mwebHeader, m.mwebLeafset} {
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		checkResponse(sp, resp, quit, peerQuit)
+	}
+}
+
+// query records the requests dispatched to the work manager, which are
+// never answered.
+func (m *mockMwebPeers) query(requests []*query.Request,
+	_ ...query.QueryOption) chan error {
+
+	m.mtx.Lock()
+	for _, req := range requests {
+		m.msgs = append(m.msgs, req.Req)
+	}
+	m.mtx.Unlock()
+
+	return make(chan error)
+}
+
+// TestVerifyMwebHeaderOnly tests that the mweb header and leafset can be
+// verified without any mweb utxos being requested.
+func TestVerifyMwebHeaderOnly(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, genesis.BlockHash(), wire.MwebHeader{
+			Height:        1,
+			OutputMMRSize: 8,
+		}, []byte{0xff},
+	)
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+
+	peers := &mockMwebPeers{
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+	bm.cfg.QueryDispatcher = &mockDispatcher{query: peers.query}
+
+	require.NoError(t, bm.verifyMwebHeaderOnly(1))
+
+	// Only the getdata for the header and leafset should have been sent.
+	require.Len(t, peers.msgs, 1)
+	for _, msg := range peers.msgs {
+		require.IsType(t, &wire.MsgGetData{}, msg)
+	}
+
+	// A leafset that doesn't match the header should fail verification.
+	peers.mwebLeafset = &wire.MsgMwebLeafset{
+		BlockHash: header.BlockHash(),
+		Leafset:   []byte{0x7f},
+	}
+	require.Error(t, bm.verifyMwebHeaderOnly(1))
+}
+
+// TestMwebHeaderCallback tests that the mweb header callbacks fire with the
+// height and block hash of a verified mweb header, and only once it has
+// been verified.
+func TestMwebHeaderCallback(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, genesis.BlockHash(), wire.MwebHeader{
+			Height:        1,
+			OutputMMRSize: 8,
+		}, []byte{0xff},
+	)
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+
+	peers := &mockMwebPeers{
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	var (
+		headers []*wire.MwebHeader
+		heights []uint32
+		hashes  []chainhash.Hash
+	)
+	bm.RegisterMwebHeaderCallback(func(mwebHeader *wire.MwebHeader,
+		height uint32, hash chainhash.Hash) {
+
+		headers = append(headers, mwebHeader)
+		heights = append(heights, height)
+		hashes = append(hashes, hash)
+
+		// No locks are held while the callback runs, so registering
+		// another callback mustn't deadlock.
+		bm.RegisterMwebHeaderCallback(func(*wire.MwebHeader, uint32,
+			chainhash.Hash) {
+		})
+	})
+
+	require.NoError(t, bm.verifyMwebHeaderOnly(1))
+	require.Len(t, headers, 1)
+	require.Equal(t, mwebHeader.MwebHeader, *headers[0])
+	require.Equal(t, []uint32{1}, heights)
+	require.Equal(t, []chainhash.Hash{header.BlockHash()}, hashes)
+
+	// A header that fails verification doesn't fire the callback.
+	peers.mwebLeafset = &wire.MsgMwebLeafset{
+		BlockHash: header.BlockHash(),
+		Leafset:   []byte{0x7f},
+	}
+	require.Error(t, bm.verifyMwebHeaderOnly(1))
+	require.Len(t, headers, 1)
+}
+
+// TestRefreshMwebState tests that refreshing the mweb state fetches and
+// verifies the mweb header and leafset of the chain tip on demand, and
+// hands them to the mweb handler only if the leafset has changed.
+func TestRefreshMwebState(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, genesis.BlockHash(), wire.MwebHeader{
+			Height:        1,
+			OutputMMRSize: 8,
+		}, []byte{0xff},
+	)
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+
+	peers := &mockMwebPeers{
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	// The mweb coins db has yet to sync the tip's leafset, so the
+	// verified header and leafset are handed to the mweb handler.
+	require.NoError(t, bm.refreshMwebState())
+	require.Len(t, peers.msgs, 1)
+	require.IsType(t, &wire.MsgGetData{}, peers.msgs[0])
+
+	refresh := bm.mwebRefresh
+	require.NotNil(t, refresh)
+	require.Equal(t, header.BlockHash(), refresh.blockHash)
+	require.Equal(t, mwebHeader, refresh.mwebHeader)
+	require.Equal(t, mwebLeafset, refresh.mwebLeafset)
+
+	// The mweb handler's next round takes them without fetching them
+	// again.
+	blockHash := header.BlockHash()
+	gotHeader, gotLeafset, err := bm.nextMwebHeaderAndLeafset(
+		refresh, &blockHash,
+	)
+	require.NoError(t, err)
+	require.Equal(t, mwebHeader, gotHeader)
+	require.Equal(t, mwebLeafset, gotLeafset)
+	require.Len(t, peers.msgs, 1)
+
+	// Once the leafset has been synced, a refresh still fetches the
+	// header and leafset, but doesn't trigger another sync.
+	bm.mwebRefresh = nil
+	coinDB.leafset = &mweb.Leafset{
+		Bits:   []byte{0xff},
+		Size:   8,
+		Height: 1,
+		Block:  header,
+	}
+	require.NoError(t, bm.refreshMwebState())
+	require.Len(t, peers.msgs, 2)
+	require.Nil(t, bm.mwebRefresh)
+
+	// A header that fails verification is an error.
+	peers.mwebLeafset = &wire.MsgMwebLeafset{
+		BlockHash: header.BlockHash(),
+		Leafset:   []byte{0x7f},
+	}
+	require.Error(t, bm.refreshMwebState())
+	require.Nil(t, bm.mwebRefresh)
+}
+
+// TestMwebDistinctUtxosPeer tests that mweb utxos served by one peer verify
+// against the mweb header served by another, and that with
+// MwebDistinctUtxosPeer set, the requests for the utxos are kept from the
+// header's peer, and its utxos are ignored.
+func TestMwebDistinctUtxosPeer(t *testing.T) {
+	t.Parallel()
+
+	t.Run("any peer", func(t *testing.T) {
+		testMwebDistinctUtxosPeer(t, false)
+	})
+	t.Run("distinct peer", func(t *testing.T) {
+		testMwebDistinctUtxosPeer(t, true)
+	})
+}
+
+func testMwebDistinctUtxosPeer(t *testing.T, distinct bool) {
+	t.Parallel()
+
+	const peerA, peerB = "10.0.0.1:9333", "10.0.0.2:9333"
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	bm.cfg.MwebDistinctUtxosPeer = distinct
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset(3, 7)
+	mwebHeader := mmr.mwebHeader()
+	mwebHeader.Height = 1
+	header, msgHeader, msgLeafset := newTestMwebHeader(
+		t, chainhash.Hash{}, *mwebHeader, leafset.Bits,
+	)
+	blockHash := header.BlockHash()
+
+	// Peer A serves the header and leafset.
+	peers := &mockMwebPeers{
+		mwebHeader:  msgHeader,
+		mwebLeafset: msgLeafset,
+		addr:        peerA,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+	_, _, err = bm.fetchMwebHeaderAndLeafset(&blockHash)
+	require.NoError(t, err)
+
+	// Each request goes to the first of peers A and B that it allows.
+	var (
+		mtx      sync.Mutex
+		servedBy []string
+	)
+	serve := func(req *query.Request) {
+		msg := req.Req.(*wire.MsgGetMwebUtxos)
+		resp := mmr.proveUtxos(leafset, msg)
+		for _, peer := range []string{peerA, peerB} {
+			if req.AllowPeer != nil && !req.AllowPeer(peer) {
+				continue
+			}
+			progress := req.HandleResp(req.Req, resp, peer)
+			require.True(t, progress.Finished)
+
+			mtx.Lock()
+			servedBy = append(servedBy, peer)
+			mtx.Unlock()
+			return
+		}
+	}
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					serve(req)
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	leafset.Height = 1
+	leafset.Block = header
+	err = bm.getMwebUtxos(&msgHeader.MwebHeader, leafset, &blockHash)
+	require.NoError(t, err)
+	require.Len(t, coinDB.coins, 18)
+
+	expected := peerA
+	if distinct {
+		expected = peerB
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.NotEmpty(t, servedBy)
+	for _, peer := range servedBy {
+		require.Equal(t, expected, peer)
+	}
+
+	// Should the header's peer serve the utxos anyway, they're ignored.
+	if distinct {
+		msg := wire.NewMsgGetMwebUtxos(
+			blockHash, 0, 1, wire.MwebNetUtxoCompact,
+		)
+		q := &mwebUtxosQuery{
+			blockMgr:   bm,
+			mwebHeader: &msgHeader.MwebHeader,
+			leafset:    leafset,
+			headerPeer: peerA,
+		}
+		progress := q.handleResponse(
+			msg, mmr.proveUtxos(leafset, msg), peerA,
+		)
+		require.Equal(t, query.Progress{}, progress)
+	}
+}
@@ -0,0 +1,180 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebHeaderChainBatch is the number of blocks whose mweb headers are
+// fetched at a time when verifying a chain of them.
+const mwebHeaderChainBatch = 1000
+
+// mwebHeaderChainMaxReorgs is the number of times that the verification of
+// a chain of mweb headers starts over on the blocks it has verified being
+// reorged out, before giving up.
+const mwebHeaderChainMaxReorgs = 3
+
+var (
+	// ErrMwebHeaderHeight is returned when an mweb header is for a
+	// different height from that of the block committing to it.
+	ErrMwebHeaderHeight = errors.New("mweb header height doesn't match " +
+		"block height")
+
+	// ErrMwebKernelMMRShrunk is returned when an mweb header has fewer
+	// leaves in its kernel MMR than the previous block's, which it must
+	// append to.
+	ErrMwebKernelMMRShrunk = errors.New("mweb header kernel mmr is " +
+		"smaller than previous block's")
+
+	// ErrMwebHeaderChainReorged is returned when the chain is reorged
+	// too many times while a chain of mweb headers is being verified.
+	ErrMwebHeaderChainReorged = errors.New("chain reorged too many " +
+		"times while verifying mweb header chain")
+)
+
+// verifyMwebHeaderLink checks that the mweb header of the block at the given
+// height follows on from the mweb header of the block before it. Its hogex
+// must spend the previous hogex, and its output and kernel MMRs must build
+// on the previous block's.
+func verifyMwebHeaderLink(prev, mwebHeader *wire.MsgMwebHeader,
+	height uint32) error {
+
+	if mwebHeader.MwebHeader.Height != int32(height) {
+		return fmt.Errorf("%w: got %v, expected %v",
+			ErrMwebHeaderHeight, mwebHeader.MwebHeader.Height,
+			height)
+	}
+	if prev == nil {
+		return nil
+	}
+
+	prevHogexHash := prev.Hogex.TxHash()
+	err := verifyMwebHogexChain(&prevHogexHash, &mwebHeader.Hogex)
+	if err != nil {
+		return err
+	}
+
+	// Outputs and kernels are only ever appended to their MMRs.
+	outputMMRSize := mwebHeader.MwebHeader.OutputMMRSize
+	if outputMMRSize < prev.MwebHeader.OutputMMRSize {
+		return fmt.Errorf("%w: got %v leaves, previous block has %v",
+			ErrMwebOutputMMRShrunk, outputMMRSize,
+			prev.MwebHeader.OutputMMRSize)
+	}
+	kernelMMRSize := mwebHeader.MwebHeader.KernelMMRSize
+	if kernelMMRSize < prev.MwebHeader.KernelMMRSize {
+		return fmt.Errorf("%w: got %v leaves, previous block has %v",
+			ErrMwebKernelMMRShrunk, kernelMMRSize,
+			prev.MwebHeader.KernelMMRSize)
+	}
+
+	return nil
+}
+
+// verifyMwebHeaderChain fetches the mweb headers of the blocks from
+// fromHeight to toHeight, a batch at a time, verifying each against its
+// block and checking that each follows on from the one before. The mweb
+// header at fromHeight is taken as the checkpoint that the rest are
+// verified from. Should blocks already verified be reorged out, the
+// verification picks up again from the start of the batch, or from
+// fromHeight if the reorg goes deeper than that.
+func (b *blockManager) verifyMwebHeaderChain(fromHeight,
+	toHeight uint32) error {
+
+	if fromHeight > toHeight {
+		return fmt.Errorf("invalid mweb header chain range, from "+
+			"height %v to %v", fromHeight, toHeight)
+	}
+
+	log.Infof("Verifying mweb header chain from height %v to %v",
+		fromHeight, toHeight)
+
+	var (
+		prev     *wire.MsgMwebHeader
+		prevHash chainhash.Hash
+		reorgs   int
+	)
+	for height := fromHeight; height <= toHeight; {
+		endHeight := toHeight
+		if endHeight-height >= mwebHeaderChainBatch {
+			endHeight = height + mwebHeaderChainBatch - 1
+		}
+
+		hashes := make([]chainhash.Hash, 0, endHeight-height+1)
+		for h := height; h <= endHeight; h++ {
+			header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(h)
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, header.BlockHash())
+		}
+
+		headers := make(map[chainhash.Hash]*wire.MsgMwebHeader,
+			len(hashes))
+		fetchErr := b.fetchMwebHeaders(hashes,
+			func(r *wire.MsgMwebHeader) {
+				headers[r.Merkle.Header.BlockHash()] = r
+			},
+		)
+		if fetchErr == ErrShuttingDown || fetchErr == errMwebCancelled {
+			return fetchErr
+		}
+
+		// The blocks of the batch are still in the chain if its last
+		// block is, along with those verified before them. The mweb
+		// headers of blocks reorged out may not be served at all, so
+		// this is checked before giving up on the fetch.
+		if !b.isMwebBlockInChain(endHeight, hashes[len(hashes)-1],
+			toHeight) {
+
+			reorgs++
+			if reorgs > mwebHeaderChainMaxReorgs {
+				return ErrMwebHeaderChainReorged
+			}
+
+			if prev != nil && !b.isMwebBlockInChain(
+				height-1, prevHash, toHeight,
+			) {
+
+				prev = nil
+				height = fromHeight
+			}
+
+			log.Infof("Chain reorged while verifying mweb "+
+				"header chain, resuming from height %v",
+				height)
+			continue
+		}
+		if fetchErr != nil {
+			return fetchErr
+		}
+
+		for i, blockHash := range hashes {
+			h := height + uint32(i)
+			mwebHeader := headers[blockHash]
+			err := verifyMwebHeaderLink(prev, mwebHeader, h)
+			if err != nil {
+				return fmt.Errorf("mweb header chain broken "+
+					"at height %v: %w", h, err)
+			}
+			prev, prevHash = mwebHeader, blockHash
+		}
+
+		log.Debugf("Verified mweb header chain up to height %v",
+			endHeight)
+
+		// The range may end at the largest height there can be.
+		if endHeight == toHeight {
+			break
+		}
+		height = endHeight + 1
+	}
+
+	log.Infof("Verified mweb header chain from height %v to %v",
+		fromHeight, toHeight)
+
+	return nil
+}
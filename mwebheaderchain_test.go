@@ -0,0 +1,340 @@
+package neutrino
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMwebHeaderChain creates the mweb headers of a chain of blocks after
+// prevBlock, with the hogex of the first spending prevOut and that of each
+// after spending the hogex before it.
+func newTestMwebHeaderChain(t *testing.T, prevBlock chainhash.Hash,
+	prevOut wire.OutPoint,
+	mwebHeaders ...wire.MwebHeader) []*wire.MsgMwebHeader {
+
+	var chain []*wire.MsgMwebHeader
+	for _, mwebHeader := range mwebHeaders {
+		_, m, _ := newTestMwebHeader(t, prevBlock, mwebHeader, nil)
+		prevBlock = chainTestHogex(m, prevOut)
+		prevOut = wire.OutPoint{Hash: m.Hogex.TxHash()}
+		chain = append(chain, m)
+	}
+	return chain
+}
+
+// nextTestMwebHeader returns the mweb header of the block at the given
+// height, adding the given numbers of outputs and kernels to the block
+// before it.
+func nextTestMwebHeader(prev *wire.MwebHeader, height int32, outputs,
+	kernels uint64) wire.MwebHeader {
+
+	return wire.MwebHeader{
+		Height:        height,
+		OutputMMRSize: prev.OutputMMRSize + outputs,
+		KernelMMRSize: prev.KernelMMRSize + kernels,
+	}
+}
+
+// errTestQueryUnanswered is returned by the mock dispatcher when it has no
+// answer for a query.
+var errTestQueryUnanswered = errors.New("query unanswered")
+
+// serveTestMwebHeaders returns a dispatcher that answers the queries for
+// mweb headers with the given ones, in the reverse order to that asked for,
+// so that none can be checked against the one before it as it comes in.
+// Each query is passed to onQuery first, if it's set.
+func serveTestMwebHeaders(served []*wire.MsgMwebHeader,
+	onQuery func()) *mockDispatcher {
+
+	byHash := make(map[chainhash.Hash]*wire.MsgMwebHeader, len(served))
+	for _, m := range served {
+		byHash[m.Merkle.Header.BlockHash()] = m
+	}
+
+	return &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			if onQuery != nil {
+				onQuery()
+			}
+
+			errChan := make(chan error, 1)
+			go func() {
+				var err error
+				for i := len(requests) - 1; i >= 0; i-- {
+					if !answerTestMwebHeaders(
+						requests[i], byHash,
+					) {
+
+						err = errTestQueryUnanswered
+					}
+				}
+				errChan <- err
+			}()
+			return errChan
+		},
+	}
+}
+
+// answerTestMwebHeaders answers the request with the mweb headers it asks
+// for, last first, returning whether it was finished.
+func answerTestMwebHeaders(req *query.Request,
+	byHash map[chainhash.Hash]*wire.MsgMwebHeader) bool {
+
+	invList := slices.Clone(req.Req.(*wire.MsgGetData).InvList)
+
+	var progress query.Progress
+	for i := len(invList) - 1; i >= 0; i-- {
+		m, ok := byHash[invList[i].Hash]
+		if !ok {
+			continue
+		}
+		progress = req.HandleResp(req.Req, m, "10.0.0.1:9333")
+	}
+	return progress.Finished
+}
+
+// writeTestBlocks writes the blocks committing to the mweb headers to the
+// header store, from the given height.
+func writeTestBlocks(t *testing.T, hdrStore headerfs.BlockHeaderStore,
+	height uint32, chain []*wire.MsgMwebHeader) {
+
+	for i, m := range chain {
+		header := m.Merkle.Header
+		require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+			BlockHeader: &header,
+			Height:      height + uint32(i),
+		}))
+	}
+}
+
+// TestVerifyMwebHeaderChain tests that a chain of mweb headers verifies
+// from any block in it, and that a reorg during the verification is
+// followed.
+func TestVerifyMwebHeaderChain(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+
+	var mwebHeaders []wire.MwebHeader
+	prev := &wire.MwebHeader{}
+	for height := int32(1); height <= 5; height++ {
+		mwebHeaders = append(mwebHeaders,
+			nextTestMwebHeader(prev, height, 8, 2))
+		prev = &mwebHeaders[len(mwebHeaders)-1]
+	}
+	chain := newTestMwebHeaderChain(
+		t, genesis.BlockHash(), wire.OutPoint{Index: 1},
+		mwebHeaders...,
+	)
+	writeTestBlocks(t, hdrStore, 1, chain)
+
+	// The blocks at heights 4 and 5 may be reorged out for others.
+	fork := chain[2]
+	forkHeader := &fork.MwebHeader
+	header4 := nextTestMwebHeader(forkHeader, 4, 3, 1)
+	header5 := nextTestMwebHeader(&header4, 5, 0, 0)
+	reorged := newTestMwebHeaderChain(
+		t, fork.Merkle.Header.BlockHash(),
+		wire.OutPoint{Hash: fork.Hogex.TxHash()}, header4, header5,
+	)
+
+	var queries int
+	bm.cfg.QueryDispatcher = serveTestMwebHeaders(
+		append(slices.Clone(chain), reorged...), func() {
+			queries++
+		},
+	)
+
+	require.NoError(t, bm.verifyMwebHeaderChain(1, 5))
+	require.NoError(t, bm.verifyMwebHeaderChain(2, 4))
+	require.NoError(t, bm.verifyMwebHeaderChain(3, 3))
+	require.Equal(t, 3, queries)
+
+	err = bm.verifyMwebHeaderChain(4, 3)
+	require.Error(t, err)
+	err = bm.verifyMwebHeaderChain(1, 6)
+	require.Error(t, err)
+
+	// The chain switches between the two forks as each batch of mweb
+	// headers is being fetched, so that the headers fetched are no
+	// longer of the chain.
+	reorg := func() {
+		queries++
+		tip, err := hdrStore.FetchHeaderByHeight(5)
+		require.NoError(t, err)
+
+		next := reorged
+		if tip.BlockHash() == reorged[1].Merkle.Header.BlockHash() {
+			next = chain[3:]
+		}
+		for i := 0; i < 2; i++ {
+			_, err := hdrStore.RollbackLastBlock()
+			require.NoError(t, err)
+		}
+		writeTestBlocks(t, hdrStore, 4, next)
+	}
+
+	// Once the chain has switched forks, the headers of the new fork
+	// are fetched and verified.
+	queries = 0
+	bm.cfg.QueryDispatcher = serveTestMwebHeaders(
+		append(slices.Clone(chain), reorged...), func() {
+			if queries == 0 {
+				reorg()
+			} else {
+				queries++
+			}
+		},
+	)
+	require.NoError(t, bm.verifyMwebHeaderChain(2, 5))
+	require.Equal(t, 2, queries)
+
+	tip, err := hdrStore.FetchHeaderByHeight(5)
+	require.NoError(t, err)
+	require.Equal(t, reorged[1].Merkle.Header.BlockHash(), tip.BlockHash())
+
+	// A chain that keeps switching forks is given up on.
+	queries = 0
+	bm.cfg.QueryDispatcher = serveTestMwebHeaders(
+		append(slices.Clone(chain), reorged...), reorg,
+	)
+	err = bm.verifyMwebHeaderChain(1, 5)
+	require.ErrorIs(t, err, ErrMwebHeaderChainReorged)
+	require.Equal(t, mwebHeaderChainMaxReorgs+1, queries)
+}
+
+// TestVerifyMwebHeaderChainBroken tests that a chain of mweb headers with a
+// broken link fails to verify across the link, however the mweb headers
+// come in.
+func TestVerifyMwebHeaderChainBroken(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+
+		// header3 is the mweb header of the block at height 3, given
+		// that of the block before it.
+		header3 func(prev *wire.MwebHeader) wire.MwebHeader
+
+		// prevOut3 is the outpoint that the hogex of the block at
+		// height 3 spends, given the right one.
+		prevOut3 func(prevOut wire.OutPoint) wire.OutPoint
+
+		err error
+	}{{
+		name: "hogex chain",
+		header3: func(prev *wire.MwebHeader) wire.MwebHeader {
+			return nextTestMwebHeader(prev, 3, 1, 1)
+		},
+		prevOut3: func(prevOut wire.OutPoint) wire.OutPoint {
+			prevOut.Index = 1
+			return prevOut
+		},
+		err: ErrMwebHogexChain,
+	}, {
+		name: "output mmr shrunk",
+		header3: func(prev *wire.MwebHeader) wire.MwebHeader {
+			header := nextTestMwebHeader(prev, 3, 0, 1)
+			header.OutputMMRSize--
+			return header
+		},
+		err: ErrMwebOutputMMRShrunk,
+	}, {
+		name: "kernel mmr shrunk",
+		header3: func(prev *wire.MwebHeader) wire.MwebHeader {
+			header := nextTestMwebHeader(prev, 3, 1, 0)
+			header.KernelMMRSize--
+			return header
+		},
+		err: ErrMwebKernelMMRShrunk,
+	}, {
+		name: "height",
+		header3: func(prev *wire.MwebHeader) wire.MwebHeader {
+			return nextTestMwebHeader(prev, 4, 1, 1)
+		},
+		err: ErrMwebHeaderHeight,
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			testVerifyMwebHeaderChainBroken(
+				t, test.header3, test.prevOut3, test.err,
+			)
+		})
+	}
+}
+
+// testVerifyMwebHeaderChainBroken verifies a chain of mweb headers whose
+// link between heights 2 and 3 is broken by the given mweb header or hogex
+// outpoint of the block at height 3, expecting the given error.
+func testVerifyMwebHeaderChainBroken(t *testing.T,
+	header3Fn func(prev *wire.MwebHeader) wire.MwebHeader,
+	prevOut3Fn func(prevOut wire.OutPoint) wire.OutPoint, wantErr error) {
+
+	header1 := wire.MwebHeader{
+		Height:        1,
+		OutputMMRSize: 8,
+		KernelMMRSize: 2,
+	}
+	header2 := nextTestMwebHeader(&header1, 2, 8, 2)
+	chain := newTestMwebHeaderChain(
+		t, *chaincfg.SimNetParams.GenesisHash, wire.OutPoint{},
+		header1, header2,
+	)
+
+	last := chain[len(chain)-1]
+	prevOut := wire.OutPoint{Hash: last.Hogex.TxHash()}
+	if prevOut3Fn != nil {
+		prevOut = prevOut3Fn(prevOut)
+	}
+	header3 := header3Fn(&header2)
+	chain = append(chain, newTestMwebHeaderChain(
+		t, last.Merkle.Header.BlockHash(), prevOut, header3,
+	)...)
+
+	last = chain[len(chain)-1]
+	chain = append(chain, newTestMwebHeaderChain(
+		t, last.Merkle.Header.BlockHash(),
+		wire.OutPoint{Hash: last.Hogex.TxHash()},
+		nextTestMwebHeader(&header3, 4, 8, 2),
+	)...)
+
+	// Each block manager remembers the mweb headers it has verified,
+	// which are checked against those served after them, so a new one
+	// is set up for each verification to leave the chain to be checked
+	// only as a whole.
+	newBlockManager := func() *blockManager {
+		bm, hdrStore, _, err := setupBlockManager(t)
+		require.NoError(t, err)
+		writeTestBlocks(t, hdrStore, 1, chain)
+		bm.cfg.QueryDispatcher = serveTestMwebHeaders(chain, nil)
+		return bm
+	}
+
+	err := newBlockManager().verifyMwebHeaderChain(1, 4)
+	require.ErrorIs(t, err, wantErr)
+	require.ErrorContains(t, err, "height 3")
+
+	// The chain verifies on either side of the link, the later side
+	// first so that it isn't checked against the earlier.
+	bm := newBlockManager()
+	if wantErr != ErrMwebHeaderHeight {
+		require.NoError(t, bm.verifyMwebHeaderChain(3, 4))
+	}
+	require.NoError(t, bm.verifyMwebHeaderChain(1, 2))
+}
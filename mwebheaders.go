@@ -3,7 +3,7 @@ package neutrino
 import (
 	"slices"
 
-	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
 	"github.com/ltcmweb/ltcd/wire"
 	"github.com/ltcmweb/neutrino/banman"
 	"github.com/ltcmweb/neutrino/query"
@@ -67,7 +67,7 @@ func (b *blockManager) getMwebHeaderBatch(fromHeight, toHeight,
 	log.Debugf("Fetching mweb headers from height %v to %v",
 		fromHeight, toHeight)
 
-	var queryMsgs []wire.Message
+	var hashes []chainhash.Hash
 	var heights []uint32
 	for height := fromHeight; height < toHeight; height += stride {
 		if _, ok := heightMap[height]; ok {
@@ -77,39 +77,66 @@ func (b *blockManager) getMwebHeaderBatch(fromHeight, toHeight,
 		if err != nil {
 			return err
 		}
-		hash := header.BlockHash()
-
-		var gdmsg *wire.MsgGetData
-		if len(queryMsgs) > 0 {
-			gdmsg = queryMsgs[len(queryMsgs)-1].(*wire.MsgGetData)
-			if len(gdmsg.InvList) == 100 {
-				gdmsg = nil
-			}
-		}
-		if gdmsg == nil {
-			gdmsg = wire.NewMsgGetData()
-			queryMsgs = append(queryMsgs, gdmsg)
-		}
-		gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &hash))
+		hashes = append(hashes, header.BlockHash())
 		heights = append(heights, height)
 	}
 
+	if len(heights) == 0 {
+		return nil
+	}
+
+	log.Infof("Starting to query for mweb headers from height=%v", heights[0])
+
 	// We'll also create an additional map that we'll use to
 	// re-order the responses as we get them in.
 	queryResponses := make(map[uint32]uint64, len(heights))
 
-	batchesCount := len(queryMsgs)
-	if batchesCount == 0 {
-		return nil
+	err := b.fetchMwebHeaders(hashes, func(r *wire.MsgMwebHeader) {
+		height := uint32(r.MwebHeader.Height)
+		blockHash := r.Merkle.Header.BlockHash()
+
+		log.Debugf("Got mwebheader at height=%v, block hash=%v",
+			height, blockHash)
+
+		b.notifyMwebHeader(&r.MwebHeader, blockHash)
+
+		queryResponses[height] = r.MwebHeader.OutputMMRSize
+	})
+	if err != nil {
+		return err
 	}
 
-	log.Infof("Starting to query for mweb headers from height=%v", heights[0])
+	return b.cfg.MwebCoins.PutLeavesAtHeight(queryResponses)
+}
+
+// fetchMwebHeaders queries our peers for the mweb headers of the given
+// blocks, passing each to handle once it has been verified. It returns once
+// all of them have been handled.
+func (b *blockManager) fetchMwebHeaders(hashes []chainhash.Hash,
+	handle func(*wire.MsgMwebHeader)) error {
+
+	var queryMsgs []wire.Message
+	pending := make(map[chainhash.Hash]struct{}, len(hashes))
+	for i := range hashes {
+		if i%100 == 0 {
+			queryMsgs = append(queryMsgs, wire.NewMsgGetData())
+		}
+		gdmsg := queryMsgs[len(queryMsgs)-1].(*wire.MsgGetData)
+		gdmsg.AddInvVect(
+			wire.NewInvVect(wire.InvTypeMwebHeader, &hashes[i]),
+		)
+		pending[hashes[i]] = struct{}{}
+	}
+
+	if len(queryMsgs) == 0 {
+		return nil
+	}
 
 	// With the set of messages constructed, we'll now request the batch
 	// all at once. This message will distribute the mwebheader requests
 	// amongst all active peers, effectively sharding each query
 	// dynamically.
-	headersChan := make(chan *wire.MsgMwebHeader, len(heights))
+	headersChan := make(chan *wire.MsgMwebHeader, len(hashes))
 	q := mwebHeadersQuery{
 		blockMgr:    b,
 		msgs:        queryMsgs,
@@ -117,14 +144,19 @@ func (b *blockManager) getMwebHeaderBatch(fromHeight, toHeight,
 	}
 
 	// Hand the queries to the work manager, and consume the verified
-	// responses as they come back.
+	// responses as they come back. The queries are cancelled as soon as
+	// we stop consuming them.
+	cancelled := b.mwebPause.cancelledChan()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	builder := q.requestBuilder(cancel)
 	errChan := b.cfg.QueryDispatcher.Query(
-		q.requests(), query.Cancel(b.quit),
+		mwebRequests(builder, q.msgs), builder.options()...,
 	)
 
 	// Keep waiting for more mweb headers as long as we haven't received an
 	// answer for our last getdata message, and no error is encountered.
-	for len(queryResponses) < len(heights) {
+	for len(pending) > 0 {
 		var r *wire.MsgMwebHeader
 		select {
 		case r = <-headersChan:
@@ -143,32 +175,36 @@ func (b *blockManager) getMwebHeaderBatch(fromHeight, toHeight,
 			// headersChan.
 			continue
 
+		case <-cancelled:
+			return errMwebCancelled
+
 		case <-b.quit:
 			return ErrShuttingDown
 		}
 
-		height := uint32(r.MwebHeader.Height)
 		blockHash := r.Merkle.Header.BlockHash()
+		if _, ok := pending[blockHash]; !ok {
+			continue
+		}
+		delete(pending, blockHash)
 
-		log.Debugf("Got mwebheader at height=%v, block hash=%v",
-			height, blockHash)
-
-		queryResponses[height] = r.MwebHeader.OutputMMRSize
+		handle(r)
 	}
 
-	return b.cfg.MwebCoins.PutLeavesAtHeight(queryResponses)
+	return nil
 }
 
-// requests creates the query.Requests for this mwebheader query.
-func (m *mwebHeadersQuery) requests() []*query.Request {
-	reqs := make([]*query.Request, len(m.msgs))
-	for idx, msg := range m.msgs {
-		reqs[idx] = &query.Request{
-			Req:        msg,
-			HandleResp: m.handleResponse,
-		}
+// requestBuilder returns the builder of the query.Requests for this
+// mwebheader query, which are cancelled once the given channel is closed.
+func (m *mwebHeadersQuery) requestBuilder(
+	cancel chan struct{}) *mwebRequestBuilder {
+
+	return &mwebRequestBuilder{
+		handleResp:  m.handleResponse,
+		allowPeer:   m.blockMgr.mwebQueryPeers.allowPeer(),
+		selectPeers: m.blockMgr.selectMwebPeers,
+		cancel:      cancel,
 	}
-	return reqs
 }
 
 // handleResponse is the internal response handler used for requests
@@ -198,19 +234,19 @@ func (m *mwebHeadersQuery) handleResponse(req, resp wire.Message,
 		return query.Progress{}
 	}
 
-	if err := mweb.VerifyHeader(r); err != nil {
-		log.Warnf("Failed to verify mwebheader at block hash %v!!!",
-			blockHash)
+	err := m.blockMgr.verifyMwebHeaderChained(&blockHash, r)
+	if err != nil {
+		m.blockMgr.mwebFailureLog.logf(peerAddr,
+			"Failed to verify mwebheader at block hash %v from "+
+				"peer %v: %v", blockHash, peerAddr, err)
 
 		// If the peer gives us a bad mwebheader message,
-		// then we'll ban the peer so we can re-allocate
-		// the query elsewhere.
-		err := m.blockMgr.cfg.BanPeer(
-			peerAddr, banman.InvalidMwebHeader,
+		// then we'll punish the peer, banning it if the ban
+		// policy says so, and re-allocate the query elsewhere.
+		m.blockMgr.recordMwebFailure(
+			peerAddr, r, banman.InvalidMwebHeader, err,
 		)
-		if err != nil {
-			log.Errorf("Unable to ban peer %v: %v", peerAddr, err)
-		}
+		m.blockMgr.punishPeer(peerAddr, banman.InvalidMwebHeader)
 
 		return query.Progress{}
 	}
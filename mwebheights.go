@@ -0,0 +1,58 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrMwebLeafHeightUnknown is returned when the leaf counts stored by the
+// mweb sync don't pin down which block a leaf was created in, or which
+// leaves a block created. Only the leaf counts of the blocks that the mweb
+// sync stopped at are stored.
+var ErrMwebLeafHeightUnknown = errors.New("mweb leaf height unknown")
+
+// leafIndexToHeight returns the height of the block that created the leaf,
+// according to the leaf counts of the blocks in the height map. The leaf
+// was created by the first block whose leaf count covers it, as long as the
+// leaf count of the block before that is known too.
+func leafIndexToHeight(heightMap map[uint32]uint64,
+	leafIndex uint64) (uint32, error) {
+
+	heights := sortedHeights(heightMap)
+	i := sort.Search(len(heights), func(i int) bool {
+		return heightMap[heights[i]] > leafIndex
+	})
+	if i == len(heights) {
+		return 0, fmt.Errorf("%w: leaf %v is beyond the last known "+
+			"block", ErrMwebLeafHeightUnknown, leafIndex)
+	}
+
+	height := heights[i]
+	if i == 0 || heights[i-1] != height-1 {
+		return 0, fmt.Errorf("%w: leaf %v was created at or before "+
+			"height %v", ErrMwebLeafHeightUnknown, leafIndex,
+			height)
+	}
+	return height, nil
+}
+
+// heightToLeafRange returns the range of leaves created by the block at the
+// given height, from start inclusive to end exclusive, according to the
+// leaf counts of the blocks in the height map. The leaf counts of both the
+// block and the one before it must be known.
+func heightToLeafRange(heightMap map[uint32]uint64,
+	height uint32) (uint64, uint64, error) {
+
+	end, ok := heightMap[height]
+	if !ok || height == 0 {
+		return 0, 0, fmt.Errorf("%w: no leaf count for height %v",
+			ErrMwebLeafHeightUnknown, height)
+	}
+	start, ok := heightMap[height-1]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: no leaf count for height %v",
+			ErrMwebLeafHeightUnknown, height-1)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,53 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebLeafHeights tests the mapping between mweb leaf indices and the
+// heights of the blocks that created them, and that the mappings are
+// inverses where the leaf counts pin down the blocks.
+func TestMwebLeafHeights(t *testing.T) {
+	t.Parallel()
+
+	coinDB := newMockCoinDatabase()
+	coinDB.leavesAtHeight = map[uint32]uint64{
+		10: 4, 11: 8, 12: 8, 13: 15, 20: 30, 21: 32,
+	}
+	s := &ChainService{MwebCoinDB: coinDB}
+
+	// Each known block's leaves map back to it.
+	for _, height := range []uint32{11, 12, 13, 21} {
+		start, end, err := s.HeightToLeafRange(height)
+		require.NoError(t, err)
+		require.Equal(t, coinDB.leavesAtHeight[height-1], start)
+		require.Equal(t, coinDB.leavesAtHeight[height], end)
+
+		for leafIdx := start; leafIdx < end; leafIdx++ {
+			got, err := s.LeafIndexToHeight(leafIdx)
+			require.NoError(t, err)
+			require.Equal(t, height, got)
+		}
+	}
+
+	// A block that created no leaves has an empty range.
+	start, end, err := s.HeightToLeafRange(12)
+	require.NoError(t, err)
+	require.Equal(t, start, end)
+
+	// Without the leaf count of the block before, the block's leaves
+	// are unknown.
+	for _, height := range []uint32{10, 14, 20, 22} {
+		_, _, err := s.HeightToLeafRange(height)
+		require.ErrorIs(t, err, ErrMwebLeafHeightUnknown)
+	}
+
+	// Leaves created before the first known block, or within a gap in
+	// the leaf counts, or after the last block, can't be placed.
+	for _, leafIdx := range []uint64{0, 3, 15, 29, 32} {
+		_, err := s.LeafIndexToHeight(leafIdx)
+		require.ErrorIs(t, err, ErrMwebLeafHeightUnknown)
+	}
+}
@@ -0,0 +1,227 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebHeaderCacheSize is the number of verified mweb headers that are
+// remembered for checking the headers served for the same block again, and
+// that the hogexes of the blocks after them chain to them.
+const mwebHeaderCacheSize = 4096
+
+var (
+	// ErrMwebHogexChain is returned when the hogex of an mweb header
+	// doesn't spend the hogex output of the previous block.
+	ErrMwebHogexChain = errors.New("mweb header hogex doesn't chain to " +
+		"previous hogex")
+
+	// ErrMwebLeafsetRootChanged is returned when an mweb header has a
+	// different leafset root from the one verified before for the same
+	// block.
+	ErrMwebLeafsetRootChanged = errors.New("mweb header leafset root " +
+		"changed for the same block")
+
+	// ErrMwebOutputMMRShrunk is returned when an mweb header has fewer
+	// leaves in its output MMR than the previous block's, which it must
+	// append to.
+	ErrMwebOutputMMRShrunk = errors.New("mweb header output mmr is " +
+		"smaller than previous block's")
+
+	// ErrMwebLeafsetShrunk is returned when an mweb leafset is shorter
+	// than the one validated before for the same block.
+	ErrMwebLeafsetShrunk = errors.New("mweb leafset is shorter than " +
+		"the one validated for the same block")
+)
+
+// verifiedMwebHeader holds what's remembered of a verified mweb header.
+type verifiedMwebHeader struct {
+	hogexHash     chainhash.Hash
+	leafsetRoot   chainhash.Hash
+	outputMMRSize uint64
+
+	// leafsetLen is the length in bytes of the longest leafset
+	// validated against the header, or zero if there's been none.
+	leafsetLen int
+
+	// servedBy is the peer whose copy of the header was last used, along
+	// with its leafset, or empty if none has been.
+	servedBy string
+}
+
+// mwebHeaderCache remembers the verified mweb headers by block hash,
+// evicting the oldest once it holds mwebHeaderCacheSize of them. The zero
+// value is ready to use, and it is safe for concurrent use.
+type mwebHeaderCache struct {
+	mtx     sync.Mutex
+	headers map[chainhash.Hash]verifiedMwebHeader
+	order   []chainhash.Hash
+}
+
+// add remembers the verified mweb header of the given block.
+func (c *mwebHeaderCache) add(blockHash chainhash.Hash,
+	header verifiedMwebHeader) {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.headers == nil {
+		c.headers = make(map[chainhash.Hash]verifiedMwebHeader)
+	}
+	if _, ok := c.headers[blockHash]; ok {
+		return
+	}
+	if len(c.order) == mwebHeaderCacheSize {
+		delete(c.headers, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.headers[blockHash] = header
+	c.order = append(c.order, blockHash)
+}
+
+// get returns the verified mweb header of the given block, if it's known.
+func (c *mwebHeaderCache) get(blockHash chainhash.Hash) (verifiedMwebHeader,
+	bool) {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	header, ok := c.headers[blockHash]
+	return header, ok
+}
+
+// addLeafset remembers that a leafset of the given length was validated for
+// the block, if its mweb header is known.
+func (c *mwebHeaderCache) addLeafset(blockHash chainhash.Hash,
+	leafsetLen int) {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	header, ok := c.headers[blockHash]
+	if !ok || header.leafsetLen >= leafsetLen {
+		return
+	}
+	header.leafsetLen = leafsetLen
+	c.headers[blockHash] = header
+}
+
+// setServedBy records the peer whose copy of the block's mweb header is
+// being used, if the header is known.
+func (c *mwebHeaderCache) setServedBy(blockHash chainhash.Hash, peer string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	header, ok := c.headers[blockHash]
+	if !ok {
+		return
+	}
+	header.servedBy = peer
+	c.headers[blockHash] = header
+}
+
+// verifyMwebHogexChain checks that the first input of the hogex spends the
+// first output of the previous block's hogex, which pays to the HogAddr
+// holding the pegged-in coins of the extension block.
+func verifyMwebHogexChain(prevHogexHash *chainhash.Hash,
+	hogex *wire.MsgTx) error {
+
+	prevOut := wire.OutPoint{Hash: *prevHogexHash}
+	if len(hogex.TxIn) == 0 {
+		return fmt.Errorf("%w: hogex has no inputs, expected %v",
+			ErrMwebHogexChain, prevOut)
+	}
+	if hogex.TxIn[0].PreviousOutPoint != prevOut {
+		return fmt.Errorf("%w: got %v, expected %v", ErrMwebHogexChain,
+			hogex.TxIn[0].PreviousOutPoint, prevOut)
+	}
+
+	return nil
+}
+
+// isMwebHeaderConflict returns whether the error is from an mweb header
+// that conflicts with the mweb headers verified before it.
+func isMwebHeaderConflict(err error) bool {
+	return errors.Is(err, ErrMwebHogexChain) ||
+		errors.Is(err, ErrMwebLeafsetRootChanged) ||
+		errors.Is(err, ErrMwebOutputMMRShrunk)
+}
+
+// verifyMwebHeaderChained checks the mweb header as verifyMwebHeaderDetailed
+// does, and against the mweb headers verified before. Its leafset root must
+// match that of any header verified for the same block, and its hogex must
+// chain to the hogex of the previous block if that has been verified, with
+// its output MMR building on the previous block's. A header that verifies
+// is remembered for checking those served after it.
+func (b *blockManager) verifyMwebHeaderChained(blockHash *chainhash.Hash,
+	mwebHeader *wire.MsgMwebHeader) error {
+
+	// This is checked first so that a header for another block is
+	// reported as such, rather than as a changed leafset root.
+	err := verifyMwebHeaderDetailed(blockHash, mwebHeader)
+	if err != nil {
+		return err
+	}
+
+	// The leafset root is committed to by the block, so a peer serving a
+	// different one for a block we've verified is either buggy or lying.
+	leafsetRoot := mwebHeader.MwebHeader.LeafsetRoot
+	if known, ok := b.mwebHeaders.get(*blockHash); ok &&
+		known.leafsetRoot != leafsetRoot {
+
+		return fmt.Errorf("%w: block %v, got %v, expected %v",
+			ErrMwebLeafsetRootChanged, blockHash, leafsetRoot,
+			known.leafsetRoot)
+	}
+
+	prevBlock := mwebHeader.Merkle.Header.PrevBlock
+	if prev, ok := b.mwebHeaders.get(prevBlock); ok {
+		err := verifyMwebHogexChain(&prev.hogexHash, &mwebHeader.Hogex)
+		if err != nil {
+			return err
+		}
+
+		// Outputs are only ever appended to the output MMR.
+		outputMMRSize := mwebHeader.MwebHeader.OutputMMRSize
+		if outputMMRSize < prev.outputMMRSize {
+			return fmt.Errorf("%w: got %v leaves, previous block "+
+				"has %v", ErrMwebOutputMMRShrunk,
+				outputMMRSize, prev.outputMMRSize)
+		}
+	}
+
+	b.mwebHeaders.add(*blockHash, verifiedMwebHeader{
+		hogexHash:     mwebHeader.Hogex.TxHash(),
+		leafsetRoot:   leafsetRoot,
+		outputMMRSize: mwebHeader.MwebHeader.OutputMMRSize,
+	})
+
+	return nil
+}
+
+// checkMwebLeafsetShrink checks that the mweb leafset is no shorter than
+// the leafset validated before for the same block. Being committed to by
+// the block, the leafset can't change, so a peer serving a shorter one is
+// either buggy or lying. Unlike a leafset that doesn't match the leafset
+// root, which may come of pairing it with another peer's header, this is
+// down to the peer that served it. A leafset for another block, such as an
+// older one that is rightly shorter, is left to be rejected as such.
+func (b *blockManager) checkMwebLeafsetShrink(blockHash *chainhash.Hash,
+	mwebLeafset *wire.MsgMwebLeafset) error {
+
+	if mwebLeafset.BlockHash != *blockHash {
+		return nil
+	}
+	known, ok := b.mwebHeaders.get(*blockHash)
+	if !ok || len(mwebLeafset.Leafset) >= known.leafsetLen {
+		return nil
+	}
+
+	return fmt.Errorf("%w: block %v, got %v bytes, expected %v",
+		ErrMwebLeafsetShrunk, blockHash, len(mwebLeafset.Leafset),
+		known.leafsetLen)
+}
@@ -0,0 +1,257 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/peer"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/stretchr/testify/require"
+)
+
+// chainTestHogex makes the hogex of the test mweb header spend the given
+// outpoint, updating the block committing to it, and returns the hash of
+// that block.
+func chainTestHogex(m *wire.MsgMwebHeader,
+	prevOut wire.OutPoint) chainhash.Hash {
+
+	m.Hogex.TxIn = nil
+	m.Hogex.AddTxIn(wire.NewTxIn(&prevOut, nil, nil))
+
+	hogexHash := m.Hogex.TxHash()
+	m.Merkle.Header.MerkleRoot = hogexHash
+	m.Merkle.Hashes = []*chainhash.Hash{&hogexHash}
+
+	return m.Merkle.Header.BlockHash()
+}
+
+// TestMwebHogexChain tests that an mweb header is only verified if its hogex
+// spends the hogex output of the previous block, when that is known.
+func TestMwebHogexChain(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	// Without the previous block's hogex, the chain can't be checked.
+	_, header1, _ := newTestMwebHeader(
+		t, chainhash.Hash{0x01}, wire.MwebHeader{Height: 1}, nil,
+	)
+	blockHash1 := chainTestHogex(header1, wire.OutPoint{Index: 7})
+	require.NoError(t, bm.verifyMwebHeaderChained(&blockHash1, header1))
+	hogexHash1 := header1.Hogex.TxHash()
+
+	// A hogex spending the previous hogex output verifies.
+	_, header2, _ := newTestMwebHeader(
+		t, blockHash1, wire.MwebHeader{Height: 2}, nil,
+	)
+	blockHash2 := chainTestHogex(header2, wire.OutPoint{Hash: hogexHash1})
+	require.NoError(t, bm.verifyMwebHeaderChained(&blockHash2, header2))
+
+	// A hogex spending anything else breaks the chain.
+	_, header3, _ := newTestMwebHeader(
+		t, blockHash2, wire.MwebHeader{Height: 3}, nil,
+	)
+	blockHash3 := chainTestHogex(header3, wire.OutPoint{Hash: hogexHash1})
+	err = bm.verifyMwebHeaderChained(&blockHash3, header3)
+	require.ErrorIs(t, err, ErrMwebHogexChain)
+
+	header3.Hogex.TxIn = nil
+	hogexHash3 := header3.Hogex.TxHash()
+	header3.Merkle.Header.MerkleRoot = hogexHash3
+	header3.Merkle.Hashes = []*chainhash.Hash{&hogexHash3}
+	blockHash3 = header3.Merkle.Header.BlockHash()
+	err = bm.verifyMwebHeaderChained(&blockHash3, header3)
+	require.ErrorIs(t, err, ErrMwebHogexChain)
+
+	// The broken hogex isn't remembered, so the block after it can't be
+	// checked either.
+	_, ok := bm.mwebHeaders.get(blockHash3)
+	require.False(t, ok)
+
+	// A peer serving a hogex that breaks the chain is banned, while the
+	// header is still accepted from a peer serving the right hogex.
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebHeader, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	_, bad, _ := newTestMwebHeader(
+		t, blockHash2, wire.MwebHeader{Height: 3}, nil,
+	)
+	badHash := chainTestHogex(bad, wire.OutPoint{Hash: hogexHash1})
+	_, good, _ := newTestMwebHeader(
+		t, blockHash2, wire.MwebHeader{Height: 3}, nil,
+	)
+	goodHash := chainTestHogex(good, wire.OutPoint{
+		Hash: header2.Hogex.TxHash(),
+	})
+
+	gdmsg := wire.NewMsgGetData()
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &badHash))
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &goodHash))
+	hq := &mwebHeadersQuery{
+		blockMgr:    bm,
+		headersChan: make(chan *wire.MsgMwebHeader, 1),
+	}
+
+	progress := hq.handleResponse(gdmsg, bad, "a")
+	require.False(t, progress.Progressed)
+	require.Equal(t, []string{"a"}, banned)
+
+	progress = hq.handleResponse(gdmsg, good, "b")
+	require.True(t, progress.Progressed)
+	require.Equal(t, []string{"a"}, banned)
+	require.Same(t, good, <-hq.headersChan)
+}
+
+// TestMwebLeafsetRootChanged tests that an mweb header with a different
+// leafset root from the one verified before for the same block is rejected,
+// and its peer banned.
+func TestMwebLeafsetRootChanged(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebHeader, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	header, mwebHeader, _ := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{Height: 1}, []byte{0x80},
+	)
+	blockHash := header.BlockHash()
+
+	gdmsg := wire.NewMsgGetData()
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &blockHash))
+	hq := &mwebHeadersQuery{
+		blockMgr:    bm,
+		headersChan: make(chan *wire.MsgMwebHeader, 1),
+	}
+	progress := hq.handleResponse(gdmsg, mwebHeader, "a")
+	require.True(t, progress.Progressed)
+	require.Same(t, mwebHeader, <-hq.headersChan)
+
+	// The same header verifies again.
+	require.NoError(t, bm.verifyMwebHeaderChained(&blockHash, mwebHeader))
+
+	// A valid header for another block is reported as being for another
+	// block, not as changing the leafset root.
+	_, other, _ := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{Height: 2}, []byte{0xc0},
+	)
+	err = bm.verifyMwebHeaderChained(&blockHash, other)
+	require.ErrorIs(t, err, ErrMwebBlockHashMismatch)
+	require.False(t, isMwebHeaderConflict(err))
+
+	// As the block commits to its mweb header, a header with another
+	// leafset root can't verify for it, so one is taken to have been
+	// verified before.
+	known, ok := bm.mwebHeaders.get(blockHash)
+	require.True(t, ok)
+	known.leafsetRoot = chainhash.Hash{0x01}
+	bm.mwebHeaders.headers[blockHash] = known
+
+	err = bm.verifyMwebHeaderChained(&blockHash, mwebHeader)
+	require.ErrorIs(t, err, ErrMwebLeafsetRootChanged)
+	require.True(t, isMwebHeaderConflict(err))
+
+	gdmsg = wire.NewMsgGetData()
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebHeader, &blockHash))
+	progress = hq.handleResponse(gdmsg, mwebHeader, "b")
+	require.False(t, progress.Progressed)
+	require.Equal(t, []string{"b"}, banned)
+}
+
+// TestMwebLeafsetShrink tests that an mweb leafset shorter than the one
+// validated before for the same block is rejected, and its peer banned.
+func TestMwebLeafsetShrink(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebHeader, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{
+			Height:        1,
+			OutputMMRSize: 16,
+		}, []byte{0xff, 0x7f},
+	)
+	blockHash := header.BlockHash()
+
+	// Each peer serves the same mweb header with its own leafset.
+	var leafsets map[string]*wire.MsgMwebLeafset
+	bm.cfg.queryAllPeers = func(_ wire.Message,
+		checkResponse func(sp *ServerPeer, resp wire.Message,
+			quit chan<- struct{}, peerQuit chan<- struct{}),
+		_ ...QueryOption) {
+
+		quit := make(chan struct{})
+		for addr, leafset := range leafsets {
+			p, err := peer.NewOutboundPeer(&peer.Config{}, addr)
+			require.NoError(t, err)
+			sp := &ServerPeer{Peer: p}
+
+			peerQuit := make(chan struct{})
+			msgs := []wire.Message{mwebHeader, leafset}
+			for _, resp := range msgs {
+				select {
+				case <-quit:
+					return
+				case <-peerQuit:
+				default:
+					checkResponse(sp, resp, quit, peerQuit)
+				}
+			}
+		}
+	}
+
+	leafsets = map[string]*wire.MsgMwebLeafset{"10.0.0.1:9333": mwebLeafset}
+	_, got, err := bm.fetchMwebHeaderAndLeafset(&blockHash)
+	require.NoError(t, err)
+	require.Same(t, mwebLeafset, got)
+	require.Empty(t, banned)
+
+	// A shorter leafset for the same block is flagged as such, before it
+	// even gets checked against the leafset root.
+	shorter := &wire.MsgMwebLeafset{
+		BlockHash: blockHash,
+		Leafset:   []byte{0xff},
+	}
+	err = bm.checkMwebLeafsetShrink(&blockHash, shorter)
+	require.ErrorIs(t, err, ErrMwebLeafsetShrunk)
+	require.NoError(t, bm.checkMwebLeafsetShrink(&blockHash, mwebLeafset))
+
+	// The shorter leafset of an older block isn't taken as a shrink.
+	older := &wire.MsgMwebLeafset{
+		BlockHash: header.PrevBlock,
+		Leafset:   []byte{0xff},
+	}
+	require.NoError(t, bm.checkMwebLeafsetShrink(&blockHash, older))
+
+	leafsets = map[string]*wire.MsgMwebLeafset{"10.0.0.2:9333": shorter}
+	_, _, err = bm.fetchMwebHeaderAndLeafset(&blockHash)
+	require.Error(t, err)
+	require.Equal(t, []string{"10.0.0.2:9333"}, banned)
+
+	// The leafset validated before is still served by honest peers.
+	leafsets = map[string]*wire.MsgMwebLeafset{"10.0.0.3:9333": mwebLeafset}
+	_, got, err = bm.fetchMwebHeaderAndLeafset(&blockHash)
+	require.NoError(t, err)
+	require.Same(t, mwebLeafset, got)
+	require.Equal(t, []string{"10.0.0.2:9333"}, banned)
+}
@@ -0,0 +1,265 @@
+package neutrino
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/go-socks/socks"
+	"github.com/ltcmweb/ltcd/peer"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// MwebIsolation is how the mweb queries sent to a peer are kept apart from
+// the rest of our traffic with it, so that an observer of our connections,
+// such as a Tor exit, can't tie the mweb data we ask for to our header and
+// filter sync.
+type MwebIsolation uint8
+
+const (
+	// MwebIsolationNone sends mweb queries over the peer's connection
+	// along with everything else.
+	MwebIsolationNone MwebIsolation = iota
+
+	// MwebIsolationPerPeer sends the mweb queries to each peer over a
+	// second connection to it, dialed over a circuit of its own.
+	MwebIsolationPerPeer
+
+	// MwebIsolationPerQuery sends each mweb query over a new connection
+	// to the peer, dialed over a circuit of its own.
+	MwebIsolationPerQuery
+)
+
+// mwebCircuitLinger is how long a connection made for a single mweb query
+// is kept once the next query has moved on to a new one, so that the
+// response to the earlier query can still come in.
+const mwebCircuitLinger = 30 * time.Second
+
+// ErrMwebCircuitsClosed is returned when an isolated mweb connection is
+// needed for a peer that has disconnected.
+var ErrMwebCircuitsClosed = errors.New("mweb circuits closed")
+
+// MwebCircuitDialer dials a connection to the address over the circuit with
+// the given ID. Connections dialed with different IDs must use different
+// circuits, as they do when the ID is given as the SOCKS credentials to a
+// Tor proxy, which isolates streams by them by default.
+type MwebCircuitDialer func(addr net.Addr, circuit string) (net.Conn, error)
+
+// NewSocksMwebCircuitDialer returns an MwebCircuitDialer that connects
+// through the SOCKS5 proxy at proxyAddr, giving the circuit ID as both the
+// username and password.
+func NewSocksMwebCircuitDialer(proxyAddr string) MwebCircuitDialer {
+	return func(addr net.Addr, circuit string) (net.Conn, error) {
+		proxy := &socks.Proxy{
+			Addr:     proxyAddr,
+			Username: circuit,
+			Password: circuit,
+		}
+		return proxy.Dial(addr.Network(), addr.String())
+	}
+}
+
+// newMwebCircuitID returns a random circuit ID.
+func newMwebCircuitID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// mwebCircuitMsg is a message queued to be sent over an isolated
+// connection.
+type mwebCircuitMsg struct {
+	msg      wire.Message
+	doneChan chan<- struct{}
+	encoding wire.MessageEncoding
+}
+
+// done signals the message's done channel, if any, without waiting on its
+// reader, as a disconnected peer does.
+func (m *mwebCircuitMsg) done() {
+	if m.doneChan != nil {
+		go func() {
+			m.doneChan <- struct{}{}
+		}()
+	}
+}
+
+// mwebCircuits holds the isolated connections that the mweb queries to a
+// peer are sent over. The messages received on them are passed to the
+// peer's subscribers as if they came over the peer's own connection.
+type mwebCircuits struct {
+	addr      net.Addr
+	isolation MwebIsolation
+	dial      MwebCircuitDialer
+
+	// peerCfg is the config of the peers on the isolated connections,
+	// whose messages are read as the peer's own.
+	peerCfg peer.Config
+
+	mtx  sync.Mutex
+	conn *peer.Peer
+
+	// msgs are the messages queued to be sent, in order, by the single
+	// sender that runs while sending is set.
+	msgs    []mwebCircuitMsg
+	sending bool
+
+	closed bool
+}
+
+// newMwebCircuits returns the isolated connections for the mweb queries to
+// the peer at the given address, or nil if mweb queries aren't isolated.
+func (s *ChainService) newMwebCircuits(sp *ServerPeer,
+	addr net.Addr) *mwebCircuits {
+
+	if s.mwebIsolation == MwebIsolationNone {
+		return nil
+	}
+
+	return &mwebCircuits{
+		addr:      addr,
+		isolation: s.mwebIsolation,
+		dial:      s.mwebCircuitDialer,
+		peerCfg: peer.Config{
+			Listeners: peer.MessageListeners{
+				OnRead:  sp.OnRead,
+				OnWrite: sp.OnWrite,
+			},
+			UserAgentName:    s.userAgentName,
+			UserAgentVersion: s.userAgentVersion,
+			ChainParams:      &s.chainParams,
+			Services:         s.services,
+			ProtocolVersion:  wire.MwebLightClientVersion,
+			DisableRelayTx:   true,
+		},
+	}
+}
+
+// queue sends the message over an isolated connection, dialing one first
+// if need be. It doesn't wait for the dial, and if that fails, the message
+// is dropped as it would be by a disconnected peer. Messages are sent in
+// the order they're queued.
+func (c *mwebCircuits) queue(msg wire.Message, doneChan chan<- struct{},
+	encoding wire.MessageEncoding) {
+
+	m := mwebCircuitMsg{msg: msg, doneChan: doneChan, encoding: encoding}
+
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		m.done()
+		return
+	}
+	c.msgs = append(c.msgs, m)
+	if !c.sending {
+		c.sending = true
+		go c.send()
+	}
+	c.mtx.Unlock()
+}
+
+// send sends the queued messages in order until there are none left, or
+// the peer has disconnected, in which case the rest are dropped.
+//
+// NOTE: This must be run as a goroutine.
+func (c *mwebCircuits) send() {
+	for {
+		c.mtx.Lock()
+		if c.closed || len(c.msgs) == 0 {
+			dropped := c.msgs
+			c.msgs = nil
+			c.sending = false
+			c.mtx.Unlock()
+
+			for i := range dropped {
+				dropped[i].done()
+			}
+			return
+		}
+		m := c.msgs[0]
+		c.msgs = c.msgs[1:]
+		c.mtx.Unlock()
+
+		conn, err := c.connect()
+		if err != nil {
+			log.Debugf("Unable to connect to %v for mweb query: %v",
+				c.addr, err)
+			m.done()
+			continue
+		}
+		conn.QueueMessageWithEncoding(m.msg, m.doneChan, m.encoding)
+	}
+}
+
+// connect returns the isolated connection to send the next mweb query over.
+// A connection per peer is reused while it stays up, whereas a connection
+// per query is always dialed anew, lingering on the one before. The dial
+// is made without holding the lock, so that it doesn't hold up close.
+func (c *mwebCircuits) connect() (*peer.Peer, error) {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return nil, ErrMwebCircuitsClosed
+	}
+	if c.conn != nil {
+		switch {
+		case c.isolation == MwebIsolationPerQuery:
+			time.AfterFunc(mwebCircuitLinger, c.conn.Disconnect)
+
+		case c.conn.Connected():
+			conn := c.conn
+			c.mtx.Unlock()
+			return conn, nil
+		}
+		c.conn = nil
+	}
+	c.mtx.Unlock()
+
+	circuit, err := newMwebCircuitID()
+	if err != nil {
+		return nil, err
+	}
+	netConn, err := c.dial(c.addr, circuit)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCfg := c.peerCfg
+	conn, err := peer.NewOutboundPeer(&peerCfg, c.addr.String())
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	conn.AssociateConnection(netConn)
+
+	// The peer may have disconnected while we were dialing.
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		conn.Disconnect()
+		return nil, ErrMwebCircuitsClosed
+	}
+
+	log.Debugf("Connected to %v for mweb queries", c.addr)
+	c.conn = conn
+
+	return conn, nil
+}
+
+// close disconnects the isolated connection, once the peer has
+// disconnected, dropping the messages still queued.
+func (c *mwebCircuits) close() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Disconnect()
+		c.conn = nil
+	}
+}
@@ -0,0 +1,342 @@
+package neutrino
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/peer"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// isolationRemote is the far end of a connection to a peer, recording the
+// queries that come over it and answering the mweb leafset queries.
+type isolationRemote struct {
+	name string
+	recv chan<- isolationQuery
+}
+
+// isolationQuery is a query received by the remote of the given name.
+type isolationQuery struct {
+	remote string
+	msg    wire.Message
+}
+
+// connPair returns the two ends of a loopback connection. Unlike a pipe,
+// writes to it are buffered, as the peers on either end send their first
+// messages at the same time.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	local, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	remote, err := listener.Accept()
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// serve runs the remote over the connection.
+func (r *isolationRemote) serve(t *testing.T, conn net.Conn) {
+	p := peer.NewInboundPeer(&peer.Config{
+		ChainParams:     &chaincfg.SimNetParams,
+		ProtocolVersion: wire.MwebLightClientVersion,
+		AllowSelfConns:  true,
+		Listeners: peer.MessageListeners{
+			OnRead: r.onRead,
+		},
+	})
+	p.AssociateConnection(conn)
+	t.Cleanup(p.Disconnect)
+}
+
+// onRead records the queries that the remote receives, answering those for
+// mweb leafsets with empty ones.
+func (r *isolationRemote) onRead(p *peer.Peer, _ int, msg wire.Message,
+	_ error) {
+
+	switch m := msg.(type) {
+	case *wire.MsgGetData:
+		for _, iv := range m.InvList {
+			p.QueueMessage(&wire.MsgMwebLeafset{
+				BlockHash: iv.Hash,
+			}, nil)
+		}
+
+	case *wire.MsgGetHeaders:
+
+	default:
+		return
+	}
+	r.recv <- isolationQuery{r.name, msg}
+}
+
+// TestMwebIsolation tests that mweb queries are sent over connections
+// dialed over circuits of their own when mweb queries are isolated, one for
+// each peer or for each query, with their responses delivered as if they
+// came over the peer's own connection, and that other messages keep to the
+// peer's own connection.
+func TestMwebIsolation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		isolation MwebIsolation
+		circuits  int
+		remote    string
+	}{{
+		name:      "none",
+		isolation: MwebIsolationNone,
+		remote:    "peer",
+	}, {
+		name:      "per peer",
+		isolation: MwebIsolationPerPeer,
+		circuits:  1,
+		remote:    "circuit",
+	}, {
+		name:      "per query",
+		isolation: MwebIsolationPerQuery,
+		circuits:  3,
+		remote:    "circuit",
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			testMwebIsolation(
+				t, test.isolation, test.circuits, test.remote,
+			)
+		})
+	}
+}
+
+// testMwebIsolation sends mweb queries to a peer with the given isolation,
+// checking that the given number of circuits are dialed and that the
+// queries go to the named remote.
+func testMwebIsolation(t *testing.T, isolation MwebIsolation,
+	numCircuits int, wantRemote string) {
+
+	const addr = "10.0.0.1:9333"
+
+	recv := make(chan isolationQuery, 10)
+	var (
+		mtx      sync.Mutex
+		circuits = make(map[string]struct{})
+	)
+	s := &ChainService{
+		chainParams:      chaincfg.SimNetParams,
+		userAgentName:    "test",
+		userAgentVersion: "1.0",
+		mwebIsolation:    isolation,
+		mwebCircuitDialer: func(netAddr net.Addr,
+			circuit string) (net.Conn, error) {
+
+			require.Equal(t, addr, netAddr.String())
+			mtx.Lock()
+			circuits[circuit] = struct{}{}
+			mtx.Unlock()
+
+			local, remote := connPair(t)
+			(&isolationRemote{"circuit", recv}).serve(t, remote)
+			return local, nil
+		},
+	}
+
+	sp := NewServerPeer(s, false)
+	p, err := peer.NewOutboundPeer(&peer.Config{
+		Listeners: peer.MessageListeners{
+			OnRead:  sp.OnRead,
+			OnWrite: sp.OnWrite,
+		},
+		ChainParams:     &s.chainParams,
+		ProtocolVersion: wire.MwebLightClientVersion,
+		AllowSelfConns:  true,
+	}, addr)
+	require.NoError(t, err)
+	netAddr, err := net.ResolveTCPAddr("tcp", addr)
+	require.NoError(t, err)
+
+	sp.Peer = p
+	sp.mwebCircuits = s.newMwebCircuits(sp, netAddr)
+	if isolation == MwebIsolationNone {
+		require.Nil(t, sp.mwebCircuits)
+	} else {
+		sp.mwebCircuits.peerCfg.AllowSelfConns = true
+	}
+
+	local, remote := connPair(t)
+	(&isolationRemote{"peer", recv}).serve(t, remote)
+	sp.AssociateConnection(local)
+	t.Cleanup(func() {
+		sp.Disconnect()
+		if sp.mwebCircuits != nil {
+			sp.mwebCircuits.close()
+		}
+	})
+
+	msgs, cancel := sp.SubscribeRecvMsg()
+	defer cancel()
+
+	// Each mweb query goes to the expected remote, and its response is
+	// delivered to the peer's subscribers.
+	for i := uint64(0); i < 3; i++ {
+		blockHash := chainhash.Hash{byte(i)}
+		getData := wire.NewMsgGetData()
+		getData.AddInvVect(wire.NewInvVect(
+			wire.InvTypeMwebLeafset, &blockHash,
+		))
+		sp.QueueMessageWithEncoding(getData, nil, wire.LatestEncoding)
+
+		select {
+		case query := <-recv:
+			require.Equal(t, wantRemote, query.remote)
+			require.IsType(t, &wire.MsgGetData{}, query.msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("query %v not received", i)
+		}
+
+	wait:
+		for {
+			select {
+			case msg := <-msgs:
+				resp, ok := msg.(*wire.MsgMwebLeafset)
+				if ok && resp.BlockHash == blockHash {
+					break wait
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("response %v not received", i)
+			}
+		}
+	}
+
+	// Other messages keep to the peer's own connection.
+	sp.QueueMessageWithEncoding(
+		wire.NewMsgGetHeaders(), nil, wire.LatestEncoding,
+	)
+	select {
+	case query := <-recv:
+		require.Equal(t, "peer", query.remote)
+		require.IsType(t, &wire.MsgGetHeaders{}, query.msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("getheaders not received")
+	}
+
+	mtx.Lock()
+	require.Len(t, circuits, numCircuits)
+	mtx.Unlock()
+
+	// Once the peer is gone, mweb queries aren't sent anywhere.
+	if sp.mwebCircuits != nil {
+		sp.mwebCircuits.close()
+		_, err := sp.mwebCircuits.connect()
+		require.ErrorIs(t, err, ErrMwebCircuitsClosed)
+	}
+}
+
+// TestMwebCircuitsDial tests that the mweb queries queued while a circuit
+// is being dialed are sent over it in order once it's up, and that the
+// peer disconnecting doesn't wait on a dial.
+func TestMwebCircuitsDial(t *testing.T) {
+	t.Parallel()
+
+	const addr = "10.0.0.1:9333"
+	netAddr, err := net.ResolveTCPAddr("tcp", addr)
+	require.NoError(t, err)
+
+	recv := make(chan isolationQuery, 10)
+	dialing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	c := &mwebCircuits{
+		addr:      netAddr,
+		isolation: MwebIsolationPerPeer,
+		dial: func(net.Addr, string) (net.Conn, error) {
+			dialing <- struct{}{}
+			<-release
+
+			local, remote := connPair(t)
+			(&isolationRemote{"circuit", recv}).serve(t, remote)
+			return local, nil
+		},
+		peerCfg: peer.Config{
+			ChainParams:     &chaincfg.SimNetParams,
+			ProtocolVersion: wire.MwebLightClientVersion,
+			AllowSelfConns:  true,
+		},
+	}
+	t.Cleanup(c.close)
+
+	queueQuery := func(i byte, doneChan chan<- struct{}) {
+		getData := wire.NewMsgGetData()
+		getData.AddInvVect(wire.NewInvVect(
+			wire.InvTypeMwebLeafset, &chainhash.Hash{i},
+		))
+		c.queue(getData, doneChan, wire.LatestEncoding)
+	}
+
+	// The queries go out in the order they were queued, however long
+	// the dial takes.
+	for i := byte(0); i < 3; i++ {
+		queueQuery(i, nil)
+	}
+	<-dialing
+	close(release)
+	for i := byte(0); i < 3; i++ {
+		select {
+		case query := <-recv:
+			getData := query.msg.(*wire.MsgGetData)
+			require.Equal(
+				t, chainhash.Hash{i}, getData.InvList[0].Hash,
+			)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("query %v not received", i)
+		}
+	}
+
+	// Once the connection drops, a new circuit is dialed, and the peer
+	// disconnecting while it is doesn't wait on the dial, which is
+	// then dropped along with the query.
+	c.mtx.Lock()
+	c.conn.Disconnect()
+	c.mtx.Unlock()
+	release = make(chan struct{})
+	done := make(chan struct{})
+	queueQuery(3, done)
+	<-dialing
+
+	closed := make(chan struct{})
+	go func() {
+		c.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited on the dial")
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped query not done")
+	}
+	select {
+	case query := <-recv:
+		t.Fatalf("dropped query received: %v", query.msg)
+	default:
+	}
+
+	c.mtx.Lock()
+	require.Nil(t, c.conn)
+	c.mtx.Unlock()
+}
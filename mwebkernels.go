@@ -0,0 +1,371 @@
+package neutrino
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/ltcmweb/ltcd/blockchain"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/query"
+)
+
+var (
+	// ErrMwebKernelsDisabled is returned by FetchMwebKernels when the
+	// mweb kernels aren't being synced.
+	ErrMwebKernelsDisabled = errors.New("mweb kernels are not stored")
+
+	// ErrMwebKernelRoot is returned when the mweb kernels of a block
+	// don't extend the kernel MMR of the block before it to the kernel
+	// root of the block's mweb header.
+	ErrMwebKernelRoot = errors.New("mweb kernel root mismatch")
+)
+
+// mwebKernelStartHeights are the heights of the first blocks with an mweb
+// on the networks where that's known, from which the mweb kernels are
+// synced, as are the mweb utxos when taken from full blocks. On other
+// networks they're synced from the block after genesis.
+var mwebKernelStartHeights = map[wire.BitcoinNet]uint32{
+	wire.MainNet: 2265984,
+}
+
+// appendMwebKernels appends the kernels to a kernel MMR of the given number
+// of leaves and peak hashes, returning the peak hashes after. Each kernel is
+// hashed into its leaf from its serialization, as each output is from its
+// output id.
+func appendMwebKernels(size uint64, peaks []*chainhash.Hash,
+	kernels []*wire.MwebKernel) ([]*chainhash.Hash, error) {
+
+	if len(peaks) != bits.OnesCount64(size) {
+		return nil, fmt.Errorf("kernel mmr of %v leaves can't have "+
+			"%v peaks", size, len(peaks))
+	}
+
+	peaks = append([]*chainhash.Hash(nil), peaks...)
+	for _, kernel := range kernels {
+		var buf bytes.Buffer
+		if err := kernel.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		node := leafIdx(size).nodeIdx()
+		hash := node.hash(buf.Bytes())
+
+		// The new leaf completes a parent with the peak to its left
+		// for each trailing one bit of the leaf count.
+		for n := size; n&1 == 1; n >>= 1 {
+			node++
+			left := peaks[len(peaks)-1]
+			hash = node.parentHash(left[:], hash[:])
+			peaks = peaks[:len(peaks)-1]
+		}
+		peaks = append(peaks, hash)
+		size++
+	}
+	return peaks, nil
+}
+
+// mwebBlockHogex checks the block's transactions against its merkle root,
+// returning its hogex, or nil for a block before the mweb activated. Once
+// the mweb has activated, as given by active, a block without a hogex is
+// an error.
+func mwebBlockHogex(block *wire.MsgBlock, active bool) (*wire.MsgTx, error) {
+	if len(block.Transactions) == 0 {
+		return nil, ErrMwebBadMerkleRoot
+	}
+	txs := ltcutil.NewBlock(block).Transactions()
+	merkleRoot := blockchain.CalcMerkleRoot(txs, false)
+	if !merkleRoot.IsEqual(&block.Header.MerkleRoot) {
+		return nil, ErrMwebBadMerkleRoot
+	}
+
+	// The mweb header can be left off by the peer, but not the hogex,
+	// which is committed to by the merkle root.
+	hogex := block.Transactions[len(block.Transactions)-1]
+	if !hogex.IsHogEx {
+		if active {
+			return nil, ErrMwebNotHogEx
+		}
+		return nil, nil
+	}
+	return hogex, nil
+}
+
+// verifyMwebKernels checks that the block's mweb header is committed to by
+// its hogex, and that its mweb kernels extend the kernel MMR after the tip
+// to the header's kernel root. It returns the kernel MMR after the block, or
+// nil for a block before the mweb activated. A nil tip is an empty kernel
+// MMR.
+func verifyMwebKernels(tip *mwebdb.KernelMmr, height uint32,
+	block *wire.MsgBlock) (*mwebdb.KernelMmr, error) {
+
+	hogex, err := mwebBlockHogex(block, tip != nil)
+	if hogex == nil || err != nil {
+		return nil, err
+	}
+	if block.MwebHeader == nil || block.MwebTransactions == nil {
+		return nil, fmt.Errorf("%w: block has no mweb",
+			ErrMwebKernelRoot)
+	}
+	if err := checkMwebHogAddr(hogex, block.MwebHeader); err != nil {
+		return nil, err
+	}
+
+	var (
+		size    uint64
+		peaks   []*chainhash.Hash
+		kernels = block.MwebTransactions.Kernels
+	)
+	if tip != nil {
+		size, peaks = tip.Size, tip.Peaks
+	}
+	newSize := block.MwebHeader.KernelMMRSize
+	if newSize < size || newSize-size != uint64(len(kernels)) {
+		return nil, fmt.Errorf("%w: %v kernels don't take the kernel "+
+			"mmr from %v to %v leaves", ErrMwebKernelRoot,
+			len(kernels), size, newSize)
+	}
+
+	peaks, err = appendMwebKernels(size, peaks, kernels)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty kernel MMR has a zero root.
+	root := bagPeaks(peaks, leafIdx(newSize).nodeIdx())
+	if root == nil {
+		root = &chainhash.Hash{}
+	}
+	if !root.IsEqual(&block.MwebHeader.KernelRoot) {
+		return nil, fmt.Errorf("%w: got %v, expected %v",
+			ErrMwebKernelRoot, root, block.MwebHeader.KernelRoot)
+	}
+
+	return &mwebdb.KernelMmr{
+		Height:    height,
+		BlockHash: block.BlockHash(),
+		Size:      newSize,
+		Peaks:     peaks,
+	}, nil
+}
+
+// syncMwebKernels fetches the mweb kernels of the blocks up to the given
+// height that aren't yet stored, one block at a time, storing each block's
+// once they've been verified. The kernels of blocks no longer in the chain
+// are rolled back first. Until the mweb activates, the last block checked
+// is stored instead, for the next round to carry on from.
+func (b *blockManager) syncMwebKernels(toHeight uint32) error {
+	store := b.cfg.MwebKernels
+	if store == nil {
+		return nil
+	}
+
+	tip, err := store.KernelMmrTip()
+	if err != nil {
+		return err
+	}
+	for tip != nil &&
+		!b.isMwebBlockInChain(tip.Height, tip.BlockHash, toHeight) {
+
+		log.Infof("Rolling back mweb kernels of block %v at height %v",
+			tip.BlockHash, tip.Height)
+
+		tip, err = store.RollbackKernels(tip.Height - 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	height := mwebKernelStartHeights[b.cfg.ChainParams.Net]
+	if height == 0 {
+		height = 1
+	}
+	if tip != nil {
+		height = tip.Height + 1
+	} else {
+		// The blocks found to be before the mweb activated in an
+		// earlier round aren't fetched again.
+		pre, err := store.PreActivationTip()
+		if err != nil {
+			return err
+		}
+		if pre != nil && pre.Height >= height && b.isMwebBlockInChain(
+			pre.Height, pre.BlockHash, toHeight,
+		) {
+
+			height = pre.Height + 1
+		}
+	}
+	if height <= toHeight {
+		log.Infof("Fetching mweb kernels from height %v to %v",
+			height, toHeight)
+	}
+
+	for ; height <= toHeight; height++ {
+		header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+		mmr, kernels, err := b.fetchMwebKernels(
+			tip, height, header.BlockHash(),
+		)
+		if err != nil {
+			return err
+		}
+
+		// Blocks before the mweb activated have no kernels, but are
+		// recorded as checked.
+		if mmr == nil {
+			err := store.PutPreActivationTip(
+				height, header.BlockHash(),
+			)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := store.PutKernels(mmr, kernels); err != nil {
+			return err
+		}
+		tip = mmr
+	}
+
+	return nil
+}
+
+// fetchMwebKernels fetches the block with the given hash along with its
+// mweb, returning the kernel MMR after it and its mweb kernels once they've
+// been verified to extend the tip.
+func (b *blockManager) fetchMwebKernels(tip *mwebdb.KernelMmr,
+	height uint32, blockHash chainhash.Hash) (*mwebdb.KernelMmr,
+	[]*wire.MwebKernel, error) {
+
+	var (
+		mmr     *mwebdb.KernelMmr
+		kernels []*wire.MwebKernel
+	)
+	err := b.fetchMwebBlock(blockHash, "mweb kernels",
+		banman.InvalidMwebKernels, func(block *wire.MsgBlock) error {
+			next, err := verifyMwebKernels(tip, height, block)
+			if err != nil {
+				return err
+			}
+			mmr = next
+			if next != nil {
+				kernels = block.MwebTransactions.Kernels
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mmr, kernels, nil
+}
+
+// mwebLocalError wraps an error from verifying a block that is down to our
+// own state, such as coins missing from the mweb coins db, rather than to
+// the peer that served the block.
+type mwebLocalError struct {
+	err error
+}
+
+// Error returns the wrapped error's message.
+func (e mwebLocalError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e mwebLocalError) Unwrap() error {
+	return e.err
+}
+
+// fetchMwebBlock fetches the block with the given hash along with its mweb,
+// returning once a peer has served one that passes verify. A peer serving
+// one that doesn't is punished for the given reason, and the block is
+// fetched from another. If verify returns an mwebLocalError, the fetch is
+// given up and the error returned, as no peer would do better. The part of
+// the block being verified is named by what, for logging.
+func (b *blockManager) fetchMwebBlock(blockHash chainhash.Hash, what string,
+	reason banman.Reason, verify func(*wire.MsgBlock) error) error {
+
+	gdmsg := wire.NewMsgGetData()
+	gdmsg.AddInvVect(wire.NewInvVect(wire.InvTypeMwebBlock, &blockHash))
+
+	var (
+		verified bool
+		localErr error
+	)
+	handleResp := func(req, resp wire.Message,
+		peerAddr string) query.Progress {
+
+		block, ok := resp.(*wire.MsgBlock)
+		if !ok || block.BlockHash() != blockHash {
+			return query.Progress{}
+		}
+
+		err := verify(block)
+		if errors.As(err, &mwebLocalError{}) {
+			localErr = err
+			return query.Progress{Finished: true, Progressed: true}
+		}
+		if err != nil {
+			b.mwebFailureLog.logf(peerAddr,
+				"Failed to verify %v of block %v from peer "+
+					"%v: %v", what, blockHash, peerAddr,
+				err)
+
+			b.recordMwebFailure(peerAddr, block, reason, err)
+			b.punishPeer(peerAddr, reason)
+
+			return query.Progress{}
+		}
+
+		verified = true
+		return query.Progress{Finished: true, Progressed: true}
+	}
+
+	cancelled := b.mwebPause.cancelledChan()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	builder := &mwebRequestBuilder{
+		handleResp:  handleResp,
+		allowPeer:   b.mwebQueryPeers.allowPeer(),
+		selectPeers: b.selectMwebPeers,
+		cancel:      cancel,
+	}
+	errChan := b.cfg.QueryDispatcher.Query(
+		mwebRequests(builder, []wire.Message{gdmsg}),
+		builder.options()...,
+	)
+
+	select {
+	case err := <-errChan:
+		switch {
+		case err == query.ErrWorkManagerShuttingDown:
+			return ErrShuttingDown
+		case err != nil:
+			return err
+		}
+
+	case <-cancelled:
+		return errMwebCancelled
+
+	case <-b.quit:
+		return ErrShuttingDown
+	}
+
+	if localErr != nil {
+		return fmt.Errorf("unable to verify %v of block %v: %w", what,
+			blockHash, localErr)
+	}
+	if !verified {
+		return fmt.Errorf("couldn't retrieve %v of block %v from "+
+			"network", what, blockHash)
+	}
+	return nil
+}
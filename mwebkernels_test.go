@@ -0,0 +1,295 @@
+package neutrino
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMwebKernels returns the given number of distinct mweb kernels,
+// starting from the given fee.
+func newTestMwebKernels(fee uint64, n int) []*wire.MwebKernel {
+	kernels := make([]*wire.MwebKernel, n)
+	for i := range kernels {
+		kernels[i] = &wire.MwebKernel{
+			Features: wire.MwebKernelFeeFeatureBit,
+			Fee:      fee + uint64(i),
+		}
+	}
+	return kernels
+}
+
+// newTestMwebKernelBlock returns a block whose hogex commits to an mweb
+// header with the given kernel MMR, carrying the given kernels.
+func newTestMwebKernelBlock(t *testing.T, prevBlock chainhash.Hash,
+	kernelRoot chainhash.Hash, kernelMMRSize uint64,
+	kernels []*wire.MwebKernel) *wire.MsgBlock {
+
+	mwebHeader := wire.MwebHeader{
+		KernelRoot:    kernelRoot,
+		KernelMMRSize: kernelMMRSize,
+	}
+	header, msgHeader, _ := newTestMwebHeader(t, prevBlock, mwebHeader, nil)
+
+	return &wire.MsgBlock{
+		Header:           *header,
+		Transactions:     []*wire.MsgTx{&msgHeader.Hogex},
+		MwebHeader:       &msgHeader.MwebHeader,
+		MwebTransactions: &wire.MwebTxBody{Kernels: kernels},
+	}
+}
+
+// TestMwebKernels tests that the mweb kernels of each block are fetched,
+// verified against the kernel root of its mweb header and stored, skipping
+// the blocks before the mweb activated without fetching them again in a
+// later round, and that a peer serving kernels that don't match the kernel
+// root is banned.
+func TestMwebKernels(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/kernels.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	kernelStore, err := mwebdb.NewKernelStore(db, 10)
+	require.NoError(t, err)
+	bm.cfg.MwebKernels = kernelStore
+
+	kernels := newTestMwebKernels(0, 5)
+	leafHash := func(i uint64) *chainhash.Hash {
+		var buf bytes.Buffer
+		require.NoError(t, kernels[i].Serialize(&buf))
+		return leafIdx(i).nodeIdx().hash(buf.Bytes())
+	}
+	parent := func(i nodeIdx, left, right *chainhash.Hash) *chainhash.Hash {
+		return i.parentHash(left[:], right[:])
+	}
+
+	// The block at height 1 is before the mweb activated. Then the mweb
+	// kernel MMR has three leaves after height 2, with peaks at nodes 2
+	// and 3, and five after height 3, with peaks at nodes 6 and 7.
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxOut(wire.NewTxOut(0, nil))
+	block1 := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			PrevBlock:  *chaincfg.SimNetParams.GenesisHash,
+			MerkleRoot: coinbase.TxHash(),
+		},
+		Transactions: []*wire.MsgTx{coinbase},
+	}
+
+	node2 := parent(2, leafHash(0), leafHash(1))
+	root2 := bagPeaks([]*chainhash.Hash{node2, leafHash(2)}, 4)
+	block2 := newTestMwebKernelBlock(
+		t, block1.BlockHash(), *root2, 3, kernels[:3],
+	)
+
+	node6 := parent(6, node2, parent(5, leafHash(2), leafHash(3)))
+	root3 := bagPeaks([]*chainhash.Hash{node6, leafHash(4)}, 8)
+	block3 := newTestMwebKernelBlock(
+		t, block2.BlockHash(), *root3, 5, kernels[3:],
+	)
+
+	blocks := make(map[chainhash.Hash]*wire.MsgBlock)
+	for i, block := range []*wire.MsgBlock{block1, block2, block3} {
+		header := block.Header
+		require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+			BlockHeader: &header,
+			Height:      uint32(i + 1),
+		}))
+		blocks[block.BlockHash()] = block
+	}
+
+	// The bad peer is asked first, and serves the last block with one
+	// of its kernels swapped for another.
+	bad := *block3
+	bad.MwebTransactions = &wire.MwebTxBody{
+		Kernels: []*wire.MwebKernel{kernels[3], kernels[3]},
+	}
+
+	var (
+		mtx       sync.Mutex
+		banned    []string
+		requested []chainhash.Hash
+	)
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		require.Equal(t, banman.InvalidMwebKernels, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetData)
+					iv := msg.InvList[0]
+					require.Equal(t, wire.InvTypeMwebBlock,
+						iv.Type)
+					mtx.Lock()
+					requested = append(requested, iv.Hash)
+					mtx.Unlock()
+
+					block, handle := blocks[iv.Hash],
+						req.HandleResp
+					if block == block3 {
+						handle(req.Req, &bad, "bad")
+					}
+					handle(req.Req, block, "good")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	// The block before the mweb activated is recorded as checked, so
+	// that the next round doesn't fetch it again.
+	require.NoError(t, bm.syncMwebKernels(1))
+	tip, err := kernelStore.KernelMmrTip()
+	require.NoError(t, err)
+	require.Nil(t, tip)
+	pre, err := kernelStore.PreActivationTip()
+	require.NoError(t, err)
+	require.Equal(t, &mwebdb.KernelMmr{
+		Height:    1,
+		BlockHash: block1.BlockHash(),
+		Peaks:     []*chainhash.Hash{},
+	}, pre)
+
+	require.NoError(t, bm.syncMwebKernels(3))
+
+	mtx.Lock()
+	require.Equal(t, []string{"bad"}, banned)
+	require.Equal(t, []chainhash.Hash{
+		block1.BlockHash(), block2.BlockHash(), block3.BlockHash(),
+	}, requested)
+	mtx.Unlock()
+
+	tip, err = kernelStore.KernelMmrTip()
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), tip.Height)
+	require.Equal(t, block3.BlockHash(), tip.BlockHash)
+	require.Equal(t, uint64(5), tip.Size)
+	require.Equal(t, []*chainhash.Hash{node6, leafHash(4)}, tip.Peaks)
+
+	stored, err := kernelStore.FetchKernels(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, kernels, stored)
+
+	// Once synced, nothing more is fetched.
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func([]*query.Request,
+			...query.QueryOption) chan error {
+
+			t.Fatal("unexpected query")
+			return nil
+		},
+	}
+	require.NoError(t, bm.syncMwebKernels(3))
+}
+
+// TestVerifyMwebKernels tests that the kernels of a block must extend the
+// kernel MMR of the block before it to exactly the kernel root and size of
+// the block's mweb header.
+func TestVerifyMwebKernels(t *testing.T) {
+	t.Parallel()
+
+	kernels := newTestMwebKernels(100, 3)
+	peaks, err := appendMwebKernels(0, nil, kernels)
+	require.NoError(t, err)
+	root := bagPeaks(peaks, leafIdx(3).nodeIdx())
+
+	genesisHash := *chaincfg.SimNetParams.GenesisHash
+	block := newTestMwebKernelBlock(t, genesisHash, *root, 3, kernels)
+	mmr, err := verifyMwebKernels(nil, 7, block)
+	require.NoError(t, err)
+	require.Equal(t, &mwebdb.KernelMmr{
+		Height:    7,
+		BlockHash: block.BlockHash(),
+		Size:      3,
+		Peaks:     peaks,
+	}, mmr)
+
+	// Kernels appended one block at a time give the same peaks as all
+	// at once.
+	onePeaks, err := appendMwebKernels(0, nil, kernels[:1])
+	require.NoError(t, err)
+	twoPeaks, err := appendMwebKernels(1, onePeaks, kernels[1:])
+	require.NoError(t, err)
+	require.Equal(t, peaks, twoPeaks)
+
+	tests := []struct {
+		name          string
+		tip           *mwebdb.KernelMmr
+		root          chainhash.Hash
+		kernelMMRSize uint64
+		kernels       []*wire.MwebKernel
+	}{{
+		name:          "missing kernel",
+		root:          *root,
+		kernelMMRSize: 3,
+		kernels:       kernels[:2],
+	}, {
+		name:          "reordered kernels",
+		root:          *root,
+		kernelMMRSize: 3,
+		kernels: []*wire.MwebKernel{
+			kernels[1], kernels[0], kernels[2],
+		},
+	}, {
+		name:          "wrong tip",
+		tip:           &mwebdb.KernelMmr{Size: 1, Peaks: peaks[1:]},
+		root:          *root,
+		kernelMMRSize: 3,
+		kernels:       kernels[1:],
+	}, {
+		name:          "shrinking mmr",
+		tip:           &mwebdb.KernelMmr{Size: 3, Peaks: peaks},
+		root:          *root,
+		kernelMMRSize: 2,
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			block := newTestMwebKernelBlock(
+				t, genesisHash, test.root, test.kernelMMRSize,
+				test.kernels,
+			)
+			_, err := verifyMwebKernels(test.tip, 7, block)
+			require.ErrorIs(t, err, ErrMwebKernelRoot)
+		})
+	}
+
+	// A block that leaves off its mweb can't pass for one from before
+	// the mweb activated, as its hogex is committed to.
+	block.MwebHeader, block.MwebTransactions = nil, nil
+	_, err = verifyMwebKernels(nil, 7, block)
+	require.ErrorIs(t, err, ErrMwebKernelRoot)
+
+	// Nor can a block whose hogex doesn't commit to its mweb header.
+	block = newTestMwebKernelBlock(t, genesisHash, *root, 3, kernels)
+	block.MwebHeader.KernelRoot = chainhash.Hash{1}
+	_, err = verifyMwebKernels(nil, 7, block)
+	require.ErrorIs(t, err, ErrMwebHogAddrMismatch)
+}
@@ -0,0 +1,77 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrMwebLeafsetSize is returned when a leafset bitmap doesn't match the
+// number of leaves it claims to cover.
+var ErrMwebLeafsetSize = errors.New("mweb leafset bitmap size mismatch")
+
+// MwebLeafset is a read-only view of an mweb leafset bitmap, in which the
+// bit for each unspent leaf of the output MMR is set, most significant bit
+// first.
+type MwebLeafset struct {
+	bits []byte
+	size uint64
+}
+
+// NewMwebLeafset validates the leafset bitmap of an output MMR with the
+// given number of leaves, as served in an mwebleafset message, and returns a
+// view of it. The bitmap must be exactly long enough to hold every leaf,
+// with none of the padding bits after the last leaf set. The bitmap is
+// copied, so the caller is free to modify it afterwards.
+func NewMwebLeafset(bitmap []byte, size uint64) (*MwebLeafset, error) {
+	if uint64(len(bitmap)) != (size+7)/8 {
+		return nil, fmt.Errorf("%w: %v bytes for %v leaves",
+			ErrMwebLeafsetSize, len(bitmap), size)
+	}
+	if size%8 != 0 && bitmap[len(bitmap)-1]&(0xff>>(size%8)) != 0 {
+		return nil, fmt.Errorf("%w: leaves set past index %v",
+			ErrMwebLeafsetSize, size-1)
+	}
+
+	return &MwebLeafset{
+		bits: append([]byte(nil), bitmap...),
+		size: size,
+	}, nil
+}
+
+// Size returns the number of leaves covered by the leafset, spent or not.
+func (l *MwebLeafset) Size() uint64 {
+	return l.size
+}
+
+// Contains returns whether the leaf at the given index is unspent. Leaves
+// past the end of the leafset are never unspent.
+func (l *MwebLeafset) Contains(idx uint64) bool {
+	if idx >= l.size {
+		return false
+	}
+	return l.bits[idx/8]&(0x80>>(idx%8)) != 0
+}
+
+// NextUnspent returns the index of the next unspent leaf after the given
+// one, or the size of the leafset if there are none.
+func (l *MwebLeafset) NextUnspent(idx uint64) uint64 {
+	if idx >= l.size {
+		return l.size
+	}
+	for idx++; idx < l.size; idx++ {
+		if l.Contains(idx) {
+			return idx
+		}
+	}
+	return l.size
+}
+
+// Count returns the number of unspent leaves.
+func (l *MwebLeafset) Count() uint64 {
+	var count uint64
+	for _, b := range l.bits {
+		count += uint64(bits.OnesCount8(b))
+	}
+	return count
+}
@@ -0,0 +1,154 @@
+package neutrino
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNewMwebLeafset tests that leafset bitmaps not matching their size are
+// rejected, and that a valid one is copied.
+func TestNewMwebLeafset(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		bitmap []byte
+		size   uint64
+		valid  bool
+	}{
+		{"empty", nil, 0, true},
+		{"empty with bitmap", []byte{0x00}, 0, false},
+		{"whole bytes", []byte{0xff, 0x01}, 16, true},
+		{"partial byte", []byte{0xff, 0xe0}, 11, true},
+		{"too short", []byte{0xff}, 9, false},
+		{"too long", []byte{0xff, 0x00}, 8, false},
+		{"padding set", []byte{0xff, 0xf0}, 11, false},
+	}
+	for _, tc := range testCases {
+		leafset, err := NewMwebLeafset(tc.bitmap, tc.size)
+		if !tc.valid {
+			require.ErrorIs(t, err, ErrMwebLeafsetSize, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.size, leafset.Size(), tc.name)
+	}
+
+	bitmap := []byte{0x80}
+	leafset, err := NewMwebLeafset(bitmap, 1)
+	require.NoError(t, err)
+	bitmap[0] = 0
+	require.True(t, leafset.Contains(0))
+}
+
+// TestMwebLeafset tests looking up leaves in a leafset, including indices
+// past the end of the leafset and of its bitmap.
+func TestMwebLeafset(t *testing.T) {
+	t.Parallel()
+
+	// Leaves 0, 2, 7 and 9 are unspent.
+	leafset, err := NewMwebLeafset([]byte{0xa1, 0x40}, 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), leafset.Count())
+
+	var unspent []uint64
+	for i := uint64(0); i < 20; i++ {
+		if leafset.Contains(i) {
+			unspent = append(unspent, i)
+		}
+	}
+	require.Equal(t, []uint64{0, 2, 7, 9}, unspent)
+	require.False(t, leafset.Contains(math.MaxUint64))
+
+	require.Equal(t, uint64(2), leafset.NextUnspent(0))
+	require.Equal(t, uint64(7), leafset.NextUnspent(2))
+	require.Equal(t, uint64(7), leafset.NextUnspent(3))
+	require.Equal(t, uint64(9), leafset.NextUnspent(7))
+	require.Equal(t, uint64(10), leafset.NextUnspent(9))
+	require.Equal(t, uint64(10), leafset.NextUnspent(15))
+	require.Equal(t, uint64(10), leafset.NextUnspent(16))
+	require.Equal(t, uint64(10), leafset.NextUnspent(math.MaxUint64))
+
+	// An empty leafset has nothing unspent.
+	empty, err := NewMwebLeafset(nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), empty.Count())
+	require.False(t, empty.Contains(0))
+	require.Equal(t, uint64(0), empty.NextUnspent(0))
+
+	// The results agree with the internal leafset helpers.
+	mmr := newTestMwebMmr(20)
+	internal := mmr.leafset(1, 5, 6, 7, 8, 19)
+	external, err := NewMwebLeafset(internal.Bits, internal.Size)
+	require.NoError(t, err)
+	for i := uint64(0); i < 24; i++ {
+		require.Equal(t, internal.Contains(i), external.Contains(i))
+		if i < internal.Size {
+			next := leafsetNextUnspent(internal, leafIdx(i))
+			require.Equal(t, uint64(next), external.NextUnspent(i))
+		}
+	}
+	require.Equal(t, uint64(14), external.Count())
+}
+
+// TestMwebLeafsetRetention tests that a MwebLeafsetHistoryDepth of zero keeps
+// no leafset history, and that depths outside of zero to MaxMwebReorgDepth
+// are rejected.
+func TestMwebLeafsetRetention(t *testing.T) {
+	t.Parallel()
+
+	retention, err := mwebLeafsetRetention(0)
+	require.NoError(t, err)
+	require.Zero(t, retention)
+
+	retention, err = mwebLeafsetRetention(MaxMwebReorgDepth)
+	require.NoError(t, err)
+	require.Equal(t, uint32(MaxMwebReorgDepth), retention)
+
+	_, err = mwebLeafsetRetention(-1)
+	require.Error(t, err)
+
+	_, err = mwebLeafsetRetention(MaxMwebReorgDepth + 1)
+	require.Error(t, err)
+}
+
+// TestMwebLeafsetAtHeight tests that the leafsets retained by the mweb coins
+// db are returned, and that one keeping no history has none to return.
+func TestMwebLeafsetAtHeight(t *testing.T) {
+	t.Parallel()
+
+	s := &ChainService{MwebCoinDB: newMockCoinDatabase()}
+	_, _, err := s.MwebLeafsetAtHeight(0)
+	require.ErrorIs(t, err, mwebdb.ErrLeafsetNotRetained)
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/coins.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	coinStore, err := mwebdb.NewCoinStore(db)
+	require.NoError(t, err)
+	require.NoError(t, coinStore.PutLeafsetAndPurge(&mweb.Leafset{
+		Bits:   []byte{0xa0},
+		Size:   3,
+		Height: 5,
+		Block:  &wire.BlockHeader{},
+	}, nil))
+
+	s.MwebCoinDB = coinStore
+	bits, size, err := s.MwebLeafsetAtHeight(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xa0}, bits)
+	require.Equal(t, uint64(3), size)
+
+	_, _, err = s.MwebLeafsetAtHeight(4)
+	require.ErrorIs(t, err, mwebdb.ErrLeafsetNotRetained)
+}
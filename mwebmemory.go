@@ -0,0 +1,106 @@
+package neutrino
+
+import (
+	"sync"
+)
+
+// mwebUtxoMemoryEstimate is a rough upper bound on the memory taken up by
+// a single compact mweb utxo once it has been received and decoded. It is
+// used to estimate the memory held by the responses to outstanding
+// getmwebutxos requests.
+const mwebUtxoMemoryEstimate = 512
+
+// mwebUtxosMemory returns the estimated memory taken up by the response to
+// a getmwebutxos request for the given number of utxos.
+func mwebUtxosMemory(numUtxos uint16) uint64 {
+	return uint64(numUtxos) * mwebUtxoMemoryEstimate
+}
+
+// mwebMemoryBudget tracks the estimated memory held by outstanding mweb
+// requests, so that new requests can be held back until enough of it has
+// been freed. A zero limit means there is no budget, and every reservation
+// is granted.
+type mwebMemoryBudget struct {
+	mtx   sync.Mutex
+	limit uint64
+	used  uint64
+
+	// freed is closed, and replaced, whenever memory is released.
+	freed chan struct{}
+}
+
+// newMwebMemoryBudget creates a memory budget with the given limit in
+// bytes.
+func newMwebMemoryBudget(limit uint64) *mwebMemoryBudget {
+	return &mwebMemoryBudget{
+		limit: limit,
+		freed: make(chan struct{}),
+	}
+}
+
+// reserve reserves the given number of bytes if doing so stays within the
+// budget, returning nil. Otherwise nothing is reserved, and the returned
+// channel is closed once memory is next released. A reservation is always
+// granted when nothing else is reserved, so that a request larger than the
+// whole budget can still make progress.
+func (m *mwebMemoryBudget) reserve(n uint64) <-chan struct{} {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.limit > 0 && m.used > 0 && m.used+n > m.limit {
+		return m.freed
+	}
+	m.used += n
+
+	return nil
+}
+
+// release returns the given number of bytes to the budget, waking anyone
+// waiting on a reservation.
+func (m *mwebMemoryBudget) release(n uint64) {
+	if n == 0 {
+		return
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.used -= n
+
+	close(m.freed)
+	m.freed = make(chan struct{})
+}
+
+// inUse returns the number of bytes currently reserved.
+func (m *mwebMemoryBudget) inUse() uint64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.used
+}
+
+// reserveMwebMemory waits until the estimated memory for the given number
+// of mweb utxos can be reserved, returning early if the chain tip changes
+// or we're shutting down.
+func (b *blockManager) reserveMwebMemory(numUtxos uint16,
+	tipChanged <-chan struct{}) (uint64, error) {
+
+	n := mwebUtxosMemory(numUtxos)
+	for {
+		freed := b.mwebMemory.reserve(n)
+		if freed == nil {
+			return n, nil
+		}
+
+		log.Debugf("Mweb memory budget of %v bytes exhausted, "+
+			"waiting for %v bytes", b.cfg.MwebMemoryBudget, n)
+
+		select {
+		case <-freed:
+		case <-tipChanged:
+			return 0, errMwebTipChanged
+		case <-b.quit:
+			return 0, ErrShuttingDown
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebMemoryBudgetReserve tests that reservations are only granted
+// within the budget, and that those refused are woken once memory is freed.
+func TestMwebMemoryBudgetReserve(t *testing.T) {
+	t.Parallel()
+
+	// Without a limit, everything is granted.
+	unlimited := newMwebMemoryBudget(0)
+	require.Nil(t, unlimited.reserve(1<<40))
+	require.Nil(t, unlimited.reserve(1<<40))
+	require.Equal(t, uint64(1<<41), unlimited.inUse())
+
+	// A reservation larger than the whole budget is granted when nothing
+	// else is reserved.
+	budget := newMwebMemoryBudget(100)
+	require.Nil(t, budget.reserve(150))
+	freed := budget.reserve(1)
+	require.NotNil(t, freed)
+	budget.release(150)
+	require.Equal(t, uint64(0), budget.inUse())
+
+	select {
+	case <-freed:
+	default:
+		t.Fatal("refused reservation not woken on release")
+	}
+
+	require.Nil(t, budget.reserve(60))
+	require.Nil(t, budget.reserve(40))
+	require.NotNil(t, budget.reserve(1))
+	budget.release(40)
+	require.Nil(t, budget.reserve(40))
+	require.Equal(t, uint64(100), budget.inUse())
+}
+
+// TestMwebMemoryBudget tests that mweb utxos batches are capped by the
+// memory budget, and that dispatch stalls while outstanding memory exceeds
+// the budget.
+func TestMwebMemoryBudget(t *testing.T) {
+	t.Parallel()
+
+	// The budget fits two of the spans at a time.
+	s := newMwebSpansTest(t)
+	bm := s.bm
+	bm.cfg.MwebMemoryBudget = 2 * mwebUtxosMemory(3)
+	bm.mwebMemory = newMwebMemoryBudget(bm.cfg.MwebMemoryBudget)
+
+	// Simulate other outstanding requests using up the whole budget.
+	require.Nil(t, bm.mwebMemory.reserve(bm.cfg.MwebMemoryBudget))
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.fetch()
+	}()
+
+	select {
+	case <-s.dispatched:
+		t.Fatal("batch dispatched while over the memory budget")
+	case err := <-errChan:
+		t.Fatalf("fetch returned while over the memory budget: %v",
+			err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the memory is freed, the fetch runs to completion.
+	bm.mwebMemory.release(bm.cfg.MwebMemoryBudget)
+
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch didn't complete once memory was freed")
+	}
+	s.requireFetched(t)
+
+	// Each batch fits the budget, and their memory is all released.
+	batches := s.dispatchedBatches()
+	var starts []uint64
+	for _, batch := range batches {
+		require.LessOrEqual(t, len(batch), 2)
+		starts = append(starts, batch...)
+	}
+	require.Len(t, batches, 13)
+	require.Len(t, starts, 25)
+	require.Equal(t, uint64(0), bm.mwebMemory.inUse())
+}
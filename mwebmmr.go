@@ -0,0 +1,609 @@
+package neutrino
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/bits"
+	"sync"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// ErrMwebPeakUnknown is returned when the hash of an MMR peak can't be
+// computed from the stored coins, as some of the leaves under it are spent.
+var ErrMwebPeakUnknown = errors.New("mweb mmr peak covers spent leaves")
+
+const (
+	// maxMwebBlockWeight is the most weight that the mweb of a block can
+	// have under the consensus rules.
+	maxMwebBlockWeight = 200_000
+
+	// maxMwebOutputsPerBlock is the most outputs that the mweb of a
+	// block can add to the output MMR.
+	maxMwebOutputsPerBlock = maxMwebBlockWeight / mweb.BaseOutputWeight
+
+	// maxMmrHeight is the height of the tallest peak that an MMR with
+	// 64-bit node indices can have.
+	maxMmrHeight = 63
+)
+
+type (
+	// leafIdx is the index of a leaf in the mweb output MMR.
+	leafIdx uint64
+
+	// nodeIdx is the index of a node in the mweb output MMR, with nodes
+	// numbered in the order they are appended.
+	nodeIdx uint64
+)
+
+func (i leafIdx) nodeIdx() nodeIdx {
+	return nodeIdx(2*i) - nodeIdx(bits.OnesCount64(uint64(i)))
+}
+
+func (i nodeIdx) height() uint64 {
+	height := uint64(i)
+	h := 64 - bits.LeadingZeros64(uint64(i))
+	for peakSize := uint64(1<<h - 1); peakSize > 0; peakSize >>= 1 {
+		if height >= peakSize {
+			height -= peakSize
+		}
+	}
+	return height
+}
+
+func (i nodeIdx) leafIdx() leafIdx {
+	leafIndex := uint64(0)
+	numLeft := uint64(i)
+	h := 64 - bits.LeadingZeros64(uint64(i))
+	for peakSize := uint64(1<<h - 1); peakSize > 0; peakSize >>= 1 {
+		if numLeft >= peakSize {
+			leafIndex += (peakSize + 1) / 2
+			numLeft -= peakSize
+		}
+	}
+	return leafIdx(leafIndex)
+}
+
+func (i nodeIdx) left(height uint64) nodeIdx {
+	return i - (1 << height)
+}
+
+func (i nodeIdx) right() nodeIdx {
+	return i - 1
+}
+
+// mmrHasherPool holds blake3 hashers for reuse, as verifying a large proof
+// hashes thousands of MMR nodes.
+var mmrHasherPool = sync.Pool{
+	New: func() interface{} {
+		return newBlake3()
+	},
+}
+
+// newMmrHasher takes a hasher from the pool, reset and ready for use. It
+// must be returned with mmrHasherPool.Put once the hash is summed.
+func newMmrHasher(i nodeIdx) hash.Hash {
+	h := mmrHasherPool.Get().(hash.Hash)
+	h.Reset()
+
+	var index [8]byte
+	binary.LittleEndian.PutUint64(index[:], uint64(i))
+	h.Write(index[:])
+	return h
+}
+
+func (i nodeIdx) hash(data []byte) *chainhash.Hash {
+	h := newMmrHasher(i)
+	defer mmrHasherPool.Put(h)
+
+	wire.WriteVarBytes(h, 0, data)
+	return (*chainhash.Hash)(h.Sum(nil))
+}
+
+func (i nodeIdx) parentHash(left, right []byte) *chainhash.Hash {
+	h := newMmrHasher(i)
+	defer mmrHasherPool.Put(h)
+
+	h.Write(left)
+	h.Write(right)
+	return (*chainhash.Hash)(h.Sum(nil))
+}
+
+// leafsetContains returns whether the given leaf is unspent.
+func leafsetContains(leafset *mweb.Leafset, i leafIdx) bool {
+	return leafset.Contains(uint64(i))
+}
+
+// leafsetNextUnspent returns the next unspent leaf after the given one, or
+// the size of the leafset if there are none.
+func leafsetNextUnspent(leafset *mweb.Leafset, i leafIdx) leafIdx {
+	for {
+		i++
+		if leafsetContains(leafset, i) || uint64(i) >= leafset.Size {
+			return i
+		}
+	}
+}
+
+// calcPeaks returns the peaks of an MMR with the given number of nodes, from
+// left to right.
+func calcPeaks(nodes uint64) (peaks []nodeIdx) {
+	sumPrevPeaks := uint64(0)
+	h := 64 - bits.LeadingZeros64(nodes)
+	for peakSize := uint64(1<<h - 1); peakSize > 0; peakSize >>= 1 {
+		if nodes >= peakSize {
+			peaks = append(peaks, nodeIdx(sumPrevPeaks+peakSize-1))
+			sumPrevPeaks += peakSize
+			nodes -= peakSize
+		}
+	}
+	return
+}
+
+// calcMmrPeakHashes computes the hashes of the peaks of the output MMR with
+// the given number of leaves, from left to right, from the output ids of its
+// leaves. Leaves without an output id are taken to be spent, and so can't be
+// hashed.
+func calcMmrPeakHashes(numLeaves uint64,
+	outputIds map[leafIdx]*chainhash.Hash) ([]chainhash.Hash, error) {
+
+	var nodeHash func(node nodeIdx, height uint64) (*chainhash.Hash,
+		error)
+	nodeHash = func(node nodeIdx, height uint64) (*chainhash.Hash, error) {
+		if height == 0 {
+			outputId, ok := outputIds[node.leafIdx()]
+			if !ok {
+				return nil, fmt.Errorf("%w: leaf %v",
+					ErrMwebPeakUnknown, node.leafIdx())
+			}
+			return node.hash(outputId[:]), nil
+		}
+
+		left, err := nodeHash(node.left(height), height-1)
+		if err != nil {
+			return nil, err
+		}
+		right, err := nodeHash(node.right(), height-1)
+		if err != nil {
+			return nil, err
+		}
+		return node.parentHash(left[:], right[:]), nil
+	}
+
+	peaks := calcPeaks(uint64(leafIdx(numLeaves).nodeIdx()))
+	peakHashes := make([]chainhash.Hash, 0, len(peaks))
+	for _, peak := range peaks {
+		peakHash, err := nodeHash(peak, peak.height())
+		if err != nil {
+			return nil, fmt.Errorf("peak at node %v: %w", peak, err)
+		}
+		peakHashes = append(peakHashes, *peakHash)
+	}
+
+	return peakHashes, nil
+}
+
+// bagPeaks folds the peak hashes, given from left to right, into a single
+// hash. The peaks are bagged from right to left, with each step hashing the
+// next peak to the left with the bag so far as a parent at nodeIdx, which is
+// the index of the next node to be added to the MMR. It returns nil if
+// there are no peaks.
+func bagPeaks(peakHashes []*chainhash.Hash, nodeIdx nodeIdx) *chainhash.Hash {
+	if len(peakHashes) == 0 {
+		return nil
+	}
+
+	baggedPeak := peakHashes[len(peakHashes)-1]
+	for i := len(peakHashes) - 2; i >= 0; i-- {
+		baggedPeak = nodeIdx.parentHash(peakHashes[i][:], baggedPeak[:])
+	}
+	return baggedPeak
+}
+
+// verifyUtxosVars holds the state of a walk over the output MMR, rebuilding
+// the peak hashes from a span of utxos and their proof hashes.
+type verifyUtxosVars struct {
+	mwebUtxos                 *wire.MsgMwebUtxos
+	leafset                   *mweb.Leafset
+	firstLeafIdx, lastLeafIdx leafIdx
+	leavesUsed, hashesUsed    int
+	isProofHash               map[nodeIdx]bool
+
+	// anyHash, if set, makes every request for a proof hash succeed with
+	// a placeholder hash. This is used to find where the proof hashes
+	// go without having a proof.
+	anyHash bool
+
+	// positions records the nodes for which proof hashes were used, in
+	// the order they were used.
+	positions []nodeIdx
+
+	// maxHeight bounds the height of the peaks walked, and so the depth
+	// of the recursion in calcNodeHash. If a peak is any taller, tooTall
+	// is set and the walk is aborted.
+	maxHeight uint64
+	tooTall   bool
+}
+
+// maxMwebMMRHeight returns the height of the tallest peak that the output
+// MMR can have at the given block height, were every block up to it full of
+// mweb outputs. A height of zero is taken to be unknown, as no block there
+// can have any, and only the width of the node indices bounds it then.
+func maxMwebMMRHeight(blockHeight uint32) uint64 {
+	if blockHeight == 0 {
+		return maxMmrHeight
+	}
+
+	maxLeaves := uint64(blockHeight) * maxMwebOutputsPerBlock
+	return uint64(bits.Len64(maxLeaves))
+}
+
+func (v *verifyUtxosVars) nextLeaf() (
+	leafIndex leafIdx, hash *chainhash.Hash) {
+
+	if v.leavesUsed == len(v.mwebUtxos.Utxos) {
+		return
+	}
+	utxo := v.mwebUtxos.Utxos[v.leavesUsed]
+	leafIndex = leafIdx(utxo.LeafIndex)
+	hash = utxo.OutputId
+	v.leavesUsed++
+	return
+}
+
+func (v *verifyUtxosVars) nextHash(
+	nodeIdx nodeIdx) (hash *chainhash.Hash) {
+
+	switch {
+	case v.anyHash:
+		hash = &chainhash.Hash{}
+	case v.hashesUsed == len(v.mwebUtxos.ProofHashes):
+		return
+	default:
+		hash = v.mwebUtxos.ProofHashes[v.hashesUsed]
+	}
+	v.hashesUsed++
+	v.isProofHash[nodeIdx] = true
+	v.positions = append(v.positions, nodeIdx)
+	return
+}
+
+func (v *verifyUtxosVars) calcNodeHash(
+	nodeIdx nodeIdx, height uint64) *chainhash.Hash {
+
+	if height > v.maxHeight {
+		v.tooTall = true
+		return nil
+	}
+	if nodeIdx < v.firstLeafIdx.nodeIdx() || v.isProofHash[nodeIdx] {
+		return v.nextHash(nodeIdx)
+	}
+	if height == 0 {
+		leafIdx := nodeIdx.leafIdx()
+		if !leafsetContains(v.leafset, leafIdx) {
+			return nil
+		}
+		leafIdx2, outputId := v.nextLeaf()
+		if leafIdx != leafIdx2 || outputId == nil {
+			return nil
+		}
+		return nodeIdx.hash(outputId[:])
+	}
+	left := v.calcNodeHash(nodeIdx.left(height), height-1)
+	var right *chainhash.Hash
+	if v.lastLeafIdx.nodeIdx() <= nodeIdx.left(height) {
+		right = v.nextHash(nodeIdx.right())
+	} else {
+		right = v.calcNodeHash(nodeIdx.right(), height-1)
+	}
+	switch {
+	case left == nil && right == nil:
+		return nil
+	case left == nil:
+		if left = v.nextHash(nodeIdx.left(height)); left == nil {
+			return nil
+		}
+	case right == nil:
+		if right = v.nextHash(nodeIdx.right()); right == nil {
+			return nil
+		}
+	}
+	return nodeIdx.parentHash(left[:], right[:])
+}
+
+// checkUtxoLeaves checks that the utxos are for consecutive unspent leaves
+// starting at the start index, and sets the last leaf index accordingly.
+func (v *verifyUtxosVars) checkUtxoLeaves() bool {
+	for i := 0; ; i++ {
+		if !leafsetContains(v.leafset, v.lastLeafIdx) {
+			return false
+		}
+		if leafIdx(v.mwebUtxos.Utxos[i].LeafIndex) != v.lastLeafIdx {
+			return false
+		}
+		if i == len(v.mwebUtxos.Utxos)-1 {
+			return true
+		}
+		v.lastLeafIdx = leafsetNextUnspent(v.leafset, v.lastLeafIdx)
+	}
+}
+
+// calcPeakHashes walks the MMR to calculate the hashes of the peaks up to
+// the one containing the last leaf, followed by the bagged hash of any
+// peaks after it. The walk is done twice: the first pass discovers which
+// nodes are given as proof hashes, so that the second pass can consume
+// them in their canonical order. Nil is returned if the utxos and proof
+// hashes don't fit the MMR.
+func (v *verifyUtxosVars) calcPeakHashes() []*chainhash.Hash {
+	var (
+		nextNodeIdx = leafIdx(v.leafset.Size).nodeIdx()
+		peaks       = calcPeaks(uint64(nextNodeIdx))
+		peakHashes  []*chainhash.Hash
+	)
+	for i := 0; i < 2; i++ {
+		peakHashes = nil
+		v.leavesUsed = 0
+		v.hashesUsed = 0
+		v.positions = nil
+
+		for _, peakNodeIdx := range peaks {
+			peakHash := v.calcNodeHash(
+				peakNodeIdx, peakNodeIdx.height(),
+			)
+			if v.tooTall {
+				return nil
+			}
+			if peakHash == nil {
+				peakHash = v.nextHash(peakNodeIdx)
+				if peakHash == nil {
+					return nil
+				}
+			}
+			peakHashes = append(peakHashes, peakHash)
+			if v.lastLeafIdx.nodeIdx() <= peakNodeIdx {
+				if peakNodeIdx != peaks[len(peaks)-1] {
+					baggedPeak := v.nextHash(nextNodeIdx)
+					if baggedPeak == nil {
+						return nil
+					}
+					peakHashes = append(
+						peakHashes, baggedPeak,
+					)
+				}
+				break
+			}
+		}
+		if v.leavesUsed != len(v.mwebUtxos.Utxos) {
+			return nil
+		}
+		if !v.anyHash && v.hashesUsed != len(v.mwebUtxos.ProofHashes) {
+			return nil
+		}
+	}
+	return peakHashes
+}
+
+// verifyMwebUtxosProof returns whether the mweb utxos are consecutive
+// unspent leaves of the leafset, and that together with their proof hashes
+// they hash to the output root of the mweb header.
+func verifyMwebUtxosProof(mwebHeader *wire.MwebHeader,
+	leafset *mweb.Leafset, mwebUtxos *wire.MsgMwebUtxos) bool {
+
+	err := checkMwebUtxosProof(nil, mwebHeader, leafset, mwebUtxos)
+	return err == nil
+}
+
+// checkMwebUtxosProof is verifyMwebUtxosProof returning an error for
+// a proof that fails to verify, either ErrMwebBadProof or ErrMwebMMRTooTall.
+// The walk over the output MMR is bounded by the tallest MMR possible at the
+// height of the leafset, so that a header claiming an implausibly large MMR
+// is rejected rather than walked. The peaks may give the output root under
+// any of the root variants, or under the default rule if there are none.
+func checkMwebUtxosProof(variants []MwebRootVariant,
+	mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) error {
+
+	_, err := walkMwebUtxosProof(variants, mwebHeader, leafset, mwebUtxos)
+	return err
+}
+
+// walkMwebUtxosProof is checkMwebUtxosProof returning the walk over the
+// output MMR that verified the proof, which is nil for an empty MMR. If the
+// proof fails to verify, the walk is returned as far as it got, or nil if
+// it never started.
+func walkMwebUtxosProof(variants []MwebRootVariant,
+	mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) (*verifyUtxosVars, error) {
+
+	// Before mweb activation the output MMR is empty, which is only
+	// proven by an empty response against an empty leafset and a header
+	// committing to no leaves. From the activation block on, the MMR has
+	// leaves and must be walked.
+	if mwebUtxos.StartIndex == 0 && len(mwebUtxos.Utxos) == 0 &&
+		len(mwebUtxos.ProofHashes) == 0 && leafset.Size == 0 &&
+		mwebHeader.OutputMMRSize == 0 &&
+		mwebHeader.OutputRoot.IsEqual(&chainhash.Hash{}) {
+		return nil, nil
+	} else if len(mwebUtxos.Utxos) == 0 || leafset.Size == 0 {
+		return nil, ErrMwebBadProof
+	}
+
+	v := &verifyUtxosVars{
+		mwebUtxos:    mwebUtxos,
+		leafset:      leafset,
+		firstLeafIdx: leafIdx(mwebUtxos.StartIndex),
+		lastLeafIdx:  leafIdx(mwebUtxos.StartIndex),
+		isProofHash:  make(map[nodeIdx]bool),
+		maxHeight:    maxMwebMMRHeight(leafset.Height),
+	}
+	if !v.checkUtxoLeaves() {
+		return v, ErrMwebBadProof
+	}
+
+	// A walk that gives no peaks can't be bagged into a root. With a
+	// single peak, the root is the peak itself.
+	peakHashes := v.calcPeakHashes()
+	if v.tooTall {
+		return v, fmt.Errorf("%w: mmr of %v leaves at height %v",
+			ErrMwebMMRTooTall, leafset.Size, leafset.Height)
+	}
+	if len(peakHashes) == 0 {
+		return v, ErrMwebBadProof
+	}
+
+	variant := matchMwebRootVariant(
+		variants, peakHashes, uint64(leafIdx(leafset.Size).nodeIdx()),
+		&mwebHeader.OutputRoot,
+	)
+	if variant == nil {
+		return v, ErrMwebBadProof
+	}
+	if len(variants) > 1 {
+		log.Debugf("Mweb utxos at index %v matched output root "+
+			"variant %v", mwebUtxos.StartIndex, variant.Name)
+	}
+
+	return v, nil
+}
+
+// proofAssignments returns the proof hashes consumed by the walk, each with
+// the node it was taken for, in the order they were consumed. It returns
+// nil for a nil walk.
+func (v *verifyUtxosVars) proofAssignments() []MwebProofAssignment {
+	if v == nil {
+		return nil
+	}
+
+	assignments := make([]MwebProofAssignment, len(v.positions))
+	for i, pos := range v.positions {
+		assignments[i] = MwebProofAssignment{
+			NodeIdx: uint64(pos),
+			Hash:    *v.mwebUtxos.ProofHashes[i],
+		}
+	}
+	return assignments
+}
+
+// minMwebProofHashes returns a lower bound on the number of proof hashes
+// that the unspent leaves from firstIndex to lastIndex inclusive need in an
+// output MMR of the given number of leaves, whichever of the leaves in
+// between are unspent. It only looks at the shape of the MMR, so is cheap
+// enough to weed out proofs that can't verify before walking them. Each
+// peak to the left of the leaves takes a hash, as does each sibling to the
+// left of the path up to the first leaf and to the right of the path up to
+// the last leaf, along with one for any peaks to the right of the leaves.
+func minMwebProofHashes(numLeaves, firstIndex, lastIndex uint64) int {
+	if lastIndex < firstIndex || lastIndex >= numLeaves {
+		return 0
+	}
+
+	// pathHashes counts the siblings to one side of the path down from
+	// the node to the leaf.
+	pathHashes := func(i nodeIdx, height uint64, leaf leafIdx,
+		left bool) int {
+
+		var count int
+		for ; height > 0; height-- {
+			l, r := i.left(height), i.right()
+			_, last := leafRange(l, height-1)
+			if leaf <= last {
+				i = l
+				if !left {
+					count++
+				}
+			} else {
+				i = r
+				if left {
+					count++
+				}
+			}
+		}
+		return count
+	}
+
+	var count int
+	firstLeaf, lastLeaf := leafIdx(firstIndex), leafIdx(lastIndex)
+	numNodes := uint64(leafIdx(numLeaves).nodeIdx())
+	for _, peak := range calcPeaks(numNodes) {
+		height := peak.height()
+		first, last := leafRange(peak, height)
+		switch {
+		case last < firstLeaf:
+			count++
+			continue
+
+		case first > lastLeaf:
+			return count + 1
+		}
+
+		if first <= firstLeaf {
+			count += pathHashes(peak, height, firstLeaf, true)
+		}
+		if lastLeaf <= last {
+			count += pathHashes(peak, height, lastLeaf, false)
+		}
+	}
+	return count
+}
+
+// MwebProofHashPositions returns the MMR node indices at which proof hashes
+// are expected, in the order they must appear in an mwebutxos message for
+// the unspent leaves from startIndex to lastIndex inclusive. The leafset
+// determines the shape of the MMR and which leaves are unspent. If the
+// peaks to the right of the span are to be given as a single bagged hash,
+// the final position is the number of nodes in the MMR, which is one past
+// the index of its last node.
+func MwebProofHashPositions(leafset *mweb.Leafset, startIndex,
+	lastIndex uint64) ([]uint64, error) {
+
+	switch {
+	case lastIndex < startIndex:
+		return nil, fmt.Errorf("last index %v is before start index %v",
+			lastIndex, startIndex)
+
+	case !leafset.Contains(startIndex):
+		return nil, fmt.Errorf("start index %v is not unspent",
+			startIndex)
+
+	case !leafset.Contains(lastIndex):
+		return nil, fmt.Errorf("last index %v is not unspent",
+			lastIndex)
+	}
+
+	// The utxos only need the right leaf indices, as their hashes don't
+	// affect the walk.
+	mwebUtxos := &wire.MsgMwebUtxos{StartIndex: startIndex}
+	for i := startIndex; i <= lastIndex; i++ {
+		if leafset.Contains(i) {
+			mwebUtxos.Utxos = append(mwebUtxos.Utxos,
+				&wire.MwebNetUtxo{
+					LeafIndex: i,
+					OutputId:  &chainhash.Hash{},
+				})
+		}
+	}
+
+	v := &verifyUtxosVars{
+		mwebUtxos:    mwebUtxos,
+		leafset:      leafset,
+		firstLeafIdx: leafIdx(startIndex),
+		lastLeafIdx:  leafIdx(lastIndex),
+		isProofHash:  make(map[nodeIdx]bool),
+		anyHash:      true,
+		maxHeight:    maxMwebMMRHeight(leafset.Height),
+	}
+	if v.calcPeakHashes() == nil {
+		return nil, fmt.Errorf("unable to walk mmr for leaves %v to %v",
+			startIndex, lastIndex)
+	}
+
+	positions := make([]uint64, len(v.positions))
+	for i, pos := range v.positions {
+		positions[i] = uint64(pos)
+	}
+	return positions, nil
+}
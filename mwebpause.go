@@ -0,0 +1,119 @@
+package neutrino
+
+import (
+	"errors"
+	"sync"
+)
+
+// errMwebCancelled is returned when an mweb query is abandoned because the
+// mweb queries were cancelled by CancelMwebQueries.
+var errMwebCancelled = errors.New("mweb queries cancelled")
+
+// mwebPause pauses the mweb sync on request, cancelling the mweb queries in
+// flight, until the sync is resumed.
+type mwebPause struct {
+	mtx sync.Mutex
+
+	// cancelled is closed once the sync is paused, and replaced with an
+	// open channel once it's resumed.
+	cancelled chan struct{}
+
+	// resumed is closed while the sync isn't paused, and replaced with
+	// an open channel once it's paused.
+	resumed chan struct{}
+}
+
+// newMwebPause returns an mwebPause for an mweb sync that isn't paused.
+func newMwebPause() *mwebPause {
+	resumed := make(chan struct{})
+	close(resumed)
+
+	return &mwebPause{
+		cancelled: make(chan struct{}),
+		resumed:   resumed,
+	}
+}
+
+// pause pauses the mweb sync, returning false if it already was.
+func (p *mwebPause) pause() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	select {
+	case <-p.cancelled:
+		return false
+	default:
+	}
+
+	close(p.cancelled)
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// resume resumes the mweb sync, returning false if it wasn't paused.
+func (p *mwebPause) resume() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	select {
+	case <-p.resumed:
+		return false
+	default:
+	}
+
+	close(p.resumed)
+	p.cancelled = make(chan struct{})
+	return true
+}
+
+// cancelledChan returns a channel that is closed once the mweb sync is
+// paused, which it already is if the sync is paused now.
+func (p *mwebPause) cancelledChan() <-chan struct{} {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.cancelled
+}
+
+// resumedChan returns a channel that is closed once the mweb sync isn't
+// paused, which it already is if the sync isn't paused now.
+func (p *mwebPause) resumedChan() <-chan struct{} {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.resumed
+}
+
+// waitMwebResumed waits until the mweb sync isn't paused, returning false
+// if we're shutting down first.
+func (b *blockManager) waitMwebResumed() bool {
+	select {
+	case <-b.mwebPause.resumedChan():
+		return true
+	default:
+	}
+
+	log.Infof("Mweb sync paused, waiting to be resumed")
+
+	select {
+	case <-b.mwebPause.resumedChan():
+		log.Infof("Mweb sync resumed")
+		return true
+	case <-b.quit:
+		return false
+	}
+}
+
+// CancelMwebQueries cancels the mweb queries in flight and pauses the mweb
+// sync until ResumeMwebQueries is called. The block header and filter
+// header sync carry on as before.
+func (b *blockManager) CancelMwebQueries() {
+	if b.mwebPause.pause() {
+		log.Infof("Cancelling mweb queries")
+	}
+}
+
+// ResumeMwebQueries resumes the mweb sync paused by CancelMwebQueries.
+func (b *blockManager) ResumeMwebQueries() {
+	b.mwebPause.resume()
+}
@@ -0,0 +1,107 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCancelMwebQueries tests that cancelling the mweb queries cancels the
+// outstanding getmwebutxos query without writing any more coins, and that
+// the fetch picks up where it left off once resumed.
+func TestCancelMwebQueries(t *testing.T) {
+	t.Parallel()
+
+	bm, coinDB, q := setupMwebUtxosQuery(t, []uint64{0, 10}, 10)
+	answer := bm.cfg.QueryDispatcher
+
+	peer := &silentPeer{sent: make(chan wire.Message, 1)}
+	peers := make(chan query.Peer, 1)
+	peers <- peer
+
+	wm := query.NewWorkManager(&query.Config{
+		ConnectedPeers: func() (<-chan query.Peer, func(), error) {
+			return peers, func() {}, nil
+		},
+		NewWorker: query.NewWorker,
+		Ranking:   query.NewPeerRanking(),
+	})
+	require.NoError(t, wm.Start())
+	t.Cleanup(func() {
+		require.NoError(t, wm.Stop())
+	})
+
+	// The first request is answered straight away, while the second is
+	// handed to a peer that never answers.
+	result := make(chan error, 1)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			options ...query.QueryOption) chan error {
+
+			msg := requests[0].Req.(*wire.MsgGetMwebUtxos)
+			errChan := wm.Query(requests[1:], options...)
+			forward := make(chan error, 1)
+			go func() {
+				q.utxosChan <- newMockMwebUtxos(msg)
+				err := <-errChan
+				result <- err
+				forward <- err
+			}()
+			return forward
+		},
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := bm.getMwebUtxosBatch(q)
+		errs <- err
+	}()
+
+	select {
+	case <-peer.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not sent to peer")
+	}
+	require.Eventually(t, func() bool {
+		coinDB.mtx.Lock()
+		defer coinDB.mtx.Unlock()
+		return len(coinDB.coins) == 10
+	}, 5*time.Second, 10*time.Millisecond)
+	bm.CancelMwebQueries()
+
+	select {
+	case err := <-errs:
+		require.ErrorIs(t, err, errMwebCancelled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch didn't return once cancelled")
+	}
+
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, query.ErrJobCanceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not cancelled")
+	}
+
+	// Only the coins answered before the cancel were written, and a
+	// fetch started while paused is cancelled straight away.
+	require.Len(t, coinDB.coins, 10)
+	require.Len(t, q.msgs, 1)
+
+	bm.cfg.QueryDispatcher = answer
+	_, err := bm.getMwebUtxosBatch(q)
+	require.ErrorIs(t, err, errMwebCancelled)
+	require.Len(t, coinDB.coins, 10)
+
+	// Once resumed, the rest of the coins are fetched.
+	bm.ResumeMwebQueries()
+	require.True(t, bm.waitMwebResumed())
+
+	count, err := bm.getMwebUtxosBatch(q)
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+	require.Len(t, coinDB.coins, 20)
+}
@@ -0,0 +1,48 @@
+package neutrino
+
+import (
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// MwebPeerSelector selects the peers that mweb queries are sent to, such as
+// by their location, latency or reputation.
+type MwebPeerSelector interface {
+	// SelectPeers is given the addresses of the connected peers free to
+	// take the mweb request, in the order that they would otherwise be
+	// tried, and returns those that it may be sent to, in the order to
+	// try them. The request is held back while it returns none, while
+	// the requests queued behind it are sent. It is called by the work
+	// manager as it dispatches each request, so it must return quickly.
+	SelectPeers(peers []string, req wire.Message) []string
+}
+
+// keepMwebPeerOrder is the default MwebPeerSelector, which leaves the peers
+// in the order given. This order already accounts for the peer ranking and
+// for the peers that mweb requests prefer.
+type keepMwebPeerOrder struct{}
+
+// A compile time check to ensure keepMwebPeerOrder satisfies the
+// MwebPeerSelector interface.
+var _ MwebPeerSelector = keepMwebPeerOrder{}
+
+// SelectPeers returns the peers as given.
+//
+// NOTE: Part of the MwebPeerSelector interface.
+func (keepMwebPeerOrder) SelectPeers(peers []string, _ wire.Message) []string {
+	return peers
+}
+
+// selectMwebPeers returns the function that selects the peers that the given
+// message is sent to with the configured MwebPeerSelector, or nil if there
+// is none, leaving the peers in the work manager's order.
+func (b *blockManager) selectMwebPeers(
+	msg wire.Message) func(peers []string) []string {
+
+	selector := b.cfg.MwebPeerSelector
+	if selector == nil {
+		return nil
+	}
+	return func(peers []string) []string {
+		return selector.SelectPeers(peers, msg)
+	}
+}
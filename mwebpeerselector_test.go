@@ -0,0 +1,141 @@
+package neutrino
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// reverseMwebPeerSelector is an MwebPeerSelector that tries the peers in
+// descending order of address, recording the requests it's asked about.
+type reverseMwebPeerSelector struct {
+	mtx  sync.Mutex
+	msgs []wire.Message
+}
+
+func (s *reverseMwebPeerSelector) SelectPeers(peers []string,
+	req wire.Message) []string {
+
+	s.mtx.Lock()
+	s.msgs = append(s.msgs, req)
+	s.mtx.Unlock()
+
+	selected := append([]string(nil), peers...)
+	sort.Sort(sort.Reverse(sort.StringSlice(selected)))
+	return selected
+}
+
+// TestMwebPeerSelector tests that the work manager gives mweb utxos requests
+// to the peers in the order that the MwebPeerSelector returns them, and that
+// the default selector keeps the order it's given.
+func TestMwebPeerSelector(t *testing.T) {
+	t.Parallel()
+
+	peers := []string{"10.0.0.1:9333", "10.0.0.2:9333", "10.0.0.3:9333"}
+	require.Equal(t, peers, keepMwebPeerOrder{}.SelectPeers(peers, nil))
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	bm.cfg.MwebCoins = newMockCoinDatabase()
+
+	selector := &reverseMwebPeerSelector{}
+	bm.cfg.MwebPeerSelector = selector
+
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset(3, 7, 12)
+
+	// Each peer answers once it's told to, so that the requests are all
+	// dispatched while the peers are busy with the first ones.
+	var (
+		mtx      sync.Mutex
+		servedBy = make(map[uint64]string)
+	)
+	release := make(chan struct{})
+	connected := make(chan query.Peer, len(peers))
+	for _, addr := range peers {
+		addr := addr
+		connected <- &answeringPeer{
+			addr: addr,
+			answer: func(msg wire.Message) wire.Message {
+				getUtxos := msg.(*wire.MsgGetMwebUtxos)
+				mtx.Lock()
+				servedBy[getUtxos.StartIndex] = addr
+				mtx.Unlock()
+
+				<-release
+				return mmr.proveUtxos(leafset, getUtxos)
+			},
+			recv: make(chan wire.Message, 1),
+		}
+	}
+
+	wm := query.NewWorkManager(&query.Config{
+		ConnectedPeers: func() (<-chan query.Peer, func(), error) {
+			return connected, func() {}, nil
+		},
+		NewWorker: query.NewWorker,
+		Ranking:   query.NewPeerRanking(),
+	})
+	require.NoError(t, wm.Start())
+	t.Cleanup(func() {
+		require.NoError(t, wm.Stop())
+	})
+	bm.cfg.QueryDispatcher = wm
+	require.Eventually(t, func() bool {
+		return len(connected) == 0
+	}, time.Second, time.Millisecond)
+
+	// The spans are small enough that there's a request for each peer.
+	bm.mwebBatchSizer.sizes["10.0.0.1:9333"] = 4
+	bm.mwebBatchSizer.sizes["10.0.0.2:9333"] = 4
+	bm.mwebBatchSizer.sizes["10.0.0.3:9333"] = 4
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- bm.getMwebUtxos(
+			mmr.mwebHeader(), leafset, &chainhash.Hash{},
+		)
+	}()
+
+	// The first three requests are given to the peers in descending
+	// order of address, as each is taken by the one before.
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(servedBy) == len(peers)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mtx.Lock()
+	var starts []uint64
+	for start := range servedBy {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	for i, start := range starts {
+		require.Equal(t, peers[len(peers)-1-i], servedBy[start])
+	}
+	mtx.Unlock()
+
+	close(release)
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("mweb utxos not fetched")
+	}
+
+	selector.mtx.Lock()
+	defer selector.mtx.Unlock()
+	require.NotEmpty(t, selector.msgs)
+	for _, msg := range selector.msgs {
+		require.IsType(t, &wire.MsgGetMwebUtxos{}, msg)
+	}
+}
@@ -0,0 +1,110 @@
+package neutrino
+
+import (
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebHeaderPrefetch is a fetch of the mweb header and leafset of a new
+// chain tip, made while the mweb utxos of the previous tip are still being
+// fetched. This way the next round of the mweb sync can start on the utxos
+// of the new tip as soon as the previous round ends, rather than waiting on
+// its header first.
+type mwebHeaderPrefetch struct {
+	// done is closed once the fetch has finished, or once it's no longer
+	// wanted if the chain tip never changed.
+	done chan struct{}
+
+	// The fields below must only be read once done is closed. The mweb
+	// header and leafset are only set if they were fetched and verified.
+	blockHash   chainhash.Hash
+	mwebHeader  *wire.MsgMwebHeader
+	mwebLeafset *wire.MsgMwebLeafset
+}
+
+// prefetchMwebHeader starts fetching the mweb header and leafset of the
+// chain tip as soon as it moves away from the current one. Nothing is
+// fetched if stop is closed first.
+func (b *blockManager) prefetchMwebHeader(
+	stop <-chan struct{}) *mwebHeaderPrefetch {
+
+	p := &mwebHeaderPrefetch{done: make(chan struct{})}
+	tipChanged := b.watchMwebTip(stop)
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer close(p.done)
+
+		select {
+		case <-tipChanged:
+		case <-stop:
+			return
+		case <-b.quit:
+			return
+		}
+
+		b.newHeadersMtx.RLock()
+		p.blockHash = b.headerTipHash
+		b.newHeadersMtx.RUnlock()
+
+		log.Debugf("Prefetching mwebheader and mwebleafset for new "+
+			"tip %v", p.blockHash)
+
+		mwebHeader, mwebLeafset, err := b.fetchMwebHeaderAndLeafset(
+			&p.blockHash,
+		)
+		if err != nil {
+			log.Debugf("Unable to prefetch mwebheader and "+
+				"mwebleafset: %v", err)
+			return
+		}
+		p.mwebHeader, p.mwebLeafset = mwebHeader, mwebLeafset
+	}()
+
+	return p
+}
+
+// getMwebUtxosPipelined fetches the mweb utxos as getMwebUtxos does, while
+// prefetching the mweb header and leafset of the next chain tip should the
+// tip change in the meantime. The prefetch is returned for the next round
+// of the mweb sync to pick up.
+func (b *blockManager) getMwebUtxosPipelined(mwebHeader *wire.MwebHeader,
+	leafset *mweb.Leafset, blockHash *chainhash.Hash) (*mwebHeaderPrefetch,
+	error) {
+
+	stop := make(chan struct{})
+	prefetch := b.prefetchMwebHeader(stop)
+
+	b.mwebHeaderPrefetch = prefetch
+	err := b.getMwebUtxos(mwebHeader, leafset, blockHash)
+	b.mwebHeaderPrefetch = nil
+	close(stop)
+
+	return prefetch, err
+}
+
+// nextMwebHeaderAndLeafset returns the mweb header and leafset of the given
+// block, taking them from the prefetch if it was for the same block, and
+// fetching them from our peers otherwise.
+func (b *blockManager) nextMwebHeaderAndLeafset(prefetch *mwebHeaderPrefetch,
+	blockHash *chainhash.Hash) (*wire.MsgMwebHeader, *wire.MsgMwebLeafset,
+	error) {
+
+	if prefetch != nil {
+		select {
+		case <-prefetch.done:
+		case <-b.quit:
+			return nil, nil, ErrShuttingDown
+		}
+
+		if prefetch.blockHash == *blockHash &&
+			prefetch.mwebHeader != nil {
+
+			return prefetch.mwebHeader, prefetch.mwebLeafset, nil
+		}
+	}
+
+	return b.fetchMwebHeaderAndLeafset(blockHash)
+}
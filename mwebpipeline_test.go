@@ -0,0 +1,109 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebHeaderPrefetch tests that the mweb header of a new chain tip is
+// fetched while the mweb utxos of the previous tip are still being fetched,
+// and that the next round picks up the prefetched header.
+func TestMwebHeaderPrefetch(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	mmr := newTestMwebMmr(16)
+	var missing []uint64
+	for i := uint64(0); i < 16; i++ {
+		missing = append(missing, i)
+	}
+	coinDB.leafset = mmr.leafset(missing...)
+	leafset := mmr.leafset()
+
+	hash1 := chainhash.Hash{0x01}
+	header2, mwebHeader2, mwebLeafset2 := newTestMwebHeader(
+		t, hash1, wire.MwebHeader{
+			Height:        2,
+			OutputMMRSize: 8,
+		}, []byte{0xff},
+	)
+	hash2 := header2.BlockHash()
+
+	bm.newHeadersMtx.Lock()
+	bm.headerTip = 1
+	bm.headerTipHash = hash1
+	bm.newHeadersMtx.Unlock()
+
+	// The utxos requests are never answered, and the new tip arrives
+	// while they're in flight.
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(_ []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			go func() {
+				bm.newHeadersSignal.L.Lock()
+				bm.headerTip = 2
+				bm.headerTipHash = hash2
+				bm.newHeadersSignal.Broadcast()
+				bm.newHeadersSignal.L.Unlock()
+			}()
+			return make(chan error, 1)
+		},
+	}
+
+	// Record whether the header of the new tip is fetched before the
+	// utxos fetch of the previous tip has returned.
+	var (
+		utxosDone  = make(chan struct{})
+		overlapped bool
+		peers      = &mockMwebPeers{
+			mwebHeader:  mwebHeader2,
+			mwebLeafset: mwebLeafset2,
+		}
+	)
+	bm.cfg.queryAllPeers = func(queryMsg wire.Message,
+		checkResponse func(sp *ServerPeer, resp wire.Message,
+			quit chan<- struct{}, peerQuit chan<- struct{}),
+		options ...QueryOption) {
+
+		select {
+		case <-utxosDone:
+		default:
+			overlapped = true
+		}
+		peers.queryAllPeers(queryMsg, checkResponse, options...)
+	}
+
+	prefetch, err := bm.getMwebUtxosPipelined(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &hash1)
+	close(utxosDone)
+	require.ErrorIs(t, err, errMwebTipChanged)
+	require.True(t, overlapped)
+	require.Nil(t, bm.mwebHeaderPrefetch)
+
+	// The next round takes the prefetched header without asking our
+	// peers again.
+	mwebHeader, mwebLeafset, err := bm.nextMwebHeaderAndLeafset(
+		prefetch, &hash2,
+	)
+	require.NoError(t, err)
+	require.Same(t, mwebHeader2, mwebHeader)
+	require.Same(t, mwebLeafset2, mwebLeafset)
+	require.Len(t, peers.msgs, 1)
+
+	// A prefetch for another block is ignored.
+	_, _, err = bm.nextMwebHeaderAndLeafset(prefetch, &hash1)
+	require.Error(t, err)
+	require.Len(t, peers.msgs, 2)
+}
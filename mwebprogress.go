@@ -0,0 +1,134 @@
+package neutrino
+
+import (
+	"slices"
+	"time"
+)
+
+// mwebRateSmoothing is the weight given to the throughput of the latest
+// batch of mweb utxos in the moving average of the sync rate. The rest is
+// given to the average of the batches before it.
+const mwebRateSmoothing = 0.2
+
+// MwebSyncProgress describes how far a sync of mweb utxos has got, as of
+// the completion of a batch of getmwebutxos messages.
+type MwebSyncProgress struct {
+	// Height is the height of the block whose leafset is being synced
+	// to.
+	Height uint32
+
+	// Fetched is the number of leaves fetched so far by the sync.
+	Fetched uint64
+
+	// Total is the number of leaves to be fetched by the sync.
+	Total uint64
+
+	// Rate is the moving average of the number of leaves fetched per
+	// second over the recent batches.
+	Rate float64
+
+	// ETA is the estimated time remaining until the sync completes at
+	// the current rate. It is zero once the sync is complete, or if the
+	// rate isn't known yet.
+	ETA time.Duration
+}
+
+// mwebRateEstimator estimates the rate at which leaves are fetched by an
+// mweb utxos sync from a moving average of the throughput of its batches.
+type mwebRateEstimator struct {
+	last time.Time
+	rate float64
+}
+
+// newMwebRateEstimator creates an estimator for a sync started at the given
+// time.
+func newMwebRateEstimator(start time.Time) *mwebRateEstimator {
+	return &mwebRateEstimator{last: start}
+}
+
+// update records a batch of the given number of leaves completing at the
+// given time, which is measured against the completion of the batch before
+// it, or the start of the sync for the first.
+func (e *mwebRateEstimator) update(leaves uint64, now time.Time) {
+	elapsed := now.Sub(e.last)
+	e.last = now
+	if elapsed <= 0 {
+		return
+	}
+
+	rate := float64(leaves) / elapsed.Seconds()
+	if e.rate == 0 {
+		e.rate = rate
+		return
+	}
+	e.rate = mwebRateSmoothing*rate + (1-mwebRateSmoothing)*e.rate
+}
+
+// eta returns the estimated time to fetch the given number of leaves, or
+// zero if the rate isn't known yet.
+func (e *mwebRateEstimator) eta(remaining uint64) time.Duration {
+	if e.rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / e.rate * float64(time.Second))
+}
+
+// RegisterMwebSyncProgressCallback will register a callback that will fire
+// with the progress of a sync of mweb utxos each time a batch of it
+// completes. The callbacks are run by the sync, so they must return
+// quickly.
+func (b *blockManager) RegisterMwebSyncProgressCallback(
+	onProgress func(MwebSyncProgress)) {
+
+	b.mwebProgressCallbacksMtx.Lock()
+	defer b.mwebProgressCallbacksMtx.Unlock()
+	b.mwebProgressCallbacks = append(b.mwebProgressCallbacks, onProgress)
+}
+
+// mwebSyncProgress tracks the progress of a sync of mweb utxos and reports
+// it to the progress callbacks.
+type mwebSyncProgress struct {
+	blockMgr  *blockManager
+	progress  MwebSyncProgress
+	estimator *mwebRateEstimator
+}
+
+// newMwebSyncProgress starts tracking a sync to the leafset at the given
+// height that fetches the given spans.
+func (b *blockManager) newMwebSyncProgress(height uint32,
+	spans []leafSpan) *mwebSyncProgress {
+
+	p := &mwebSyncProgress{
+		blockMgr:  b,
+		progress:  MwebSyncProgress{Height: height},
+		estimator: newMwebRateEstimator(time.Now()),
+	}
+	for _, span := range spans {
+		p.progress.Total += uint64(span.count)
+	}
+	return p
+}
+
+// batchDone records the completion of a batch of the given number of leaves
+// and fires the progress callbacks.
+func (p *mwebSyncProgress) batchDone(leaves uint64) {
+	p.estimator.update(leaves, time.Now())
+
+	p.progress.Fetched += leaves
+	if p.progress.Fetched > p.progress.Total {
+		p.progress.Fetched = p.progress.Total
+	}
+	p.progress.Rate = p.estimator.rate
+	p.progress.ETA = p.estimator.eta(
+		p.progress.Total - p.progress.Fetched,
+	)
+
+	b := p.blockMgr
+	b.mwebProgressCallbacksMtx.Lock()
+	callbacks := slices.Clone(b.mwebProgressCallbacks)
+	b.mwebProgressCallbacksMtx.Unlock()
+
+	for _, cb := range callbacks {
+		cb(p.progress)
+	}
+}
@@ -0,0 +1,129 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebRateEstimator tests that the ETA estimated from synthetic batch
+// completions converges on the true time remaining, both at a steady rate
+// and once the rate changes.
+func TestMwebRateEstimator(t *testing.T) {
+	t.Parallel()
+
+	const total = 100000
+	now := time.Unix(1700000000, 0)
+	e := newMwebRateEstimator(now)
+	require.Zero(t, e.eta(total))
+
+	// Batches of 1000 leaves every 10 seconds give 100 leaves a second.
+	var fetched uint64
+	complete := func(leaves uint64, elapsed time.Duration) {
+		now = now.Add(elapsed)
+		fetched += leaves
+		e.update(leaves, now)
+	}
+	complete(1000, 10*time.Second)
+	require.InDelta(t, 100, e.rate, 0.001)
+	require.Equal(t, 990*time.Second, e.eta(total-fetched))
+
+	// Noisy batches average out around the true rate.
+	for i := 0; i < 20; i++ {
+		elapsed := 8 * time.Second
+		if i%2 == 1 {
+			elapsed = 12 * time.Second
+		}
+		complete(1000, elapsed)
+	}
+	require.InDelta(t, 100, e.rate, 10)
+
+	// Once the peers slow down to half the rate, the ETA converges on
+	// twice what it was, rather than jumping there on a single batch.
+	remaining := func() time.Duration {
+		return time.Duration(total-fetched) * time.Second / 50
+	}
+	complete(1000, 20*time.Second)
+	require.Less(t, e.eta(total-fetched), remaining()*3/4)
+	for i := 0; i < 30; i++ {
+		complete(1000, 20*time.Second)
+	}
+	require.InDelta(t, 50, e.rate, 0.1)
+	require.InEpsilon(t, float64(remaining()),
+		float64(e.eta(total-fetched)), 0.01)
+
+	// A batch that completes in no time doesn't skew the rate.
+	rate := e.rate
+	complete(1000, 0)
+	require.Equal(t, rate, e.rate)
+}
+
+// TestMwebSyncProgress tests that the progress callbacks fire as each batch
+// of an mweb utxos sync completes, until all the leaves are fetched.
+func TestMwebSyncProgress(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	// With every fourth leaf already stored, there are 75 leaves to
+	// fetch in three batches.
+	mmr := newTestMwebMmr(100)
+	var missing []uint64
+	for i := uint64(0); i < 100; i++ {
+		if i%4 != 0 {
+			missing = append(missing, i)
+		}
+	}
+	coinDB.leafset = mmr.leafset(missing...)
+	leafset := mmr.leafset()
+	leafset.Height = 7
+
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	var events []MwebSyncProgress
+	bm.RegisterMwebSyncProgressCallback(func(p MwebSyncProgress) {
+		events = append(events, p)
+	})
+
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	require.Len(t, events, 3)
+	var fetched uint64
+	for _, p := range events {
+		require.Equal(t, uint32(7), p.Height)
+		require.Equal(t, uint64(75), p.Total)
+		require.Greater(t, p.Fetched, fetched)
+		fetched = p.Fetched
+	}
+	require.Equal(t, []uint64{30, 60, 75}, []uint64{
+		events[0].Fetched, events[1].Fetched, events[2].Fetched,
+	})
+	require.Zero(t, events[2].ETA)
+}
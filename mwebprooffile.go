@@ -0,0 +1,187 @@
+package neutrino
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// ErrMwebProofFile is returned when an mweb proof file is malformed, or its
+// parts aren't for the same block.
+var ErrMwebProofFile = errors.New("mweb proof file is bad")
+
+// mwebProofFileMagic begins every mweb proof file.
+var mwebProofFileMagic = [4]byte{'m', 'w', 'p', 'f'}
+
+// mwebProofFileVersion is the version of the mweb proof file format.
+const mwebProofFileVersion = 1
+
+// MwebProofFile is an inclusion proof of mweb utxos in the output MMR of a
+// block, as handed from one wallet to another. It is encoded as:
+//
+//   - the 4 bytes "mwpf"
+//   - the format version, a single byte, currently 1
+//   - the mwebheader message of the block, whose merkle block carries the
+//     block header that the proof refers to
+//   - the mwebleafset message of the block
+//   - the mwebutxos message of the utxos, with their proof hashes
+//
+// Each message is encoded as its payload on the wire at the mweb light
+// client protocol version, without a message header.
+type MwebProofFile struct {
+	// MwebHeader is the mweb header of the block, along with the proof
+	// that the block commits to it.
+	MwebHeader *wire.MsgMwebHeader
+
+	// Leafset is the leafset of the block.
+	Leafset *wire.MsgMwebLeafset
+
+	// Utxos are the mweb utxos proven, along with their proof hashes.
+	Utxos *wire.MsgMwebUtxos
+}
+
+// Encode writes the mweb proof file to w.
+func (f *MwebProofFile) Encode(w io.Writer) error {
+	if _, err := w.Write(mwebProofFileMagic[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{mwebProofFileVersion}); err != nil {
+		return err
+	}
+
+	msgs := []wire.Message{f.MwebHeader, f.Leafset, f.Utxos}
+	for _, msg := range msgs {
+		err := msg.BtcEncode(
+			w, wire.MwebLightClientVersion, wire.LatestEncoding,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeMwebProofFile reads an mweb proof file from r, which must hold
+// nothing after it. The proof isn't verified.
+func DecodeMwebProofFile(r io.Reader) (*MwebProofFile, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMwebProofFile, err)
+	}
+	if !bytes.Equal(prefix[:4], mwebProofFileMagic[:]) {
+		return nil, fmt.Errorf("%w: bad magic %x", ErrMwebProofFile,
+			prefix[:4])
+	}
+	if prefix[4] != mwebProofFileVersion {
+		return nil, fmt.Errorf("%w: unknown version %v",
+			ErrMwebProofFile, prefix[4])
+	}
+
+	f := &MwebProofFile{
+		MwebHeader: &wire.MsgMwebHeader{},
+		Leafset:    &wire.MsgMwebLeafset{},
+		Utxos:      &wire.MsgMwebUtxos{},
+	}
+	msgs := []wire.Message{f.MwebHeader, f.Leafset, f.Utxos}
+	for _, msg := range msgs {
+		err := msg.BtcDecode(
+			r, wire.MwebLightClientVersion, wire.LatestEncoding,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v: %v", ErrMwebProofFile,
+				msg.Command(), err)
+		}
+	}
+
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrMwebProofFile)
+	}
+	return f, nil
+}
+
+// MwebProofResult is the result of verifying an mweb proof file.
+type MwebProofResult struct {
+	// BlockHash is the hash of the block that the utxos were proven
+	// unspent in the output MMR of.
+	BlockHash chainhash.Hash
+
+	// Height is the height of the block in our chain.
+	Height uint32
+
+	// MwebHeader is the mweb header of the block.
+	MwebHeader *wire.MwebHeader
+
+	// Utxos are the mweb utxos proven.
+	Utxos []*wire.MwebNetUtxo
+}
+
+// verifyMwebProofFile decodes the mweb proof file from r and verifies it
+// against the block header in our chain that it refers to. The mweb header
+// must be committed to by the block, the leafset must match its leafset
+// root, and the utxos must be unspent in the leafset and, together with
+// their proof hashes, hash to its output root.
+func (b *blockManager) verifyMwebProofFile(
+	r io.Reader) (*MwebProofResult, error) {
+
+	f, err := DecodeMwebProofFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	blockHash := f.MwebHeader.Merkle.Header.BlockHash()
+	header, height, err := b.cfg.BlockHeaders.FetchHeader(&blockHash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find block %v of mweb "+
+			"proof file: %w", blockHash, err)
+	}
+	if f.Leafset.BlockHash != blockHash ||
+		f.Utxos.BlockHash != blockHash {
+
+		return nil, fmt.Errorf("%w: leafset for block %v and utxos "+
+			"for block %v, expected %v", ErrMwebProofFile,
+			f.Leafset.BlockHash, f.Utxos.BlockHash, blockHash)
+	}
+	if len(f.Utxos.Utxos) == 0 {
+		return nil, fmt.Errorf("%w: no utxos", ErrMwebProofFile)
+	}
+
+	// The block hash was taken from the mweb header itself, so this
+	// only checks that the block commits to the mweb header.
+	err = verifyMwebHeaderDetailed(&blockHash, f.MwebHeader)
+	if err != nil {
+		return nil, err
+	}
+	mwebHeader := &f.MwebHeader.MwebHeader
+	if err := verifyMwebLeafsetDetailed(mwebHeader, f.Leafset); err != nil {
+		return nil, err
+	}
+	_, err = NewMwebLeafset(f.Leafset.Leafset, mwebHeader.OutputMMRSize)
+	if err != nil {
+		return nil, err
+	}
+
+	leafset := &mweb.Leafset{
+		Bits:   f.Leafset.Leafset,
+		Size:   mwebHeader.OutputMMRSize,
+		Height: height,
+		Block:  header,
+	}
+	err = verifyMwebUtxosDetailed(
+		b.cfg.MwebRootVariants, mwebHeader, leafset, f.Utxos,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MwebProofResult{
+		BlockHash:  blockHash,
+		Height:     height,
+		MwebHeader: mwebHeader,
+		Utxos:      f.Utxos.Utxos,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package neutrino
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVerifyMwebProofFile tests that an mweb proof file round trips through
+// its encoding and verifies against the block in our chain that it refers
+// to, and that tampering with any part of it fails verification.
+func TestVerifyMwebProofFile(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+
+	// The output ids of the MMR are the hashes of real outputs, so that
+	// they survive the outputs being encoded.
+	mmr := newTestMwebMmr(10)
+	newOutput := func(leafIdx uint64, tag byte) *wire.MwebOutput {
+		return &wire.MwebOutput{
+			RangeProofHash: chainhash.Hash{byte(leafIdx), tag},
+		}
+	}
+	for i := range mmr.outputIds {
+		mmr.outputIds[i] = *newOutput(uint64(i), 0).Hash()
+	}
+	leafset := mmr.leafset(5)
+	leafset.Height = 1
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, genesis.BlockHash(), wire.MwebHeader{
+			Height:        1,
+			OutputRoot:    mmr.root(),
+			OutputMMRSize: leafset.Size,
+		}, leafset.Bits,
+	)
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+	blockHash := header.BlockHash()
+
+	// The proof is for the utxos of leaves 3, 4 and 6.
+	newProofFile := func() *MwebProofFile {
+		utxos := mmr.proveUtxos(leafset, wire.NewMsgGetMwebUtxos(
+			blockHash, 3, 3, wire.MwebNetUtxoCompact,
+		))
+		for _, utxo := range utxos.Utxos {
+			utxo.Output = newOutput(utxo.LeafIndex, 0)
+		}
+		return &MwebProofFile{
+			MwebHeader: mwebHeader,
+			Leafset:    mwebLeafset,
+			Utxos:      utxos,
+		}
+	}
+	encode := func(f *MwebProofFile) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, f.Encode(&buf))
+		return buf.Bytes()
+	}
+	verify := func(b []byte) (*MwebProofResult, error) {
+		return bm.verifyMwebProofFile(bytes.NewReader(b))
+	}
+
+	valid := encode(newProofFile())
+	require.Equal(t, []byte("mwpf\x01"), valid[:5])
+
+	f, err := DecodeMwebProofFile(bytes.NewReader(valid))
+	require.NoError(t, err)
+	require.Equal(t, valid, encode(f))
+
+	result, err := verify(valid)
+	require.NoError(t, err)
+	require.Equal(t, blockHash, result.BlockHash)
+	require.Equal(t, uint32(1), result.Height)
+	require.Equal(t, mwebHeader.MwebHeader, *result.MwebHeader)
+	require.Len(t, result.Utxos, 3)
+	for i, leaf := range []uint64{3, 4, 6} {
+		require.Equal(t, leaf, result.Utxos[i].LeafIndex)
+		require.Equal(t, mmr.outputIds[leaf], *result.Utxos[i].OutputId)
+	}
+
+	// A tampered utxo or proof hash doesn't hash to the output root.
+	tampered := newProofFile()
+	tampered.Utxos.Utxos[1].Output = newOutput(4, 1)
+	_, err = verify(encode(tampered))
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	tampered = newProofFile()
+	require.NotEmpty(t, tampered.Utxos.ProofHashes)
+	tampered.Utxos.ProofHashes[0] = &chainhash.Hash{0x01}
+	_, err = verify(encode(tampered))
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	// A leafset with a spent leaf marked unspent doesn't match the
+	// leafset root.
+	tampered = newProofFile()
+	tampered.Leafset = &wire.MsgMwebLeafset{
+		BlockHash: blockHash,
+		Leafset:   mmr.leafset().Bits,
+	}
+	_, err = verify(encode(tampered))
+	require.ErrorIs(t, err, ErrMwebLeafsetRoot)
+
+	// An mweb header that the block doesn't commit to fails.
+	tampered = newProofFile()
+	badHeader := *mwebHeader
+	badHeader.MwebHeader.OutputMMRSize++
+	tampered.MwebHeader = &badHeader
+	_, err = verify(encode(tampered))
+	require.ErrorIs(t, err, ErrMwebHogAddrMismatch)
+
+	// The parts of the file must all be for the same block.
+	tampered = newProofFile()
+	tampered.Utxos.BlockHash = chainhash.Hash{0x01}
+	_, err = verify(encode(tampered))
+	require.ErrorIs(t, err, ErrMwebProofFile)
+
+	// A proof for a block that isn't in our chain can't be trusted.
+	otherHeader, otherMwebHeader, _ := newTestMwebHeader(
+		t, blockHash, wire.MwebHeader{Height: 2}, leafset.Bits,
+	)
+	tampered = newProofFile()
+	tampered.MwebHeader = otherMwebHeader
+	tampered.Leafset = &wire.MsgMwebLeafset{
+		BlockHash: otherHeader.BlockHash(),
+		Leafset:   leafset.Bits,
+	}
+	tampered.Utxos.BlockHash = otherHeader.BlockHash()
+	_, err = verify(encode(tampered))
+	require.Error(t, err)
+
+	// Malformed files are rejected before anything is verified.
+	for _, b := range [][]byte{
+		nil,
+		append([]byte("mwpx"), valid[4:]...),
+		append([]byte("mwpf\x02"), valid[5:]...),
+		valid[:len(valid)-1],
+		append(append([]byte(nil), valid...), 0x00),
+	} {
+		_, err = verify(b)
+		require.ErrorIs(t, err, ErrMwebProofFile)
+	}
+}
@@ -0,0 +1,136 @@
+package neutrino
+
+import (
+	"errors"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+// ErrMwebProofsDisabled is returned by VerifyStoredMwebCoins when the proofs
+// of the mweb coins aren't being stored.
+var ErrMwebProofsDisabled = errors.New("mweb utxos proofs are not stored")
+
+// MwebCoinsAudit is the result of verifying the stored mweb coins against
+// their stored proofs.
+type MwebCoinsAudit struct {
+	// Verified is the number of proofs that the stored coins verified
+	// against.
+	Verified int
+
+	// Skipped is the number of proofs that couldn't be checked, as some
+	// of their coins have since been spent and purged.
+	Skipped int
+
+	// Failed holds the start indices of the proofs that the stored coins
+	// failed to verify against.
+	Failed []uint64
+}
+
+// mwebCoinMarker is implemented by mweb coins dbs that mark the coins that
+// have been verified, as the CoinStore does.
+type mwebCoinMarker interface {
+	// FetchLeavesUnchecked fetches the coins of the leaves whether or
+	// not they're marked verified.
+	FetchLeavesUnchecked([]uint64) ([]*wire.MwebNetUtxo, error)
+
+	// MarkCoinsVerified marks the coins of the leaves verified.
+	MarkCoinsVerified([]uint64) error
+}
+
+// newMwebUtxosProof returns the proof of the verified mweb utxos for storing
+// alongside the coins.
+func newMwebUtxosProof(mwebHeader *wire.MwebHeader,
+	mwebUtxos *wire.MsgMwebUtxos) *mwebdb.UtxosProof {
+
+	proof := &mwebdb.UtxosProof{
+		OutputRoot:    mwebHeader.OutputRoot,
+		OutputMMRSize: mwebHeader.OutputMMRSize,
+		StartIndex:    mwebUtxos.StartIndex,
+		ProofHashes:   mwebUtxos.ProofHashes,
+	}
+	if len(mwebUtxos.Utxos) == 0 {
+		return proof
+	}
+
+	lastIndex := mwebUtxos.Utxos[len(mwebUtxos.Utxos)-1].LeafIndex
+	proof.Leaves = make([]byte, (lastIndex-mwebUtxos.StartIndex)/8+1)
+	for _, utxo := range mwebUtxos.Utxos {
+		i := utxo.LeafIndex - mwebUtxos.StartIndex
+		proof.Leaves[i/8] |= 0x80 >> (i % 8)
+	}
+	return proof
+}
+
+// verifyStoredMwebCoins verifies the stored mweb coins against each of the
+// stored proofs. The proofs don't carry the leafsets they were verified
+// with, but only the leaves within the span of a proof bear on it, and
+// those are recorded in the proof. If the coins db marks verified coins,
+// the coins are checked whether or not they're marked, and marked if they
+// verify.
+func verifyStoredMwebCoins(coinDB mwebdb.CoinDatabase,
+	proofs *mwebdb.ProofStore) (*MwebCoinsAudit, error) {
+
+	fetchLeaves := coinDB.FetchLeaves
+	marker, canMark := coinDB.(mwebCoinMarker)
+	if canMark {
+		fetchLeaves = marker.FetchLeavesUnchecked
+	}
+
+	audit := &MwebCoinsAudit{}
+	leafset := &mweb.Leafset{}
+	err := proofs.ForEachProof(func(proof *mwebdb.UtxosProof) error {
+		leaves := proof.LeafIndices()
+		coins, err := fetchLeaves(leaves)
+		if err != nil {
+			return err
+		}
+		if len(leaves) == 0 || len(coins) != len(leaves) {
+			audit.Skipped++
+			return nil
+		}
+
+		if leafset.Size != proof.OutputMMRSize {
+			leafset.Size = proof.OutputMMRSize
+			leafset.Bits = make([]byte, (leafset.Size+7)/8)
+		}
+		for _, leaf := range leaves {
+			if leaf < leafset.Size {
+				leafset.Bits[leaf/8] |= 0x80 >> (leaf % 8)
+			}
+		}
+
+		mwebHeader := &wire.MwebHeader{
+			OutputRoot:    proof.OutputRoot,
+			OutputMMRSize: proof.OutputMMRSize,
+		}
+		mwebUtxos := &wire.MsgMwebUtxos{
+			StartIndex:  proof.StartIndex,
+			Utxos:       coins,
+			ProofHashes: proof.ProofHashes,
+		}
+		verified := verifyMwebUtxosProof(mwebHeader, leafset, mwebUtxos)
+		if verified {
+			audit.Verified++
+		} else {
+			audit.Failed = append(audit.Failed, proof.StartIndex)
+		}
+
+		for _, leaf := range leaves {
+			if leaf < leafset.Size {
+				leafset.Bits[leaf/8] = 0
+			}
+		}
+
+		if verified && canMark {
+			return marker.MarkCoinsVerified(leaves)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return audit, nil
+}
@@ -0,0 +1,107 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVerifyStoredMwebCoins tests that the proofs stored while fetching mweb
+// utxos let the stored coins be verified again without the network.
+func TestVerifyStoredMwebCoins(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/proofs.db", true, time.Second*10,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	proofStore, err := mwebdb.NewProofStore(db, 100)
+	require.NoError(t, err)
+	bm.cfg.MwebProofs = proofStore
+
+	// Every seventh leaf is spent, and the utxos are fetched in spans of
+	// 64 so that there are several proofs.
+	mmr := newTestMwebMmr(200)
+	var all, spent []uint64
+	for i := uint64(0); i < 200; i++ {
+		all = append(all, i)
+		if i%7 == 3 {
+			spent = append(spent, i)
+		}
+	}
+	coinDB.leafset = mmr.leafset(all...)
+	leafset := mmr.leafset(spent...)
+	for i := 0; i < 4; i++ {
+		bm.mwebBatchSizer.record("peer", 0, mwebSlowResponse, nil)
+	}
+
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+	require.Len(t, coinDB.coins, 200-len(spent))
+
+	var starts []uint64
+	err = proofStore.ForEachProof(func(p *mwebdb.UtxosProof) error {
+		starts = append(starts, p.StartIndex)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, starts, 3)
+
+	// Without a chain service to reach the network, the stored coins
+	// verify against the stored proofs.
+	s := &ChainService{MwebCoinDB: coinDB, mwebProofs: proofStore}
+	audit, err := s.VerifyStoredMwebCoins()
+	require.NoError(t, err)
+	require.Equal(t, &MwebCoinsAudit{Verified: 3}, audit)
+
+	// A stored coin that was tampered with fails its proof, while a
+	// proof whose coins were purged is skipped.
+	coinDB.coins[11].OutputId = &chainhash.Hash{0x01}
+	delete(coinDB.coins, 151)
+	audit, err = s.VerifyStoredMwebCoins()
+	require.NoError(t, err)
+	require.Equal(t, &MwebCoinsAudit{
+		Verified: 1,
+		Skipped:  1,
+		Failed:   []uint64{starts[0]},
+	}, audit)
+
+	// Without the proofs being stored, there's nothing to verify.
+	s.mwebProofs = nil
+	_, err = s.VerifyStoredMwebCoins()
+	require.ErrorIs(t, err, ErrMwebProofsDisabled)
+}
@@ -0,0 +1,111 @@
+package neutrino
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// MwebProofEfficiency describes the mwebutxos responses verified from a
+// peer, for telling peers that construct their proofs optimally from those
+// that send more proof hashes than needed, even if they still verify.
+type MwebProofEfficiency struct {
+	// Responses is the number of responses verified.
+	Responses uint64
+
+	// UtxoBytes is the total size on the wire of the utxos delivered.
+	UtxoBytes uint64
+
+	// ProofBytes is the total size on the wire of the proof hashes
+	// delivered alongside them.
+	ProofBytes uint64
+}
+
+// Ratio returns the number of proof hash bytes delivered per utxo byte, or
+// zero if no utxos have been.
+func (e MwebProofEfficiency) Ratio() float64 {
+	if e.UtxoBytes == 0 {
+		return 0
+	}
+	return float64(e.ProofBytes) / float64(e.UtxoBytes)
+}
+
+// mwebUtxosSizes returns the size on the wire of the utxos of the mwebutxos
+// message, and of its proof hashes. The fields that the message has either
+// way, including the counts of its utxos and proof hashes, are left out.
+func mwebUtxosSizes(r *wire.MsgMwebUtxos) (uint64, uint64, error) {
+	encodedSize := func(msg *wire.MsgMwebUtxos) (uint64, error) {
+		var buf bytes.Buffer
+		err := msg.BtcEncode(
+			&buf, wire.MwebLightClientVersion, wire.LatestEncoding,
+		)
+		return uint64(buf.Len()), err
+	}
+
+	total, err := encodedSize(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	base, err := encodedSize(&wire.MsgMwebUtxos{
+		BlockHash:    r.BlockHash,
+		StartIndex:   r.StartIndex,
+		OutputFormat: r.OutputFormat,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	proofBytes := uint64(len(r.ProofHashes)) * chainhash.HashSize
+	return total - base - proofBytes, proofBytes, nil
+}
+
+// mwebProofTracker records the proof efficiency of the mwebutxos responses
+// verified from each peer. It is safe for concurrent use.
+type mwebProofTracker struct {
+	mtx   sync.Mutex
+	peers map[string]*MwebProofEfficiency
+}
+
+// newMwebProofTracker creates a tracker with no peers recorded.
+func newMwebProofTracker() *mwebProofTracker {
+	return &mwebProofTracker{
+		peers: make(map[string]*MwebProofEfficiency),
+	}
+}
+
+// record adds a verified mwebutxos response served by the peer to its
+// tally.
+func (t *mwebProofTracker) record(peer string, r *wire.MsgMwebUtxos) {
+	utxoBytes, proofBytes, err := mwebUtxosSizes(r)
+	if err != nil {
+		log.Debugf("Unable to size mwebutxos from peer %v: %v",
+			peer, err)
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	e, ok := t.peers[peer]
+	if !ok {
+		e = &MwebProofEfficiency{}
+		t.peers[peer] = e
+	}
+	e.Responses++
+	e.UtxoBytes += utxoBytes
+	e.ProofBytes += proofBytes
+}
+
+// snapshot returns a copy of the tallies by peer.
+func (t *mwebProofTracker) snapshot() map[string]MwebProofEfficiency {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	peers := make(map[string]MwebProofEfficiency, len(t.peers))
+	for peer, e := range t.peers {
+		peers[peer] = *e
+	}
+	return peers
+}
@@ -0,0 +1,78 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebProofEfficiency tests that the proof efficiency of each peer is
+// tallied from the mwebutxos responses verified from it. Both peers serve
+// the same utxos with valid proofs, but one serves them a leaf at a time,
+// needing a full set of proof hashes for each, and so has the worse ratio.
+func TestMwebProofEfficiency(t *testing.T) {
+	t.Parallel()
+
+	const numLeaves = 64
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+	require.Nil(t, bm.mwebProofTracker)
+
+	bm.mwebProofTracker = newMwebProofTracker()
+
+	mmr := newTestMwebMmr(numLeaves)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset()
+	go func() {
+		for range q.utxosChan {
+		}
+	}()
+
+	handle := func(peer string, start uint64, count uint16) bool {
+		req := wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, start, count, wire.MwebNetUtxoCompact,
+		)
+		resp := mmr.proveUtxos(q.leafset, req)
+		return q.handleResponse(req, resp, peer).Finished
+	}
+
+	require.True(t, handle("efficient", 0, numLeaves))
+	for i := uint64(0); i < numLeaves; i++ {
+		require.True(t, handle("bloated", i, 1))
+	}
+
+	// A response failing verification isn't tallied.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 8, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(q.leafset, req)
+	resp.Utxos[0].OutputId = &chainhash.Hash{}
+	require.False(t, q.handleResponse(req, resp, "efficient").Finished)
+
+	peers := bm.mwebProofTracker.snapshot()
+	require.Len(t, peers, 2)
+
+	efficient, bloated := peers["efficient"], peers["bloated"]
+	require.Equal(t, uint64(1), efficient.Responses)
+	require.Equal(t, uint64(numLeaves), bloated.Responses)
+	require.NotZero(t, efficient.UtxoBytes)
+	require.Equal(t, efficient.UtxoBytes, bloated.UtxoBytes)
+
+	// A single span covering the whole MMR needs no proof hashes at all,
+	// while each leaf on its own needs one for every level above it.
+	require.Zero(t, efficient.ProofBytes)
+	require.Zero(t, efficient.Ratio())
+	require.Equal(t, uint64(numLeaves*6*chainhash.HashSize),
+		bloated.ProofBytes)
+	require.Greater(t, bloated.Ratio(), efficient.Ratio())
+
+	// The snapshot is a copy.
+	efficient.Responses = 100
+	peers["efficient"] = efficient
+	snapshot := bm.mwebProofTracker.snapshot()
+	require.Equal(t, uint64(1), snapshot["efficient"].Responses)
+}
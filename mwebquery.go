@@ -0,0 +1,164 @@
+package neutrino
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+)
+
+// mwebRequestBuilder constructs the query.Requests of an mweb query along
+// with the options that they're dispatched with, so that every kind of
+// mweb message is sent to our peers the same way.
+type mwebRequestBuilder struct {
+	// handleResp is the response handler of every request.
+	handleResp func(req, resp wire.Message, peer string) query.Progress
+
+	// preferPeer, if set, returns the peers that the given message is
+	// preferably sent to, or nil if it has no preference.
+	preferPeer func(msg wire.Message) func(peer string) bool
+
+	// allowPeer, if set, reports the peers that the requests are kept to
+	// while any of them are connected.
+	allowPeer func(peer string) bool
+
+	// selectPeers, if set, returns the function that selects the peers
+	// that the given message is sent to, in the order to try them.
+	selectPeers func(msg wire.Message) func(peers []string) []string
+
+	// peerGroup, if set, returns the network group of a peer, across
+	// which the requests are spread.
+	peerGroup func(peer string) string
+
+	// onResult, if set, is told how each attempt at sending the given
+	// message to a peer went.
+	onResult func(msg wire.Message, peer string, elapsed time.Duration,
+		err error)
+
+	// timeout is the total time that each request may be retried for.
+	// If zero, the work manager's default is used.
+	timeout time.Duration
+
+	// noRetryMax is whether each request is retried until it succeeds
+	// or is cancelled, rather than failing after a few retries.
+	noRetryMax bool
+
+	// cancel, if set, cancels the requests once closed.
+	cancel chan struct{}
+
+	// fanOut is the number of peers that each message is sent to at
+	// once. If more than one, the others are cancelled once one of them
+	// finishes the request.
+	fanOut int
+}
+
+// request constructs the query.Request for a single message.
+func (m *mwebRequestBuilder) request(msg wire.Message) *query.Request {
+	req := &query.Request{
+		Req:        msg,
+		HandleResp: m.handleResp,
+	}
+	if m.preferPeer != nil {
+		req.PreferPeer = m.preferPeer(msg)
+	}
+	req.AllowPeer = m.allowPeer
+	req.PeerGroup = m.peerGroup
+	if m.selectPeers != nil {
+		req.SelectPeers = m.selectPeers(msg)
+	}
+	if m.onResult != nil {
+		req.OnResult = func(peer string, elapsed time.Duration,
+			err error) {
+
+			m.onResult(msg, peer, elapsed, err)
+		}
+	}
+	return req
+}
+
+// requests constructs the query.Requests for a single message, one for each
+// peer that it's sent to at once. The requests share a cancel channel that
+// the first of them to be finished closes, cancelling the rest.
+func (m *mwebRequestBuilder) requests(msg wire.Message) []*query.Request {
+	if m.fanOut <= 1 {
+		return []*query.Request{m.request(msg)}
+	}
+
+	var (
+		cancel = make(chan struct{})
+		once   sync.Once
+	)
+	finished := func(progress query.Progress) {
+		if progress.Finished {
+			once.Do(func() {
+				close(cancel)
+			})
+		}
+	}
+	handleResp := func(req, resp wire.Message,
+		peer string) query.Progress {
+
+		progress := m.handleResp(req, resp, peer)
+		if progress.Pending == nil {
+			finished(progress)
+			return progress
+		}
+
+		// A response still being handled finishes the request once
+		// its progress is delivered.
+		pending := make(chan query.Progress, 1)
+		go func() {
+			select {
+			case progress := <-progress.Pending:
+				finished(progress)
+				pending <- progress
+			case <-cancel:
+
+			// The requests are given up along with the query.
+			case <-m.cancel:
+				once.Do(func() {
+					close(cancel)
+				})
+			}
+		}()
+		return query.Progress{Pending: pending}
+	}
+
+	reqs := make([]*query.Request, m.fanOut)
+	for idx := range reqs {
+		reqs[idx] = m.request(msg)
+		reqs[idx].HandleResp = handleResp
+		reqs[idx].Cancel = cancel
+	}
+	return reqs
+}
+
+// options returns the query options that the requests are to be dispatched
+// with.
+func (m *mwebRequestBuilder) options() []query.QueryOption {
+	var opts []query.QueryOption
+	if m.timeout > 0 {
+		opts = append(opts, query.Timeout(m.timeout))
+	}
+	if m.noRetryMax {
+		opts = append(opts, query.NoRetryMax())
+	}
+	if m.cancel != nil {
+		opts = append(opts, query.Cancel(m.cancel))
+	}
+	return opts
+}
+
+// mwebRequests constructs the query.Requests for the messages with the
+// given builder, in the same order. Each message has as many requests as
+// the builder fans it out to.
+func mwebRequests[M wire.Message](m *mwebRequestBuilder,
+	msgs []M) []*query.Request {
+
+	reqs := make([]*query.Request, 0, len(msgs))
+	for _, msg := range msgs {
+		reqs = append(reqs, m.requests(msg)...)
+	}
+	return reqs
+}
@@ -0,0 +1,341 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebRequestBuilder tests that the requests constructed by the builder
+// carry its response handler and peer preference, and that each configured
+// option is dispatched with them.
+func TestMwebRequestBuilder(t *testing.T) {
+	t.Parallel()
+
+	var handled []wire.Message
+	builder := &mwebRequestBuilder{
+		handleResp: func(req, _ wire.Message, _ string) query.Progress {
+			handled = append(handled, req)
+			return query.Progress{Finished: true}
+		},
+		preferPeer: func(msg wire.Message) func(string) bool {
+			if msg.(*wire.MsgGetMwebUtxos).StartIndex >= 100 {
+				return nil
+			}
+			return func(peer string) bool {
+				return peer == "archival"
+			}
+		},
+	}
+
+	msgs := []*wire.MsgGetMwebUtxos{
+		wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, 0, 10, wire.MwebNetUtxoCompact,
+		),
+		wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, 100, 10, wire.MwebNetUtxoCompact,
+		),
+	}
+	reqs := mwebRequests(builder, msgs)
+	require.Len(t, reqs, len(msgs))
+	for i, req := range reqs {
+		require.Same(t, msgs[i], req.Req)
+		progress := req.HandleResp(req.Req, nil, "peer")
+		require.True(t, progress.Finished)
+	}
+	require.Equal(t, []wire.Message{msgs[0], msgs[1]}, handled)
+
+	require.NotNil(t, reqs[0].PreferPeer)
+	require.True(t, reqs[0].PreferPeer("archival"))
+	require.False(t, reqs[0].PreferPeer("pruned"))
+	require.Nil(t, reqs[1].PreferPeer)
+
+	// Without any options configured, the work manager's defaults are
+	// used.
+	require.Empty(t, builder.options())
+
+	builder.timeout = time.Minute
+	require.Len(t, builder.options(), 1)
+	builder.noRetryMax = true
+	require.Len(t, builder.options(), 2)
+	builder.cancel = make(chan struct{})
+	require.Len(t, builder.options(), 3)
+
+	// A builder without a peer preference leaves it unset.
+	builder.preferPeer = nil
+	require.Nil(t, builder.request(msgs[0]).PreferPeer)
+}
+
+// TestMwebUtxosRequestBuilder tests that the requests of an mweb utxos query
+// prefer archival peers only for leaves deep below the chain tip, otherwise
+// preferring the peers whose batch size they fit, and are cancelled with the
+// query.
+func TestMwebUtxosRequestBuilder(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, []uint64{0, 50, 100}, 100)
+	q.archivalLeafIndex = 60
+
+	cancel := make(chan struct{})
+	builder := q.requestBuilder(cancel)
+	require.Equal(t, cancel, builder.cancel)
+	require.Len(t, builder.options(), 1)
+
+	// Shrink the batch size of a slow peer below the size of the
+	// messages.
+	for i := 0; i < 5; i++ {
+		bm.mwebBatchSizer.record("slow", 100, mwebSlowResponse, nil)
+	}
+
+	// Without archival peers configured, only the batch sizes count.
+	for _, req := range mwebRequests(builder, q.msgs) {
+		require.True(t, req.PreferPeer("fast"))
+		require.False(t, req.PreferPeer("slow"))
+	}
+
+	bm.cfg.MwebArchivalPeer = func(addr string) bool {
+		return addr == "archival"
+	}
+	reqs := mwebRequests(builder, q.msgs)
+	require.True(t, reqs[0].PreferPeer("archival"))
+	require.False(t, reqs[0].PreferPeer("fast"))
+	require.True(t, reqs[1].PreferPeer("archival"))
+	require.True(t, reqs[2].PreferPeer("fast"))
+	require.False(t, reqs[2].PreferPeer("slow"))
+}
+
+// answeringPeer is a query.Peer that answers each message sent to it with
+// the given function.
+type answeringPeer struct {
+	addr   string
+	answer func(msg wire.Message) wire.Message
+	recv   chan wire.Message
+}
+
+var _ query.Peer = (*answeringPeer)(nil)
+
+func (p *answeringPeer) QueueMessageWithEncoding(msg wire.Message,
+	_ chan<- struct{}, _ wire.MessageEncoding) {
+
+	go func() {
+		p.recv <- p.answer(msg)
+	}()
+}
+
+func (p *answeringPeer) SubscribeRecvMsg() (<-chan wire.Message, func()) {
+	return p.recv, func() {}
+}
+
+func (p *answeringPeer) Addr() string {
+	return p.addr
+}
+
+func (p *answeringPeer) OnDisconnect() <-chan struct{} {
+	return make(chan struct{})
+}
+
+// TestMwebFanOut tests that with a fan-out of two, each span is requested
+// from two peers at once, and that the slower peer's request is cancelled
+// once the faster one answers with verified utxos, whether they're verified
+// by the query worker or on the verify pool.
+func TestMwebFanOut(t *testing.T) {
+	t.Parallel()
+
+	t.Run("query worker", func(t *testing.T) {
+		testMwebFanOut(t, 0)
+	})
+	t.Run("verify pool", func(t *testing.T) {
+		testMwebFanOut(t, 2)
+	})
+}
+
+// testMwebFanOut runs TestMwebFanOut with a verify pool of the given size,
+// if any.
+func testMwebFanOut(t *testing.T, verifyWorkers int) {
+	t.Parallel()
+
+	bm, coinDB, q := setupMwebUtxosQuery(t, []uint64{0}, 10)
+	bm.cfg.MwebFanOut = 2
+	if verifyWorkers > 0 {
+		quit := make(chan struct{})
+		var wg sync.WaitGroup
+		bm.mwebVerifyPool = newMwebVerifyPool(verifyWorkers, quit, &wg)
+		t.Cleanup(func() {
+			close(quit)
+			wg.Wait()
+		})
+	}
+
+	mmr := newTestMwebMmr(10)
+	q.leafset = mmr.leafset()
+	q.mwebHeader = &wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: q.leafset.Size,
+	}
+
+	// The fast peer only answers once the slow peer, which never does,
+	// has been sent the span too.
+	slow := &silentPeer{sent: make(chan wire.Message, 1)}
+	fast := &answeringPeer{
+		addr: "fast",
+		answer: func(msg wire.Message) wire.Message {
+			<-slow.sent
+			return mmr.proveUtxos(
+				q.leafset, msg.(*wire.MsgGetMwebUtxos),
+			)
+		},
+		recv: make(chan wire.Message, 1),
+	}
+	peers := make(chan query.Peer, 2)
+	peers <- fast
+	peers <- slow
+
+	wm := query.NewWorkManager(&query.Config{
+		ConnectedPeers: func() (<-chan query.Peer, func(), error) {
+			return peers, func() {}, nil
+		},
+		NewWorker: query.NewWorker,
+		Ranking:   query.NewPeerRanking(),
+	})
+	require.NoError(t, wm.Start())
+	t.Cleanup(func() {
+		require.NoError(t, wm.Stop())
+	})
+
+	// The query is dispatched without the option cancelling it as a
+	// whole, so that it only finishes if the slow peer's request is
+	// cancelled on its own.
+	result := make(chan error, 1)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			require.Len(t, requests, 2)
+			errChan := wm.Query(requests)
+			forward := make(chan error, 1)
+			go func() {
+				err := <-errChan
+				result <- err
+				forward <- err
+			}()
+			return forward
+		},
+	}
+
+	count, err := bm.getMwebUtxosBatch(q)
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+	require.Len(t, coinDB.coins, 10)
+
+	select {
+	case err := <-result:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow peer's request wasn't cancelled")
+	}
+}
+
+// TestMwebUtxosNotFound tests that a request for mweb utxos declined by a
+// peer with a notfound is given to another peer at once, rather than once
+// it times out, and that the peer is no longer preferred.
+func TestMwebUtxosNotFound(t *testing.T) {
+	t.Parallel()
+
+	bm, coinDB, q := setupMwebUtxosQuery(t, []uint64{0}, 10)
+
+	mmr := newTestMwebMmr(10)
+	q.leafset = mmr.leafset()
+	q.mwebHeader = mmr.mwebHeader()
+
+	// The pruned peer is the only one connected until it has declined
+	// the span.
+	peers := make(chan query.Peer, 2)
+	full := &answeringPeer{
+		addr: "full",
+		answer: func(msg wire.Message) wire.Message {
+			return mmr.proveUtxos(
+				q.leafset, msg.(*wire.MsgGetMwebUtxos),
+			)
+		},
+		recv: make(chan wire.Message, 1),
+	}
+	var connectFull sync.Once
+	pruned := &answeringPeer{
+		addr: "pruned",
+		answer: func(msg wire.Message) wire.Message {
+			connectFull.Do(func() {
+				peers <- full
+			})
+			notFound := wire.NewMsgNotFound()
+			blockHash := msg.(*wire.MsgGetMwebUtxos).BlockHash
+			require.NoError(t, notFound.AddInvVect(
+				wire.NewInvVect(wire.InvTypeBlock, &blockHash),
+			))
+			return notFound
+		},
+		recv: make(chan wire.Message, 1),
+	}
+	peers <- pruned
+
+	wm := query.NewWorkManager(&query.Config{
+		ConnectedPeers: func() (<-chan query.Peer, func(), error) {
+			return peers, func() {}, nil
+		},
+		NewWorker: query.NewWorker,
+		Ranking:   query.NewPeerRanking(),
+	})
+	require.NoError(t, wm.Start())
+	t.Cleanup(func() {
+		require.NoError(t, wm.Stop())
+	})
+
+	// The pruned peer may be given the span again before the full peer
+	// connects, so the retries aren't capped.
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			opts ...query.QueryOption) chan error {
+
+			opts = append(opts, query.NoRetryMax())
+			return wm.Query(requests, opts...)
+		},
+	}
+
+	// The span is served well before the pruned peer's request would
+	// have timed out.
+	start := time.Now()
+	count, err := bm.getMwebUtxosBatch(q)
+	require.NoError(t, err)
+	require.Equal(t, 10, count)
+	require.Len(t, coinDB.coins, 10)
+	require.Less(t, time.Since(start), time.Second)
+
+	preferPeer := q.preferPeer(wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 10, wire.MwebNetUtxoCompact,
+	))
+	require.False(t, preferPeer("pruned"))
+	require.True(t, preferPeer("full"))
+
+	// A reject of the command declines the request too, while other
+	// messages are ignored.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 10, wire.MwebNetUtxoCompact,
+	)
+	reject := wire.NewMsgReject(
+		wire.CmdGetMwebUtxos, wire.RejectInvalid, "",
+	)
+	require.True(t, q.handleResponse(req, reject, "peer").Declined)
+
+	reject = wire.NewMsgReject(wire.CmdTx, wire.RejectInvalid, "")
+	require.False(t, q.handleResponse(req, reject, "peer").Declined)
+
+	otherBlock := wire.NewMsgNotFound()
+	require.NoError(t, otherBlock.AddInvVect(
+		wire.NewInvVect(wire.InvTypeBlock, &chainhash.Hash{0x01}),
+	))
+	require.False(t, q.handleResponse(req, otherBlock, "peer").Declined)
+}
@@ -0,0 +1,65 @@
+package neutrino
+
+import (
+	"net"
+	"sync"
+)
+
+// mwebQueryPeers holds the peers that mweb queries are pinned to by
+// SetMwebQueryPeers.
+type mwebQueryPeers struct {
+	mtx   sync.RWMutex
+	addrs map[string]struct{}
+}
+
+// set pins the mweb queries to the given peer addresses, either host:port or
+// just the host. An empty list unpins them.
+func (p *mwebQueryPeers) set(addrs []string) {
+	var pinned map[string]struct{}
+	if len(addrs) > 0 {
+		pinned = make(map[string]struct{}, len(addrs))
+		for _, addr := range addrs {
+			pinned[addr] = struct{}{}
+		}
+	}
+
+	p.mtx.Lock()
+	p.addrs = pinned
+	p.mtx.Unlock()
+}
+
+// allowPeer returns a function reporting whether a peer is pinned, by either
+// its full address or its host, or nil if no peers are pinned. The function
+// keeps to the peers pinned when it was returned, so that the requests of a
+// query all go to the same peers.
+func (p *mwebQueryPeers) allowPeer() func(peer string) bool {
+	p.mtx.RLock()
+	pinned := p.addrs
+	p.mtx.RUnlock()
+
+	if pinned == nil {
+		return nil
+	}
+
+	return func(peer string) bool {
+		if _, ok := pinned[peer]; ok {
+			return true
+		}
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			return false
+		}
+		_, ok := pinned[host]
+		return ok
+	}
+}
+
+// queryOptions returns the options that mweb queries to all peers are made
+// with, keeping them to the pinned peers.
+func (p *mwebQueryPeers) queryOptions() []QueryOption {
+	allow := p.allowPeer()
+	if allow == nil {
+		return nil
+	}
+	return []QueryOption{AllowPeers(allow)}
+}
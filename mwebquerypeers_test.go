@@ -0,0 +1,119 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/peer"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebQueryPeers tests that mweb utxos queries only go to the pinned
+// peers while any of them are connected, and to any peer otherwise.
+func TestMwebQueryPeers(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	bm.cfg.MwebCoins = newMockCoinDatabase()
+
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset(3, 7, 12)
+
+	var (
+		mtx    sync.Mutex
+		served = make(map[string]int)
+	)
+	peers := make(chan query.Peer, 3)
+	for _, addr := range []string{
+		"10.0.0.1:9333", "10.0.0.2:9333", "10.0.0.3:9333",
+	} {
+		addr := addr
+		peers <- &answeringPeer{
+			addr: addr,
+			answer: func(msg wire.Message) wire.Message {
+				mtx.Lock()
+				served[addr]++
+				mtx.Unlock()
+
+				return mmr.proveUtxos(
+					leafset, msg.(*wire.MsgGetMwebUtxos),
+				)
+			},
+			recv: make(chan wire.Message, 1),
+		}
+	}
+
+	wm := query.NewWorkManager(&query.Config{
+		ConnectedPeers: func() (<-chan query.Peer, func(), error) {
+			return peers, func() {}, nil
+		},
+		NewWorker: query.NewWorker,
+		Ranking:   query.NewPeerRanking(),
+	})
+	require.NoError(t, wm.Start())
+	t.Cleanup(func() {
+		require.NoError(t, wm.Stop())
+	})
+	bm.cfg.QueryDispatcher = wm
+
+	// Wait for all of the peers to connect, so that the pinned one is
+	// connected by the time the utxos are queried.
+	require.Eventually(t, func() bool {
+		return len(peers) == 0
+	}, time.Second, time.Millisecond)
+
+	// The peer is pinned by its host alone.
+	bm.mwebQueryPeers.set([]string{"10.0.0.2"})
+	err = bm.getMwebUtxos(mmr.mwebHeader(), leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	mtx.Lock()
+	require.Len(t, served, 1)
+	require.NotZero(t, served["10.0.0.2:9333"])
+	served = make(map[string]int)
+	mtx.Unlock()
+
+	// With none of the pinned peers connected, any peer is queried.
+	bm.cfg.MwebCoins = newMockCoinDatabase()
+	bm.mwebQueryPeers.set([]string{"10.0.0.4:9333"})
+	err = bm.getMwebUtxos(mmr.mwebHeader(), leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	mtx.Lock()
+	require.NotEmpty(t, served)
+	mtx.Unlock()
+
+	// Unpinning leaves the queries free to go anywhere.
+	bm.mwebQueryPeers.set(nil)
+	require.Nil(t, bm.mwebQueryPeers.allowPeer())
+	require.Nil(t, bm.mwebQueryPeers.queryOptions())
+}
+
+// TestMwebQueryPeersAllPeers tests that the mweb queries sent to all peers
+// only go to the pinned peers while any of them are connected.
+func TestMwebQueryPeersAllPeers(t *testing.T) {
+	t.Parallel()
+
+	var sps []*ServerPeer
+	for _, addr := range []string{"10.0.0.1:9333", "10.0.0.2:9333"} {
+		p, err := peer.NewOutboundPeer(&peer.Config{}, addr)
+		require.NoError(t, err)
+		sps = append(sps, &ServerPeer{Peer: p})
+	}
+
+	var pinned mwebQueryPeers
+	pinned.set([]string{"10.0.0.2:9333"})
+	qo := defaultQueryOptions()
+	qo.applyQueryOptions(pinned.queryOptions()...)
+	require.Equal(t, sps[1:], allowServerPeers(sps, qo.allowPeer))
+
+	pinned.set([]string{"10.0.0.4"})
+	qo = defaultQueryOptions()
+	qo.applyQueryOptions(pinned.queryOptions()...)
+	require.Equal(t, sps, allowServerPeers(sps, qo.allowPeer))
+}
@@ -0,0 +1,56 @@
+package neutrino
+
+import (
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+// mwebUnspentCoinsFetcher is implemented by mweb coins dbs that can read the
+// leafset and the coins of its unspent leaves in a single snapshot, as the
+// CoinStore does.
+type mwebUnspentCoinsFetcher interface {
+	// FetchUnspentCoins fetches the leafset along with the coins of its
+	// unspent leaves.
+	FetchUnspentCoins() (*mweb.Leafset, []*wire.MwebNetUtxo, error)
+}
+
+// fetchUnspentMwebCoins returns the leafset of the mweb coins db along with
+// the coins of its unspent leaves, consistent with each other even while the
+// mweb sync writes to the db. For a db that can't read both in a single
+// snapshot, the leafset is read again after the coins, and the coins
+// fetched again until the leafset stays put, which only takes a retry if a
+// sync stored a new leafset in between.
+func fetchUnspentMwebCoins(coinDB mwebdb.CoinDatabase) (*mweb.Leafset,
+	[]*wire.MwebNetUtxo, error) {
+
+	if fetcher, ok := coinDB.(mwebUnspentCoinsFetcher); ok {
+		return fetcher.FetchUnspentCoins()
+	}
+
+	leafset, err := coinDB.GetLeafset()
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		var leaves []uint64
+		for i := uint64(0); i < leafset.Size; i++ {
+			if leafset.Contains(i) {
+				leaves = append(leaves, i)
+			}
+		}
+		coins, err := coinDB.FetchLeaves(leaves)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		after, err := coinDB.GetLeafset()
+		if err != nil {
+			return nil, nil, err
+		}
+		if mwebLeafsetsEqual(leafset, after) {
+			return leafset, coins, nil
+		}
+		leafset = after
+	}
+}
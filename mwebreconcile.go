@@ -0,0 +1,76 @@
+package neutrino
+
+import (
+	"slices"
+
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+// MwebWalletLeaves returns the leaf indices of the mweb coins that a wallet
+// has on record as unspent, in any order.
+type MwebWalletLeaves func() ([]uint64, error)
+
+// MwebCoinDiscrepancies is the result of reconciling the mweb coins stored
+// by the mweb sync against a wallet's records. Both lists of leaf indices
+// are in ascending order.
+type MwebCoinDiscrepancies struct {
+	// Height is the block height of the leafset that the coins were
+	// reconciled at.
+	Height uint32
+
+	// MissingFromWallet are the leaves whose coins we have stored as
+	// unspent, but the wallet has no record of.
+	MissingFromWallet []uint64
+
+	// MissingFromNeutrino are the leaves that the wallet has on record,
+	// but we have no unspent coin stored for, either because the leaf is
+	// spent or because its coin was never fetched.
+	MissingFromNeutrino []uint64
+}
+
+// Empty returns whether the wallet's records and the stored coins agree.
+func (d *MwebCoinDiscrepancies) Empty() bool {
+	return len(d.MissingFromWallet) == 0 && len(d.MissingFromNeutrino) == 0
+}
+
+// reconcileMwebCoins compares the unspent coins stored in the mweb coins db
+// with the leaves that the wallet has on record.
+func reconcileMwebCoins(coinDB mwebdb.CoinDatabase,
+	walletLeaves MwebWalletLeaves) (*MwebCoinDiscrepancies, error) {
+
+	leafset, coins, err := fetchUnspentMwebCoins(coinDB)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[uint64]struct{}, len(coins))
+	for _, coin := range coins {
+		stored[coin.LeafIndex] = struct{}{}
+	}
+
+	leaves, err := walletLeaves()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[uint64]struct{}, len(leaves))
+	for _, leaf := range leaves {
+		known[leaf] = struct{}{}
+	}
+
+	d := &MwebCoinDiscrepancies{Height: leafset.Height}
+	for leaf := range stored {
+		if _, ok := known[leaf]; !ok {
+			d.MissingFromWallet = append(d.MissingFromWallet, leaf)
+		}
+	}
+	for leaf := range known {
+		if _, ok := stored[leaf]; !ok {
+			d.MissingFromNeutrino = append(
+				d.MissingFromNeutrino, leaf,
+			)
+		}
+	}
+	slices.Sort(d.MissingFromWallet)
+	slices.Sort(d.MissingFromNeutrino)
+
+	return d, nil
+}
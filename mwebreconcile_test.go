@@ -0,0 +1,58 @@
+package neutrino
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReconcileMwebCoins tests that the coins that only the wallet or only
+// the mweb sync has are reported.
+func TestReconcileMwebCoins(t *testing.T) {
+	t.Parallel()
+
+	coinDB := newMockCoinDatabase()
+	s := &ChainService{MwebCoinDB: coinDB}
+
+	// Leaves 2 and 5 are spent, and the coin of leaf 7 was never fetched.
+	mmr := newTestMwebMmr(10)
+	coinDB.leafset = mmr.leafset(2, 5)
+	coinDB.leafset.Height = 100
+	for i := uint64(0); i < 10; i++ {
+		if i == 2 || i == 5 || i == 7 {
+			continue
+		}
+		coinDB.coins[i] = &wire.MwebNetUtxo{LeafIndex: i}
+	}
+
+	// A wallet that agrees has nothing to report.
+	d, err := s.ReconcileMwebCoins(func() ([]uint64, error) {
+		return []uint64{9, 8, 6, 4, 3, 1, 0}, nil
+	})
+	require.NoError(t, err)
+	require.True(t, d.Empty())
+	require.Equal(t, uint32(100), d.Height)
+
+	// The wallet is missing leaves 3 and 8, and has leaf 5 unspent,
+	// leaf 7 that we never fetched, and leaf 12 past the end of the
+	// leafset.
+	d, err = s.ReconcileMwebCoins(func() ([]uint64, error) {
+		return []uint64{12, 0, 1, 4, 5, 6, 7, 9, 1}, nil
+	})
+	require.NoError(t, err)
+	require.False(t, d.Empty())
+	require.Equal(t, &MwebCoinDiscrepancies{
+		Height:              100,
+		MissingFromWallet:   []uint64{3, 8},
+		MissingFromNeutrino: []uint64{5, 7, 12},
+	}, d)
+
+	// Errors fetching the wallet's records are passed on.
+	walletErr := errors.New("wallet error")
+	_, err = s.ReconcileMwebCoins(func() ([]uint64, error) {
+		return nil, walletErr
+	})
+	require.ErrorIs(t, err, walletErr)
+}
@@ -0,0 +1,123 @@
+package neutrino
+
+import (
+	"context"
+)
+
+// mwebResync is a full resync of the mweb coins db requested by ResyncMweb.
+// It starts with the mweb handler wiping the db, and completes once the
+// handler has caught up with the chain tip again.
+type mwebResync struct {
+	// wiped is whether the mweb coins db has been wiped for the resync.
+	wiped bool
+
+	// paused is whether the resync paused the mweb sync when its context
+	// was done, for the next call to resume it.
+	paused bool
+
+	// done is closed once the resync has completed, or failed with err.
+	done chan struct{}
+	err  error
+}
+
+// pending returns whether the resync is yet to wipe the mweb coins db. A nil
+// resync is never pending.
+func (r *mwebResync) pending() bool {
+	return r != nil && !r.wiped
+}
+
+// resyncMweb requests a full resync of the mweb coins db, or resumes the one
+// already requested, and waits for it to complete. If the context is done
+// first, the mweb sync is paused as by CancelMwebQueries, leaving the resync
+// to be resumed by the next call. A pause that the resync didn't make itself
+// is left for ResumeMwebQueries to lift.
+func (b *blockManager) resyncMweb(ctx context.Context) error {
+	b.newHeadersSignal.L.Lock()
+	resync := b.mwebResync
+	if resync == nil {
+		log.Infof("Starting full mweb resync")
+		resync = &mwebResync{done: make(chan struct{})}
+		b.mwebResync = resync
+	} else {
+		log.Infof("Resuming full mweb resync")
+	}
+	pending := resync.pending()
+	paused := resync.paused
+	resync.paused = false
+	b.newHeadersSignal.L.Unlock()
+	b.newHeadersSignal.Broadcast()
+
+	// The round under way is cut short if the db is yet to be wiped, so
+	// that it's wiped without waiting for the round to finish.
+	if pending && b.mwebPause.pause() {
+		paused = true
+	}
+	if paused {
+		b.mwebPause.resume()
+	}
+
+	select {
+	case <-resync.done:
+		return resync.err
+
+	case <-ctx.Done():
+		if b.mwebPause.pause() {
+			log.Infof("Pausing full mweb resync")
+
+			b.newHeadersSignal.L.Lock()
+			resync.paused = true
+			b.newHeadersSignal.L.Unlock()
+		}
+		return ctx.Err()
+
+	case <-b.quit:
+		return ErrShuttingDown
+	}
+}
+
+// wipeMwebForResync wipes the mweb coins db if a resync has been requested
+// and it's yet to be wiped, returning whether it was. It must only be called
+// from the mwebHandler goroutine.
+func (b *blockManager) wipeMwebForResync() bool {
+	b.newHeadersSignal.L.Lock()
+	resync := b.mwebResync
+	b.newHeadersSignal.L.Unlock()
+
+	if !resync.pending() {
+		return false
+	}
+
+	log.Infof("Wiping mweb coins db for full resync")
+	err := b.cfg.MwebCoins.PurgeCoins()
+
+	b.newHeadersSignal.L.Lock()
+	defer b.newHeadersSignal.L.Unlock()
+
+	if err != nil {
+		log.Errorf("Unable to wipe mweb coins db: %v", err)
+		resync.err = err
+		close(resync.done)
+		b.mwebResync = nil
+		return false
+	}
+
+	// Nothing fetched before the wipe is of any use after it.
+	resync.wiped = true
+	b.mwebUtxosResume = nil
+	b.mwebRefresh = nil
+	return true
+}
+
+// finishMwebResync completes the resync once the mweb handler has caught up
+// with the chain tip after wiping the mweb coins db. Callers MUST hold
+// newHeadersMtx.
+func (b *blockManager) finishMwebResync() {
+	resync := b.mwebResync
+	if resync == nil || !resync.wiped {
+		return
+	}
+
+	log.Infof("Full mweb resync complete")
+	close(resync.done)
+	b.mwebResync = nil
+}
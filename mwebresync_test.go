@@ -0,0 +1,203 @@
+package neutrino
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestResyncMweb tests that a full resync wipes a corrupt mweb coins db and
+// fetches the mweb utxos again, that it can be cancelled part way through,
+// that it then resumes from where it left off rather than starting over, and
+// that it leaves a pause it didn't make to be lifted by ResumeMwebQueries.
+func TestResyncMweb(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	// There are no mweb headers to fetch below the tip on this network.
+	bm.cfg.ChainParams.Net = wire.TestNet
+
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset(3, 7)
+	mwebHeader := mmr.mwebHeader()
+	mwebHeader.Height = 1
+	genesisHash := *chaincfg.SimNetParams.GenesisHash
+	header, msgHeader, msgLeafset := newTestMwebHeader(
+		t, genesisHash, *mwebHeader, leafset.Bits,
+	)
+
+	// The tip is recent, so that the block headers count as synced.
+	header.Timestamp = time.Unix(time.Now().Unix(), 0)
+	msgHeader.Merkle.Header = *header
+	msgLeafset.BlockHash = header.BlockHash()
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+	bm.newHeadersMtx.Lock()
+	bm.headerTip = 1
+	bm.headerTipHash = header.BlockHash()
+	bm.newHeadersMtx.Unlock()
+
+	leafset.Height = 1
+	leafset.Block = header
+
+	// The coins db is synced to the tip, but its coins are corrupt.
+	coinDB := newMockCoinDatabase()
+	coinDB.leafset = leafset
+	coinDB.leavesAtHeight[1] = leafset.Size
+	coinDB.coins[0] = &wire.MwebNetUtxo{LeafIndex: 0}
+	bm.cfg.MwebCoins = coinDB
+
+	peers := &mockMwebPeers{
+		mwebHeader:  msgHeader,
+		mwebLeafset: msgLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	// The utxos are fetched a few at a time, so that there's more than
+	// one request to fetch them with.
+	bm.mwebBatchSizer.sizes["peer"] = 4
+
+	// Until stalled is closed, only the first utxos request of each
+	// query is answered.
+	var (
+		mtx       sync.Mutex
+		requested []uint64
+	)
+	stall := true
+	stalled := make(chan struct{})
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			mtx.Lock()
+			stalling := stall
+			for _, req := range requests {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				requested = append(requested, msg.StartIndex)
+			}
+			mtx.Unlock()
+
+			errChan := make(chan error, 1)
+			go func() {
+				for i, req := range requests {
+					if stalling && i > 0 {
+						close(stalled)
+						return
+					}
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	bm.wg.Add(1)
+	go bm.mwebHandler()
+	defer func() {
+		require.NoError(t, bm.Stop())
+	}()
+
+	// Nothing is fetched while the coins db appears to be synced.
+	time.Sleep(100 * time.Millisecond)
+	mtx.Lock()
+	require.Empty(t, requested)
+	mtx.Unlock()
+
+	// The resync wipes the db, and is cancelled once the first span
+	// has been fetched.
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- bm.resyncMweb(ctx)
+	}()
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resync didn't fetch any mweb utxos")
+	}
+	cancel()
+
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("resync not cancelled")
+	}
+
+	// The utxos of the first request were written over the wiped db
+	// before the cancel.
+	require.Eventually(t, func() bool {
+		coinDB.mtx.Lock()
+		defer coinDB.mtx.Unlock()
+		return len(coinDB.coins) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	coinDB.mtx.Lock()
+	require.Zero(t, coinDB.leafset.Size)
+	require.NotNil(t, coinDB.coins[0].Output)
+	coinDB.mtx.Unlock()
+
+	mtx.Lock()
+	require.Equal(t, []uint64{0, 5, 10, 14, 18}, requested)
+	requested = nil
+	stall = false
+	mtx.Unlock()
+
+	// Resuming the resync fetches the rest, without wiping the db again.
+	err = bm.resyncMweb(context.Background())
+	require.NoError(t, err)
+
+	mtx.Lock()
+	require.NotEmpty(t, requested)
+	require.Equal(t, uint64(5), requested[0])
+	for _, start := range requested {
+		require.GreaterOrEqual(t, start, uint64(5))
+	}
+	mtx.Unlock()
+
+	checkSynced := func() {
+		coinDB.mtx.Lock()
+		defer coinDB.mtx.Unlock()
+		require.Len(t, coinDB.coins, 18)
+		require.True(t, mwebLeafsetsEqual(leafset, coinDB.leafset))
+		for _, coin := range coinDB.coins {
+			require.NotNil(t, coin.Output)
+		}
+	}
+	checkSynced()
+
+	// A resync doesn't lift a pause that it didn't make, but waits for
+	// the mweb sync to be resumed.
+	bm.CancelMwebQueries()
+	ctx, cancel = context.WithTimeout(
+		context.Background(), 100*time.Millisecond,
+	)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		err = bm.resyncMweb(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		select {
+		case <-bm.mwebPause.resumedChan():
+			t.Fatal("resync lifted the pause")
+		default:
+		}
+	}
+
+	bm.ResumeMwebQueries()
+	require.NoError(t, bm.resyncMweb(context.Background()))
+	checkSynced()
+}
@@ -0,0 +1,54 @@
+package neutrino
+
+import (
+	"errors"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+)
+
+// ErrMwebCoinsNoRetain is returned when ShouldRetainPurgedCoin is set with
+// an mweb coins db that can't mark the coins it retains spent, as the
+// retained coins would otherwise be taken for unspent ones.
+var ErrMwebCoinsNoRetain = errors.New("mweb coins db can't retain spent " +
+	"coins")
+
+// mwebCoinRetainer is implemented by mweb coins dbs that can keep the coins
+// of spent leaves marked spent in place of purging them, as the CoinStore
+// does.
+type mwebCoinRetainer interface {
+	// PutLeafsetAndRetain sets the leafset, purges the coins of the
+	// removed leaves and marks those of the retained leaves spent.
+	PutLeafsetAndRetain(*mweb.Leafset, []uint64, []uint64) error
+}
+
+// putLeafsetAndPurge sets the leafset and purges the coins of the removed
+// leaves from the mweb coins db, except for those that ShouldRetainPurgedCoin
+// retains, which are marked spent. ErrMwebCoinsNoRetain is returned if the
+// db can't mark them.
+func (b *blockManager) putLeafsetAndPurge(leafset *mweb.Leafset,
+	removedLeaves []uint64) error {
+
+	coinDB, retain := b.cfg.MwebCoins, b.cfg.ShouldRetainPurgedCoin
+	if retain == nil || len(removedLeaves) == 0 {
+		return coinDB.PutLeafsetAndPurge(leafset, removedLeaves)
+	}
+
+	retainer, ok := coinDB.(mwebCoinRetainer)
+	if !ok {
+		return ErrMwebCoinsNoRetain
+	}
+
+	var purged, retained []uint64
+	for _, leaf := range removedLeaves {
+		if retain(leaf) {
+			retained = append(retained, leaf)
+		} else {
+			purged = append(purged, leaf)
+		}
+	}
+	if len(retained) > 0 {
+		log.Debugf("Retaining %v spent mweb txos in db", len(retained))
+	}
+
+	return retainer.PutLeafsetAndRetain(leafset, purged, retained)
+}
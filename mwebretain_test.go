@@ -0,0 +1,125 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestShouldRetainPurgedCoin tests that the spent coins that
+// ShouldRetainPurgedCoin retains are kept, marked spent and taken as purged
+// other than by FetchRetainedCoin, while the rest are purged, and that a db
+// that can't mark coins spent is rejected.
+func TestShouldRetainPurgedCoin(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/coins.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	coinStore, err := mwebdb.NewCoinStore(db)
+	require.NoError(t, err)
+
+	// The coins of the even leaves are the wallet's own, and retained.
+	bm.cfg.ShouldRetainPurgedCoin = func(leafIdx uint64) bool {
+		return leafIdx%2 == 0
+	}
+	bm.cfg.MwebCoins = coinStore
+
+	mmr := newTestMwebMmr(6)
+	coins := make([]*wire.MwebNetUtxo, len(mmr.outputIds))
+	for i := range coins {
+		coins[i] = &wire.MwebNetUtxo{
+			Height:    1,
+			LeafIndex: uint64(i),
+			Output:    &wire.MwebOutput{},
+			OutputId:  &mmr.outputIds[i],
+		}
+	}
+
+	require.NoError(t, coinStore.PutCoins(coins))
+	leafset := mmr.leafset()
+	leafset.Height, leafset.Block = 1, &wire.BlockHeader{Nonce: 1}
+	require.NoError(t, bm.purgeSpentMwebTxos(leafset, nil))
+
+	// Leaves 2 to 5 are spent by the next block.
+	leafset = mmr.leafset(2, 3, 4, 5)
+	leafset.Height, leafset.Block = 2, &wire.BlockHeader{Nonce: 2}
+	require.NoError(t, bm.purgeSpentMwebTxos(
+		leafset, []uint64{2, 3, 4, 5},
+	))
+
+	// The retained coins are left out as if they were purged.
+	stored, err := coinStore.FetchLeaves([]uint64{0, 1, 2, 3, 4, 5})
+	require.NoError(t, err)
+	require.Equal(t, coins[:2], stored)
+
+	s := &ChainService{MwebCoinDB: coinStore}
+	for i, coin := range coins {
+		_, err := coinStore.FetchCoin(coin.OutputId)
+		require.Equal(t, i < 2, s.MwebUtxoExists(coin.OutputId))
+		if i >= 2 {
+			require.ErrorIs(t, err, mwebdb.ErrCoinNotFound)
+		} else {
+			require.NoError(t, err)
+		}
+
+		retained, err := coinStore.FetchRetainedCoin(coin.OutputId)
+		if i == 2 || i == 4 {
+			require.NoError(t, err)
+			require.Equal(t, coin.Output, retained)
+		} else {
+			require.ErrorIs(t, err, mwebdb.ErrCoinNotFound)
+		}
+	}
+
+	for i, coin := range coins[:5] {
+		spent, err := coinStore.IsCoinSpent(coin.OutputId)
+		if i == 3 {
+			require.ErrorIs(t, err, mwebdb.ErrCoinNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, i == 2 || i == 4, spent)
+	}
+
+	// The spent mark stays when a coin is marked verified again.
+	require.NoError(t, coinStore.MarkCoinsVerified([]uint64{2}))
+	spent, err := coinStore.IsCoinSpent(coins[2].OutputId)
+	require.NoError(t, err)
+	require.True(t, spent)
+	_, err = coinStore.IsCoinSpent(&chainhash.Hash{})
+	require.ErrorIs(t, err, mwebdb.ErrCoinNotFound)
+
+	// A db that can't mark the retained coins spent is rejected.
+	mockDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = mockDB
+	require.NoError(t, mockDB.PutCoins(coins))
+	err = bm.purgeSpentMwebTxos(leafset, []uint64{2, 3, 4, 5})
+	require.ErrorIs(t, err, ErrMwebCoinsNoRetain)
+
+	_, err = newBlockManager(bm.cfg)
+	require.ErrorIs(t, err, ErrMwebCoinsNoRetain)
+}
+
+// unspentLeaves returns the unspent leaves of the leafset.
+func unspentLeaves(leafset *mweb.Leafset) []uint64 {
+	var leaves []uint64
+	for i := uint64(0); i < leafset.Size; i++ {
+		if leafset.Contains(i) {
+			leaves = append(leaves, i)
+		}
+	}
+	return leaves
+}
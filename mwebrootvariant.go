@@ -0,0 +1,50 @@
+package neutrino
+
+import (
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+)
+
+// MwebRootVariant is a rule for computing the output root of an mweb header
+// from the peak hashes of its output MMR. During a protocol upgrade our
+// peers may briefly disagree on the rule, so more than one can be accepted.
+type MwebRootVariant struct {
+	// Name identifies the variant in the logs.
+	Name string
+
+	// BagPeaks folds the peak hashes, given from left to right, into the
+	// output root of an MMR with the given number of nodes. It returns
+	// nil if there are no peaks.
+	BagPeaks func(peakHashes []*chainhash.Hash,
+		numNodes uint64) *chainhash.Hash
+}
+
+// DefaultMwebRootVariant is the current rule for computing the output root,
+// which bags the peaks from right to left.
+var DefaultMwebRootVariant = MwebRootVariant{
+	Name: "default",
+	BagPeaks: func(peakHashes []*chainhash.Hash,
+		numNodes uint64) *chainhash.Hash {
+
+		return bagPeaks(peakHashes, nodeIdx(numNodes))
+	},
+}
+
+// matchMwebRootVariant returns the first of the variants under which the
+// peak hashes give the output root, or nil if none do. If no variants are
+// given, only the default rule is tried.
+func matchMwebRootVariant(variants []MwebRootVariant,
+	peakHashes []*chainhash.Hash, numNodes uint64,
+	outputRoot *chainhash.Hash) *MwebRootVariant {
+
+	if len(variants) == 0 {
+		variants = []MwebRootVariant{DefaultMwebRootVariant}
+	}
+
+	for i := range variants {
+		root := variants[i].BagPeaks(peakHashes, numNodes)
+		if root != nil && root.IsEqual(outputRoot) {
+			return &variants[i]
+		}
+	}
+	return nil
+}
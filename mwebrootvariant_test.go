@@ -0,0 +1,82 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// reversedMwebRootVariant bags the peaks from left to right, as a rule that
+// peers might briefly disagree with the default one on.
+var reversedMwebRootVariant = MwebRootVariant{
+	Name: "reversed",
+	BagPeaks: func(peakHashes []*chainhash.Hash,
+		numNodes uint64) *chainhash.Hash {
+
+		if len(peakHashes) == 0 {
+			return nil
+		}
+		baggedPeak := peakHashes[0]
+		for _, peakHash := range peakHashes[1:] {
+			baggedPeak = nodeIdx(numNodes).parentHash(
+				peakHash[:], baggedPeak[:],
+			)
+		}
+		return baggedPeak
+	},
+}
+
+// TestMwebRootVariants tests that a proof of mweb utxos is accepted if the
+// output root matches any of the configured root variants, and only the
+// default rule otherwise.
+func TestMwebRootVariants(t *testing.T) {
+	t.Parallel()
+
+	// Six leaves make two peaks, so the rules give different roots.
+	mmr := newTestMwebMmr(6)
+	leafset := mmr.leafset()
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 6, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(leafset, req)
+
+	peaks := calcPeaks(uint64(mmr.nextNodeIdx()))
+	require.Len(t, peaks, 2)
+	peak0, peak1 := mmr.nodeHash(uint64(peaks[0])),
+		mmr.nodeHash(uint64(peaks[1]))
+	peakHashes := []*chainhash.Hash{&peak0, &peak1}
+	defaultRoot := mmr.root()
+	reversedRoot := *reversedMwebRootVariant.BagPeaks(
+		peakHashes, uint64(mmr.nextNodeIdx()),
+	)
+	require.NotEqual(t, defaultRoot, reversedRoot)
+
+	variants := []MwebRootVariant{
+		DefaultMwebRootVariant, reversedMwebRootVariant,
+	}
+	for _, root := range []chainhash.Hash{defaultRoot, reversedRoot} {
+		mwebHeader := mmr.mwebHeader()
+		mwebHeader.OutputRoot = root
+		require.NoError(t, verifyMwebUtxosDetailed(
+			variants, mwebHeader, leafset, resp,
+		))
+	}
+
+	// Only the default rule is accepted without any variants.
+	mwebHeader := mmr.mwebHeader()
+	require.NoError(t, verifyMwebUtxosDetailed(
+		nil, mwebHeader, leafset, resp,
+	))
+	mwebHeader.OutputRoot = reversedRoot
+	err := verifyMwebUtxosDetailed(nil, mwebHeader, leafset, resp)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	// A root matching neither variant is still rejected.
+	mwebHeader.OutputRoot = chainhash.Hash{0x01}
+	err = verifyMwebUtxosDetailed(
+		variants, mwebHeader, leafset, resp,
+	)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+}
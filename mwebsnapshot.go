@@ -0,0 +1,145 @@
+package neutrino
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// ErrMwebSnapshot is returned when an mweb snapshot doesn't match the block
+// it's for, or its coins don't match its leafset.
+var ErrMwebSnapshot = errors.New("mweb snapshot is bad")
+
+// MwebSnapshot is a trusted snapshot of the mweb utxo set at a checkpoint
+// block, from which the mweb sync can start rather than fetching every mweb
+// utxo from the start of the chain.
+type MwebSnapshot struct {
+	// Height is the height of the checkpoint block.
+	Height uint32
+
+	// MwebHeader is the mweb header of the checkpoint block. It must
+	// commit to the block at Height in our block header chain, and the
+	// mweb headers of the blocks after it must build on it.
+	MwebHeader *wire.MsgMwebHeader
+
+	// Leafset is the leafset of the checkpoint block, which must match
+	// the leafset root of the mweb header.
+	Leafset []byte
+
+	// Coins are the unspent mweb coins at the checkpoint block, one for
+	// each unspent leaf of the leafset in order. As the spent leaves
+	// aren't part of the snapshot, the coins can't be checked against
+	// the output root, and so are trusted.
+	Coins []*wire.MwebNetUtxo
+}
+
+// verifyMwebSnapshot checks the mweb snapshot against the block at its
+// height, returning the leafset that it seeds the mweb coins db with.
+func (b *blockManager) verifyMwebSnapshot(
+	snapshot *MwebSnapshot) (*mweb.Leafset, error) {
+
+	header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(snapshot.Height)
+	if err != nil {
+		return nil, err
+	}
+	blockHash := header.BlockHash()
+
+	// Remembering the mweb header means that the mweb header of the next
+	// block must chain to it.
+	mwebHeader := snapshot.MwebHeader
+	err = b.verifyMwebHeaderChained(&blockHash, mwebHeader)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyMwebLeafsetDetailed(
+		&mwebHeader.MwebHeader, &wire.MsgMwebLeafset{
+			BlockHash: blockHash,
+			Leafset:   snapshot.Leafset,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	leafset := &mweb.Leafset{
+		Bits:   snapshot.Leafset,
+		Size:   mwebHeader.MwebHeader.OutputMMRSize,
+		Height: snapshot.Height,
+		Block:  header,
+	}
+	if uint64(len(leafset.Bits)) != (leafset.Size+7)/8 {
+		return nil, fmt.Errorf("%w: leafset of %v bytes for mmr of %v "+
+			"leaves", ErrMwebSnapshot, len(leafset.Bits),
+			leafset.Size)
+	}
+
+	// Each unspent leaf must have exactly one coin, in order.
+	var next uint64
+	for _, coin := range snapshot.Coins {
+		for next < leafset.Size && !leafset.Contains(next) {
+			next++
+		}
+		if coin.LeafIndex != next || coin.OutputId == nil {
+			return nil, fmt.Errorf("%w: unexpected coin at leaf "+
+				"index %v", ErrMwebSnapshot, coin.LeafIndex)
+		}
+		next++
+	}
+	for next < leafset.Size && !leafset.Contains(next) {
+		next++
+	}
+	if next < leafset.Size {
+		return nil, fmt.Errorf("%w: no coin for leaf index %v",
+			ErrMwebSnapshot, next)
+	}
+
+	return leafset, nil
+}
+
+// loadMwebSnapshot seeds the mweb coins db with the mweb snapshot, so that
+// the mweb sync only fetches the mweb utxos created after it. The snapshot
+// is only loaded into an empty mweb coins db. Its coins are delivered to the
+// utxos callbacks like any others.
+func (b *blockManager) loadMwebSnapshot(snapshot *MwebSnapshot) error {
+	b.mwebUtxosCallbacksMtx.Lock()
+	defer b.mwebUtxosCallbacksMtx.Unlock()
+
+	oldLeafset, err := b.cfg.MwebCoins.GetLeafset()
+	if err != nil {
+		return err
+	}
+	if oldLeafset.Size > 0 {
+		log.Infof("Mweb coins db already synced to height=%v, not "+
+			"loading mweb snapshot", oldLeafset.Height)
+		return nil
+	}
+
+	leafset, err := b.verifyMwebSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Loading mweb snapshot of %v coins at height=%v",
+		len(snapshot.Coins), snapshot.Height)
+
+	err = b.retryMwebWrite(func() error {
+		return b.cfg.MwebCoins.PutCoins(snapshot.Coins)
+	})
+	if err != nil {
+		return err
+	}
+	for _, cb := range b.mwebUtxosCallbacks {
+		cb(nil, snapshot.Coins)
+	}
+
+	err = b.cfg.MwebCoins.PutLeavesAtHeight(map[uint32]uint64{
+		leafset.Height: leafset.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.purgeSpentMwebTxos(leafset, nil)
+}
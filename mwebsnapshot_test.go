@@ -0,0 +1,107 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebSnapshot tests that an empty mweb coins db is seeded from an mweb
+// snapshot, and that the mweb header of the next block must build on the
+// snapshot's.
+func TestMwebSnapshot(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	var delivered []*wire.MwebNetUtxo
+	bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		delivered = append(delivered, utxos...)
+	})
+
+	// The checkpoint block has eight leaves, of which the first four
+	// are unspent.
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+	header1, mwebHeader1, mwebLeafset1 := newTestMwebHeader(
+		t, genesis.BlockHash(), wire.MwebHeader{
+			Height:        1,
+			OutputMMRSize: 8,
+		}, []byte{0xf0},
+	)
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header1,
+		Height:      1,
+	}))
+
+	snapshot := &MwebSnapshot{
+		Height:     1,
+		MwebHeader: mwebHeader1,
+		Leafset:    mwebLeafset1.Leafset,
+	}
+	for i := uint64(0); i < 4; i++ {
+		snapshot.Coins = append(snapshot.Coins, &wire.MwebNetUtxo{
+			LeafIndex: i,
+			OutputId:  &chainhash.Hash{byte(i)},
+		})
+	}
+
+	// A snapshot missing a coin is rejected without touching the db.
+	bad := *snapshot
+	bad.Coins = bad.Coins[1:]
+	require.ErrorIs(t, bm.loadMwebSnapshot(&bad), ErrMwebSnapshot)
+	require.Empty(t, coinDB.coins)
+
+	require.NoError(t, bm.loadMwebSnapshot(snapshot))
+	require.Len(t, coinDB.coins, 4)
+	require.Equal(t, snapshot.Coins, delivered)
+	require.Equal(t, uint64(8), coinDB.leafset.Size)
+	require.Equal(t, uint32(1), coinDB.leafset.Height)
+	require.Equal(t, map[uint32]uint64{1: 8}, coinDB.leavesAtHeight)
+
+	// The snapshot isn't loaded again once the db has been synced.
+	require.NoError(t, bm.loadMwebSnapshot(&bad))
+	require.Len(t, coinDB.coins, 4)
+
+	// The mweb header of the next block must spend the snapshot's hogex
+	// output, and append to its output MMR.
+	hogexHash1 := mwebHeader1.Hogex.TxHash()
+	newNextHeader := func(outputMMRSize uint64,
+		prevOut wire.OutPoint) (chainhash.Hash, *wire.MsgMwebHeader) {
+
+		_, mwebHeader, _ := newTestMwebHeader(
+			t, header1.BlockHash(), wire.MwebHeader{
+				Height:        2,
+				OutputMMRSize: outputMMRSize,
+			}, nil,
+		)
+		blockHash := chainTestHogex(mwebHeader, prevOut)
+		return blockHash, mwebHeader
+	}
+
+	blockHash, mwebHeader := newNextHeader(6, wire.OutPoint{
+		Hash: hogexHash1,
+	})
+	err = bm.verifyMwebHeaderChained(&blockHash, mwebHeader)
+	require.ErrorIs(t, err, ErrMwebOutputMMRShrunk)
+	require.True(t, isMwebHeaderConflict(err))
+
+	blockHash, mwebHeader = newNextHeader(10, wire.OutPoint{Index: 1})
+	err = bm.verifyMwebHeaderChained(&blockHash, mwebHeader)
+	require.ErrorIs(t, err, ErrMwebHogexChain)
+
+	blockHash, mwebHeader = newNextHeader(10, wire.OutPoint{
+		Hash: hogexHash1,
+	})
+	require.NoError(t, bm.verifyMwebHeaderChained(&blockHash, mwebHeader))
+}
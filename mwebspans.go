@@ -0,0 +1,115 @@
+package neutrino
+
+import (
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+// mwebSpanRecorder is implemented by mweb coins dbs that record the spans of
+// leaves verified and stored by an mweb utxos fetch, as the CoinStore does,
+// so that a fetch cut short by a restart needn't fetch and verify them
+// again.
+type mwebSpanRecorder interface {
+	// GetVerifiedSpans returns the spans recorded, or nil if none are.
+	GetVerifiedSpans() (*mwebdb.VerifiedSpans, error)
+
+	// AddVerifiedSpans records the spans as verified and stored by a
+	// fetch against the leafset of the given block, replacing those
+	// recorded for any other block.
+	AddVerifiedSpans(uint32, chainhash.Hash, []mwebdb.VerifiedSpan) error
+
+	// ClearVerifiedSpans removes the spans recorded.
+	ClearVerifiedSpans() error
+}
+
+// verifiedMwebSpans returns the spans of leaves that the mweb coins db
+// recorded as verified and stored by an earlier fetch, as long as that was
+// against a block that the new leafset builds upon. The spans are then
+// recorded against the new leafset's block, so that they're still skipped
+// if the fetch against it is cut short too.
+func (b *blockManager) verifiedMwebSpans(newLeafset *mweb.Leafset,
+	blockHash *chainhash.Hash) []mwebdb.VerifiedSpan {
+
+	recorder, ok := b.cfg.MwebCoins.(mwebSpanRecorder)
+	if !ok {
+		return nil
+	}
+	record, err := recorder.GetVerifiedSpans()
+	if err != nil {
+		log.Warnf("Couldn't read verified mweb spans: %v", err)
+		return nil
+	}
+	if record == nil {
+		return nil
+	}
+
+	if !b.isMwebBlockInChain(
+		record.Height, record.BlockHash, newLeafset.Height,
+	) {
+		log.Debugf("Discarding verified mweb spans at height=%v",
+			record.Height)
+		b.clearVerifiedMwebSpans()
+		return nil
+	}
+
+	if record.BlockHash != *blockHash {
+		err := recorder.AddVerifiedSpans(
+			newLeafset.Height, *blockHash, record.Spans,
+		)
+		if err != nil {
+			log.Warnf("Couldn't record verified mweb spans: %v",
+				err)
+		}
+	}
+
+	log.Infof("Skipping %v mweb leaf spans verified before restart",
+		len(record.Spans))
+
+	return record.Spans
+}
+
+// recordVerifiedMwebSpans records the spans of leaves covered by the
+// written mweb utxos responses in the mweb coins db, if the fetch records
+// them. Failing to record them only means that they're fetched again after
+// a restart.
+func (b *blockManager) recordVerifiedMwebSpans(q *mwebUtxosQuery,
+	resps []*wire.MsgMwebUtxos) {
+
+	if q.spanBlock == nil {
+		return
+	}
+	recorder, ok := b.cfg.MwebCoins.(mwebSpanRecorder)
+	if !ok {
+		return
+	}
+
+	spans := make([]mwebdb.VerifiedSpan, 0, len(resps))
+	for _, r := range resps {
+		if len(r.Utxos) == 0 {
+			continue
+		}
+		spans = append(spans, mwebdb.VerifiedSpan{
+			Start: r.Utxos[0].LeafIndex,
+			End:   r.Utxos[len(r.Utxos)-1].LeafIndex + 1,
+		})
+	}
+
+	err := recorder.AddVerifiedSpans(q.leafset.Height, *q.spanBlock, spans)
+	if err != nil {
+		log.Warnf("Couldn't record verified mweb spans: %v", err)
+	}
+}
+
+// clearVerifiedMwebSpans removes the spans recorded in the mweb coins db,
+// once the leafset has been stored and they're no longer needed.
+func (b *blockManager) clearVerifiedMwebSpans() {
+	recorder, ok := b.cfg.MwebCoins.(mwebSpanRecorder)
+	if !ok {
+		return
+	}
+	if err := recorder.ClearVerifiedSpans(); err != nil {
+		log.Warnf("Couldn't clear verified mweb spans: %v", err)
+	}
+}
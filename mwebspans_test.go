@@ -0,0 +1,158 @@
+package neutrino
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebVerifiedSpansRestart tests that the spans of leaves written by a
+// fetch that is cut short are skipped by the fetch after a restart, so that
+// they're neither fetched nor verified again, while the rest are fetched.
+func TestMwebVerifiedSpansRestart(t *testing.T) {
+	t.Parallel()
+
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/coins.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	coinStore, err := mwebdb.NewCoinStore(db)
+	require.NoError(t, err)
+
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset(3, 7, 12)
+	leafset.Block = &chaincfg.SimNetParams.GenesisBlock.Header
+	blockHash := leafset.Block.BlockHash()
+	mwebHeader := mmr.mwebHeader()
+
+	// setup returns a block manager over the coin store, as one would be
+	// after a restart, along with the start indices of the messages it
+	// sent and the spans of leaves that it verified. Only the requests
+	// that answer allows are answered.
+	type verified struct {
+		start, end uint64
+	}
+	setup := func(answer func(i int) bool) (*blockManager, func() (
+		[]uint64, []verified)) {
+
+		bm, _, _, err := setupBlockManager(t)
+		require.NoError(t, err)
+		bm.cfg.MwebCoins = coinStore
+		bm.mwebBatchSizer.sizes["peer"] = 4
+
+		var (
+			mtx       sync.Mutex
+			requested []uint64
+			verifies  []verified
+		)
+		handle := func(req *query.Request, resp *wire.MsgMwebUtxos) {
+			p := req.HandleResp(req.Req, resp, "peer")
+			if !p.Finished {
+				return
+			}
+
+			last := resp.Utxos[len(resp.Utxos)-1].LeafIndex
+			mtx.Lock()
+			verifies = append(verifies, verified{
+				start: resp.Utxos[0].LeafIndex,
+				end:   last + 1,
+			})
+			mtx.Unlock()
+		}
+		bm.cfg.QueryDispatcher = &mockDispatcher{
+			query: func(requests []*query.Request,
+				_ ...query.QueryOption) chan error {
+
+				errChan := make(chan error, 1)
+				for i, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					mtx.Lock()
+					requested = append(
+						requested, msg.StartIndex,
+					)
+					mtx.Unlock()
+					if !answer(i) {
+						continue
+					}
+
+					resp := mmr.proveUtxos(leafset, msg)
+					go handle(req, resp)
+				}
+				return errChan
+			},
+		}
+
+		return bm, func() ([]uint64, []verified) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			return requested, verifies
+		}
+	}
+
+	// The first fetch only gets answers to every other request, and is
+	// cancelled once they've been written.
+	bm, results := setup(func(i int) bool {
+		return i%2 == 0
+	})
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- bm.getMwebUtxos(mwebHeader, leafset, &blockHash)
+	}()
+
+	var committed []verified
+	require.Eventually(t, func() bool {
+		requested, verifies := results()
+		committed = verifies
+		return len(requested) > 2 &&
+			len(verifies) == (len(requested)+1)/2
+	}, 5*time.Second, 10*time.Millisecond)
+	bm.CancelMwebQueries()
+
+	select {
+	case err := <-errChan:
+		require.ErrorIs(t, err, errMwebCancelled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch not cancelled")
+	}
+
+	record, err := coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	require.Equal(t, blockHash, record.BlockHash)
+
+	// After a restart, only the leaves that weren't written are fetched
+	// and verified.
+	bm, results = setup(func(int) bool {
+		return true
+	})
+	err = bm.getMwebUtxos(mwebHeader, leafset, &blockHash)
+	require.NoError(t, err)
+
+	requested, verifies := results()
+	require.NotEmpty(t, requested)
+	for _, v := range verifies {
+		for _, c := range committed {
+			require.False(t, v.start < c.end && c.start < v.end,
+				"span %v verified again", v)
+		}
+	}
+
+	_, utxos, err := coinStore.FetchUnspentCoins()
+	require.NoError(t, err)
+	require.Len(t, utxos, 17)
+
+	// The record is cleared once the leafset is stored.
+	record, err = coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	require.Nil(t, record)
+}
@@ -0,0 +1,106 @@
+package neutrino
+
+import (
+	"sync"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/neutrino/blockntfns"
+)
+
+// mwebNtfnQueue holds the block notifications queued by the mweb sync until
+// they're delivered, so that the sync doesn't wait on the subscribers to
+// the block notifications. It is safe for concurrent use.
+type mwebNtfnQueue struct {
+	mtx    sync.Mutex
+	ntfns  []blockntfns.BlockNtfn
+	signal chan struct{}
+}
+
+// newMwebNtfnQueue returns an empty notification queue.
+func newMwebNtfnQueue() *mwebNtfnQueue {
+	return &mwebNtfnQueue{signal: make(chan struct{}, 1)}
+}
+
+// push queues the notification, signalling that there is one to deliver.
+func (q *mwebNtfnQueue) push(ntfn blockntfns.BlockNtfn) {
+	q.mtx.Lock()
+	q.ntfns = append(q.ntfns, ntfn)
+	q.mtx.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the queued notifications, oldest first.
+func (q *mwebNtfnQueue) pop() []blockntfns.BlockNtfn {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	ntfns := q.ntfns
+	q.ntfns = nil
+	return ntfns
+}
+
+// mwebNtfnHandler delivers the notifications queued by the mweb sync along
+// with the other block notifications, in the order they were queued.
+//
+// NOTE: This must be run as a goroutine.
+func (b *blockManager) mwebNtfnHandler() {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case <-b.mwebNtfns.signal:
+		case <-b.quit:
+			return
+		}
+
+		for _, ntfn := range b.mwebNtfns.pop() {
+			select {
+			case b.blockNtfnChan <- ntfn:
+			case <-b.quit:
+				return
+			}
+		}
+	}
+}
+
+// mwebBlockSummary returns the summary of the block's effect on the mweb,
+// computed from the diff of the mweb leafset stored for it and the one
+// stored before it. It returns nil if the two aren't of consecutive blocks,
+// such as when a round of the mweb sync spans several blocks.
+func mwebBlockSummary(prevLeafset,
+	leafset *mweb.Leafset) *blockntfns.MwebSummary {
+
+	if prevLeafset == nil || prevLeafset.Block == nil ||
+		leafset.Block == nil ||
+		prevLeafset.Height+1 != leafset.Height ||
+		prevLeafset.Block.BlockHash() != leafset.Block.PrevBlock ||
+		prevLeafset.Size > leafset.Size {
+
+		return nil
+	}
+
+	_, removedLeaves := diffLeafsets(prevLeafset, leafset)
+	return &blockntfns.MwebSummary{
+		LeavesAdded:   leafset.Size - prevLeafset.Size,
+		LeavesRemoved: uint64(len(removedLeaves)),
+		MMRSize:       leafset.Size,
+	}
+}
+
+// notifyMwebBlock queues an MwebConnected notification for the block of the
+// leafset that the mweb sync has just stored, if it directly follows the
+// block of the leafset stored before it.
+func (b *blockManager) notifyMwebBlock(prevLeafset, leafset *mweb.Leafset) {
+	summary := mwebBlockSummary(prevLeafset, leafset)
+	if summary == nil {
+		return
+	}
+
+	b.mwebNtfns.push(blockntfns.NewMwebConnected(
+		*leafset.Block, leafset.Height, *summary,
+	))
+}
@@ -0,0 +1,97 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/blockntfns"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebBlockSummary tests that once the mweb sync stores the leafset of a
+// block directly following the one it stored before, a notification
+// summarizing the block's effect on the mweb is delivered, and that none is
+// for a round of the sync spanning several blocks.
+func TestMwebBlockSummary(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	bm.cfg.MwebCoins = newTestCoinStore(t)
+
+	bm.wg.Add(1)
+	go bm.mwebNtfnHandler()
+	t.Cleanup(func() {
+		close(bm.quit)
+		bm.wg.Wait()
+	})
+
+	mmr := newTestMwebMmr(10)
+	syncTo := func(height uint32, header *wire.BlockHeader,
+		spent ...uint64) {
+
+		leafset := mmr.leafset(spent...)
+		leafset.Height, leafset.Block = height, header
+		bm.cfg.QueryDispatcher = serveTestMwebUtxos(mmr, leafset)
+		blockHash := header.BlockHash()
+		err := bm.getMwebUtxos(mmr.mwebHeader(), leafset, &blockHash)
+		require.NoError(t, err)
+	}
+	next := func() *blockntfns.MwebConnected {
+		select {
+		case ntfn := <-bm.Notifications():
+			return ntfn.(*blockntfns.MwebConnected)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no mweb block notification")
+			return nil
+		}
+	}
+
+	header1 := wire.BlockHeader{
+		PrevBlock: *chaincfg.SimNetParams.GenesisHash,
+		Nonce:     1,
+	}
+	header2 := wire.BlockHeader{PrevBlock: header1.BlockHash(), Nonce: 2}
+	syncTo(1, &header1, 3)
+
+	// The block at height 2 spends leaves 1 and 4 of the ten before it,
+	// and adds six more, of which leaf 13 is already spent.
+	mmr.appendLeaves(6)
+	syncTo(2, &header2, 1, 3, 4, 13)
+
+	ntfn := next()
+	require.Equal(t, header2, ntfn.Header())
+	require.Equal(t, uint32(2), ntfn.Height())
+	require.Equal(t, blockntfns.MwebSummary{
+		LeavesAdded:   6,
+		LeavesRemoved: 2,
+		MMRSize:       16,
+	}, ntfn.MwebSummary())
+
+	// A round spanning blocks 3 to 5 has no summary, while the block
+	// after it does.
+	header5 := wire.BlockHeader{Nonce: 5}
+	header6 := wire.BlockHeader{PrevBlock: header5.BlockHash(), Nonce: 6}
+	mmr.appendLeaves(2)
+	syncTo(5, &header5, 1, 3, 4, 13)
+	syncTo(6, &header6, 1, 3, 4, 5, 13)
+
+	ntfn = next()
+	require.Equal(t, uint32(6), ntfn.Height())
+	require.Equal(t, blockntfns.MwebSummary{
+		LeavesRemoved: 1,
+		MMRSize:       18,
+	}, ntfn.MwebSummary())
+
+	// The leafsets must be of the same chain too.
+	require.Nil(t, mwebBlockSummary(
+		&mweb.Leafset{Height: 6, Block: &header6},
+		&mweb.Leafset{Height: 7, Block: &wire.BlockHeader{
+			PrevBlock: chainhash.Hash{0x01},
+		}},
+	))
+}
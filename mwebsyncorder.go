@@ -0,0 +1,57 @@
+package neutrino
+
+import (
+	"slices"
+)
+
+// MwebSyncOrder is the order in which the spans of mweb utxos added since
+// the last sync are fetched.
+type MwebSyncOrder uint8
+
+const (
+	// MwebSyncOldestFirst fetches the spans from the lowest leaf index
+	// up, so that the utxos come in the order they were created.
+	MwebSyncOldestFirst MwebSyncOrder = iota
+
+	// MwebSyncNewestFirst fetches the spans from the highest leaf index
+	// down, so that the most recently created utxos, which are the
+	// likeliest to be the wallet's own, show up first.
+	MwebSyncNewestFirst
+)
+
+// String returns a human readable string for the sync order.
+func (o MwebSyncOrder) String() string {
+	switch o {
+	case MwebSyncOldestFirst:
+		return "oldest-first"
+	case MwebSyncNewestFirst:
+		return "newest-first"
+	default:
+		return "unknown"
+	}
+}
+
+// orderLeafSpans returns the spans in the order they're to be fetched in,
+// given the spans in ascending order. Newest first, the spans are split
+// into groups the size of a batch, which are taken from the highest leaf
+// index down. The spans within a group stay in ascending order, as a batch
+// must be. This isn't done if callbacks must be delivered in leaf index
+// order.
+func (b *blockManager) orderLeafSpans(spans []leafSpan) []leafSpan {
+	if b.cfg.MwebSyncOrder != MwebSyncNewestFirst ||
+		b.cfg.OrderedMwebCallbacks {
+
+		return spans
+	}
+
+	ordered := make([]leafSpan, 0, len(spans))
+	for end := len(spans); end > 0; end -= mwebUtxosBatchMsgs {
+		start := end - mwebUtxosBatchMsgs
+		if start < 0 {
+			start = 0
+		}
+		ordered = append(ordered, spans[start:end]...)
+	}
+
+	return slices.Clip(ordered)
+}
@@ -0,0 +1,115 @@
+package neutrino
+
+import (
+	"sync"
+
+	"github.com/ltcmweb/neutrino/query"
+)
+
+// MwebTimeoutPolicy is what's done with a peer once it has timed out on too
+// many getmwebutxos messages in a row. Unlike a peer serving invalid data,
+// such a peer isn't banned, as it may just be slow or overloaded.
+type MwebTimeoutPolicy uint8
+
+const (
+	// MwebTimeoutDeprioritize gives the peer mweb utxos requests only
+	// when none of our other peers are free, until it answers one again.
+	MwebTimeoutDeprioritize MwebTimeoutPolicy = iota
+
+	// MwebTimeoutDisconnect disconnects the peer, as well as
+	// deprioritizing it until it's gone.
+	MwebTimeoutDisconnect
+)
+
+// String returns a human readable string for the timeout policy.
+func (p MwebTimeoutPolicy) String() string {
+	switch p {
+	case MwebTimeoutDeprioritize:
+		return "deprioritize"
+	case MwebTimeoutDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// mwebTimeoutTracker counts the getmwebutxos messages that each peer has
+// timed out on in a row, neither answering nor failing. A peer that has
+// timed out the threshold number of times is deprioritized until it next
+// answers. It is safe for concurrent use.
+type mwebTimeoutTracker struct {
+	threshold int
+
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+// newMwebTimeoutTracker returns a tracker that deprioritizes peers once they
+// time out the given number of times in a row. If the threshold is zero,
+// peers are never deprioritized.
+func newMwebTimeoutTracker(threshold int) *mwebTimeoutTracker {
+	return &mwebTimeoutTracker{
+		threshold: threshold,
+		counts:    make(map[string]int),
+	}
+}
+
+// record counts an attempt by the peer at a getmwebutxos message, returning
+// true if it has just reached the threshold. Timeouts are counted, while an
+// answer resets the count. Other errors, such as the peer disconnecting,
+// leave it as it is.
+func (t *mwebTimeoutTracker) record(peer string, err error) bool {
+	if t.threshold <= 0 {
+		return false
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	switch err {
+	case nil:
+		delete(t.counts, peer)
+		return false
+
+	case query.ErrQueryTimeout:
+		t.counts[peer]++
+		return t.counts[peer] == t.threshold
+
+	default:
+		return false
+	}
+}
+
+// timedOut returns whether the peer has reached the threshold of timeouts
+// in a row.
+func (t *mwebTimeoutTracker) timedOut(peer string) bool {
+	if t.threshold <= 0 {
+		return false
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.counts[peer] >= t.threshold
+}
+
+// removePeer forgets the timeouts of a disconnected peer.
+func (t *mwebTimeoutTracker) removePeer(peer string) {
+	t.mtx.Lock()
+	delete(t.counts, peer)
+	t.mtx.Unlock()
+}
+
+// mwebPeerTimedOut applies the timeout policy to a peer that has just timed
+// out on too many getmwebutxos messages in a row.
+func (b *blockManager) mwebPeerTimedOut(peer string) {
+	log.Warnf("Peer %v timed out on %v mweb utxos requests in a row, "+
+		"applying policy %v", peer, b.mwebTimeouts.threshold,
+		b.cfg.MwebTimeoutPolicy)
+
+	if b.cfg.MwebTimeoutPolicy == MwebTimeoutDisconnect &&
+		b.cfg.DisconnectPeer != nil {
+
+		b.cfg.DisconnectPeer(peer)
+	}
+}
@@ -0,0 +1,83 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebTimeoutPolicy tests that a silent peer timing out on getmwebutxos
+// messages is deprioritized, and disconnected under that policy, once it
+// has timed out the threshold number of times in a row, and that it's
+// preferred again once it answers.
+func TestMwebTimeoutPolicy(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	bm.mwebTimeouts = newMwebTimeoutTracker(3)
+	bm.cfg.MwebTimeoutPolicy = MwebTimeoutDisconnect
+
+	var disconnected []string
+	bm.cfg.DisconnectPeer = func(addr string) {
+		disconnected = append(disconnected, addr)
+	}
+
+	req := q.requestBuilder(nil).request(wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 10, wire.MwebNetUtxoCompact,
+	))
+	timeout := func(peer string) {
+		req.OnResult(peer, 2*time.Second, query.ErrQueryTimeout)
+	}
+
+	// Other errors, such as the peer disconnecting, don't count.
+	req.OnResult("silent", time.Second, query.ErrPeerDisconnected)
+	for i := 0; i < 2; i++ {
+		timeout("silent")
+		require.True(t, req.PreferPeer("silent"))
+	}
+
+	// An answer resets the count.
+	req.OnResult("silent", time.Second, nil)
+	for i := 0; i < 2; i++ {
+		timeout("silent")
+		require.True(t, req.PreferPeer("silent"))
+	}
+	require.Empty(t, disconnected)
+
+	// The third timeout in a row deprioritizes and disconnects the peer,
+	// and only the once.
+	timeout("silent")
+	require.False(t, req.PreferPeer("silent"))
+	require.True(t, req.PreferPeer("other"))
+	require.Equal(t, []string{"silent"}, disconnected)
+
+	timeout("silent")
+	require.False(t, req.PreferPeer("silent"))
+	require.Equal(t, []string{"silent"}, disconnected)
+
+	// Once the peer answers again, it's preferred again.
+	req.OnResult("silent", time.Second, nil)
+	require.True(t, req.PreferPeer("silent"))
+
+	// The archival peers are subject to the timeouts too.
+	bm.cfg.MwebArchivalPeer = func(string) bool {
+		return true
+	}
+	q.archivalLeafIndex = 10
+	req = q.requestBuilder(nil).request(wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 10, wire.MwebNetUtxoCompact,
+	))
+	for i := 0; i < 3; i++ {
+		timeout("archival")
+	}
+	require.False(t, req.PreferPeer("archival"))
+	require.True(t, req.PreferPeer("silent"))
+
+	// A disconnected peer's timeouts are forgotten.
+	bm.mwebTimeouts.removePeer("archival")
+	require.True(t, req.PreferPeer("archival"))
+}
@@ -0,0 +1,141 @@
+package neutrino
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// mwebVerifyTimingBounds are the upper bounds, inclusive, on the number of
+// utxos in a response for each bucket of the mweb utxos verification
+// timings. The last bucket covers the largest response allowed.
+var mwebVerifyTimingBounds = []int{16, 64, 256, 1024, wire.MaxMwebUtxosPerQuery}
+
+// MwebVerifyTimingBucket holds the timings of the mweb utxos responses
+// verified with up to MaxUtxos utxos, and more than the MaxUtxos of the
+// bucket before.
+type MwebVerifyTimingBucket struct {
+	// MaxUtxos is the largest number of utxos of a response counted in
+	// the bucket.
+	MaxUtxos int
+
+	// Count is the number of responses verified.
+	Count uint64
+
+	// Utxos is the total number of utxos in the responses verified.
+	Utxos uint64
+
+	// Total is the total time taken to verify the responses.
+	Total time.Duration
+
+	// Max is the longest time taken to verify a single response.
+	Max time.Duration
+}
+
+// mwebVerifyTimer records how long mweb utxos responses take to verify,
+// bucketed by the number of utxos in each.
+type mwebVerifyTimer struct {
+	mtx     sync.Mutex
+	buckets []MwebVerifyTimingBucket
+}
+
+// newMwebVerifyTimer creates a timer with empty buckets.
+func newMwebVerifyTimer() *mwebVerifyTimer {
+	t := &mwebVerifyTimer{
+		buckets: make(
+			[]MwebVerifyTimingBucket, len(mwebVerifyTimingBounds),
+		),
+	}
+	for i, bound := range mwebVerifyTimingBounds {
+		t.buckets[i].MaxUtxos = bound
+	}
+	return t
+}
+
+// record adds the time taken to verify a response with the given number of
+// utxos to its bucket. Responses larger than the last bound are counted in
+// the last bucket.
+func (t *mwebVerifyTimer) record(numUtxos int, elapsed time.Duration) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	bucket := &t.buckets[len(t.buckets)-1]
+	for i := range t.buckets {
+		if numUtxos <= t.buckets[i].MaxUtxos {
+			bucket = &t.buckets[i]
+			break
+		}
+	}
+
+	bucket.Count++
+	bucket.Utxos += uint64(numUtxos)
+	bucket.Total += elapsed
+	if elapsed > bucket.Max {
+		bucket.Max = elapsed
+	}
+}
+
+// snapshot returns a copy of the buckets.
+func (t *mwebVerifyTimer) snapshot() []MwebVerifyTimingBucket {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return append([]MwebVerifyTimingBucket(nil), t.buckets...)
+}
+
+// MwebUtxosBatchStats describes a verified mwebutxos response, for telling
+// whether the proofs served are bloated relative to the utxos delivered.
+type MwebUtxosBatchStats struct {
+	// Peer is the address of the peer that served the response.
+	Peer string
+
+	// StartIndex is the leaf index of the first utxo in the response.
+	StartIndex uint64
+
+	// Utxos is the number of utxos delivered by the response.
+	Utxos int
+
+	// ProofHashes is the number of proof hashes consumed verifying the
+	// response.
+	ProofHashes int
+
+	// Elapsed is the time taken to verify the response.
+	Elapsed time.Duration
+}
+
+// RegisterMwebUtxosStatsCallback will register a callback that will fire
+// with the stats of each mwebutxos response once verified. The callbacks
+// are run by the query workers, so they must return quickly.
+func (b *blockManager) RegisterMwebUtxosStatsCallback(
+	onStats func(MwebUtxosBatchStats)) {
+
+	b.mwebStatsCallbacksMtx.Lock()
+	defer b.mwebStatsCallbacksMtx.Unlock()
+	b.mwebStatsCallbacks = append(b.mwebStatsCallbacks, onStats)
+}
+
+// notifyMwebUtxosStats fires the stats callbacks for a verified mwebutxos
+// response served by the given peer.
+func (b *blockManager) notifyMwebUtxosStats(peer string,
+	r *wire.MsgMwebUtxos, elapsed time.Duration) {
+
+	b.mwebStatsCallbacksMtx.Lock()
+	callbacks := slices.Clone(b.mwebStatsCallbacks)
+	b.mwebStatsCallbacksMtx.Unlock()
+
+	if len(callbacks) == 0 {
+		return
+	}
+	stats := MwebUtxosBatchStats{
+		Peer:        peer,
+		StartIndex:  r.StartIndex,
+		Utxos:       len(r.Utxos),
+		ProofHashes: len(r.ProofHashes),
+		Elapsed:     elapsed,
+	}
+	for _, cb := range callbacks {
+		cb(stats)
+	}
+}
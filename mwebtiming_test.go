@@ -0,0 +1,158 @@
+package neutrino
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebVerifyTimer tests that verification timings are counted in the
+// bucket for their number of utxos.
+func TestMwebVerifyTimer(t *testing.T) {
+	t.Parallel()
+
+	timer := newMwebVerifyTimer()
+	timer.record(0, time.Millisecond)
+	timer.record(16, 3*time.Millisecond)
+	timer.record(17, 5*time.Millisecond)
+	timer.record(wire.MaxMwebUtxosPerQuery, time.Second)
+	timer.record(wire.MaxMwebUtxosPerQuery+1, 2*time.Second)
+
+	buckets := timer.snapshot()
+	require.Len(t, buckets, len(mwebVerifyTimingBounds))
+	require.Equal(t, MwebVerifyTimingBucket{
+		MaxUtxos: 16,
+		Count:    2,
+		Utxos:    16,
+		Total:    4 * time.Millisecond,
+		Max:      3 * time.Millisecond,
+	}, buckets[0])
+	require.Equal(t, MwebVerifyTimingBucket{
+		MaxUtxos: 64,
+		Count:    1,
+		Utxos:    17,
+		Total:    5 * time.Millisecond,
+		Max:      5 * time.Millisecond,
+	}, buckets[1])
+	require.Zero(t, buckets[2].Count)
+	require.Zero(t, buckets[3].Count)
+	require.Equal(t, MwebVerifyTimingBucket{
+		MaxUtxos: wire.MaxMwebUtxosPerQuery,
+		Count:    2,
+		Utxos:    2*wire.MaxMwebUtxosPerQuery + 1,
+		Total:    3 * time.Second,
+		Max:      2 * time.Second,
+	}, buckets[4])
+
+	// The snapshot is a copy.
+	buckets[0].Count = 100
+	require.Equal(t, uint64(2), timer.snapshot()[0].Count)
+}
+
+// TestMwebVerifyTiming tests that verifying mweb utxos responses of
+// different sizes populates the timing buckets, whether or not they pass.
+func TestMwebVerifyTiming(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+	require.Nil(t, bm.mwebVerifyTimer)
+
+	bm.mwebVerifyTimer = newMwebVerifyTimer()
+
+	mmr := newTestMwebMmr(1000)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset()
+	go func() {
+		for range q.utxosChan {
+		}
+	}()
+
+	for _, count := range []uint16{5, 10, 50, 200, 1000} {
+		req := wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, 0, count, wire.MwebNetUtxoCompact,
+		)
+		resp := mmr.proveUtxos(q.leafset, req)
+		progress := q.handleResponse(req, resp, "peer")
+		require.True(t, progress.Finished)
+	}
+
+	// A response failing verification is timed too.
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 300, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(q.leafset, req)
+	resp.Utxos[0].OutputId = &chainhash.Hash{}
+	q.handleResponse(req, resp, "peer")
+
+	buckets := bm.mwebVerifyTimer.snapshot()
+	counts := make([]uint64, len(buckets))
+	for i, bucket := range buckets {
+		counts[i] = bucket.Count
+		if bucket.Count > 0 {
+			require.NotZero(t, bucket.Total)
+			require.LessOrEqual(t, bucket.Max, bucket.Total)
+		}
+	}
+	require.Equal(t, []uint64{2, 1, 1, 2, 0}, counts)
+	require.Equal(t, uint64(1300), buckets[3].Utxos)
+}
+
+// TestMwebUtxosStats tests that the stats of each verified mwebutxos response
+// count its utxos and the proof hashes consumed verifying it, and that no
+// stats are given for a response failing verification.
+func TestMwebUtxosStats(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+
+	var stats []MwebUtxosBatchStats
+	bm.RegisterMwebUtxosStatsCallback(func(s MwebUtxosBatchStats) {
+		stats = append(stats, s)
+	})
+
+	// With ten leaves, the output MMR has peaks over the first eight
+	// leaves and the last two. The first four leaves then need the hash
+	// of the next four and the bagged peak to their right, while all
+	// ten need no proof hashes at all.
+	mmr := newTestMwebMmr(10)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset()
+	go func() {
+		for range q.utxosChan {
+		}
+	}()
+
+	for _, count := range []uint16{4, 10} {
+		req := wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, 0, count, wire.MwebNetUtxoCompact,
+		)
+		resp := mmr.proveUtxos(q.leafset, req)
+		progress := q.handleResponse(req, resp, "peer")
+		require.True(t, progress.Finished)
+	}
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 4, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(q.leafset, req)
+	resp.Utxos[0].OutputId = &chainhash.Hash{}
+	q.handleResponse(req, resp, "peer")
+
+	require.Len(t, stats, 2)
+	for i, want := range []struct{ utxos, proofHashes int }{
+		{4, 2}, {10, 0},
+	} {
+		require.Equal(t, "peer", stats[i].Peer)
+		require.Zero(t, stats[i].StartIndex)
+		require.Equal(t, want.utxos, stats[i].Utxos)
+		require.Equal(t, want.proofHashes, stats[i].ProofHashes)
+		require.NotZero(t, stats[i].Elapsed)
+	}
+}
@@ -1,16 +1,55 @@
 package neutrino
 
 import (
+	"bytes"
 	"cmp"
+	"errors"
+	"fmt"
+	"math"
 	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
 	"github.com/ltcmweb/ltcd/ltcutil/mweb"
 	"github.com/ltcmweb/ltcd/wire"
 	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/mwebdb"
 	"github.com/ltcmweb/neutrino/query"
 )
 
+// errMwebTipChanged is returned when an mweb utxos fetch is abandoned
+// because the chain tip changed while it was in progress.
+var errMwebTipChanged = errors.New("chain tip changed during mweb " +
+	"utxos fetch")
+
+// ErrMwebNotSynced is returned when the mweb coins db is needed to have been
+// synced, but no mweb utxos have been fetched yet.
+var ErrMwebNotSynced = errors.New("mweb utxos not synced")
+
+// ErrMwebFetchedLeaves is returned when the coins fetched from the mweb coins
+// db for a set of leaves don't match the leaves asked for.
+var ErrMwebFetchedLeaves = errors.New("mweb coins db returned coins not " +
+	"matching the requested leaves")
+
+// ErrMwebUtxosTruncated is returned when a peer serves fewer mweb utxos than
+// requested, though the leafset has more to serve, once more short responses
+// have been served than are accepted.
+var ErrMwebUtxosTruncated = errors.New("mweb utxos response truncated")
+
+const (
+	// mwebMaxUtxosTails is the number of times that the rest of a span of
+	// mweb utxos is requested again after a short response, after which
+	// a short response for the span is rejected.
+	mwebMaxUtxosTails = 4
+
+	// mwebMaxShortResponses is the number of short mwebutxos responses
+	// that a peer may serve during a fetch, after which its short
+	// responses are rejected.
+	mwebMaxShortResponses = 2
+)
+
 // mwebUtxosQuery holds all information necessary to perform and
 // handle a query for mweb utxos.
 type mwebUtxosQuery struct {
@@ -21,19 +60,96 @@ type mwebUtxosQuery struct {
 	heightMap  map[uint32]uint64
 	msgs       []*wire.MsgGetMwebUtxos
 	utxosChan  chan *wire.MsgMwebUtxos
+
+	// tipChanged is closed once the chain tip moves away from the one
+	// at the start of the fetch, or once the mweb header of the new tip
+	// has been prefetched.
+	tipChanged <-chan struct{}
+
+	// done is closed once the fetch returns, cancelling any requests
+	// still in flight.
+	done chan struct{}
+
+	// pending holds the responses that have been written but not yet
+	// delivered to the callbacks, in ascending order of start index. It
+	// is only used when callbacks must be delivered in order, and is
+	// discarded if the fetch is abandoned.
+	pending []*wire.MsgMwebUtxos
+
+	// nextLeafIndex is one past the highest leaf index written by the
+	// batches completed so far. Utxos below it are never written again.
+	nextLeafIndex uint64
+
+	// reserved is the memory reserved from the mweb memory budget for
+	// the responses to the current batch.
+	reserved uint64
+
+	// delivery, if set, runs the utxos callbacks behind the fetch.
+	// Otherwise they're run inline.
+	delivery *mwebUtxosDelivery
+
+	// trackedLeafset, if set, is the leafset that we tracked ourselves
+	// up to the start of the fetch, which each response is cross-checked
+	// against.
+	trackedLeafset *mweb.Leafset
+
+	// archivalLeafIndex is the leaf index below which requests prefer
+	// archival peers.
+	archivalLeafIndex uint64
+
+	// spanBlock, if set, is the block whose leafset the fetch is against,
+	// which the spans of leaves written are recorded against in the mweb
+	// coins db, so that they're skipped if the fetch is cut short by a
+	// restart.
+	spanBlock *chainhash.Hash
+
+	// declinedMtx guards declined.
+	declinedMtx sync.Mutex
+
+	// declined holds the peers that have declined a getmwebutxos
+	// message during this fetch, such as peers that have pruned the
+	// utxos. They are no longer preferred for the fetch's requests.
+	declined map[string]struct{}
+
+	// shortMtx guards tails and shortBy.
+	shortMtx sync.Mutex
+
+	// tails holds the number of times that the rest of a span has been
+	// requested again, by the message requesting it.
+	tails map[*wire.MsgGetMwebUtxos]int
+
+	// shortBy holds the number of short responses that each peer has
+	// served during this fetch.
+	shortBy map[string]int
+
+	// headerPeer, if set, is the peer that served the mweb header that
+	// the utxos are verified against, whose utxos are declined so that
+	// they're served by another peer.
+	headerPeer string
 }
 
-func (b *blockManager) getMwebUtxos(mwebHeader *wire.MwebHeader,
-	newLeafset *mweb.Leafset, blockHash *chainhash.Hash) error {
+// mwebUtxosResume records the point reached by an mweb utxos fetch that
+// was abandoned due to a change of chain tip. Every added leaf below
+// leafIndex was written to the coins db.
+type mwebUtxosResume struct {
+	height    uint32
+	blockHash chainhash.Hash
+	leafIndex uint64
+}
 
-	log.Infof("Fetching set of mweb utxos from "+
-		"height=%v, hash=%v", newLeafset.Height, *blockHash)
+// leafSpan is a contiguous run of leaves to be fetched with a single
+// getmwebutxos message.
+type leafSpan struct {
+	start uint64
+	count uint16
+}
 
-	oldLeafset, err := b.cfg.MwebCoins.GetLeafset()
-	if err != nil {
-		log.Errorf("Couldn't read mweb coins db: %v", err)
-		return err
-	}
+// diffLeafsets compares the old and new leafsets, returning the spans of
+// leaves that were added and the indices of the leaves that were removed.
+// The added spans are in ascending order and each holds no more than
+// wire.MaxMwebUtxosPerQuery leaves.
+func diffLeafsets(oldLeafset, newLeafset *mweb.Leafset) ([]leafSpan,
+	[]uint64) {
 
 	// Skip over common prefix
 	var index uint64
@@ -44,17 +160,13 @@ func (b *blockManager) getMwebUtxos(mwebHeader *wire.MwebHeader,
 	}
 	index *= 8
 
-	type span struct {
-		start uint64
-		count uint16
-	}
-	var addLeaf span
-	var addedLeaves []span
+	var addLeaf leafSpan
+	var addedLeaves []leafSpan
 	var removedLeaves []uint64
 	addLeafSpan := func() {
 		if addLeaf.count > 0 {
 			addedLeaves = append(addedLeaves, addLeaf)
-			addLeaf = span{}
+			addLeaf = leafSpan{}
 		}
 	}
 	for ; index < oldLeafset.Size || index < newLeafset.Size; index++ {
@@ -75,16 +187,146 @@ func (b *blockManager) getMwebUtxos(mwebHeader *wire.MwebHeader,
 	}
 	addLeafSpan()
 
-	b.mwebUtxosCallbacksMtx.Lock()
-	defer b.mwebUtxosCallbacksMtx.Unlock()
+	return addedLeaves, removedLeaves
+}
 
-	batchesCount := len(addedLeaves)
-	if batchesCount == 0 {
-		return b.purgeSpentMwebTxos(newLeafset, removedLeaves)
+// DiffLeafsets compares two mweb leafset bitmaps, such as those stored at
+// two different heights, returning the indices of the leaves that were
+// added and of those that were removed, each in ascending order. Leaf i is
+// bit i counting from the most significant bit of the first byte, and the
+// bitmaps may be of different lengths, with the missing bytes of the
+// shorter taken as zero.
+func DiffLeafsets(oldLeafset, newLeafset []byte) (added, removed []uint64) {
+	newSet := &mweb.Leafset{
+		Bits: newLeafset,
+		Size: uint64(len(newLeafset)) * 8,
 	}
+	spans, removed := diffLeafsets(&mweb.Leafset{
+		Bits: oldLeafset,
+		Size: uint64(len(oldLeafset)) * 8,
+	}, newSet)
 
-	log.Infof("Starting to query for mweb utxos from index=%v", addedLeaves[0].start)
-	log.Infof("Attempting to query for %v mwebutxos batches", batchesCount)
+	// Like a getmwebutxos request, each span counts the unspent leaves
+	// from its start, skipping over those in neither leafset.
+	for _, span := range spans {
+		for i, n := span.start, span.count; n > 0; i++ {
+			if newSet.Contains(i) {
+				added = append(added, i)
+				n--
+			}
+		}
+	}
+	return added, removed
+}
+
+// validateLeafSpans checks that the given spans are non-empty, in ascending
+// order and don't overlap, so that no leaf is ever fetched and written
+// twice.
+func validateLeafSpans(spans []leafSpan) error {
+	for i, span := range spans {
+		if span.count == 0 || span.count > wire.MaxMwebUtxosPerQuery {
+			return fmt.Errorf("leaf span at index %v has invalid "+
+				"count %v", span.start, span.count)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := spans[i-1]
+		if span.start < prev.start+uint64(prev.count) {
+			return fmt.Errorf("leaf span at index %v overlaps "+
+				"span at index %v with count %v", span.start,
+				prev.start, prev.count)
+		}
+	}
+	return nil
+}
+
+// mwebLeafsetsEqual returns whether the two leafsets are identical, both in
+// their unspent leaves and in the block they were taken at.
+func mwebLeafsetsEqual(a, b *mweb.Leafset) bool {
+	if a.Size != b.Size || a.Height != b.Height ||
+		!bytes.Equal(a.Bits, b.Bits) {
+
+		return false
+	}
+	if a.Block == nil || b.Block == nil {
+		return a.Block == b.Block
+	}
+	return a.Block.BlockHash() == b.Block.BlockHash()
+}
+
+// trimLeafSpans returns the spans with any leaves before the given index
+// removed.
+func trimLeafSpans(spans []leafSpan, index uint64) []leafSpan {
+	var trimmed []leafSpan
+	for _, span := range spans {
+		end := span.start + uint64(span.count)
+		switch {
+		case end <= index:
+			continue
+		case span.start < index:
+			span.count = uint16(end - index)
+			span.start = index
+		}
+		trimmed = append(trimmed, span)
+	}
+	return trimmed
+}
+
+func (b *blockManager) getMwebUtxos(mwebHeader *wire.MwebHeader,
+	newLeafset *mweb.Leafset, blockHash *chainhash.Hash) error {
+
+	oldLeafset, err := b.cfg.MwebCoins.GetLeafset()
+	if err != nil {
+		log.Errorf("Couldn't read mweb coins db: %v", err)
+		return err
+	}
+
+	// There's nothing to do if we already have this exact leafset.
+	if mwebLeafsetsEqual(oldLeafset, newLeafset) {
+		log.Debugf("Mweb utxos already up to date at height=%v, "+
+			"hash=%v", newLeafset.Height, *blockHash)
+		return nil
+	}
+
+	log.Infof("Fetching set of mweb utxos from "+
+		"height=%v, hash=%v", newLeafset.Height, *blockHash)
+
+	// If the previous fetch was abandoned part way through, treat the
+	// leaves it already wrote as known so that we don't fetch them
+	// again.
+	resumeLeafset, err := b.resumeMwebLeafset(
+		oldLeafset, newLeafset, blockHash,
+	)
+	if err != nil {
+		log.Errorf("Couldn't read mweb coins db: %v", err)
+		return err
+	}
+	addedLeaves, removedLeaves := diffLeafsets(resumeLeafset, newLeafset)
+	if err := validateLeafSpans(addedLeaves); err != nil {
+		log.Errorf("Invalid mweb leaf spans: %v", err)
+		return err
+	}
+	addedLeaves = b.prioritizeLeafSpans(b.orderLeafSpans(addedLeaves))
+
+	// The output MMR normally only grows, but a reorg can shrink it. The
+	// leaves past the new size are among those removed by the diff, and
+	// the leaf counts of the blocks that were disconnected must go too,
+	// as they no longer describe the chain.
+	if newLeafset.Size < oldLeafset.Size {
+		log.Infof("Output MMR shrank from %v to %v leaves, rolling "+
+			"back mweb leaves", oldLeafset.Size, newLeafset.Size)
+
+		err := b.cfg.MwebCoins.RollbackLeavesAtHeight(newLeafset.Height)
+		if err != nil {
+			log.Errorf("Couldn't roll back leaves at height: %v",
+				err)
+			return err
+		}
+	}
+
+	b.mwebUtxosCallbacksMtx.Lock()
+	defer b.mwebUtxosCallbacksMtx.Unlock()
 
 	// Load the block height to leaf count mapping so that we can
 	// work out roughly when a utxo was included in a block.
@@ -93,11 +335,27 @@ func (b *blockManager) getMwebUtxos(mwebHeader *wire.MwebHeader,
 		log.Errorf("Couldn't get leaves at height from db: %v", err)
 		return err
 	}
-	heights := make([]uint32, 0, len(heightMap))
-	for height := range heightMap {
-		heights = append(heights, height)
+
+	// Skip the leaves created before the sync start height, if one was
+	// set. Their coins are never stored, so there's nothing to purge
+	// when they're spent.
+	if startIndex := b.mwebSyncStartLeaf(heightMap); startIndex > 0 {
+		addedLeaves = trimLeafSpans(addedLeaves, startIndex)
+		removedLeaves = slices.DeleteFunc(removedLeaves,
+			func(leaf uint64) bool {
+				return leaf < startIndex
+			},
+		)
+	}
+
+	batchesCount := len(addedLeaves)
+	if batchesCount == 0 {
+		return b.purgeSpentMwebTxos(newLeafset, removedLeaves)
 	}
-	slices.Sort(heights)
+
+	log.Infof("Starting to query for mweb utxos from index=%v", addedLeaves[0].start)
+	log.Infof("Attempting to query for %v mwebutxos batches", batchesCount)
+	heights := sortedHeights(heightMap)
 
 	// With the set of messages constructed, we'll now request the
 	// batch all at once. This message will distribute the mwebutxos
@@ -110,45 +368,217 @@ func (b *blockManager) getMwebUtxos(mwebHeader *wire.MwebHeader,
 		heights:    heights,
 		heightMap:  heightMap,
 		utxosChan:  make(chan *wire.MsgMwebUtxos),
+		done:       make(chan struct{}),
+		delivery:   b.newMwebUtxosDelivery(),
+		spanBlock:  blockHash,
+	}
+	defer close(q.done)
+	defer q.delivery.wait()
+
+	if b.cfg.StrictMwebLeafsetCheck && b.isMwebLeafsetInChain(oldLeafset) {
+		q.trackedLeafset = oldLeafset
+	}
+
+	// The header may come from one peer and the utxos from another, as
+	// the utxos are verified against the header whoever serves them. We
+	// can insist on that, so that a single peer can't serve us both.
+	if b.cfg.MwebDistinctUtxosPeer {
+		if known, ok := b.mwebHeaders.get(*blockHash); ok {
+			q.headerPeer = known.servedBy
+		}
 	}
 
+	// Old leaves are fetched from archival peers where possible, as
+	// pruned peers may struggle to serve them.
+	if b.cfg.MwebArchivalPeer != nil {
+		q.archivalLeafIndex = mwebArchivalLeafIndex(
+			heights, heightMap, newLeafset.Height,
+		)
+	}
+
+	// Watch for the chain tip changing underneath us, in which case
+	// the leafset we're fetching against is already stale. If the mweb
+	// header of the new tip is being prefetched, we keep fetching until
+	// it's ready, as there's nothing to fetch against in the meantime.
+	if b.mwebHeaderPrefetch != nil {
+		q.tipChanged = b.mwebHeaderPrefetch.done
+	} else {
+		q.tipChanged = b.watchMwebTip(q.done)
+	}
+
+	progress := b.newMwebSyncProgress(newLeafset.Height, addedLeaves)
 	totalUtxos := 0
 	for len(addedLeaves) > 0 {
-		for _, addLeaf := range addedLeaves {
+		// Each batch must be in ascending order, so a batch ends
+		// where the prioritized spans give way to the rest. As the
+		// rest start over from a lower index, the leaves written so
+		// far no longer bound those still to come.
+		if addedLeaves[0].start < q.nextLeafIndex {
+			q.nextLeafIndex = 0
+		}
+
+		// The batch also ends once the memory budget is used up. The
+		// first message of a batch waits for memory to be freed
+		// instead, so that dispatch stalls while over budget.
+		var err error
+		spanSize := b.mwebBatchSizer.spanSize()
+		for i := 0; i < len(addedLeaves); i++ {
+			if i > 0 &&
+				addedLeaves[i].start < addedLeaves[i-1].start {
+
+				break
+			}
+
+			// Each message asks for no more utxos than suits our
+			// peers, with the rest of its span left for later.
+			head, tail := splitLeafSpan(
+				newLeafset, addedLeaves[i], spanSize,
+			)
+			if tail.count > 0 {
+				addedLeaves[i] = head
+				addedLeaves = slices.Insert(
+					addedLeaves, i+1, tail,
+				)
+			}
+			addLeaf := addedLeaves[i]
+
+			var reserved uint64
+			if i == 0 {
+				reserved, err = b.reserveMwebMemory(
+					addLeaf.count, q.tipChanged,
+				)
+				if err != nil {
+					break
+				}
+			} else {
+				reserved = mwebUtxosMemory(addLeaf.count)
+				if b.mwebMemory.reserve(reserved) != nil {
+					break
+				}
+			}
+			q.reserved += reserved
 			q.msgs = append(q.msgs, wire.NewMsgGetMwebUtxos(*blockHash,
 				addLeaf.start, addLeaf.count, wire.MwebNetUtxoCompact))
-			if len(q.msgs) == 10 {
+			if len(q.msgs) == mwebUtxosBatchMsgs {
 				break
 			}
 		}
 		addedLeaves = addedLeaves[len(q.msgs):]
 
-		count, err := b.getMwebUtxosBatch(q)
-		if err != nil {
+		var batchLeaves uint64
+		for _, msg := range q.msgs {
+			batchLeaves += uint64(msg.NumRequested)
+		}
+
+		var count int
+		if err == nil {
+			count, err = b.getMwebUtxosBatch(q)
+		}
+		if err == errMwebTipChanged || err == errMwebCancelled {
+			// All the leaves before the first outstanding message
+			// or span have been written, so the next fetch can
+			// skip them as long as it builds on this block.
+			// The responses written but held back from the
+			// callbacks to keep them in order are fetched again.
+			resumeIndex := q.discardPending()
+			if len(q.msgs) > 0 &&
+				q.msgs[0].StartIndex < resumeIndex {
+
+				resumeIndex = q.msgs[0].StartIndex
+			}
+			for _, addLeaf := range addedLeaves {
+				if addLeaf.start < resumeIndex {
+					resumeIndex = addLeaf.start
+				}
+			}
+			b.mwebUtxosResume = &mwebUtxosResume{
+				height:    newLeafset.Height,
+				blockHash: *blockHash,
+				leafIndex: resumeIndex,
+			}
+			log.Infof("Abandoning mweb utxos fetch at index=%v: "+
+				"%v", resumeIndex, err)
+			return err
+		} else if err != nil {
 			return err
 		}
 		totalUtxos += count
+		progress.batchDone(batchLeaves)
 	}
 
 	log.Infof("Successfully got %v mweb utxos", totalUtxos)
 
+	// The added utxos must all have reached the callbacks before the
+	// spent ones are purged.
+	q.delivery.wait()
+
 	return b.purgeSpentMwebTxos(newLeafset, removedLeaves)
 }
 
 func (b *blockManager) getMwebUtxosBatch(q *mwebUtxosQuery) (int, error) {
 	// Hand the queries to the work manager, and consume the
-	// verified responses as they come back.
+	// verified responses as they come back. The queries are cancelled
+	// as soon as we stop consuming them.
+	cancelled := b.mwebPause.cancelledChan()
+	cancel := make(chan struct{})
+	builder := q.requestBuilder(cancel)
 	errChan := b.cfg.QueryDispatcher.Query(
-		q.requests(), query.Cancel(b.quit))
+		mwebRequests(builder, q.msgs), builder.options()...,
+	)
+	defer func() {
+		b.stopMwebQuery(cancel, errChan)
+
+		// The batch's responses have all been handled or abandoned
+		// by now, so their memory can go to the next batch once the
+		// callbacks are through with them.
+		q.releaseMemory(q.reserved)
+		q.reserved = 0
+	}()
 
 	// Keep waiting for more mwebutxos as long as we haven't received an
 	// answer for our last getmwebutxos, and no error is encountered.
 	totalUtxos := 0
+	batchNextLeafIndex := q.nextLeafIndex
+	tailErrChan := make(chan error)
+
+	// The verified responses are buffered until they're written. Large
+	// batches are written response by response, so that they needn't
+	// all be held in memory at once, while small ones are written in one
+	// go to save on database transactions. Whatever was verified is
+	// still written if the batch is abandoned, as the next fetch skips
+	// the leaves before the first outstanding message.
+	var (
+		streaming = b.mwebBatchStreams(q.msgs)
+		buffered  []*wire.MsgMwebUtxos
+		proofs    []*mwebdb.UtxosProof
+	)
+	flush := func() error {
+		if len(buffered) == 0 {
+			return nil
+		}
+		if err := b.writeMwebUtxos(q, buffered, proofs); err != nil {
+			return err
+		}
+		for _, r := range buffered {
+			totalUtxos += len(r.Utxos)
+		}
+		buffered, proofs = nil, nil
+		return nil
+	}
 	for len(q.msgs) > 0 {
 		var r *wire.MsgMwebUtxos
 		select {
 		case r = <-q.utxosChan:
+		case err := <-tailErrChan:
+			if err == query.ErrWorkManagerShuttingDown {
+				return totalUtxos, ErrShuttingDown
+			}
+			log.Errorf("Query for the rest of a partial mwebutxos "+
+				"response failed: %v", err)
+			return totalUtxos, err
+
 		case err := <-errChan:
+			errChan = nil
 			switch {
 			case err == query.ErrWorkManagerShuttingDown:
 				return totalUtxos, ErrShuttingDown
@@ -162,6 +592,18 @@ func (b *blockManager) getMwebUtxosBatch(q *mwebUtxosQuery) (int, error) {
 			// picking up the last mwebutxos sent on the utxosChan.
 			continue
 
+		case <-q.tipChanged:
+			if err := flush(); err != nil {
+				return totalUtxos, err
+			}
+			return totalUtxos, errMwebTipChanged
+
+		case <-cancelled:
+			if err := flush(); err != nil {
+				return totalUtxos, err
+			}
+			return totalUtxos, errMwebCancelled
+
 		case <-b.quit:
 			return totalUtxos, ErrShuttingDown
 		}
@@ -178,39 +620,294 @@ func (b *blockManager) getMwebUtxosBatch(q *mwebUtxosQuery) (int, error) {
 		if !ok {
 			continue
 		}
-		q.msgs = append(q.msgs[:index], q.msgs[index+1:]...)
+
+		// If the peer served only part of the span, request the rest
+		// of it again, starting from the next unspent leaf.
+		msg := q.msgs[index]
+		numUtxos := uint16(len(r.Utxos))
+		nextIndex := uint64(leafsetNextUnspent(
+			q.leafset, leafIdx(lastIndex),
+		))
+		if numUtxos < msg.NumRequested && nextIndex < q.leafset.Size {
+			log.Debugf("Got %v of %v mwebutxos from index=%v, "+
+				"requesting the rest from index=%v", numUtxos,
+				msg.NumRequested, startIndex, nextIndex)
+
+			q.msgs[index] = wire.NewMsgGetMwebUtxos(
+				msg.BlockHash, nextIndex,
+				msg.NumRequested-numUtxos, msg.OutputFormat,
+			)
+			q.addTail(msg, q.msgs[index])
+			b.requestMwebUtxosTail(
+				builder, q.msgs[index], tailErrChan,
+			)
+		} else {
+			q.msgs = append(q.msgs[:index], q.msgs[index+1:]...)
+		}
 
 		log.Debugf("Got mwebutxos from index=%v to index=%v, "+
 			"block hash=%v", startIndex, lastIndex, r.BlockHash)
 
-		// Calculate rough heights for each utxo.
-		for _, utxo := range r.Utxos {
-			index, _ := slices.BinarySearchFunc(q.heights, utxo.LeafIndex,
-				func(height uint32, target uint64) int {
-					return cmp.Compare(q.heightMap[height]-1, target)
+		// The proof covers the utxos as served, before any that
+		// overlap an earlier batch are dropped.
+		var proof *mwebdb.UtxosProof
+		if b.cfg.MwebProofs != nil {
+			proof = newMwebUtxosProof(q.mwebHeader, r)
+		}
+
+		// Drop any utxos that an earlier batch already wrote, so
+		// that they aren't written or notified twice. Responses within
+		// a batch may arrive in any order, so only completed batches
+		// are considered.
+		if startIndex < q.nextLeafIndex {
+			log.Warnf("Dropping mwebutxos from index=%v "+
+				"overlapping leaves already written up to "+
+				"index=%v",
+				startIndex, q.nextLeafIndex-1)
+
+			r.Utxos = slices.DeleteFunc(r.Utxos,
+				func(utxo *wire.MwebNetUtxo) bool {
+					return utxo.LeafIndex < q.nextLeafIndex
 				})
-			if index < len(q.heights) {
-				utxo.Height = int32(q.heights[index])
-			} else {
-				utxo.Height = int32(q.leafset.Height)
+			if len(r.Utxos) == 0 {
+				continue
 			}
 		}
+		if lastIndex >= batchNextLeafIndex {
+			batchNextLeafIndex = lastIndex + 1
+		}
 
-		if err := b.cfg.MwebCoins.PutCoins(r.Utxos); err != nil {
-			log.Errorf("Couldn't write mweb coins: %v", err)
-			return totalUtxos, err
+		// Calculate rough heights for each utxo.
+		for _, utxo := range r.Utxos {
+			utxo.Height = int32(q.leafHeight(utxo.LeafIndex))
 		}
 
-		for _, cb := range b.mwebUtxosCallbacks {
-			cb(nil, r.Utxos)
+		buffered = append(buffered, r)
+		proofs = append(proofs, proof)
+		if !streaming {
+			continue
 		}
+		if err := flush(); err != nil {
+			return totalUtxos, err
+		}
+	}
 
-		totalUtxos += len(r.Utxos)
+	if err := flush(); err != nil {
+		return totalUtxos, err
 	}
+	q.nextLeafIndex = batchNextLeafIndex
 
 	return totalUtxos, nil
 }
 
+// mwebBatchStreams returns whether the responses to a batch of getmwebutxos
+// messages are written to the mweb coins db as each is verified, which is
+// the case if the batch is estimated to take up more memory than the
+// MwebStreamThreshold. Otherwise they're written in one go once they've all
+// been verified.
+func (b *blockManager) mwebBatchStreams(
+	msgs []*wire.MsgGetMwebUtxos) bool {
+
+	var memory uint64
+	for _, msg := range msgs {
+		memory += mwebUtxosMemory(msg.NumRequested)
+	}
+	return memory > b.cfg.MwebStreamThreshold
+}
+
+// writeMwebUtxos writes the verified mweb utxos responses to the mweb coins
+// db in a single write, stores the proofs given for them, if any, and then
+// delivers them to the callbacks.
+func (b *blockManager) writeMwebUtxos(q *mwebUtxosQuery,
+	resps []*wire.MsgMwebUtxos, proofs []*mwebdb.UtxosProof) error {
+
+	var utxos []*wire.MwebNetUtxo
+	for _, r := range resps {
+		utxos = append(utxos, r.Utxos...)
+	}
+	err := b.retryMwebWrite(func() error {
+		return b.cfg.MwebCoins.PutCoins(utxos)
+	})
+	if err != nil {
+		log.Errorf("Couldn't write mweb coins: %v", err)
+		return err
+	}
+
+	// Failing to store a proof doesn't affect the sync, only what can
+	// be verified again later.
+	for _, proof := range proofs {
+		if proof == nil {
+			continue
+		}
+		if err := b.cfg.MwebProofs.PutProof(proof); err != nil {
+			log.Warnf("Couldn't store mweb utxos proof: %v", err)
+		}
+	}
+
+	// Only the spans of the responses delivered are recorded, so that
+	// those held back are fetched again if the fetch is cut short.
+	delivered := resps
+	if b.cfg.OrderedMwebCallbacks {
+		delivered = q.deliverOrdered(resps)
+	} else {
+		for _, r := range resps {
+			q.deliver(r.Utxos)
+		}
+	}
+	b.recordVerifiedMwebSpans(q, delivered)
+
+	return nil
+}
+
+// requestMwebUtxosTail dispatches a getmwebutxos message for the rest of a
+// span that a peer only partly served. If the query fails, its error is
+// sent on errChan unless the batch has been cancelled by then.
+func (b *blockManager) requestMwebUtxosTail(builder *mwebRequestBuilder,
+	msg *wire.MsgGetMwebUtxos, errChan chan<- error) {
+
+	cancel := builder.cancel
+	queryErrChan := b.cfg.QueryDispatcher.Query(
+		builder.requests(msg), builder.options()...,
+	)
+	go func() {
+		var err error
+		select {
+		case err = <-queryErrChan:
+		case <-cancel:
+			return
+		}
+		if err == nil {
+			return
+		}
+
+		select {
+		case errChan <- err:
+		case <-cancel:
+		}
+	}()
+}
+
+// refetchMwebRange fetches the unspent mweb utxos with leaf indices in the
+// given range again from our peers, overwriting those stored in the coins
+// db once they have been verified. The utxos are fetched as of the block
+// that the coins db was last synced to, and are delivered to the utxos
+// callbacks like any others.
+func (b *blockManager) refetchMwebRange(start, count uint64) error {
+	b.mwebUtxosCallbacksMtx.Lock()
+	defer b.mwebUtxosCallbacksMtx.Unlock()
+
+	leafset, err := b.cfg.MwebCoins.GetLeafset()
+	if err != nil {
+		return err
+	}
+	if leafset.Block == nil {
+		return ErrMwebNotSynced
+	}
+
+	end := start + count
+	if end < start || end > leafset.Size {
+		end = leafset.Size
+	}
+	var leaves []uint64
+	for i := start; i < end; i++ {
+		if leafset.Contains(i) {
+			leaves = append(leaves, i)
+		}
+	}
+
+	log.Infof("Refetching mweb utxos from index=%v to index=%v at "+
+		"height=%v", start, end-1, leafset.Height)
+
+	total, err := b.fetchSyncedMwebLeaves(leafset, leaves)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Refetched %v mweb utxos", total)
+
+	return nil
+}
+
+// fetchSyncedMwebLeaves fetches the mweb utxos of the given leaves that are
+// unspent in the leafset that the coins db was last synced to, writing them
+// to the coins db once verified and delivering them to the utxos callbacks.
+// It returns the number of utxos fetched. The caller must hold the
+// mwebUtxosCallbacksMtx.
+func (b *blockManager) fetchSyncedMwebLeaves(leafset *mweb.Leafset,
+	leaves []uint64) (int, error) {
+
+	blockHash := leafset.Block.BlockHash()
+
+	// The leafset served by our peers must match the one we synced,
+	// otherwise we'd be fetching a different set of utxos.
+	mwebHeader, mwebLeafset, err := b.fetchMwebHeaderAndLeafset(&blockHash)
+	if err != nil {
+		return 0, err
+	}
+	if mwebHeader.MwebHeader.OutputMMRSize != leafset.Size ||
+		!bytes.Equal(mwebLeafset.Leafset, leafset.Bits) {
+
+		return 0, fmt.Errorf("mweb leafset at block %v doesn't match "+
+			"the coins db", blockHash)
+	}
+
+	// The spans to fetch are those that would be added to a leafset
+	// missing the leaves.
+	without := &mweb.Leafset{
+		Bits: append([]byte(nil), leafset.Bits...),
+		Size: leafset.Size,
+	}
+	for _, i := range leaves {
+		if i < leafset.Size {
+			without.Bits[i/8] &^= 0x80 >> (i % 8)
+		}
+	}
+	spans, _ := diffLeafsets(without, leafset)
+	if len(spans) == 0 {
+		return 0, nil
+	}
+
+	heightMap, err := b.cfg.MwebCoins.GetLeavesAtHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	q := &mwebUtxosQuery{
+		blockMgr:   b,
+		mwebHeader: &mwebHeader.MwebHeader,
+		leafset:    leafset,
+		heights:    sortedHeights(heightMap),
+		heightMap:  heightMap,
+		utxosChan:  make(chan *wire.MsgMwebUtxos),
+		done:       make(chan struct{}),
+		delivery:   b.newMwebUtxosDelivery(),
+	}
+	defer close(q.done)
+	defer q.delivery.wait()
+
+	var total int
+	for len(spans) > 0 {
+		for _, span := range spans {
+			q.msgs = append(q.msgs, wire.NewMsgGetMwebUtxos(
+				blockHash, span.start, span.count,
+				wire.MwebNetUtxoCompact,
+			))
+			if len(q.msgs) == mwebUtxosBatchMsgs {
+				break
+			}
+		}
+		spans = spans[len(q.msgs):]
+
+		n, err := b.getMwebUtxosBatch(q)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
 func (b *blockManager) purgeSpentMwebTxos(
 	leafset *mweb.Leafset, removedLeaves []uint64) error {
 
@@ -218,29 +915,627 @@ func (b *blockManager) purgeSpentMwebTxos(
 		log.Infof("Purging %v spent mweb txos from db", len(removedLeaves))
 	}
 
-	err := b.cfg.MwebCoins.PutLeafsetAndPurge(leafset, removedLeaves)
+	prevLeafset, err := b.cfg.MwebCoins.GetLeafset()
+	if err != nil {
+		log.Errorf("Couldn't read mweb coins db: %v", err)
+		return err
+	}
+
+	err = b.retryMwebWrite(func() error {
+		return b.putLeafsetAndPurge(leafset, removedLeaves)
+	})
 	if err != nil {
 		log.Errorf("Couldn't purge mweb txos: %v", err)
 		return err
 	}
 
+	// The stored leafset has moved on, so any resume point from an
+	// abandoned fetch no longer applies.
+	b.mwebUtxosResume = nil
+	b.clearVerifiedMwebSpans()
+
 	for _, cb := range b.mwebUtxosCallbacks {
 		cb(leafset, nil)
 	}
+	b.notifyMwebBlock(prevLeafset, leafset)
 
 	return nil
 }
 
-// requests creates the query.Requests for this mwebutxos query.
-func (m *mwebUtxosQuery) requests() []*query.Request {
-	reqs := make([]*query.Request, len(m.msgs))
-	for idx, msg := range m.msgs {
-		reqs[idx] = &query.Request{
-			Req:        msg,
-			HandleResp: m.handleResponse,
+// proveMwebUtxo fetches a fresh inclusion proof for the mweb utxo at the
+// given leaf index from our peers, verifying it against the mweb header and
+// leafset at the current chain tip. It returns false without an error if
+// the leaf is spent at the tip.
+func (b *blockManager) proveMwebUtxo(leafIndex uint64) (bool, error) {
+	header, height, err := b.cfg.BlockHeaders.ChainTip()
+	if err != nil {
+		return false, err
+	}
+	blockHash := header.BlockHash()
+
+	mwebHeader, mwebLeafset, err := b.fetchMwebHeaderAndLeafset(&blockHash)
+	if err != nil {
+		return false, err
+	}
+
+	leafset := &mweb.Leafset{
+		Bits:   mwebLeafset.Leafset,
+		Size:   mwebHeader.MwebHeader.OutputMMRSize,
+		Height: height,
+		Block:  header,
+	}
+	if !leafset.Contains(leafIndex) {
+		log.Debugf("Mweb utxo at index=%v is spent at height=%v",
+			leafIndex, height)
+		return false, nil
+	}
+
+	q := &mwebUtxosQuery{
+		blockMgr:   b,
+		mwebHeader: &mwebHeader.MwebHeader,
+		leafset:    leafset,
+		msgs: []*wire.MsgGetMwebUtxos{
+			wire.NewMsgGetMwebUtxos(blockHash, leafIndex, 1,
+				wire.MwebNetUtxoCompact),
+		},
+		utxosChan: make(chan *wire.MsgMwebUtxos),
+		done:      make(chan struct{}),
+	}
+
+	// Responses with a bad proof are rejected by the response handler,
+	// and the peer banned, so an error here means that no peer could
+	// prove the utxo.
+	builder := q.requestBuilder(q.done)
+	errChan := b.cfg.QueryDispatcher.Query(
+		mwebRequests(builder, q.msgs), builder.options()...,
+	)
+	defer func() {
+		b.stopMwebQuery(q.done, errChan)
+	}()
+
+	select {
+	case <-q.utxosChan:
+		return true, nil
+
+	case err := <-errChan:
+		errChan = nil
+		if err == nil {
+			err = errors.New("query finished without a response")
+		}
+		return false, fmt.Errorf("unable to prove mweb utxo at "+
+			"index %v: %w", leafIndex, err)
+
+	case <-b.quit:
+		return false, ErrShuttingDown
+	}
+}
+
+// stopMwebQuery cancels an mweb query given to the query dispatcher. If
+// we're shutting down, we then give the dispatcher up to the quit timeout
+// to report the cancellation on errChan, so that the query isn't left
+// running behind us. A nil errChan means the query already finished.
+func (b *blockManager) stopMwebQuery(cancel chan struct{},
+	errChan <-chan error) {
+
+	close(cancel)
+
+	select {
+	case <-b.quit:
+	default:
+		return
+	}
+	if errChan == nil || b.cfg.MwebQuitTimeout <= 0 {
+		return
+	}
+
+	select {
+	case err := <-errChan:
+		log.Debugf("Mweb query stopped on shutdown: %v", err)
+	case <-time.After(b.cfg.MwebQuitTimeout):
+		log.Warnf("Mweb query wasn't cancelled within %v of "+
+			"shutdown", b.cfg.MwebQuitTimeout)
+	}
+}
+
+// recordMwebFailure hands an mweb message that failed verification to the
+// failure sink, if there is one.
+func (b *blockManager) recordMwebFailure(peerAddr string, msg wire.Message,
+	reason banman.Reason, err error) {
+
+	if b.cfg.MwebFailureSink == nil {
+		return
+	}
+	b.cfg.MwebFailureSink.RecordMwebFailure(peerAddr, msg, reason, err)
+}
+
+// punishPeer consults the ban policy about a peer that served us invalid
+// mweb data for the given reason, banning the peer if it decides to.
+func (b *blockManager) punishPeer(peerAddr string, reason banman.Reason) {
+	policy := b.cfg.BanPolicy
+	if policy == nil {
+		policy = banOnFirstOffense{}
+	}
+	if !policy.ShouldBan(peerAddr, reason) {
+		log.Debugf("Not banning peer %v (%v) due to ban policy",
+			peerAddr, reason)
+		return
+	}
+
+	err := b.banPeer(peerAddr, reason)
+	if err != nil {
+		log.Errorf("Unable to ban peer %v: %v", peerAddr, err)
+	}
+}
+
+// watchMwebTip returns a channel that is closed once the chain tip changes
+// from the current one, or never if done is closed first.
+func (b *blockManager) watchMwebTip(done <-chan struct{}) <-chan struct{} {
+	b.newHeadersMtx.RLock()
+	startTip := b.headerTipHash
+	b.newHeadersMtx.RUnlock()
+
+	tipChanged := make(chan struct{})
+	go func() {
+		b.newHeadersSignal.L.Lock()
+		defer b.newHeadersSignal.L.Unlock()
+
+		for b.headerTipHash == startTip {
+			select {
+			case <-done:
+				return
+			case <-b.quit:
+				return
+			default:
+			}
+			b.newHeadersSignal.Wait()
+		}
+		close(tipChanged)
+	}()
+
+	// Wake the watcher once we're done so that it can exit.
+	go func() {
+		select {
+		case <-done:
+		case <-b.quit:
 		}
+		b.newHeadersSignal.L.Lock()
+		b.newHeadersSignal.Broadcast()
+		b.newHeadersSignal.L.Unlock()
+	}()
+
+	return tipChanged
+}
+
+// isMwebLeafsetInChain returns whether the block of the leafset is still in
+// our best chain, so that no block spending its leaves has been
+// disconnected since.
+func (b *blockManager) isMwebLeafsetInChain(leafset *mweb.Leafset) bool {
+	if leafset.Block == nil {
+		return false
+	}
+
+	header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(leafset.Height)
+	if err != nil {
+		return false
 	}
-	return reqs
+
+	return header.BlockHash() == leafset.Block.BlockHash()
+}
+
+// resumeMwebLeafset returns the old leafset to diff the new one against.
+// If the last fetch was abandoned on a block that the new leafset builds
+// upon, the leaves of the new leafset that it already wrote are included,
+// as are those in the spans that the mweb coins db recorded as verified and
+// stored before a restart. This is safe because the output MMR is append
+// only along a chain, so a leaf that is still unspent refers to the same
+// output. The leaves in those spans whose coins were written but that the
+// new leafset has since spent are included too, so that the diff purges
+// them.
+func (b *blockManager) resumeMwebLeafset(oldLeafset,
+	newLeafset *mweb.Leafset, blockHash *chainhash.Hash) (*mweb.Leafset,
+	error) {
+
+	spans := b.verifiedMwebSpans(newLeafset, blockHash)
+
+	resume := b.mwebUtxosResume
+	if resume != nil && b.isMwebBlockInChain(
+		resume.height, resume.blockHash, newLeafset.Height,
+	) {
+		log.Infof("Resuming mweb utxos fetch from index=%v",
+			resume.leafIndex)
+
+		spans = append(spans, mwebdb.VerifiedSpan{
+			End: resume.leafIndex,
+		})
+	} else if resume != nil {
+		log.Debugf("Discarding mweb utxos resume point at "+
+			"height=%v", resume.height)
+	}
+
+	if len(spans) == 0 {
+		return oldLeafset, nil
+	}
+
+	leafset := &mweb.Leafset{
+		Size:   oldLeafset.Size,
+		Height: oldLeafset.Height,
+		Block:  oldLeafset.Block,
+	}
+	for i := range spans {
+		if spans[i].End > newLeafset.Size {
+			spans[i].End = newLeafset.Size
+		}
+		if leafset.Size < spans[i].End {
+			leafset.Size = spans[i].End
+		}
+	}
+	leafset.Bits = make([]byte, (leafset.Size+7)/8)
+	copy(leafset.Bits, oldLeafset.Bits)
+	var spent []uint64
+	for _, span := range spans {
+		for i := span.Start; i < span.End; i++ {
+			switch {
+			case newLeafset.Contains(i):
+				leafset.Bits[i/8] |= 0x80 >> (i % 8)
+			case !oldLeafset.Contains(i):
+				spent = append(spent, i)
+			}
+		}
+	}
+	if len(spent) == 0 {
+		return leafset, nil
+	}
+
+	// Only the spent leaves whose coins are stored can be purged.
+	fetchLeaves := b.cfg.MwebCoins.FetchLeaves
+	if marker, ok := b.cfg.MwebCoins.(mwebCoinMarker); ok {
+		fetchLeaves = marker.FetchLeavesUnchecked
+	}
+	coins, err := fetchLeaves(spent)
+	if err != nil {
+		return nil, err
+	}
+	for _, coin := range coins {
+		i := coin.LeafIndex
+		leafset.Bits[i/8] |= 0x80 >> (i % 8)
+	}
+
+	return leafset, nil
+}
+
+// isMwebBlockInChain returns whether the block with the given height and
+// hash is in our chain, at or below the given height.
+func (b *blockManager) isMwebBlockInChain(height uint32,
+	blockHash chainhash.Hash, maxHeight uint32) bool {
+
+	if height > maxHeight {
+		return false
+	}
+	header, err := b.cfg.BlockHeaders.FetchHeaderByHeight(height)
+	return err == nil && header.BlockHash() == blockHash
+}
+
+// prioritizeLeafSpans moves the spans holding any leaves that pass the
+// interest filter to the front, keeping the order of the spans otherwise.
+// This isn't done if callbacks must be delivered in leaf index order.
+func (b *blockManager) prioritizeLeafSpans(spans []leafSpan) []leafSpan {
+	filter := b.cfg.MwebInterestFilter
+	if filter == nil || b.cfg.OrderedMwebCallbacks {
+		return spans
+	}
+
+	var prioritized, rest []leafSpan
+	for _, span := range spans {
+		interested := false
+		for i := uint64(0); i < uint64(span.count); i++ {
+			if filter(span.start + i) {
+				interested = true
+				break
+			}
+		}
+		if interested {
+			prioritized = append(prioritized, span)
+		} else {
+			rest = append(rest, span)
+		}
+	}
+
+	if len(prioritized) > 0 {
+		log.Infof("Prioritizing %v of %v mweb utxos spans",
+			len(prioritized), len(spans))
+	}
+
+	return append(prioritized, rest...)
+}
+
+// sortedHeights returns the heights of the height map in ascending order.
+func sortedHeights(heightMap map[uint32]uint64) []uint32 {
+	heights := make([]uint32, 0, len(heightMap))
+	for height := range heightMap {
+		heights = append(heights, height)
+	}
+	slices.Sort(heights)
+	return heights
+}
+
+// mwebSyncStartLeaf returns the index of the first leaf that may have been
+// created at or after the mweb sync start height, according to the leaf
+// counts of the blocks in the height map. As not every block's leaf count is
+// stored, the count of the nearest block before the start height is used.
+func (b *blockManager) mwebSyncStartLeaf(heightMap map[uint32]uint64) uint64 {
+	return mwebStartLeaf(
+		heightMap, atomic.LoadUint32(&b.mwebSyncStartHeight),
+	)
+}
+
+// mwebStartLeaf returns the index of the first leaf that may have been
+// created at or after the given height, according to the leaf counts of the
+// blocks in the height map.
+func mwebStartLeaf(heightMap map[uint32]uint64, startHeight uint32) uint64 {
+	var leafIndex uint64
+	for height, numLeaves := range heightMap {
+		if height < startHeight && numLeaves > leafIndex {
+			leafIndex = numLeaves
+		}
+	}
+	return leafIndex
+}
+
+// retryMwebWrite performs the given write to the mweb coins db, retrying
+// with exponential backoff on failure. This lets us ride out transient
+// errors such as lock contention. If all retries are exhausted, the last
+// error is returned so that the caller can abandon the current sync
+// attempt, leaving the stored leafset intact for the next one to resume
+// from.
+func (b *blockManager) retryMwebWrite(write func() error) error {
+	backoff := b.cfg.MwebWriteBackoff
+	err := write()
+	for i := 0; err != nil && i < b.cfg.MwebWriteRetries; i++ {
+		log.Warnf("Mweb coins db write failed, retrying in %v: %v",
+			backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-b.quit:
+			return ErrShuttingDown
+		}
+
+		backoff *= 2
+		err = write()
+	}
+	return err
+}
+
+// requestBuilder returns the builder of the query.Requests for this
+// mwebutxos query, which are cancelled once the given channel is closed.
+// The requests are kept from the peer that served the mweb header, if it
+// must not serve the utxos too.
+func (m *mwebUtxosQuery) requestBuilder(
+	cancel chan struct{}) *mwebRequestBuilder {
+
+	allowPeer := m.blockMgr.mwebQueryPeers.allowPeer()
+	if headerPeer := m.headerPeer; headerPeer != "" {
+		pinned := allowPeer
+		allowPeer = func(peer string) bool {
+			return peer != headerPeer &&
+				(pinned == nil || pinned(peer))
+		}
+	}
+
+	return &mwebRequestBuilder{
+		handleResp:  m.handleResponse,
+		preferPeer:  m.preferPeer,
+		allowPeer:   allowPeer,
+		selectPeers: m.blockMgr.selectMwebPeers,
+		peerGroup:   m.blockMgr.cfg.MwebPeerGroup,
+		onResult:    m.onResult,
+		cancel:      cancel,
+		fanOut:      m.blockMgr.cfg.MwebFanOut,
+	}
+}
+
+// preferPeer returns the peers that the getmwebutxos message is preferably
+// sent to. These are the archival peers for leaves deep below the chain tip,
+// and otherwise the peers whose batch size the message fits. Peers that
+// have timed out on too many messages in a row, or that have declined a
+// message during this fetch, are never preferred.
+func (m *mwebUtxosQuery) preferPeer(msg wire.Message) func(string) bool {
+	getUtxos, ok := msg.(*wire.MsgGetMwebUtxos)
+	if !ok {
+		return nil
+	}
+
+	timeouts := m.blockMgr.mwebTimeouts
+	if getUtxos.StartIndex < m.archivalLeafIndex &&
+		m.blockMgr.cfg.MwebArchivalPeer != nil {
+
+		isArchival := m.blockMgr.cfg.MwebArchivalPeer
+		return func(peer string) bool {
+			return isArchival(peer) && !timeouts.timedOut(peer) &&
+				!m.declinedBy(peer)
+		}
+	}
+
+	sizer := m.blockMgr.mwebBatchSizer
+	return func(peer string) bool {
+		return getUtxos.NumRequested <= sizer.size(peer) &&
+			!timeouts.timedOut(peer) && !m.declinedBy(peer)
+	}
+}
+
+// declinedBy returns whether the peer has declined a getmwebutxos message
+// during this fetch.
+func (m *mwebUtxosQuery) declinedBy(peer string) bool {
+	m.declinedMtx.Lock()
+	defer m.declinedMtx.Unlock()
+
+	_, ok := m.declined[peer]
+	return ok
+}
+
+// leafHeight returns the height of the first block whose leaf count covers
+// the leaf, or the height of the leafset if none do. The blocks before mweb
+// activation have no leaves, and so never cover any.
+func (m *mwebUtxosQuery) leafHeight(leafIndex uint64) uint32 {
+	index, _ := slices.BinarySearchFunc(m.heights, leafIndex,
+		func(height uint32, target uint64) int {
+			return cmp.Compare(m.heightMap[height], target+1)
+		})
+	if index < len(m.heights) {
+		return m.heights[index]
+	}
+	return m.leafset.Height
+}
+
+// onResult adjusts the batch size of the peer given a getmwebutxos message
+// according to how quickly it answered, if at all, and counts it towards
+// the peer's timeouts. A peer that declined it is deprioritized for the
+// rest of the fetch instead, as how quickly it did so says nothing of how
+// quickly it serves mweb utxos.
+func (m *mwebUtxosQuery) onResult(msg wire.Message, peer string,
+	elapsed time.Duration, err error) {
+
+	getUtxos, ok := msg.(*wire.MsgGetMwebUtxos)
+	switch {
+	case !ok:
+		return
+
+	case err == query.ErrPeerDeclined:
+		m.declinedMtx.Lock()
+		if m.declined == nil {
+			m.declined = make(map[string]struct{})
+		}
+		m.declined[peer] = struct{}{}
+		m.declinedMtx.Unlock()
+
+	default:
+		m.blockMgr.mwebBatchSizer.record(
+			peer, getUtxos.NumRequested, elapsed, err,
+		)
+		if m.blockMgr.mwebTimeouts.record(peer, err) {
+			m.blockMgr.mwebPeerTimedOut(peer)
+		}
+	}
+}
+
+// deliverOrdered buffers the given responses, then delivers to the
+// callbacks every buffered response that no longer has an outstanding
+// request before it, returning those delivered. As batches are fetched one
+// after another, this gives strict leaf index ordering across the whole
+// sync.
+func (m *mwebUtxosQuery) deliverOrdered(
+	resps []*wire.MsgMwebUtxos) []*wire.MsgMwebUtxos {
+
+	for _, r := range resps {
+		index, _ := slices.BinarySearchFunc(m.pending, r.StartIndex,
+			func(resp *wire.MsgMwebUtxos, target uint64) int {
+				return cmp.Compare(resp.StartIndex, target)
+			})
+		m.pending = slices.Insert(m.pending, index, r)
+	}
+
+	var delivered []*wire.MsgMwebUtxos
+	for len(m.pending) > 0 {
+		next := m.pending[0]
+		if len(m.msgs) > 0 && m.msgs[0].StartIndex < next.StartIndex {
+			break
+		}
+		m.deliver(next.Utxos)
+		delivered = append(delivered, next)
+		m.pending = m.pending[1:]
+	}
+	return delivered
+}
+
+// discardPending drops the responses held back from the callbacks when the
+// fetch is abandoned, returning the first leaf index that they cover, or
+// the maximum index if there are none. Their coins have been written, but
+// as the callbacks haven't seen them, they must be fetched again.
+func (m *mwebUtxosQuery) discardPending() uint64 {
+	if len(m.pending) == 0 {
+		return math.MaxUint64
+	}
+
+	index := m.pending[0].StartIndex
+	log.Debugf("Discarding %v undelivered mwebutxos responses from "+
+		"index=%v", len(m.pending), index)
+	m.pending = nil
+
+	return index
+}
+
+// addTail records the message requesting the rest of the span that the
+// given message requested.
+func (m *mwebUtxosQuery) addTail(msg, tail *wire.MsgGetMwebUtxos) {
+	m.shortMtx.Lock()
+	defer m.shortMtx.Unlock()
+
+	if m.tails == nil {
+		m.tails = make(map[*wire.MsgGetMwebUtxos]int)
+	}
+	m.tails[tail] = m.tails[msg] + 1
+	delete(m.tails, msg)
+}
+
+// checkShortResponse checks a response serving fewer utxos than requested
+// though the leafset has more unspent leaves to serve, which no spend that
+// we know of explains. The rest of the span is requested again, but only so
+// many times for each span, and only so many short responses are accepted
+// of each peer, so that a peer can't hold up the fetch by trickling the
+// utxos. ErrMwebUtxosTruncated is returned once either is used up.
+func (m *mwebUtxosQuery) checkShortResponse(q *wire.MsgGetMwebUtxos,
+	r *wire.MsgMwebUtxos, peer string) error {
+
+	if len(r.Utxos) >= int(q.NumRequested) {
+		return nil
+	}
+	last := r.Utxos[len(r.Utxos)-1].LeafIndex
+	if uint64(leafsetNextUnspent(m.leafset, leafIdx(last))) >=
+		m.leafset.Size {
+
+		return nil
+	}
+
+	m.shortMtx.Lock()
+	defer m.shortMtx.Unlock()
+
+	switch {
+	case m.tails[q] >= mwebMaxUtxosTails:
+		return fmt.Errorf("%w: %v of %v utxos from index %v, with "+
+			"the rest of the span requested %v times already",
+			ErrMwebUtxosTruncated, len(r.Utxos), q.NumRequested,
+			q.StartIndex, m.tails[q])
+
+	case m.shortBy[peer] >= mwebMaxShortResponses:
+		return fmt.Errorf("%w: %v of %v utxos from index %v, after "+
+			"%v short responses", ErrMwebUtxosTruncated,
+			len(r.Utxos), q.NumRequested, q.StartIndex,
+			m.shortBy[peer])
+	}
+
+	if m.shortBy == nil {
+		m.shortBy = make(map[string]int)
+	}
+	m.shortBy[peer]++
+	return nil
+}
+
+// mwebUtxosDeclined returns whether the response is a peer declining the
+// getmwebutxos message, either with a notfound for the block it was sent
+// for, or with a reject of the command.
+func mwebUtxosDeclined(q *wire.MsgGetMwebUtxos, resp wire.Message) bool {
+	switch m := resp.(type) {
+	case *wire.MsgNotFound:
+		for _, iv := range m.InvList {
+			if iv.Hash == q.BlockHash {
+				return true
+			}
+		}
+
+	case *wire.MsgReject:
+		return m.Cmd == wire.CmdGetMwebUtxos
+	}
+	return false
 }
 
 // handleResponse is the internal response handler used for requests
@@ -250,6 +1545,17 @@ func (m *mwebUtxosQuery) handleResponse(req, resp wire.Message,
 
 	r, ok := resp.(*wire.MsgMwebUtxos)
 	if !ok {
+		// A peer that can't serve the mweb utxos, such as one that
+		// has pruned them, may say so rather than leave us waiting
+		// for the request to time out.
+		q, ok := req.(*wire.MsgGetMwebUtxos)
+		if ok && mwebUtxosDeclined(q, resp) {
+			log.Debugf("Peer %v declined getmwebutxos at "+
+				"index %v with %v", peerAddr, q.StartIndex,
+				resp.Command())
+			return query.Progress{Declined: true}
+		}
+
 		// We are only looking for mwebutxos messages.
 		return query.Progress{}
 	}
@@ -261,27 +1567,153 @@ func (m *mwebUtxosQuery) handleResponse(req, resp wire.Message,
 		return query.Progress{}
 	}
 
-	// The response doesn't match the query.
+	// The peer that served the header can't vouch for the utxos too.
+	// The requests are kept from it, unless it's our only peer, in
+	// which case its response is ignored.
+	if m.headerPeer != "" && peerAddr == m.headerPeer {
+		log.Debugf("Ignoring mwebutxos at index %v from peer %v, "+
+			"which served the mweb header", q.StartIndex, peerAddr)
+		return query.Progress{}
+	}
+
+	// The response doesn't match the query. A peer may serve fewer
+	// utxos than requested, in which case the rest are requested again
+	// once what it did serve has been verified.
 	if !q.BlockHash.IsEqual(&r.BlockHash) ||
 		q.StartIndex != r.StartIndex ||
 		q.OutputFormat != r.OutputFormat ||
-		q.NumRequested != uint16(len(r.Utxos)) {
+		q.NumRequested < uint16(len(r.Utxos)) ||
+		(q.NumRequested > 0 && len(r.Utxos) == 0) {
 		return query.Progress{}
 	}
 
-	if !mweb.VerifyUtxos(m.mwebHeader, m.leafset, r) {
-		log.Warnf("Failed to verify mweb utxos at index %v!!!",
-			r.StartIndex)
+	if err := m.checkShortResponse(q, r, peerAddr); err != nil {
+		m.blockMgr.mwebFailureLog.logf(peerAddr,
+			"Peer %v served mwebutxos with %v", peerAddr, err)
 
-		// If the peer gives us a bad mwebutxos message, then we'll
-		// ban the peer so we can reallocate the query elsewhere.
-		err := m.blockMgr.cfg.BanPeer(peerAddr, banman.InvalidMwebUtxos)
+		m.blockMgr.recordMwebFailure(
+			peerAddr, r, banman.InvalidMwebUtxos, err,
+		)
+		m.blockMgr.punishPeer(peerAddr, banman.InvalidMwebUtxos)
+
+		return query.Progress{}
+	}
+
+	// Each leaf index may only appear once in a response, in ascending
+	// order. Anything else is a deliberate attempt to get us to process
+	// the same leaves twice, so there's no need to verify the proof.
+	for i := 1; i < len(r.Utxos); i++ {
+		if r.Utxos[i].LeafIndex > r.Utxos[i-1].LeafIndex {
+			continue
+		}
+
+		err := fmt.Errorf("duplicate or unordered leaf index %v",
+			r.Utxos[i].LeafIndex)
+		m.blockMgr.mwebFailureLog.logf(peerAddr,
+			"Peer %v served mwebutxos with %v", peerAddr, err)
+
+		m.blockMgr.recordMwebFailure(
+			peerAddr, r, banman.InvalidMwebUtxos, err,
+		)
+		m.blockMgr.punishPeer(peerAddr, banman.InvalidMwebUtxos)
+
+		return query.Progress{}
+	}
+
+	// A proof with far too few hashes can't possibly verify, so under
+	// spam it's cheaper to reject it without walking it.
+	if ratio := m.blockMgr.cfg.MwebMinProofHashRatio; ratio > 0 {
+		err := checkMwebProofHashCount(ratio, m.leafset, r)
 		if err != nil {
-			log.Errorf("Unable to ban peer %v: %v", peerAddr, err)
+			m.blockMgr.mwebFailureLog.logf(peerAddr,
+				"Peer %v served mwebutxos with %v", peerAddr,
+				err)
+
+			m.blockMgr.recordMwebFailure(
+				peerAddr, r, banman.InvalidMwebUtxos, err,
+			)
+			m.blockMgr.punishPeer(
+				peerAddr, banman.InvalidMwebUtxos,
+			)
+
+			return query.Progress{}
 		}
+	}
+
+	// The proof is verified on the verify pool if there is one, with
+	// the progress delivered once it's done, so that the CPU-bound work
+	// doesn't hold up the query worker's goroutine.
+	pool := m.blockMgr.mwebVerifyPool
+	if pool == nil {
+		return m.verifyResponse(r, peerAddr)
+	}
 
+	progress := make(chan query.Progress, 1)
+	queued := pool.queue(func() {
+		progress <- m.verifyResponse(r, peerAddr)
+	})
+	if !queued {
 		return query.Progress{}
 	}
+	return query.Progress{Pending: progress}
+}
+
+// verifyResponse verifies the proof of an mwebutxos response that matches
+// its request, delivering its utxos on the utxosChan if it verifies, and
+// punishing the peer that served it if not. It returns the progress of the
+// request that the response answers.
+func (m *mwebUtxosQuery) verifyResponse(r *wire.MsgMwebUtxos,
+	peerAddr string) query.Progress {
+
+	var (
+		v     *verifyUtxosVars
+		err   error
+		start = time.Now()
+	)
+
+	// Utxos below a trusted checkpoint are only verified up to its
+	// peaks.
+	checkpoint := m.blockMgr.cfg.MwebCheckpoint
+	if checkpoint.covers(m.leafset, r) {
+		err = verifyMwebUtxosCheckpoint(
+			checkpoint, m.mwebHeader, m.leafset, r,
+		)
+	} else {
+		v, err = walkVerifiedMwebUtxos(
+			m.blockMgr.cfg.MwebRootVariants, m.mwebHeader,
+			m.leafset, r,
+		)
+	}
+	elapsed := time.Since(start)
+	if m.blockMgr.mwebVerifyTimer != nil {
+		m.blockMgr.mwebVerifyTimer.record(len(r.Utxos), elapsed)
+	}
+	if err == nil && m.trackedLeafset != nil {
+		err = verifyMwebUtxosTracked(m.trackedLeafset, r)
+	}
+	if err != nil {
+		m.blockMgr.mwebFailureLog.logf(peerAddr,
+			"Failed to verify mweb utxos at index %v from peer "+
+				"%v: %v", r.StartIndex, peerAddr, err)
+		m.blockMgr.dumpMwebVerifyState(
+			peerAddr, m.mwebHeader, m.leafset, r, v, err,
+		)
+
+		// If the peer gives us a bad mwebutxos message, then we'll
+		// punish the peer, banning it if the ban policy says so, and
+		// reallocate the query elsewhere.
+		m.blockMgr.recordMwebFailure(
+			peerAddr, r, banman.InvalidMwebUtxos, err,
+		)
+		m.blockMgr.punishPeer(peerAddr, banman.InvalidMwebUtxos)
+
+		return query.Progress{}
+	}
+
+	m.blockMgr.notifyMwebUtxosStats(peerAddr, r, elapsed)
+	if m.blockMgr.mwebProofTracker != nil {
+		m.blockMgr.mwebProofTracker.record(peerAddr, r)
+	}
 
 	// At this point, the response matches the query,
 	// so we'll deliver the verified utxos on the utxosChan.
@@ -290,6 +1722,8 @@ func (m *mwebUtxosQuery) handleResponse(req, resp wire.Message,
 	// query can move on to the next query.
 	select {
 	case m.utxosChan <- r:
+	case <-m.done:
+		return query.Progress{}
 	case <-m.blockMgr.quit:
 		return query.Progress{}
 	}
@@ -323,6 +1757,13 @@ func (b *blockManager) notifyAddedMwebUtxos(oldLeafset *mweb.Leafset) error {
 		return err
 	}
 
+	// Nothing was added if the leafset hasn't changed.
+	if oldLeafset.Size == newLeafset.Size &&
+		bytes.Equal(oldLeafset.Bits, newLeafset.Bits) {
+
+		return nil
+	}
+
 	// Skip over common prefix
 	var index uint64
 	for index < uint64(len(oldLeafset.Bits)) &&
@@ -343,6 +1784,14 @@ func (b *blockManager) notifyAddedMwebUtxos(oldLeafset *mweb.Leafset) error {
 		return err
 	}
 
+	if b.cfg.CheckMwebFetchedLeaves {
+		err := checkMwebFetchedLeaves(newLeafset, addedLeaves, utxos)
+		if err != nil {
+			log.Errorf("Mweb coins db is inconsistent: %v", err)
+			return err
+		}
+	}
+
 	for _, cb := range b.mwebUtxosCallbacks {
 		cb(newLeafset, utxos)
 	}
@@ -350,6 +1799,36 @@ func (b *blockManager) notifyAddedMwebUtxos(oldLeafset *mweb.Leafset) error {
 	return nil
 }
 
+// checkMwebFetchedLeaves checks that the coins fetched for the given
+// leaves, which are in ascending order, are for those leaves in the same
+// order, and that each of them is unspent in the leafset. Coins may be left
+// out, such as those that a coins db in safe mode hasn't verified, but none
+// may be added, repeated or reordered.
+func checkMwebFetchedLeaves(leafset *mweb.Leafset, leaves []uint64,
+	utxos []*wire.MwebNetUtxo) error {
+
+	var i int
+	for _, utxo := range utxos {
+		for i < len(leaves) && leaves[i] < utxo.LeafIndex {
+			i++
+		}
+		if i == len(leaves) || leaves[i] != utxo.LeafIndex {
+			return fmt.Errorf("%w: got leaf %v, which wasn't "+
+				"requested or is out of order",
+				ErrMwebFetchedLeaves, utxo.LeafIndex)
+		}
+		i++
+
+		if !leafset.Contains(utxo.LeafIndex) {
+			return fmt.Errorf("%w: leaf %v isn't in the leafset "+
+				"at height %v", ErrMwebFetchedLeaves,
+				utxo.LeafIndex, leafset.Height)
+		}
+	}
+
+	return nil
+}
+
 func (b *blockManager) notifyMwebUtxos(outputs []*wire.MwebOutput) {
 	b.mwebUtxosCallbacksMtx.Lock()
 	defer b.mwebUtxosCallbacksMtx.Unlock()
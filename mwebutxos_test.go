@@ -0,0 +1,2128 @@
+package neutrino
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/headerfs"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	_ "github.com/ltcsuite/ltcwallet/walletdb/bdb"
+	"github.com/stretchr/testify/require"
+)
+
+// errMockWrite is returned by the mockCoinDatabase for injected write
+// failures.
+var errMockWrite = errors.New("mock write failure")
+
+// mockCoinDatabase is an in-memory implementation of the CoinDatabase
+// interface that can be made to fail writes a number of times.
+type mockCoinDatabase struct {
+	mtx sync.Mutex
+
+	rollbackHeight uint32
+	leavesAtHeight map[uint32]uint64
+	leafset        *mweb.Leafset
+	coins          map[uint64]*wire.MwebNetUtxo
+
+	// putCoinsFailures is the number of remaining PutCoins calls that
+	// will fail before writes start succeeding.
+	putCoinsFailures int
+	putCoinsCalls    int
+
+	// putLeafsetFailures is the number of remaining PutLeafsetAndPurge
+	// calls that will fail before writes start succeeding.
+	putLeafsetFailures int
+	putLeafsetCalls    int
+}
+
+// A compile-time check to ensure the mockCoinDatabase adheres to the
+// CoinDatabase interface.
+var _ mwebdb.CoinDatabase = (*mockCoinDatabase)(nil)
+
+func newMockCoinDatabase() *mockCoinDatabase {
+	return &mockCoinDatabase{
+		leavesAtHeight: make(map[uint32]uint64),
+		leafset:        &mweb.Leafset{},
+		coins:          make(map[uint64]*wire.MwebNetUtxo),
+	}
+}
+
+func (m *mockCoinDatabase) GetRollbackHeight() (uint32, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.rollbackHeight, nil
+}
+
+func (m *mockCoinDatabase) PutRollbackHeight(height uint32) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rollbackHeight = height
+	return nil
+}
+
+func (m *mockCoinDatabase) ClearRollbackHeight(height uint32) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.rollbackHeight == height {
+		m.rollbackHeight = 0
+	}
+	return nil
+}
+
+func (m *mockCoinDatabase) GetLeavesAtHeight() (map[uint32]uint64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	leaves := make(map[uint32]uint64, len(m.leavesAtHeight))
+	for height, numLeaves := range m.leavesAtHeight {
+		leaves[height] = numLeaves
+	}
+	return leaves, nil
+}
+
+func (m *mockCoinDatabase) PutLeavesAtHeight(leaves map[uint32]uint64) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for height, numLeaves := range leaves {
+		m.leavesAtHeight[height] = numLeaves
+	}
+	return nil
+}
+
+func (m *mockCoinDatabase) RollbackLeavesAtHeight(height uint32) error {
+	if height == 0 {
+		return nil
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for h := range m.leavesAtHeight {
+		if h > height {
+			delete(m.leavesAtHeight, h)
+		}
+	}
+	return nil
+}
+
+func (m *mockCoinDatabase) GetLeafset() (*mweb.Leafset, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.leafset, nil
+}
+
+func (m *mockCoinDatabase) PutLeafsetAndPurge(leafset *mweb.Leafset,
+	removedLeaves []uint64) error {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.putLeafsetCalls++
+	if m.putLeafsetFailures > 0 {
+		m.putLeafsetFailures--
+		return errMockWrite
+	}
+	m.leafset = leafset
+	for _, leaf := range removedLeaves {
+		delete(m.coins, leaf)
+	}
+	return nil
+}
+
+func (m *mockCoinDatabase) PutCoins(coins []*wire.MwebNetUtxo) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.putCoinsCalls++
+	if m.putCoinsFailures > 0 {
+		m.putCoinsFailures--
+		return errMockWrite
+	}
+	for _, coin := range coins {
+		m.coins[coin.LeafIndex] = coin
+	}
+	return nil
+}
+
+func (m *mockCoinDatabase) FetchCoin(
+	outputId *chainhash.Hash) (*wire.MwebOutput, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, coin := range m.coins {
+		if coin.OutputId.IsEqual(outputId) {
+			return coin.Output, nil
+		}
+	}
+	return nil, mwebdb.ErrCoinNotFound
+}
+
+func (m *mockCoinDatabase) FetchLeaves(
+	leaves []uint64) ([]*wire.MwebNetUtxo, error) {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var coins []*wire.MwebNetUtxo
+	for _, leaf := range leaves {
+		if coin, ok := m.coins[leaf]; ok {
+			coins = append(coins, coin)
+		}
+	}
+	return coins, nil
+}
+
+func (m *mockCoinDatabase) PurgeCoins() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.rollbackHeight = 0
+	m.leavesAtHeight = make(map[uint32]uint64)
+	m.leafset = &mweb.Leafset{}
+	m.coins = make(map[uint64]*wire.MwebNetUtxo)
+	return nil
+}
+
+// newMockMwebUtxos returns an mwebutxos response for the given request
+// containing a dummy utxo for each leaf requested.
+func newMockMwebUtxos(req *wire.MsgGetMwebUtxos) *wire.MsgMwebUtxos {
+	resp := &wire.MsgMwebUtxos{
+		BlockHash:    req.BlockHash,
+		StartIndex:   req.StartIndex,
+		OutputFormat: req.OutputFormat,
+	}
+	for i := uint64(0); i < uint64(req.NumRequested); i++ {
+		resp.Utxos = append(resp.Utxos, &wire.MwebNetUtxo{
+			LeafIndex: req.StartIndex + i,
+			Output:    &wire.MwebOutput{},
+			OutputId:  &chainhash.Hash{byte(req.StartIndex + i)},
+		})
+	}
+	return resp
+}
+
+// setupMwebUtxosQuery returns a blockManager backed by a mockCoinDatabase,
+// along with an mwebutxos query for the given spans whose requests are
+// answered directly by the mock dispatcher.
+func setupMwebUtxosQuery(t *testing.T, starts []uint64,
+	count uint16) (*blockManager, *mockCoinDatabase, *mwebUtxosQuery) {
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	q := &mwebUtxosQuery{
+		blockMgr:   bm,
+		mwebHeader: &wire.MwebHeader{},
+		leafset:    &mweb.Leafset{},
+		heightMap:  make(map[uint32]uint64),
+		utxosChan:  make(chan *wire.MsgMwebUtxos),
+	}
+	for _, start := range starts {
+		q.msgs = append(q.msgs, wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, start, count, wire.MwebNetUtxoCompact,
+		))
+	}
+
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					q.utxosChan <- newMockMwebUtxos(msg)
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	return bm, coinDB, q
+}
+
+// TestMwebWriteRetry tests that transient failures writing mweb coins to
+// the db are retried, and that the batch is eventually written.
+func TestMwebWriteRetry(t *testing.T) {
+	t.Parallel()
+
+	bm, coinDB, q := setupMwebUtxosQuery(t, []uint64{0, 10}, 10)
+	bm.cfg.MwebWriteRetries = 3
+	bm.cfg.MwebWriteBackoff = time.Millisecond
+	coinDB.putCoinsFailures = 2
+
+	count, err := bm.getMwebUtxosBatch(q)
+	require.NoError(t, err)
+	require.Equal(t, 20, count)
+	require.Len(t, coinDB.coins, 20)
+	require.Equal(t, 4, coinDB.putCoinsCalls)
+
+	// Once the retries are exhausted, the error should be returned
+	// rather than the write being silently dropped.
+	bm, coinDB, q = setupMwebUtxosQuery(t, []uint64{0}, 10)
+	bm.cfg.MwebWriteRetries = 1
+	bm.cfg.MwebWriteBackoff = time.Millisecond
+	coinDB.putCoinsFailures = 2
+
+	_, err = bm.getMwebUtxosBatch(q)
+	require.ErrorIs(t, err, errMockWrite)
+	require.Empty(t, coinDB.coins)
+
+	// The same applies to the leafset checkpoint.
+	coinDB.putLeafsetFailures = 1
+	leafset := &mweb.Leafset{Size: 8, Bits: []byte{0xff}}
+	require.NoError(t, bm.purgeSpentMwebTxos(leafset, nil))
+	require.Equal(t, leafset, coinDB.leafset)
+	require.Equal(t, 2, coinDB.putLeafsetCalls)
+}
+
+// TestMwebStreamThreshold tests that the responses to a batch of mweb utxos
+// requests estimated to take up more memory than the threshold are written
+// one by one as they arrive, and otherwise all at once after the last.
+func TestMwebStreamThreshold(t *testing.T) {
+	t.Parallel()
+
+	// The batch of three messages for ten utxos each is estimated to
+	// take up 15360 bytes.
+	testCases := []struct {
+		threshold uint64
+		streaming bool
+		writes    int
+	}{
+		{threshold: 0, streaming: true, writes: 3},
+		{threshold: 15359, streaming: true, writes: 3},
+		{threshold: 15360, streaming: false, writes: 1},
+		{threshold: 1 << 20, streaming: false, writes: 1},
+	}
+	for _, testCase := range testCases {
+		bm, coinDB, q := setupMwebUtxosQuery(
+			t, []uint64{0, 10, 20}, 10,
+		)
+		bm.cfg.MwebStreamThreshold = testCase.threshold
+		require.Equal(
+			t, testCase.streaming, bm.mwebBatchStreams(q.msgs),
+		)
+
+		// Once the second response has been taken, the first has been
+		// handled, and written only if the batch streams. The batch
+		// can't have been written in one go yet, as the third response
+		// is still to come.
+		writtenMid := make(chan int, 1)
+		serve := func(requests []*query.Request, errChan chan error) {
+			for i, req := range requests {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				q.utxosChan <- newMockMwebUtxos(msg)
+				if i != 1 {
+					continue
+				}
+
+				coinDB.mtx.Lock()
+				writtenMid <- len(coinDB.coins)
+				coinDB.mtx.Unlock()
+			}
+			errChan <- nil
+		}
+		bm.cfg.QueryDispatcher = &mockDispatcher{
+			query: func(requests []*query.Request,
+				_ ...query.QueryOption) chan error {
+
+				errChan := make(chan error, 1)
+				go serve(requests, errChan)
+				return errChan
+			},
+		}
+
+		count, err := bm.getMwebUtxosBatch(q)
+		require.NoError(t, err)
+		require.Equal(t, 30, count)
+		require.Len(t, coinDB.coins, 30)
+		require.Equal(t, testCase.writes, coinDB.putCoinsCalls)
+
+		if testCase.streaming {
+			require.GreaterOrEqual(t, <-writtenMid, 10)
+		} else {
+			require.Zero(t, <-writtenMid)
+		}
+	}
+}
+
+// TestDiffLeafsets tests that the spans of added leaves built from a pair
+// of leafsets are correct, ordered and non-overlapping, including when the
+// changes straddle byte boundaries.
+func TestDiffLeafsets(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		oldLeafset  *mweb.Leafset
+		newLeafset  *mweb.Leafset
+		wantAdded   []leafSpan
+		wantRemoved []uint64
+	}{
+		{
+			name:       "identical",
+			oldLeafset: &mweb.Leafset{Bits: []byte{0xf0}, Size: 8},
+			newLeafset: &mweb.Leafset{Bits: []byte{0xf0}, Size: 8},
+		},
+		{
+			name:       "from empty",
+			oldLeafset: &mweb.Leafset{},
+			newLeafset: &mweb.Leafset{Bits: []byte{0xff}, Size: 8},
+			wantAdded:  []leafSpan{{start: 0, count: 8}},
+		},
+		{
+			name:       "span across byte boundary",
+			oldLeafset: &mweb.Leafset{Bits: []byte{0xfc}, Size: 6},
+			newLeafset: &mweb.Leafset{
+				Bits: []byte{0xff, 0xc0}, Size: 10,
+			},
+			wantAdded: []leafSpan{{start: 6, count: 4}},
+		},
+		{
+			name: "spans split by unchanged leaf",
+			oldLeafset: &mweb.Leafset{
+				Bits: []byte{0x00, 0x80}, Size: 9,
+			},
+			newLeafset: &mweb.Leafset{
+				Bits: []byte{0x01, 0xc0}, Size: 10,
+			},
+			wantAdded: []leafSpan{
+				{start: 7, count: 1},
+				{start: 9, count: 1},
+			},
+		},
+		{
+			name: "removed at byte boundary",
+			oldLeafset: &mweb.Leafset{
+				Bits: []byte{0x01, 0x80}, Size: 9,
+			},
+			newLeafset: &mweb.Leafset{
+				Bits: []byte{0x00, 0x40}, Size: 10,
+			},
+			wantAdded:   []leafSpan{{start: 9, count: 1}},
+			wantRemoved: []uint64{7, 8},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			added, removed := diffLeafsets(tc.oldLeafset, tc.newLeafset)
+			require.Equal(t, tc.wantAdded, added)
+			require.Equal(t, tc.wantRemoved, removed)
+			require.NoError(t, validateLeafSpans(added))
+		})
+	}
+
+	// Large runs of added leaves should be split into spans no bigger
+	// than a single query allows.
+	numLeaves := uint64(wire.MaxMwebUtxosPerQuery)*2 + 3
+	newLeafset := &mweb.Leafset{
+		Bits: make([]byte, (numLeaves+7)/8),
+		Size: numLeaves,
+	}
+	for i := range newLeafset.Bits {
+		newLeafset.Bits[i] = 0xff
+	}
+	added, _ := diffLeafsets(&mweb.Leafset{}, newLeafset)
+	require.Len(t, added, 3)
+	require.NoError(t, validateLeafSpans(added))
+}
+
+// TestDiffLeafsetBitmaps tests that the leaves added and removed between a
+// pair of leafset bitmaps are listed in order, including when the bitmaps
+// differ in length and the changes straddle byte boundaries.
+func TestDiffLeafsetBitmaps(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name        string
+		oldBits     []byte
+		newBits     []byte
+		wantAdded   []uint64
+		wantRemoved []uint64
+	}{
+		{
+			name:    "identical",
+			oldBits: []byte{0x5a, 0x01},
+			newBits: []byte{0x5a, 0x01},
+		},
+		{
+			name:    "both empty",
+			oldBits: nil,
+			newBits: []byte{},
+		},
+		{
+			name:      "additions",
+			oldBits:   []byte{0x80},
+			newBits:   []byte{0xc1},
+			wantAdded: []uint64{1, 7},
+		},
+		{
+			name:        "removals",
+			oldBits:     []byte{0xff},
+			newBits:     []byte{0x7e},
+			wantRemoved: []uint64{0, 7},
+		},
+		{
+			name:        "mixed across byte boundary",
+			oldBits:     []byte{0x01, 0x00, 0x80},
+			newBits:     []byte{0x00, 0x80, 0x80},
+			wantAdded:   []uint64{8},
+			wantRemoved: []uint64{7},
+		},
+		{
+			name:      "grown by a byte",
+			oldBits:   []byte{0xf0},
+			newBits:   []byte{0xf0, 0x81},
+			wantAdded: []uint64{8, 15},
+		},
+		{
+			name:        "shrunk by two bytes",
+			oldBits:     []byte{0x01, 0x80, 0x01},
+			newBits:     []byte{0x01},
+			wantRemoved: []uint64{8, 23},
+		},
+		{
+			name:        "mixed with differing lengths",
+			oldBits:     []byte{0xaa, 0x01},
+			newBits:     []byte{0x55, 0x00, 0x40},
+			wantAdded:   []uint64{1, 3, 5, 7, 17},
+			wantRemoved: []uint64{0, 2, 4, 6, 15},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			added, removed := DiffLeafsets(tc.oldBits, tc.newBits)
+			require.Equal(t, tc.wantAdded, added)
+			require.Equal(t, tc.wantRemoved, removed)
+
+			// Swapping the bitmaps swaps the changes.
+			added, removed = DiffLeafsets(tc.newBits, tc.oldBits)
+			require.Equal(t, tc.wantRemoved, added)
+			require.Equal(t, tc.wantAdded, removed)
+		})
+	}
+
+	// Runs of added leaves longer than the spans that the internal diff
+	// splits them into still come out whole.
+	numBytes := wire.MaxMwebUtxosPerQuery/8*2 + 1
+	newBits := bytes.Repeat([]byte{0xff}, numBytes)
+	added, removed := DiffLeafsets(nil, newBits)
+	require.Len(t, added, numBytes*8)
+	for i, leaf := range added {
+		require.Equal(t, uint64(i), leaf)
+	}
+	require.Empty(t, removed)
+}
+
+// TestValidateLeafSpans tests that unordered or overlapping spans are
+// rejected.
+func TestValidateLeafSpans(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validateLeafSpans(nil))
+	require.NoError(t, validateLeafSpans([]leafSpan{
+		{start: 0, count: 8}, {start: 8, count: 1},
+	}))
+	require.Error(t, validateLeafSpans([]leafSpan{
+		{start: 0, count: 8}, {start: 7, count: 1},
+	}))
+	require.Error(t, validateLeafSpans([]leafSpan{
+		{start: 8, count: 1}, {start: 0, count: 1},
+	}))
+	require.Error(t, validateLeafSpans([]leafSpan{{start: 0}}))
+}
+
+// TestMwebUtxosTipChange tests that a new chain tip arriving while mweb
+// utxos are being fetched abandons the fetch, and that the next fetch is
+// made against the new tip without refetching the leaves already written.
+func TestMwebUtxosTipChange(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	// The stored leafset has every even leaf, so fetching the odd ones
+	// takes two batches of single leaf spans.
+	mmr := newTestMwebMmr(40)
+	var oddLeaves []uint64
+	for i := uint64(1); i < 40; i += 2 {
+		oddLeaves = append(oddLeaves, i)
+	}
+	coinDB.leafset = mmr.leafset(oddLeaves...)
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+	header1 := &wire.BlockHeader{PrevBlock: genesis.BlockHash()}
+	hash1 := header1.BlockHash()
+	header2 := &wire.BlockHeader{PrevBlock: hash1}
+	hash2 := header2.BlockHash()
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header1,
+		Height:      1,
+	}))
+
+	bm.newHeadersMtx.Lock()
+	bm.headerTip = 1
+	bm.headerTipHash = hash1
+	bm.newHeadersMtx.Unlock()
+
+	var (
+		mtx       sync.Mutex
+		leafset   *mweb.Leafset
+		batches   [][]*wire.MsgGetMwebUtxos
+		changeTip = func() {
+			require.NoError(t, hdrStore.WriteHeaders(
+				headerfs.BlockHeader{
+					BlockHeader: header2,
+					Height:      2,
+				},
+			))
+			bm.newHeadersSignal.L.Lock()
+			bm.headerTip = 2
+			bm.headerTipHash = hash2
+			bm.newHeadersSignal.Broadcast()
+			bm.newHeadersSignal.L.Unlock()
+		}
+	)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			var msgs []*wire.MsgGetMwebUtxos
+			for _, req := range requests {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				msgs = append(msgs, msg)
+			}
+			batches = append(batches, msgs)
+
+			// The new tip arrives while the second batch is in
+			// flight, which is never answered.
+			errChan := make(chan error, 1)
+			if len(batches) == 2 {
+				go changeTip()
+				return errChan
+			}
+
+			respLeafset := leafset
+			go func() {
+				for i, req := range requests {
+					resp := mmr.proveUtxos(
+						respLeafset, msgs[i],
+					)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	leafset = mmr.leafset()
+	leafset.Height = 1
+	leafset.Block = header1
+	mwebHeader := mmr.mwebHeader()
+
+	err = bm.getMwebUtxos(mwebHeader, leafset, &hash1)
+	require.ErrorIs(t, err, errMwebTipChanged)
+	require.Len(t, batches, 2)
+	require.Len(t, coinDB.coins, 10)
+	require.Equal(t, &mwebUtxosResume{
+		height:    1,
+		blockHash: hash1,
+		leafIndex: 21,
+	}, bm.mwebUtxosResume)
+
+	// The stored leafset must not have been touched.
+	require.Equal(t, mmr.leafset(oddLeaves...), coinDB.leafset)
+
+	// The new tip adds some more leaves to the MMR.
+	mmr.appendLeaves(8)
+	mtx.Lock()
+	leafset = mmr.leafset()
+	leafset.Height = 2
+	leafset.Block = header2
+	mtx.Unlock()
+	mwebHeader = mmr.mwebHeader()
+
+	err = bm.getMwebUtxos(mwebHeader, leafset, &hash2)
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+
+	// The restarted fetch should be against the new block, and pick up
+	// from where the abandoned one left off.
+	require.Equal(t, uint64(21), batches[2][0].StartIndex)
+	for _, msg := range batches[2] {
+		require.Equal(t, hash2, msg.BlockHash)
+	}
+
+	require.Len(t, coinDB.coins, 28)
+	require.Equal(t, leafset, coinDB.leafset)
+	require.Nil(t, bm.mwebUtxosResume)
+}
+
+// answerMwebUtxosReversed answers the mwebutxos requests in reverse order,
+// then signals that the query has finished.
+func answerMwebUtxosReversed(q *mwebUtxosQuery, requests []*query.Request,
+	errChan chan<- error) {
+
+	for i := len(requests) - 1; i >= 0; i-- {
+		msg := requests[i].Req.(*wire.MsgGetMwebUtxos)
+		q.utxosChan <- newMockMwebUtxos(msg)
+	}
+	errChan <- nil
+}
+
+// TestOrderedMwebCallbacks tests that when OrderedMwebCallbacks is set, the
+// mweb utxos of responses arriving out of order are still delivered to the
+// callbacks in leaf index order.
+func TestOrderedMwebCallbacks(t *testing.T) {
+	t.Parallel()
+
+	starts := []uint64{0, 10, 20, 30}
+	for _, ordered := range []bool{false, true} {
+		bm, _, q := setupMwebUtxosQuery(t, starts, 10)
+		bm.cfg.OrderedMwebCallbacks = ordered
+
+		// Answer the requests from last to first.
+		bm.cfg.QueryDispatcher = &mockDispatcher{
+			query: func(requests []*query.Request,
+				_ ...query.QueryOption) chan error {
+
+				errChan := make(chan error, 1)
+				go answerMwebUtxosReversed(q, requests, errChan)
+				return errChan
+			},
+		}
+
+		var leaves []uint64
+		bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+			utxos []*wire.MwebNetUtxo) {
+
+			for _, utxo := range utxos {
+				leaves = append(leaves, utxo.LeafIndex)
+			}
+		})
+
+		count, err := bm.getMwebUtxosBatch(q)
+		require.NoError(t, err)
+		require.Equal(t, 40, count)
+		require.Len(t, leaves, 40)
+		require.Equal(t, ordered, slices.IsSorted(leaves))
+		require.Empty(t, q.pending)
+	}
+}
+
+// TestOrderedMwebCallbacksAbort tests that when a fetch with ordered
+// callbacks is abandoned, the responses held back from the callbacks are
+// discarded, and that the next fetch resumes from the first of them rather
+// than skipping leaves that the callbacks never saw.
+func TestOrderedMwebCallbacksAbort(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+	coinStore := newTestCoinStore(t)
+	bm.cfg.MwebCoins = coinStore
+	bm.cfg.OrderedMwebCallbacks = true
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+	header := &wire.BlockHeader{PrevBlock: genesis.BlockHash()}
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+	blockHash := header.BlockHash()
+
+	// The fetch is split into four spans of ten leaves.
+	bm.mwebBatchSizer.sizes["peer"] = 10
+	mmr := newTestMwebMmr(40)
+	leafset := mmr.leafset()
+	leafset.Height, leafset.Block = 1, header
+
+	// All but the first request are answered, after which the mweb
+	// queries are cancelled.
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests[1:] {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				bm.mwebPause.pause()
+			}()
+			return errChan
+		},
+	}
+
+	var leaves []uint64
+	bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		for _, utxo := range utxos {
+			leaves = append(leaves, utxo.LeafIndex)
+		}
+	})
+
+	err = bm.getMwebUtxos(mmr.mwebHeader(), leafset, &blockHash)
+	require.ErrorIs(t, err, errMwebCancelled)
+	require.Empty(t, leaves)
+	require.Equal(t, uint64(0), bm.mwebUtxosResume.leafIndex)
+
+	// None of the responses written were recorded as verified either.
+	spans, err := coinStore.GetVerifiedSpans()
+	require.NoError(t, err)
+	if spans != nil {
+		require.Empty(t, spans.Spans)
+	}
+
+	// The next fetch delivers every leaf, in order.
+	bm.mwebPause.resume()
+	bm.cfg.QueryDispatcher = serveTestMwebUtxos(mmr, leafset)
+	err = bm.getMwebUtxos(mmr.mwebHeader(), leafset, &blockHash)
+	require.NoError(t, err)
+	require.Len(t, leaves, 40)
+	require.True(t, slices.IsSorted(leaves))
+}
+
+// TestMwebUtxosOverlap tests that utxos overlapping leaves written by an
+// earlier batch are dropped, and that a peer serving the same leaf twice in
+// a response is banned.
+func TestMwebUtxosOverlap(t *testing.T) {
+	t.Parallel()
+
+	bm, coinDB, q := setupMwebUtxosQuery(t, []uint64{0, 10}, 10)
+
+	var leaves []uint64
+	bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		for _, utxo := range utxos {
+			leaves = append(leaves, utxo.LeafIndex)
+		}
+	})
+
+	count, err := bm.getMwebUtxosBatch(q)
+	require.NoError(t, err)
+	require.Equal(t, 20, count)
+	require.Equal(t, uint64(20), q.nextLeafIndex)
+
+	// A later batch overlapping the leaves already written should only
+	// write and notify the new leaves.
+	leaves = nil
+	q.msgs = []*wire.MsgGetMwebUtxos{
+		wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, 15, 10, wire.MwebNetUtxoCompact,
+		),
+	}
+	count, err = bm.getMwebUtxosBatch(q)
+	require.NoError(t, err)
+	require.Equal(t, 5, count)
+	require.Equal(t, []uint64{20, 21, 22, 23, 24}, leaves)
+	require.Equal(t, uint64(25), q.nextLeafIndex)
+	require.Len(t, coinDB.coins, 25)
+
+	// A response repeating a leaf index is rejected outright, and the
+	// peer banned.
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 30, 2, wire.MwebNetUtxoCompact,
+	)
+	resp := newMockMwebUtxos(req)
+	resp.Utxos[1].LeafIndex = resp.Utxos[0].LeafIndex
+
+	progress := q.handleResponse(req, resp, "peer")
+	require.Equal(t, query.Progress{}, progress)
+	require.Equal(t, []string{"peer"}, banned)
+}
+
+// TestMwebUtxosOutputFormat tests that a peer serving a utxo that isn't
+// encoded in the output format of its batch is banned, even when the proof
+// for the batch is otherwise valid.
+func TestMwebUtxosOutputFormat(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+
+	mmr := newTestMwebMmr(8)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset()
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 8, wire.MwebNetUtxoCompact,
+	)
+
+	// A batch in the requested format is delivered.
+	go func() { <-q.utxosChan }()
+	progress := q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "a")
+	require.Equal(t, query.Progress{Finished: true, Progressed: true},
+		progress)
+	require.Empty(t, banned)
+
+	// A hash-only utxo in a compact batch still hashes to the output
+	// root, but doesn't match the format of the batch.
+	resp := mmr.proveUtxos(q.leafset, req)
+	resp.Utxos[3].Output = nil
+	require.True(t, verifyMwebUtxosProof(q.mwebHeader, q.leafset, resp))
+	require.ErrorIs(t, verifyMwebUtxosDetailed(
+		nil, q.mwebHeader, q.leafset, resp,
+	), ErrMwebUtxoFormat)
+
+	progress = q.handleResponse(req, resp, "b")
+	require.Equal(t, query.Progress{}, progress)
+	require.Equal(t, []string{"b"}, banned)
+
+	// Likewise a compact utxo in a hash-only batch.
+	req.OutputFormat = wire.MwebNetUtxoHashOnly
+	resp = mmr.proveUtxos(q.leafset, req)
+	for _, utxo := range resp.Utxos {
+		utxo.Output = nil
+	}
+	resp.Utxos[5].Output = &wire.MwebOutput{}
+
+	progress = q.handleResponse(req, resp, "c")
+	require.Equal(t, query.Progress{}, progress)
+	require.Equal(t, []string{"b", "c"}, banned)
+}
+
+// TestStrictMwebLeafsetCheck tests that with the strict leafset check, a
+// peer serving a utxo for a leaf that our tracked leafset has seen spent is
+// banned, and that the tracked leafset is only used while its block is
+// still in the chain.
+func TestStrictMwebLeafsetCheck(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	sink := &recordingFailureSink{}
+	bm.cfg.MwebFailureSink = sink
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// The chain tip's leafset has every leaf unspent, but our tracked
+	// leafset saw leaf 3 spent.
+	mmr := newTestMwebMmr(8)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset()
+	tracked := mmr.leafset(3)
+	tracked.Size = 6
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 8, wire.MwebNetUtxoCompact,
+	)
+
+	// Without the tracked leafset, the response is delivered.
+	go func() { <-q.utxosChan }()
+	progress := q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "a")
+	require.True(t, progress.Finished)
+	require.Empty(t, banned)
+
+	q.trackedLeafset = tracked
+	progress = q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "b")
+	require.Equal(t, query.Progress{}, progress)
+	require.Equal(t, []string{"b"}, banned)
+	require.Len(t, sink.failures, 1)
+	require.ErrorIs(t, sink.failures[0].err, ErrMwebLeafsetConflict)
+
+	// Leaves past the end of the tracked leafset, or still unspent in
+	// it, don't conflict.
+	req = wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 4, 4, wire.MwebNetUtxoCompact,
+	)
+	go func() { <-q.utxosChan }()
+	progress = q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "c")
+	require.True(t, progress.Finished)
+	require.Equal(t, []string{"b"}, banned)
+
+	// The tracked leafset is only trusted while its block is in the
+	// chain.
+	genesis, err := bm.cfg.BlockHeaders.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+	require.False(t, bm.isMwebLeafsetInChain(tracked))
+	tracked.Block = genesis
+	require.True(t, bm.isMwebLeafsetInChain(tracked))
+	tracked.Block = &wire.BlockHeader{Nonce: 1}
+	require.False(t, bm.isMwebLeafsetInChain(tracked))
+	tracked.Height = 1
+	require.False(t, bm.isMwebLeafsetInChain(tracked))
+}
+
+// TestProveMwebUtxo tests proving a single mweb utxo against the chain tip
+// when it is unspent, spent, and when the peer's proof is invalid.
+func TestProveMwebUtxo(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+
+	mmr := newTestMwebMmr(10)
+	leafset := mmr.leafset(5)
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, genesis.BlockHash(), wire.MwebHeader{
+			Height:        1,
+			OutputRoot:    mmr.root(),
+			OutputMMRSize: leafset.Size,
+		}, leafset.Bits,
+	)
+	require.NoError(t, hdrStore.WriteHeaders(headerfs.BlockHeader{
+		BlockHeader: header,
+		Height:      1,
+	}))
+
+	peers := &mockMwebPeers{
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// The peer answers each request, corrupting the proof if asked to,
+	// after which it gives up on the query.
+	var (
+		corrupt bool
+		queries int
+	)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			queries++
+			errChan := make(chan error, 1)
+			go func() {
+				req := requests[0]
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				resp := mmr.proveUtxos(leafset, msg)
+				if corrupt {
+					resp.ProofHashes[0] = &chainhash.Hash{}
+				}
+				progress := req.HandleResp(
+					req.Req, resp, "peer",
+				)
+				if !progress.Finished {
+					errChan <- query.ErrQueryTimeout
+					return
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	ok, err := bm.proveMwebUtxo(3)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Spent and out of range leaves are absent, without needing any
+	// getmwebutxos to be sent.
+	for _, leafIndex := range []uint64{5, 10} {
+		ok, err = bm.proveMwebUtxo(leafIndex)
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	require.Equal(t, 1, queries)
+
+	corrupt = true
+	ok, err = bm.proveMwebUtxo(3)
+	require.ErrorIs(t, err, query.ErrQueryTimeout)
+	require.False(t, ok)
+	require.Equal(t, []string{"peer"}, banned)
+}
+
+// TestMwebUtxosShrink tests that when the output MMR shrinks, the leaves past
+// its new size are purged along with the leaf counts of the disconnected
+// blocks, without any utxos being fetched.
+func TestMwebUtxosShrink(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	// The stored leafset is at height 3 with 16 leaves.
+	mmr := newTestMwebMmr(16)
+	coinDB.leafset = mmr.leafset()
+	coinDB.leafset.Height = 3
+	for i := uint64(0); i < 16; i++ {
+		coinDB.coins[i] = &wire.MwebNetUtxo{LeafIndex: i}
+	}
+	coinDB.leavesAtHeight = map[uint32]uint64{1: 8, 2: 12, 3: 16}
+
+	// A reorg leaves the tip at height 2 with only 10 leaves, the count
+	// of which is stored before the utxos are fetched.
+	newMmr := newTestMwebMmr(10)
+	newLeafset := newMmr.leafset()
+	newLeafset.Height = 2
+	require.NoError(t, coinDB.PutLeavesAtHeight(
+		map[uint32]uint64{2: newLeafset.Size},
+	))
+
+	// Any query would panic, as the dispatcher has no query function.
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    newMmr.root(),
+		OutputMMRSize: newLeafset.Size,
+	}, newLeafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	require.Equal(t, newLeafset, coinDB.leafset)
+	require.Len(t, coinDB.coins, 10)
+	for i := uint64(0); i < 10; i++ {
+		require.Contains(t, coinDB.coins, i)
+	}
+	require.Equal(t, map[uint32]uint64{1: 8, 2: 10}, coinDB.leavesAtHeight)
+}
+
+// silentPeer is a query.Peer that never answers the messages queued to it,
+// signalling on sent whenever one is queued.
+type silentPeer struct {
+	sent chan wire.Message
+}
+
+var _ query.Peer = (*silentPeer)(nil)
+
+func (p *silentPeer) QueueMessageWithEncoding(msg wire.Message,
+	_ chan<- struct{}, _ wire.MessageEncoding) {
+
+	p.sent <- msg
+}
+
+func (p *silentPeer) SubscribeRecvMsg() (<-chan wire.Message, func()) {
+	return make(chan wire.Message), func() {}
+}
+
+func (p *silentPeer) Addr() string {
+	return "silent"
+}
+
+func (p *silentPeer) OnDisconnect() <-chan struct{} {
+	return make(chan struct{})
+}
+
+// TestMwebUtxosShutdown tests that on shutdown an mweb utxos fetch waits
+// for the query dispatcher to cancel its outstanding query, and that this
+// happens well within the quit timeout.
+func TestMwebUtxosShutdown(t *testing.T) {
+	t.Parallel()
+
+	const quitTimeout = 10 * time.Second
+
+	bm, _, q := setupMwebUtxosQuery(t, []uint64{0}, 10)
+	bm.cfg.MwebQuitTimeout = quitTimeout
+
+	peer := &silentPeer{sent: make(chan wire.Message, 1)}
+	peers := make(chan query.Peer, 1)
+	peers <- peer
+
+	wm := query.NewWorkManager(&query.Config{
+		ConnectedPeers: func() (<-chan query.Peer, func(), error) {
+			return peers, func() {}, nil
+		},
+		NewWorker: query.NewWorker,
+		Ranking:   query.NewPeerRanking(),
+	})
+	require.NoError(t, wm.Start())
+	t.Cleanup(func() {
+		require.NoError(t, wm.Stop())
+	})
+
+	// Record the final result of the query before handing it on, so we
+	// can tell whether it was reported by the time the fetch returns.
+	result := make(chan error, 1)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			options ...query.QueryOption) chan error {
+
+			errChan := wm.Query(requests, options...)
+			forward := make(chan error, 1)
+			go func() {
+				err := <-errChan
+				result <- err
+				forward <- err
+			}()
+			return forward
+		},
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := bm.getMwebUtxosBatch(q)
+		errs <- err
+	}()
+
+	// Shut down once the peer has been given the query.
+	select {
+	case <-peer.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("query not sent to peer")
+	}
+	start := time.Now()
+	close(bm.quit)
+
+	select {
+	case err := <-errs:
+		require.ErrorIs(t, err, ErrShuttingDown)
+	case <-time.After(2 * quitTimeout):
+		t.Fatal("fetch didn't return on shutdown")
+	}
+	require.Less(t, time.Since(start), quitTimeout)
+
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, query.ErrJobCanceled)
+	default:
+		t.Fatal("query not cancelled before fetch returned")
+	}
+}
+
+// TestMwebSyncStartHeight tests that the leaves created before the mweb sync
+// start height aren't fetched, using the leaf counts stored for the blocks
+// before it.
+func TestMwebSyncStartHeight(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+	coinDB.leavesAtHeight = map[uint32]uint64{100: 10, 200: 25, 300: 40}
+
+	mmr := newTestMwebMmr(40)
+	leafset := mmr.leafset()
+	leafset.Height = 300
+
+	var (
+		mtx  sync.Mutex
+		msgs []*wire.MsgGetMwebUtxos
+	)
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			mtx.Lock()
+			for _, req := range requests {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				msgs = append(msgs, msg)
+			}
+			mtx.Unlock()
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	// The wallet was created at height 250, so only the leaves from
+	// the end of block 200 onwards are needed.
+	atomic.StoreUint32(&bm.mwebSyncStartHeight, 250)
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Len(t, msgs, 1)
+	require.EqualValues(t, 25, msgs[0].StartIndex)
+	require.EqualValues(t, 15, msgs[0].NumRequested)
+
+	require.Len(t, coinDB.coins, 15)
+	for i := uint64(0); i < 25; i++ {
+		require.NotContains(t, coinDB.coins, i)
+	}
+	require.Equal(t, leafset, coinDB.leafset)
+}
+
+// newTestCoinStore returns a CoinStore in a new database.
+func newTestCoinStore(t *testing.T) *mwebdb.CoinStore {
+	db, err := walletdb.Create(
+		"bdb", t.TempDir()+"/coins.db", true, dbOpenTimeout,
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, db.Close())
+	})
+	coinStore, err := mwebdb.NewCoinStore(db)
+	require.NoError(t, err)
+	return coinStore
+}
+
+// serveTestMwebUtxos returns a dispatcher that answers each request for mweb
+// utxos as an honest peer would against the leafset of the MMR.
+func serveTestMwebUtxos(mmr *testMwebMmr,
+	leafset *mweb.Leafset) *mockDispatcher {
+
+	return &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+}
+
+// TestMwebSyncStartHeightSpend tests that a leaf skipped for being before
+// the sync start height can be spent, though a CoinStore has no coin of it
+// to purge.
+func TestMwebSyncStartHeightSpend(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinStore := newTestCoinStore(t)
+	bm.cfg.MwebCoins = coinStore
+	require.NoError(t, coinStore.PutLeavesAtHeight(
+		map[uint32]uint64{100: 10, 200: 25, 300: 40},
+	))
+
+	mmr := newTestMwebMmr(40)
+	leafset := mmr.leafset()
+	leafset.Height, leafset.Block = 300, &wire.BlockHeader{Nonce: 300}
+	bm.cfg.QueryDispatcher = serveTestMwebUtxos(mmr, leafset)
+
+	atomic.StoreUint32(&bm.mwebSyncStartHeight, 250)
+	err = bm.getMwebUtxos(
+		mmr.mwebHeader(), leafset, &chainhash.Hash{0x01},
+	)
+	require.NoError(t, err)
+
+	// The next block spends the skipped leaf 3 and the stored leaf 30.
+	next := mmr.leafset(3, 30)
+	next.Height, next.Block = 301, &wire.BlockHeader{Nonce: 301}
+	err = bm.getMwebUtxos(mmr.mwebHeader(), next, &chainhash.Hash{0x02})
+	require.NoError(t, err)
+
+	stored, err := coinStore.GetLeafset()
+	require.NoError(t, err)
+	require.Equal(t, next.Bits, stored.Bits)
+	require.Equal(t, uint32(301), stored.Height)
+
+	var leaves []uint64
+	for i := uint64(0); i < 40; i++ {
+		leaves = append(leaves, i)
+	}
+	coins, err := coinStore.FetchLeaves(leaves)
+	require.NoError(t, err)
+	require.Len(t, coins, 14)
+	for _, coin := range coins {
+		require.GreaterOrEqual(t, coin.LeafIndex, uint64(25))
+		require.NotEqual(t, uint64(30), coin.LeafIndex)
+	}
+}
+
+// TestMwebResumeSpentLeaves tests that the coins written by an abandoned
+// fetch are purged once the block of the next leafset spends them.
+func TestMwebResumeSpentLeaves(t *testing.T) {
+	t.Parallel()
+
+	bm, hdrStore, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinStore := newTestCoinStore(t)
+	bm.cfg.MwebCoins = coinStore
+
+	// The abandoned fetch wrote the coins of leaves 0 to 3 before the
+	// tip changed.
+	mmr := newTestMwebMmr(8)
+	var written []*wire.MwebNetUtxo
+	for i := range mmr.outputIds[:4] {
+		written = append(written, &wire.MwebNetUtxo{
+			LeafIndex: uint64(i),
+			Output:    &wire.MwebOutput{},
+			OutputId:  &mmr.outputIds[i],
+		})
+	}
+	require.NoError(t, coinStore.PutCoins(written))
+
+	genesis, err := hdrStore.FetchHeaderByHeight(0)
+	require.NoError(t, err)
+	bm.mwebUtxosResume = &mwebUtxosResume{
+		blockHash: genesis.BlockHash(),
+		leafIndex: 4,
+	}
+
+	// The new tip spends two of the leaves written, and one that wasn't.
+	leafset := mmr.leafset(1, 2, 5)
+	leafset.Height, leafset.Block = 1, &wire.BlockHeader{Nonce: 1}
+	bm.cfg.QueryDispatcher = serveTestMwebUtxos(mmr, leafset)
+	err = bm.getMwebUtxos(
+		mmr.mwebHeader(), leafset, &chainhash.Hash{0x01},
+	)
+	require.NoError(t, err)
+
+	coins, err := coinStore.FetchLeaves(
+		[]uint64{0, 1, 2, 3, 4, 5, 6, 7},
+	)
+	require.NoError(t, err)
+	var leaves []uint64
+	for _, coin := range coins {
+		leaves = append(leaves, coin.LeafIndex)
+	}
+	require.Equal(t, []uint64{0, 3, 4, 6, 7}, leaves)
+
+	s := &ChainService{MwebCoinDB: coinStore}
+	require.False(t, s.MwebUtxoExists(&mmr.outputIds[1]))
+	require.True(t, s.MwebUtxoExists(&mmr.outputIds[3]))
+}
+
+// TestTrimLeafSpans tests that trimming spans drops the leaves before the
+// given index, splitting the span that straddles it.
+func TestTrimLeafSpans(t *testing.T) {
+	t.Parallel()
+
+	spans := []leafSpan{{0, 5}, {8, 4}, {20, 10}}
+	require.Equal(t, spans, trimLeafSpans(spans, 0))
+	require.Equal(t, []leafSpan{{10, 2}, {20, 10}},
+		trimLeafSpans(spans, 10))
+	require.Equal(t, []leafSpan{{20, 10}}, trimLeafSpans(spans, 12))
+	require.Equal(t, []leafSpan{{29, 1}}, trimLeafSpans(spans, 29))
+	require.Empty(t, trimLeafSpans(spans, 30))
+}
+
+// mwebSpansTest fetches the mweb utxos of 100 leaves, every fourth of which
+// is already stored, leaving 25 spans of three leaves to fetch. Its
+// dispatcher records the start indices of the requests of each batch
+// before answering them all.
+type mwebSpansTest struct {
+	bm      *blockManager
+	coinDB  *mockCoinDatabase
+	mmr     *testMwebMmr
+	leafset *mweb.Leafset
+	missing []uint64
+
+	// dispatched is signalled as each batch is dispatched.
+	dispatched chan struct{}
+
+	mtx     sync.Mutex
+	batches [][]uint64
+}
+
+// newMwebSpansTest returns the fetch of the 25 spans.
+func newMwebSpansTest(t *testing.T) *mwebSpansTest {
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	s := &mwebSpansTest{
+		bm:         bm,
+		coinDB:     newMockCoinDatabase(),
+		mmr:        newTestMwebMmr(100),
+		dispatched: make(chan struct{}, 100),
+	}
+	bm.cfg.MwebCoins = s.coinDB
+
+	for i := uint64(0); i < 100; i++ {
+		if i%4 != 0 {
+			s.missing = append(s.missing, i)
+		}
+	}
+	s.coinDB.leafset = s.mmr.leafset(s.missing...)
+	s.leafset = s.mmr.leafset()
+
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			var starts []uint64
+			for _, req := range requests {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				starts = append(starts, msg.StartIndex)
+			}
+			s.mtx.Lock()
+			s.batches = append(s.batches, starts)
+			s.mtx.Unlock()
+			s.dispatched <- struct{}{}
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := s.mmr.proveUtxos(s.leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+	return s
+}
+
+// fetch fetches the missing mweb utxos.
+func (s *mwebSpansTest) fetch() error {
+	return s.bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    s.mmr.root(),
+		OutputMMRSize: s.leafset.Size,
+	}, s.leafset, &chainhash.Hash{})
+}
+
+// dispatchedBatches returns the start indices of the requests of each batch
+// dispatched so far.
+func (s *mwebSpansTest) dispatchedBatches() [][]uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return slices.Clone(s.batches)
+}
+
+// requireFetched checks that all the missing mweb utxos were written.
+func (s *mwebSpansTest) requireFetched(t *testing.T) {
+	s.coinDB.mtx.Lock()
+	defer s.coinDB.mtx.Unlock()
+
+	require.Len(t, s.coinDB.coins, len(s.missing))
+	require.Equal(t, s.leafset, s.coinDB.leafset)
+}
+
+// TestMwebInterestFilter tests that the spans holding leaves that pass the
+// interest filter are dispatched before the rest, with every batch still in
+// ascending order.
+func TestMwebInterestFilter(t *testing.T) {
+	t.Parallel()
+
+	// The wallet is interested in a leaf of each of two spans.
+	s := newMwebSpansTest(t)
+	s.bm.cfg.MwebInterestFilter = func(leafIndex uint64) bool {
+		return leafIndex == 50 || leafIndex == 87
+	}
+	require.NoError(t, s.fetch())
+	s.requireFetched(t)
+
+	// The prioritized spans make up a batch of their own, followed by
+	// the rest in order.
+	batches := s.dispatchedBatches()
+	require.Equal(t, []uint64{49, 85}, batches[0])
+	var rest []uint64
+	for _, batch := range batches[1:] {
+		require.True(t, slices.IsSorted(batch))
+		require.LessOrEqual(t, len(batch), 10)
+		rest = append(rest, batch...)
+	}
+	require.Len(t, rest, 23)
+	require.True(t, slices.IsSorted(rest))
+	require.NotContains(t, rest, uint64(49))
+	require.NotContains(t, rest, uint64(85))
+}
+
+// TestMwebSyncNewestFirst tests that newest first, the spans with the
+// highest leaf indices are dispatched and delivered before those below
+// them, with every batch still in ascending order.
+func TestMwebSyncNewestFirst(t *testing.T) {
+	t.Parallel()
+
+	s := newMwebSpansTest(t)
+	s.bm.cfg.MwebSyncOrder = MwebSyncNewestFirst
+
+	var (
+		mtx       sync.Mutex
+		delivered []uint64
+	)
+	s.bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		mtx.Lock()
+		for _, utxo := range utxos {
+			delivered = append(delivered, utxo.LeafIndex)
+		}
+		mtx.Unlock()
+	})
+	require.NoError(t, s.fetch())
+	s.requireFetched(t)
+
+	// The batches go from the highest spans down, each of them in
+	// ascending order.
+	require.Equal(t, [][]uint64{
+		{61, 65, 69, 73, 77, 81, 85, 89, 93, 97},
+		{21, 25, 29, 33, 37, 41, 45, 49, 53, 57},
+		{1, 5, 9, 13, 17},
+	}, s.dispatchedBatches())
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.ElementsMatch(t, s.missing, delivered)
+	require.Equal(t, uint64(61), delivered[0])
+}
+
+// TestMwebUtxosIdenticalLeafset tests that nothing is fetched, written or
+// notified when the new leafset is identical to the one we already have.
+func TestMwebUtxosIdenticalLeafset(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	mmr := newTestMwebMmr(20)
+	coinDB.leafset = mmr.leafset(3, 7)
+	coinDB.leafset.Height = 100
+
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(_ []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			t.Fatal("unexpected mweb utxos query")
+			return nil
+		},
+	}
+
+	var callbacks int
+	bm.RegisterMwebUtxosCallback(func(*mweb.Leafset, []*wire.MwebNetUtxo) {
+		callbacks++
+	})
+
+	// An identical copy of the stored leafset is a no-op.
+	leafset := mmr.leafset(3, 7)
+	leafset.Height = 100
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+	require.Zero(t, coinDB.putLeafsetCalls)
+
+	require.NoError(t, bm.notifyAddedMwebUtxos(mmr.leafset(3, 7)))
+	require.Zero(t, callbacks)
+
+	// The same unspent leaves at a new height still move the stored
+	// leafset on, without fetching anything.
+	leafset = mmr.leafset(3, 7)
+	leafset.Height = 101
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+	require.Equal(t, 1, coinDB.putLeafsetCalls)
+	require.Equal(t, leafset, coinDB.leafset)
+	require.Equal(t, 1, callbacks)
+}
+
+// mismatchedCoinDatabase is a mockCoinDatabase whose FetchLeaves returns the
+// coin of another leaf in place of the one asked for.
+type mismatchedCoinDatabase struct {
+	*mockCoinDatabase
+
+	from, to uint64
+}
+
+func (m *mismatchedCoinDatabase) FetchLeaves(
+	leaves []uint64) ([]*wire.MwebNetUtxo, error) {
+
+	coins, err := m.mockCoinDatabase.FetchLeaves(leaves)
+	for i, coin := range coins {
+		if coin.LeafIndex == m.from {
+			coins[i] = m.coins[m.to]
+		}
+	}
+	return coins, err
+}
+
+// TestCheckMwebFetchedLeaves tests that with the check on, coins fetched
+// for the added leaves that don't match the leaves asked for, or aren't in
+// the leafset, fail the notification instead of reaching the callbacks.
+func TestCheckMwebFetchedLeaves(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	mmr := newTestMwebMmr(20)
+	coinDB.leafset = mmr.leafset(3, 7)
+	for i := uint64(0); i < 20; i++ {
+		coinDB.coins[i] = &wire.MwebNetUtxo{LeafIndex: i}
+	}
+	store := &mismatchedCoinDatabase{mockCoinDatabase: coinDB}
+	bm.cfg.MwebCoins = store
+	bm.cfg.CheckMwebFetchedLeaves = true
+
+	var callbacks int
+	bm.RegisterMwebUtxosCallback(func(*mweb.Leafset, []*wire.MwebNetUtxo) {
+		callbacks++
+	})
+
+	// A store returning the coins asked for passes the check.
+	oldLeafset := mmr.leafset(3, 7, 12, 13, 14)
+	require.NoError(t, bm.notifyAddedMwebUtxos(oldLeafset))
+	require.Equal(t, 1, callbacks)
+
+	// A coin for a leaf that wasn't asked for fails it.
+	store.from, store.to = 13, 15
+	err = bm.notifyAddedMwebUtxos(oldLeafset)
+	require.ErrorIs(t, err, ErrMwebFetchedLeaves)
+	require.Equal(t, 1, callbacks)
+
+	// As does a coin returned out of order.
+	store.from, store.to = 13, 12
+	err = bm.notifyAddedMwebUtxos(oldLeafset)
+	require.ErrorIs(t, err, ErrMwebFetchedLeaves)
+	require.Equal(t, 1, callbacks)
+
+	// Without the check, the mismatch goes unnoticed.
+	bm.cfg.CheckMwebFetchedLeaves = false
+	require.NoError(t, bm.notifyAddedMwebUtxos(oldLeafset))
+	require.Equal(t, 2, callbacks)
+
+	// Leaves left out of the coins returned are allowed, as a coins db
+	// in safe mode leaves out those it hasn't verified.
+	require.NoError(t, checkMwebFetchedLeaves(
+		coinDB.leafset, []uint64{12, 13, 14},
+		[]*wire.MwebNetUtxo{coinDB.coins[12], coinDB.coins[14]},
+	))
+
+	// A coin for a leaf that's spent in the leafset fails the check,
+	// even if it was asked for.
+	err = checkMwebFetchedLeaves(
+		coinDB.leafset, []uint64{7},
+		[]*wire.MwebNetUtxo{coinDB.coins[7]},
+	)
+	require.ErrorIs(t, err, ErrMwebFetchedLeaves)
+}
+
+// TestMwebUtxosPartialResponse tests that a peer serving a valid prefix of
+// the requested utxos isn't punished, and that the rest of the span is
+// requested again, while an invalid short response is still punished.
+func TestMwebUtxosPartialResponse(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		banned = append(banned, addr)
+		return nil
+	}
+
+	// Leaves 3 and 10 are spent, so the 18 unspent leaves are fetched
+	// in a single span.
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset(3, 10)
+
+	var (
+		mtx      sync.Mutex
+		requests []wire.MsgGetMwebUtxos
+	)
+	answerPartially := func(req *query.Request) {
+		msg := req.Req.(*wire.MsgGetMwebUtxos)
+		mtx.Lock()
+		requests = append(requests, *msg)
+		first := len(requests) == 1
+		mtx.Unlock()
+
+		if !first {
+			resp := mmr.proveUtxos(leafset, msg)
+			req.HandleResp(msg, resp, "b")
+			return
+		}
+
+		// The first request gets an invalid short response, followed
+		// by a valid one serving only part of the span.
+		short := *msg
+		short.NumRequested = 7
+		resp := mmr.proveUtxos(leafset, &short)
+		resp.Utxos[1].OutputId = &chainhash.Hash{}
+		req.HandleResp(msg, resp, "a")
+
+		resp = mmr.proveUtxos(leafset, &short)
+		req.HandleResp(msg, resp, "c")
+	}
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(reqs []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range reqs {
+					answerPartially(req)
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	var leaves []uint64
+	bm.RegisterMwebUtxosCallback(func(_ *mweb.Leafset,
+		utxos []*wire.MwebNetUtxo) {
+
+		for _, utxo := range utxos {
+			leaves = append(leaves, utxo.LeafIndex)
+		}
+	})
+
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	// Only the peer serving an invalid response was punished.
+	require.Equal(t, []string{"a"}, banned)
+
+	// The rest of the span was requested from the leaf after the last
+	// one served.
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Len(t, requests, 2)
+	require.Equal(t, uint64(0), requests[0].StartIndex)
+	require.Equal(t, uint16(18), requests[0].NumRequested)
+	require.Equal(t, uint64(8), requests[1].StartIndex)
+	require.Equal(t, uint16(11), requests[1].NumRequested)
+
+	require.Len(t, coinDB.coins, 18)
+	require.Len(t, leaves, 18)
+	require.Equal(t, leafset, coinDB.leafset)
+}
+
+// TestMwebUtxosTrickle tests that a short response is only accepted so
+// many times of each peer and for each span, with the peer serving one past
+// that punished and the span served in full by another.
+func TestMwebUtxosTrickle(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+
+		// peer returns the peer serving a single utxo in response
+		// to the given request.
+		peer func(request int) string
+
+		// banned is the peer punished for trickling the utxos.
+		banned string
+	}{{
+		name: "same peer",
+		peer: func(int) string {
+			return "a"
+		},
+		banned: "a",
+	}, {
+		name: "many peers",
+		peer: func(request int) string {
+			return fmt.Sprintf("p%v", request)
+		},
+		banned: "p4",
+	}}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			testMwebUtxosTrickle(t, test.peer, test.banned)
+		})
+	}
+}
+
+func testMwebUtxosTrickle(t *testing.T, trickler func(int) string,
+	expected string) {
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	var (
+		mtx      sync.Mutex
+		banned   []string
+		requests int
+	)
+	bm.cfg.BanPeer = func(addr string, _ banman.Reason) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		banned = append(banned, addr)
+		return nil
+	}
+
+	mmr := newTestMwebMmr(20)
+	leafset := mmr.leafset()
+	trickle := func(req *query.Request) {
+		mtx.Lock()
+		peer := trickler(requests)
+		requests++
+		mtx.Unlock()
+
+		msg := req.Req.(*wire.MsgGetMwebUtxos)
+		one := *msg
+		one.NumRequested = 1
+		progress := req.HandleResp(
+			msg, mmr.proveUtxos(leafset, &one), peer,
+		)
+		if !progress.Finished {
+			req.HandleResp(msg, mmr.proveUtxos(leafset, msg), "b")
+		}
+	}
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(reqs []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range reqs {
+					trickle(req)
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	err = bm.getMwebUtxos(&wire.MwebHeader{
+		OutputRoot:    mmr.root(),
+		OutputMMRSize: leafset.Size,
+	}, leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+	require.Len(t, coinDB.coins, 20)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, []string{expected}, banned)
+}
+
+// TestRefetchMwebRange tests that refetching a range of leaves overwrites
+// the stored coins in that range with verified ones, leaving the rest alone.
+func TestRefetchMwebRange(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+
+	// Nothing can be refetched before the first sync.
+	require.ErrorIs(t, bm.refetchMwebRange(0, 10), ErrMwebNotSynced)
+
+	mmr := newTestMwebMmr(30)
+	leafset := mmr.leafset(4, 12)
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{
+			Height:        1,
+			OutputRoot:    mmr.root(),
+			OutputMMRSize: leafset.Size,
+		}, leafset.Bits,
+	)
+	leafset.Height = 1
+	leafset.Block = header
+	coinDB.leafset = leafset
+
+	peers := &mockMwebPeers{
+		mwebHeader:  mwebHeader,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	var requests []wire.MsgGetMwebUtxos
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(reqs []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			for _, req := range reqs {
+				msg := req.Req.(*wire.MsgGetMwebUtxos)
+				requests = append(requests, *msg)
+			}
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range reqs {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(msg, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+
+	// Store every unspent coin, with those from 2 up to 15 corrupted.
+	corrupt := &chainhash.Hash{0x01}
+	for i := uint64(0); i < leafset.Size; i++ {
+		if !leafset.Contains(i) {
+			continue
+		}
+		outputId := mmr.outputIds[i]
+		if i >= 2 && i < 15 {
+			outputId = *corrupt
+		}
+		coinDB.coins[i] = &wire.MwebNetUtxo{
+			LeafIndex: i,
+			OutputId:  &outputId,
+		}
+	}
+	untouched := coinDB.coins[20]
+
+	require.NoError(t, bm.refetchMwebRange(2, 13))
+
+	// The range was fetched as a single span of its unspent leaves.
+	require.Len(t, requests, 1)
+	require.Equal(t, uint64(2), requests[0].StartIndex)
+	require.Equal(t, uint16(11), requests[0].NumRequested)
+	require.Equal(t, header.BlockHash(), requests[0].BlockHash)
+
+	for i, coin := range coinDB.coins {
+		require.Equal(t, mmr.outputIds[i], *coin.OutputId, "leaf %v", i)
+	}
+	require.Same(t, untouched, coinDB.coins[20])
+	require.Equal(t, leafset, coinDB.leafset)
+
+	// A range past the end of the leafset fetches nothing.
+	require.NoError(t, bm.refetchMwebRange(leafset.Size, 10))
+	require.Len(t, requests, 1)
+
+	// The leafset served by our peers must match the stored one.
+	coinDB.leafset = mmr.leafset(4, 12, 13)
+	coinDB.leafset.Block = header
+	require.Error(t, bm.refetchMwebRange(0, 10))
+	require.Len(t, requests, 1)
+}
+
+// TestMwebActivationBoundary tests the sync across the block that activates
+// mweb. Before it the output MMR is empty and so is the leafset, and only an
+// empty response verifies. At it, the leafset goes from empty to populated,
+// and the new leaves are fetched and dated to the activation block, although
+// the blocks before it have leaf counts of zero.
+func TestMwebActivationBoundary(t *testing.T) {
+	t.Parallel()
+
+	const activationHeight = 4
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	coinDB := newMockCoinDatabase()
+	bm.cfg.MwebCoins = coinDB
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func([]*query.Request, ...query.QueryOption) chan error {
+			t.Fatal("mweb utxos queried before activation")
+			return nil
+		},
+	}
+
+	// The blocks before activation commit to an empty output MMR.
+	emptyHeader := &wire.MwebHeader{}
+	for height := uint32(1); height < activationHeight; height++ {
+		require.NoError(t, coinDB.PutLeavesAtHeight(
+			map[uint32]uint64{height: 0},
+		))
+		leafset := &mweb.Leafset{Height: height}
+		err := bm.getMwebUtxos(emptyHeader, leafset, &chainhash.Hash{})
+		require.NoError(t, err)
+	}
+	require.Empty(t, coinDB.coins)
+	require.Zero(t, coinDB.leafset.Size)
+
+	// Only an empty response proves the empty MMR, and not against a
+	// header that commits to leaves.
+	empty := &wire.MsgMwebUtxos{}
+	require.True(t, verifyMwebUtxos(
+		emptyHeader, &mweb.Leafset{}, empty,
+	))
+	require.False(t, verifyMwebUtxos(
+		&wire.MwebHeader{OutputMMRSize: 1}, &mweb.Leafset{}, empty,
+	))
+
+	// The activation block adds the first leaves.
+	mmr := newTestMwebMmr(5)
+	leafset := mmr.leafset(1)
+	leafset.Height = activationHeight
+	require.NoError(t, coinDB.PutLeavesAtHeight(
+		map[uint32]uint64{activationHeight: leafset.Size},
+	))
+	require.False(t, verifyMwebUtxos(mmr.mwebHeader(), leafset, empty))
+
+	bm.cfg.QueryDispatcher = &mockDispatcher{
+		query: func(requests []*query.Request,
+			_ ...query.QueryOption) chan error {
+
+			errChan := make(chan error, 1)
+			go func() {
+				for _, req := range requests {
+					msg := req.Req.(*wire.MsgGetMwebUtxos)
+					resp := mmr.proveUtxos(leafset, msg)
+					req.HandleResp(req.Req, resp, "peer")
+				}
+				errChan <- nil
+			}()
+			return errChan
+		},
+	}
+	err = bm.getMwebUtxos(mmr.mwebHeader(), leafset, &chainhash.Hash{})
+	require.NoError(t, err)
+
+	require.Len(t, coinDB.coins, 4)
+	for leafIndex, coin := range coinDB.coins {
+		require.NotEqual(t, uint64(1), leafIndex)
+		require.EqualValues(t, activationHeight, coin.Height)
+	}
+	require.True(t, mwebLeafsetsEqual(leafset, coinDB.leafset))
+}
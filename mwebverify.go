@@ -0,0 +1,411 @@
+package neutrino
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ltcmweb/ltcd/blockchain"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/bloom"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/txscript"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+var (
+	// ErrMwebBlockHashMismatch is returned when an mweb header is for a
+	// different block than the one requested.
+	ErrMwebBlockHashMismatch = errors.New("mweb header block hash mismatch")
+
+	// ErrMwebBadMerkleRoot is returned when the merkle block of an mweb
+	// header doesn't commit to the hogex as the last transaction of the
+	// block.
+	ErrMwebBadMerkleRoot = errors.New("mweb header merkle block is bad")
+
+	// ErrMwebMalformedMerkleBlock is returned when the merkle block of an
+	// mweb header has more flags or hashes than a partial merkle tree of
+	// its number of transactions could have, or too few to cover them.
+	ErrMwebMalformedMerkleBlock = errors.New("mweb header merkle block " +
+		"is malformed")
+
+	// ErrMwebNotHogEx is returned when the transaction of an mweb header
+	// isn't a hogex.
+	ErrMwebNotHogEx = errors.New("mweb header hogex is not hogex")
+
+	// ErrMwebHogAddrMismatch is returned when the hogex of an mweb header
+	// doesn't pay to the HogAddr committing to the header.
+	ErrMwebHogAddrMismatch = errors.New("mweb header HogAddr mismatch")
+
+	// ErrMwebLeafsetRoot is returned when the hash of a leafset doesn't
+	// match the leafset root of its mweb header.
+	ErrMwebLeafsetRoot = errors.New("mweb leafset root mismatch")
+
+	// ErrMwebBadProof is returned when a set of mweb utxos and their
+	// proof hashes don't hash to the output root of the mweb header.
+	ErrMwebBadProof = errors.New("mweb utxos proof is bad")
+
+	// ErrMwebMMRTooTall is returned when the output MMR of an mweb header
+	// is taller than any that the chain could have at its height, which
+	// would have the proof of its utxos walked to an unreasonable depth.
+	ErrMwebMMRTooTall = errors.New("mweb output mmr too tall for height")
+
+	// ErrMwebUtxoFormat is returned when an mweb utxo isn't encoded in
+	// the output format of the mwebutxos message carrying it.
+	ErrMwebUtxoFormat = errors.New("mweb utxo output format mismatch")
+
+	// ErrMwebLeafsetConflict is returned when an mweb utxo is for a leaf
+	// that our tracked leafset has already seen spent.
+	ErrMwebLeafsetConflict = errors.New("mweb utxo conflicts with " +
+		"tracked leafset")
+
+	// ErrMwebLeafIndexRange is returned when an mweb utxo has a leaf
+	// index beyond the number of leaves in the output MMR of the mweb
+	// header.
+	ErrMwebLeafIndexRange = errors.New("mweb utxo leaf index out of " +
+		"range")
+
+	// ErrMwebTooFewProofHashes is returned when an mwebutxos message has
+	// too few proof hashes for its proof to possibly verify.
+	ErrMwebTooFewProofHashes = errors.New("mweb utxos proof has too " +
+		"few hashes")
+)
+
+// verifyMwebHeaderDetailed checks that the mweb header is for the given
+// block, and that it is committed to by the block's hogex. The returned
+// error wraps one of the ErrMweb verification errors so that callers can
+// act on the reason for the failure.
+func verifyMwebHeaderDetailed(blockHash *chainhash.Hash,
+	mwebHeader *wire.MsgMwebHeader) error {
+
+	if headerHash := mwebHeader.Merkle.Header.BlockHash(); headerHash !=
+		*blockHash {
+
+		return fmt.Errorf("%w: got %v, expected %v",
+			ErrMwebBlockHashMismatch, headerHash, blockHash)
+	}
+
+	// The flags are expanded to a bit each before the merkle block is
+	// checked, so they're bounded first.
+	if err := checkMwebMerkleBlockSize(&mwebHeader.Merkle); err != nil {
+		return err
+	}
+
+	extractResult := bloom.VerifyMerkleBlock(&mwebHeader.Merkle)
+	if !extractResult.Root.IsEqual(&mwebHeader.Merkle.Header.MerkleRoot) ||
+		len(extractResult.Match) == 0 {
+
+		return ErrMwebBadMerkleRoot
+	}
+
+	if !mwebHeader.Hogex.IsHogEx {
+		return ErrMwebNotHogEx
+	}
+
+	// Validate that the hash of the HogEx transaction in the tx message
+	// matches the hash in the merkleblock message, and that it's the
+	// last transaction committed to by the merkle root of the block.
+	finalTx := extractResult.Match[len(extractResult.Match)-1]
+	if hogexHash := mwebHeader.Hogex.TxHash(); hogexHash != *finalTx {
+		return fmt.Errorf("%w: tx hash mismatch, hogex=%v, last "+
+			"merkle tx=%v", ErrMwebBadMerkleRoot, hogexHash,
+			finalTx)
+	}
+
+	finalTxPos := extractResult.Index[len(extractResult.Index)-1]
+	if finalTxPos != mwebHeader.Merkle.Transactions-1 {
+		return fmt.Errorf("%w: tx index mismatch, got=%v, expected=%v",
+			ErrMwebBadMerkleRoot, finalTxPos,
+			mwebHeader.Merkle.Transactions-1)
+	}
+
+	return checkMwebHogAddr(&mwebHeader.Hogex, &mwebHeader.MwebHeader)
+}
+
+// checkMwebHogAddr checks that the first output of the hogex pays to the
+// HogAddr committing to the mweb header.
+func checkMwebHogAddr(hogex *wire.MsgTx, mwebHeader *wire.MwebHeader) error {
+	// Validate that the pubkey script of the first output contains the
+	// HogAddr, which shall consist of <OP_8><0x20> followed by the
+	// 32-byte hash of the MWEB header.
+	script, err := txscript.NewScriptBuilder().
+		AddOp(txscript.MwebHogAddrWitnessVersion + txscript.OP_1 - 1).
+		AddData(mwebHeader.Hash()[:]).Script()
+	if err != nil {
+		return err
+	}
+	if len(hogex.TxOut) == 0 ||
+		!bytes.Equal(hogex.TxOut[0].PkScript, script) {
+
+		return ErrMwebHogAddrMismatch
+	}
+
+	return nil
+}
+
+// checkMwebMerkleBlockSize checks that the flag and hash counts of the merkle
+// block fit a partial merkle tree of its number of transactions, which can
+// have no more hashes than transactions, and no more flag bits than it has
+// nodes.
+func checkMwebMerkleBlockSize(m *wire.MsgMerkleBlock) error {
+	numTx := m.Transactions
+	if numTx == 0 || numTx > blockchain.MaxOutputsPerBlock {
+		return fmt.Errorf("%w: %v transactions",
+			ErrMwebMalformedMerkleBlock, numTx)
+	}
+
+	numHashes := uint64(len(m.Hashes))
+	if numHashes == 0 || numHashes > uint64(numTx) {
+		return fmt.Errorf("%w: %v hashes for %v transactions",
+			ErrMwebMalformedMerkleBlock, numHashes, numTx)
+	}
+
+	// Each level of the tree is half as wide as the one below it,
+	// rounding up, up to the root.
+	var maxBits uint64
+	for width := uint64(numTx); ; width = (width + 1) / 2 {
+		maxBits += width
+		if width == 1 {
+			break
+		}
+	}
+
+	numBits := uint64(len(m.Flags)) * 8
+	if numBits < numHashes || numBits > (maxBits+7)/8*8 {
+		return fmt.Errorf("%w: %v flag bytes for %v transactions "+
+			"and %v hashes", ErrMwebMalformedMerkleBlock,
+			len(m.Flags), numTx, numHashes)
+	}
+
+	return nil
+}
+
+// verifyMwebHeader returns whether the mweb header is for the given block
+// and is committed to by the block's hogex.
+func verifyMwebHeader(blockHash *chainhash.Hash,
+	mwebHeader *wire.MsgMwebHeader) bool {
+
+	err := verifyMwebHeaderDetailed(blockHash, mwebHeader)
+	if err != nil {
+		log.Debugf("Failed to verify mwebheader: %v", err)
+		return false
+	}
+	return true
+}
+
+// VerifyLeafsetRoot returns whether the leafset bitmap hashes to the given
+// leafset root, as committed to by an mweb header.
+func VerifyLeafsetRoot(leafset []byte, root chainhash.Hash) bool {
+	return blake3Sum256(leafset) == root
+}
+
+// verifyMwebLeafsetDetailed checks that the hash of the leafset bitmap
+// matches the leafset root of the mweb header.
+func verifyMwebLeafsetDetailed(mwebHeader *wire.MwebHeader,
+	mwebLeafset *wire.MsgMwebLeafset) error {
+
+	if !VerifyLeafsetRoot(mwebLeafset.Leafset, mwebHeader.LeafsetRoot) {
+		return fmt.Errorf("%w: leafset=%v, header=%v",
+			ErrMwebLeafsetRoot,
+			blake3Sum256(mwebLeafset.Leafset),
+			mwebHeader.LeafsetRoot)
+	}
+
+	return nil
+}
+
+// verifyMwebUtxosDetailed checks that the mweb utxos are unspent in the
+// leafset, and that together with their proof hashes they hash to the
+// output root of the mweb header, under any of the root variants. Without
+// root variants only the default rule is accepted.
+func verifyMwebUtxosDetailed(variants []MwebRootVariant,
+	mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) error {
+
+	_, err := walkVerifiedMwebUtxos(
+		variants, mwebHeader, leafset, mwebUtxos,
+	)
+	return err
+}
+
+// walkVerifiedMwebUtxos is verifyMwebUtxosDetailed returning the walk over
+// the output MMR that verified the mweb utxos, which is nil for an empty
+// MMR. If the proof fails to verify, the walk is returned as far as it got,
+// or nil if it never started.
+func walkVerifiedMwebUtxos(variants []MwebRootVariant,
+	mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) (*verifyUtxosVars, error) {
+
+	if err := checkMwebUtxosFormat(mwebHeader, mwebUtxos); err != nil {
+		return nil, err
+	}
+
+	v, err := walkMwebUtxosProof(
+		variants, mwebHeader, leafset, mwebUtxos,
+	)
+	if err == ErrMwebBadProof {
+		return v, fmt.Errorf("%w: start index %v", ErrMwebBadProof,
+			mwebUtxos.StartIndex)
+	}
+
+	return v, err
+}
+
+// checkMwebUtxosFormat checks that the mweb utxos lie within the output MMR
+// of the mweb header, and carry the fields of their output format.
+func checkMwebUtxosFormat(mwebHeader *wire.MwebHeader,
+	mwebUtxos *wire.MsgMwebUtxos) error {
+
+	// A leaf index beyond the output MMR would have the walk compute
+	// node indices outside of it, so it's rejected up front.
+	for _, utxo := range mwebUtxos.Utxos {
+		if utxo.LeafIndex >= mwebHeader.OutputMMRSize {
+			return fmt.Errorf("%w: leaf index %v in mmr of "+
+				"%v leaves", ErrMwebLeafIndexRange,
+				utxo.LeafIndex, mwebHeader.OutputMMRSize)
+		}
+	}
+
+	for _, utxo := range mwebUtxos.Utxos {
+		if !mwebUtxoMatchesFormat(utxo, mwebUtxos.OutputFormat) {
+			return fmt.Errorf("%w: leaf index %v",
+				ErrMwebUtxoFormat, utxo.LeafIndex)
+		}
+	}
+
+	return nil
+}
+
+// checkMwebProofHashCount checks that the mwebutxos message has at least
+// the given ratio of the fewest proof hashes that its utxos could need in
+// the output MMR of the leafset. A ratio of one rejects every proof that has
+// too few hashes to verify.
+func checkMwebProofHashCount(ratio float64, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) error {
+
+	if len(mwebUtxos.Utxos) == 0 {
+		return nil
+	}
+
+	minHashes := minMwebProofHashes(
+		leafset.Size, mwebUtxos.Utxos[0].LeafIndex,
+		mwebUtxos.Utxos[len(mwebUtxos.Utxos)-1].LeafIndex,
+	)
+	if float64(len(mwebUtxos.ProofHashes)) < ratio*float64(minHashes) {
+		return fmt.Errorf("%w: %v given for start index %v, at least "+
+			"%v needed", ErrMwebTooFewProofHashes,
+			len(mwebUtxos.ProofHashes), mwebUtxos.StartIndex,
+			minHashes)
+	}
+
+	return nil
+}
+
+// verifyMwebUtxosTracked cross-checks the mweb utxos against the leafset
+// that we've tracked ourselves from earlier syncs. As leaves are only ever
+// appended to the output MMR, a leaf that the tracked leafset has seen
+// spent can't be unspent again unless the block it was spent in has been
+// disconnected.
+func verifyMwebUtxosTracked(tracked *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos) error {
+
+	for _, utxo := range mwebUtxos.Utxos {
+		if utxo.LeafIndex < tracked.Size &&
+			!tracked.Contains(utxo.LeafIndex) {
+
+			return fmt.Errorf("%w: leaf index %v is spent at "+
+				"height %v", ErrMwebLeafsetConflict,
+				utxo.LeafIndex, tracked.Height)
+		}
+	}
+
+	return nil
+}
+
+// mwebUtxoMatchesFormat returns whether the mweb utxo carries exactly the
+// fields that the given output format puts on the wire.
+func mwebUtxoMatchesFormat(utxo *wire.MwebNetUtxo,
+	format wire.MwebNetUtxoType) bool {
+
+	if utxo.OutputId == nil {
+		return false
+	}
+
+	switch format {
+	case wire.MwebNetUtxoHashOnly:
+		return utxo.Output == nil
+
+	case wire.MwebNetUtxoCompact:
+		return utxo.Output != nil && utxo.Output.RangeProof == nil
+
+	case wire.MwebNetUtxoFull:
+		return utxo.Output != nil
+
+	default:
+		return false
+	}
+}
+
+// MwebProofAssignment is a proof hash of a verified mwebutxos message, along
+// with the index of the MMR node that it is the hash of. The node index is
+// the number of nodes in the MMR for the bagged hash of the peaks to the
+// right of the utxos.
+type MwebProofAssignment struct {
+	NodeIdx uint64
+	Hash    chainhash.Hash
+}
+
+// MwebVerifyOption is a functional option argument to VerifyMwebUtxos.
+type MwebVerifyOption func(*mwebVerifyOptions)
+
+// mwebVerifyOptions holds the options of a call to VerifyMwebUtxos.
+type mwebVerifyOptions struct {
+	assignments *[]MwebProofAssignment
+}
+
+// MwebProofAssignments is a verify option that has the proof hashes of the
+// mweb utxos, with the nodes they were taken for, stored in assignments
+// once the utxos verify. They're in the order of the proof hashes.
+func MwebProofAssignments(
+	assignments *[]MwebProofAssignment) MwebVerifyOption {
+
+	return func(o *mwebVerifyOptions) {
+		o.assignments = assignments
+	}
+}
+
+// VerifyMwebUtxos checks that the mweb utxos are unspent in the leafset and
+// are committed to by the output root of the mweb header, returning why if
+// they aren't. It only reads its arguments, so can be used to audit mweb
+// utxos and their proofs.
+func VerifyMwebUtxos(mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos, options ...MwebVerifyOption) error {
+
+	opts := &mwebVerifyOptions{}
+	for _, option := range options {
+		option(opts)
+	}
+
+	v, err := walkVerifiedMwebUtxos(nil, mwebHeader, leafset, mwebUtxos)
+	if err != nil {
+		return err
+	}
+
+	if opts.assignments != nil {
+		*opts.assignments = v.proofAssignments()
+	}
+	return nil
+}
+
+// verifyMwebUtxos returns whether the mweb utxos are unspent in the leafset
+// and are committed to by the output root of the mweb header.
+func verifyMwebUtxos(mwebHeader *wire.MwebHeader, leafset *mweb.Leafset,
+	mwebUtxos *wire.MsgMwebUtxos, options ...MwebVerifyOption) bool {
+
+	err := VerifyMwebUtxos(mwebHeader, leafset, mwebUtxos, options...)
+	if err != nil {
+		log.Debugf("Failed to verify mwebutxos: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,1253 @@
+package neutrino
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/banman"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+)
+
+// TestVerifyMwebHeaderDetailed tests that each kind of bad mweb header
+// results in the matching verification error.
+func TestVerifyMwebHeaderDetailed(t *testing.T) {
+	t.Parallel()
+
+	header, mwebHeader, _ := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{Height: 1}, []byte{0x80},
+	)
+	blockHash := header.BlockHash()
+
+	require.NoError(t, verifyMwebHeaderDetailed(&blockHash, mwebHeader))
+	require.True(t, verifyMwebHeader(&blockHash, mwebHeader))
+
+	testCases := []struct {
+		name    string
+		corrupt func(*wire.MsgMwebHeader) *chainhash.Hash
+		err     error
+	}{
+		{
+			name: "block hash mismatch",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				return &chainhash.Hash{0x01}
+			},
+			err: ErrMwebBlockHashMismatch,
+		},
+		{
+			name: "bad merkle root",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.Merkle.Hashes = []*chainhash.Hash{{0x01}}
+				return &blockHash
+			},
+			err: ErrMwebBadMerkleRoot,
+		},
+		{
+			name: "hogex not last tx",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.Merkle.Transactions = 2
+				m.Merkle.Flags = []byte{0x03}
+				m.Merkle.Hashes = append(
+					m.Merkle.Hashes, &chainhash.Hash{},
+				)
+				return &blockHash
+			},
+			err: ErrMwebBadMerkleRoot,
+		},
+		{
+			name: "oversized flags",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.Merkle.Flags = make([]byte, 1<<20)
+				return &blockHash
+			},
+			err: ErrMwebMalformedMerkleBlock,
+		},
+		{
+			name: "more hashes than transactions",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.Merkle.Hashes = append(
+					m.Merkle.Hashes, &chainhash.Hash{},
+				)
+				return &blockHash
+			},
+			err: ErrMwebMalformedMerkleBlock,
+		},
+		{
+			name: "no transactions",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.Merkle.Transactions = 0
+				return &blockHash
+			},
+			err: ErrMwebMalformedMerkleBlock,
+		},
+		{
+			name: "not hogex",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.Hogex.IsHogEx = false
+				return &blockHash
+			},
+			err: ErrMwebNotHogEx,
+		},
+		{
+			name: "hogaddr mismatch",
+			corrupt: func(m *wire.MsgMwebHeader) *chainhash.Hash {
+				m.MwebHeader.Height++
+				return &blockHash
+			},
+			err: ErrMwebHogAddrMismatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			m := *mwebHeader
+			m.Merkle.Hashes = append(
+				[]*chainhash.Hash(nil), m.Merkle.Hashes...,
+			)
+			blockHash := tc.corrupt(&m)
+
+			err := verifyMwebHeaderDetailed(blockHash, &m)
+			require.ErrorIs(t, err, tc.err)
+			require.False(t, verifyMwebHeader(blockHash, &m))
+		})
+	}
+}
+
+// TestMwebMalformedMerkleBlockBan tests that a peer serving an mweb header
+// for the requested block with a malformed merkle block is banned.
+func TestMwebMalformedMerkleBlockBan(t *testing.T) {
+	t.Parallel()
+
+	bm, _, _, err := setupBlockManager(t)
+	require.NoError(t, err)
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebHeader, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	header, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{Height: 1}, []byte{0x80},
+	)
+	blockHash := header.BlockHash()
+
+	malformed := *mwebHeader
+	malformed.Merkle.Flags = make([]byte, 1<<20)
+	peers := &mockMwebPeers{
+		mwebHeader:  &malformed,
+		mwebLeafset: mwebLeafset,
+	}
+	bm.cfg.queryAllPeers = peers.queryAllPeers
+
+	_, _, err = bm.fetchMwebHeaderAndLeafset(&blockHash)
+	require.Error(t, err)
+	require.Equal(t, []string{"10.0.0.1:9333"}, banned)
+}
+
+// TestVerifyMwebLeafsetDetailed tests that a leafset not matching the
+// leafset root of the mweb header is rejected.
+func TestVerifyMwebLeafsetDetailed(t *testing.T) {
+	t.Parallel()
+
+	_, mwebHeader, mwebLeafset := newTestMwebHeader(
+		t, chainhash.Hash{}, wire.MwebHeader{Height: 1}, []byte{0x80},
+	)
+	require.NoError(t, verifyMwebLeafsetDetailed(
+		&mwebHeader.MwebHeader, mwebLeafset,
+	))
+
+	mwebLeafset.Leafset = []byte{0xc0}
+	require.ErrorIs(t, verifyMwebLeafsetDetailed(
+		&mwebHeader.MwebHeader, mwebLeafset,
+	), ErrMwebLeafsetRoot)
+}
+
+// TestVerifyLeafsetRoot tests that a leafset bitmap only verifies against
+// its own leafset root.
+func TestVerifyLeafsetRoot(t *testing.T) {
+	t.Parallel()
+
+	leafset := []byte{0xff, 0x80}
+	root := chainhash.Hash(blake3.Sum256(leafset))
+	require.True(t, VerifyLeafsetRoot(leafset, root))
+
+	require.False(t, VerifyLeafsetRoot([]byte{0xff, 0x00}, root))
+	require.False(t, VerifyLeafsetRoot(leafset, chainhash.Hash{}))
+	require.False(t, VerifyLeafsetRoot(nil, root))
+	require.True(t, VerifyLeafsetRoot(nil, blake3.Sum256(nil)))
+}
+
+// TestVerifyMwebUtxosDetailed tests that mweb utxos which don't hash to the
+// output root of the mweb header are rejected.
+func TestVerifyMwebUtxosDetailed(t *testing.T) {
+	t.Parallel()
+
+	// An empty set of utxos is only valid for an empty output root.
+	mwebHeader := &wire.MwebHeader{}
+	leafset := &mweb.Leafset{}
+	mwebUtxos := &wire.MsgMwebUtxos{}
+	require.NoError(t, verifyMwebUtxosDetailed(
+		nil, mwebHeader, leafset, mwebUtxos,
+	))
+	require.True(t, verifyMwebUtxos(mwebHeader, leafset, mwebUtxos))
+
+	// A single utxo must hash to the output root.
+	mwebHeader = &wire.MwebHeader{OutputMMRSize: 1}
+	leafset = &mweb.Leafset{Bits: []byte{0x80}, Size: 1}
+	mwebUtxos = newMockMwebUtxos(wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	))
+	err := verifyMwebUtxosDetailed(
+		nil, mwebHeader, leafset, mwebUtxos,
+	)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+	require.False(t, verifyMwebUtxos(mwebHeader, leafset, mwebUtxos))
+}
+
+// TestMwebMMRTooTall tests that the proof of mweb utxos is rejected without
+// being walked when the output MMR claimed by the mweb header is too tall for
+// the height of the chain, and that the peer serving it is banned.
+func TestMwebMMRTooTall(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, uint64(maxMmrHeight), maxMwebMMRHeight(0))
+	require.Equal(t, uint64(14), maxMwebMMRHeight(1))
+	require.Equal(t, uint64(44), maxMwebMMRHeight(1<<30))
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+
+	mmr := newTestMwebMmr(8)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset()
+	q.leafset.Height = 1
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 8, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(q.leafset, req)
+	require.NoError(t, verifyMwebUtxosDetailed(
+		nil, q.mwebHeader, q.leafset, resp,
+	))
+
+	// A header claiming a trillion outputs a block after activation
+	// can't be right.
+	q.leafset.Size = 1 << 40
+	err := verifyMwebUtxosDetailed(
+		nil, q.mwebHeader, q.leafset, resp,
+	)
+	require.ErrorIs(t, err, ErrMwebMMRTooTall)
+
+	// Much further up the chain, the same MMR is plausible, and the
+	// proof is walked only to be found bad.
+	q.leafset.Height = 1 << 30
+	err = verifyMwebUtxosDetailed(
+		nil, q.mwebHeader, q.leafset, resp,
+	)
+	require.ErrorIs(t, err, ErrMwebBadProof)
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	q.leafset.Height = 1
+	progress := q.handleResponse(req, resp, "peer")
+	require.Equal(t, query.Progress{}, progress)
+	require.Equal(t, []string{"peer"}, banned)
+}
+
+// TestMwebLeafIndexRange tests that mweb utxos with a leaf index beyond the
+// output MMR of the mweb header are rejected before the proof is walked, and
+// that the peer serving them is banned.
+func TestMwebLeafIndexRange(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+
+	// The leafset runs past the eight leaves of the header's MMR, so the
+	// utxos beyond them still look unspent.
+	mmr := newTestMwebMmr(16)
+	q.leafset = mmr.leafset()
+	q.mwebHeader = newTestMwebMmr(8).mwebHeader()
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 4, 8, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(q.leafset, req)
+	err := verifyMwebUtxosDetailed(
+		nil, q.mwebHeader, q.leafset, resp,
+	)
+	require.ErrorIs(t, err, ErrMwebLeafIndexRange)
+	require.ErrorContains(t, err, "leaf index 8 in mmr of 8 leaves")
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	progress := q.handleResponse(req, resp, "peer")
+	require.Equal(t, query.Progress{}, progress)
+	require.Equal(t, []string{"peer"}, banned)
+}
+
+// TestMwebProofAssignments tests that the proof hashes of verified mweb utxos
+// are returned with the nodes they were taken for, and that together with
+// the utxos they rebuild the output root.
+func TestMwebProofAssignments(t *testing.T) {
+	t.Parallel()
+
+	mmr := newTestMwebMmr(11)
+	mwebHeader := mmr.mwebHeader()
+	leafset := mmr.leafset(2, 9)
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 3, 4, wire.MwebNetUtxoCompact,
+	)
+	resp := mmr.proveUtxos(leafset, req)
+
+	var assignments []MwebProofAssignment
+	require.NoError(t, VerifyMwebUtxos(
+		mwebHeader, leafset, resp, MwebProofAssignments(&assignments),
+	))
+	require.Len(t, assignments, len(resp.ProofHashes))
+
+	positions, err := MwebProofHashPositions(leafset, 3, 6)
+	require.NoError(t, err)
+	for i, assignment := range assignments {
+		require.Equal(t, positions[i], assignment.NodeIdx)
+		require.Equal(t, *resp.ProofHashes[i], assignment.Hash)
+	}
+
+	// Rebuild the output root from the utxos and the assigned hashes
+	// alone.
+	nextNodeIdx := mmr.nextNodeIdx()
+	assigned := make(map[nodeIdx]*chainhash.Hash)
+	for i := range assignments {
+		assigned[nodeIdx(assignments[i].NodeIdx)] = &assignments[i].Hash
+	}
+	leaves := make(map[leafIdx]*chainhash.Hash)
+	for _, utxo := range resp.Utxos {
+		leaves[leafIdx(utxo.LeafIndex)] = utxo.OutputId
+	}
+
+	var rebuild func(node nodeIdx, height uint64) *chainhash.Hash
+	rebuild = func(node nodeIdx, height uint64) *chainhash.Hash {
+		if hash, ok := assigned[node]; ok {
+			return hash
+		}
+		if height == 0 {
+			outputId, ok := leaves[node.leafIdx()]
+			require.True(t, ok, "no hash for leaf %v", node)
+			return node.hash(outputId[:])
+		}
+		left := rebuild(node.left(height), height-1)
+		right := rebuild(node.right(), height-1)
+		return node.parentHash(left[:], right[:])
+	}
+
+	var peakHashes []*chainhash.Hash
+	for _, peak := range calcPeaks(uint64(nextNodeIdx)) {
+		peakHashes = append(peakHashes, rebuild(peak, peak.height()))
+		if peak < leafIdx(6).nodeIdx() {
+			continue
+		}
+
+		// The peaks after the one holding the last utxo are given
+		// as a single bagged hash.
+		if bagged, ok := assigned[nextNodeIdx]; ok {
+			peakHashes = append(peakHashes, bagged)
+		}
+		break
+	}
+	root := bagPeaks(peakHashes, nextNodeIdx)
+	require.Equal(t, mwebHeader.OutputRoot, *root)
+
+	// Nothing is assigned for utxos that don't verify.
+	assignments = nil
+	mwebHeader.OutputRoot = chainhash.Hash{0x01}
+	require.ErrorIs(t, VerifyMwebUtxos(
+		mwebHeader, leafset, resp, MwebProofAssignments(&assignments),
+	), ErrMwebBadProof)
+	require.Nil(t, assignments)
+	require.False(t, verifyMwebUtxos(mwebHeader, leafset, resp))
+}
+
+// testMwebMmr is an mweb output MMR built from a list of output ids. It is
+// used to produce the utxo proofs that an honest peer would serve.
+type testMwebMmr struct {
+	outputIds []chainhash.Hash
+}
+
+// newTestMwebMmr creates an MMR with the given number of leaves. Output ids
+// are derived from the leaf index, so an MMR that is grown keeps the same
+// prefix of leaves.
+func newTestMwebMmr(numLeaves int) *testMwebMmr {
+	m := &testMwebMmr{}
+	m.appendLeaves(numLeaves)
+	return m
+}
+
+// appendLeaves adds the given number of leaves to the MMR.
+func (m *testMwebMmr) appendLeaves(numLeaves int) {
+	for i := 0; i < numLeaves; i++ {
+		n := len(m.outputIds)
+		m.outputIds = append(m.outputIds, chainhash.Hash{
+			byte(n), byte(n >> 8), 0xff,
+		})
+	}
+}
+
+// testMmrNodeIdx returns the node index of the given leaf.
+func testMmrNodeIdx(leafIndex uint64) uint64 {
+	return 2*leafIndex - uint64(bits.OnesCount64(leafIndex))
+}
+
+// testMmrHeight returns the height of the given node.
+func testMmrHeight(node uint64) uint64 {
+	height := node
+	h := 64 - bits.LeadingZeros64(node)
+	for peakSize := uint64(1<<h - 1); peakSize > 0; peakSize >>= 1 {
+		if height >= peakSize {
+			height -= peakSize
+		}
+	}
+	return height
+}
+
+// testMmrLeafIdx returns the leaf index of the given leaf node.
+func testMmrLeafIdx(node uint64) uint64 {
+	leafIndex := uint64(0)
+	h := 64 - bits.LeadingZeros64(node)
+	for peakSize := uint64(1<<h - 1); peakSize > 0; peakSize >>= 1 {
+		if node >= peakSize {
+			leafIndex += (peakSize + 1) / 2
+			node -= peakSize
+		}
+	}
+	return leafIndex
+}
+
+// testMmrPeaks returns the peaks of an MMR with the given number of nodes.
+func testMmrPeaks(nodes uint64) []uint64 {
+	var peaks []uint64
+	sumPrevPeaks := uint64(0)
+	h := 64 - bits.LeadingZeros64(nodes)
+	for peakSize := uint64(1<<h - 1); peakSize > 0; peakSize >>= 1 {
+		if nodes >= peakSize {
+			peaks = append(peaks, sumPrevPeaks+peakSize-1)
+			sumPrevPeaks += peakSize
+			nodes -= peakSize
+		}
+	}
+	return peaks
+}
+
+// testMmrHash hashes the data of a leaf node.
+func testMmrHash(node uint64, data []byte) chainhash.Hash {
+	h := blake3.New(32, nil)
+	binary.Write(h, binary.LittleEndian, node)
+	wire.WriteVarBytes(h, 0, data)
+	return *(*chainhash.Hash)(h.Sum(nil))
+}
+
+// testMmrParentHash hashes the children of a parent node.
+func testMmrParentHash(node uint64,
+	left, right chainhash.Hash) chainhash.Hash {
+
+	h := blake3.New(32, nil)
+	binary.Write(h, binary.LittleEndian, node)
+	h.Write(left[:])
+	h.Write(right[:])
+	return *(*chainhash.Hash)(h.Sum(nil))
+}
+
+// nodeHash computes the hash of the given node.
+func (m *testMwebMmr) nodeHash(node uint64) chainhash.Hash {
+	height := testMmrHeight(node)
+	if height == 0 {
+		outputId := m.outputIds[testMmrLeafIdx(node)]
+		return testMmrHash(node, outputId[:])
+	}
+	return testMmrParentHash(node, m.nodeHash(node-(1<<height)),
+		m.nodeHash(node-1))
+}
+
+// baggedPeaks bags the given peaks from right to left.
+func (m *testMwebMmr) baggedPeaks(peaks []uint64) chainhash.Hash {
+	nextNode := testMmrNodeIdx(uint64(len(m.outputIds)))
+	bagged := m.nodeHash(peaks[len(peaks)-1])
+	for i := len(peaks) - 2; i >= 0; i-- {
+		bagged = testMmrParentHash(
+			nextNode, m.nodeHash(peaks[i]), bagged,
+		)
+	}
+	return bagged
+}
+
+// root returns the output root of the MMR.
+func (m *testMwebMmr) root() chainhash.Hash {
+	if len(m.outputIds) == 0 {
+		return chainhash.Hash{}
+	}
+	return m.baggedPeaks(testMmrPeaks(
+		testMmrNodeIdx(uint64(len(m.outputIds))),
+	))
+}
+
+// nextNodeIdx returns the index of the next node to be added to the MMR.
+func (m *testMwebMmr) nextNodeIdx() nodeIdx {
+	return nodeIdx(testMmrNodeIdx(uint64(len(m.outputIds))))
+}
+
+// mwebHeader returns an mweb header committing to the MMR.
+func (m *testMwebMmr) mwebHeader() *wire.MwebHeader {
+	return &wire.MwebHeader{
+		OutputRoot:    m.root(),
+		OutputMMRSize: uint64(len(m.outputIds)),
+	}
+}
+
+// leafset returns a leafset of the MMR with every leaf unspent except the
+// given ones.
+func (m *testMwebMmr) leafset(spent ...uint64) *mweb.Leafset {
+	size := uint64(len(m.outputIds))
+	leafset := &mweb.Leafset{Bits: make([]byte, (size+7)/8), Size: size}
+	for i := uint64(0); i < size; i++ {
+		leafset.Bits[i/8] |= 0x80 >> (i % 8)
+	}
+	for _, i := range spent {
+		leafset.Bits[i/8] &^= 0x80 >> (i % 8)
+	}
+	return leafset
+}
+
+// testMmrProver walks the MMR in the same way as mweb.VerifyUtxos, but
+// supplies the true hash of any node that the verifier expects to be given
+// as a proof hash, recording them in order.
+type testMmrProver struct {
+	mmr           *testMwebMmr
+	leafset       *mweb.Leafset
+	utxos         []*wire.MwebNetUtxo
+	firstLeafNode uint64
+	lastLeafNode  uint64
+	leavesUsed    int
+	proofHashes   []*chainhash.Hash
+	isProofHash   map[uint64]bool
+	nextNode      uint64
+	bagged        chainhash.Hash
+}
+
+func (p *testMmrProver) nextHash(node uint64) *chainhash.Hash {
+	hash := p.bagged
+	if node != p.nextNode {
+		hash = p.mmr.nodeHash(node)
+	}
+	p.proofHashes = append(p.proofHashes, &hash)
+	p.isProofHash[node] = true
+	return &hash
+}
+
+func (p *testMmrProver) calcNodeHash(node, height uint64) *chainhash.Hash {
+	if node < p.firstLeafNode || p.isProofHash[node] {
+		return p.nextHash(node)
+	}
+	if height == 0 {
+		if !p.leafset.Contains(testMmrLeafIdx(node)) {
+			return nil
+		}
+		outputId := p.utxos[p.leavesUsed].OutputId
+		p.leavesUsed++
+		hash := testMmrHash(node, outputId[:])
+		return &hash
+	}
+	leftNode := node - (1 << height)
+	left := p.calcNodeHash(leftNode, height-1)
+	var right *chainhash.Hash
+	if p.lastLeafNode <= leftNode {
+		right = p.nextHash(node - 1)
+	} else {
+		right = p.calcNodeHash(node-1, height-1)
+	}
+	switch {
+	case left == nil && right == nil:
+		return nil
+	case left == nil:
+		left = p.nextHash(leftNode)
+	case right == nil:
+		right = p.nextHash(node - 1)
+	}
+	hash := testMmrParentHash(node, *left, *right)
+	return &hash
+}
+
+// proveUtxos returns the mwebutxos message that an honest peer would serve
+// for the given request against the leafset.
+func (m *testMwebMmr) proveUtxos(leafset *mweb.Leafset,
+	req *wire.MsgGetMwebUtxos) *wire.MsgMwebUtxos {
+
+	resp := &wire.MsgMwebUtxos{
+		BlockHash:    req.BlockHash,
+		StartIndex:   req.StartIndex,
+		OutputFormat: req.OutputFormat,
+	}
+	index := req.StartIndex
+	for len(resp.Utxos) < int(req.NumRequested) && index < leafset.Size {
+		if leafset.Contains(index) {
+			outputId := m.outputIds[index]
+			resp.Utxos = append(resp.Utxos, &wire.MwebNetUtxo{
+				LeafIndex: index,
+				Output:    &wire.MwebOutput{},
+				OutputId:  &outputId,
+			})
+		}
+		index++
+	}
+	if len(resp.Utxos) == 0 {
+		return resp
+	}
+
+	p := &testMmrProver{
+		mmr:           m,
+		leafset:       leafset,
+		utxos:         resp.Utxos,
+		firstLeafNode: testMmrNodeIdx(req.StartIndex),
+		lastLeafNode: testMmrNodeIdx(
+			resp.Utxos[len(resp.Utxos)-1].LeafIndex,
+		),
+		isProofHash: make(map[uint64]bool),
+		nextNode:    testMmrNodeIdx(leafset.Size),
+	}
+
+	// As with the verifier, the first pass discovers which nodes are
+	// proof hashes, and the second gives their canonical order.
+	peaks := testMmrPeaks(p.nextNode)
+	for i := 0; i < 2; i++ {
+		p.leavesUsed = 0
+		p.proofHashes = nil
+
+		for j, peak := range peaks {
+			if p.calcNodeHash(peak, testMmrHeight(peak)) == nil {
+				p.nextHash(peak)
+			}
+			if p.lastLeafNode <= peak {
+				if j != len(peaks)-1 {
+					p.bagged = m.baggedPeaks(peaks[j+1:])
+					p.nextHash(p.nextNode)
+				}
+				break
+			}
+		}
+	}
+	resp.ProofHashes = p.proofHashes
+
+	return resp
+}
+
+// TestTestMwebMmrProofs tests that the proofs produced by the test MMR are
+// accepted by the verifier, so that other tests can rely on them.
+func TestTestMwebMmrProofs(t *testing.T) {
+	t.Parallel()
+
+	mmr := newTestMwebMmr(21)
+	mwebHeader := mmr.mwebHeader()
+	for _, leafset := range []*mweb.Leafset{
+		mmr.leafset(), mmr.leafset(0, 3, 4, 11, 20), mmr.leafset(7),
+	} {
+		for start := uint64(0); start < leafset.Size; start++ {
+			if !leafset.Contains(start) {
+				continue
+			}
+			for count := uint16(1); count <= 5; count++ {
+				req := wire.NewMsgGetMwebUtxos(chainhash.Hash{},
+					start, count, wire.MwebNetUtxoCompact)
+				resp := mmr.proveUtxos(leafset, req)
+				require.NoError(t, verifyMwebUtxosDetailed(
+					nil, mwebHeader, leafset, resp,
+				), "start=%v count=%v", start, count)
+			}
+		}
+	}
+}
+
+// TestMwebProofHashPositions tests the proof hash positions computed for
+// small trees against ones derived by hand.
+func TestMwebProofHashPositions(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name      string
+		size      uint64
+		spent     []uint64
+		start     uint64
+		last      uint64
+		positions []uint64
+		err       bool
+	}{
+		{
+			// A single peak of 4 leaves, fetching the right pair
+			// needs the left pair's parent (node 2).
+			name:      "right half of single peak",
+			size:      4,
+			start:     2,
+			last:      3,
+			positions: []uint64{2},
+		},
+		{
+			// Peaks at nodes 6 and 7. Fetching leaf 0 needs its
+			// sibling (node 1), its parent's sibling (node 5), then
+			// the bagged peak to the right at node 8.
+			name:      "first leaf with peak to the right",
+			size:      5,
+			start:     0,
+			last:      0,
+			positions: []uint64{1, 5, 8},
+		},
+		{
+			// Leaf 1 is spent, so its hash must be given within the
+			// span of leaves 0 and 2, followed by the sibling of
+			// leaf 2 (node 4).
+			name:      "spent leaf within span",
+			size:      4,
+			spent:     []uint64{1},
+			start:     0,
+			last:      2,
+			positions: []uint64{1, 4},
+		},
+		{
+			// Leaves 1 to 4 are spent. Node 5 covers leaves 2
+			// and 3, node 7 is leaf 4 and node 12 covers leaves 6
+			// and 7.
+			name:      "spent subtrees within span",
+			size:      8,
+			spent:     []uint64{1, 2, 3, 4},
+			start:     0,
+			last:      5,
+			positions: []uint64{1, 5, 7, 12},
+		},
+		{
+			// Fetching the last leaf of the last peak needs all the
+			// peaks before it.
+			name:      "last peak",
+			size:      7,
+			start:     6,
+			last:      6,
+			positions: []uint64{6, 9},
+		},
+		{
+			name:  "spent start",
+			size:  4,
+			spent: []uint64{0},
+			start: 0,
+			last:  1,
+			err:   true,
+		},
+		{
+			name:  "last before start",
+			size:  4,
+			start: 2,
+			last:  1,
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mmr := newTestMwebMmr(int(tc.size))
+			leafset := mmr.leafset(tc.spent...)
+			positions, err := MwebProofHashPositions(
+				leafset, tc.start, tc.last,
+			)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.positions, positions)
+		})
+	}
+
+	// There's a position for every proof hash that an honest peer
+	// serves.
+	mmr := newTestMwebMmr(21)
+	leafset := mmr.leafset(0, 3, 4, 11, 20)
+	for start := uint64(0); start < leafset.Size; start++ {
+		if !leafset.Contains(start) {
+			continue
+		}
+		req := wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, start, 5, wire.MwebNetUtxoCompact,
+		)
+		resp := mmr.proveUtxos(leafset, req)
+		positions, err := MwebProofHashPositions(
+			leafset, start, resp.Utxos[len(resp.Utxos)-1].LeafIndex,
+		)
+		require.NoError(t, err)
+		require.Len(t, positions, len(resp.ProofHashes),
+			"start=%v", start)
+	}
+}
+
+// TestMinMwebProofHashes tests that the fewest proof hashes that a span of
+// leaves could need never exceeds the number that its proof actually takes,
+// and matches it when no leaves are spent.
+func TestMinMwebProofHashes(t *testing.T) {
+	t.Parallel()
+
+	for size := uint64(1); size <= 40; size++ {
+		mmr := newTestMwebMmr(int(size))
+		var spent []uint64
+		for i := uint64(1); i < size; i += 3 {
+			spent = append(spent, i)
+		}
+
+		for first := uint64(0); first < size; first++ {
+			for last := first; last < size; last++ {
+				minHashes := minMwebProofHashes(
+					size, first, last,
+				)
+
+				positions, err := MwebProofHashPositions(
+					mmr.leafset(), first, last,
+				)
+				require.NoError(t, err)
+				require.Equal(t, len(positions), minHashes,
+					"size %v first %v last %v", size,
+					first, last)
+
+				leafset := mmr.leafset(spent...)
+				if !leafset.Contains(first) ||
+					!leafset.Contains(last) {
+
+					continue
+				}
+				positions, err = MwebProofHashPositions(
+					leafset, first, last,
+				)
+				require.NoError(t, err)
+				require.LessOrEqual(t, minHashes,
+					len(positions), "size %v first %v "+
+						"last %v spent", size, first,
+					last)
+			}
+		}
+	}
+
+	require.Zero(t, minMwebProofHashes(4, 2, 1))
+	require.Zero(t, minMwebProofHashes(4, 0, 4))
+}
+
+// TestMwebTooFewProofHashes tests that with a minimum proof hash ratio, an
+// mwebutxos response with too few proof hashes to verify is rejected without
+// its proof being walked, and the peer serving it is banned.
+func TestMwebTooFewProofHashes(t *testing.T) {
+	t.Parallel()
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+	go func() {
+		for range q.utxosChan {
+		}
+	}()
+
+	mmr := newTestMwebMmr(29)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset(2, 9)
+	q.leafset.Height = 1
+
+	// Every walk of a proof is timed, whether or not it verifies, so
+	// the timings tell us whether the proof was walked.
+	bm.mwebVerifyTimer = newMwebVerifyTimer()
+	walked := func() uint64 {
+		var count uint64
+		for _, bucket := range bm.mwebVerifyTimer.snapshot() {
+			count += bucket.Count
+		}
+		return count
+	}
+
+	var banned []string
+	bm.cfg.BanPeer = func(addr string, reason banman.Reason) error {
+		require.Equal(t, banman.InvalidMwebUtxos, reason)
+		banned = append(banned, addr)
+		return nil
+	}
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 3, 4, wire.MwebNetUtxoCompact,
+	)
+	short := mmr.proveUtxos(q.leafset, req)
+	require.Greater(t, len(short.ProofHashes), 2)
+	short.ProofHashes = short.ProofHashes[:2]
+
+	// Without a ratio, the short proof is walked before it's rejected.
+	require.False(t, q.handleResponse(req, short, "peer1").Finished)
+	require.Equal(t, uint64(1), walked())
+	require.Equal(t, []string{"peer1"}, banned)
+
+	bm.cfg.MwebMinProofHashRatio = 1
+	require.False(t, q.handleResponse(req, short, "peer2").Finished)
+	require.Equal(t, uint64(1), walked())
+	require.Equal(t, []string{"peer1", "peer2"}, banned)
+
+	// A full proof passes the check and verifies.
+	resp := mmr.proveUtxos(q.leafset, req)
+	require.True(t, q.handleResponse(req, resp, "peer3").Finished)
+	require.Equal(t, uint64(2), walked())
+	require.Equal(t, []string{"peer1", "peer2"}, banned)
+
+	err := checkMwebProofHashCount(1, q.leafset, short)
+	require.ErrorIs(t, err, ErrMwebTooFewProofHashes)
+	require.NoError(t, checkMwebProofHashCount(0.4, q.leafset, short))
+}
+
+// TestBagPeaks tests that peaks are bagged from right to left, and that the
+// bagged peaks of an MMR with 1 to 4 peaks give an output root that ltcd
+// accepts proofs against.
+func TestBagPeaks(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, bagPeaks(nil, 0))
+
+	p := []*chainhash.Hash{{0x01}, {0x02}, {0x03}, {0x04}}
+	n := nodeIdx(100)
+	parent := func(left, right *chainhash.Hash) *chainhash.Hash {
+		return n.parentHash(left[:], right[:])
+	}
+
+	testCases := []struct {
+		peaks []*chainhash.Hash
+		want  *chainhash.Hash
+	}{
+		{p[:1], p[0]},
+		{p[:2], parent(p[0], p[1])},
+		{p[:3], parent(p[0], parent(p[1], p[2]))},
+		{p[:4], parent(p[0], parent(p[1], parent(p[2], p[3])))},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.want, bagPeaks(tc.peaks, n),
+			"%d peaks", len(tc.peaks))
+	}
+
+	// Bagging in the other direction must give a different hash.
+	require.NotEqual(t, parent(parent(p[0], p[1]), p[2]),
+		bagPeaks(p[:3], n))
+
+	// MMRs with 4, 6, 7 and 15 leaves have 1, 2, 3 and 4 peaks.
+	for numPeaks, numLeaves := range []int{4, 6, 7, 15} {
+		mmr := newTestMwebMmr(numLeaves)
+		peaks := calcPeaks(uint64(mmr.nextNodeIdx()))
+		require.Len(t, peaks, numPeaks+1)
+
+		mwebHeader := mmr.mwebHeader()
+		leafset := mmr.leafset()
+		for start := uint64(0); start < leafset.Size; start++ {
+			req := wire.NewMsgGetMwebUtxos(chainhash.Hash{},
+				start, 1, wire.MwebNetUtxoCompact)
+			resp := mmr.proveUtxos(leafset, req)
+			require.True(t, mweb.VerifyUtxos(
+				mwebHeader, leafset, resp,
+			), "leaves=%v start=%v", numLeaves, start)
+		}
+	}
+}
+
+// TestMwebMmrPeaks tests that the peaks of the output MMR are recomputed
+// from the stored coins, as long as none of the peaks cover a spent leaf.
+func TestMwebMmrPeaks(t *testing.T) {
+	t.Parallel()
+
+	coinDB := newMockCoinDatabase()
+	s := &ChainService{MwebCoinDB: coinDB}
+
+	// An empty MMR has no peaks.
+	peaks, err := s.MwebMmrPeaks()
+	require.NoError(t, err)
+	require.Empty(t, peaks)
+
+	// An MMR of 11 leaves has peaks of 8, 2 and 1 leaves.
+	mmr := newTestMwebMmr(11)
+	coinDB.leafset = mmr.leafset()
+	for i, outputId := range mmr.outputIds {
+		outputId := outputId
+		coinDB.coins[uint64(i)] = &wire.MwebNetUtxo{
+			LeafIndex: uint64(i),
+			OutputId:  &outputId,
+		}
+	}
+
+	expectedPeaks := []nodeIdx{14, 17, 18}
+	require.Equal(t, expectedPeaks, calcPeaks(uint64(mmr.nextNodeIdx())))
+
+	var expected []chainhash.Hash
+	for _, peak := range expectedPeaks {
+		expected = append(expected, mmr.nodeHash(uint64(peak)))
+	}
+	peaks, err = s.MwebMmrPeaks()
+	require.NoError(t, err)
+	require.Equal(t, expected, peaks)
+
+	bagged := bagPeaks([]*chainhash.Hash{
+		&peaks[0], &peaks[1], &peaks[2],
+	}, mmr.nextNodeIdx())
+	require.Equal(t, mmr.root(), *bagged)
+
+	// Once a leaf is spent, the peak covering it can't be recomputed.
+	coinDB.leafset = mmr.leafset(9)
+	delete(coinDB.coins, 9)
+	_, err = s.MwebMmrPeaks()
+	require.ErrorIs(t, err, ErrMwebPeakUnknown)
+}
+
+// TestVerifyMwebUtxosPeakCounts tests the edge cases of bagging the peaks
+// into the output root: an MMR with a single peak has that peak as its
+// root, and a walk that gives no peaks is rejected rather than panicking.
+func TestVerifyMwebUtxosPeakCounts(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, bagPeaks([]*chainhash.Hash{}, 0))
+
+	// MMRs of 1, 2, 4 and 8 leaves have a single peak.
+	for _, numLeaves := range []int{1, 2, 4, 8} {
+		mmr := newTestMwebMmr(numLeaves)
+		peaks := calcPeaks(uint64(mmr.nextNodeIdx()))
+		require.Len(t, peaks, 1)
+
+		root := mmr.root()
+		require.Equal(t, mmr.nodeHash(uint64(peaks[0])), root)
+
+		mwebHeader := &wire.MwebHeader{OutputRoot: root}
+		leafset := mmr.leafset()
+		for start := uint64(0); start < leafset.Size; start++ {
+			req := wire.NewMsgGetMwebUtxos(chainhash.Hash{},
+				start, uint16(leafset.Size-start),
+				wire.MwebNetUtxoCompact)
+			resp := mmr.proveUtxos(leafset, req)
+			require.True(t, verifyMwebUtxosProof(
+				mwebHeader, leafset, resp,
+			), "leaves=%v start=%v", numLeaves, start)
+
+			// The lone peak mustn't be bagged with anything,
+			// such as an extra proof hash.
+			resp.ProofHashes = append(resp.ProofHashes,
+				&chainhash.Hash{})
+			require.False(t, verifyMwebUtxosProof(
+				mwebHeader, leafset, resp,
+			), "leaves=%v start=%v", numLeaves, start)
+		}
+	}
+
+	// An empty MMR has no peaks, so no utxos can be proven against it,
+	// whatever the output root.
+	leafset := &mweb.Leafset{}
+	resp := newMockMwebUtxos(wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 0, 1, wire.MwebNetUtxoCompact,
+	))
+	for _, root := range []chainhash.Hash{{}, {0x01}} {
+		mwebHeader := &wire.MwebHeader{OutputRoot: root}
+		require.NotPanics(t, func() {
+			require.False(t, verifyMwebUtxosProof(
+				mwebHeader, leafset, resp,
+			))
+		})
+	}
+
+	// The walk itself gives no peaks for an empty MMR.
+	v := &verifyUtxosVars{
+		mwebUtxos:   resp,
+		leafset:     leafset,
+		isProofHash: make(map[nodeIdx]bool),
+	}
+	require.Empty(t, v.calcPeakHashes())
+}
+
+// TestMmrHasherPool tests that hashers taken from the pool are fully reset,
+// so that hashes match those of a fresh hasher whatever the pooled hasher
+// was last used for.
+func TestMmrHasherPool(t *testing.T) {
+	// Leave a hasher in the pool that has written enough data to span
+	// several chunks.
+	h := newMmrHasher(0)
+	h.Write(make([]byte, 10000))
+	h.Sum(nil)
+	mmrHasherPool.Put(h)
+
+	for _, node := range []nodeIdx{0, 1, 2, 1 << 40} {
+		data := []byte{byte(node), 0xaa}
+		fresh := blake3.New(32, nil)
+		binary.Write(fresh, binary.LittleEndian, uint64(node))
+		wire.WriteVarBytes(fresh, 0, data)
+		require.Equal(t, fresh.Sum(nil), node.hash(data)[:])
+
+		left, right := chainhash.Hash{0x01}, chainhash.Hash{0x02}
+		fresh = blake3.New(32, nil)
+		binary.Write(fresh, binary.LittleEndian, uint64(node))
+		fresh.Write(left[:])
+		fresh.Write(right[:])
+		require.Equal(t, fresh.Sum(nil),
+			node.parentHash(left[:], right[:])[:])
+	}
+}
+
+// BenchmarkMwebNodeHash compares hashing an MMR node with a freshly
+// allocated blake3 hasher against one taken from the pool.
+func BenchmarkMwebNodeHash(b *testing.B) {
+	left, right := chainhash.Hash{0x01}, chainhash.Hash{0x02}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h := blake3.New(32, nil)
+			binary.Write(h, binary.LittleEndian, uint64(i))
+			h.Write(left[:])
+			h.Write(right[:])
+			h.Sum(nil)
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			nodeIdx(i).parentHash(left[:], right[:])
+		}
+	})
+}
+
+// BenchmarkVerifyMwebUtxosProof benchmarks verifying a full batch of mweb
+// utxos against a 10k leaf MMR.
+func BenchmarkVerifyMwebUtxosProof(b *testing.B) {
+	mmr := newTestMwebMmr(10000)
+	mwebHeader := mmr.mwebHeader()
+	leafset := mmr.leafset()
+	resp := mmr.proveUtxos(leafset, wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 2048, wire.MaxMwebUtxosPerQuery,
+		wire.MwebNetUtxoCompact,
+	))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !verifyMwebUtxosProof(mwebHeader, leafset, resp) {
+			b.Fatal("proof failed to verify")
+		}
+	}
+}
+
+// TestVerifyMwebUtxosMatchesLtcd runs random trees and proofs, honest and
+// tampered with, through both our walk over the output MMR and the one in
+// mweb.VerifyUtxos that it follows, checking that they always agree.
+func TestVerifyMwebUtxosMatchesLtcd(t *testing.T) {
+	t.Parallel()
+
+	rng := rand.New(rand.NewSource(1))
+
+	// Each tampering is given the response to change in place.
+	tamperings := []func(resp *wire.MsgMwebUtxos){
+		// An honest proof is left as it is.
+		func(resp *wire.MsgMwebUtxos) {},
+
+		// A proof hash is corrupted.
+		func(resp *wire.MsgMwebUtxos) {
+			if len(resp.ProofHashes) == 0 {
+				return
+			}
+			i := rng.Intn(len(resp.ProofHashes))
+			hash := *resp.ProofHashes[i]
+			hash[rng.Intn(len(hash))] ^= 0x01
+			resp.ProofHashes[i] = &hash
+		},
+
+		// A proof hash is dropped.
+		func(resp *wire.MsgMwebUtxos) {
+			if len(resp.ProofHashes) == 0 {
+				return
+			}
+			i := rng.Intn(len(resp.ProofHashes))
+			hashes := resp.ProofHashes
+			resp.ProofHashes = append(hashes[:i:i], hashes[i+1:]...)
+		},
+
+		// An extra proof hash is given.
+		func(resp *wire.MsgMwebUtxos) {
+			resp.ProofHashes = append(
+				resp.ProofHashes, &chainhash.Hash{0x01},
+			)
+		},
+
+		// The last utxo is dropped.
+		func(resp *wire.MsgMwebUtxos) {
+			resp.Utxos = resp.Utxos[:len(resp.Utxos)-1]
+		},
+
+		// A utxo claims another leaf.
+		func(resp *wire.MsgMwebUtxos) {
+			i := rng.Intn(len(resp.Utxos))
+			utxo := *resp.Utxos[i]
+			utxo.LeafIndex++
+			resp.Utxos[i] = &utxo
+		},
+
+		// A utxo has another output id.
+		func(resp *wire.MsgMwebUtxos) {
+			i := rng.Intn(len(resp.Utxos))
+			utxo := *resp.Utxos[i]
+			outputId := *utxo.OutputId
+			outputId[0] ^= 0x01
+			utxo.OutputId = &outputId
+			resp.Utxos[i] = &utxo
+		},
+
+		// The proof claims to start elsewhere.
+		func(resp *wire.MsgMwebUtxos) {
+			resp.StartIndex++
+		},
+	}
+
+	for i := 0; i < 1000; i++ {
+		mmr := newTestMwebMmr(1 + rng.Intn(80))
+		mwebHeader := mmr.mwebHeader()
+
+		var spent []uint64
+		for leaf := range mmr.outputIds {
+			if rng.Intn(4) == 0 {
+				spent = append(spent, uint64(leaf))
+			}
+		}
+		leafset := mmr.leafset(spent...)
+
+		start := uint64(rng.Intn(int(leafset.Size)))
+		if !leafset.Contains(start) {
+			continue
+		}
+		count := uint16(1 + rng.Intn(10))
+		req := wire.NewMsgGetMwebUtxos(
+			chainhash.Hash{}, start, count, wire.MwebNetUtxoCompact,
+		)
+
+		tamper := rng.Intn(len(tamperings))
+		resp := mmr.proveUtxos(leafset, req)
+		tamperings[tamper](resp)
+
+		require.Equal(t,
+			mweb.VerifyUtxos(mwebHeader, leafset, resp),
+			verifyMwebUtxosProof(mwebHeader, leafset, resp),
+			"leaves=%v spent=%v start=%v count=%v tamper=%v",
+			leafset.Size, spent, start, count, tamper,
+		)
+	}
+}
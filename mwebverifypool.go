@@ -0,0 +1,115 @@
+package neutrino
+
+import (
+	"sync"
+)
+
+// mwebVerifyPool runs the verification of mweb utxos responses on a fixed
+// number of goroutines of its own. This way the CPU-bound work of verifying
+// proofs is kept apart from the goroutines handling our peers' messages,
+// and no more than the pool's size of verifications run at once, however
+// many peers are serving us. Jobs wait in a queue for a free goroutine, so
+// queueing one never blocks.
+type mwebVerifyPool struct {
+	size int
+	quit <-chan struct{}
+	wg   *sync.WaitGroup
+
+	mtx  sync.Mutex
+	jobs []func()
+
+	// signal wakes a goroutine waiting for a job to be queued.
+	signal chan struct{}
+
+	startOnce sync.Once
+}
+
+// newMwebVerifyPool creates a pool of the given number of goroutines, which
+// are started on first use and exit once quit is closed. They're added to
+// the wait group while they run.
+func newMwebVerifyPool(size int, quit <-chan struct{},
+	wg *sync.WaitGroup) *mwebVerifyPool {
+
+	return &mwebVerifyPool{
+		size:   size,
+		quit:   quit,
+		wg:     wg,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// start starts the pool's goroutines.
+func (p *mwebVerifyPool) start() {
+	p.wg.Add(p.size)
+	for i := 0; i < p.size; i++ {
+		go p.worker()
+	}
+}
+
+// next takes the oldest job from the queue, or returns nil if there are
+// none. If more are left, another goroutine is woken for them.
+func (p *mwebVerifyPool) next() func() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if len(p.jobs) == 0 {
+		return nil
+	}
+	job := p.jobs[0]
+	p.jobs[0] = nil
+	p.jobs = p.jobs[1:]
+	if len(p.jobs) > 0 {
+		p.wake()
+	}
+	return job
+}
+
+// wake wakes a goroutine waiting for a job, if none has been woken yet.
+func (p *mwebVerifyPool) wake() {
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// worker runs jobs until we're shutting down.
+func (p *mwebVerifyPool) worker() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.signal:
+		case <-p.quit:
+			return
+		}
+
+		for job := p.next(); job != nil; job = p.next() {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
+			job()
+		}
+	}
+}
+
+// queue queues f to run on one of the pool's goroutines once one is free,
+// returning without waiting for it. It returns false without queueing f if
+// we're shutting down.
+func (p *mwebVerifyPool) queue(f func()) bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
+
+	p.startOnce.Do(p.start)
+
+	p.mtx.Lock()
+	p.jobs = append(p.jobs, f)
+	p.mtx.Unlock()
+	p.wake()
+
+	return true
+}
@@ -0,0 +1,136 @@
+package neutrino
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/query"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMwebVerifyPool tests that mweb utxos responses are verified on the
+// verify pool's goroutines rather than the query workers', and that no more
+// than the pool's size of them are verified at once.
+func TestMwebVerifyPool(t *testing.T) {
+	t.Parallel()
+
+	const (
+		poolSize    = 2
+		responses   = 6
+		workerFrame = "(*mwebVerifyPool).worker"
+	)
+
+	bm, _, q := setupMwebUtxosQuery(t, nil, 0)
+	q.done = make(chan struct{})
+	defer close(q.done)
+
+	quit := make(chan struct{})
+	var poolWg sync.WaitGroup
+	bm.mwebVerifyPool = newMwebVerifyPool(poolSize, quit, &poolWg)
+
+	mmr := newTestMwebMmr(11)
+	q.mwebHeader = mmr.mwebHeader()
+	q.leafset = mmr.leafset(2, 9)
+	q.leafset.Height = 1
+
+	// Bagging the peaks is part of each verification, so it tells us
+	// where the verification runs, and holds it up until we let it go.
+	var (
+		mtx        sync.Mutex
+		running    int
+		maxRunning int
+		offPool    int
+	)
+	release := make(chan struct{})
+	bm.cfg.MwebRootVariants = []MwebRootVariant{{
+		Name: "blocking",
+		BagPeaks: func(peakHashes []*chainhash.Hash,
+			numNodes uint64) *chainhash.Hash {
+
+			buf := make([]byte, 1<<16)
+			stack := string(buf[:runtime.Stack(buf, false)])
+
+			mtx.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			if !strings.Contains(stack, workerFrame) {
+				offPool++
+			}
+			mtx.Unlock()
+
+			<-release
+
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+
+			return DefaultMwebRootVariant.BagPeaks(
+				peakHashes, numNodes,
+			)
+		},
+	}}
+
+	req := wire.NewMsgGetMwebUtxos(
+		chainhash.Hash{}, 3, 4, wire.MwebNetUtxoCompact,
+	)
+	go func() {
+		for i := 0; i < responses; i++ {
+			<-q.utxosChan
+		}
+	}()
+
+	// Each response is handled as if by a different query worker, which
+	// gets back the pending progress at once rather than waiting for the
+	// response to be verified.
+	var pending []<-chan query.Progress
+	for i := 0; i < responses; i++ {
+		p := q.handleResponse(
+			req, mmr.proveUtxos(q.leafset, req), "peer",
+		)
+		require.False(t, p.Finished)
+		require.NotNil(t, p.Pending)
+		pending = append(pending, p.Pending)
+	}
+
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return running == poolSize
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The other responses wait for a free goroutine.
+	time.Sleep(50 * time.Millisecond)
+	mtx.Lock()
+	require.Equal(t, poolSize, running)
+	mtx.Unlock()
+
+	close(release)
+	for _, p := range pending {
+		select {
+		case progress := <-p:
+			require.True(t, progress.Finished)
+		case <-time.After(5 * time.Second):
+			t.Fatal("response not handled")
+		}
+	}
+
+	mtx.Lock()
+	require.Equal(t, poolSize, maxRunning)
+	require.Zero(t, offPool)
+	mtx.Unlock()
+
+	// Once we're shutting down, nothing more is verified, and the pool's
+	// goroutines exit.
+	close(quit)
+	poolWg.Wait()
+	p := q.handleResponse(req, mmr.proveUtxos(q.leafset, req), "peer")
+	require.False(t, p.Finished)
+	require.Nil(t, p.Pending)
+}
@@ -4,8 +4,10 @@
 package neutrino
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -87,6 +89,57 @@ var (
 	// DefaultBlockCacheSize is the size (in bytes) of blocks neutrino will
 	// keep in memory if no size is specified in the neutrino.Config.
 	DefaultBlockCacheSize uint64 = 4096 * 10 * 1000 // 40 MB
+
+	// DefaultMwebWriteRetries is the number of times a failed write to
+	// the mweb coins db will be retried if no value is specified in the
+	// neutrino.Config.
+	DefaultMwebWriteRetries = 3
+
+	// DefaultMwebQuitTimeout is the longest we'll wait on shutdown for an
+	// outstanding mweb query to be cancelled if no value is specified in
+	// the neutrino.Config.
+	DefaultMwebQuitTimeout = 5 * time.Second
+
+	// DefaultMwebWriteBackoff is the initial time to wait before retrying
+	// a failed write to the mweb coins db if no value is specified in the
+	// neutrino.Config. The wait doubles after each failed attempt.
+	DefaultMwebWriteBackoff = 100 * time.Millisecond
+
+	// DefaultMwebCircuitThreshold is the number of mweb sync failures in
+	// a row after which the sync cools down if no value is specified in
+	// the neutrino.Config.
+	DefaultMwebCircuitThreshold = 10
+
+	// DefaultMwebCircuitCooldown is how long the mweb sync cools down for
+	// after failing too many times in a row if no value is specified in
+	// the neutrino.Config.
+	DefaultMwebCircuitCooldown = 5 * time.Minute
+
+	// DefaultMwebFullBlockFallbackAfter is how long the mweb sync may go
+	// without any peer serving it before falling back to full blocks, when
+	// MwebFullBlockFallback is set, if no value is specified in the
+	// neutrino.Config.
+	DefaultMwebFullBlockFallbackAfter = 30 * time.Minute
+
+	// DefaultMwebTimeoutThreshold is the number of getmwebutxos messages
+	// in a row that a peer may time out on before the MwebTimeoutPolicy
+	// is applied to it if no value is specified in the neutrino.Config.
+	DefaultMwebTimeoutThreshold = 5
+
+	// DefaultMwebFanOut is the number of peers that each span of mweb
+	// utxos is requested from at once if no value is specified in the
+	// neutrino.Config.
+	DefaultMwebFanOut = 1
+
+	// DefaultMwebStreamThreshold is the estimated memory in bytes of a
+	// batch of mweb utxos above which its responses are written as each
+	// is verified if no value is specified in the neutrino.Config.
+	DefaultMwebStreamThreshold = uint64(1 << 20)
+
+	// MaxMwebReorgDepth is the deepest reorg that the mweb sync keeps the
+	// leafsets around to roll back, and so the most recent blocks whose
+	// leafsets may be retained by the MwebLeafsetHistoryDepth option.
+	MaxMwebReorgDepth = 288
 )
 
 // isDevNetwork indicates if the chain is a private development network, namely
@@ -183,6 +236,10 @@ type ServerPeer struct {
 	recvSubscribers  map[spMsgSubscription]struct{}
 	recvSubscribers2 map[msgSubscription]struct{}
 	mtxSubscribers   sync.RWMutex
+
+	// mwebCircuits holds the isolated connections that mweb queries are
+	// sent to the peer over. It is nil unless MwebIsolation is set.
+	mwebCircuits *mwebCircuits
 }
 
 // NewServerPeer returns a new ServerPeer instance. The peer needs to be set by
@@ -241,7 +298,9 @@ func (sp *ServerPeer) OnVersion(_ *peer.Peer, msg *wire.MsgVersion) *wire.MsgRej
 	// so we can find compatible peers.
 	if sp.Services()&RequiredServices != RequiredServices {
 		peerAddr := sp.Addr()
-		err := sp.server.BanPeer(peerAddr, banman.NoCompactFilters)
+		err := sp.server.blockManager.banPeer(
+			peerAddr, banman.NoCompactFilters,
+		)
 		if err != nil {
 			log.Errorf("Unable to ban peer %v: %v", peerAddr, err)
 		}
@@ -263,6 +322,10 @@ func (sp *ServerPeer) OnVersion(_ *peer.Peer, msg *wire.MsgVersion) *wire.MsgRej
 		sp.server.addrManager.SetServices(sp.NA(), msg.Services)
 	}
 
+	if sp.server.mwebArchival != nil {
+		sp.server.mwebArchival.addPeer(sp.Addr(), msg.Services)
+	}
+
 	return nil
 }
 
@@ -468,10 +531,12 @@ func (sp *ServerPeer) OnRead(_ *peer.Peer, bytesRead int, msg wire.Message,
 	sp.server.AddBytesReceived(uint64(bytesRead))
 
 	// Send a message to each subscriber. Each message gets its own
-	// goroutine to prevent blocking on the mutex lock.
+	// goroutine to prevent blocking on the mutex lock. The lock is held
+	// for writing as canceled subscriptions are deleted, and messages can
+	// be read over the peer's isolated mweb connections at the same time.
 	// TODO: Flood control.
-	sp.mtxSubscribers.RLock()
-	defer sp.mtxSubscribers.RUnlock()
+	sp.mtxSubscribers.Lock()
+	defer sp.mtxSubscribers.Unlock()
 	for subscription := range sp.recvSubscribers {
 		go func(subscription spMsgSubscription) {
 			select {
@@ -546,6 +611,21 @@ func (sp *ServerPeer) SubscribeRecvMsg() (<-chan wire.Message, func()) {
 	}
 }
 
+// QueueMessageWithEncoding adds the passed message to the peer's send queue,
+// unless it's an mweb query and mweb queries are isolated, in which case
+// it's sent over an isolated connection to the peer instead.
+//
+// NOTE: Part of the query.Peer interface.
+func (sp *ServerPeer) QueueMessageWithEncoding(msg wire.Message,
+	doneChan chan<- struct{}, encoding wire.MessageEncoding) {
+
+	if sp.mwebCircuits != nil && isMwebQuery(msg) {
+		sp.mwebCircuits.queue(msg, doneChan, encoding)
+		return
+	}
+	sp.Peer.QueueMessageWithEncoding(msg, doneChan, encoding)
+}
+
 // OnDisconnect returns a channel that will be closed when this peer is
 // disconnected.
 //
@@ -638,6 +718,335 @@ type Config struct {
 	// you're going to use a lot more bandwidth but it may be acceptable for apps
 	// which only run for brief periods of time.
 	BlocksOnly bool
+
+	// MwebWriteRetries is the number of times we'll retry a failed write
+	// to the mweb coins db before abandoning the current sync attempt.
+	// If zero, DefaultMwebWriteRetries is used, and if negative, failed
+	// writes aren't retried.
+	MwebWriteRetries int
+
+	// MwebWriteBackoff is the initial time we'll wait before retrying a
+	// failed write to the mweb coins db. If zero,
+	// DefaultMwebWriteBackoff is used.
+	MwebWriteBackoff time.Duration
+
+	// MwebCircuitThreshold is the number of times in a row the mweb sync
+	// may fail, such as when all our peers are banned or keep failing
+	// verification, before it stops retrying and cools down for
+	// MwebCircuitCooldown. If zero, DefaultMwebCircuitThreshold is used.
+	MwebCircuitThreshold int
+
+	// MwebCircuitCooldown is how long the mweb sync cools down for once
+	// it has failed MwebCircuitThreshold times in a row. If zero,
+	// DefaultMwebCircuitCooldown is used.
+	MwebCircuitCooldown time.Duration
+
+	// MwebTimeoutThreshold is the number of getmwebutxos messages in a
+	// row that a peer may time out on, neither answering nor failing,
+	// before MwebTimeoutPolicy is applied to it. If zero,
+	// DefaultMwebTimeoutThreshold is used, and if negative, the policy is
+	// never applied and peers timing out are only ever reassigned.
+	MwebTimeoutThreshold int
+
+	// MwebTimeoutPolicy is what's done with a peer that has timed out on
+	// MwebTimeoutThreshold getmwebutxos messages in a row. Such a peer
+	// isn't banned, as it may just be slow. By default it's given mweb
+	// utxos requests only when no other peer is free, until it answers
+	// one again.
+	MwebTimeoutPolicy MwebTimeoutPolicy
+
+	// MwebFanOut is the number of peers that each span of mweb utxos is
+	// requested from at once. The first verified response is used, and
+	// the requests to the other peers are cancelled. Requesting from
+	// more than one peer trades bandwidth for a faster sync when some
+	// peers are slow. If zero, DefaultMwebFanOut is used.
+	MwebFanOut int
+
+	// MwebQuitTimeout is the grace period given on shutdown for an
+	// outstanding mweb query to be cancelled by the query dispatcher. If
+	// zero, DefaultMwebQuitTimeout is used.
+	MwebQuitTimeout time.Duration
+
+	// MwebQueryRateLimit is the maximum number of mweb requests per
+	// second that will be sent to any single peer. Requests beyond this
+	// rate are spread to other peers or wait for the peer's limit to
+	// allow them, as do the requests for mweb headers and leafsets sent
+	// to all peers at once. If zero, mweb requests aren't rate limited.
+	MwebQueryRateLimit float64
+
+	// MwebQueryBurst is the number of mweb requests that may be sent to a
+	// peer in a burst before MwebQueryRateLimit applies.
+	MwebQueryBurst int
+
+	// NumQueryWorkers is the maximum number of peers that will be given
+	// queries concurrently by the query dispatcher. More workers can
+	// speed up the initial mweb sync on fast connections, while fewer
+	// conserve resources on constrained devices. If zero, every connected
+	// peer may be given a query.
+	NumQueryWorkers int
+
+	// BanPolicy decides whether a peer that serves us invalid mweb data
+	// is banned. If nil, such peers are banned on their first offense.
+	// With a policy from NewGreylistBanPolicy, greylisted peers are also
+	// given queries only once no other peer is free.
+	BanPolicy BanPolicy
+
+	// BeforeBan, if set, is called before any peer is banned, such as for
+	// serving us invalid data once the BanPolicy has decided to ban it,
+	// or for lacking the services we require, and the ban only goes
+	// ahead if it returns true. This lets operators veto bans
+	// with a reputation system of their own. The peer's data is rejected
+	// either way. It must return quickly, as it holds up the sync. If
+	// nil, every ban goes ahead.
+	BeforeBan func(addr string, reason banman.Reason) bool
+
+	// MaxBannedPeers caps the number of peers banned at once, so that a
+	// coordinated attack can't get so many peers banned that we're cut
+	// off from the network. Past the cap, the bans of the lowest
+	// severity are lifted first, so that peers banned for invalid mweb
+	// data stay banned over those that merely exceeded the ban
+	// threshold. If zero, there is no cap.
+	MaxBannedPeers int
+
+	// MwebFailureSink, if set, is given every mweb message that fails
+	// verification, along with the peer that served it and the reason,
+	// before the peer is punished. This preserves the offending data for
+	// protocol debugging. See NewDirMwebFailureSink.
+	MwebFailureSink MwebFailureSink
+
+	// MwebVerifyDumpDir, if set, is a directory that the state of each
+	// failed verification of mweb utxos is dumped to, including how far
+	// the walk over the output MMR got. Each dump can be loaded with
+	// LoadMwebVerifyState and replayed to reproduce the failure. At most
+	// 100 states are dumped, so that peers serving bad proofs can't fill
+	// the disk.
+	MwebVerifyDumpDir string
+
+	// OrderedMwebCallbacks, if true, guarantees that the mweb utxos
+	// fetched during a sync are delivered to the registered callbacks in
+	// ascending leaf index order. Batches that arrive early are buffered
+	// until all the batches before them have been delivered.
+	OrderedMwebCallbacks bool
+
+	// MwebInterestFilter, if set, reports whether the wallet is interested
+	// in the mweb utxo at the given leaf index, such as one created in a
+	// block that the wallet has activity in. The spans of leaves holding
+	// any it's interested in are fetched first, so that the wallet's own
+	// coins show up as soon as possible, with the rest fetched afterwards.
+	// It is ignored if OrderedMwebCallbacks is set.
+	MwebInterestFilter func(leafIndex uint64) bool
+
+	// MwebConfirmations is the number of confirmations that mweb utxos
+	// need before they're passed to the callbacks registered with
+	// RegisterMwebConfirmedUtxosCallback, where a utxo in the tip block
+	// has one. Until then they're held as pending, so that a wallet can
+	// hold off acting on coins from a block that might be reorged out,
+	// as with the maturity of regular utxos. Zero is taken as one.
+	MwebConfirmations uint32
+
+	// ShouldRetainPurgedCoin, if set, is consulted for each mweb utxo that
+	// is spent before its coin is purged from the mweb coins db. The coins
+	// of the leaves that it reports true for are kept, marked spent, so
+	// that a wallet can still look up the coins it owned with
+	// mwebdb.CoinStore.FetchRetainedCoin, such as when auditing its own
+	// spends. They're otherwise taken as purged, so MwebUtxoExists reports
+	// them spent. Retained coins are still purged by a full resync of the
+	// mweb coins.
+	ShouldRetainPurgedCoin func(leafIdx uint64) bool
+
+	// MwebSyncOrder is the order in which the mweb utxos added since the
+	// last sync are fetched. MwebSyncNewestFirst fetches the most
+	// recently created ones first, so that a wallet watching for recent
+	// activity finds its coins sooner. The utxos are written and
+	// delivered to the callbacks as they come in either way, but an
+	// abandoned newest-first fetch can only resume from its lowest
+	// outstanding leaf. It is ignored if OrderedMwebCallbacks is set. The
+	// default is MwebSyncOldestFirst.
+	MwebSyncOrder MwebSyncOrder
+
+	// MwebMemoryBudget caps the estimated memory in bytes taken up by the
+	// responses to outstanding mweb utxos requests. Requests are held
+	// back while the budget is used up, trading sync speed for a bounded
+	// memory footprint on constrained devices. A single request is always
+	// allowed, even if it alone exceeds the budget. If zero, there is no
+	// budget.
+	MwebMemoryBudget uint64
+
+	// MwebStreamThreshold is the estimated memory in bytes of a batch of
+	// mweb utxos requests above which the responses are written to the
+	// mweb coins db one by one as they're verified, so that they needn't
+	// all be held in memory at once. Smaller batches are
+	// written in one go once they've all been verified, which keeps them
+	// fast. If zero, DefaultMwebStreamThreshold is used.
+	MwebStreamThreshold uint64
+
+	// StrictMwebLeafsetCheck, if true, cross-checks the mweb utxos served
+	// by our peers against the leafset that we've tracked ourselves from
+	// earlier syncs, in addition to the leafset of the chain tip. A peer
+	// serving a utxo for a leaf that we've already seen spent is banned.
+	// The check is skipped if the block of the tracked leafset has since
+	// been disconnected. It is off by default, as it costs an extra pass
+	// over every response.
+	StrictMwebLeafsetCheck bool
+
+	// MwebDistinctUtxosPeer, if true, requires the mweb utxos of a sync
+	// to be served by peers other than the one that served the mweb
+	// header they're verified against. Either way, the utxos are
+	// verified against the header whoever serves them, but this way a
+	// single peer can't serve us both a header and utxos made up to
+	// match it, should the header's checks against the block header
+	// ever fall short. The sync stalls if the header's peer is our only
+	// peer.
+	MwebDistinctUtxosPeer bool
+
+	// CheckMwebFetchedLeaves, if true, asserts that the coins fetched
+	// from the mweb coins db to notify of added mweb utxos are for the
+	// leaves asked for, and are unspent in the leafset. A mismatch is
+	// logged and returned as an error instead of being delivered to the
+	// callbacks, catching bugs in the coins db early. It is off by
+	// default, being an invariant check.
+	CheckMwebFetchedLeaves bool
+
+	// MwebArchivalPeers is a list of peer addresses, either host:port or
+	// just the host, that are known to be archival. During sync, mweb
+	// utxos created more than a day's worth of blocks below the chain tip
+	// are fetched from archival peers where possible, falling back to
+	// other peers when none are free.
+	MwebArchivalPeers []string
+
+	// MwebArchivalServices, if non-zero, tags the peers advertising all
+	// of these service bits as archival, in addition to those listed in
+	// MwebArchivalPeers.
+	MwebArchivalServices wire.ServiceFlag
+
+	// MwebVerifyTiming, if true, records the time taken to verify each
+	// mweb utxos response, bucketed by the number of utxos in it. The
+	// timings are returned by MwebVerifyTimings.
+	MwebVerifyTiming bool
+
+	// MwebProofStats, if true, records the bytes of proof hashes and of
+	// utxos in the mweb utxos responses verified from each peer, so that
+	// peers serving bloated proofs can be told apart. The tallies are
+	// returned by MwebProofEfficiency.
+	MwebProofStats bool
+
+	// MwebCheckpoint, if set, turns on light verification of mweb utxos:
+	// those below the checkpoint's leaf count are only verified to hash
+	// to its peaks, rather than to the output root of the block being
+	// synced to. This saves walking their proofs all the way up, at the
+	// cost of trusting the checkpoint as described on MwebCheckpoint.
+	MwebCheckpoint *MwebCheckpoint
+
+	// MwebVerifyWorkers, if non-zero, is the number of goroutines
+	// dedicated to verifying the proofs of mweb utxos responses. This
+	// keeps the CPU-bound verification apart from the handling of our
+	// peers' messages, and bounds how many verifications run at once.
+	// If zero, each response is verified by the query worker that
+	// received it.
+	MwebVerifyWorkers int
+
+	// MwebMinProofHashRatio, if non-zero, rejects mweb utxos responses
+	// with fewer proof hashes than this ratio of the fewest that their
+	// utxos could need in the output MMR, banning the peer serving them.
+	// Such proofs can't possibly verify, so under spam this saves the
+	// CPU time of walking them. A ratio of 1 rejects every proof that is
+	// too short to verify, and it must be between 0 and 1.
+	MwebMinProofHashRatio float64
+
+	// MwebLeafsetHistoryDepth is the number of recent blocks whose mweb
+	// leafsets are retained in the mweb coins db, for rolling back a
+	// reorg and for MwebLeafsetAtHeight. The leafsets of older blocks are
+	// pruned as new ones are synced. If zero, no history is kept. It can
+	// be at most MaxMwebReorgDepth.
+	MwebLeafsetHistoryDepth int
+
+	// MwebProofLimit, if non-zero, stores the proofs of the most recently
+	// fetched spans of mweb utxos in the database, up to this many, so
+	// that VerifyStoredMwebCoins can verify the stored coins again
+	// without the network. Each proof takes up around a kilobyte, with
+	// the oldest dropped once the limit is reached.
+	MwebProofLimit uint64
+
+	// MwebKernels, if true, fetches the mweb kernels of each block along
+	// with the mweb utxos, verifies them against the kernel root of the
+	// block's mweb header, and stores them in the database, where they're
+	// returned by FetchMwebKernels. This fetches every block in full from
+	// the mweb activation height on, so it adds a lot of bandwidth.
+	MwebKernels bool
+
+	// MwebFullBlockFallback, if true, falls back to taking the mweb utxos
+	// from full blocks once the mweb sync has gone for
+	// MwebFullBlockFallbackAfter without any peer serving it. As
+	// RequiredServices includes SFNodeMWEBLightClient, we only ever
+	// connect to peers that advertise the mweb light client protocol, so
+	// the full blocks are fetched from the same peers that failed to serve
+	// the mweb sync, and this only helps where they serve mweb blocks but
+	// not the mweb sync messages. Each block after the last one synced is
+	// downloaded with its mweb, and its outputs and inputs applied to the
+	// stored coins, which takes far more bandwidth. The coins taken this
+	// way can't be proven against the output root, so they aren't marked
+	// verified, which keeps them from being fetched in MwebSafeMode,
+	// though they're still delivered to the mweb utxos callbacks as
+	// they're taken. The light client sync is tried again after each
+	// round of the fallback.
+	MwebFullBlockFallback bool
+
+	// MwebFullBlockFallbackAfter is how long the mweb sync may go without
+	// any peer serving it before MwebFullBlockFallback takes effect. If
+	// zero, DefaultMwebFullBlockFallbackAfter is used.
+	MwebFullBlockFallbackAfter time.Duration
+
+	// MwebSafeMode keeps the mweb coins in the mweb coins db that aren't
+	// marked verified from being fetched, and so from being delivered to
+	// the mweb utxos callbacks, until VerifyStoredMwebCoins has verified
+	// them again. Coins are marked verified as they're stored, so this
+	// only guards against coins stored by older versions or otherwise
+	// written without verification.
+	MwebSafeMode bool
+
+	// MwebPeerDiversity, if true, spreads the getmwebutxos requests
+	// across the network groups of our peers, as the address manager
+	// groups them, so that they don't all land on peers from the same
+	// subnet. Preferences for archival peers and batch sizes still come
+	// first.
+	MwebPeerDiversity bool
+
+	// MwebPeerSelector, if set, selects the peers that mweb header and
+	// utxos requests are sent to, out of the connected peers free to
+	// take each request, and the order in which they're tried. It is
+	// given the peers in the order that they would otherwise be tried,
+	// which the default selector keeps, so it can build on the peer
+	// ranking and MwebPeerDiversity as well as replace them.
+	MwebPeerSelector MwebPeerSelector
+
+	// MwebIsolation, if set, sends the mweb queries to each peer over
+	// connections of their own, dialed with MwebCircuitDialer, rather
+	// than over the connection that the headers and filters come over.
+	// MwebIsolationPerPeer dials one for each peer, whereas
+	// MwebIsolationPerQuery dials one for each query, so that no two
+	// queries share a circuit. Queries that go to every peer at once,
+	// such as that for the mweb header and leafset, are isolated too.
+	MwebIsolation MwebIsolation
+
+	// MwebCircuitDialer dials the connections that mweb queries are
+	// isolated on, each over a circuit of its own. It must be set if
+	// MwebIsolation is, and NewSocksMwebCircuitDialer returns one for a
+	// Tor SOCKS proxy.
+	MwebCircuitDialer MwebCircuitDialer
+
+	// MwebRootVariants are the rules for computing the output root of an
+	// mweb header that the mweb utxos proofs are accepted under, any of
+	// which may match. This eases a protocol upgrade during which our
+	// peers may disagree on the rule. If empty, only
+	// DefaultMwebRootVariant is accepted.
+	MwebRootVariants []MwebRootVariant
+
+	// MwebSnapshot, if set, is a trusted snapshot of the mweb utxo set
+	// at a checkpoint block that an empty mweb coins db is seeded with,
+	// so that only the mweb utxos created after it are fetched. The
+	// snapshot is checked against the block header chain, and the mweb
+	// headers of the blocks after it must build on it.
+	MwebSnapshot *MwebSnapshot
 }
 
 // peerSubscription holds a peer subscription which we'll notify about any
@@ -659,8 +1068,16 @@ type ChainService struct { // nolint:maligned
 	FilterDB         filterdb.FilterDatabase
 	BlockHeaders     headerfs.BlockHeaderStore
 	RegFilterHeaders *headerfs.FilterHeaderStore
-	MwebCoinDB       mwebdb.CoinDatabase
-	persistToDisk    bool
+
+	// MwebCoinDB holds the mweb coins stored by the mweb sync. It may be
+	// read by any number of goroutines while the sync writes to it, with
+	// each call seeing a consistent snapshot, but separate calls may see
+	// different leafsets. The ChainService methods that read the leafset
+	// along with its coins, such as MwebMmrPeaks, read both in a single
+	// snapshot.
+	MwebCoinDB mwebdb.CoinDatabase
+
+	persistToDisk bool
 
 	FilterCache *lru.Cache[FilterCacheKey, *CacheableFilter]
 	BlockCache  *lru.Cache[wire.InvVect, *CacheableBlock]
@@ -682,9 +1099,14 @@ type ChainService struct { // nolint:maligned
 	utxoScanner          *UtxoScanner
 	broadcaster          *pushtx.Broadcaster
 	banStore             banman.Store
+	banEnforcement       banman.Enforcement
 	workManager          query.WorkManager
 	filterBatchWriter    *chanutils.BatchWriter[*filterdb.FilterData]
 
+	// rateLimiter, if set, limits the rate at which mweb queries are sent
+	// to each peer, by the work manager and by queryAllPeers alike.
+	rateLimiter query.RateLimiter
+
 	// peerSubscribers is a slice of active peer subscriptions, that we
 	// will notify each time a new peer is connected.
 	peerSubscribers []*peerSubscription
@@ -698,10 +1120,30 @@ type ChainService struct { // nolint:maligned
 	nameResolver func(string) ([]net.IP, error)
 	dialer       func(net.Addr) (net.Conn, error)
 
+	// mwebIsolation is how mweb queries are isolated, over connections
+	// dialed with mwebCircuitDialer.
+	mwebIsolation     MwebIsolation
+	mwebCircuitDialer MwebCircuitDialer
+
 	broadcastTimeout time.Duration
 
 	blocksOnly bool
 
+	// mwebArchival tracks the peers preferred for old mweb utxos. It is
+	// nil if no archival peers are configured.
+	mwebArchival *mwebArchivalPeers
+
+	// banStats counts the peers banned for each reason.
+	banStats banStats
+
+	// mwebProofs stores the proofs of the fetched mweb utxos. It is nil
+	// unless MwebProofLimit is set.
+	mwebProofs *mwebdb.ProofStore
+
+	// mwebKernels stores the verified mweb kernels. It is nil unless
+	// MwebKernels is set.
+	mwebKernels *mwebdb.KernelStore
+
 	mempool *Mempool
 }
 
@@ -714,6 +1156,75 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		cfg.BroadcastTimeout = pushtx.DefaultBroadcastTimeout
 	}
 
+	// Likewise for the mweb coins db write retry policy.
+	if cfg.MwebWriteRetries == 0 {
+		cfg.MwebWriteRetries = DefaultMwebWriteRetries
+	}
+	if cfg.MwebWriteBackoff == 0 {
+		cfg.MwebWriteBackoff = DefaultMwebWriteBackoff
+	}
+	if cfg.MwebQuitTimeout == 0 {
+		cfg.MwebQuitTimeout = DefaultMwebQuitTimeout
+	}
+	if cfg.MwebCircuitThreshold == 0 {
+		cfg.MwebCircuitThreshold = DefaultMwebCircuitThreshold
+	}
+	if cfg.MwebCircuitCooldown == 0 {
+		cfg.MwebCircuitCooldown = DefaultMwebCircuitCooldown
+	}
+	if cfg.MwebFullBlockFallbackAfter == 0 {
+		cfg.MwebFullBlockFallbackAfter =
+			DefaultMwebFullBlockFallbackAfter
+	}
+	if cfg.MwebFanOut == 0 {
+		cfg.MwebFanOut = DefaultMwebFanOut
+	}
+	if cfg.MwebTimeoutThreshold == 0 {
+		cfg.MwebTimeoutThreshold = DefaultMwebTimeoutThreshold
+	}
+	if cfg.MwebStreamThreshold == 0 {
+		cfg.MwebStreamThreshold = DefaultMwebStreamThreshold
+	}
+
+	if cfg.NumQueryWorkers < 0 {
+		return nil, fmt.Errorf("NumQueryWorkers must be non-negative, "+
+			"got %v", cfg.NumQueryWorkers)
+	}
+	if cfg.MwebVerifyWorkers < 0 {
+		return nil, fmt.Errorf("MwebVerifyWorkers must be "+
+			"non-negative, got %v", cfg.MwebVerifyWorkers)
+	}
+	if cfg.MwebMinProofHashRatio < 0 || cfg.MwebMinProofHashRatio > 1 {
+		return nil, fmt.Errorf("MwebMinProofHashRatio must be between "+
+			"0 and 1, got %v", cfg.MwebMinProofHashRatio)
+	}
+	if cfg.MwebSyncOrder > MwebSyncNewestFirst {
+		return nil, fmt.Errorf("unknown MwebSyncOrder %d",
+			cfg.MwebSyncOrder)
+	}
+	if cfg.MwebIsolation > MwebIsolationPerQuery {
+		return nil, fmt.Errorf("unknown MwebIsolation %d",
+			cfg.MwebIsolation)
+	}
+	if cfg.MwebIsolation != MwebIsolationNone &&
+		cfg.MwebCircuitDialer == nil {
+
+		return nil, errors.New("MwebIsolation requires " +
+			"MwebCircuitDialer")
+	}
+	if cfg.MwebCheckpoint != nil {
+		if err := cfg.MwebCheckpoint.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	leafsetRetention, err := mwebLeafsetRetention(
+		cfg.MwebLeafsetHistoryDepth,
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	// First, we'll sort out the methods that we'll use to established
 	// outbound TCP connections, as well as perform any DNS queries.
 	//
@@ -760,18 +1271,37 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		userAgentVersion:  UserAgentVersion,
 		nameResolver:      nameResolver,
 		dialer:            dialer,
+		mwebIsolation:     cfg.MwebIsolation,
+		mwebCircuitDialer: cfg.MwebCircuitDialer,
 		persistToDisk:     cfg.PersistToDisk,
 		broadcastTimeout:  cfg.BroadcastTimeout,
 		blocksOnly:        cfg.BlocksOnly,
 		mempool:           NewMempool(),
+		mwebArchival: newMwebArchivalPeers(
+			cfg.MwebArchivalServices, cfg.MwebArchivalPeers,
+		),
 	}
-	s.workManager = query.NewWorkManager(&query.Config{
+	queryCfg := &query.Config{
 		ConnectedPeers: s.ConnectedPeers,
 		NewWorker:      query.NewWorker,
 		Ranking:        query.NewPeerRanking(),
-	})
+		MaxWorkers:     cfg.NumQueryWorkers,
+	}
+	if p, ok := cfg.BanPolicy.(*greylistBanPolicy); ok {
+		queryCfg.Ranking = &greylistRanking{
+			PeerRanking: queryCfg.Ranking,
+			greylist:    p.greylist,
+		}
+	}
+	if cfg.MwebQueryRateLimit > 0 {
+		s.rateLimiter = query.NewPeerRateLimiter(
+			cfg.MwebQueryRateLimit, cfg.MwebQueryBurst,
+			isMwebQuery,
+		)
+		queryCfg.RateLimiter = s.rateLimiter
+	}
+	s.workManager = query.NewWorkManager(queryCfg)
 
-	var err error
 	s.FilterDB, err = filterdb.New(cfg.Database, cfg.ChainParams)
 	if err != nil {
 		return nil, err
@@ -826,12 +1356,33 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		return nil, err
 	}
 
-	s.MwebCoinDB, err = mwebdb.NewCoinStore(cfg.Database)
+	coinStore, err := mwebdb.NewCoinStore(cfg.Database)
 	if err != nil {
 		return nil, err
 	}
+	coinStore.SetLeafsetRetention(leafsetRetention)
+	coinStore.SetSafeMode(cfg.MwebSafeMode)
+	s.MwebCoinDB = coinStore
 
-	bm, err := newBlockManager(&blockManagerCfg{
+	if cfg.MwebProofLimit > 0 {
+		s.mwebProofs, err = mwebdb.NewProofStore(
+			cfg.Database, cfg.MwebProofLimit,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.MwebKernels {
+		s.mwebKernels, err = mwebdb.NewKernelStore(
+			cfg.Database, uint32(MaxMwebReorgDepth),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bmCfg := &blockManagerCfg{
 		ChainParams:      s.chainParams,
 		BlockHeaders:     s.BlockHeaders,
 		RegFilterHeaders: s.RegFilterHeaders,
@@ -839,11 +1390,57 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		TimeSource:       s.timeSource,
 		QueryDispatcher:  s.workManager,
 		BanPeer:          s.BanPeer,
+		DisconnectPeer:   s.disconnectPeer,
+		BanPolicy:        cfg.BanPolicy,
+		BeforeBan:        cfg.BeforeBan,
+		MwebFailureSink:  cfg.MwebFailureSink,
 		GetBlock:         s.GetBlock,
 		firstPeerSignal:  s.firstPeerConnect,
 		queryAllPeers:    s.queryAllPeers,
 		mempool:          s.mempool,
-	})
+		MwebWriteRetries: cfg.MwebWriteRetries,
+		MwebWriteBackoff: cfg.MwebWriteBackoff,
+		MwebQuitTimeout:  cfg.MwebQuitTimeout,
+
+		MwebCircuitThreshold: cfg.MwebCircuitThreshold,
+		MwebCircuitCooldown:  cfg.MwebCircuitCooldown,
+		MwebFanOut:           cfg.MwebFanOut,
+		MwebVerifyDumpDir:    cfg.MwebVerifyDumpDir,
+		MwebTimeoutThreshold: cfg.MwebTimeoutThreshold,
+		MwebTimeoutPolicy:    cfg.MwebTimeoutPolicy,
+
+		OrderedMwebCallbacks: cfg.OrderedMwebCallbacks,
+		MwebInterestFilter:   cfg.MwebInterestFilter,
+		MwebSyncOrder:        cfg.MwebSyncOrder,
+		MwebConfirmations:    cfg.MwebConfirmations,
+		MwebMemoryBudget:     cfg.MwebMemoryBudget,
+		MwebStreamThreshold:  cfg.MwebStreamThreshold,
+
+		StrictMwebLeafsetCheck: cfg.StrictMwebLeafsetCheck,
+		ShouldRetainPurgedCoin: cfg.ShouldRetainPurgedCoin,
+		CheckMwebFetchedLeaves: cfg.CheckMwebFetchedLeaves,
+		MwebDistinctUtxosPeer:  cfg.MwebDistinctUtxosPeer,
+		MwebVerifyTiming:       cfg.MwebVerifyTiming,
+		MwebProofStats:         cfg.MwebProofStats,
+		MwebVerifyWorkers:      cfg.MwebVerifyWorkers,
+		MwebMinProofHashRatio:  cfg.MwebMinProofHashRatio,
+		MwebCheckpoint:         cfg.MwebCheckpoint,
+		MwebProofs:             s.mwebProofs,
+		MwebKernels:            s.mwebKernels,
+		MwebPeerSelector:       cfg.MwebPeerSelector,
+		MwebRootVariants:       cfg.MwebRootVariants,
+		MwebSnapshot:           cfg.MwebSnapshot,
+	}
+	if s.mwebArchival != nil {
+		bmCfg.MwebArchivalPeer = s.mwebArchival.isArchival
+	}
+	if cfg.MwebPeerDiversity {
+		bmCfg.MwebPeerGroup = mwebPeerGroup
+	}
+	if cfg.MwebFullBlockFallback {
+		bmCfg.MwebFullBlockFallback = cfg.MwebFullBlockFallbackAfter
+	}
+	bm, err := newBlockManager(bmCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -976,7 +1573,9 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		RebroadcastInterval: pushtx.DefaultRebroadcastInterval,
 	})
 
-	s.banStore, err = banman.NewStore(cfg.Database)
+	s.banStore, err = banman.NewLimitedStore(
+		cfg.Database, cfg.MaxBannedPeers,
+	)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize ban store: %v", err)
 	}
@@ -1103,7 +1702,8 @@ func (s *ChainService) GetBlockHeight(hash *chainhash.Hash) (int32, error) {
 }
 
 // BanPeer disconnects and bans a peer due to a specific reason for a duration
-// of BanDuration.
+// of BanDuration. While ban enforcement is paused, the ban is recorded but
+// the peer stays connected.
 func (s *ChainService) BanPeer(addr string, reason banman.Reason) error {
 	log.Warnf("Banning peer %v: duration=%v, reason=%v", addr, BanDuration,
 		reason)
@@ -1111,33 +1711,68 @@ func (s *ChainService) BanPeer(addr string, reason banman.Reason) error {
 	// We'll want to disconnect the peer after we return regardless of
 	// whether we ban the peer or not. We do this to prevent a possible race
 	// condition where we end up reconnecting with the peer slightly
-	// before the ban succeeds.
-	defer func() {
-		// We do so in a goroutine to prevent blocking if the server is
-		// handling a query or a new/stale peer.
-		go func() {
-			if sp := s.PeerByAddr(addr); sp != nil {
-				sp.Disconnect()
-			}
+	// before the ban succeeds. While enforcement is paused, the ban is
+	// only recorded.
+	if s.banEnforcement.Enforced() {
+		defer func() {
+			// We do so in a goroutine to prevent blocking if the
+			// server is handling a query or a new/stale peer.
+			go func() {
+				if sp := s.PeerByAddr(addr); sp != nil {
+					sp.Disconnect()
+				}
+			}()
 		}()
-	}()
+	} else {
+		log.Infof("Ban enforcement paused, not disconnecting peer %v",
+			addr)
+	}
 
-	ipNet, err := banman.ParseIPNet(addr, nil)
+	// The address is normalized first, so that the ban covers however
+	// else the same peer's address may be written.
+	peerAddr, err := banman.ParsePeerAddr(addr)
 	if err != nil {
 		return fmt.Errorf("unable to parse IP network for peer %v: %v",
 			addr, err)
 	}
-	return s.banStore.BanIPNet(ipNet, reason, BanDuration)
+	ipNet := peerAddr.IPNet(nil)
+	log.Debugf("Banning IP network %v for peer %v", ipNet, peerAddr)
+
+	err = s.banStore.BanIPNet(ipNet, reason, BanDuration)
+	if err != nil {
+		return err
+	}
+
+	s.banStats.record(reason)
+
+	return nil
+}
+
+// SetBanEnforcement pauses or resumes the enforcement of bans by this chain
+// service. While paused, bans are still recorded along with their reasons,
+// but banned peers are no longer kept from connecting. Enforcement is on by
+// default.
+func (s *ChainService) SetBanEnforcement(enabled bool) {
+	s.banEnforcement.Set(enabled)
+}
+
+// BanStats returns the number of peers banned for each reason since the
+// chain service was created, which tells whether bans are dominated by
+// invalid mweb data, missing compact filters or other misbehavior.
+func (s *ChainService) BanStats() map[banman.Reason]int {
+	return s.banStats.snapshot()
 }
 
-// IsBanned returns true if the peer is banned, and false otherwise.
+// IsBanned returns true if the peer is banned, and false otherwise. It always
+// returns false while ban enforcement is paused.
 func (s *ChainService) IsBanned(addr string) bool {
-	ipNet, err := banman.ParseIPNet(addr, nil)
+	peerAddr, err := banman.ParsePeerAddr(addr)
 	if err != nil {
 		log.Errorf("Unable to parse IP network for peer %v: %v", addr,
 			err)
 		return false
 	}
+	ipNet := peerAddr.IPNet(nil)
 	banStatus, err := s.banStore.Status(ipNet)
 	if err != nil {
 		log.Errorf("Unable to determine ban status for peer %v: %v",
@@ -1151,6 +1786,11 @@ func (s *ChainService) IsBanned(addr string) bool {
 			time.Until(banStatus.Expiration))
 	}
 
+	if banStatus.Banned && !s.banEnforcement.Enforced() {
+		log.Debugf("Ban enforcement paused, allowing peer %v", addr)
+		return false
+	}
+
 	return banStatus.Banned
 }
 
@@ -1202,12 +1842,347 @@ func (s *ChainService) RegisterMwebUtxosCallback(
 	s.blockManager.RegisterMwebUtxosCallback(onMwebUtxos)
 }
 
+// RegisterMwebConfirmedUtxosCallback registers a callback to be fired
+// whenever mweb utxos reach the number of confirmations set by the
+// MwebConfirmations config option, along with the leafset of the block that
+// confirmed them.
+func (s *ChainService) RegisterMwebConfirmedUtxosCallback(
+	onConfirmed func(*mweb.Leafset, []*wire.MwebNetUtxo)) {
+
+	s.blockManager.RegisterMwebConfirmedUtxosCallback(onConfirmed)
+}
+
+// MwebUtxoChannel returns a channel receiving the mweb utxos as they would be
+// passed to the mweb utxos callbacks, for consumers that would rather range
+// over a channel, along with a function to cancel it. See the
+// MwebUtxoChannelOption options for what happens while the channel is full.
+func (s *ChainService) MwebUtxoChannel(
+	options ...MwebUtxoChannelOption) (<-chan MwebUtxoEvent, func()) {
+
+	return s.blockManager.MwebUtxoChannel(options...)
+}
+
+// RegisterMwebUtxosDepthCallback registers a callback to be fired whenever
+// new mweb utxos are received, along with their confirmation depths at the
+// current chain tip.
+func (s *ChainService) RegisterMwebUtxosDepthCallback(
+	onMwebUtxos func(*mweb.Leafset, []MwebUtxoDepth)) {
+
+	s.blockManager.RegisterMwebUtxosDepthCallback(onMwebUtxos)
+}
+
+// CancelMwebQueries cancels the mweb queries in flight, so that no more
+// mweb coins are written, and pauses the mweb sync until ResumeMwebQueries
+// is called. The block header and filter header sync keep running.
+func (s *ChainService) CancelMwebQueries() {
+	s.blockManager.CancelMwebQueries()
+}
+
+// MwebCircuitState returns the state of the circuit breaker around the mweb
+// sync. It is MwebCircuitOpen while the sync is cooling down after failing
+// MwebCircuitThreshold times in a row.
+func (s *ChainService) MwebCircuitState() MwebCircuitState {
+	return s.blockManager.MwebCircuitState()
+}
+
+// ResumeMwebQueries restarts the mweb sync paused by CancelMwebQueries,
+// picking up from where it left off.
+func (s *ChainService) ResumeMwebQueries() {
+	s.blockManager.ResumeMwebQueries()
+}
+
+// RegisterMwebHeaderCallback registers a callback to be fired whenever an
+// mweb header has been verified, along with the height and hash of its
+// block.
+func (s *ChainService) RegisterMwebHeaderCallback(
+	onMwebHeader func(*wire.MwebHeader, uint32, chainhash.Hash)) {
+
+	s.blockManager.RegisterMwebHeaderCallback(onMwebHeader)
+}
+
 // Notify of any added mweb utxos since the last snapshot indicated by
 // the leafset.
 func (s *ChainService) NotifyAddedMwebUtxos(leafset *mweb.Leafset) error {
 	return s.blockManager.notifyAddedMwebUtxos(leafset)
 }
 
+// VerifyMwebHeaderOnly fetches the mweb header and leafset for the block at
+// the given height from our peers and verifies that they are committed to
+// by the block, without downloading any mweb utxos. This is useful for
+// clients that only need to check the validity of the mweb commitment.
+func (s *ChainService) VerifyMwebHeaderOnly(height uint32) error {
+	return s.blockManager.verifyMwebHeaderOnly(height)
+}
+
+// VerifyMwebHeaderChain fetches the mweb headers of every block from
+// fromHeight to toHeight from our peers, verifying each against its block
+// and checking that each follows on from the one before: its hogex must
+// spend the previous block's, and its output and kernel MMRs must build on
+// the previous block's. The mweb header at fromHeight is trusted as far as
+// its block is. This is much heavier than VerifyMwebHeaderOnly, and is meant
+// for audits and recovery. A chain reorg during the verification is
+// followed, with the blocks reorged out verified anew.
+func (s *ChainService) VerifyMwebHeaderChain(fromHeight,
+	toHeight uint32) error {
+
+	return s.blockManager.verifyMwebHeaderChain(fromHeight, toHeight)
+}
+
+// VerifyMwebProofFile verifies an mweb proof file, such as one handed over
+// by another wallet, against the block header in our chain that it refers
+// to, returning the mweb utxos that it proves unspent as of that block. See
+// MwebProofFile for the format of the file.
+func (s *ChainService) VerifyMwebProofFile(
+	r io.Reader) (*MwebProofResult, error) {
+
+	return s.blockManager.verifyMwebProofFile(r)
+}
+
+// RefreshMwebState fetches and verifies the mweb header and leafset of the
+// current chain tip from our peers, without waiting for a new block. If the
+// leafset has changed since the mweb utxos were last synced, a sync of the
+// mweb utxos is triggered.
+func (s *ChainService) RefreshMwebState() error {
+	return s.blockManager.refreshMwebState()
+}
+
+// ProveMwebUtxo requests a fresh inclusion proof for the mweb utxo at the
+// given leaf index from our peers, and verifies it against the output root
+// at the current chain tip. It returns true if the utxo is unspent and its
+// proof is valid, or false with a nil error if the utxo has been spent. An
+// error is returned if no peer could serve a valid proof.
+func (s *ChainService) ProveMwebUtxo(leafIdx uint64) (bool, error) {
+	return s.blockManager.proveMwebUtxo(leafIdx)
+}
+
+// ResyncMweb wipes the mweb coins db, including the leafset, and fetches all
+// of the mweb utxos again from our peers, seeding the db from MwebSnapshot
+// first if it is set, and verifying against MwebCheckpoint as usual. This
+// is the way to recover from a db that is suspected to be corrupt. It
+// returns once the mweb sync has caught up with the chain tip again, while
+// the block header and filter header sync carry on as before.
+//
+// If ctx is done first, the mweb sync is paused as by CancelMwebQueries and
+// ctx.Err() is returned. Calling ResyncMweb again resumes the resync from
+// where it left off, without wiping the db again. If the mweb sync was
+// paused by CancelMwebQueries, the resync waits for ResumeMwebQueries.
+func (s *ChainService) ResyncMweb(ctx context.Context) error {
+	return s.blockManager.resyncMweb(ctx)
+}
+
+// RefetchMwebRange fetches the unspent mweb utxos with leaf indices from
+// start to start+count-1 again from our peers, as of the block that the mweb
+// coins db was last synced to. Once verified, they overwrite the stored
+// coins, which is useful when the stored coins are suspected to be stale or
+// corrupt. ErrMwebNotSynced is returned if no mweb utxos have been synced.
+func (s *ChainService) RefetchMwebRange(start, count uint64) error {
+	return s.blockManager.refetchMwebRange(start, count)
+}
+
+// SetMwebSyncStartHeight sets the height of the first block whose mweb utxos
+// are fetched, such as the birthday of a newly created wallet. Utxos created
+// in earlier blocks are skipped by every later sync, which can greatly cut
+// the time taken by the initial sync. Lowering the height later on, such as
+// for an earlier birthday, fetches the utxos that were skipped under the
+// old height before returning. Only the height set since the ChainService
+// was created is known, so one lowered across a restart fetches nothing
+// that was already skipped, unless the mweb coins db is purged.
+func (s *ChainService) SetMwebSyncStartHeight(height uint32) error {
+	return s.blockManager.setMwebSyncStartHeight(height)
+}
+
+// SetMwebQueryPeers pins the mweb queries, for mweb headers, leafsets and
+// utxos, to the peers with the given addresses, either host:port or just
+// the host. This is useful for testing against a known-good node, or for
+// keeping mweb queries away from untrusted peers. As long as any of the
+// pinned peers are connected, mweb queries wait for them rather than going
+// to other peers; if none are connected, they go to all peers as usual.
+// Passing no addresses unpins the mweb queries. Queries already under way
+// keep to the peers pinned when they started.
+func (s *ChainService) SetMwebQueryPeers(addrs []string) {
+	s.blockManager.mwebQueryPeers.set(addrs)
+}
+
+// MwebSyncStartHeight returns the height of the first block whose mweb utxos
+// are fetched, as set by SetMwebSyncStartHeight. It is zero if unset.
+func (s *ChainService) MwebSyncStartHeight() uint32 {
+	return atomic.LoadUint32(&s.blockManager.mwebSyncStartHeight)
+}
+
+// MwebVerifyTimings returns the time taken to verify the mweb utxos
+// responses served by our peers so far, bucketed by the number of utxos in
+// each response in ascending order. It returns nil unless the
+// MwebVerifyTiming config option is set.
+func (s *ChainService) MwebVerifyTimings() []MwebVerifyTimingBucket {
+	if s.blockManager.mwebVerifyTimer == nil {
+		return nil
+	}
+	return s.blockManager.mwebVerifyTimer.snapshot()
+}
+
+// MwebProofEfficiency returns the bytes of proof hashes and of utxos in the
+// mweb utxos responses verified from each peer so far, keyed by the peer's
+// address. It returns nil unless the MwebProofStats config option is set.
+func (s *ChainService) MwebProofEfficiency() map[string]MwebProofEfficiency {
+	if s.blockManager.mwebProofTracker == nil {
+		return nil
+	}
+	return s.blockManager.mwebProofTracker.snapshot()
+}
+
+// RegisterMwebUtxosStatsCallback registers a callback to be fired with the
+// number of utxos delivered, the number of proof hashes consumed and the
+// verification time of each mwebutxos response once verified. This tells
+// whether the proofs served are bloated relative to the coins delivered.
+// The callback must return quickly, as it holds up the query worker.
+func (s *ChainService) RegisterMwebUtxosStatsCallback(
+	onStats func(MwebUtxosBatchStats)) {
+
+	s.blockManager.RegisterMwebUtxosStatsCallback(onStats)
+}
+
+// RegisterMwebSyncProgressCallback registers a callback to be fired with the
+// progress of each sync of mweb utxos as its batches complete, including an
+// estimate of the time remaining from a moving average of the recent
+// batches' throughput. This lets wallet UIs show an ETA for the mweb sync.
+// No progress is reported unless a callback is registered. The callback
+// must return quickly, as it holds up the sync.
+func (s *ChainService) RegisterMwebSyncProgressCallback(
+	onProgress func(MwebSyncProgress)) {
+
+	s.blockManager.RegisterMwebSyncProgressCallback(onProgress)
+}
+
+// mwebLeafsetHistory is implemented by mweb coins dbs that retain the
+// leafsets of recent blocks, as the CoinStore does.
+type mwebLeafsetHistory interface {
+	// FetchLeafsetAtHeight fetches the leafset as it was at the given
+	// block height. In the case that the leafset at that height isn't
+	// retained, then mwebdb.ErrLeafsetNotRetained is to be returned.
+	FetchLeafsetAtHeight(uint32) (*mweb.Leafset, error)
+}
+
+// MwebLeafsetAtHeight returns the mweb leafset as it was at the given block
+// height, along with its size in leaves. Only the leafsets of the most
+// recent blocks that the mweb sync stored are retained, as set by the
+// MwebLeafsetHistoryDepth config option, so mwebdb.ErrLeafsetNotRetained is
+// returned for any others, and for all of them if the mweb coins db keeps
+// no history.
+func (s *ChainService) MwebLeafsetAtHeight(height uint32) ([]byte, uint64,
+	error) {
+
+	history, ok := s.MwebCoinDB.(mwebLeafsetHistory)
+	if !ok {
+		return nil, 0, fmt.Errorf("unable to fetch mweb leafset at "+
+			"height %v: %w", height, mwebdb.ErrLeafsetNotRetained)
+	}
+
+	leafset, err := history.FetchLeafsetAtHeight(height)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to fetch mweb leafset at "+
+			"height %v: %w", height, err)
+	}
+
+	return leafset.Bits, leafset.Size, nil
+}
+
+// mwebLeafsetRetention returns the number of blocks whose leafsets the mweb
+// coins db is to retain for the given MwebLeafsetHistoryDepth, which must
+// be between zero, keeping no history, and MaxMwebReorgDepth.
+func mwebLeafsetRetention(depth int) (uint32, error) {
+	if depth < 0 || depth > MaxMwebReorgDepth {
+		return 0, fmt.Errorf("MwebLeafsetHistoryDepth must be between "+
+			"0 and %v, got %v", MaxMwebReorgDepth, depth)
+	}
+
+	return uint32(depth), nil
+}
+
+// LeafIndexToHeight returns the height of the block that created the mweb
+// leaf with the given index. It uses the leaf counts of the blocks stored
+// by the mweb sync, so ErrMwebLeafHeightUnknown is returned if those don't
+// pin down the block.
+func (s *ChainService) LeafIndexToHeight(leafIdx uint64) (uint32, error) {
+	heightMap, err := s.MwebCoinDB.GetLeavesAtHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	return leafIndexToHeight(heightMap, leafIdx)
+}
+
+// HeightToLeafRange returns the range of the mweb leaves created by the
+// block at the given height, from start inclusive to end exclusive. It uses
+// the leaf counts of the blocks stored by the mweb sync, so
+// ErrMwebLeafHeightUnknown is returned unless the leaf counts of both the
+// block and the one before it are known.
+func (s *ChainService) HeightToLeafRange(height uint32) (uint64, uint64,
+	error) {
+
+	heightMap, err := s.MwebCoinDB.GetLeavesAtHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return heightToLeafRange(heightMap, height)
+}
+
+// MwebMmrPeaks returns the hashes of the peaks of the mweb output MMR, from
+// left to right, recomputed from the coins stored by the mweb sync. This is
+// meant for debugging a disagreement with a peer over the output root. As
+// only unspent coins are stored, ErrMwebPeakUnknown is returned if any peak
+// covers a spent leaf, or one skipped by SetMwebSyncStartHeight.
+func (s *ChainService) MwebMmrPeaks() ([]chainhash.Hash, error) {
+	leafset, coins, err := fetchUnspentMwebCoins(s.MwebCoinDB)
+	if err != nil {
+		return nil, err
+	}
+
+	outputIds := make(map[leafIdx]*chainhash.Hash, len(coins))
+	for _, coin := range coins {
+		outputIds[leafIdx(coin.LeafIndex)] = coin.OutputId
+	}
+
+	return calcMmrPeakHashes(leafset.Size, outputIds)
+}
+
+// VerifyStoredMwebCoins verifies the stored mweb coins again against the
+// proofs stored when they were fetched, without the network. Only the
+// proofs of the most recently fetched spans are kept, as set by the
+// MwebProofLimit config option, and ErrMwebProofsDisabled is returned
+// without it. The coins that verify are marked verified, releasing any that
+// MwebSafeMode was keeping back.
+func (s *ChainService) VerifyStoredMwebCoins() (*MwebCoinsAudit, error) {
+	if s.mwebProofs == nil {
+		return nil, ErrMwebProofsDisabled
+	}
+	return verifyStoredMwebCoins(s.MwebCoinDB, s.mwebProofs)
+}
+
+// FetchMwebKernels returns the verified mweb kernels with leaf indices from
+// start in the kernel MMR, up to count of them, stopping short at the first
+// that hasn't been synced. The kernels are only synced if the MwebKernels
+// config option is set, and ErrMwebKernelsDisabled is returned without it.
+func (s *ChainService) FetchMwebKernels(start, count uint64) (
+	[]*wire.MwebKernel, error) {
+
+	if s.mwebKernels == nil {
+		return nil, ErrMwebKernelsDisabled
+	}
+	return s.mwebKernels.FetchKernels(start, count)
+}
+
+// ReconcileMwebCoins reports the discrepancies between the unspent mweb
+// coins stored by the mweb sync and the leaves that a wallet has on record,
+// as returned by walletLeaves. It is meant for diagnosing a wallet whose
+// balance disagrees with ours once the mweb sync is done, as coins fetched
+// while it runs show up as discrepancies.
+func (s *ChainService) ReconcileMwebCoins(
+	walletLeaves MwebWalletLeaves) (*MwebCoinDiscrepancies, error) {
+
+	return reconcileMwebCoins(s.MwebCoinDB, walletLeaves)
+}
+
 // MwebUtxoExists checks if a mweb utxo with the given output ID exists
 // in the db.
 func (s *ChainService) MwebUtxoExists(outputId *chainhash.Hash) bool {
@@ -1647,6 +2622,7 @@ func (s *ChainService) outboundPeerConnected(c *connmgr.ConnReq, conn net.Conn)
 	}
 	sp.Peer = p
 	sp.connReq = c
+	sp.mwebCircuits = s.newMwebCircuits(sp, c.Addr)
 	sp.AssociateConnection(conn)
 	go s.peerDoneHandler(sp)
 }
@@ -1666,6 +2642,12 @@ func (s *ChainService) peerDoneHandler(sp *ServerPeer) {
 	if sp.VersionKnown() {
 		s.blockManager.DonePeer(sp)
 	}
+	if s.mwebArchival != nil {
+		s.mwebArchival.removePeer(sp.Addr())
+	}
+	if sp.mwebCircuits != nil {
+		sp.mwebCircuits.close()
+	}
 	close(sp.quit)
 }
 
@@ -1787,6 +2769,17 @@ func (s *ChainService) PeerByAddr(addr string) *ServerPeer {
 	return nil
 }
 
+// disconnectPeer disconnects the peer with the given address, if we're still
+// connected to it. It does so in a goroutine, as it may be called while the
+// server is busy handling a query or a new peer.
+func (s *ChainService) disconnectPeer(addr string) {
+	go func() {
+		if sp := s.PeerByAddr(addr); sp != nil {
+			sp.Disconnect()
+		}
+	}()
+}
+
 // RescanChainSource is a wrapper type around the ChainService struct that will
 // be used to satisfy the rescan.ChainSource interface.
 type RescanChainSource struct {
@@ -201,12 +201,18 @@ func (b *Broadcaster) broadcastHandler(sub *blockntfns.Subscription) {
 
 		// A new block notification has arrived, so we'll rebroadcast
 		// all of our pending transactions.
-		case _, ok := <-sub.Notifications:
+		case ntfn, ok := <-sub.Notifications:
 			if !ok {
 				log.Warn("Unable to rebroadcast transactions: " +
 					"block subscription was canceled")
 				continue
 			}
+
+			// The mweb sync follows up on blocks that have
+			// already been notified.
+			if _, ok := ntfn.(*blockntfns.MwebConnected); ok {
+				continue
+			}
 			triggerRebroadcast()
 
 		// Between blocks, we'll also try to attempt additional
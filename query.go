@@ -120,6 +120,11 @@ type queryOptions struct {
 	// and that we should attempt to batch more items with the query such
 	// that they can be cached, avoiding the extra round trip.
 	optimisticBatch optimisticBatchType
+
+	// allowPeer, if set, reports the peers that the query is kept to as
+	// long as any of them are connected. This option is only used when
+	// querying all peers.
+	allowPeer func(addr string) bool
 }
 
 // optimisticBatchType is a type indicating the kind of batching we want to
@@ -253,6 +258,17 @@ func MaxBatchSize(maxSize int64) QueryOption {
 	}
 }
 
+// AllowPeers is a query option that keeps the query to the peers that allow
+// reports, as long as any of them are connected. Otherwise, the query is
+// sent to all peers as usual.
+//
+// NOTE: This option is currently only used when querying all peers.
+func AllowPeers(allow func(addr string) bool) QueryOption {
+	return func(qo *queryOptions) {
+		qo.allowPeer = allow
+	}
+}
+
 // We provide 3 kinds of queries:
 //
 // * queryAllPeers allows a single query to be broadcast to all peers, and
@@ -302,6 +318,9 @@ func (s *ChainService) queryAllPeers(
 	// framework that requires access to peerState, so it's done once per
 	// query.
 	peers := s.Peers()
+	if qo.allowPeer != nil {
+		peers = allowServerPeers(peers, qo.allowPeer)
+	}
 
 	// This will be shared state between the per-peer goroutines.
 	queryQuit := make(chan struct{})
@@ -326,6 +345,12 @@ func (s *ChainService) queryAllPeers(
 			defer sp.unsubscribeRecvMsgs(subscription)
 
 			for i := uint8(0); i < qo.numRetries; i++ {
+				if !s.waitRateLimit(
+					sp, queryMsg, queryQuit, peerQuit,
+				) {
+					return
+				}
+
 				timeout := time.After(qo.timeout)
 				sp.QueueMessageWithEncoding(queryMsg,
 					nil, qo.encoding)
@@ -392,6 +417,52 @@ checkResponses:
 	}
 }
 
+// waitRateLimit waits until the peer may be sent the message within its rate
+// limit, if any, counting the message towards it. False is returned if the
+// query for the peer ended first.
+func (s *ChainService) waitRateLimit(sp *ServerPeer, msg wire.Message,
+	queryQuit, peerQuit <-chan struct{}) bool {
+
+	if s.rateLimiter == nil {
+		return true
+	}
+
+	for {
+		wait := s.rateLimiter.Delay(sp.Addr(), msg)
+		if wait == 0 {
+			s.rateLimiter.Take(sp.Addr(), msg)
+			return true
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-queryQuit:
+			return false
+		case <-peerQuit:
+			return false
+		case <-s.quit:
+			return false
+		}
+	}
+}
+
+// allowServerPeers returns the peers that are allowed, or all of them if
+// none are.
+func allowServerPeers(peers []*ServerPeer,
+	allow func(addr string) bool) []*ServerPeer {
+
+	var allowed []*ServerPeer
+	for _, sp := range peers {
+		if allow(sp.Addr()) {
+			allowed = append(allowed, sp)
+		}
+	}
+	if len(allowed) == 0 {
+		return peers
+	}
+	return allowed
+}
+
 // getFilterFromCache returns a filter from ChainService's FilterCache if it
 // exists, returning nil and error if it doesn't.
 func (s *ChainService) getFilterFromCache(blockHash *chainhash.Hash,
@@ -879,7 +950,7 @@ func (s *ChainService) GetBlock(blockHash chainhash.Hash,
 				blockHash, peer, err)
 
 			// Ban and disconnect the peer.
-			err = s.BanPeer(peer, banman.InvalidBlock)
+			err = s.blockManager.banPeer(peer, banman.InvalidBlock)
 			if err != nil {
 				log.Errorf("Unable to ban peer %v: %v", peer,
 					err)
@@ -898,7 +969,7 @@ func (s *ChainService) GetBlock(blockHash chainhash.Hash,
 			log.Warnf("Invalid block for %s received from %s: %v "+
 				"-- disconnecting peer", blockHash, peer, err)
 
-			err = s.BanPeer(peer, banman.InvalidBlock)
+			err = s.blockManager.banPeer(peer, banman.InvalidBlock)
 			if err != nil {
 				log.Errorf("Unable to ban peer %v: %v", peer,
 					err)
@@ -119,6 +119,19 @@ type Progress struct {
 	// used for the requests types where more than one response is
 	// expected.
 	Progressed bool
+
+	// Declined is true if the peer declined to answer the request, such
+	// as with a notfound or reject message. Rather than waiting for the
+	// request to time out, it is given to another peer at once.
+	Declined bool
+
+	// Pending, if set, is where the progress of the response is delivered
+	// once it has been handled on another goroutine, and the other fields
+	// are ignored. This lets a handler with expensive work to do return
+	// at once. Meanwhile the worker goes on reading the peer's messages,
+	// and the request's timeout restarts. The channel should be buffered,
+	// as the worker stops waiting on it if the request ends first.
+	Pending <-chan Progress
 }
 
 // Request is the main struct that defines a bitcoin network query to be sent to
@@ -137,8 +150,54 @@ type Request struct {
 	// is running, it should not be doing any expensive operations. It
 	// should validate the response and immediately return the progress.
 	// The response should be handed off to another goroutine for
-	// processing.
+	// processing. If validating it is expensive too, the progress can be
+	// delivered later through Progress.Pending.
 	HandleResp func(req, resp wire.Message, peer string) Progress
+
+	// PreferPeer, if set, reports the peers that the request should be
+	// given to in preference to the others, whatever their ranking. The
+	// request still goes to other peers if none of the preferred ones are
+	// free. It is called from the work manager's dispatcher, so it must
+	// return quickly.
+	PreferPeer func(peer string) bool
+
+	// AllowPeer, if set, reports the peers that the request may be given
+	// to. As long as any of them are connected, the request waits for one
+	// of them to be free rather than going to any other peer, while the
+	// requests queued behind it are given out. If none are connected, it
+	// goes to any peer as usual. It is called from the work manager's
+	// dispatcher, so it must return quickly.
+	AllowPeer func(peer string) bool
+
+	// SelectPeers, if set, is given the addresses of the peers free to
+	// take the request, in the order that the work manager would try
+	// them, and returns those that it may be given to, in the order to
+	// try them. The request is held back while it returns none, while
+	// the requests queued behind it are given out. It is called from the
+	// work manager's dispatcher, so it must return quickly.
+	SelectPeers func(peers []string) []string
+
+	// PeerGroup, if set, returns the network group of a peer, and the
+	// request is given to a peer in the group with the fewest jobs in
+	// flight, ahead of the peer ranking but behind PreferPeer. This
+	// spreads the requests across network groups rather than having them
+	// land on peers from the same subnet. It is called from the work
+	// manager's dispatcher, so it must return quickly.
+	PeerGroup func(peer string) string
+
+	// OnResult, if set, is called each time a peer given the request
+	// either answers it or fails to, with the time taken and the error
+	// it failed with, if any. It isn't called if the request is
+	// canceled. It is called from the work manager's dispatcher, so it
+	// must return quickly.
+	OnResult func(peer string, elapsed time.Duration, err error)
+
+	// Cancel, if set, cancels just this request once closed, without
+	// canceling the rest of its batch. The batch then no longer waits
+	// for the request, as if it had been answered. This lets the same
+	// message be sent to several peers at once, with the others
+	// canceled once one of them answers.
+	Cancel <-chan struct{}
 }
 
 // WorkManager defines an API for a manager that dispatches queries to bitcoin
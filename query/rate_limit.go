@@ -0,0 +1,126 @@
+package query
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// tokenBucket is a simple token bucket which refills at a constant rate up
+// to a maximum burst size.
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// peerRateLimiter is a RateLimiter that keeps a token bucket for each peer,
+// limiting the rate at which matching requests are sent to it.
+type peerRateLimiter struct {
+	// rate is the number of tokens added to each bucket per second.
+	rate float64
+
+	// burst is the maximum number of tokens a bucket can hold.
+	burst float64
+
+	// match determines whether a request is subject to the limit.
+	match func(wire.Message) bool
+
+	// now returns the current time. It is configurable for tests.
+	now func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// A compile time check to ensure peerRateLimiter satisfies the RateLimiter
+// interface.
+var _ RateLimiter = (*peerRateLimiter)(nil)
+
+// NewPeerRateLimiter returns a RateLimiter allowing each peer to be sent at
+// most rate requests per second for which match returns true, with bursts
+// of up to burst requests. Requests that don't match are never limited.
+func NewPeerRateLimiter(rate float64, burst int,
+	match func(wire.Message) bool) RateLimiter {
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &peerRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		match:   match,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Delay returns zero if the peer's bucket holds a token for sending the given
+// request, and otherwise the time until it will. The token isn't taken.
+//
+// NOTE: Part of the RateLimiter interface.
+func (p *peerRateLimiter) Delay(peer string, req wire.Message) time.Duration {
+	if p.rate <= 0 || !p.match(req) {
+		return 0
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	b := p.refill(peer)
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / p.rate * float64(time.Second))
+	if wait <= 0 {
+		wait = time.Nanosecond
+	}
+	return wait
+}
+
+// Take takes a token from the peer's bucket for the given request having
+// been sent. Should the bucket have run dry in the meantime, it goes into
+// debt, delaying the peer's next request for longer.
+//
+// NOTE: Part of the RateLimiter interface.
+func (p *peerRateLimiter) Take(peer string, req wire.Message) {
+	if p.rate <= 0 || !p.match(req) {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.refill(peer).tokens--
+}
+
+// refill returns the peer's bucket, topped up with the tokens accrued since
+// it was last refilled. The mutex must be held.
+func (p *peerRateLimiter) refill(peer string) *tokenBucket {
+	now := p.now()
+	b, ok := p.buckets[peer]
+	if !ok {
+		b = &tokenBucket{tokens: p.burst, lastRefill: now}
+		p.buckets[peer] = b
+	}
+
+	b.tokens += now.Sub(b.lastRefill).Seconds() * p.rate
+	if b.tokens > p.burst {
+		b.tokens = p.burst
+	}
+	b.lastRefill = now
+
+	return b
+}
+
+// RemovePeer forgets the bucket for the given peer.
+//
+// NOTE: Part of the RateLimiter interface.
+func (p *peerRateLimiter) RemovePeer(peer string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.buckets, peer)
+}
@@ -0,0 +1,172 @@
+package query
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPeerRateLimiter tests that the per-peer token buckets refill at the
+// configured rate and only limit matching requests.
+func TestPeerRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	isGetData := func(msg wire.Message) bool {
+		_, ok := msg.(*wire.MsgGetData)
+		return ok
+	}
+	limiter := NewPeerRateLimiter(2, 2, isGetData).(*peerRateLimiter)
+
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time {
+		return now
+	}
+
+	// reserve takes a token for the request if the peer has one.
+	reserve := func(peer string, req wire.Message) time.Duration {
+		wait := limiter.Delay(peer, req)
+		if wait == 0 {
+			limiter.Take(peer, req)
+		}
+		return wait
+	}
+
+	getData := wire.NewMsgGetData()
+	ping := wire.NewMsgPing(0)
+
+	// A new peer starts out with a full bucket, so the first burst of
+	// requests should be allowed.
+	require.Zero(t, reserve("a", getData))
+	require.Zero(t, reserve("a", getData))
+
+	// The bucket is now empty, so we'll have to wait half a second for
+	// the next token. Requests that don't match aren't limited.
+	require.Equal(t, 500*time.Millisecond, reserve("a", getData))
+	require.Zero(t, reserve("a", ping))
+
+	// Other peers have their own bucket.
+	require.Zero(t, reserve("b", getData))
+
+	// After a quarter of a second we should still be waiting.
+	now = now.Add(250 * time.Millisecond)
+	require.Equal(t, 250*time.Millisecond, reserve("a", getData))
+
+	// Once enough time has passed, the token becomes available.
+	now = now.Add(250 * time.Millisecond)
+	require.Zero(t, reserve("a", getData))
+
+	// The bucket never holds more than the burst size.
+	now = now.Add(time.Hour)
+	require.Zero(t, reserve("a", getData))
+	require.Zero(t, reserve("a", getData))
+	require.NotZero(t, reserve("a", getData))
+
+	// Removing the peer resets its bucket.
+	limiter.RemovePeer("a")
+	require.Zero(t, reserve("a", getData))
+
+	// Checking the delay doesn't take a token, while taking one from an
+	// empty bucket puts it into debt.
+	require.Zero(t, limiter.Delay("a", getData))
+	require.Zero(t, limiter.Delay("a", getData))
+	limiter.Take("a", getData)
+	limiter.Take("a", getData)
+	require.Equal(t, time.Second, limiter.Delay("a", getData))
+}
+
+// TestWorkManagerRateLimit tests that the work dispatcher doesn't give
+// queries to a peer faster than its rate limit allows.
+func TestWorkManagerRateLimit(t *testing.T) {
+	const (
+		numQueries = 10
+		numWorkers = 2
+		rate       = 20
+		interval   = time.Second / rate
+	)
+
+	wm, workers := startWorkManager(t, numWorkers, func(cfg *Config) {
+		cfg.RateLimiter = NewPeerRateLimiter(
+			rate, 1, func(wire.Message) bool { return true },
+		)
+	})
+
+	var queries []*Request
+	for i := 0; i < numQueries; i++ {
+		queries = append(queries, &Request{})
+	}
+
+	// Each worker records the time it was handed each job, and responds
+	// immediately with a successful result.
+	var (
+		mtx   sync.Mutex
+		times = make(map[*mockWorker][]time.Time)
+	)
+	for _, wk := range workers {
+		wk := wk
+		go func() {
+			for job := range wk.nextJob {
+				mtx.Lock()
+				times[wk] = append(times[wk], time.Now())
+				mtx.Unlock()
+
+				wk.results <- &jobResult{job: job}
+			}
+		}()
+	}
+
+	errChan := wm.Query(queries)
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("batch did not finish")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	// Allow for some timer imprecision when comparing the intervals.
+	total := 0
+	for _, jobTimes := range times {
+		total += len(jobTimes)
+		for i := 1; i < len(jobTimes); i++ {
+			gap := jobTimes[i].Sub(jobTimes[i-1])
+			require.GreaterOrEqual(t, gap, interval*9/10)
+		}
+	}
+	require.Equal(t, numQueries, total)
+}
+
+// TestWorkManagerRateLimitSkips tests that a query rate limited for all free
+// peers doesn't hold back the queries behind it that aren't limited.
+func TestWorkManagerRateLimitSkips(t *testing.T) {
+	isGetData := func(msg wire.Message) bool {
+		_, ok := msg.(*wire.MsgGetData)
+		return ok
+	}
+	wm, workers := startWorkManager(t, 1, func(cfg *Config) {
+		cfg.RateLimiter = NewPeerRateLimiter(0.001, 1, isGetData)
+	})
+
+	_ = wm.Query([]*Request{
+		{Req: wire.NewMsgGetData()},
+		{Req: wire.NewMsgGetData()},
+		{Req: wire.NewMsgPing(0)},
+	})
+
+	// The first query uses up the peer's burst, so the second has to
+	// wait while the third goes ahead.
+	for _, index := range []uint64{0, 2} {
+		select {
+		case job := <-workers[0].nextJob:
+			require.Equal(t, index, job.index)
+			workers[0].results <- &jobResult{job: job}
+
+		case <-time.After(time.Second):
+			t.Fatalf("job %v not scheduled", index)
+		}
+	}
+}
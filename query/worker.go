@@ -19,6 +19,16 @@ var (
 	// ErrJobCanceled is returned if the job is canceled before the query
 	// has been answered.
 	ErrJobCanceled = errors.New("job canceled")
+
+	// ErrRequestCanceled is returned if the job's own request is canceled
+	// before the query has been answered. Unlike ErrJobCanceled, it
+	// doesn't cancel the rest of the job's batch.
+	ErrRequestCanceled = errors.New("request canceled")
+
+	// ErrPeerDeclined is returned if the worker's peer declines to
+	// answer the query, such as by responding that it doesn't have the
+	// data requested.
+	ErrPeerDeclined = errors.New("peer declined request")
 )
 
 // queryJob is the internal struct that wraps the Query to work on, in
@@ -130,6 +140,13 @@ func (w *worker) Run(results chan<- *jobResult, quit <-chan struct{}) {
 			// result will be sent back.
 			break
 
+		// Likewise if just this job's request is canceled.
+		case <-job.Cancel:
+			log.Tracef("Worker %v found request of job with index "+
+				"%v already canceled", peer.Addr(), job.Index())
+
+			break
+
 		// We received a non-canceled query job, send it to the peer.
 		default:
 			log.Tracef("Worker %v queuing job %T with index %v",
@@ -139,51 +156,61 @@ func (w *worker) Run(results chan<- *jobResult, quit <-chan struct{}) {
 		}
 
 		// Wait for the correct response to be received from the peer,
-		// or an error happening.
+		// or an error happening. The progress of responses still being
+		// handled elsewhere is taken in the order they were received.
 		var (
 			jobErr  error
 			timeout = time.NewTimer(job.timeout)
+			pending []<-chan Progress
 		)
 
 	Loop:
 		for {
+			var (
+				progress    Progress
+				nextPending <-chan Progress
+			)
+			if len(pending) > 0 {
+				nextPending = pending[0]
+			}
+
 			select {
 			// A message was received from the peer, use the
 			// response handler to check whether it was answering
 			// our request.
 			case resp := <-msgChan:
-				progress := job.HandleResp(
+				progress = job.HandleResp(
 					job.Req, resp, peer.Addr(),
 				)
 
 				log.Tracef("Worker %v handled msg %T while "+
 					"waiting for response to %T (job=%v). "+
-					"Finished=%v, progressed=%v",
-					peer.Addr(), resp, job.Req, job.Index(),
-					progress.Finished, progress.Progressed)
-
-				// If the response did not answer our query, we
-				// check whether it did progress it.
-				if !progress.Finished {
-					// If it did make progress we reset the
-					// timeout. This ensures that the
-					// queries with multiple responses
-					// expected won't timeout before all
-					// responses have been handled.
-					// TODO(halseth): separate progress
-					// timeout value.
-					if progress.Progressed {
-						timeout.Stop()
-						timeout = time.NewTimer(
-							job.timeout,
-						)
-					}
+					"Finished=%v, progressed=%v, "+
+					"pending=%v", peer.Addr(), resp,
+					job.Req, job.Index(), progress.Finished,
+					progress.Progressed,
+					progress.Pending != nil)
+
+				// The time taken to handle the response
+				// mustn't count against the peer.
+				if progress.Pending != nil {
+					pending = append(
+						pending, progress.Pending,
+					)
+					timeout.Stop()
+					timeout = time.NewTimer(job.timeout)
 					continue Loop
 				}
 
-				// We did get a valid response, and can break
-				// the loop.
-				break Loop
+			// A response handled elsewhere is done with.
+			case progress = <-nextPending:
+				pending = pending[1:]
+
+				log.Tracef("Worker %v handled pending msg "+
+					"for %T (job=%v). Finished=%v, "+
+					"progressed=%v", peer.Addr(), job.Req,
+					job.Index(), progress.Finished,
+					progress.Progressed)
 
 			// If the timeout is reached before a valid response
 			// has been received, we exit with an error.
@@ -216,9 +243,46 @@ func (w *worker) Run(results chan<- *jobResult, quit <-chan struct{}) {
 				jobErr = ErrJobCanceled
 				break Loop
 
+			// If just the job's request was canceled, we report
+			// this back too, so that the rest of the batch can go
+			// on without it.
+			case <-job.Cancel:
+				log.Tracef("Worker %v job %v request canceled",
+					peer.Addr(), job.Index())
+
+				jobErr = ErrRequestCanceled
+				break Loop
+
 			case <-quit:
 				return
 			}
+
+			// If the peer declined to answer, there's no point
+			// waiting for it to time out.
+			if progress.Declined {
+				jobErr = ErrPeerDeclined
+				break Loop
+			}
+
+			// If the response did not answer our query, we check
+			// whether it did progress it.
+			if !progress.Finished {
+				// If it did make progress we reset the
+				// timeout. This ensures that the queries with
+				// multiple responses expected won't timeout
+				// before all responses have been handled.
+				// TODO(halseth): separate progress timeout
+				// value.
+				if progress.Progressed {
+					timeout.Stop()
+					timeout = time.NewTimer(job.timeout)
+				}
+				continue Loop
+			}
+
+			// We did get a valid response, and can break the
+			// loop.
+			break Loop
 		}
 
 		// Stop to allow garbage collection.
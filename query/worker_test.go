@@ -399,6 +399,144 @@ func TestWorkerProgress(t *testing.T) {
 	}
 }
 
+// TestWorkerDeclined tests that the worker gives up on a job at once if the
+// peer declines to answer it, rather than waiting for it to time out.
+func TestWorkerDeclined(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := startWorker()
+	if err != nil {
+		t.Fatalf("unable to start worker: %v", err)
+	}
+
+	// Create a task with a long timeout that declines on a notfound.
+	task := makeJob()
+	handleResp := task.HandleResp
+	task.HandleResp = func(req, resp wire.Message, peer string) Progress {
+		if _, ok := resp.(*wire.MsgNotFound); ok {
+			return Progress{Declined: true}
+		}
+		return handleResp(req, resp, peer)
+	}
+
+	select {
+	case ctx.nextJob <- task:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("did not pick up job")
+	}
+
+	// The request should be given to the peer.
+	select {
+	case <-ctx.peer.requests:
+	case <-time.After(time.Second):
+		t.Fatalf("request not sent")
+	}
+
+	// Decline the request.
+	select {
+	case ctx.peer.responses <- wire.NewMsgNotFound():
+	case <-time.After(time.Second):
+		t.Fatalf("resp not received")
+	}
+
+	// The worker should respond with an error well before the timeout.
+	var result *jobResult
+	select {
+	case result = <-ctx.jobResults:
+	case <-time.After(time.Second):
+		t.Fatalf("response not received")
+	}
+
+	if result.err != ErrPeerDeclined {
+		t.Fatalf("expected declined, got: %v", result.err)
+	}
+
+	// Make sure the result was given for the intended task.
+	if result.job != task {
+		t.Fatalf("got result for unexpected job")
+	}
+
+	// It will immediately attempt to fetch another task.
+	select {
+	case ctx.nextJob <- task:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("did not pick up job")
+	}
+}
+
+// TestWorkerPending tests that the worker goes on reading the peer's
+// messages while a response is handled elsewhere, and finishes the job once
+// the pending progress says so.
+func TestWorkerPending(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := startWorker()
+	if err != nil {
+		t.Fatalf("unable to start worker: %v", err)
+	}
+
+	// Create a task whose final response is handled elsewhere.
+	task := makeJob()
+	handleResp := task.HandleResp
+	pending := make(chan Progress, 1)
+	task.HandleResp = func(req, resp wire.Message, peer string) Progress {
+		if resp == finalResp {
+			return Progress{Pending: pending}
+		}
+		return handleResp(req, resp, peer)
+	}
+
+	select {
+	case ctx.nextJob <- task:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("did not pick up job")
+	}
+
+	// The request should be given to the peer.
+	select {
+	case <-ctx.peer.requests:
+	case <-time.After(time.Second):
+		t.Fatalf("request not sent")
+	}
+
+	select {
+	case ctx.peer.responses <- finalResp:
+	case <-time.After(time.Second):
+		t.Fatalf("resp not received")
+	}
+
+	// The worker must still take the peer's messages while the final
+	// response is handled.
+	select {
+	case ctx.peer.responses <- progressResp:
+	case <-time.After(time.Second):
+		t.Fatalf("resp not received")
+	}
+
+	select {
+	case <-ctx.jobResults:
+		t.Fatalf("job finished before response was handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once handled, the job is finished.
+	pending <- Progress{Finished: true, Progressed: true}
+
+	var result *jobResult
+	select {
+	case result = <-ctx.jobResults:
+	case <-time.After(time.Second):
+		t.Fatalf("response not received")
+	}
+
+	if result.err != nil {
+		t.Fatalf("expected no error, got: %v", result.err)
+	}
+	if result.job != task {
+		t.Fatalf("got result for unexpected job")
+	}
+}
+
 // TestWorkerJobCanceled tests that the worker will return an error if the job is
 // canceled while the worker is handling it.
 func TestWorkerJobCanceled(t *testing.T) {
@@ -3,8 +3,11 @@ package query
 import (
 	"container/heap"
 	"errors"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/ltcmweb/ltcd/wire"
 )
 
 const (
@@ -69,6 +72,22 @@ type PeerRanking interface {
 	Order(peers []Peer)
 }
 
+// RateLimiter is an interface that must be satisfied by the underlying module
+// used to limit the rate at which queries are given to each peer.
+type RateLimiter interface {
+	// Delay returns zero if the request may be given to the peer now, or
+	// otherwise the time to wait before it can be. It doesn't count the
+	// request towards the peer's limit.
+	Delay(peer string, req wire.Message) time.Duration
+
+	// Take should be called once the request has been given to the peer,
+	// counting it towards the peer's limit.
+	Take(peer string, req wire.Message)
+
+	// RemovePeer should be called when the peer is no longer active.
+	RemovePeer(peer string)
+}
+
 // activeWorker wraps a Worker that is currently running, together with the job
 // we have given to it.
 // TODO(halseth): support more than one active job at a time.
@@ -76,6 +95,9 @@ type activeWorker struct {
 	w         Worker
 	activeJob *queryJob
 	onExit    chan struct{}
+
+	// sentAt is when the active job was given to the worker.
+	sentAt time.Time
 }
 
 // Config holds the configuration options for a new WorkManager.
@@ -94,6 +116,16 @@ type Config struct {
 	// Ranking is used to rank the connected peers when determining who to
 	// give work to.
 	Ranking PeerRanking
+
+	// RateLimiter is an optional limiter used to avoid giving queries to
+	// a peer faster than it allows. A query that can't be given to any
+	// free peer will wait until one of them becomes available, while the
+	// queries behind it are given out.
+	RateLimiter RateLimiter
+
+	// MaxWorkers is the maximum number of workers that may have a query
+	// in flight at the same time. If zero, all workers may be used.
+	MaxWorkers int
 }
 
 // peerWorkManager is the main access point for outside callers, and satisfies
@@ -206,30 +238,67 @@ func (w *peerWorkManager) workDispatcher() {
 
 Loop:
 	for {
-		// If the work queue is non-empty, we'll take out the first
-		// element in order to distribute it to a worker.
-		if work.Len() > 0 {
-			next := work.Peek().(*queryJob)
-
-			// Find the peers with free work slots available.
-			var freeWorkers []Peer
-			for p, r := range workers {
-				// Only one active job at a time is currently
-				// supported.
-				if r.activeJob != nil {
-					continue
-				}
-
-				freeWorkers = append(freeWorkers, p)
+		// If a query in the work queue is rate limited for all free
+		// peers, we'll wake up once the earliest of them can take it.
+		var rateLimitWait time.Duration
+
+		// Find the peers with free work slots available.
+		var (
+			freeWorkers []Peer
+			busyWorkers []Peer
+		)
+		for p, r := range workers {
+			// Only one active job at a time is currently supported.
+			if r.activeJob != nil {
+				busyWorkers = append(busyWorkers, p)
+				continue
 			}
 
-			// Use the historical data to rank them.
-			w.cfg.Ranking.Order(freeWorkers)
+			freeWorkers = append(freeWorkers, p)
+		}
+
+		// If the maximum number of workers are already busy, the
+		// queries must wait for one of them to finish.
+		if w.cfg.MaxWorkers > 0 && len(busyWorkers) >= w.cfg.MaxWorkers {
+			freeWorkers = nil
+		}
+
+		// Go through the work queue in order, giving the first query
+		// that a free worker can take to the highest ranked of them.
+		// A query held back, such as one kept to busy peers or rate
+		// limited for all of the free ones, is set aside so that the
+		// queries behind it still go out.
+		var (
+			heldBack []*queryJob
+			sent     bool
+		)
+		for !sent && len(freeWorkers) > 0 && work.Len() > 0 {
+			next := heap.Pop(work).(*queryJob)
+
+			peers := w.jobPeers(next, freeWorkers, busyWorkers)
+			for _, p := range peers {
+				// Skip the worker if it exited while we were
+				// giving out an earlier query.
+				r, ok := workers[p]
+				if !ok {
+					continue
+				}
 
-			// Give the job to the highest ranked peer with free
-			// slots available.
-			for _, p := range freeWorkers {
-				r := workers[p]
+				// Skip the peer if giving it the query would
+				// exceed its rate limit.
+				if w.cfg.RateLimiter != nil {
+					wait := w.cfg.RateLimiter.Delay(
+						p.Addr(), next.Req,
+					)
+					if wait > 0 {
+						if rateLimitWait == 0 ||
+							wait < rateLimitWait {
+
+							rateLimitWait = wait
+						}
+						continue
+					}
+				}
 
 				// The worker has free work slots, it should
 				// pick up the query.
@@ -237,30 +306,61 @@ Loop:
 				case r.w.NewJob() <- next:
 					log.Tracef("Sent job %v to worker %v",
 						next.Index(), p)
-					heap.Pop(work)
 					r.activeJob = next
-
-					// Go back to start of loop, to check
-					// if there are more jobs to
-					// distribute.
-					continue Loop
+					r.sentAt = time.Now()
+					sent = true
+
+					// The query only counts towards the
+					// peer's rate limit once it's given.
+					if w.cfg.RateLimiter != nil {
+						w.cfg.RateLimiter.Take(
+							p.Addr(), next.Req,
+						)
+					}
 
 				// Remove workers no longer active.
 				case <-r.onExit:
 					delete(workers, p)
+					if w.cfg.RateLimiter != nil {
+						w.cfg.RateLimiter.RemovePeer(
+							p.Addr(),
+						)
+					}
 					continue
 
 				case <-w.quit:
 					return
 				}
+				break
+			}
+
+			if !sent {
+				heldBack = append(heldBack, next)
 			}
 		}
+		for _, job := range heldBack {
+			heap.Push(work, job)
+		}
+
+		// Go back to start of loop, to check if there are more jobs
+		// to distribute.
+		if sent {
+			continue Loop
+		}
+
+		var rateLimitTimer <-chan time.Time
+		if rateLimitWait > 0 {
+			rateLimitTimer = time.After(rateLimitWait)
+		}
 
 		// Otherwise the work queue is empty, or there are no workers
 		// to distribute work to, so we'll just wait for a result of a
 		// previous query to come back, a new peer to connect, or for a
 		// new batch of queries to be scheduled.
 		select {
+		// A rate limited peer can now be given the next query.
+		case <-rateLimitTimer:
+
 		// Spin up a goroutine that runs a worker each time a peer
 		// connects.
 		case peer := <-peersConnected:
@@ -300,6 +400,18 @@ Loop:
 			r := workers[result.peer]
 			r.activeJob = nil
 
+			// Report how the query went to the caller, unless it
+			// was canceled.
+			if result.job.OnResult != nil &&
+				result.err != ErrJobCanceled &&
+				result.err != ErrRequestCanceled {
+
+				elapsed := time.Since(r.sentAt)
+				result.job.OnResult(
+					result.peer.Addr(), elapsed, result.err,
+				)
+			}
+
 			// Get the index of this query's batch.
 			batchNum := result.job.batch
 			batch := currentBatches[batchNum]
@@ -327,7 +439,9 @@ Loop:
 			// If the query ended with any other error, put it back
 			// into the work queue if it has not reached the
 			// maximum number of retries.
-			case result.err != nil:
+			case result.err != nil &&
+				result.err != ErrRequestCanceled:
+
 				// Punish the peer for the failed query.
 				w.cfg.Ranking.Punish(result.peer.Addr())
 
@@ -385,11 +499,15 @@ Loop:
 
 				heap.Push(work, result.job)
 
-			// Otherwise, we got a successful result and update the
-			// status of the batch this query is a part of.
+			// Otherwise, we got a successful result, or the query's
+			// own request was canceled, and update the status of
+			// the batch this query is a part of. A canceled request
+			// is no longer waited for, as if it had been answered.
 			default:
 				// Reward the peer for the successful query.
-				w.cfg.Ranking.Reward(result.peer.Addr())
+				if result.err == nil {
+					w.cfg.Ranking.Reward(result.peer.Addr())
+				}
 
 				// Decrement the number of queries remaining in
 				// the batch.
@@ -504,3 +622,107 @@ func (w *peerWorkManager) Query(requests []*Request,
 
 	return errChan
 }
+
+// jobPeers returns the free peers that the job may be given to, in the order
+// that it's to be offered to them. The job's peer options are applied on top
+// of the ranking, which may leave no peers for it for now.
+func (w *peerWorkManager) jobPeers(job *queryJob, free, busy []Peer) []Peer {
+	peers := make([]Peer, len(free))
+	copy(peers, free)
+
+	// Keep the query to the peers it allows, if any of them are
+	// connected.
+	if job.AllowPeer != nil {
+		peers = allowPeers(peers, busy, job.AllowPeer)
+	}
+
+	// Use the historical data to rank them, spreading the query across
+	// network groups if it asks to, with any peers preferred by the query
+	// going first.
+	w.cfg.Ranking.Order(peers)
+	if job.PeerGroup != nil {
+		spreadPeerGroups(peers, busy, job.PeerGroup)
+	}
+	if job.PreferPeer != nil {
+		preferPeers(peers, job.PreferPeer)
+	}
+	if job.SelectPeers != nil {
+		peers = selectPeers(peers, job.SelectPeers)
+	}
+
+	return peers
+}
+
+// spreadPeerGroups orders the free peers by the number of busy peers in
+// their network group, fewest first, keeping the relative order of the peers
+// otherwise.
+func spreadPeerGroups(free, busy []Peer, group func(peer string) string) {
+	load := make(map[string]int)
+	for _, p := range busy {
+		load[group(p.Addr())]++
+	}
+
+	groups := make(map[Peer]string, len(free))
+	for _, p := range free {
+		groups[p] = group(p.Addr())
+	}
+	sort.SliceStable(free, func(i, j int) bool {
+		return load[groups[free[i]]] < load[groups[free[j]]]
+	})
+}
+
+// allowPeers returns the free peers that are allowed, unless none of the
+// free or busy peers are, in which case all of the free peers are returned.
+func allowPeers(free, busy []Peer, allow func(peer string) bool) []Peer {
+	var allowed []Peer
+	for _, p := range free {
+		if allow(p.Addr()) {
+			allowed = append(allowed, p)
+		}
+	}
+	if len(allowed) > 0 {
+		return allowed
+	}
+
+	for _, p := range busy {
+		if allow(p.Addr()) {
+			return nil
+		}
+	}
+	return free
+}
+
+// selectPeers returns the peers selected by the given function, in the order
+// that it returns them. Addresses that aren't among the peers, or that are
+// repeated, are ignored.
+func selectPeers(peers []Peer, sel func(peers []string) []string) []Peer {
+	addrs := make([]string, len(peers))
+	byAddr := make(map[string]Peer, len(peers))
+	for i, p := range peers {
+		addrs[i] = p.Addr()
+		byAddr[addrs[i]] = p
+	}
+
+	var selected []Peer
+	for _, addr := range sel(addrs) {
+		p, ok := byAddr[addr]
+		if !ok {
+			continue
+		}
+		selected = append(selected, p)
+		delete(byAddr, addr)
+	}
+	return selected
+}
+
+// preferPeers moves the preferred peers to the front of the slice, keeping
+// the relative order of the peers otherwise.
+func preferPeers(peers []Peer, prefer func(peer string) bool) {
+	preferred := make(map[Peer]bool, len(peers))
+	for _, p := range peers {
+		preferred[p] = prefer(p.Addr())
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		return preferred[peers[i]] && !preferred[peers[j]]
+	})
+}
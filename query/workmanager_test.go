@@ -3,6 +3,7 @@ package query
 import (
 	"fmt"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -64,16 +65,16 @@ func (p *mockPeerRanking) Reward(peer string) {
 }
 
 // startWorkManager starts a new workmanager with the given number of mock
-// workers.
-func startWorkManager(t *testing.T, numWorkers int) (WorkManager,
-	[]*mockWorker) {
+// workers. Any config modifiers given are applied before it is started.
+func startWorkManager(t *testing.T, numWorkers int,
+	modifiers ...func(*Config)) (WorkManager, []*mockWorker) {
 
 	// We set up a custom NewWorker closure for the WorkManager, such that
 	// we can start mockWorkers when it is called.
 	workerChan := make(chan *mockWorker)
 
 	peerChan := make(chan Peer)
-	wm := NewWorkManager(&Config{
+	cfg := &Config{
 		ConnectedPeers: func() (<-chan Peer, func(), error) {
 			return peerChan, func() {}, nil
 		},
@@ -87,7 +88,11 @@ func startWorkManager(t *testing.T, numWorkers int) (WorkManager,
 			return m
 		},
 		Ranking: &mockPeerRanking{},
-	})
+	}
+	for _, modify := range modifiers {
+		modify(cfg)
+	}
+	wm := NewWorkManager(cfg)
 
 	// Start the work manager.
 	wm.Start()
@@ -476,3 +481,387 @@ func TestWorkManagerWorkRankingScheduling(t *testing.T) {
 		}
 	}
 }
+
+// TestWorkManagerPreferPeer checks that queries are given to the peers they
+// prefer ahead of the peer ranking, falling back to the ranking otherwise.
+func TestWorkManagerPreferPeer(t *testing.T) {
+	const numWorkers = 8
+
+	workMgr, workers := startWorkManager(t, numWorkers)
+
+	require.IsType(t, workMgr, &peerWorkManager{})
+	wm := workMgr.(*peerWorkManager) //nolint:forcetypeassert
+
+	// Set up the ranking to prioritize lower numbered workers.
+	wm.cfg.Ranking.(*mockPeerRanking).less = func(i, j string) bool {
+		return i < j
+	}
+
+	// The first two queries prefer the highest numbered workers, the
+	// rest have no preference.
+	preferHigh := func(peer string) bool {
+		return peer == "mock5" || peer == "mock7"
+	}
+	queries := []*Request{
+		{PreferPeer: preferHigh},
+		{PreferPeer: preferHigh},
+		{},
+		{},
+	}
+	_ = wm.Query(queries)
+
+	for i, wk := range []int{5, 7, 0, 1} {
+		select {
+		case job := <-workers[wk].nextJob:
+			require.Equal(t, uint64(i), job.index)
+
+		case <-time.After(time.Second):
+			t.Fatalf("job %v not scheduled on worker %v", i, wk)
+		}
+	}
+}
+
+// TestWorkManagerAllowPeer checks that queries are only given to the peers
+// they allow while any of those are connected, waiting for one of them to be
+// free without holding back the queries behind them, and to any peer
+// otherwise.
+func TestWorkManagerAllowPeer(t *testing.T) {
+	const numWorkers = 4
+
+	workMgr, workers := startWorkManager(t, numWorkers)
+
+	require.IsType(t, workMgr, &peerWorkManager{})
+	wm := workMgr.(*peerWorkManager) //nolint:forcetypeassert
+
+	// Set up the ranking to prioritize lower numbered workers.
+	wm.cfg.Ranking.(*mockPeerRanking).less = func(i, j string) bool {
+		return i < j
+	}
+
+	// The first two queries are only allowed on the same worker, while
+	// the last allows only a peer that isn't connected.
+	allowTwo := func(peer string) bool {
+		return peer == "mock2"
+	}
+	allowGone := func(peer string) bool {
+		return peer == "mock9"
+	}
+	queries := []*Request{
+		{AllowPeer: allowTwo},
+		{AllowPeer: allowTwo},
+		{AllowPeer: allowGone},
+	}
+	_ = wm.Query(queries)
+
+	var job *queryJob
+	select {
+	case job = <-workers[2].nextJob:
+		require.Equal(t, uint64(0), job.index)
+
+	case <-time.After(time.Second):
+		t.Fatalf("job 0 not scheduled on worker 2")
+	}
+
+	// The second query waits for its worker to be free, rather than
+	// going to any of the free ones, while the last one, with none of
+	// the peers it allows connected, isn't held back behind it.
+	select {
+	case job := <-workers[0].nextJob:
+		require.Equal(t, uint64(2), job.index)
+
+	case <-time.After(time.Second):
+		t.Fatalf("job 2 not scheduled on worker 0")
+	}
+	for i, wk := range workers {
+		select {
+		case job := <-wk.nextJob:
+			t.Fatalf("job %v scheduled on worker %v", job.index, i)
+
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	workers[2].results <- &jobResult{job: job}
+
+	select {
+	case job := <-workers[2].nextJob:
+		require.Equal(t, uint64(1), job.index)
+
+	case <-time.After(time.Second):
+		t.Fatalf("job 1 not scheduled on worker 2")
+	}
+}
+
+// TestWorkManagerSelectPeers checks that queries are given to the peers
+// they select, in the order selected, and are held back while none of the
+// free peers are selected, without holding back the queries behind them.
+func TestWorkManagerSelectPeers(t *testing.T) {
+	const numWorkers = 4
+
+	workMgr, workers := startWorkManager(t, numWorkers)
+
+	require.IsType(t, workMgr, &peerWorkManager{})
+	wm := workMgr.(*peerWorkManager) //nolint:forcetypeassert
+
+	// Set up the ranking to prioritize lower numbered workers, which the
+	// queries reverse, never selecting the first worker.
+	wm.cfg.Ranking.(*mockPeerRanking).less = func(i, j string) bool {
+		return i < j
+	}
+	reverse := func(peers []string) []string {
+		var selected []string
+		for i := len(peers) - 1; i >= 0; i-- {
+			if peers[i] != "mock0" {
+				selected = append(selected, peers[i])
+			}
+		}
+		return selected
+	}
+
+	queries := []*Request{
+		{SelectPeers: reverse},
+		{SelectPeers: reverse},
+		{SelectPeers: reverse},
+		{SelectPeers: reverse},
+	}
+	_ = wm.Query(queries)
+
+	for i, wk := range []int{3, 2, 1} {
+		select {
+		case job := <-workers[wk].nextJob:
+			require.Equal(t, uint64(i), job.index)
+
+		case <-time.After(time.Second):
+			t.Fatalf("job %v not scheduled on worker %v", i, wk)
+		}
+	}
+
+	// The last query isn't given to the only free worker, but it doesn't
+	// hold back an unrelated query scheduled after it.
+	select {
+	case job := <-workers[0].nextJob:
+		t.Fatalf("job %v scheduled on worker 0", job.index)
+
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = wm.Query([]*Request{{}})
+
+	select {
+	case job := <-workers[0].nextJob:
+		require.Equal(t, uint64(4), job.index)
+
+	case <-time.After(time.Second):
+		t.Fatalf("job 4 not scheduled on worker 0")
+	}
+}
+
+// TestWorkManagerPeerGroup checks that queries asking to be spread across
+// network groups are given to peers in the least busy group ahead of the
+// peer ranking.
+func TestWorkManagerPeerGroup(t *testing.T) {
+	const numWorkers = 4
+
+	workMgr, workers := startWorkManager(t, numWorkers)
+
+	require.IsType(t, workMgr, &peerWorkManager{})
+	wm := workMgr.(*peerWorkManager) //nolint:forcetypeassert
+
+	// Set up the ranking to prioritize lower numbered workers, all but
+	// the last of which are in the same group.
+	wm.cfg.Ranking.(*mockPeerRanking).less = func(i, j string) bool {
+		return i < j
+	}
+	peerGroup := func(peer string) string {
+		if peer == "mock3" {
+			return "b"
+		}
+		return "a"
+	}
+
+	queries := []*Request{
+		{PeerGroup: peerGroup},
+		{PeerGroup: peerGroup},
+		{PeerGroup: peerGroup},
+	}
+	_ = wm.Query(queries)
+
+	for i, wk := range []int{0, 3, 1} {
+		select {
+		case job := <-workers[wk].nextJob:
+			require.Equal(t, uint64(i), job.index)
+
+		case <-time.After(time.Second):
+			t.Fatalf("job %v not scheduled on worker %v", i, wk)
+		}
+	}
+}
+
+// TestWorkManagerOnResult checks that the work manager reports the outcome
+// of each attempt at a query, along with the time the peer took.
+func TestWorkManagerOnResult(t *testing.T) {
+	wm, workers := startWorkManager(t, 1)
+	wk := workers[0]
+
+	type result struct {
+		peer    string
+		elapsed time.Duration
+		err     error
+	}
+	results := make(chan result, 2)
+	errChan := wm.Query([]*Request{{
+		OnResult: func(peer string, elapsed time.Duration,
+			err error) {
+
+			results <- result{peer, elapsed, err}
+		},
+	}})
+
+	// The first attempt times out, and the second succeeds.
+	for _, jobErr := range []error{ErrQueryTimeout, nil} {
+		var job *queryJob
+		select {
+		case job = <-wk.nextJob:
+		case <-time.After(time.Second):
+			t.Fatalf("job not scheduled")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		select {
+		case wk.results <- &jobResult{job: job, err: jobErr}:
+		case <-time.After(time.Second):
+			t.Fatalf("result not handled")
+		}
+
+		select {
+		case r := <-results:
+			require.Equal(t, "mock0", r.peer)
+			require.GreaterOrEqual(
+				t, r.elapsed, 20*time.Millisecond,
+			)
+			require.Equal(t, jobErr, r.err)
+		case <-time.After(time.Second):
+			t.Fatalf("result not reported")
+		}
+	}
+
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("nothing received on errChan")
+	}
+}
+
+// TestWorkManagerMaxWorkers tests that no more than the configured maximum
+// number of workers are given queries at the same time.
+func TestWorkManagerMaxWorkers(t *testing.T) {
+	const (
+		numQueries = 20
+		numWorkers = 5
+		maxWorkers = 2
+	)
+
+	wm, workers := startWorkManager(t, numWorkers, func(cfg *Config) {
+		cfg.MaxWorkers = maxWorkers
+	})
+
+	var queries []*Request
+	for i := 0; i < numQueries; i++ {
+		queries = append(queries, &Request{})
+	}
+
+	// Each worker holds on to its job for a while before responding,
+	// keeping track of how many jobs are in flight at once.
+	var (
+		mtx         sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	for _, wk := range workers {
+		wk := wk
+		go func() {
+			for job := range wk.nextJob {
+				mtx.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mtx.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mtx.Lock()
+				inFlight--
+				mtx.Unlock()
+
+				wk.results <- &jobResult{job: job}
+			}
+		}()
+	}
+
+	errChan := wm.Query(queries)
+	select {
+	case err := <-errChan:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("batch did not finish")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, maxWorkers, maxInFlight)
+}
+
+// TestWorkManagerCancelRequest tests that a query whose own request is
+// canceled no longer holds up its batch, without canceling the rest of it.
+func TestWorkManagerCancelRequest(t *testing.T) {
+	t.Parallel()
+
+	wm, workers := startWorkManager(t, 1)
+	wk := workers[0]
+
+	var results []error
+	onResult := func(_ string, _ time.Duration, err error) {
+		results = append(results, err)
+	}
+	cancel := make(chan struct{})
+	queries := []*Request{
+		{OnResult: onResult, Cancel: cancel},
+		{OnResult: onResult},
+	}
+	errChan := wm.Query(queries)
+	close(cancel)
+
+	for _, err := range []error{ErrRequestCanceled, nil} {
+		var job *queryJob
+		select {
+		case job = <-wk.nextJob:
+		case <-errChan:
+			t.Fatalf("did not expect on errChan")
+		case <-time.After(time.Second):
+			t.Fatalf("next job not received")
+		}
+
+		select {
+		case wk.results <- &jobResult{job: job, err: err}:
+		case <-time.After(time.Second):
+			t.Fatalf("result not handled")
+		}
+	}
+
+	// The batch finishes once the other query is answered, and only its
+	// result is reported.
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("expected no error, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("nothing received on errChan")
+	}
+	if len(results) != 1 || results[0] != nil {
+		t.Fatalf("expected a single successful result, got %v",
+			results)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/ltcmweb/ltcd/ltcutil"
 	"github.com/ltcmweb/ltcd/ltcutil/gcs"
 	"github.com/ltcmweb/ltcd/ltcutil/gcs/builder"
+	"github.com/ltcmweb/ltcd/peer"
 	"github.com/ltcmweb/ltcd/wire"
 	"github.com/ltcmweb/neutrino/cache/lru"
 	"github.com/ltcmweb/neutrino/filterdb"
@@ -414,3 +415,32 @@ func TestBlockCache(t *testing.T) {
 	b := blocks[0]
 	fetchAndAssertPeersQueried(*b.Hash())
 }
+
+// TestWaitRateLimit tests that a message queued to each peer by
+// queryAllPeers waits for the peer's rate limit to allow it, and that it's
+// dropped if the peer's query ends first.
+func TestWaitRateLimit(t *testing.T) {
+	t.Parallel()
+
+	s := &ChainService{
+		quit: make(chan struct{}),
+		rateLimiter: query.NewPeerRateLimiter(
+			20, 1, func(wire.Message) bool { return true },
+		),
+	}
+	p, err := peer.NewOutboundPeer(&peer.Config{}, "10.0.0.1:9333")
+	require.NoError(t, err)
+	sp := &ServerPeer{Peer: p}
+	msg := wire.NewMsgGetData()
+
+	// The first message goes out right away, and the next once the rate
+	// limit allows it.
+	quit := make(chan struct{})
+	start := time.Now()
+	require.True(t, s.waitRateLimit(sp, msg, quit, quit))
+	require.True(t, s.waitRateLimit(sp, msg, quit, quit))
+	require.GreaterOrEqual(t, time.Since(start), 45*time.Millisecond)
+
+	close(quit)
+	require.False(t, s.waitRateLimit(sp, msg, quit, quit))
+}
@@ -96,10 +96,11 @@ type rescanOptions struct {
 
 	endBlock *headerfs.BlockStamp
 
-	watchAddrs  []ltcutil.Address
-	watchInputs []InputWithScript
-	watchList   [][]byte
-	txIdx       uint32
+	watchAddrs   []ltcutil.Address
+	watchInputs  []InputWithScript
+	watchPegouts [][]byte
+	watchList    [][]byte
+	txIdx        uint32
 
 	update <-chan *updateOptions
 	quit   <-chan struct{}
@@ -186,6 +187,18 @@ func WatchAddrs(watchAddrs ...ltcutil.Address) RescanOption {
 	}
 }
 
+// WatchPegoutScripts specifies the output scripts of mweb pegouts to watch
+// for. Pegouts are paid by the hogex, the last transaction of the block,
+// whose outputs are matched by the block filter like any other. Each call
+// to this function adds to the list of scripts being watched rather than
+// replacing the list. Each time the hogex pays to one of the scripts, the
+// outpoint is added to the WatchOutPoints list.
+func WatchPegoutScripts(scripts ...[]byte) RescanOption {
+	return func(ro *rescanOptions) {
+		ro.watchPegouts = append(ro.watchPegouts, scripts...)
+	}
+}
+
 // InputWithScript couples an previous outpoint along with its input script.
 // We'll use the prev script to match the filter itself, but then scan for the
 // particular outpoint when we need to make a notification decision.
@@ -345,6 +358,7 @@ func newRescanState(chain ChainSource, options ...RescanOption) (*rescanState,
 	for _, input := range ro.watchInputs {
 		ro.watchList = append(ro.watchList, input.PkScript)
 	}
+	ro.watchList = append(ro.watchList, ro.watchPegouts...)
 
 	// Check that we have either an end block or a quit channel.
 	if ro.endBlock != nil {
@@ -625,6 +639,10 @@ rescanLoop:
 
 					rs.handleBlockDisconnected(ntfn)
 
+				// The mweb sync's follow up on a block
+				// has nothing for the rescan.
+				case *blockntfns.MwebConnected:
+
 				default:
 					log.Warnf("Received unhandled block "+
 						"notification: %T", ntfn)
@@ -1044,6 +1062,9 @@ func extractBlockMatches(chain ChainSource, ro *rescanOptions,
 		if err != nil {
 			return nil, err
 		}
+		if ro.paysWatchedPegout(tx) {
+			pays = true
+		}
 
 		if pays {
 			relevant = true
@@ -1351,6 +1372,55 @@ txOutLoop:
 	return anyMatchingOutputs, nil
 }
 
+// MwebPegoutOutputs returns the indices of the outputs of the transaction
+// that are mweb pegouts. Only the hogex has pegouts, in every output after
+// the first, which pays to the HogAddr.
+func MwebPegoutOutputs(tx *wire.MsgTx) []uint32 {
+	if !tx.IsHogEx {
+		return nil
+	}
+
+	var outputs []uint32
+	for outIdx := 1; outIdx < len(tx.TxOut); outIdx++ {
+		outputs = append(outputs, uint32(outIdx))
+	}
+	return outputs
+}
+
+// paysWatchedPegout returns whether the transaction is a hogex with a pegout
+// paying to a watched pegout script. If that is the case, this also updates
+// the filter to watch the pegout going forward.
+func (ro *rescanOptions) paysWatchedPegout(tx *ltcutil.Tx) bool {
+	anyMatchingOutputs := false
+
+	for _, outIdx := range MwebPegoutOutputs(tx.MsgTx()) {
+		pkScript := tx.MsgTx().TxOut[outIdx].PkScript
+
+		for _, script := range ro.watchPegouts {
+			if !bytes.Equal(pkScript, script) {
+				continue
+			}
+
+			anyMatchingOutputs = true
+
+			// Watch the pegout for the event in the future that
+			// it's spent.
+			ro.watchInputs = append(ro.watchInputs, InputWithScript{
+				PkScript: pkScript,
+				OutPoint: wire.OutPoint{
+					Hash:  *tx.Hash(),
+					Index: outIdx,
+				},
+			})
+			ro.watchList = append(ro.watchList, pkScript)
+
+			break
+		}
+	}
+
+	return anyMatchingOutputs
+}
+
 // Rescan is an object that represents a long-running rescan/notification
 // client with updateable filters. It's meant to be close to a drop-in
 // replacement for the btcd rescan and notification functionality used in
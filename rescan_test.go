@@ -10,12 +10,14 @@ import (
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/ltcmweb/ltcd/btcjson"
 	"github.com/ltcmweb/ltcd/chaincfg"
 	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
 	"github.com/ltcmweb/ltcd/ltcutil"
 	"github.com/ltcmweb/ltcd/ltcutil/gcs"
 	"github.com/ltcmweb/ltcd/ltcutil/gcs/builder"
 	"github.com/ltcmweb/ltcd/rpcclient"
+	"github.com/ltcmweb/ltcd/txscript"
 	"github.com/ltcmweb/ltcd/wire"
 	"github.com/ltcmweb/neutrino/blockntfns"
 	"github.com/ltcmweb/neutrino/headerfs"
@@ -666,3 +668,117 @@ func TestRescanRetryBlocksAfterCatchingUp(t *testing.T) {
 	ctx.assertFilterQueried(block3.Hash)
 	ctx.recvBlockConnected(block3)
 }
+
+// TestRescanPegoutMatch tests that a watched pegout script matches the block
+// filter of a block whose hogex pays to it, and that only the hogex is then
+// extracted as relevant.
+func TestRescanPegoutMatch(t *testing.T) {
+	t.Parallel()
+
+	makeScript := func(version byte, data []byte) []byte {
+		script, err := txscript.NewScriptBuilder().
+			AddOp(version).AddData(data).Script()
+		if err != nil {
+			t.Fatalf("unable to build script: %v", err)
+		}
+		return script
+	}
+	hogAddr := makeScript(
+		txscript.MwebHogAddrWitnessVersion+txscript.OP_1-1,
+		make([]byte, 32),
+	)
+	pegoutScript := makeScript(txscript.OP_0, []byte{19: 0x01})
+	otherScript := makeScript(txscript.OP_0, []byte{19: 0x02})
+
+	// A regular transaction also pays to the pegout script, which isn't
+	// a pegout.
+	regularTx := &wire.MsgTx{
+		Version: 2,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: 1},
+		}},
+		TxOut: []*wire.TxOut{{Value: 1, PkScript: pegoutScript}},
+	}
+	hogex := &wire.MsgTx{
+		Version: 2,
+		TxIn: []*wire.TxIn{{
+			PreviousOutPoint: wire.OutPoint{Index: 0},
+		}},
+		TxOut: []*wire.TxOut{
+			{Value: 1000, PkScript: hogAddr},
+			{Value: 10, PkScript: otherScript},
+			{Value: 20, PkScript: pegoutScript},
+		},
+		IsHogEx: true,
+	}
+	if outputs := MwebPegoutOutputs(hogex); !reflect.DeepEqual(
+		outputs, []uint32{1, 2}) {
+
+		t.Fatalf("unexpected pegout outputs %v", outputs)
+	}
+	if outputs := MwebPegoutOutputs(regularTx); outputs != nil {
+		t.Fatalf("unexpected pegout outputs %v", outputs)
+	}
+
+	chain := newMockChainSource(1)
+	header := wire.BlockHeader{
+		PrevBlock: *chain.ChainParams().GenesisHash,
+	}
+	msgBlock := &wire.MsgBlock{
+		Header:       header,
+		Transactions: []*wire.MsgTx{{}, regularTx, hogex},
+	}
+	blockHash := header.BlockHash()
+	chain.blocks[blockHash] = ltcutil.NewBlock(msgBlock)
+
+	filter, err := builder.BuildBasicFilter(msgBlock, nil)
+	if err != nil {
+		t.Fatalf("unable to build filter: %v", err)
+	}
+
+	var received []*ltcutil.Tx
+	ro := defaultRescanOptions()
+	WatchPegoutScripts(pegoutScript)(ro)
+	NotificationHandlers(rpcclient.NotificationHandlers{
+		OnRecvTx: func(tx *ltcutil.Tx, _ *btcjson.BlockDetails) {
+			received = append(received, tx)
+		},
+	})(ro)
+	ro.watchList = append(ro.watchList, ro.watchPegouts...)
+
+	matched, err := matchBlockFilter(ro, filter, &blockHash)
+	if err != nil {
+		t.Fatalf("unable to match filter: %v", err)
+	}
+	if !matched {
+		t.Fatal("filter didn't match watched pegout script")
+	}
+
+	relevant, err := extractBlockMatches(chain, ro, &headerfs.BlockStamp{
+		Hash:   blockHash,
+		Height: 1,
+	}, filter)
+	if err != nil {
+		t.Fatalf("unable to extract block matches: %v", err)
+	}
+	if len(relevant) != 1 || !relevant[0].MsgTx().IsHogEx {
+		t.Fatalf("expected only the hogex to be relevant, got %v",
+			spew.Sdump(relevant))
+	}
+	if len(received) != 1 || received[0] != relevant[0] {
+		t.Fatalf("expected the hogex to be notified, got %v",
+			spew.Sdump(received))
+	}
+
+	// The pegout is now watched for spends.
+	expectedInput := InputWithScript{
+		OutPoint: wire.OutPoint{Hash: hogex.TxHash(), Index: 2},
+		PkScript: pegoutScript,
+	}
+	if !reflect.DeepEqual(ro.watchInputs,
+		[]InputWithScript{expectedInput}) {
+
+		t.Fatalf("unexpected watched inputs %v",
+			spew.Sdump(ro.watchInputs))
+	}
+}